@@ -0,0 +1,102 @@
+package anthropic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+)
+
+// MessagesWriter writes chat responses as responses of the Messages API,
+// streaming them as events.
+type MessagesWriter struct {
+	gin.ResponseWriter
+	Stream   bool
+	ID       string
+	Messages *MessageStream
+}
+
+func (w *MessagesWriter) writeError(data []byte) (int, error) {
+	var serr api.StatusError
+	if err := json.Unmarshal(data, &serr); err != nil {
+		return 0, err
+	}
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w.ResponseWriter).Encode(NewError(w.ResponseWriter.Status(), serr.Error())); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (w *MessagesWriter) writeResponse(data []byte) (int, error) {
+	var r api.ChatResponse
+	if err := json.Unmarshal(data, &r); err != nil {
+		return 0, err
+	}
+	if w.Stream {
+		w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
+		for _, e := range w.Messages.Events(r) {
+			d, err := json.Marshal(e)
+			if err != nil {
+				return 0, err
+			}
+			if _, err = w.ResponseWriter.Write([]byte(fmt.Sprintf("event: %s\ndata: %s\n\n", e.Type, d))); err != nil {
+				return 0, err
+			}
+		}
+		return len(data), nil
+	}
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w.ResponseWriter).Encode(ToMessagesResponse(w.ID, r)); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (w *MessagesWriter) Write(data []byte) (int, error) {
+	if w.ResponseWriter.Status() != http.StatusOK {
+		return w.writeError(data)
+	}
+	return w.writeResponse(data)
+}
+
+// MessagesMiddleware converts requests to the Messages API to chat
+// requests, and writes their responses as the Messages API does.
+func MessagesMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req MessagesRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+		if len(req.Messages) == 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, "messages: at least one message is required"))
+			return
+		}
+		var b bytes.Buffer
+		chatReq, err := FromMessagesRequest(req)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+		if err := json.NewEncoder(&b).Encode(chatReq); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+		c.Request.Body = io.NopCloser(&b)
+		id := randomID("msg_")
+		w := &MessagesWriter{
+			ResponseWriter: c.Writer,
+			Stream:         req.Stream,
+			ID:             id,
+			Messages:       NewMessageStream(id),
+		}
+		c.Writer = w
+		c.Next()
+	}
+}
@@ -0,0 +1,560 @@
+// Package anthropic translates requests to the Anthropic Messages API to
+// chat requests and their responses back, so clients of the Messages API
+// can use local models.
+package anthropic
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math/rand"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/goobla/goobla/api"
+)
+
+// MessagesRequest is a request to the Messages API.
+type MessagesRequest struct {
+	Model         string          `json:"model"`
+	MaxTokens     int             `json:"max_tokens"`
+	System        json.RawMessage `json:"system"`
+	Messages      []Message       `json:"messages"`
+	Stream        bool            `json:"stream"`
+	Temperature   *float64        `json:"temperature"`
+	TopP          *float64        `json:"top_p"`
+	TopK          *int            `json:"top_k"`
+	StopSequences []string        `json:"stop_sequences"`
+	Tools         []Tool          `json:"tools"`
+	ToolChoice    *ToolChoice     `json:"tool_choice"`
+	Thinking      *Thinking       `json:"thinking"`
+}
+
+// Message is a message of a [MessagesRequest]. Its content is a string or a
+// list of [ContentBlock].
+type Message struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+type Tool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type ToolChoice struct {
+	Type                   string `json:"type"`
+	DisableParallelToolUse bool   `json:"disable_parallel_tool_use"`
+}
+
+type Thinking struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens"`
+}
+
+// ContentBlock is a block of the content of a message: text, an image, the
+// model's thinking, a tool it used or the result of one.
+type ContentBlock struct {
+	Type string `json:"type"`
+
+	// text
+	Text string `json:"text,omitempty"`
+
+	// thinking
+	Thinking  string `json:"thinking,omitempty"`
+	Signature string `json:"signature,omitempty"`
+
+	// image
+	Source *ImageSource `json:"source,omitempty"`
+
+	// tool_use
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+
+	// tool_result, whose content is a string or a list of text blocks
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   json.RawMessage `json:"content,omitempty"`
+	IsError   bool            `json:"is_error,omitempty"`
+}
+
+// MarshalJSON includes the fields of the block's type even when they're
+// empty, such as the text of a block that was just started.
+func (b ContentBlock) MarshalJSON() ([]byte, error) {
+	switch b.Type {
+	case "text":
+		return json.Marshal(struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		}{b.Type, b.Text})
+	case "thinking":
+		return json.Marshal(struct {
+			Type      string `json:"type"`
+			Thinking  string `json:"thinking"`
+			Signature string `json:"signature"`
+		}{b.Type, b.Thinking, b.Signature})
+	case "tool_use":
+		input := b.Input
+		if len(input) == 0 {
+			input = json.RawMessage(`{}`)
+		}
+		return json.Marshal(struct {
+			Type  string          `json:"type"`
+			ID    string          `json:"id"`
+			Name  string          `json:"name"`
+			Input json.RawMessage `json:"input"`
+		}{b.Type, b.ID, b.Name, input})
+	}
+
+	type block ContentBlock
+	return json.Marshal(block(b))
+}
+
+type ImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+// MessagesResponse is a response of the Messages API.
+type MessagesResponse struct {
+	ID           string         `json:"id"`
+	Type         string         `json:"type"`
+	Role         string         `json:"role"`
+	Model        string         `json:"model"`
+	Content      []ContentBlock `json:"content"`
+	StopReason   *string        `json:"stop_reason"`
+	StopSequence *string        `json:"stop_sequence"`
+	Usage        Usage          `json:"usage"`
+}
+
+type Usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// Event is an event of a streamed [MessagesResponse]. Only the fields of
+// the event's type are set.
+type Event struct {
+	Type         string            `json:"type"`
+	Message      *MessagesResponse `json:"message,omitempty"`
+	Index        *int              `json:"index,omitempty"`
+	ContentBlock *ContentBlock     `json:"content_block,omitempty"`
+	Delta        any               `json:"delta,omitempty"`
+	Usage        *Usage            `json:"usage,omitempty"`
+}
+
+// Delta is the delta of a content_block_delta event.
+type Delta struct {
+	Type        string `json:"type"`
+	Text        string `json:"text,omitempty"`
+	Thinking    string `json:"thinking,omitempty"`
+	PartialJSON string `json:"partial_json,omitempty"`
+}
+
+// MessageDelta is the delta of a message_delta event.
+type MessageDelta struct {
+	StopReason   string  `json:"stop_reason"`
+	StopSequence *string `json:"stop_sequence"`
+}
+
+type ErrorResponse struct {
+	Type  string `json:"type"`
+	Error Error  `json:"error"`
+}
+
+type Error struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// NewError returns the error response for an HTTP status code.
+func NewError(code int, message string) ErrorResponse {
+	var etype string
+	switch code {
+	case http.StatusBadRequest:
+		etype = "invalid_request_error"
+	case http.StatusNotFound:
+		etype = "not_found_error"
+	case http.StatusTooManyRequests:
+		etype = "rate_limit_error"
+	case http.StatusServiceUnavailable:
+		etype = "overloaded_error"
+	default:
+		etype = "api_error"
+	}
+	return ErrorResponse{Type: "error", Error: Error{Type: etype, Message: message}}
+}
+
+func randomID(prefix string) string {
+	const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	b := make([]byte, 24)
+	for i := range b {
+		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+	}
+	return prefix + string(b)
+}
+
+// MessageStream builds a [MessagesResponse] from the responses of a chat,
+// and the events to stream it with. Text and thinking are streamed to the
+// content block they're part of, which is stopped once the model moves on
+// to something else, and tool calls to tool_use blocks of their own.
+type MessageStream struct {
+	response MessagesResponse
+	started  bool
+
+	// open is the index of the content block text is streamed to, or -1
+	open int
+
+	// calls maps the indices of tool calls to their content blocks, and
+	// stopped is whether a block was stopped
+	calls   map[int]int
+	stopped map[int]bool
+}
+
+// NewMessageStream returns a stream for the message id.
+func NewMessageStream(id string) *MessageStream {
+	return &MessageStream{
+		response: MessagesResponse{
+			ID:      id,
+			Type:    "message",
+			Role:    "assistant",
+			Content: []ContentBlock{},
+		},
+		open:    -1,
+		calls:   make(map[int]int),
+		stopped: make(map[int]bool),
+	}
+}
+
+// Response returns the message built so far.
+func (s *MessageStream) Response() MessagesResponse {
+	r := s.response
+	r.Content = slices.Clone(r.Content)
+	return r
+}
+
+// Events adds the chat response r to the message, returning the events for
+// it.
+func (s *MessageStream) Events(r api.ChatResponse) []Event {
+	var events []Event
+	emit := func(e Event) {
+		events = append(events, e)
+	}
+
+	if s.response.Model == "" {
+		s.response.Model = r.Model
+	}
+
+	if !s.started {
+		s.started = true
+		start := s.Response()
+		emit(Event{Type: "message_start", Message: &start})
+		emit(Event{Type: "ping"})
+	}
+
+	if r.Message.Thinking != "" {
+		s.text("thinking", r.Message.Thinking, emit)
+	}
+
+	if r.Message.Content != "" {
+		s.text("text", r.Message.Content, emit)
+	}
+
+	for _, d := range r.Message.ToolCallDeltas {
+		i := s.call(d.Index, d.Name, emit)
+		if d.Arguments != "" {
+			s.response.Content[i].Input = append(s.response.Content[i].Input, d.Arguments...)
+			emit(Event{Type: "content_block_delta", Index: &i, Delta: Delta{Type: "input_json_delta", PartialJSON: d.Arguments}})
+		}
+	}
+
+	for _, tc := range r.Message.ToolCalls {
+		args, err := json.Marshal(tc.Function.Arguments)
+		if err != nil {
+			slog.Error("could not marshall function arguments to json", "error", err)
+			continue
+		}
+
+		i := s.call(tc.Function.Index, tc.Function.Name, emit)
+		if len(s.response.Content[i].Input) == 0 {
+			emit(Event{Type: "content_block_delta", Index: &i, Delta: Delta{Type: "input_json_delta", PartialJSON: string(args)}})
+		}
+		s.response.Content[i].Input = args
+		s.stop(i, emit)
+	}
+
+	if r.Done {
+		s.stop(s.open, emit)
+
+		// calls that were started but not completed, whose input may not
+		// be valid
+		for _, i := range slices.Sorted(maps.Values(s.calls)) {
+			if !s.stopped[i] {
+				s.response.Content[i].Input = nil
+				s.stop(i, emit)
+			}
+		}
+
+		reason := "end_turn"
+		switch {
+		case len(s.calls) > 0:
+			reason = "tool_use"
+		case r.DoneReason == "length":
+			reason = "max_tokens"
+		}
+
+		s.response.StopReason = &reason
+		s.response.Usage = Usage{InputTokens: r.PromptEvalCount, OutputTokens: r.EvalCount}
+
+		usage := s.response.Usage
+		emit(Event{Type: "message_delta", Delta: MessageDelta{StopReason: reason}, Usage: &usage})
+		emit(Event{Type: "message_stop"})
+	}
+
+	return events
+}
+
+// text adds text to the content block of kind, which is text or thinking,
+// starting a block if the last one is of another kind.
+func (s *MessageStream) text(kind, text string, emit func(Event)) {
+	if s.open < 0 || s.response.Content[s.open].Type != kind {
+		s.stop(s.open, emit)
+		s.open = s.start(ContentBlock{Type: kind}, emit)
+	}
+
+	i := s.open
+	if kind == "text" {
+		s.response.Content[i].Text += text
+		emit(Event{Type: "content_block_delta", Index: &i, Delta: Delta{Type: "text_delta", Text: text}})
+	} else {
+		s.response.Content[i].Thinking += text
+		emit(Event{Type: "content_block_delta", Index: &i, Delta: Delta{Type: "thinking_delta", Thinking: text}})
+	}
+}
+
+// call returns the content block of the tool call with the index, starting
+// it if it's new.
+func (s *MessageStream) call(index int, name string, emit func(Event)) int {
+	if i, ok := s.calls[index]; ok {
+		return i
+	}
+
+	s.stop(s.open, emit)
+	i := s.start(ContentBlock{Type: "tool_use", ID: randomID("toolu_"), Name: name}, emit)
+	s.calls[index] = i
+	return i
+}
+
+// start adds block to the content, returning its index.
+func (s *MessageStream) start(block ContentBlock, emit func(Event)) int {
+	i := len(s.response.Content)
+	s.response.Content = append(s.response.Content, block)
+	emit(Event{Type: "content_block_start", Index: &i, ContentBlock: &block})
+	return i
+}
+
+// stop stops the content block at i if it hasn't been.
+func (s *MessageStream) stop(i int, emit func(Event)) {
+	if i < 0 || s.stopped[i] {
+		return
+	}
+
+	if i == s.open {
+		s.open = -1
+	}
+
+	s.stopped[i] = true
+	emit(Event{Type: "content_block_stop", Index: &i})
+}
+
+// ToMessagesResponse converts a complete chat response to a
+// [MessagesResponse].
+func ToMessagesResponse(id string, r api.ChatResponse) MessagesResponse {
+	s := NewMessageStream(id)
+	s.Events(r)
+	return s.Response()
+}
+
+// FromMessagesRequest converts a request to the Messages API to a chat
+// request.
+func FromMessagesRequest(r MessagesRequest) (*api.ChatRequest, error) {
+	var messages []api.Message
+	if len(r.System) > 0 {
+		system, err := textContent(r.System)
+		if err != nil {
+			return nil, fmt.Errorf("invalid system: %w", err)
+		}
+		messages = append(messages, api.Message{Role: "system", Content: system})
+	}
+
+	for _, m := range r.Messages {
+		msgs, err := fromMessage(m)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msgs...)
+	}
+
+	var tools []api.Tool
+	for _, t := range r.Tools {
+		tool := api.Tool{Type: "function"}
+		tool.Function.Name = t.Name
+		tool.Function.Description = t.Description
+		if len(t.InputSchema) > 0 {
+			if err := json.Unmarshal(t.InputSchema, &tool.Function.Parameters); err != nil {
+				return nil, fmt.Errorf("invalid input_schema for tool %q: %w", t.Name, err)
+			}
+		}
+		tools = append(tools, tool)
+	}
+
+	var parallel *bool
+	if r.ToolChoice != nil {
+		switch r.ToolChoice.Type {
+		case "none":
+			tools = nil
+		case "auto", "any", "tool":
+		default:
+			return nil, fmt.Errorf("tool_choice type %q isn't supported", r.ToolChoice.Type)
+		}
+
+		if r.ToolChoice.DisableParallelToolUse {
+			parallel = new(bool)
+		}
+	}
+
+	options := make(map[string]any)
+	if r.MaxTokens > 0 {
+		options["num_predict"] = r.MaxTokens
+	}
+	if r.Temperature != nil {
+		options["temperature"] = *r.Temperature
+	} else {
+		options["temperature"] = 1.0
+	}
+	if r.TopP != nil {
+		options["top_p"] = *r.TopP
+	}
+	if r.TopK != nil {
+		options["top_k"] = *r.TopK
+	}
+	if len(r.StopSequences) > 0 {
+		options["stop"] = r.StopSequences
+	}
+
+	var think *bool
+	if r.Thinking != nil {
+		think = new(bool)
+		*think = r.Thinking.Type == "enabled"
+	}
+
+	return &api.ChatRequest{
+		Model:    r.Model,
+		Messages: messages,
+		Options:  options,
+		Stream:   &r.Stream,
+		Tools:    tools,
+		Think:    think,
+
+		ParallelToolCalls: parallel,
+	}, nil
+}
+
+// fromMessage converts a message to chat messages. Tool results become
+// messages of their own, following the rest of the content.
+func fromMessage(m Message) ([]api.Message, error) {
+	msg := api.Message{Role: m.Role}
+	if err := json.Unmarshal(m.Content, &msg.Content); err == nil {
+		return []api.Message{msg}, nil
+	}
+
+	var blocks []ContentBlock
+	if err := json.Unmarshal(m.Content, &blocks); err != nil {
+		return nil, errors.New("invalid message content")
+	}
+
+	var sb strings.Builder
+	var results []api.Message
+	for _, b := range blocks {
+		switch b.Type {
+		case "text":
+			sb.WriteString(b.Text)
+		case "thinking":
+			msg.Thinking += b.Thinking
+		case "redacted_thinking":
+		case "image":
+			if b.Source == nil || b.Source.Type != "base64" {
+				return nil, errors.New("only base64 image sources are supported")
+			}
+			img, err := base64.StdEncoding.DecodeString(b.Source.Data)
+			if err != nil {
+				return nil, errors.New("invalid image data")
+			}
+			msg.Images = append(msg.Images, img)
+		case "tool_use":
+			var tc api.ToolCall
+			tc.Function.Name = b.Name
+			tc.Function.Index = len(msg.ToolCalls)
+			if err := json.Unmarshal(b.Input, &tc.Function.Arguments); err != nil {
+				return nil, errors.New("invalid tool_use input")
+			}
+			msg.ToolCalls = append(msg.ToolCalls, tc)
+		case "tool_result":
+			content, err := textContent(b.Content)
+			if err != nil {
+				return nil, fmt.Errorf("invalid tool_result content: %w", err)
+			}
+			if b.IsError {
+				content = "error: " + content
+			}
+			results = append(results, api.Message{Role: "tool", Content: content})
+		default:
+			return nil, fmt.Errorf("content block type %q isn't supported", b.Type)
+		}
+	}
+	msg.Content = sb.String()
+
+	// a message of only tool results doesn't need a message of its own
+	if msg.Content == "" && msg.Thinking == "" && len(msg.Images) == 0 && len(msg.ToolCalls) == 0 && len(results) > 0 {
+		return results, nil
+	}
+
+	return append([]api.Message{msg}, results...), nil
+}
+
+// textContent returns the text of content which is a string or a list of
+// text blocks.
+func textContent(content json.RawMessage) (string, error) {
+	if len(content) == 0 {
+		return "", nil
+	}
+
+	var s string
+	if err := json.Unmarshal(content, &s); err == nil {
+		return s, nil
+	}
+
+	var blocks []ContentBlock
+	if err := json.Unmarshal(content, &blocks); err != nil {
+		return "", errors.New("must be a string or a list of text blocks")
+	}
+
+	var sb strings.Builder
+	for i, b := range blocks {
+		if b.Type != "text" {
+			return "", fmt.Errorf("content block type %q isn't supported", b.Type)
+		}
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString(b.Text)
+	}
+
+	return sb.String(), nil
+}
@@ -0,0 +1,174 @@
+package anthropic
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/goobla/goobla/api"
+)
+
+func TestFromMessagesRequest(t *testing.T) {
+	var req MessagesRequest
+	if err := json.Unmarshal([]byte(`{
+		"model": "test",
+		"max_tokens": 64,
+		"system": [{"type": "text", "text": "Be brief."}],
+		"messages": [
+			{"role": "user", "content": [{"type": "text", "text": "What's the weather in Paris?"}, {"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "aGk="}}]},
+			{"role": "assistant", "content": [{"type": "text", "text": "Let me look."}, {"type": "tool_use", "id": "toolu_1", "name": "get_weather", "input": {"city": "Paris"}}]},
+			{"role": "user", "content": [{"type": "tool_result", "tool_use_id": "toolu_1", "content": [{"type": "text", "text": "sunny"}]}]},
+			{"role": "user", "content": "Thanks!"}
+		],
+		"tools": [{"name": "get_weather", "input_schema": {"type": "object", "required": ["city"], "properties": {"city": {"type": "string"}}}}],
+		"tool_choice": {"type": "auto", "disable_parallel_tool_use": true},
+		"stop_sequences": ["###"],
+		"top_k": 20,
+		"thinking": {"type": "enabled", "budget_tokens": 1024}
+	}`), &req); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := FromMessagesRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []api.Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "What's the weather in Paris?", Images: []api.ImageData{[]byte("hi")}},
+		{Role: "assistant", Content: "Let me look.", ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"city": "Paris"}}}}},
+		{Role: "tool", Content: "sunny"},
+		{Role: "user", Content: "Thanks!"},
+	}
+	if diff := cmp.Diff(want, got.Messages); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	if len(got.Tools) != 1 || got.Tools[0].Function.Name != "get_weather" || got.Tools[0].Function.Parameters.Required[0] != "city" {
+		t.Errorf("unexpected tools %+v", got.Tools)
+	}
+
+	wantOptions := map[string]any{"num_predict": 64, "temperature": 1.0, "top_k": 20, "stop": []string{"###"}}
+	if diff := cmp.Diff(wantOptions, got.Options); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	if got.Think == nil || !*got.Think || got.ParallelToolCalls == nil || *got.ParallelToolCalls {
+		t.Errorf("unexpected think %v and parallel tool calls %v", got.Think, got.ParallelToolCalls)
+	}
+
+	for _, content := range []string{
+		`42`,
+		`[{"type": "image", "source": {"type": "url", "url": "https://example.com/a.png"}}]`,
+		`[{"type": "tool_result", "tool_use_id": "toolu_1", "content": [{"type": "image"}]}]`,
+		`[{"type": "document"}]`,
+	} {
+		req := MessagesRequest{Messages: []Message{{Role: "user", Content: json.RawMessage(content)}}}
+		if _, err := FromMessagesRequest(req); err == nil {
+			t.Errorf("%s: expected an error", content)
+		}
+	}
+}
+
+func TestMessageStream(t *testing.T) {
+	s := NewMessageStream("msg_1")
+
+	var events []string
+	var partial string
+	for _, r := range []api.ChatResponse{
+		{Model: "test", Message: api.Message{Role: "assistant", Thinking: "Checking."}},
+		{Message: api.Message{Role: "assistant", Content: "Let me "}},
+		{Message: api.Message{Role: "assistant", Content: "look."}},
+		{Message: api.Message{Role: "assistant", ToolCallDeltas: []api.ToolCallDelta{{Index: 0, Name: "get_weather", Arguments: `{"city":`}}}},
+		{Message: api.Message{Role: "assistant", ToolCallDeltas: []api.ToolCallDelta{{Index: 0, Arguments: `"Paris"}`}}}},
+		{Message: api.Message{Role: "assistant", ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"city": "Paris"}}}}}},
+		{Message: api.Message{Role: "assistant"}, Done: true, DoneReason: "stop", Metrics: api.Metrics{PromptEvalCount: 3, EvalCount: 5}},
+	} {
+		for _, e := range s.Events(r) {
+			events = append(events, e.Type)
+			if d, ok := e.Delta.(Delta); ok && d.Type == "input_json_delta" {
+				partial += d.PartialJSON
+			}
+		}
+	}
+
+	want := []string{
+		"message_start",
+		"ping",
+		"content_block_start",
+		"content_block_delta",
+		"content_block_stop",
+		"content_block_start",
+		"content_block_delta",
+		"content_block_delta",
+		"content_block_stop",
+		"content_block_start",
+		"content_block_delta",
+		"content_block_delta",
+		"content_block_stop",
+		"message_delta",
+		"message_stop",
+	}
+	if diff := cmp.Diff(want, events); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	if partial != `{"city":"Paris"}` {
+		t.Errorf("unexpected partial json %q", partial)
+	}
+
+	r := s.Response()
+	if r.Model != "test" || r.StopReason == nil || *r.StopReason != "tool_use" || r.Usage != (Usage{InputTokens: 3, OutputTokens: 5}) {
+		t.Errorf("unexpected response %+v", r)
+	}
+
+	if len(r.Content) != 3 {
+		t.Fatalf("expected 3 content blocks, got %d", len(r.Content))
+	}
+
+	if r.Content[0].Thinking != "Checking." || r.Content[1].Text != "Let me look." {
+		t.Errorf("unexpected text %+v", r.Content[:2])
+	}
+
+	if call := r.Content[2]; call.Name != "get_weather" || string(call.Input) != `{"city":"Paris"}` {
+		t.Errorf("unexpected call %+v", call)
+	}
+
+	b, err := json.Marshal(ToMessagesResponse("msg_2", api.ChatResponse{Message: api.Message{Role: "assistant", Content: "Hi"}, Done: true, DoneReason: "length"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	wantMessage := map[string]any{
+		"id":            "msg_2",
+		"type":          "message",
+		"role":          "assistant",
+		"model":         "",
+		"content":       []any{map[string]any{"type": "text", "text": "Hi"}},
+		"stop_reason":   "max_tokens",
+		"stop_sequence": nil,
+		"usage":         map[string]any{"input_tokens": float64(0), "output_tokens": float64(0)},
+	}
+	if diff := cmp.Diff(wantMessage, got); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestNewError(t *testing.T) {
+	b, err := json.Marshal(NewError(http.StatusNotFound, "model not found"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := `{"type":"error","error":{"type":"not_found_error","message":"model not found"}}`; string(b) != want {
+		t.Errorf("got %s, want %s", b, want)
+	}
+}
@@ -17,12 +17,17 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"runtime"
 	"strconv"
 	"time"
@@ -56,6 +61,15 @@ func checkError(resp *http.Response, body []byte) error {
 	return apiError
 }
 
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx with which requests are made with the
+// id, so a generate or chat request can be canceled with [Client.Cancel]
+// while it's in progress.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
 // ClientFromEnvironment creates a new [Client] using configuration from the
 // environment variable GOOBLA_HOST, which points to the network host and
 // port on which the Goobla service is listening. The format of this variable
@@ -66,12 +80,79 @@ func checkError(resp *http.Response, body []byte) error {
 // If the variable is not specified, a default Goobla host and port will be
 // used.
 func ClientFromEnvironment() (*Client, error) {
+	tlsConfig, err := TLSConfig(envconfig.TLSCACert(), envconfig.TLSClientCert(), envconfig.TLSClientKey())
+	if err != nil {
+		return nil, err
+	}
+
+	base := envconfig.Host()
+	client := http.DefaultClient
+	if tlsConfig != nil || base.Scheme == "unix" {
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.TLSClientConfig = tlsConfig
+		if base.Scheme == "unix" {
+			// requests are sent over the socket to a placeholder host
+			path := base.Path
+			tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			}
+			base = &url.URL{Scheme: "http", Host: "localhost"}
+		}
+		client = &http.Client{Transport: tr}
+	}
+
 	return &Client{
-		base: envconfig.Host(),
-		http: http.DefaultClient,
+		base: base,
+		http: client,
 	}, nil
 }
 
+// TLSConfig returns the TLS configuration of a client that trusts the CA
+// certificates in caCert, in addition to the system's, and presents the
+// certificate clientCert with the private key clientKey to servers that
+// require one. It returns nil if all of them are empty, to use the defaults.
+//
+// It's used by [ClientFromEnvironment] with the files set by
+// GOOBLA_TLS_CA_CERT, GOOBLA_TLS_CLIENT_CERT and GOOBLA_TLS_CLIENT_KEY, and
+// can be used to configure the [http.Client] passed to [NewClient].
+func TLSConfig(caCert, clientCert, clientKey string) (*tls.Config, error) {
+	if caCert == "" && clientCert == "" && clientKey == "" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caCert != "" {
+		pem, err := os.ReadFile(caCert)
+		if err != nil {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", caCert)
+		}
+
+		cfg.RootCAs = pool
+	}
+
+	if clientCert != "" || clientKey != "" {
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
 func NewClient(base *url.URL, http *http.Client) *Client {
 	return &Client{
 		base: base,
@@ -87,6 +168,29 @@ func getAuthorizationToken(ctx context.Context, challenge string) (string, error
 	return token, nil
 }
 
+// authorize signs a request to path so the server can authenticate it,
+// adding the timestamp and single-use nonce the signature covers to query.
+// The signature covers the whole query, so it can't be replayed or used for
+// another request.
+func (c *Client) authorize(ctx context.Context, method, path string, query url.Values) (string, error) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	query.Set("ts", now)
+
+	if !envconfig.UseAuth() {
+		// goobla.com only knows the signatures of the method, path and
+		// timestamp
+		return getAuthorizationToken(ctx, fmt.Sprintf("%s,%s?ts=%s", method, path, now))
+	}
+
+	nonce, err := auth.NewNonce(rand.Reader, 16)
+	if err != nil {
+		return "", err
+	}
+	query.Set("nonce", nonce)
+
+	return getAuthorizationToken(ctx, fmt.Sprintf("%s,%s?%s", method, path, query.Encode()))
+}
+
 func (c *Client) do(ctx context.Context, method, path string, reqData, respData any) error {
 	var reqBody io.Reader
 	var data []byte
@@ -111,15 +215,11 @@ func (c *Client) do(ctx context.Context, method, path string, reqData, respData
 
 	var token string
 	if envconfig.UseAuth() || c.base.Hostname() == "goobla.com" {
-		now := strconv.FormatInt(time.Now().Unix(), 10)
-		chal := fmt.Sprintf("%s,%s?ts=%s", method, path, now)
-		token, err = getAuthorizationToken(ctx, chal)
+		q := requestURL.Query()
+		token, err = c.authorize(ctx, method, path, q)
 		if err != nil {
 			return err
 		}
-
-		q := requestURL.Query()
-		q.Set("ts", now)
 		requestURL.RawQuery = q.Encode()
 	}
 
@@ -130,12 +230,19 @@ func (c *Client) do(ctx context.Context, method, path string, reqData, respData
 
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("Accept", "application/json")
+	if id, _ := ctx.Value(requestIDKey{}).(string); id != "" {
+		request.Header.Set("X-Request-Id", id)
+	}
 	request.Header.Set("User-Agent", fmt.Sprintf("goobla/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
 
 	if token != "" {
 		request.Header.Set("Authorization", token)
 	}
 
+	if key := envconfig.APIKey(); key != "" {
+		request.Header.Set("X-Api-Key", key)
+	}
+
 	respObj, err := c.http.Do(request)
 	if err != nil {
 		return err
@@ -177,15 +284,11 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 	var token string
 	if envconfig.UseAuth() || c.base.Hostname() == "goobla.com" {
 		var err error
-		now := strconv.FormatInt(time.Now().Unix(), 10)
-		chal := fmt.Sprintf("%s,%s?ts=%s", method, path, now)
-		token, err = getAuthorizationToken(ctx, chal)
+		q := requestURL.Query()
+		token, err = c.authorize(ctx, method, path, q)
 		if err != nil {
 			return err
 		}
-
-		q := requestURL.Query()
-		q.Set("ts", now)
 		requestURL.RawQuery = q.Encode()
 	}
 
@@ -196,12 +299,19 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("Accept", "application/x-ndjson")
+	if id, _ := ctx.Value(requestIDKey{}).(string); id != "" {
+		request.Header.Set("X-Request-Id", id)
+	}
 	request.Header.Set("User-Agent", fmt.Sprintf("goobla/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
 
 	if token != "" {
 		request.Header.Set("Authorization", token)
 	}
 
+	if key := envconfig.APIKey(); key != "" {
+		request.Header.Set("X-Api-Key", key)
+	}
+
 	response, err := c.http.Do(request)
 	if err != nil {
 		return err
@@ -213,24 +323,26 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 	scanBuf := make([]byte, 0, maxBufferSize)
 	scanner.Buffer(scanBuf, maxBufferSize)
 	for scanner.Scan() {
-		var errorResponse struct {
-			Error string `json:"error,omitempty"`
-		}
+		var errorResponse StreamError
 
 		bts := scanner.Bytes()
 		if err := json.Unmarshal(bts, &errorResponse); err != nil {
 			return fmt.Errorf("unmarshal: %w", err)
 		}
 
-		if errorResponse.Error != "" {
-			return errors.New(errorResponse.Error)
+		if errorResponse.Code != "" {
+			return errorResponse
+		}
+
+		if errorResponse.ErrorMessage != "" {
+			return errors.New(errorResponse.ErrorMessage)
 		}
 
 		if response.StatusCode >= http.StatusBadRequest {
 			return StatusError{
 				StatusCode:   response.StatusCode,
 				Status:       response.Status,
-				ErrorMessage: errorResponse.Error,
+				ErrorMessage: errorResponse.ErrorMessage,
 			}
 		}
 
@@ -281,6 +393,24 @@ func (c *Client) Chat(ctx context.Context, req *ChatRequest, fn ChatResponseFunc
 	})
 }
 
+// CompareResponseFunc is a function that [Client.Compare] invokes every time
+// a response is received from one of the models. If this function returns an
+// error, [Client.Compare] will stop generating and return this error.
+type CompareResponseFunc func(CompareResponse) error
+
+// Compare generates responses to the same chat from several models at once.
+// fn is called for each response of each model, as they're generated.
+func (c *Client) Compare(ctx context.Context, req *CompareRequest, fn CompareResponseFunc) error {
+	return c.stream(ctx, http.MethodPost, "/api/compare", req, func(bts []byte) error {
+		var resp CompareResponse
+		if err := json.Unmarshal(bts, &resp); err != nil {
+			return err
+		}
+
+		return fn(resp)
+	})
+}
+
 // PullProgressFunc is a function that [Client.Pull] invokes every time there
 // is progress with a "pull" request sent to the service. If this function
 // returns an error, [Client.Pull] will stop the process and return this error.
@@ -339,6 +469,25 @@ func (c *Client) Create(ctx context.Context, req *CreateRequest, fn CreateProgre
 	})
 }
 
+// EditProgressFunc is a function that [Client.Edit] invokes when progress is
+// made.
+// It's similar to other progress function types like [PullProgressFunc].
+type EditProgressFunc func(ProgressResponse) error
+
+// Edit rewrites the GGUF metadata of a model without changing its weights.
+// fn is a progress function that behaves similarly to other methods (see
+// [Client.Pull]).
+func (c *Client) Edit(ctx context.Context, req *EditRequest, fn EditProgressFunc) error {
+	return c.stream(ctx, http.MethodPost, "/api/edit", req, func(bts []byte) error {
+		var resp ProgressResponse
+		if err := json.Unmarshal(bts, &resp); err != nil {
+			return err
+		}
+
+		return fn(resp)
+	})
+}
+
 // List lists models that are available locally.
 func (c *Client) List(ctx context.Context) (*ListResponse, error) {
 	var lr ListResponse
@@ -348,6 +497,33 @@ func (c *Client) List(ctx context.Context) (*ListResponse, error) {
 	return &lr, nil
 }
 
+// StorageHealth reports the results of checking the server's model blobs
+// for corruption.
+func (c *Client) StorageHealth(ctx context.Context) (*StorageHealthResponse, error) {
+	var resp StorageHealthResponse
+	if err := c.do(ctx, http.MethodGet, "/api/health/storage", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Preload loads a model and keeps it loaded regardless of keep alive.
+func (c *Client) Preload(ctx context.Context, req *PreloadRequest) error {
+	return c.do(ctx, http.MethodPost, "/api/preload", req, nil)
+}
+
+// DeletePreload stops keeping a preloaded model loaded, so it's unloaded
+// once it has been idle for the default keep alive.
+func (c *Client) DeletePreload(ctx context.Context, req *PreloadRequest) error {
+	return c.do(ctx, http.MethodDelete, "/api/preload", req, nil)
+}
+
+// Drain stops the server once the requests in progress have finished,
+// refusing new inference requests in the meantime.
+func (c *Client) Drain(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/api/admin/drain", nil, nil)
+}
+
 // ListRunning lists running models.
 func (c *Client) ListRunning(ctx context.Context) (*ProcessResponse, error) {
 	var lr ProcessResponse
@@ -359,6 +535,19 @@ func (c *Client) ListRunning(ctx context.Context) (*ProcessResponse, error) {
 
 // Copy copies a model - creating a model with another name from an existing
 // model.
+// Status streams the state of the server to fn when it's called and whenever
+// the state changes, until ctx is done.
+func (c *Client) Status(ctx context.Context, fn func(StatusResponse) error) error {
+	return c.stream(ctx, http.MethodGet, "/api/status", nil, func(bts []byte) error {
+		var resp StatusResponse
+		if err := json.Unmarshal(bts, &resp); err != nil {
+			return fmt.Errorf("unmarshal: %w", err)
+		}
+
+		return fn(resp)
+	})
+}
+
 func (c *Client) Copy(ctx context.Context, req *CopyRequest) error {
 	if err := c.do(ctx, http.MethodPost, "/api/copy", req, nil); err != nil {
 		return err
@@ -366,6 +555,37 @@ func (c *Client) Copy(ctx context.Context, req *CopyRequest) error {
 	return nil
 }
 
+// Pin protects a model from being evicted to stay within the server's disk
+// quota.
+func (c *Client) Pin(ctx context.Context, req *PinRequest) error {
+	return c.do(ctx, http.MethodPost, "/api/pin", req, nil)
+}
+
+// Unpin allows a pinned model to be evicted again.
+func (c *Client) Unpin(ctx context.Context, req *PinRequest) error {
+	return c.do(ctx, http.MethodDelete, "/api/pin", req, nil)
+}
+
+// Sign signs a model with the server's key so its provenance can be verified
+// when it is pushed and pulled.
+func (c *Client) Sign(ctx context.Context, req *SignRequest) (*SignResponse, error) {
+	var resp SignResponse
+	if err := c.do(ctx, http.MethodPost, "/api/sign", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Updates checks the models the server has pulled against their registries,
+// returning those with a newer version.
+func (c *Client) Updates(ctx context.Context) (*UpdatesResponse, error) {
+	var resp UpdatesResponse
+	if err := c.do(ctx, http.MethodGet, "/api/updates", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 // Delete deletes a model and its data.
 func (c *Client) Delete(ctx context.Context, req *DeleteRequest) error {
 	if err := c.do(ctx, http.MethodDelete, "/api/delete", req, nil); err != nil {
@@ -374,6 +594,218 @@ func (c *Client) Delete(ctx context.Context, req *DeleteRequest) error {
 	return nil
 }
 
+// DeleteChatSession deletes the caches the server saved for the chat
+// requests with a [ChatRequest.SessionID].
+func (c *Client) DeleteChatSession(ctx context.Context, req *DeleteChatSessionRequest) error {
+	return c.do(ctx, http.MethodDelete, "/api/chat/session", req, nil)
+}
+
+// ListAliases lists the model aliases.
+func (c *Client) ListAliases(ctx context.Context) (*ListAliasesResponse, error) {
+	var resp ListAliasesResponse
+	if err := c.do(ctx, http.MethodGet, "/api/aliases", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CreateAlias creates an alias for a model, or points an existing alias at
+// another model.
+func (c *Client) CreateAlias(ctx context.Context, req *AliasRequest) error {
+	return c.do(ctx, http.MethodPost, "/api/aliases", req, nil)
+}
+
+// DeleteAlias deletes an alias. The model it refers to is not deleted.
+func (c *Client) DeleteAlias(ctx context.Context, req *AliasRequest) error {
+	return c.do(ctx, http.MethodDelete, "/api/aliases", req, nil)
+}
+
+// ListKeys lists the API keys of the server, without their secrets.
+func (c *Client) ListKeys(ctx context.Context) (*ListKeysResponse, error) {
+	var resp ListKeysResponse
+	if err := c.do(ctx, http.MethodGet, "/api/keys", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CreateKey creates an API key. The returned key is the only time its
+// secret is available.
+func (c *Client) CreateKey(ctx context.Context, req *CreateKeyRequest) (*APIKey, error) {
+	var resp APIKey
+	if err := c.do(ctx, http.MethodPost, "/api/keys", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// DeleteKey revokes the API key id.
+func (c *Client) DeleteKey(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/keys/"+url.PathEscape(id), nil, nil)
+}
+
+// Config returns the runtime configuration of the server.
+func (c *Client) Config(ctx context.Context) (*ServerConfig, error) {
+	var resp ServerConfig
+	if err := c.do(ctx, http.MethodGet, "/api/config", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// UpdateConfig changes the runtime configuration of the server without
+// restarting it, returning the configuration after the change.
+func (c *Client) UpdateConfig(ctx context.Context, req *ServerConfig) (*ServerConfig, error) {
+	var resp ServerConfig
+	if err := c.do(ctx, http.MethodPatch, "/api/config", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CreateConversation creates a conversation stored on the server.
+func (c *Client) CreateConversation(ctx context.Context, req *ConversationRequest) (*Conversation, error) {
+	var resp Conversation
+	if err := c.do(ctx, http.MethodPost, "/api/conversations", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ListConversations lists the conversations stored on the server, most
+// recently updated first.
+func (c *Client) ListConversations(ctx context.Context) (*ListConversationsResponse, error) {
+	var resp ListConversationsResponse
+	if err := c.do(ctx, http.MethodGet, "/api/conversations", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// GetConversation returns the conversation with the id and its messages.
+func (c *Client) GetConversation(ctx context.Context, id string) (*Conversation, error) {
+	var resp Conversation
+	if err := c.do(ctx, http.MethodGet, "/api/conversations/"+url.PathEscape(id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// AddMessages adds messages to the end of the conversation with the id.
+func (c *Client) AddMessages(ctx context.Context, id string, req *ConversationRequest) (*Conversation, error) {
+	var resp Conversation
+	if err := c.do(ctx, http.MethodPost, "/api/conversations/"+url.PathEscape(id)+"/messages", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// DeleteConversation deletes the conversation with the id.
+func (c *Client) DeleteConversation(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/conversations/"+url.PathEscape(id), nil, nil)
+}
+
+// CreateSession creates a live session with a model.
+func (c *Client) CreateSession(ctx context.Context, req *SessionRequest) (*Session, error) {
+	var resp Session
+	if err := c.do(ctx, http.MethodPost, "/api/sessions", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ListSessions lists the live sessions, most recently used first.
+func (c *Client) ListSessions(ctx context.Context) (*ListSessionsResponse, error) {
+	var resp ListSessionsResponse
+	if err := c.do(ctx, http.MethodGet, "/api/sessions", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SessionChat sends the new messages of req to the session with the id,
+// which adds them and the model's reply to its history. Its model is the
+// session's, and fn is called for each response as in [Client.Chat].
+func (c *Client) SessionChat(ctx context.Context, id string, req *ChatRequest, fn ChatResponseFunc) error {
+	return c.stream(ctx, http.MethodPost, "/api/sessions/"+url.PathEscape(id)+"/chat", req, func(bts []byte) error {
+		var resp ChatResponse
+		if err := json.Unmarshal(bts, &resp); err != nil {
+			return err
+		}
+
+		return fn(resp)
+	})
+}
+
+// CloseSession closes the session with the id, discarding its history and
+// KV cache.
+func (c *Client) CloseSession(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/sessions/"+url.PathEscape(id), nil, nil)
+}
+
+// CreateBatch queues a batch of requests to be processed in the
+// background.
+func (c *Client) CreateBatch(ctx context.Context, req *BatchRequest) (*Batch, error) {
+	var resp Batch
+	if err := c.do(ctx, http.MethodPost, "/api/batch", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ListBatches lists the batches, most recently created first.
+func (c *Client) ListBatches(ctx context.Context) (*ListBatchesResponse, error) {
+	var resp ListBatchesResponse
+	if err := c.do(ctx, http.MethodGet, "/api/batch", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// GetBatch returns the batch with the id and its progress.
+func (c *Client) GetBatch(ctx context.Context, id string) (*Batch, error) {
+	var resp Batch
+	if err := c.do(ctx, http.MethodGet, "/api/batch/"+url.PathEscape(id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CancelBatch cancels the batch with the id. Results of the requests
+// processed before it was cancelled are kept.
+func (c *Client) CancelBatch(ctx context.Context, id string) (*Batch, error) {
+	var resp Batch
+	if err := c.do(ctx, http.MethodPost, "/api/batch/"+url.PathEscape(id)+"/cancel", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// DeleteBatch deletes the batch with the id and its results, cancelling it
+// if it's still being processed.
+func (c *Client) DeleteBatch(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/batch/"+url.PathEscape(id), nil, nil)
+}
+
+// BatchResults calls fn with the result of each request of the batch with
+// the id that has been processed so far, in the order of the requests.
+func (c *Client) BatchResults(ctx context.Context, id string, fn func(BatchResult) error) error {
+	return c.stream(ctx, http.MethodGet, "/api/batch/"+url.PathEscape(id)+"/results", nil, func(bts []byte) error {
+		var r BatchResult
+		if err := json.Unmarshal(bts, &r); err != nil {
+			return err
+		}
+
+		return fn(r)
+	})
+}
+
+// Cancel cancels the generate or chat request with the id, set with
+// [WithRequestID], which stops the model generating its response.
+func (c *Client) Cancel(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodPost, "/api/cancel/"+url.PathEscape(id), nil, nil)
+}
+
 // Show obtains model information, including details, modelfile, license etc.
 func (c *Client) Show(ctx context.Context, req *ShowRequest) (*ShowResponse, error) {
 	var resp ShowResponse
@@ -401,6 +833,55 @@ func (c *Client) Embed(ctx context.Context, req *EmbedRequest) (*EmbedResponse,
 	return &resp, nil
 }
 
+// Rerank scores the relevance of documents to a query with a reranking
+// model.
+func (c *Client) Rerank(ctx context.Context, req *RerankRequest) (*RerankResponse, error) {
+	var resp RerankResponse
+	if err := c.do(ctx, http.MethodPost, "/api/rerank", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Tokenize formats a prompt or chat like the model would for generation and
+// returns its tokens.
+func (c *Client) Tokenize(ctx context.Context, req *TokenizeRequest) (*TokenizeResponse, error) {
+	var resp TokenizeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/tokenize", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Detokenize turns tokens of a model back into text.
+func (c *Client) Detokenize(ctx context.Context, req *DetokenizeRequest) (*DetokenizeResponse, error) {
+	var resp DetokenizeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/detokenize", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Template renders a chat with the model's template, returning the prompt
+// the model would be given to respond to it.
+func (c *Client) Template(ctx context.Context, req *TemplateRequest) (*TemplateResponse, error) {
+	var resp TemplateResponse
+	if err := c.do(ctx, http.MethodPost, "/api/template", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Score returns the log probabilities of a completion of a prompt, as the
+// model's response to it, without generating one.
+func (c *Client) Score(ctx context.Context, req *ScoreRequest) (*ScoreResponse, error) {
+	var resp ScoreResponse
+	if err := c.do(ctx, http.MethodPost, "/api/score", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 // Embeddings generates an embedding from a model.
 func (c *Client) Embeddings(ctx context.Context, req *EmbeddingRequest) (*EmbeddingResponse, error) {
 	var resp EmbeddingResponse
@@ -416,11 +897,148 @@ func (c *Client) CreateBlob(ctx context.Context, digest string, r io.Reader) err
 	return c.do(ctx, http.MethodPost, fmt.Sprintf("/api/blobs/%s", digest), r, nil)
 }
 
+// LinkBlob creates a blob from a file on the same machine as the server.
+// The server shares the file's storage using a reflink or hardlink where the
+// filesystem allows it, and copies it otherwise. digest is the expected
+// SHA256 digest of the file.
+//
+// Only clients connecting over a loopback address may link blobs; others
+// should use [Client.CreateBlob].
+func (c *Client) LinkBlob(ctx context.Context, digest string, req *LinkBlobRequest) (*LinkBlobResponse, error) {
+	var resp LinkBlobResponse
+	if err := c.do(ctx, http.MethodPost, fmt.Sprintf("/api/blobs/%s/link", digest), req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Export writes an archive of a model, including all of its blobs, to w. The
+// archive can be imported by another server with [Client.Import].
+func (c *Client) Export(ctx context.Context, req *ExportRequest, w io.Writer) error {
+	bts, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.send(ctx, http.MethodPost, "/api/export", nil, bytes.NewReader(bts))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Import creates a model from an archive made by [Client.Export], read from
+// r. The model is named model, or the name stored in the archive if model is
+// empty. Every blob in the archive is verified before the model is created.
+func (c *Client) Import(ctx context.Context, r io.Reader, model string) (*ImportResponse, error) {
+	query := url.Values{}
+	if model != "" {
+		query.Set("model", model)
+	}
+
+	resp, err := c.send(ctx, http.MethodPost, "/api/import", query, r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var ir ImportResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ir); err != nil {
+		return nil, err
+	}
+	return &ir, nil
+}
+
+// Audit queries the server's audit log, returning the most recent entries
+// that match req.
+func (c *Client) Audit(ctx context.Context, req *AuditRequest) (*AuditResponse, error) {
+	query := url.Values{}
+	if req.Model != "" {
+		query.Set("model", req.Model)
+	}
+	if req.Action != "" {
+		query.Set("action", req.Action)
+	}
+	if req.User != "" {
+		query.Set("user", req.User)
+	}
+	if !req.Since.IsZero() {
+		query.Set("since", req.Since.Format(time.RFC3339Nano))
+	}
+	if req.Limit > 0 {
+		query.Set("limit", strconv.Itoa(req.Limit))
+	}
+
+	resp, err := c.send(ctx, http.MethodGet, "/api/audit", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var ar AuditResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ar); err != nil {
+		return nil, err
+	}
+	return &ar, nil
+}
+
+// send sends a request with query parameters and returns the response
+// unread, for requests whose bodies aren't JSON and may be large. The caller
+// must close the response body.
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, body io.Reader) (*http.Response, error) {
+	requestURL := c.base.JoinPath(path)
+	if query == nil {
+		query = url.Values{}
+	}
+
+	var token string
+	if envconfig.UseAuth() || c.base.Hostname() == "goobla.com" {
+		var err error
+		token, err = c.authorize(ctx, method, path, query)
+		if err != nil {
+			return nil, err
+		}
+	}
+	requestURL.RawQuery = query.Encode()
+
+	request, err := http.NewRequestWithContext(ctx, method, requestURL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("User-Agent", fmt.Sprintf("goobla/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
+
+	if token != "" {
+		request.Header.Set("Authorization", token)
+	}
+
+	if key := envconfig.APIKey(); key != "" {
+		request.Header.Set("X-Api-Key", key)
+	}
+
+	resp, err := c.http.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		return nil, checkError(resp, respBody)
+	}
+
+	return resp, nil
+}
+
 // Version returns the Goobla server version as a string.
 func (c *Client) Version(ctx context.Context) (string, error) {
-	var version struct {
-		Version string `json:"version"`
-	}
+	var version VersionResponse
 
 	if err := c.do(ctx, http.MethodGet, "/api/version", nil, &version); err != nil {
 		return "", err
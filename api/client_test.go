@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -161,6 +162,32 @@ func TestClientStream(t *testing.T) {
 	}
 }
 
+func TestClientStreamError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		if err := enc.Encode(ChatResponse{Message: Message{Content: "partial"}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := enc.Encode(StreamError{ErrorMessage: "model runner has unexpectedly stopped", Code: ErrorCodeRunnerStopped, Usage: &Usage{EvalCount: 1}}); err != nil {
+			t.Fatal(err)
+		}
+	}))
+	defer ts.Close()
+
+	client := NewClient(&url.URL{Scheme: "http", Host: ts.Listener.Addr().String()}, http.DefaultClient)
+	err := client.Chat(t.Context(), &ChatRequest{}, func(ChatResponse) error { return nil })
+
+	var serr StreamError
+	if !errors.As(err, &serr) {
+		t.Fatalf("expected a StreamError, got %v", err)
+	}
+
+	if serr.Code != ErrorCodeRunnerStopped || serr.Usage == nil || serr.Usage.EvalCount != 1 {
+		t.Errorf("unexpected error %+v", serr)
+	}
+}
+
 func TestClientDo(t *testing.T) {
 	testCases := []struct {
 		name     string
@@ -6,10 +6,12 @@ import (
 	"log/slog"
 	"math"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/goobla/goobla/envconfig"
 	"github.com/goobla/goobla/types/model"
@@ -36,9 +38,123 @@ func (e StatusError) Error() string {
 	}
 }
 
-// ImageData represents the raw binary data of an image file.
+// ErrorCode is a stable code for why a request failed, so clients can handle
+// failures without matching their messages, which may change.
+type ErrorCode string
+
+const (
+	// ErrorCodeRunnerStopped is the code of a request whose model runner
+	// stopped, such as by crashing, while running it.
+	ErrorCodeRunnerStopped ErrorCode = "runner_stopped"
+
+	// ErrorCodeOutOfMemory is the code of a request the model ran out of
+	// memory for.
+	ErrorCodeOutOfMemory ErrorCode = "out_of_memory"
+
+	// ErrorCodeTimeout is the code of a request that took too long, such as
+	// waiting for the model runner to respond.
+	ErrorCodeTimeout ErrorCode = "timeout"
+
+	// ErrorCodeCanceled is the code of a request that was canceled, such as
+	// by the client closing the connection.
+	ErrorCodeCanceled ErrorCode = "canceled"
+
+	// ErrorCodeInternal is the code of a request that failed for any other
+	// reason.
+	ErrorCodeInternal ErrorCode = "internal"
+)
+
+// StreamError is the final response of a streamed generate or chat request
+// that fails after it has started. [Client.Generate] and [Client.Chat] return
+// it as their error.
+type StreamError struct {
+	ErrorMessage string    `json:"error"`
+	Code         ErrorCode `json:"code"`
+
+	// Usage is of the response up to the failure, which is incomplete.
+	Usage *Usage `json:"usage,omitempty"`
+
+	// CrashID is the id of the crash report of a model runner that crashed
+	// while running the request.
+	CrashID string `json:"crash_id,omitempty"`
+}
+
+func (e StreamError) Error() string {
+	return e.ErrorMessage
+}
+
+// ImageData represents the raw binary data of an image file. It can also
+// hold the http(s) or file URL, or the absolute path, of an image for the
+// server to load, which is sent as it is rather than base64 encoded.
 type ImageData []byte
 
+// Ref returns the URL or path d holds, or "" if d holds image data.
+func (d ImageData) Ref() string {
+	// no image format starts with these, so the data of an image isn't
+	// mistaken for a reference
+	if len(d) > 0 && len(d) <= 4096 && utf8.Valid(d) {
+		s := string(d)
+		for _, prefix := range []string{"http://", "https://", "file://"} {
+			if strings.HasPrefix(s, prefix) {
+				return s
+			}
+		}
+
+		if filepath.IsAbs(s) {
+			return s
+		}
+	}
+
+	return ""
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface. Strings that
+// aren't base64 are kept as references if they're URLs or paths.
+func (d *ImageData) UnmarshalJSON(b []byte) error {
+	var data []byte
+	err := json.Unmarshal(b, &data)
+	if err == nil {
+		*d = data
+		return nil
+	}
+
+	var s string
+	if json.Unmarshal(b, &s) == nil && ImageData(s).Ref() != "" {
+		*d = ImageData(s)
+		return nil
+	}
+
+	return err
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (d ImageData) MarshalJSON() ([]byte, error) {
+	if ref := d.Ref(); ref != "" {
+		return json.Marshal(ref)
+	}
+
+	return json.Marshal([]byte(d))
+}
+
+// AudioData represents the raw binary data of an audio file. Like ImageData,
+// it can also hold the URL or path of a file for the server to load.
+type AudioData []byte
+
+// Ref returns the URL or path d holds, or "" if d holds audio data.
+func (d AudioData) Ref() string {
+	return ImageData(d).Ref()
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (d *AudioData) UnmarshalJSON(b []byte) error {
+	return (*ImageData)(d).UnmarshalJSON(b)
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (d AudioData) MarshalJSON() ([]byte, error) {
+	return ImageData(d).MarshalJSON()
+}
+
 // GenerateRequest describes a request sent by [Client.Generate]. While you
 // have to specify the Model and Prompt fields, all the other fields have
 // reasonable defaults for basic uses.
@@ -89,6 +205,37 @@ type GenerateRequest struct {
 	// (request that thinking _not_ be used) and unset (use the old behavior
 	// before this option was introduced)
 	Think *bool `json:"think,omitempty"`
+
+	// StatsInterval, if set, streams a response with the [Usage] so far at
+	// this interval while the response is being generated.
+	StatsInterval *Duration `json:"stats_interval,omitempty"`
+
+	// Timeout is the longest the model can generate the response for, after
+	// which it's stopped with the response so far and the DoneReason
+	// "timeout". The server's GOOBLA_MAX_GENERATION_TIME applies if it's
+	// shorter.
+	Timeout *Duration `json:"timeout,omitempty"`
+
+	// Priority is the scheduling priority of the request: "low", "normal"
+	// (the default) or "high". Queued requests with a higher priority are
+	// scheduled first.
+	Priority string `json:"priority,omitempty"`
+
+	// Draft is the name of a smaller model that proposes tokens for the
+	// model to check with speculative decoding, overriding the model's
+	// DRAFT. It must share the model's vocabulary.
+	Draft string `json:"draft,omitempty"`
+
+	// Grammar is a GBNF grammar to constrain the response to, such as SQL
+	// or a custom format. It can't be set with Format.
+	Grammar string `json:"grammar,omitempty"`
+
+	// Logprobs returns the log probability of each token in the response.
+	Logprobs bool `json:"logprobs,omitempty"`
+
+	// TopLogprobs is the number of most likely alternatives to return for
+	// each token, along with their log probabilities. It requires Logprobs.
+	TopLogprobs int `json:"top_logprobs,omitempty"`
 }
 
 // ChatRequest describes a request sent by [Client.Chat].
@@ -112,12 +259,60 @@ type ChatRequest struct {
 	// Tools is an optional list of tools the model has access to.
 	Tools `json:"tools,omitempty"`
 
+	// ParallelToolCalls allows the model to call more than one tool in a
+	// response; true by default. If false, only the first call is
+	// returned.
+	ParallelToolCalls *bool `json:"parallel_tool_calls,omitempty"`
+
+	// ServerTools names built-in tools enabled on the server, such as
+	// "calculator", for the model to use in addition to Tools. The server
+	// runs the calls the model makes to them and gives it their results
+	// until it answers, returning the calls it ran in
+	// ChatResponse.ToolExecutions.
+	ServerTools []string `json:"server_tools,omitempty"`
+
 	// Options lists model-specific options.
 	Options map[string]any `json:"options"`
 
 	// Think controls whether thinking/reasoning models will think before
 	// responding
 	Think *bool `json:"think,omitempty"`
+
+	// StatsInterval is the interval to stream the [Usage] at, as in
+	// [GenerateRequest].
+	StatsInterval *Duration `json:"stats_interval,omitempty"`
+
+	// Timeout is the longest the model can generate the response for, as in
+	// [GenerateRequest].
+	Timeout *Duration `json:"timeout,omitempty"`
+
+	// Priority is the scheduling priority of the request, as in
+	// [GenerateRequest].
+	Priority string `json:"priority,omitempty"`
+
+	// Draft is the name of a draft model, as in [GenerateRequest].
+	Draft string `json:"draft,omitempty"`
+
+	// Grammar is a GBNF grammar to constrain the response to, as in
+	// [GenerateRequest].
+	Grammar string `json:"grammar,omitempty"`
+
+	// SessionID names a conversation whose cache is saved to disk, so
+	// following requests with the same SessionID don't need to evaluate
+	// its history again, even after the model is unloaded. Unused caches
+	// expire, and [Client.DeleteChatSession] deletes them.
+	SessionID string `json:"session_id,omitempty"`
+
+	// ConversationID names a conversation stored on the server. Its
+	// messages come before Messages, which only need to hold the new ones,
+	// and the new messages and the response are added to it once the
+	// response is done.
+	ConversationID string `json:"conversation_id,omitempty"`
+
+	// Logprobs and TopLogprobs return the log probabilities of the tokens
+	// in the response, as in [GenerateRequest].
+	Logprobs    bool `json:"logprobs,omitempty"`
+	TopLogprobs int  `json:"top_logprobs,omitempty"`
 }
 
 type Tools []Tool
@@ -140,9 +335,17 @@ type Message struct {
 	Content string `json:"content"`
 	// Thinking contains the text that was inside thinking tags in the
 	// original model output when ChatRequest.Think is enabled.
-	Thinking  string      `json:"thinking,omitempty"`
-	Images    []ImageData `json:"images,omitempty"`
+	Thinking string      `json:"thinking,omitempty"`
+	Images   []ImageData `json:"images,omitempty"`
+	// Audio is a list of audio files, such as WAV files, for models that
+	// support audio input.
+	Audio     []AudioData `json:"audio,omitempty"`
 	ToolCalls []ToolCall  `json:"tool_calls,omitempty"`
+
+	// ToolCallDeltas are the parts of tool calls generated since the last
+	// response while streaming, so they can be shown before the calls are
+	// complete.
+	ToolCallDeltas []ToolCallDelta `json:"tool_call_deltas,omitempty"`
 }
 
 func (m *Message) UnmarshalJSON(b []byte) error {
@@ -169,6 +372,17 @@ type ToolCallFunction struct {
 
 type ToolCallFunctionArguments map[string]any
 
+// ToolCallDelta is part of a tool call streamed while it's generated. The
+// first delta of a call has its name, and joining the arguments of its
+// deltas gives the call's arguments as JSON. The complete call is still
+// sent in ToolCalls once it's generated, and calls that turn out not to
+// match their tool, such as by having unknown arguments, aren't.
+type ToolCallDelta struct {
+	Index     int    `json:"index"`
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments,omitempty"`
+}
+
 func (t *ToolCallFunctionArguments) String() string {
 	bts, _ := json.Marshal(t)
 	return string(bts)
@@ -252,11 +466,35 @@ type ChatResponse struct {
 	Message    Message   `json:"message"`
 	DoneReason string    `json:"done_reason,omitempty"`
 
+	// Usage is set on the responses streamed every
+	// ChatRequest.StatsInterval, which have no message content.
+	Usage *Usage `json:"usage,omitempty"`
+
+	// Logprobs holds the log probabilities of the tokens in Message when
+	// ChatRequest.Logprobs is set.
+	Logprobs []Logprob `json:"logprobs,omitempty"`
+
+	// Reproducibility is set on the final response of a deterministic
+	// request.
+	Reproducibility *Reproducibility `json:"reproducibility,omitempty"`
+
+	// ToolExecutions are the calls to ChatRequest.ServerTools that the
+	// server ran for the model.
+	ToolExecutions []ToolExecution `json:"tool_executions,omitempty"`
+
 	Done bool `json:"done"`
 
 	Metrics
 }
 
+// ToolExecution is a call to a built-in tool that the server ran for the
+// model, and its result or why it failed.
+type ToolExecution struct {
+	Call   ToolCall `json:"call"`
+	Result string   `json:"result,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
 type Metrics struct {
 	TotalDuration      time.Duration `json:"total_duration,omitempty"`
 	LoadDuration       time.Duration `json:"load_duration,omitempty"`
@@ -264,6 +502,29 @@ type Metrics struct {
 	PromptEvalDuration time.Duration `json:"prompt_eval_duration,omitempty"`
 	EvalCount          int           `json:"eval_count,omitempty"`
 	EvalDuration       time.Duration `json:"eval_duration,omitempty"`
+
+	// PromptImageCount is the number of the PromptEvalCount tokens that
+	// the images of the request took.
+	PromptImageCount int `json:"prompt_image_count,omitempty"`
+
+	// NumCtx is the context length the response was generated with, which
+	// the server chooses to fit the available memory when the num_ctx
+	// option is "auto".
+	NumCtx int `json:"num_ctx,omitempty"`
+}
+
+// Usage is the progress of a response while it is being generated.
+type Usage struct {
+	// PromptEvalCount is the number of the PromptTokens evaluated so far.
+	PromptEvalCount int `json:"prompt_eval_count"`
+	PromptTokens    int `json:"prompt_tokens"`
+
+	// EvalCount is the number of tokens generated so far.
+	EvalCount int `json:"eval_count"`
+
+	// TokensPerSecond is the rate tokens were generated at since the
+	// previous usage.
+	TokensPerSecond float64 `json:"tokens_per_second"`
 }
 
 // Options specified in [GenerateRequest].  If you add a new option here, also
@@ -285,14 +546,132 @@ type Options struct {
 	PresencePenalty  float32  `json:"presence_penalty,omitempty"`
 	FrequencyPenalty float32  `json:"frequency_penalty,omitempty"`
 	Stop             []string `json:"stop,omitempty"`
+
+	// DynatempRange enables dynamic temperature, which samples with a
+	// temperature up to DynatempRange above or below Temperature, higher
+	// when the model is less certain. DynatempExponent shapes the curve.
+	DynatempRange    float32 `json:"dynatemp_range,omitempty"`
+	DynatempExponent float32 `json:"dynatemp_exponent,omitempty"`
+
+	// Mirostat enables mirostat 2.0 sampling if it's 2, which keeps the
+	// surprise of the response close to MirostatTau, adapting at the rate
+	// MirostatEta, in place of top_k, top_p, min_p and typical_p.
+	Mirostat    int     `json:"mirostat,omitempty"`
+	MirostatTau float32 `json:"mirostat_tau,omitempty"`
+	MirostatEta float32 `json:"mirostat_eta,omitempty"`
+
+	// NumBeams decodes with beam search instead of sampling if it's more
+	// than 1, returning the most likely response found by keeping the
+	// NumBeams most likely ones at each step. Finished responses are ranked
+	// by their log probability divided by their length to the power of
+	// LengthPenalty, so higher values favor longer responses.
+	NumBeams      int     `json:"num_beams,omitempty"`
+	LengthPenalty float32 `json:"length_penalty,omitempty"`
+
+	// DryMultiplier enables DRY ("don't repeat yourself") sampling if it's
+	// positive, which penalizes tokens that would extend a sequence repeated
+	// from the last DryPenaltyLastN tokens, or the whole context if it's -1.
+	// Repetitions at least DryAllowedLength long are penalized by
+	// DryMultiplier * DryBase^(length - DryAllowedLength). Repetitions can't
+	// span tokens containing one of DrySequenceBreakers.
+	DryMultiplier       float32  `json:"dry_multiplier,omitempty"`
+	DryBase             float32  `json:"dry_base,omitempty"`
+	DryAllowedLength    int      `json:"dry_allowed_length,omitempty"`
+	DryPenaltyLastN     int      `json:"dry_penalty_last_n,omitempty"`
+	DrySequenceBreakers []string `json:"dry_sequence_breakers,omitempty"`
+
+	// Samplers is the order the sampling transforms are applied in, such as
+	// ["penalties", "top_k", "temperature", "top_p"]. Transforms that
+	// aren't listed aren't applied.
+	Samplers []string `json:"samplers,omitempty"`
+
+	// LogitBias is added to the logits of tokens before sampling, by token
+	// ID or by text, which biases each of its tokens. A bias of -100 or
+	// less bans a token.
+	LogitBias map[string]float32 `json:"logit_bias,omitempty"`
+
+	// StopTokenIDs are the IDs of tokens that end the response, in addition
+	// to the model's end of sequence tokens.
+	StopTokenIDs []int `json:"stop_token_ids,omitempty"`
+
+	// Deterministic makes repeated requests generate the same response: the
+	// seed is fixed if it isn't set, the model is loaded so that no other
+	// requests are evaluated in the same batch, and the response reports
+	// what it was generated with in its Reproducibility.
+	Deterministic bool `json:"deterministic,omitempty"`
+
+	// ContextOverflow is what happens when a request doesn't fit in the
+	// context window, one of ContextOverflowTruncateOldest (the default),
+	// ContextOverflowError or ContextOverflowShift.
+	ContextOverflow string `json:"context_overflow,omitempty"`
+
+	// Adapter is the scale to apply each of the model's adapters with, by
+	// name or index, in place of applying all of them with scale 1.
+	// Adapters that aren't listed aren't applied, so requests can switch
+	// between the adapters of a loaded model without reloading it. It can
+	// also be set to the name of a single adapter, or "none" to apply none.
+	Adapter map[string]float32 `json:"adapter,omitempty"`
 }
 
+// AdapterNone is the Adapter option that applies none of the model's
+// adapters.
+const AdapterNone = "none"
+
+const (
+	// ContextOverflowTruncateOldest drops the oldest messages of a chat
+	// that don't fit in the context window, and the oldest tokens after
+	// num_keep when the context fills.
+	ContextOverflowTruncateOldest = "truncate_oldest"
+
+	// ContextOverflowError fails requests whose prompt doesn't fit in the
+	// context window, and ends responses with done_reason "length" when
+	// the context fills while generating.
+	ContextOverflowError = "error"
+
+	// ContextOverflowShift keeps every message, and when the context fills
+	// drops as few of the oldest tokens as possible after the first
+	// num_keep, at least 4. Those are kept as attention sinks so the model
+	// stays stable while it attends to them and a sliding window of the
+	// latest tokens.
+	ContextOverflowShift = "shift_with_attention_sink"
+)
+
+// NumCtxAuto is the NumCtx of a model loaded with the largest context that
+// fits in the available memory, set with num_ctx "auto".
+const NumCtxAuto = -1
+
 // Runner options which must be set when the model is loaded into memory
 type Runner struct {
-	NumCtx    int   `json:"num_ctx,omitempty"`
-	NumBatch  int   `json:"num_batch,omitempty"`
-	NumGPU    int   `json:"num_gpu,omitempty"`
-	MainGPU   int   `json:"main_gpu,omitempty"`
+	NumCtx   int `json:"num_ctx,omitempty"`
+	NumBatch int `json:"num_batch,omitempty"`
+	NumGPU   int `json:"num_gpu,omitempty"`
+	MainGPU  int `json:"main_gpu,omitempty"`
+
+	// TensorSplit is the proportion of the model's layers to place on each
+	// GPU, comma separated in the order the GPUs were discovered, such as
+	// "3,1". It replaces the automatic split when the model is loaded on
+	// more than one GPU, and layers that don't fit on their GPU run on the
+	// CPU.
+	TensorSplit string `json:"tensor_split,omitempty"`
+
+	// Device pins the model to a backend, such as "cpu", "metal" or "cuda",
+	// optionally followed by the ID or index of one of its GPUs, such as
+	// "cuda:1".
+	Device string `json:"device,omitempty"`
+
+	// NUMA is how the threads of a model on the CPU are placed on the nodes
+	// of a NUMA system: "distribute" spreads them across all the nodes,
+	// "isolate" keeps them on one node and "numactl" uses the CPUs given by
+	// numactl. Models on the CPU are distributed on systems with more than
+	// one node unless it's "disabled".
+	NUMA string `json:"numa,omitempty"`
+
+	// KVCacheType is the type of the model's KV cache: f16, or q8_0 or
+	// q4_0 to quantize it, which roughly halves or quarters its memory at
+	// some cost in accuracy. It overrides GOOBLA_KV_CACHE_TYPE, and
+	// quantizing the cache enables flash attention for the model.
+	KVCacheType string `json:"kv_cache_type,omitempty"`
+
 	UseMMap   *bool `json:"use_mmap,omitempty"`
 	NumThread int   `json:"num_thread,omitempty"`
 }
@@ -305,14 +684,77 @@ type EmbedRequest struct {
 	// Input is the input to embed.
 	Input any `json:"input"`
 
+	// Documents are split into chunks of ChunkSize tokens, which are
+	// embedded and returned in [EmbedResponse.Chunks] instead of
+	// Embeddings. It can't be used with Input.
+	Documents []EmbedDocument `json:"documents,omitempty"`
+
+	// ChunkSize is the number of tokens in each chunk of the Documents.
+	// It defaults to 512, or the context length if it's less.
+	ChunkSize int `json:"chunk_size,omitempty"`
+
+	// ChunkOverlap is the number of tokens at the start of each chunk that
+	// are also at the end of the previous one. It must be less than
+	// ChunkSize.
+	ChunkOverlap int `json:"chunk_overlap,omitempty"`
+
 	// KeepAlive controls how long the model will stay loaded in memory following
 	// this request.
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
 	Truncate *bool `json:"truncate,omitempty"`
 
+	// Dimensions shortens the embeddings to their first Dimensions values
+	// for models trained to allow it, such as matryoshka embedding models.
+	// It can't be more than the size of the model's embeddings.
+	Dimensions int `json:"dimensions,omitempty"`
+
+	// Normalize scales the embeddings, after shortening them, to have an L2
+	// norm of 1 so their dot product is their cosine similarity. It
+	// defaults to true.
+	Normalize *bool `json:"normalize,omitempty"`
+
 	// Options lists model-specific options.
 	Options map[string]any `json:"options"`
+
+	// Priority is the scheduling priority of the request, as in
+	// [GenerateRequest].
+	Priority string `json:"priority,omitempty"`
+}
+
+// EmbedDocument is a document to embed in chunks, sent as a string or as
+// an object with its text and an optional id.
+type EmbedDocument struct {
+	ID   string `json:"id,omitempty"`
+	Text string `json:"text"`
+}
+
+func (d *EmbedDocument) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &d.Text); err == nil {
+		return nil
+	}
+
+	type Alias EmbedDocument
+	return json.Unmarshal(b, (*Alias)(d))
+}
+
+// EmbedChunk is a chunk of a document of an [EmbedRequest] and its
+// embedding.
+type EmbedChunk struct {
+	// Document is the index of the chunk's document in the request.
+	Document int    `json:"document"`
+	ID       string `json:"id,omitempty"`
+	Text     string `json:"text"`
+
+	// Start and End are the offsets of the chunk's text in the document,
+	// in characters (Unicode code points).
+	Start int `json:"start"`
+	End   int `json:"end"`
+
+	// Tokens is the number of tokens in the chunk.
+	Tokens int `json:"tokens"`
+
+	Embedding []float32 `json:"embedding"`
 }
 
 // EmbedResponse is the response from [Client.Embed].
@@ -320,11 +762,304 @@ type EmbedResponse struct {
 	Model      string      `json:"model"`
 	Embeddings [][]float32 `json:"embeddings"`
 
+	// Chunks are the chunks of the documents of the request, in order.
+	Chunks []EmbedChunk `json:"chunks,omitempty"`
+
+	TotalDuration   time.Duration `json:"total_duration,omitempty"`
+	LoadDuration    time.Duration `json:"load_duration,omitempty"`
+	PromptEvalCount int           `json:"prompt_eval_count,omitempty"`
+}
+
+// RerankRequest is the request passed to [Client.Rerank].
+type RerankRequest struct {
+	// Model is the model name, which must be a reranking model.
+	Model string `json:"model"`
+
+	// Query is what the documents are scored against.
+	Query string `json:"query"`
+
+	// Documents are the documents to score.
+	Documents []string `json:"documents"`
+
+	// TopN returns only the TopN most relevant documents. Zero returns
+	// all of them.
+	TopN int `json:"top_n,omitempty"`
+
+	// ReturnDocuments includes the text of the documents in the results.
+	ReturnDocuments bool `json:"return_documents,omitempty"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	Truncate *bool `json:"truncate,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]any `json:"options"`
+
+	// Priority is the scheduling priority of the request, as in
+	// [GenerateRequest].
+	Priority string `json:"priority,omitempty"`
+}
+
+// RerankResponse is the response from [Client.Rerank].
+type RerankResponse struct {
+	Model string `json:"model"`
+
+	// Results are the scored documents, most relevant first.
+	Results []RerankResult `json:"results"`
+
 	TotalDuration   time.Duration `json:"total_duration,omitempty"`
 	LoadDuration    time.Duration `json:"load_duration,omitempty"`
 	PromptEvalCount int           `json:"prompt_eval_count,omitempty"`
 }
 
+// RerankResult is the score of a document of a [RerankRequest]. Index is the
+// document's index in the request, and RelevanceScore is between 0 and 1,
+// higher meaning more relevant.
+type RerankResult struct {
+	Index          int     `json:"index"`
+	Document       string  `json:"document,omitempty"`
+	RelevanceScore float64 `json:"relevance_score"`
+}
+
+// TokenizeRequest is the request passed to [Client.Tokenize]. It takes
+// either a Prompt, formatted like a [GenerateRequest], or Messages,
+// formatted like a [ChatRequest].
+type TokenizeRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Prompt is the prompt to tokenize.
+	Prompt string `json:"prompt,omitempty"`
+
+	// System overrides the model's default system message for Prompt.
+	System string `json:"system,omitempty"`
+
+	// Raw tokenizes Prompt without formatting it with the model's template.
+	Raw bool `json:"raw,omitempty"`
+
+	// Messages are the messages of a chat to tokenize. Unlike a chat, they
+	// aren't truncated to fit the context window, and their images aren't
+	// counted.
+	Messages []Message `json:"messages,omitempty"`
+
+	// Tools are the tools available to the model in the chat.
+	Tools `json:"tools,omitempty"`
+
+	// Think formats the chat for thinking models to think.
+	Think *bool `json:"think,omitempty"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Options lists model-specific options, such as num_ctx.
+	Options map[string]any `json:"options"`
+
+	// Priority is the scheduling priority of the request, as in
+	// [GenerateRequest].
+	Priority string `json:"priority,omitempty"`
+}
+
+// TokenizeResponse is the response from [Client.Tokenize].
+type TokenizeResponse struct {
+	Model string `json:"model"`
+
+	// Tokens are the ids of the tokens of the formatted prompt.
+	Tokens []int `json:"tokens"`
+
+	// Count is the number of tokens.
+	Count int `json:"count"`
+
+	// ContextLength is the size of the context window of the model with
+	// the request's options, which the tokens must fit in.
+	ContextLength int `json:"context_length"`
+}
+
+// DetokenizeRequest is the request passed to [Client.Detokenize].
+type DetokenizeRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Tokens are the ids of the tokens to turn back into text.
+	Tokens []int `json:"tokens"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]any `json:"options"`
+
+	// Priority is the scheduling priority of the request, as in
+	// [GenerateRequest].
+	Priority string `json:"priority,omitempty"`
+}
+
+// DetokenizeResponse is the response from [Client.Detokenize].
+type DetokenizeResponse struct {
+	Model   string `json:"model"`
+	Content string `json:"content"`
+}
+
+// TemplateRequest is the request passed to [Client.Template].
+type TemplateRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Messages are the messages of the chat to render.
+	Messages []Message `json:"messages"`
+
+	// Tools are the tools available to the model in the chat.
+	Tools `json:"tools,omitempty"`
+
+	// Think renders the chat for thinking models to think.
+	Think *bool `json:"think,omitempty"`
+
+	// Template overrides the model's template.
+	Template string `json:"template,omitempty"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]any `json:"options"`
+
+	// Priority is the scheduling priority of the request, as in
+	// [GenerateRequest].
+	Priority string `json:"priority,omitempty"`
+}
+
+// TemplateResponse is the response from [Client.Template].
+type TemplateResponse struct {
+	Model string `json:"model"`
+
+	// Prompt is the chat rendered with the model's template, which is what
+	// the model is given to respond to it.
+	Prompt string `json:"prompt"`
+
+	// Count is the number of tokens of Prompt.
+	Count int `json:"count"`
+}
+
+// ScoreRequest is the request passed to [Client.Score].
+type ScoreRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Prompt is the prompt the completion responds to. It's formatted with
+	// the model's template as in [GenerateRequest], unless Raw is set.
+	Prompt string `json:"prompt"`
+
+	// Completion is the text to score as the model's response to Prompt.
+	Completion string `json:"completion"`
+
+	// System overrides the model's default system message.
+	System string `json:"system,omitempty"`
+
+	// Raw scores the completion of Prompt without formatting it with the
+	// model's template.
+	Raw bool `json:"raw,omitempty"`
+
+	// TopLogprobs is the number of most likely alternatives to return for
+	// each token of the completion, along with their log probabilities.
+	TopLogprobs int `json:"top_logprobs,omitempty"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]any `json:"options"`
+
+	// Priority is the scheduling priority of the request, as in
+	// [GenerateRequest].
+	Priority string `json:"priority,omitempty"`
+}
+
+// ScoreResponse is the response from [Client.Score].
+type ScoreResponse struct {
+	Model string `json:"model"`
+
+	// Logprob is the log-likelihood of the completion, the sum of the log
+	// probabilities of its tokens.
+	Logprob float64 `json:"logprob"`
+
+	// Perplexity is the exponential of the negative mean log probability of
+	// the tokens of the completion.
+	Perplexity float64 `json:"perplexity"`
+
+	// Logprobs are the log probabilities of each token of the completion.
+	Logprobs []Logprob `json:"logprobs"`
+
+	TotalDuration      time.Duration `json:"total_duration,omitempty"`
+	LoadDuration       time.Duration `json:"load_duration,omitempty"`
+	PromptEvalCount    int           `json:"prompt_eval_count,omitempty"`
+	PromptEvalDuration time.Duration `json:"prompt_eval_duration,omitempty"`
+}
+
+// CompareRequest is the request passed to [Client.Compare]. It takes either
+// a Prompt or Messages, which are given to each of the models as a chat.
+type CompareRequest struct {
+	// Models are the names of the models to compare.
+	Models []string `json:"models"`
+
+	// Prompt is the prompt of the chat.
+	Prompt string `json:"prompt,omitempty"`
+
+	// System is the system message of the chat with Prompt, in place of the
+	// models' own.
+	System string `json:"system,omitempty"`
+
+	// Messages are the messages of the chat, in place of Prompt.
+	Messages []Message `json:"messages,omitempty"`
+
+	// Tools is an optional list of tools the models have access to.
+	Tools `json:"tools,omitempty"`
+
+	// Format is the format to return the responses in (e.g. "json").
+	Format json.RawMessage `json:"format,omitempty"`
+
+	// Stream enables streaming of the responses; true by default. If false,
+	// the response of each model is returned whole once it's done.
+	Stream *bool `json:"stream,omitempty"`
+
+	// Think controls whether thinking models think before responding.
+	Think *bool `json:"think,omitempty"`
+
+	// KeepAlive controls how long the models will stay loaded into memory
+	// following the request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Options lists model-specific options, which apply to each model.
+	Options map[string]any `json:"options"`
+
+	// Priority is the scheduling priority of the request, as in
+	// [GenerateRequest].
+	Priority string `json:"priority,omitempty"`
+}
+
+// CompareResponse is a response of one of the models of a [CompareRequest].
+// The streamed responses of the models are interleaved in the order they're
+// generated.
+type CompareResponse struct {
+	// Index is the position of the response's model in
+	// CompareRequest.Models.
+	Index int `json:"index"`
+
+	ChatResponse
+
+	// ModelError is why the model's response failed, if it did, which
+	// doesn't stop the responses of the other models.
+	ModelError string `json:"model_error,omitempty"`
+
+	// ModelErrorCode is the code of ModelError, if the response failed
+	// after it started.
+	ModelErrorCode ErrorCode `json:"model_error_code,omitempty"`
+}
+
 // EmbeddingRequest is the request passed to [Client.Embeddings].
 type EmbeddingRequest struct {
 	// Model is the model name.
@@ -339,6 +1074,10 @@ type EmbeddingRequest struct {
 
 	// Options lists model-specific options.
 	Options map[string]any `json:"options"`
+
+	// Priority is the scheduling priority of the request, as in
+	// [GenerateRequest].
+	Priority string `json:"priority,omitempty"`
 }
 
 // EmbeddingResponse is the response from [Client.Embeddings].
@@ -361,6 +1100,28 @@ type CreateRequest struct {
 	Parameters map[string]any    `json:"parameters,omitempty"`
 	Messages   []Message         `json:"messages,omitempty"`
 
+	// Metadata overrides the metadata read from the model's weights.
+	Metadata *ModelMetadata `json:"metadata,omitempty"`
+
+	// Draft is the name of a smaller model that proposes tokens for the
+	// model to check with speculative decoding.
+	Draft string `json:"draft,omitempty"`
+
+	// ImportanceMatrix is the digest of a blob holding an importance matrix,
+	// computed by llama-imatrix from calibration data, to weight the
+	// quantization of the model with. It requires Quantize.
+	ImportanceMatrix string `json:"importance_matrix,omitempty"`
+
+	// Locked stops requests from overriding the template and system prompt
+	// of the model, so they can't be removed by API callers. Models created
+	// from a locked model are locked too.
+	Locked bool `json:"locked,omitempty"`
+
+	// Check renders the model's template with sample conversations before
+	// the model is created and fails if the template is broken, such as when
+	// it refers to undefined variables or leaves messages out of the prompt.
+	Check bool `json:"check,omitempty"`
+
 	// Deprecated: set the model name with Model instead
 	Name string `json:"name"`
 	// Deprecated: use Quantize instead
@@ -375,6 +1136,12 @@ type DeleteRequest struct {
 	Name string `json:"name"`
 }
 
+// DeleteChatSessionRequest is the request passed to
+// [Client.DeleteChatSession].
+type DeleteChatSessionRequest struct {
+	SessionID string `json:"session_id"`
+}
+
 // ShowRequest is the request passed to [Client.Show].
 type ShowRequest struct {
 	Model  string `json:"model"`
@@ -404,6 +1171,12 @@ type ShowResponse struct {
 	Tensors       []Tensor           `json:"tensors,omitempty"`
 	Capabilities  []model.Capability `json:"capabilities,omitempty"`
 	ModifiedAt    time.Time          `json:"modified_at,omitempty"`
+	Metadata      ModelMetadata      `json:"metadata,omitzero"`
+
+	// Samplers is the order the model's sampling transforms are applied
+	// in, followed by how the token is picked. It's only set for verbose
+	// requests.
+	Samplers []string `json:"samplers,omitempty"`
 }
 
 // CopyRequest is the request passed to [Client.Copy].
@@ -412,6 +1185,317 @@ type CopyRequest struct {
 	Destination string `json:"destination"`
 }
 
+// EditRequest is the request passed to [Client.Edit].
+type EditRequest struct {
+	// Model is the model whose metadata is edited.
+	Model string `json:"model"`
+
+	// Destination is the name of the edited model. The model is edited in
+	// place if it's empty.
+	Destination string `json:"destination,omitempty"`
+
+	// Metadata are the GGUF key-values to set, or remove if they're null,
+	// such as "tokenizer.chat_template" or "context_length". Keys without a
+	// "general." or "tokenizer." prefix are prefixed with the model's
+	// architecture.
+	Metadata map[string]any `json:"metadata"`
+
+	Stream *bool `json:"stream,omitempty"`
+}
+
+// PinRequest is the request passed to [Client.Pin] and [Client.Unpin].
+type PinRequest struct {
+	Model string `json:"model"`
+}
+
+// SignRequest is the request passed to [Client.Sign].
+type SignRequest struct {
+	Model string `json:"model"`
+}
+
+// SignResponse is the response from [Client.Sign].
+type SignResponse struct {
+	// PublicKey is the key that signed the model, in authorized_keys format.
+	PublicKey string `json:"public_key"`
+}
+
+// UpdatesResponse is the response from [Client.Updates].
+type UpdatesResponse struct {
+	Models []ModelUpdate `json:"models"`
+}
+
+// ModelUpdate describes a local model with a newer version in its registry.
+type ModelUpdate struct {
+	Model string `json:"model"`
+
+	// Digest is the digest of the local model, as in [ListModelResponse].
+	Digest string `json:"digest"`
+
+	// RemoteDigest is the digest of the newer manifest in the registry.
+	RemoteDigest string `json:"remote_digest"`
+}
+
+// LinkBlobRequest is the request passed to [Client.LinkBlob].
+type LinkBlobRequest struct {
+	// Path is the absolute path of a file on the server's filesystem.
+	Path string `json:"path"`
+}
+
+// LinkBlobResponse is the response from [Client.LinkBlob].
+type LinkBlobResponse struct {
+	// Method is how the file was added to the blob store: "reflink",
+	// "copy", or "existing" if the blob was already present.
+	Method string `json:"method"`
+}
+
+// ExportRequest is the request passed to [Client.Export].
+type ExportRequest struct {
+	Model string `json:"model"`
+}
+
+// ImportResponse is the response from [Client.Import].
+type ImportResponse struct {
+	// Model is the name of the imported model.
+	Model string `json:"model"`
+}
+
+// AliasRequest is the request passed to [Client.CreateAlias] and
+// [Client.DeleteAlias].
+type AliasRequest struct {
+	// Alias is the name of the alias.
+	Alias string `json:"alias"`
+
+	// Target is the model the alias refers to. It is ignored when deleting
+	// an alias.
+	Target string `json:"target,omitempty"`
+}
+
+// ListAliasesResponse is the response from [Client.ListAliases].
+type ListAliasesResponse struct {
+	Aliases []AliasResponse `json:"aliases"`
+}
+
+// AliasResponse is a single alias in [ListAliasesResponse].
+type AliasResponse struct {
+	Alias  string `json:"alias"`
+	Target string `json:"target"`
+}
+
+// The scopes of an [APIKey], which limit the requests made with it.
+const (
+	// ScopeRead allows listing and showing models and other information
+	// about the server.
+	ScopeRead = "read"
+
+	// ScopeGenerate allows running models, such as with generate, chat and
+	// embed requests.
+	ScopeGenerate = "generate"
+
+	// ScopeManageModels allows pulling, pushing, creating, copying and
+	// deleting models.
+	ScopeManageModels = "manage-models"
+
+	// ScopeAdmin allows every request, including managing API keys.
+	ScopeAdmin = "admin"
+)
+
+// APIKeyScopes are the scopes an [APIKey] can have.
+var APIKeyScopes = []string{ScopeRead, ScopeGenerate, ScopeManageModels, ScopeAdmin}
+
+// APIKey is a key requests to the server are authenticated with, once any
+// have been created.
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// RequestsPerMinute and TokensPerMinute limit the requests made with
+	// the key in place of the server's rate limits, if they're set.
+	RequestsPerMinute uint `json:"requests_per_minute,omitempty"`
+	TokensPerMinute   uint `json:"tokens_per_minute,omitempty"`
+
+	// Key is the secret requests are made with. It's only returned when the
+	// key is created.
+	Key string `json:"key,omitempty"`
+}
+
+// CreateKeyRequest is the request passed to [Client.CreateKey].
+type CreateKeyRequest struct {
+	// Name describes what the key is used for.
+	Name string `json:"name"`
+
+	// Scopes are the scopes of the key, from [APIKeyScopes].
+	Scopes []string `json:"scopes"`
+
+	// RequestsPerMinute and TokensPerMinute are the rate limits of the key,
+	// or the server's if they're 0.
+	RequestsPerMinute uint `json:"requests_per_minute,omitempty"`
+	TokensPerMinute   uint `json:"tokens_per_minute,omitempty"`
+}
+
+// ListKeysResponse is the response from [Client.ListKeys].
+type ListKeysResponse struct {
+	Keys []APIKey `json:"keys"`
+}
+
+// ServerConfig is the runtime configuration of the server returned by
+// [Client.Config]. With [Client.UpdateConfig], only the fields that are set
+// are changed.
+type ServerConfig struct {
+	// KeepAlive is how long models stay loaded when requests don't set
+	// their own keep alive.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// MaxLoadedModels is the maximum number of models loaded per GPU, or 0
+	// to choose it automatically.
+	MaxLoadedModels *uint `json:"max_loaded_models,omitempty"`
+
+	// NumParallel is the number of requests each model handles in
+	// parallel, or 0 to choose it automatically. It applies to models
+	// loaded after it's changed.
+	NumParallel *uint `json:"num_parallel,omitempty"`
+
+	// MaxClientRequests is the number of requests each client can have in
+	// progress, or 0 for no limit.
+	MaxClientRequests *uint `json:"max_client_requests,omitempty"`
+
+	// LogLevel is one of error, warn, info, debug or trace.
+	LogLevel string `json:"log_level,omitempty"`
+}
+
+// Conversation is a chat history stored on the server, which chat requests
+// refer to with [ChatRequest.ConversationID].
+type Conversation struct {
+	ID        string    `json:"id"`
+	Model     string    `json:"model,omitempty"`
+	Messages  []Message `json:"messages,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ConversationRequest is the request passed to [Client.CreateConversation]
+// and [Client.AddMessages].
+type ConversationRequest struct {
+	// Model is the model chat requests in the conversation use when they
+	// don't name one. It is ignored when adding messages.
+	Model string `json:"model,omitempty"`
+
+	// Messages are added to the end of the conversation.
+	Messages []Message `json:"messages,omitempty"`
+}
+
+// ListConversationsResponse is the response from
+// [Client.ListConversations]. Its conversations don't include their
+// messages.
+type ListConversationsResponse struct {
+	Conversations []Conversation `json:"conversations"`
+}
+
+// Session is a live chat session with a model. The server keeps its history
+// and the KV cache of the model for it, so each request of the session only
+// sends its new messages and they're the only ones evaluated. A session
+// lasts until it's closed or it has been idle for its idle timeout.
+type Session struct {
+	ID       string `json:"id"`
+	Model    string `json:"model"`
+	Messages int    `json:"messages"`
+
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// SessionRequest is the request passed to [Client.CreateSession].
+type SessionRequest struct {
+	// Model is the model the session chats with.
+	Model string `json:"model"`
+
+	// System is the system message the session starts with, instead of
+	// the model's.
+	System string `json:"system,omitempty"`
+
+	// Options are the model options of the session's requests, which
+	// their own options override.
+	Options map[string]any `json:"options,omitempty"`
+
+	// IdleTimeout is how long the session is kept without requests before
+	// it's closed, 30 minutes by default.
+	IdleTimeout *Duration `json:"idle_timeout,omitempty"`
+}
+
+// ListSessionsResponse is the response from [Client.ListSessions].
+type ListSessionsResponse struct {
+	Sessions []Session `json:"sessions"`
+}
+
+// BatchRequest is the request passed to [Client.CreateBatch]. The requests
+// of a batch are either listed in Requests or read from File, the digest of
+// a blob of JSON lines of [BatchItem] uploaded with [Client.CreateBlob].
+type BatchRequest struct {
+	Requests []BatchItem `json:"requests,omitempty"`
+	File     string      `json:"file,omitempty"`
+
+	// Endpoint is the endpoint of requests that don't have a URL of their
+	// own, "/api/chat" or "/api/generate".
+	Endpoint string `json:"endpoint,omitempty"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// BatchItem is a request of a batch. Its body is a [ChatRequest] or a
+// [GenerateRequest], which is never streamed and always has low priority.
+type BatchItem struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method,omitempty"`
+	URL      string          `json:"url,omitempty"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// Batch is a batch of requests processed in the background, as returned by
+// [Client.CreateBatch] and [Client.GetBatch]. Its status is one of
+// "queued", "in_progress", "completed", "failed", "cancelling" or
+// "cancelled".
+type Batch struct {
+	ID            string             `json:"id"`
+	Status        string             `json:"status"`
+	Endpoint      string             `json:"endpoint,omitempty"`
+	RequestCounts BatchRequestCounts `json:"request_counts"`
+	Metadata      map[string]string  `json:"metadata,omitempty"`
+	Error         string             `json:"error,omitempty"`
+	CreatedAt     time.Time          `json:"created_at"`
+	StartedAt     *time.Time         `json:"started_at,omitempty"`
+	CompletedAt   *time.Time         `json:"completed_at,omitempty"`
+	CancelledAt   *time.Time         `json:"cancelled_at,omitempty"`
+}
+
+// BatchRequestCounts is the progress of a batch: how many of its requests
+// have been processed, and how many of those failed.
+type BatchRequestCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+// BatchResult is the result of a request of a batch, as returned by
+// [Client.BatchResults]. Requests that failed have an error status, and the
+// error in their body.
+type BatchResult struct {
+	ID       string              `json:"id"`
+	CustomID string              `json:"custom_id"`
+	Response BatchResultResponse `json:"response"`
+}
+
+type BatchResultResponse struct {
+	StatusCode int             `json:"status_code"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// ListBatchesResponse is the response from [Client.ListBatches].
+type ListBatchesResponse struct {
+	Batches []Batch `json:"batches"`
+}
+
 // PullRequest is the request passed to [Client.Pull].
 type PullRequest struct {
 	Model    string `json:"model"`
@@ -420,6 +1504,14 @@ type PullRequest struct {
 	Password string `json:"password"`           // Deprecated: ignored
 	Stream   *bool  `json:"stream,omitempty"`
 
+	// RateLimit limits the download bandwidth to this many bytes per
+	// second. Zero means no limit beyond the server's own.
+	RateLimit int64 `json:"rate_limit,omitempty"`
+
+	// From is the URL of another Goobla server to pull the model from
+	// instead of its registry, such as "http://other-host:11434".
+	From string `json:"from,omitempty"`
+
 	// Deprecated: set the model name with Model instead
 	Name string `json:"name"`
 }
@@ -431,6 +1523,17 @@ type ProgressResponse struct {
 	Digest    string `json:"digest,omitempty"`
 	Total     int64  `json:"total,omitempty"`
 	Completed int64  `json:"completed,omitempty"`
+
+	// Chunks reports the progress of each range of a layer that is
+	// downloaded concurrently.
+	Chunks []ChunkProgress `json:"chunks,omitempty"`
+}
+
+// ChunkProgress is the progress of a range of a layer in [ProgressResponse].
+type ChunkProgress struct {
+	Offset    int64 `json:"offset"`
+	Total     int64 `json:"total"`
+	Completed int64 `json:"completed"`
 }
 
 // PushRequest is the request passed to [Client.Push].
@@ -441,6 +1544,10 @@ type PushRequest struct {
 	Password string `json:"password"`
 	Stream   *bool  `json:"stream,omitempty"`
 
+	// RateLimit limits the upload bandwidth to this many bytes per
+	// second. Zero means no limit beyond the server's own.
+	RateLimit int64 `json:"rate_limit,omitempty"`
+
 	// Deprecated: set the model name with Model instead
 	Name string `json:"name"`
 }
@@ -448,21 +1555,208 @@ type PushRequest struct {
 // ListResponse is the response from [Client.List].
 type ListResponse struct {
 	Models []ListModelResponse `json:"models"`
+
+	// Storage summarizes the disk space used by the listed models.
+	Storage *StorageStats `json:"storage,omitempty"`
+}
+
+// StorageStats describes how much disk space models use once layers shared
+// between models and linked from imported files are accounted for.
+type StorageStats struct {
+	// Size is the sum of the sizes of all models.
+	Size int64 `json:"size"`
+
+	// UniqueSize is the size of the distinct layers used by the models,
+	// which is the space they take up in the models directory.
+	UniqueSize int64 `json:"unique_size"`
+
+	// LinkedSize is the size of layers that share storage with files
+	// outside the models directory through hardlinks.
+	LinkedSize int64 `json:"linked_size"`
+}
+
+// PreloadRequest is the request passed to [Client.Preload] and
+// [Client.DeletePreload].
+type PreloadRequest struct {
+	Model string `json:"model"`
+}
+
+// PreloadStatus is the status of a preloaded model: "loading", "ready" or
+// "error".
+type PreloadStatus struct {
+	Model  string `json:"model"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// HealthResponse is the response from the server's /api/health and
+// /api/health/ready readiness checks, whose status code is 503 Service
+// Unavailable until Status is "ready", and from its /api/health/live
+// liveness check.
+type HealthResponse struct {
+	// Status is "ready" once every preloaded model is loaded, "loading"
+	// until then and "error" if any couldn't be loaded or a check failed.
+	// It's "draining" while the server is being drained to stop, and
+	// "alive" for the liveness check.
+	Status string `json:"status"`
+
+	Models []PreloadStatus `json:"models,omitempty"`
+
+	// Checks are the checks of /api/health/ready.
+	Checks []HealthCheck `json:"checks,omitempty"`
+}
+
+// HealthCheck is the result of one of the checks of the server's readiness.
+type HealthCheck struct {
+	// Name is "models" for the model store, "runners" for the runners of
+	// the loaded models and "gpus" for the GPUs.
+	Name string `json:"name"`
+
+	// Status is "ok" or "error".
+	Status string `json:"status"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// StorageHealthResponse is the response from [Client.StorageHealth].
+type StorageHealthResponse struct {
+	// Status is "ok" if no corrupted blobs have been found and "corrupted"
+	// otherwise.
+	Status string `json:"status"`
+
+	// Scrubbing is true while blobs are being checked.
+	Scrubbing bool `json:"scrubbing"`
+
+	// LastScrub is when blobs were last checked, if they have been.
+	LastScrub *time.Time `json:"last_scrub,omitempty"`
+
+	Corrupted []CorruptedBlob `json:"corrupted,omitempty"`
+}
+
+// CorruptedBlob is a blob whose contents no longer match its digest.
+type CorruptedBlob struct {
+	Digest     string    `json:"digest"`
+	Actual     string    `json:"actual"`
+	DetectedAt time.Time `json:"detected_at"`
+
+	// Models are the models using the blob, which need to be pulled or
+	// created again.
+	Models []string `json:"models,omitempty"`
+}
+
+// AuditRequest is the request passed to [Client.Audit]. Entries match if
+// they match every field that is set.
+type AuditRequest struct {
+	Model  string
+	Action string
+	User   string
+	Since  time.Time
+
+	// Limit is the number of most recent matching entries returned. The
+	// server returns 100 if it is zero.
+	Limit int
+}
+
+// AuditResponse is the response from [Client.Audit].
+type AuditResponse struct {
+	Entries []AuditEntry `json:"entries"`
+}
+
+// AuditEntry is a request recorded in the server's audit log.
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+
+	// Action is the kind of request, such as "pull" or "generate".
+	Action string `json:"action"`
+
+	// User is the user that made the request to a multi-user server.
+	User       string `json:"user,omitempty"`
+	RemoteAddr string `json:"remote_addr"`
+	Model      string `json:"model,omitempty"`
+
+	// Parameters are the fields of the request other than the model and
+	// its content, such as prompts, messages and files.
+	Parameters map[string]any `json:"parameters,omitempty"`
+
+	// Status is the HTTP status of the response. Error is set if the
+	// request failed, including after a streamed response started.
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
 }
 
 // ProcessResponse is the response from [Client.Process].
 type ProcessResponse struct {
 	Models []ProcessModelResponse `json:"models"`
+
+	// Devices are the GPUs the server has discovered, including GPUs that
+	// have since disappeared.
+	Devices []DeviceStatus `json:"devices,omitempty"`
+}
+
+// DeviceStatus is the health of a GPU in [ProcessResponse].
+type DeviceStatus struct {
+	Library string `json:"library"`
+	ID      string `json:"id"`
+	Name    string `json:"name,omitempty"`
+
+	// Status is "available", or "missing" if the GPU disappeared, such as
+	// after a driver reset or being unplugged. Models loaded on a missing
+	// GPU are unloaded, and it's used again if it recovers.
+	Status    string `json:"status"`
+	TotalVRAM int64  `json:"total_vram,omitempty"`
+}
+
+// StatusResponse is the state of the server streamed by [Client.Status].
+type StatusResponse struct {
+	// State is "generating" while a loaded model runs a request,
+	// "downloading" while a model is pulled, "error" if a GPU is missing,
+	// which Message explains, or "idle" otherwise.
+	State   string `json:"state"`
+	Message string `json:"message,omitempty"`
+
+	// Models are the loaded models, VRAM the GPU memory they use and
+	// TotalVRAM the memory of the GPUs that are available.
+	Models    []string `json:"models"`
+	VRAM      int64    `json:"vram"`
+	TotalVRAM int64    `json:"total_vram"`
+}
+
+// VersionResponse is the response from [Client.Version].
+type VersionResponse struct {
+	Version string `json:"version"`
+
+	// CPU describes the CPU backend the runners load.
+	CPU *CPUDiagnostics `json:"cpu,omitempty"`
+}
+
+// CPUDiagnostics are the instruction set extensions of the server's CPU and
+// the build of the CPU backend the runners load for them.
+type CPUDiagnostics struct {
+	Features []string `json:"features"`
+
+	// Variant is the build of the CPU backend, such as haswell, and Forced
+	// whether it was set with GOOBLA_CPU_VARIANT rather than detected.
+	Variant string `json:"variant,omitempty"`
+	Forced  bool   `json:"forced,omitempty"`
 }
 
 // ListModelResponse is a single model description in [ListResponse].
 type ListModelResponse struct {
-	Name       string       `json:"name"`
-	Model      string       `json:"model"`
-	ModifiedAt time.Time    `json:"modified_at"`
-	Size       int64        `json:"size"`
-	Digest     string       `json:"digest"`
-	Details    ModelDetails `json:"details,omitempty"`
+	Name       string        `json:"name"`
+	Model      string        `json:"model"`
+	ModifiedAt time.Time     `json:"modified_at"`
+	Size       int64         `json:"size"`
+	Digest     string        `json:"digest"`
+	Details    ModelDetails  `json:"details,omitempty"`
+	Metadata   ModelMetadata `json:"metadata,omitzero"`
+
+	// Pinned is set for models that are never evicted to stay within the
+	// server's disk quota.
+	Pinned bool `json:"pinned,omitempty"`
+
+	// SharedSize is the size of the model's layers that are also used by
+	// other models.
+	SharedSize int64 `json:"shared_size,omitempty"`
 }
 
 // ProcessModelResponse is a single model description in [ProcessResponse].
@@ -474,6 +1768,14 @@ type ProcessModelResponse struct {
 	Details   ModelDetails `json:"details,omitempty"`
 	ExpiresAt time.Time    `json:"expires_at"`
 	SizeVRAM  int64        `json:"size_vram"`
+
+	// KVCacheType is the type of the model's KV cache, such as f16 or
+	// q8_0, and KVCacheSize its estimated size in bytes.
+	KVCacheType string `json:"kv_cache_type,omitempty"`
+	KVCacheSize int64  `json:"kv_cache_size,omitempty"`
+
+	// Sessions is the number of live sessions with the model.
+	Sessions int `json:"sessions,omitempty"`
 }
 
 type TokenResponse struct {
@@ -505,9 +1807,65 @@ type GenerateResponse struct {
 	// can be sent in the next request to keep a conversational memory.
 	Context []int `json:"context,omitempty"`
 
+	// Usage is set on the responses streamed every
+	// GenerateRequest.StatsInterval, which have no other content.
+	Usage *Usage `json:"usage,omitempty"`
+
+	// Logprobs holds the log probabilities of the tokens in Response when
+	// GenerateRequest.Logprobs is set.
+	Logprobs []Logprob `json:"logprobs,omitempty"`
+
+	// Reproducibility is set on the final response of a deterministic
+	// request.
+	Reproducibility *Reproducibility `json:"reproducibility,omitempty"`
+
 	Metrics
 }
 
+// Reproducibility is what a deterministic response was generated with.
+// Repeating the request is expected to generate the same response only when
+// all of it matches, since different hardware, libraries or quantizations
+// compute slightly different results.
+type Reproducibility struct {
+	// Seed is the seed the response was sampled with.
+	Seed int `json:"seed"`
+
+	// Digest is the digest of the model.
+	Digest string `json:"digest"`
+
+	// Quantization is the quantization of the model's weights, such as Q4_0.
+	Quantization string `json:"quantization,omitempty"`
+
+	// Engine is the inference engine the model ran on, goobla or llama.cpp.
+	Engine string `json:"engine"`
+
+	// Backend is the library the model ran on, such as cuda_v12 or cpu, and
+	// GPULayers how many of its layers were offloaded to GPUs.
+	Backend   string `json:"backend"`
+	GPULayers int    `json:"gpu_layers"`
+
+	// Version is the version of the server.
+	Version string `json:"version"`
+}
+
+// TokenLogprob is a token and its log probability.
+type TokenLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+
+	// Bytes is the UTF-8 encoding of Token, which may be part of a
+	// character split across tokens.
+	Bytes []int `json:"bytes,omitempty"`
+}
+
+// Logprob is the log probability of a generated token, along with the most
+// likely tokens at its position.
+type Logprob struct {
+	TokenLogprob
+
+	TopLogprobs []TokenLogprob `json:"top_logprobs,omitempty"`
+}
+
 // ModelDetails provides details about a model.
 type ModelDetails struct {
 	ParentModel       string   `json:"parent_model"`
@@ -518,6 +1876,19 @@ type ModelDetails struct {
 	QuantizationLevel string   `json:"quantization_level"`
 }
 
+// ModelMetadata is structured information about a model, recorded in its
+// config when the model is created.
+type ModelMetadata struct {
+	// License is the SPDX identifier of the model's license, such as
+	// "apache-2.0".
+	License        string `json:"license,omitempty"`
+	ParameterCount uint64 `json:"parameter_count,omitempty"`
+	ContextLength  uint64 `json:"context_length,omitempty"`
+	// Source is the URL the model's weights came from.
+	Source       string `json:"source,omitempty"`
+	Quantization string `json:"quantization,omitempty"`
+}
+
 // Tensor describes the metadata for a given tensor.
 type Tensor struct {
 	Name  string   `json:"name"`
@@ -538,6 +1909,10 @@ func (m *Metrics) Summary() {
 		fmt.Fprintf(os.Stderr, "prompt eval count:    %d token(s)\n", m.PromptEvalCount)
 	}
 
+	if m.PromptImageCount > 0 {
+		fmt.Fprintf(os.Stderr, "prompt image count:   %d token(s)\n", m.PromptImageCount)
+	}
+
 	if m.PromptEvalDuration > 0 {
 		fmt.Fprintf(os.Stderr, "prompt eval duration: %s\n", m.PromptEvalDuration)
 		fmt.Fprintf(os.Stderr, "prompt eval rate:     %.2f tokens/s\n", float64(m.PromptEvalCount)/m.PromptEvalDuration.Seconds())
@@ -587,6 +1962,11 @@ func (opts *Options) FromMap(m map[string]any) error {
 				case float64:
 					// when JSON unmarshals numbers, it uses float64, not int
 					field.SetInt(int64(t))
+				case string:
+					if key != "num_ctx" || t != "auto" {
+						return fmt.Errorf("option %q must be of type integer", key)
+					}
+					field.SetInt(NumCtxAuto)
 				default:
 					return fmt.Errorf("option %q must be of type integer", key)
 				}
@@ -615,6 +1995,21 @@ func (opts *Options) FromMap(m map[string]any) error {
 				if !ok {
 					return fmt.Errorf("option %q must be of type array", key)
 				}
+
+				if field.Type().Elem().Kind() == reflect.Int {
+					// convert []any to []int
+					slice := make([]int, len(val))
+					for i, item := range val {
+						n, ok := item.(float64)
+						if !ok || n != math.Trunc(n) {
+							return fmt.Errorf("option %q must be of an array of integers", key)
+						}
+						slice[i] = int(n)
+					}
+					field.Set(reflect.ValueOf(slice))
+					continue
+				}
+
 				// convert []any to []string
 				slice := make([]string, len(val))
 				for i, item := range val {
@@ -625,6 +2020,32 @@ func (opts *Options) FromMap(m map[string]any) error {
 					slice[i] = str
 				}
 				field.Set(reflect.ValueOf(slice))
+			case reflect.Map:
+				// an adapter can be selected by name alone
+				if name, ok := val.(string); ok && key == "adapter" {
+					m := make(map[string]float32)
+					if name != AdapterNone {
+						m[name] = 1
+					}
+					field.Set(reflect.ValueOf(m))
+					continue
+				}
+
+				// JSON unmarshals to map[string]any
+				val, ok := val.(map[string]any)
+				if !ok {
+					return fmt.Errorf("option %q must be of type object", key)
+				}
+				// convert map[string]any to map[string]float32
+				m := make(map[string]float32, len(val))
+				for k, item := range val {
+					f, ok := item.(float64)
+					if !ok {
+						return fmt.Errorf("option %q must be an object of numbers", key)
+					}
+					m[k] = float32(f)
+				}
+				field.Set(reflect.ValueOf(m))
 			case reflect.Pointer:
 				var b bool
 				if field.Type() == reflect.TypeOf(&b) {
@@ -662,6 +2083,13 @@ func DefaultOptions() Options {
 		RepeatPenalty:    1.1,
 		PresencePenalty:  0.0,
 		FrequencyPenalty: 0.0,
+		DynatempExponent: 1.0,
+		MirostatTau:      5.0,
+		MirostatEta:      0.1,
+		LengthPenalty:    1.0,
+		DryBase:          1.75,
+		DryAllowedLength: 2,
+		DryPenaltyLastN:  -1,
 		Seed:             -1,
 
 		Runner: Runner{
@@ -748,6 +2176,11 @@ func FormatParams(params map[string][]string) (map[string]any, error) {
 
 					out[key] = float32(floatVal)
 				case reflect.Int:
+					if key == "num_ctx" && vals[0] == "auto" {
+						out[key] = vals[0]
+						break
+					}
+
 					intVal, err := strconv.ParseInt(vals[0], 10, 64)
 					if err != nil {
 						return nil, fmt.Errorf("invalid int value %s", vals)
@@ -764,8 +2197,46 @@ func FormatParams(params map[string][]string) (map[string]any, error) {
 				case reflect.String:
 					out[key] = vals[0]
 				case reflect.Slice:
-					// TODO: only string slices are supported right now
-					out[key] = vals
+					if field.Type().Elem().Kind() != reflect.Int {
+						out[key] = vals
+						break
+					}
+
+					ints := make([]int64, len(vals))
+					for i, v := range vals {
+						n, err := strconv.ParseInt(v, 10, 64)
+						if err != nil {
+							return nil, fmt.Errorf("invalid int value %s", vals)
+						}
+						ints[i] = n
+					}
+
+					out[key] = ints
+				case reflect.Map:
+					// each value is a token ID or text and its bias, such
+					// as "128000:-100", or an adapter and its scale, which
+					// is 1 if it's left out
+					m := make(map[string]float32, len(vals))
+					for _, v := range vals {
+						i := strings.LastIndex(v, ":")
+						if i < 0 && key == "adapter" {
+							if v != AdapterNone {
+								m[v] = 1
+							}
+							continue
+						} else if i < 0 {
+							return nil, fmt.Errorf("invalid %s value %q, expected a token and bias such as 1234:-100", key, v)
+						}
+
+						f, err := strconv.ParseFloat(v[i+1:], 32)
+						if err != nil {
+							return nil, fmt.Errorf("invalid float value %s", v[i+1:])
+						}
+
+						m[v[:i]] = float32(f)
+					}
+
+					out[key] = m
 				case reflect.Pointer:
 					var b bool
 					if field.Type() == reflect.TypeOf(&b) {
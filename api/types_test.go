@@ -145,6 +145,79 @@ func TestUseMmapParsingFromJSON(t *testing.T) {
 	}
 }
 
+func TestLogitBiasOptions(t *testing.T) {
+	params, err := FormatParams(map[string][]string{
+		"logit_bias":     {"1734:-100", "a:b:2.5"},
+		"stop_token_ids": {"128001", "128009"},
+	})
+	require.NoError(t, err)
+
+	// options are stored as JSON, then loaded from the map it unmarshals to
+	b, err := json.Marshal(params)
+	require.NoError(t, err)
+
+	var oMap map[string]any
+	require.NoError(t, json.Unmarshal(b, &oMap))
+
+	opts := DefaultOptions()
+	require.NoError(t, opts.FromMap(oMap))
+	assert.Equal(t, map[string]float32{"1734": -100, "a:b": 2.5}, opts.LogitBias)
+	assert.Equal(t, []int{128001, 128009}, opts.StopTokenIDs)
+
+	_, err = FormatParams(map[string][]string{"logit_bias": {"1734"}})
+	require.Error(t, err)
+
+	_, err = FormatParams(map[string][]string{"stop_token_ids": {"eos"}})
+	require.Error(t, err)
+
+	require.Error(t, opts.FromMap(map[string]any{"stop_token_ids": []any{1.5}}))
+	require.Error(t, opts.FromMap(map[string]any{"logit_bias": map[string]any{"1": "high"}}))
+}
+
+func TestAdapterOption(t *testing.T) {
+	params, err := FormatParams(map[string][]string{"adapter": {"support", "legal:0.5"}})
+	require.NoError(t, err)
+
+	b, err := json.Marshal(params)
+	require.NoError(t, err)
+
+	var oMap map[string]any
+	require.NoError(t, json.Unmarshal(b, &oMap))
+
+	opts := DefaultOptions()
+	require.NoError(t, opts.FromMap(oMap))
+	assert.Equal(t, map[string]float32{"support": 1, "legal": 0.5}, opts.Adapter)
+
+	require.NoError(t, opts.FromMap(map[string]any{"adapter": "support"}))
+	assert.Equal(t, map[string]float32{"support": 1}, opts.Adapter)
+
+	require.NoError(t, opts.FromMap(map[string]any{"adapter": AdapterNone}))
+	assert.Equal(t, map[string]float32{}, opts.Adapter)
+
+	require.Error(t, opts.FromMap(map[string]any{"adapter": 1.0}))
+}
+
+func TestNumCtxAuto(t *testing.T) {
+	params, err := FormatParams(map[string][]string{"num_ctx": {"auto"}})
+	require.NoError(t, err)
+
+	b, err := json.Marshal(params)
+	require.NoError(t, err)
+
+	var oMap map[string]any
+	require.NoError(t, json.Unmarshal(b, &oMap))
+
+	opts := DefaultOptions()
+	require.NoError(t, opts.FromMap(oMap))
+	assert.Equal(t, NumCtxAuto, opts.NumCtx)
+
+	_, err = FormatParams(map[string][]string{"num_ctx": {"max"}})
+	require.Error(t, err)
+
+	require.Error(t, opts.FromMap(map[string]any{"num_ctx": "max"}))
+	require.Error(t, opts.FromMap(map[string]any{"num_batch": "auto"}))
+}
+
 func TestUseMmapFormatParams(t *testing.T) {
 	tr := true
 	fa := false
@@ -373,6 +446,121 @@ func TestPropertyType_MarshalJSON(t *testing.T) {
 	}
 }
 
+func TestImageData_JSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected ImageData
+		ref      string
+		err      bool
+	}{
+		{
+			name:     "base64",
+			input:    `"aW1hZ2U="`,
+			expected: ImageData("image"),
+		},
+		{
+			name:     "url",
+			input:    `"https://example.com/image.png"`,
+			expected: ImageData("https://example.com/image.png"),
+			ref:      "https://example.com/image.png",
+		},
+		{
+			name:     "file url",
+			input:    `"file:///images/image.png"`,
+			expected: ImageData("file:///images/image.png"),
+			ref:      "file:///images/image.png",
+		},
+		{
+			name:     "path",
+			input:    `"/images/image.png"`,
+			expected: ImageData("/images/image.png"),
+			ref:      "/images/image.png",
+		},
+		{
+			name:  "invalid",
+			input: `"image.png"`,
+			err:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var data ImageData
+			err := json.Unmarshal([]byte(test.input), &data)
+			if test.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(data) != string(test.expected) {
+				t.Errorf("data mismatch: got %q, expected %q", data, test.expected)
+			}
+
+			if data.Ref() != test.ref {
+				t.Errorf("ref mismatch: got %q, expected %q", data.Ref(), test.ref)
+			}
+
+			b, err := json.Marshal(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(b) != test.input {
+				t.Errorf("marshaled data mismatch: got %s, expected %s", b, test.input)
+			}
+		})
+	}
+}
+
+func TestEmbedDocument_UnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected EmbedDocument
+		err      bool
+	}{
+		{
+			name:     "string",
+			input:    `"some text"`,
+			expected: EmbedDocument{Text: "some text"},
+		},
+		{
+			name:     "object",
+			input:    `{"id": "doc-1", "text": "some text"}`,
+			expected: EmbedDocument{ID: "doc-1", Text: "some text"},
+		},
+		{
+			name:  "invalid",
+			input: `1`,
+			err:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var doc EmbedDocument
+			err := json.Unmarshal([]byte(test.input), &doc)
+			if test.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if doc != test.expected {
+				t.Errorf("document mismatch: got %+v, expected %+v", doc, test.expected)
+			}
+		})
+	}
+}
+
 func TestThinking_UnmarshalJSON(t *testing.T) {
 	trueVal := true
 	falseVal := false
@@ -0,0 +1,73 @@
+# Shows the proxy settings dialog of the Goobla app. The current settings are
+# read as JSON from stdin, and the saved settings are written as JSON to
+# stdout, or nothing if the dialog is cancelled.
+
+Add-Type -AssemblyName System.Windows.Forms
+[System.Windows.Forms.Application]::EnableVisualStyles()
+
+$settings = [Console]::In.ReadToEnd() | ConvertFrom-Json
+
+$fields = @(
+    @{ Name = "http";     Label = "HTTP proxy" },
+    @{ Name = "https";    Label = "HTTPS proxy" },
+    @{ Name = "socks5";   Label = "SOCKS5 proxy" },
+    @{ Name = "no-proxy"; Label = "Bypass proxy for" },
+    @{ Name = "pac";      Label = "Auto-config script URL" }
+)
+
+$form = New-Object System.Windows.Forms.Form
+$form.Text = "Goobla proxy settings"
+$form.FormBorderStyle = "FixedDialog"
+$form.StartPosition = "CenterScreen"
+$form.MaximizeBox = $false
+$form.MinimizeBox = $false
+$form.TopMost = $true
+$form.ClientSize = New-Object System.Drawing.Size(460, 280)
+
+$note = New-Object System.Windows.Forms.Label
+$note.Text = "Leave the proxies empty to use the proxy environment variables. Separate the hosts to bypass the proxy for with commas."
+$note.Location = New-Object System.Drawing.Point(12, 12)
+$note.Size = New-Object System.Drawing.Size(436, 32)
+$form.Controls.Add($note)
+
+$boxes = @{}
+$y = 54
+foreach ($field in $fields) {
+    $label = New-Object System.Windows.Forms.Label
+    $label.Text = $field.Label
+    $label.Location = New-Object System.Drawing.Point(12, ($y + 3))
+    $label.Size = New-Object System.Drawing.Size(140, 20)
+    $form.Controls.Add($label)
+
+    $box = New-Object System.Windows.Forms.TextBox
+    $box.Location = New-Object System.Drawing.Point(156, $y)
+    $box.Size = New-Object System.Drawing.Size(292, 20)
+    if ($settings.($field.Name)) {
+        $box.Text = $settings.($field.Name)
+    }
+    $form.Controls.Add($box)
+    $boxes[$field.Name] = $box
+    $y += 32
+}
+
+$ok = New-Object System.Windows.Forms.Button
+$ok.Text = "Save"
+$ok.Location = New-Object System.Drawing.Point(292, 240)
+$ok.DialogResult = [System.Windows.Forms.DialogResult]::OK
+$form.AcceptButton = $ok
+$form.Controls.Add($ok)
+
+$cancel = New-Object System.Windows.Forms.Button
+$cancel.Text = "Cancel"
+$cancel.Location = New-Object System.Drawing.Point(373, 240)
+$cancel.DialogResult = [System.Windows.Forms.DialogResult]::Cancel
+$form.CancelButton = $cancel
+$form.Controls.Add($cancel)
+
+if ($form.ShowDialog() -eq [System.Windows.Forms.DialogResult]::OK) {
+    $saved = [ordered]@{}
+    foreach ($field in $fields) {
+        $saved[$field.Name] = $boxes[$field.Name].Text.Trim()
+    }
+    [Console]::Out.Write(($saved | ConvertTo-Json -Compress))
+}
@@ -1,8 +1,16 @@
+param([string]$model)
+
 # TODO - consider ANSI colors and maybe ASCII art...
 write-host ""
 write-host "Welcome to Goobla!"
 write-host ""
-write-host "Run your first model:"
-write-host ""
-write-host "`tgoobla run llama3.2"
-write-host ""
+if ($model) {
+    write-host "Chatting with $model, type /bye to exit:"
+    write-host ""
+    goobla run $model
+} else {
+    write-host "Run your first model:"
+    write-host ""
+    write-host "`tgoobla run llama3.2"
+    write-host ""
+}
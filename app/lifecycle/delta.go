@@ -0,0 +1,129 @@
+package lifecycle
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// An update can list deltas, binary patches to its installer from the
+// installers of earlier versions, so updating only downloads what changed since
+// the installer of the last update, which is left in the stage directory. A
+// delta is a zstd frame that uses the earlier installer as a raw dictionary, as
+// made by zstd --patch-from, and the patched installer is only staged if its
+// hash matches the one of the update. Otherwise the full installer is
+// downloaded instead.
+
+// maxDeltaWindow is the largest window of a delta, which spans the installer it
+// patches.
+const maxDeltaWindow = 4 << 30
+
+// UpdateDelta is a binary patch to the installer of an update.
+type UpdateDelta struct {
+	// From is the SHA-256 of the installer the delta patches
+	From string `json:"from"`
+	URL  string `json:"url"`
+}
+
+// downloadDelta stages the installer of updateResp at stageFilename by
+// patching the staged installer of the last update with a delta.
+func downloadDelta(ctx context.Context, updateResp UpdateResponse, stageFilename string) error {
+	if updateResp.SHA256 == "" || len(updateResp.Deltas) == 0 {
+		return errors.New("no deltas available")
+	}
+
+	base, err := stagedInstaller()
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(base)
+	from := hex.EncodeToString(sum[:])
+	i := slices.IndexFunc(updateResp.Deltas, func(d UpdateDelta) bool {
+		return strings.EqualFold(d.From, from)
+	})
+	if i < 0 {
+		return fmt.Errorf("no delta from installer %s", from)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, updateResp.Deltas[i].URL, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := updateClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error downloading delta: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status attempting to download delta %d", resp.StatusCode)
+	}
+
+	payload, err := applyDelta(base, resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to apply delta: %w", err)
+	}
+
+	if err := verifyInstaller(payload, updateResp.SHA256); err != nil {
+		return err
+	}
+
+	cleanupOldDownloads()
+	if err := os.MkdirAll(filepath.Dir(stageFilename), 0o755); err != nil {
+		return fmt.Errorf("create goobla dir %s: %v", filepath.Dir(stageFilename), err)
+	}
+
+	if err := os.WriteFile(stageFilename, payload, 0o755); err != nil {
+		return fmt.Errorf("write payload %s: %w", stageFilename, err)
+	}
+
+	slog.Info("new update patched " + stageFilename)
+	return nil
+}
+
+// stagedInstaller returns the installer of the last update.
+func stagedInstaller() ([]byte, error) {
+	files, err := filepath.Glob(filepath.Join(UpdateStageDir, "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, errors.New("no earlier installer to patch")
+	}
+
+	return os.ReadFile(files[0])
+}
+
+// applyDelta patches base with delta.
+func applyDelta(base []byte, delta io.Reader) ([]byte, error) {
+	dec, err := zstd.NewReader(delta, zstd.WithDecoderDictRaw(0, base), zstd.WithDecoderMaxWindow(maxDeltaWindow))
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+
+	return io.ReadAll(dec)
+}
+
+// verifyInstaller checks that the SHA-256 of the installer payload is sha256.
+func verifyInstaller(payload []byte, want string) error {
+	sum := sha256.Sum256(payload)
+	if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, want) {
+		return fmt.Errorf("installer hash %s doesn't match %s", got, want)
+	}
+
+	return nil
+}
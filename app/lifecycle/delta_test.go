@@ -0,0 +1,109 @@
+package lifecycle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadNewReleaseDelta(t *testing.T) {
+	oldStageDir := UpdateStageDir
+	defer func() { UpdateStageDir = oldStageDir }()
+
+	hash := func(b []byte) string {
+		sum := sha256.Sum256(b)
+		return hex.EncodeToString(sum[:])
+	}
+
+	base := bytes.Repeat([]byte("goobla installer v1 "), 4096)
+	installer := bytes.ReplaceAll(base, []byte("v1"), []byte("v2"))
+
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderDictRaw(0, base), zstd.WithWindowSize(1<<20))
+	require.NoError(t, err)
+	delta := enc.EncodeAll(installer, nil)
+	require.NoError(t, enc.Close())
+
+	var full int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Etag", `"v2"`)
+		w.Header().Set("Content-Disposition", `attachment; filename="GooblaSetup.exe"`)
+		switch r.URL.Path {
+		case "/v2/GooblaSetup.exe":
+			if r.Method == http.MethodGet {
+				full++
+			}
+			w.Write(installer) //nolint:errcheck
+		case "/v2/GooblaSetup.exe.delta":
+			w.Write(delta) //nolint:errcheck
+		case "/v1/GooblaSetup.exe.delta":
+			// a delta from another installer
+			w.Write(installer[:len(installer)/2]) //nolint:errcheck
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	resp := UpdateResponse{
+		UpdateURL: srv.URL + "/v2/GooblaSetup.exe",
+		SHA256:    hash(installer),
+		Deltas:    []UpdateDelta{{From: hash(base), URL: srv.URL + "/v2/GooblaSetup.exe.delta"}},
+	}
+
+	stage := func(t *testing.T) {
+		UpdateStageDir = t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(UpdateStageDir, "v1"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(UpdateStageDir, "v1", "GooblaSetup.exe"), base, 0o755))
+		full = 0
+	}
+
+	staged := func(t *testing.T) {
+		t.Helper()
+		b, err := os.ReadFile(filepath.Join(UpdateStageDir, "v2", "GooblaSetup.exe"))
+		require.NoError(t, err)
+		require.Equal(t, installer, b)
+
+		_, err = os.Stat(filepath.Join(UpdateStageDir, "v1"))
+		require.ErrorIs(t, err, os.ErrNotExist)
+	}
+
+	t.Run("delta", func(t *testing.T) {
+		stage(t)
+		require.NoError(t, DownloadNewRelease(t.Context(), resp))
+		staged(t)
+		require.Zero(t, full)
+	})
+
+	t.Run("bad delta", func(t *testing.T) {
+		stage(t)
+		resp := resp
+		resp.Deltas = []UpdateDelta{{From: hash(base), URL: srv.URL + "/v1/GooblaSetup.exe.delta"}}
+		require.NoError(t, DownloadNewRelease(t.Context(), resp))
+		staged(t)
+		require.Equal(t, 1, full)
+	})
+
+	t.Run("no base", func(t *testing.T) {
+		stage(t)
+		require.NoError(t, os.WriteFile(filepath.Join(UpdateStageDir, "v1", "GooblaSetup.exe"), []byte("other"), 0o755))
+		require.NoError(t, DownloadNewRelease(t.Context(), resp))
+		staged(t)
+		require.Equal(t, 1, full)
+	})
+
+	t.Run("full hash mismatch", func(t *testing.T) {
+		stage(t)
+		resp := resp
+		resp.Deltas = nil
+		resp.SHA256 = hash(base)
+		require.Error(t, DownloadNewRelease(t.Context(), resp))
+	})
+}
@@ -0,0 +1,158 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/app/store"
+	"github.com/goobla/goobla/app/tray/commontray"
+	"github.com/goobla/goobla/format"
+)
+
+// The first time it's run, GetStarted suggests a starter model that fits the
+// memory of the GPUs, pulls it with its progress in notifications and opens a
+// terminal to chat with it. Once a starter model has been pulled, which is
+// recorded in the store, it only opens the terminal.
+
+// deviceAvailable is the status of a GPU the server can use.
+const deviceAvailable = "available"
+
+// starterModels are the models GetStarted suggests, from the largest, with the
+// GPU memory they need.
+var starterModels = []struct {
+	name   string
+	memory uint64
+}{
+	{"gemma3:12b", 12 << 30},
+	{"llama3.1:8b", 8 << 30},
+	{"llama3.2", 4 << 30},
+	{"llama3.2:1b", 0},
+}
+
+// pullNotifyInterval is how often the progress of pulling the starter model is
+// notified.
+var pullNotifyInterval = 10 * time.Second
+
+var gettingStarted atomic.Bool
+
+func GetStarted(ctx context.Context, t commontray.GooblaTray) error {
+	if !gettingStarted.CompareAndSwap(false, true) {
+		return errors.New("already getting started")
+	}
+	defer gettingStarted.Store(false)
+
+	if model := store.GetStarterModel(); model != "" {
+		return openTerminal(model)
+	}
+
+	// a starter model can't be downloaded offline
+	if offline() {
+		return openTerminal("")
+	}
+
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	ps, err := client.ListRunning(ctx)
+	if err != nil {
+		return err
+	}
+
+	model, gpu := suggestModel(ps.Devices)
+	message := fmt.Sprintf("Goobla suggests %s to get started.\n\nDownload it now?", model)
+	if gpu != nil {
+		message = fmt.Sprintf("Goobla found %s with %s of memory, and suggests %s to get started.\n\nDownload it now?", gpuName(*gpu), format.HumanBytes2(uint64(gpu.TotalVRAM)), model)
+	}
+
+	ok, err := confirm("Get started with Goobla", message)
+	if err != nil {
+		return err
+	} else if !ok {
+		slog.Info("starter model declined", "model", model)
+		return openTerminal("")
+	}
+
+	notify := func(message string) {
+		if err := t.DisplayNotification("Getting started", message); err != nil {
+			slog.Debug(fmt.Sprintf("failed to notify: %s", err))
+		}
+	}
+
+	if err := pullStarter(ctx, client, model, notify); err != nil {
+		notify(fmt.Sprintf("Failed to download %s: %s", model, err))
+		return err
+	}
+
+	store.SetStarterModel(model)
+	notify(fmt.Sprintf("%s is ready", model))
+	return openTerminal(model)
+}
+
+// suggestModel returns the largest starter model that fits the GPU with the
+// most memory of devices, and that GPU.
+func suggestModel(devices []api.DeviceStatus) (string, *api.DeviceStatus) {
+	var gpu *api.DeviceStatus
+	for i, d := range devices {
+		if d.Status == deviceAvailable && (gpu == nil || d.TotalVRAM > gpu.TotalVRAM) {
+			gpu = &devices[i]
+		}
+	}
+
+	var memory uint64
+	if gpu != nil {
+		memory = uint64(gpu.TotalVRAM)
+	}
+
+	for _, m := range starterModels {
+		if memory >= m.memory {
+			return m.name, gpu
+		}
+	}
+
+	return starterModels[len(starterModels)-1].name, gpu
+}
+
+func gpuName(d api.DeviceStatus) string {
+	if d.Name != "" {
+		return d.Name
+	}
+
+	return fmt.Sprintf("a %s GPU", strings.ToUpper(d.Library))
+}
+
+// pullStarter pulls model, notifying of its progress every pullNotifyInterval.
+func pullStarter(ctx context.Context, client *api.Client, model string, notify func(string)) error {
+	notify(fmt.Sprintf("Downloading %s", model))
+
+	type layer struct{ completed, total int64 }
+	layers := make(map[string]layer)
+	last := time.Now()
+	return client.Pull(ctx, &api.PullRequest{Model: model}, func(resp api.ProgressResponse) error {
+		if resp.Digest == "" || resp.Total == 0 {
+			return nil
+		}
+		layers[resp.Digest] = layer{resp.Completed, resp.Total}
+
+		if time.Since(last) < pullNotifyInterval {
+			return nil
+		}
+		last = time.Now()
+
+		var completed, total int64
+		for _, l := range layers {
+			completed += l.completed
+			total += l.total
+		}
+
+		notify(fmt.Sprintf("Downloading %s: %d%% of %s", model, completed*100/total, format.HumanBytes(total)))
+		return nil
+	})
+}
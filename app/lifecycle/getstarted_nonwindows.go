@@ -4,6 +4,10 @@ package lifecycle
 
 import "errors"
 
-func GetStarted() error {
+func confirm(title, message string) (bool, error) {
+	return false, errors.New("not implemented")
+}
+
+func openTerminal(model string) error {
 	return errors.New("not implemented")
 }
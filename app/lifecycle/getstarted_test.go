@@ -0,0 +1,78 @@
+package lifecycle
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/goobla/goobla/api"
+)
+
+func TestSuggestModel(t *testing.T) {
+	cases := []struct {
+		name    string
+		devices []api.DeviceStatus
+		model   string
+		gpu     string
+	}{
+		{"no GPUs", nil, "llama3.2:1b", ""},
+		{"small GPU", []api.DeviceStatus{{ID: "0", Status: deviceAvailable, TotalVRAM: 6 << 30}}, "llama3.2", "0"},
+		{"largest GPU", []api.DeviceStatus{
+			{ID: "0", Status: deviceAvailable, TotalVRAM: 4 << 30},
+			{ID: "1", Status: deviceAvailable, TotalVRAM: 24 << 30},
+		}, "gemma3:12b", "1"},
+		{"missing GPU", []api.DeviceStatus{
+			{ID: "0", Status: deviceAvailable, TotalVRAM: 8 << 30},
+			{ID: "1", Status: "missing", TotalVRAM: 24 << 30},
+		}, "llama3.1:8b", "0"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			model, gpu := suggestModel(tt.devices)
+			require.Equal(t, tt.model, model)
+			if tt.gpu == "" {
+				require.Nil(t, gpu)
+			} else {
+				require.Equal(t, tt.gpu, gpu.ID)
+			}
+		})
+	}
+}
+
+func TestPullStarter(t *testing.T) {
+	oldInterval := pullNotifyInterval
+	defer func() { pullNotifyInterval = oldInterval }()
+	pullNotifyInterval = 0
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/pull", r.URL.Path)
+		enc := json.NewEncoder(w)
+		for _, p := range []api.ProgressResponse{
+			{Status: "pulling manifest"},
+			{Status: "pulling a", Digest: "sha256:a", Total: 300 << 20, Completed: 0},
+			{Status: "pulling b", Digest: "sha256:b", Total: 100 << 20, Completed: 100 << 20},
+			{Status: "pulling a", Digest: "sha256:a", Total: 300 << 20, Completed: 300 << 20},
+			{Status: "success"},
+		} {
+			require.NoError(t, enc.Encode(p))
+		}
+	}))
+	defer srv.Close()
+	t.Setenv("GOOBLA_HOST", srv.URL)
+
+	client, err := api.ClientFromEnvironment()
+	require.NoError(t, err)
+
+	var notified []string
+	require.NoError(t, pullStarter(t.Context(), client, "llama3.2", func(m string) { notified = append(notified, m) }))
+	require.Equal(t, []string{
+		"Downloading llama3.2",
+		"Downloading llama3.2: 0% of 314 MB",
+		"Downloading llama3.2: 25% of 419 MB",
+		"Downloading llama3.2: 100% of 419 MB",
+	}, notified)
+}
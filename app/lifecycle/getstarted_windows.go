@@ -7,15 +7,40 @@ import (
 	"os/exec"
 	"path/filepath"
 	"syscall"
+
+	"golang.org/x/sys/windows"
 )
 
-func GetStarted() error {
+func confirm(title, message string) (bool, error) {
+	const IDYES = 6
+	titlePtr, err := windows.UTF16PtrFromString(title)
+	if err != nil {
+		return false, err
+	}
+	messagePtr, err := windows.UTF16PtrFromString(message)
+	if err != nil {
+		return false, err
+	}
+
+	ret, err := windows.MessageBox(0, messagePtr, titlePtr, windows.MB_YESNO|windows.MB_ICONQUESTION|windows.MB_SETFOREGROUND)
+	if ret == 0 {
+		return false, err
+	}
+	return ret == IDYES, nil
+}
+
+// openTerminal opens a terminal with the getting started banner, chatting
+// with model if it's set.
+func openTerminal(model string) error {
 	const CREATE_NEW_CONSOLE = 0x00000010
 	var err error
 	bannerScript := filepath.Join(AppDir, "goobla_welcome.ps1")
 	args := []string{
 		"powershell", "-noexit", "-nologo", "-file", bannerScript,
 	}
+	if model != "" {
+		args = append(args, model)
+	}
 	args[0], err = exec.LookPath(args[0])
 	if err != nil {
 		return err
@@ -21,12 +21,17 @@ func Run() {
 	ctx, cancel := context.WithCancel(context.Background())
 	var done chan int
 
+	setProxy(store.GetProxy())
+	offlineMode.Store(store.GetOffline())
+
 	t, err := tray.NewTray()
 	if err != nil {
 		log.Fatalf("Failed to start: %s", err)
 	}
 	callbacks := t.GetCallbacks()
 
+	refresh := make(chan struct{}, 1)
+
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
@@ -36,6 +41,13 @@ func Run() {
 			select {
 			case <-callbacks.Quit:
 				slog.Debug("quit called")
+				if store.GetUpdateOnQuit() {
+					store.SetUpdateOnQuit(false)
+					err := DoUpgrade(cancel, done)
+					if err != nil {
+						slog.Warn(fmt.Sprintf("upgrade attempt failed: %s", err))
+					}
+				}
 				t.Quit()
 			case <-signals:
 				slog.Debug("shutting down due to signal")
@@ -45,13 +57,58 @@ func Run() {
 				if err != nil {
 					slog.Warn(fmt.Sprintf("upgrade attempt failed: %s", err))
 				}
+			case <-callbacks.UpdateOnQuit:
+				store.SetUpdateOnQuit(true)
+			case <-callbacks.RemindLater:
+				RemindLater()
+				if err := t.ClearUpdateAvailable(); err != nil {
+					slog.Warn(fmt.Sprintf("Failed to clear the update menu: %s", err))
+				}
+			case channel := <-callbacks.UpdateChannel:
+				// an update from the previous channel no longer applies
+				if channel != UpdateChannel() {
+					if err := SetUpdateChannel(channel); err != nil {
+						slog.Warn(fmt.Sprintf("Failed to set the update channel: %s", err))
+					} else if err := t.ClearUpdateAvailable(); err != nil {
+						slog.Warn(fmt.Sprintf("Failed to clear the update menu: %s", err))
+					}
+				}
+				if err := t.SetUpdateChannel(UpdateChannel()); err != nil {
+					slog.Warn(fmt.Sprintf("Failed to update the update channel menu: %s", err))
+				}
 			case <-callbacks.ShowLogs:
 				ShowLogs()
-			case <-callbacks.DoFirstUse:
-				err := GetStarted()
-				if err != nil {
-					slog.Warn(fmt.Sprintf("Failed to launch getting started shell: %s", err))
+			case <-callbacks.ShowModels:
+				ShowModels()
+			case name := <-callbacks.LoadModel:
+				go load(ctx, name, false, refresh)
+			case name := <-callbacks.UnloadModel:
+				go load(ctx, name, true, refresh)
+			case <-callbacks.ProxySettings:
+				go func() {
+					if err := EditProxy(t); err != nil {
+						slog.Warn(fmt.Sprintf("Failed to edit the proxy settings: %s", err))
+					}
+				}()
+			case enabled := <-callbacks.Offline:
+				SetOffline(enabled)
+				if err := t.SetOffline(offline()); err != nil {
+					slog.Warn(fmt.Sprintf("Failed to update the offline menu: %s", err))
 				}
+			case enabled := <-callbacks.StartOnLogin:
+				if err := SetStartOnLogin(enabled); err != nil {
+					slog.Warn(fmt.Sprintf("Failed to set start on login: %s", err))
+				}
+				if err := t.SetStartOnLogin(store.GetStartOnLogin()); err != nil {
+					slog.Warn(fmt.Sprintf("Failed to update the start on login menu: %s", err))
+				}
+			case <-callbacks.DoFirstUse:
+				go func() {
+					err := GetStarted(ctx, t)
+					if err != nil {
+						slog.Warn(fmt.Sprintf("Failed to get started: %s", err))
+					}
+				}()
 			}
 		}
 	}()
@@ -68,10 +125,18 @@ func Run() {
 		slog.Debug("Not first time, skipping first run notification")
 	}
 
-	if IsServerRunning(ctx) {
+	if serviceInstalled() {
+		slog.Info("using the goobla service")
+		done, err = useService(ctx)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Failed to start the goobla service, spawning a server instead %s", err))
+		}
+	}
+
+	if done == nil && IsServerRunning(ctx) {
 		slog.Info("Detected another instance of goobla running, exiting")
 		os.Exit(1)
-	} else {
+	} else if done == nil {
 		done, err = SpawnServer(ctx, CLIName)
 		if err != nil {
 			// TODO - should we retry in a backoff loop?
@@ -82,6 +147,26 @@ func Run() {
 		}
 	}
 
+	// Upgrades add the app back to the startup folder
+	if !store.GetStartOnLogin() {
+		if err := SetStartOnLogin(false); err != nil {
+			slog.Warn(fmt.Sprintf("Failed to turn off start on login: %s", err))
+		}
+	}
+	if err := t.SetStartOnLogin(store.GetStartOnLogin()); err != nil {
+		slog.Warn(fmt.Sprintf("Failed to update the start on login menu: %s", err))
+	}
+
+	if err := t.SetUpdateChannel(UpdateChannel()); err != nil {
+		slog.Warn(fmt.Sprintf("Failed to update the update channel menu: %s", err))
+	}
+
+	if err := t.SetOffline(offline()); err != nil {
+		slog.Warn(fmt.Sprintf("Failed to update the offline menu: %s", err))
+	}
+
+	go refreshModels(ctx, t, refresh)
+	go watchStatus(ctx, t)
 	StartBackgroundUpdaterChecker(ctx, t.UpdateAvailable)
 
 	t.Run()
@@ -92,3 +177,16 @@ func Run() {
 	}
 	slog.Info("Goobla app exiting")
 }
+
+// load loads or unloads the model name chosen from the models menu, then
+// refreshes the menu.
+func load(ctx context.Context, name string, unload bool, refresh chan<- struct{}) {
+	if err := loadModel(ctx, name, unload); err != nil {
+		slog.Warn(fmt.Sprintf("Failed to load or unload %s: %s", name, err))
+	}
+
+	select {
+	case refresh <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,87 @@
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/app/tray/commontray"
+)
+
+// modelsRefreshInterval is how often the models menu of the tray is refreshed
+// with the installed models and which of them are loaded.
+const modelsRefreshInterval = 10 * time.Second
+
+// refreshModels refreshes the models menu of t every modelsRefreshInterval,
+// and whenever refresh receives, until ctx is done.
+func refreshModels(ctx context.Context, t commontray.GooblaTray, refresh <-chan struct{}) {
+	ticker := time.NewTicker(modelsRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		if models, err := listModels(ctx); err != nil {
+			slog.Debug(fmt.Sprintf("failed to list models: %s", err))
+		} else if err := t.SetModels(models); err != nil {
+			slog.Warn(fmt.Sprintf("failed to update the models menu: %s", err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-refresh:
+		}
+	}
+}
+
+// listModels lists the installed models by name.
+func listModels(ctx context.Context) ([]commontray.Model, error) {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := client.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	running, err := client.ListRunning(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	loaded := make(map[string]bool)
+	for _, m := range running.Models {
+		loaded[m.Name] = true
+	}
+
+	models := make([]commontray.Model, 0, len(list.Models))
+	for _, m := range list.Models {
+		models = append(models, commontray.Model{Name: m.Name, Loaded: loaded[m.Name]})
+	}
+
+	slices.SortFunc(models, func(a, b commontray.Model) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return models, nil
+}
+
+// loadModel loads the model name, or unloads it if unload is set.
+func loadModel(ctx context.Context, name string, unload bool) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	req := &api.GenerateRequest{Model: name}
+	if unload {
+		req.KeepAlive = &api.Duration{Duration: 0}
+	}
+
+	return client.Generate(ctx, req, func(api.GenerateResponse) error { return nil })
+}
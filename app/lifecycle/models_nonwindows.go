@@ -0,0 +1,16 @@
+//go:build !windows
+
+package lifecycle
+
+import (
+	"errors"
+	"log/slog"
+)
+
+func ShowModels() {
+	slog.Warn("not implemented")
+}
+
+func SetStartOnLogin(enabled bool) error {
+	return errors.New("not implemented")
+}
@@ -0,0 +1,47 @@
+package lifecycle
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/app/tray/commontray"
+)
+
+func TestModels(t *testing.T) {
+	var generated []api.GenerateRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/tags":
+			json.NewEncoder(w).Encode(api.ListResponse{Models: []api.ListModelResponse{{Name: "qwen3:latest"}, {Name: "llama3.2:latest"}}}) //nolint:errcheck
+		case "/api/ps":
+			json.NewEncoder(w).Encode(api.ProcessResponse{Models: []api.ProcessModelResponse{{Name: "qwen3:latest"}}}) //nolint:errcheck
+		case "/api/generate":
+			var req api.GenerateRequest
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			generated = append(generated, req)
+			json.NewEncoder(w).Encode(api.GenerateResponse{Model: req.Model, Done: true}) //nolint:errcheck
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	t.Setenv("GOOBLA_HOST", srv.URL)
+
+	models, err := listModels(t.Context())
+	require.NoError(t, err)
+	require.Equal(t, []commontray.Model{{Name: "llama3.2:latest"}, {Name: "qwen3:latest", Loaded: true}}, models)
+
+	require.NoError(t, loadModel(t.Context(), "llama3.2:latest", false))
+	require.NoError(t, loadModel(t.Context(), "qwen3:latest", true))
+	require.Len(t, generated, 2)
+	require.Equal(t, "llama3.2:latest", generated[0].Model)
+	require.Nil(t, generated[0].KeepAlive)
+	require.Equal(t, "qwen3:latest", generated[1].Model)
+	require.NotNil(t, generated[1].KeepAlive)
+	require.Zero(t, generated[1].KeepAlive.Duration)
+}
@@ -0,0 +1,88 @@
+package lifecycle
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+
+	"github.com/goobla/goobla/app/store"
+	"github.com/goobla/goobla/envconfig"
+)
+
+// The installer adds a shortcut to the app to the startup folder. Turning
+// starting on login off removes it, and the choice is kept in the store so the
+// shortcut is removed again after an upgrade adds it back. Turning it on again
+// adds the app to the Run key of the user instead.
+const (
+	runKey   = `Software\Microsoft\Windows\CurrentVersion\Run`
+	runValue = "Goobla"
+)
+
+func ShowModels() {
+	dir, err := envconfig.Models()
+	if err != nil {
+		slog.Error(fmt.Sprintf("Failed to find models dir: %s", err))
+		return
+	}
+
+	cmd_path := "c:\\Windows\\system32\\cmd.exe"
+	slog.Debug(fmt.Sprintf("viewing models with start %s", dir))
+	cmd := exec.Command(cmd_path, "/c", "start", "", dir)
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: false, CreationFlags: 0x08000000}
+	if err := cmd.Start(); err != nil {
+		slog.Error(fmt.Sprintf("Failed to open models dir: %s", err))
+	}
+}
+
+// SetStartOnLogin sets whether the app is started when the user logs in.
+func SetStartOnLogin(enabled bool) error {
+	if err := setStartOnLogin(enabled); err != nil {
+		return err
+	}
+
+	store.SetStartOnLogin(enabled)
+	return nil
+}
+
+func setStartOnLogin(enabled bool) error {
+	dir, err := windows.KnownFolderPath(windows.FOLDERID_Startup, 0)
+	if err != nil {
+		return err
+	}
+
+	k, _, err := registry.CreateKey(registry.CURRENT_USER, runKey, registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer k.Close()
+
+	shortcut := filepath.Join(dir, "Goobla.lnk")
+	if !enabled {
+		if err := os.Remove(shortcut); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	// the shortcut of the installer starts the app if it's there
+	if _, err := os.Stat(shortcut); !enabled || err == nil {
+		if err := k.DeleteValue(runValue); err != nil && !errors.Is(err, registry.ErrNotExist) {
+			return err
+		}
+
+		return nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	return k.SetStringValue(runValue, `"`+exe+`"`)
+}
@@ -0,0 +1,31 @@
+package lifecycle
+
+import (
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/goobla/goobla/app/store"
+	"github.com/goobla/goobla/envconfig"
+)
+
+// offlineMode is whether Goobla is offline, loaded from the store by Run.
+// Goobla is also offline when GOOBLA_OFFLINE is set, which the app passes on
+// to the server it spawns, and then it doesn't check for updates.
+var offlineMode atomic.Bool
+
+func offline() bool {
+	return offlineMode.Load() || envconfig.Offline()
+}
+
+// SetOffline sets whether Goobla is offline, restarting the server to apply
+// it.
+func SetOffline(enabled bool) {
+	if enabled == offlineMode.Load() {
+		return
+	}
+
+	store.SetOffline(enabled)
+	offlineMode.Store(enabled)
+	slog.Info("offline mode changed, restarting the server", "offline", enabled)
+	RestartServer()
+}
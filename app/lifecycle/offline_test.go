@@ -0,0 +1,32 @@
+package lifecycle
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOffline(t *testing.T) {
+	var checked bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checked = true
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	base := UpdateCheckURLBase
+	UpdateCheckURLBase = srv.URL
+	defer func() { UpdateCheckURLBase = base }()
+
+	t.Setenv("GOOBLA_OFFLINE", "")
+	require.Nil(t, serverEnv())
+
+	t.Setenv("GOOBLA_OFFLINE", "1")
+	available, _ := IsNewReleaseAvailable(t.Context())
+	require.False(t, available)
+	require.False(t, checked, "expected no update check offline")
+	require.True(t, slices.Contains(serverEnv(), "GOOBLA_OFFLINE=1"))
+}
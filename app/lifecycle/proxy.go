@@ -0,0 +1,196 @@
+package lifecycle
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/http/httpproxy"
+
+	"github.com/goobla/goobla/app/store"
+	"github.com/goobla/goobla/app/tray/commontray"
+)
+
+// The proxy settings of the app are passed to the server it spawns in the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables, and used by the
+// updater. Without settings, both use the proxy of the environment. A proxy
+// auto-config script is evaluated for the registry to configure the server,
+// since that's where it pulls models from, and for each request of the
+// updater.
+
+// proxyTarget is the URL the proxy auto-config script is evaluated for to
+// configure the server.
+const proxyTarget = "https://registry.goobla.ai/"
+
+var (
+	// proxy is the proxy settings, loaded from the store by Run
+	proxy atomic.Pointer[store.Proxy]
+
+	// editingProxy is whether the proxy settings dialog is open
+	editingProxy atomic.Bool
+)
+
+func getProxy() store.Proxy {
+	if p := proxy.Load(); p != nil {
+		return *p
+	}
+	return store.Proxy{}
+}
+
+func setProxy(p store.Proxy) {
+	proxy.Store(&p)
+}
+
+// proxyConfig returns the proxy configuration of p for requests to target, or
+// of the environment if p is empty. If the proxy auto-config script of p
+// can't be evaluated, its other settings are used.
+func proxyConfig(p store.Proxy, target string) *httpproxy.Config {
+	if p == (store.Proxy{}) {
+		return httpproxy.FromEnvironment()
+	}
+
+	c := &httpproxy.Config{HTTPProxy: p.HTTP, HTTPSProxy: p.HTTPS, NoProxy: p.NoProxy}
+	if p.PAC != "" {
+		pac, err := resolvePAC(p.PAC, target)
+		if err == nil {
+			c.HTTPProxy, c.HTTPSProxy = pac, pac
+			return c
+		}
+		slog.Warn(fmt.Sprintf("failed to evaluate the proxy auto-config script %s: %s", p.PAC, err))
+	}
+
+	if p.SOCKS5 != "" {
+		socks := p.SOCKS5
+		if !strings.Contains(socks, "://") {
+			socks = "socks5://" + socks
+		}
+		c.HTTPProxy = cmp.Or(c.HTTPProxy, socks)
+		c.HTTPSProxy = cmp.Or(c.HTTPSProxy, socks)
+	}
+
+	return c
+}
+
+// proxyEnv returns the environment variables that configure the server to use
+// the proxy of p, or nil if p is empty so the server uses the proxy of the
+// environment.
+func proxyEnv(p store.Proxy) []string {
+	if p == (store.Proxy{}) {
+		return nil
+	}
+
+	c := proxyConfig(p, proxyTarget)
+	var env []string
+	for _, v := range []struct{ name, val string }{
+		{"HTTP_PROXY", c.HTTPProxy},
+		{"HTTPS_PROXY", c.HTTPSProxy},
+		{"NO_PROXY", c.NoProxy},
+	} {
+		// the lowercase variables are used when the uppercase ones are empty
+		env = append(env, v.name+"="+v.val, strings.ToLower(v.name)+"="+v.val)
+	}
+	return env
+}
+
+// proxyFromSettings returns the proxy for req of the proxy settings, for the
+// Proxy of an [http.Transport].
+func proxyFromSettings(req *http.Request) (*url.URL, error) {
+	return proxyConfig(getProxy(), req.URL.String()).ProxyFunc()(req.URL)
+}
+
+// updateClient is the client of the updater.
+var updateClient = &http.Client{Transport: func() http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = proxyFromSettings
+	return t
+}()}
+
+// pacProxy returns the first proxy of list, the proxies a proxy auto-config
+// script returned such as "PROXY proxy:8080; DIRECT", or WinHTTP returned such
+// as "socks=proxy:1080", as a URL, or "" if it's to connect directly.
+func pacProxy(list string) string {
+	fields := strings.Fields(strings.ReplaceAll(list, ";", " "))
+	if len(fields) == 0 {
+		return ""
+	}
+
+	switch strings.ToUpper(fields[0]) {
+	case "DIRECT":
+		return ""
+	case "PROXY", "HTTP":
+		if len(fields) > 1 {
+			return fields[1]
+		}
+	case "HTTPS":
+		if len(fields) > 1 {
+			return "https://" + fields[1]
+		}
+	case "SOCKS", "SOCKS5":
+		if len(fields) > 1 {
+			return "socks5://" + fields[1]
+		}
+	}
+
+	scheme, host, ok := strings.Cut(fields[0], "=")
+	if !ok {
+		return fields[0]
+	}
+
+	if strings.EqualFold(scheme, "socks") {
+		return "socks5://" + host
+	}
+	return host
+}
+
+// validateProxy checks that the proxies of p are URLs or host and port pairs.
+func validateProxy(p store.Proxy) error {
+	var errs []error
+	for _, s := range []struct{ name, val, scheme string }{
+		{"HTTP proxy", p.HTTP, "http://"},
+		{"HTTPS proxy", p.HTTPS, "http://"},
+		{"SOCKS5 proxy", p.SOCKS5, "socks5://"},
+		{"proxy auto-config URL", p.PAC, "http://"},
+	} {
+		if s.val == "" {
+			continue
+		}
+
+		val := s.val
+		if !strings.Contains(val, "://") {
+			val = s.scheme + val
+		}
+		if u, err := url.Parse(val); err != nil || (u.Host == "" && u.Scheme != "file") {
+			errs = append(errs, fmt.Errorf("%s %q isn't a URL", s.name, s.val))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// EditProxy shows the proxy settings dialog and applies the settings that are
+// saved, restarting the server.
+func EditProxy(t commontray.GooblaTray) error {
+	if !editingProxy.CompareAndSwap(false, true) {
+		return nil
+	}
+	defer editingProxy.Store(false)
+
+	p, ok, err := proxyDialog(getProxy())
+	if err != nil || !ok {
+		return err
+	}
+
+	if err := validateProxy(p); err != nil {
+		return t.DisplayNotification("Invalid proxy settings", err.Error())
+	}
+
+	store.SetProxy(p)
+	setProxy(p)
+	slog.Info("proxy settings changed, restarting the server")
+	RestartServer()
+	return nil
+}
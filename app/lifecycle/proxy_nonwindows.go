@@ -0,0 +1,17 @@
+//go:build !windows
+
+package lifecycle
+
+import (
+	"errors"
+
+	"github.com/goobla/goobla/app/store"
+)
+
+func resolvePAC(pacURL, target string) (string, error) {
+	return "", errors.New("not implemented")
+}
+
+func proxyDialog(p store.Proxy) (store.Proxy, bool, error) {
+	return p, false, errors.New("not implemented")
+}
@@ -0,0 +1,68 @@
+package lifecycle
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/goobla/goobla/app/store"
+)
+
+func TestProxy(t *testing.T) {
+	t.Setenv("HTTPS_PROXY", "http://env.example.com:3128")
+
+	// without settings the environment's proxy is used
+	require.Nil(t, proxyEnv(store.Proxy{}))
+	require.Equal(t, "http://env.example.com:3128", proxyConfig(store.Proxy{}, proxyTarget).HTTPSProxy)
+
+	p := store.Proxy{HTTP: "proxy.example.com:8080", SOCKS5: "socks.example.com:1080", NoProxy: "localhost,.corp"}
+	require.Equal(t, []string{
+		"HTTP_PROXY=proxy.example.com:8080", "http_proxy=proxy.example.com:8080",
+		"HTTPS_PROXY=socks5://socks.example.com:1080", "https_proxy=socks5://socks.example.com:1080",
+		"NO_PROXY=localhost,.corp", "no_proxy=localhost,.corp",
+	}, proxyEnv(p))
+
+	setProxy(p)
+	defer setProxy(store.Proxy{})
+
+	req, err := http.NewRequest(http.MethodGet, "https://goobla.com/api/update", nil)
+	require.NoError(t, err)
+	u, err := proxyFromSettings(req)
+	require.NoError(t, err)
+	require.Equal(t, "socks5://socks.example.com:1080", u.String())
+
+	req, err = http.NewRequest(http.MethodGet, "https://updates.corp/api/update", nil)
+	require.NoError(t, err)
+	u, err = proxyFromSettings(req)
+	require.NoError(t, err)
+	require.Nil(t, u)
+}
+
+func TestPACProxy(t *testing.T) {
+	cases := map[string]string{
+		"":                              "",
+		"DIRECT":                        "",
+		"PROXY proxy:8080; DIRECT":      "proxy:8080",
+		"SOCKS5 socks:1080":             "socks5://socks:1080",
+		"HTTPS proxy:443":               "https://proxy:443",
+		"proxy1:8080;proxy2:8080":       "proxy1:8080",
+		"socks=socks:1080":              "socks5://socks:1080",
+		"https=proxy:443 http=proxy:80": "proxy:443",
+	}
+
+	for list, want := range cases {
+		require.Equal(t, want, pacProxy(list), list)
+	}
+}
+
+func TestValidateProxy(t *testing.T) {
+	require.NoError(t, validateProxy(store.Proxy{}))
+	require.NoError(t, validateProxy(store.Proxy{
+		HTTP:   "proxy.example.com:8080",
+		HTTPS:  "https://proxy.example.com",
+		SOCKS5: "socks.example.com:1080",
+		PAC:    "file:///C:/proxy.pac",
+	}))
+	require.ErrorContains(t, validateProxy(store.Proxy{HTTPS: "http://"}), "HTTPS proxy")
+}
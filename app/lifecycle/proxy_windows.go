@@ -0,0 +1,126 @@
+package lifecycle
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/goobla/goobla/app/store"
+)
+
+var (
+	winhttp                = windows.NewLazySystemDLL("winhttp.dll")
+	pWinHttpOpen           = winhttp.NewProc("WinHttpOpen")
+	pWinHttpCloseHandle    = winhttp.NewProc("WinHttpCloseHandle")
+	pWinHttpGetProxyForUrl = winhttp.NewProc("WinHttpGetProxyForUrl")
+
+	k32         = windows.NewLazySystemDLL("kernel32.dll")
+	pGlobalFree = k32.NewProc("GlobalFree")
+)
+
+const (
+	WINHTTP_ACCESS_TYPE_NO_PROXY = 1
+	WINHTTP_AUTOPROXY_CONFIG_URL = 0x00000002
+)
+
+// https://learn.microsoft.com/en-us/windows/win32/api/winhttp/ns-winhttp-winhttp_autoproxy_options
+type winhttpAutoProxyOptions struct {
+	Flags                 uint32
+	AutoDetectFlags       uint32
+	AutoConfigURL         *uint16
+	Reserved              uintptr
+	Reserved2             uint32
+	AutoLogonIfChallenged int32
+}
+
+// https://learn.microsoft.com/en-us/windows/win32/api/winhttp/ns-winhttp-winhttp_proxy_info
+type winhttpProxyInfo struct {
+	AccessType  uint32
+	Proxy       *uint16
+	ProxyBypass *uint16
+}
+
+// resolvePAC evaluates the proxy auto-config script at pacURL for target with
+// WinHTTP, returning the proxy to use or "" to connect directly.
+func resolvePAC(pacURL, target string) (string, error) {
+	session, _, err := pWinHttpOpen.Call(0, WINHTTP_ACCESS_TYPE_NO_PROXY, 0, 0, 0)
+	if session == 0 {
+		return "", fmt.Errorf("WinHttpOpen: %w", err)
+	}
+	defer pWinHttpCloseHandle.Call(session) //nolint:errcheck
+
+	pacURLPtr, err := windows.UTF16PtrFromString(pacURL)
+	if err != nil {
+		return "", err
+	}
+	targetPtr, err := windows.UTF16PtrFromString(target)
+	if err != nil {
+		return "", err
+	}
+
+	options := winhttpAutoProxyOptions{
+		Flags:                 WINHTTP_AUTOPROXY_CONFIG_URL,
+		AutoConfigURL:         pacURLPtr,
+		AutoLogonIfChallenged: 1,
+	}
+	var info winhttpProxyInfo
+	ret, _, err := pWinHttpGetProxyForUrl.Call(session, uintptr(unsafe.Pointer(targetPtr)), uintptr(unsafe.Pointer(&options)), uintptr(unsafe.Pointer(&info)))
+	if ret == 0 {
+		return "", fmt.Errorf("WinHttpGetProxyForUrl: %w", err)
+	}
+
+	if info.ProxyBypass != nil {
+		pGlobalFree.Call(uintptr(unsafe.Pointer(info.ProxyBypass))) //nolint:errcheck
+	}
+	if info.Proxy == nil {
+		return "", nil
+	}
+	defer pGlobalFree.Call(uintptr(unsafe.Pointer(info.Proxy))) //nolint:errcheck
+
+	if info.AccessType == WINHTTP_ACCESS_TYPE_NO_PROXY {
+		return "", nil
+	}
+	return pacProxy(windows.UTF16PtrToString(info.Proxy)), nil
+}
+
+// proxyDialog shows the proxy settings dialog with the settings p, returning
+// the settings that are saved or false if it's cancelled.
+func proxyDialog(p store.Proxy) (store.Proxy, bool, error) {
+	const CREATE_NO_WINDOW = 0x08000000
+	script := filepath.Join(AppDir, "goobla_proxy.ps1")
+	if _, err := os.Stat(script); err != nil {
+		return p, false, fmt.Errorf("proxy settings script error %s", err)
+	}
+
+	in, err := json.Marshal(p)
+	if err != nil {
+		return p, false, err
+	}
+
+	cmd := exec.Command("powershell", "-noprofile", "-nologo", "-executionpolicy", "bypass", "-file", script)
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: CREATE_NO_WINDOW, HideWindow: true}
+	cmd.Stdin = bytes.NewReader(in)
+	out, err := cmd.Output()
+	if err != nil {
+		return p, false, fmt.Errorf("proxy settings dialog failed: %w", err)
+	}
+
+	// nothing is written when the dialog is cancelled
+	out = bytes.TrimSpace(out)
+	if len(out) == 0 {
+		return p, false, nil
+	}
+
+	var saved store.Proxy
+	if err := json.Unmarshal(out, &saved); err != nil {
+		return p, false, fmt.Errorf("proxy settings dialog failed: %w", err)
+	}
+	return saved, true, nil
+}
@@ -51,6 +51,7 @@ func getCLIFullPath(command string) string {
 
 func start(ctx context.Context, command string) (*exec.Cmd, error) {
 	cmd := getCmd(ctx, getCLIFullPath(command))
+	cmd.Env = serverEnv()
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return nil, fmt.Errorf("failed to spawn server stdout pipe: %w", err)
@@ -131,6 +132,33 @@ func start(ctx context.Context, command string) (*exec.Cmd, error) {
 	return cmd, nil
 }
 
+// serverEnv returns the environment of the server with the proxy and offline
+// settings of the app, or nil if it's the environment of the app.
+func serverEnv() []string {
+	env := proxyEnv(getProxy())
+	if offline() {
+		env = append(env, "GOOBLA_OFFLINE=1")
+	}
+
+	if env == nil {
+		return nil
+	}
+	return append(os.Environ(), env...)
+}
+
+// restartServer receives when the server spawned by SpawnServer should be
+// restarted.
+var restartServer = make(chan struct{}, 1)
+
+// RestartServer restarts the server spawned by SpawnServer, such as for it to
+// use new proxy settings.
+func RestartServer() {
+	select {
+	case restartServer <- struct{}{}:
+	default:
+	}
+}
+
 func SpawnServer(ctx context.Context, command string) (chan int, error) {
 	done := make(chan int)
 
@@ -139,15 +167,31 @@ func SpawnServer(ctx context.Context, command string) (chan int, error) {
 		crashCount := 0
 		for {
 			slog.Info("starting server...")
-			cmd, err := start(ctx, command)
+			serverCtx, cancel := context.WithCancel(ctx)
+			cmd, err := start(serverCtx, command)
 			if err != nil {
+				cancel()
 				crashCount++
 				slog.Error(fmt.Sprintf("failed to start server %s", err))
 				time.Sleep(500 * time.Millisecond * time.Duration(crashCount))
 				continue
 			}
 
+			exited := make(chan struct{})
+			restarting := make(chan bool, 1)
+			go func() {
+				select {
+				case <-restartServer:
+					restarting <- true
+					cancel()
+				case <-exited:
+					restarting <- false
+				}
+			}()
+
 			cmd.Wait() //nolint:errcheck
+			close(exited)
+			cancel()
 			var code int
 			if cmd.ProcessState != nil {
 				code = cmd.ProcessState.ExitCode()
@@ -159,6 +203,10 @@ func SpawnServer(ctx context.Context, command string) (chan int, error) {
 				done <- code
 				return
 			default:
+				if <-restarting {
+					slog.Info("restarting server")
+					continue
+				}
 				crashCount++
 				slog.Warn(fmt.Sprintf("server crash %d - exit code %d - respawning", crashCount, code))
 				time.Sleep(500 * time.Millisecond * time.Duration(crashCount))
@@ -0,0 +1,68 @@
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// The server can be registered as a service of the OS, a Windows service or a
+// systemd user unit, with the service subcommands of the app, so it runs
+// without the app, such as before anyone logs in. When the service is
+// installed, the app starts it if it isn't running instead of spawning a server
+// of its own, and leaves it running when the app exits.
+
+const (
+	serviceName        = "Goobla"
+	serviceDescription = "Runs the Goobla server"
+)
+
+// ServiceCommand runs the service subcommand args[0] of the app, one of
+// install, uninstall, start or stop.
+func ServiceCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s service install|uninstall|start|stop", AppName)
+	}
+
+	switch args[0] {
+	case "install":
+		return installService()
+	case "uninstall":
+		return uninstallService()
+	case "start":
+		return startService()
+	case "stop":
+		return stopService()
+	case "run":
+		// run is how the service manager runs the service rather than a
+		// subcommand for users
+		return runService()
+	default:
+		return fmt.Errorf("unknown service command %q", args[0])
+	}
+}
+
+// useService starts the service if it isn't running. Its done channel receives
+// once ctx is done, like the one of SpawnServer, but the service is left
+// running.
+func useService(ctx context.Context) (chan int, error) {
+	running, err := serviceRunning()
+	if err != nil {
+		return nil, err
+	}
+
+	if !running {
+		slog.Info("starting the goobla service")
+		if err := startService(); err != nil {
+			return nil, err
+		}
+	}
+
+	done := make(chan int, 1)
+	go func() {
+		<-ctx.Done()
+		done <- 0
+	}()
+
+	return done, nil
+}
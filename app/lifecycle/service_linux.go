@@ -0,0 +1,146 @@
+package lifecycle
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+const serviceUnit = "goobla.service"
+
+var unitTemplate = template.Must(template.New(serviceUnit).Funcs(template.FuncMap{"quote": systemdQuote}).Parse(`[Unit]
+Description={{ .Description }}
+After=network-online.target
+
+[Service]
+ExecStart={{ quote .Exec }} serve
+Restart=always
+RestartSec=3
+
+[Install]
+WantedBy=default.target
+`))
+
+// systemdQuote quotes s as one argument of a command line in a unit, such as
+// a path with spaces, escaping what systemd would otherwise interpret:
+// backslashes and quotes, "%" specifiers and "$" variables.
+func systemdQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$").Replace(s) + `"`
+}
+
+// systemctl runs systemctl for the units of the user.
+var systemctl = func(args ...string) error {
+	out, err := exec.Command("systemctl", append([]string{"--user"}, args...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s: %w: %s", strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+
+	return nil
+}
+
+func unitPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "systemd", "user", serviceUnit), nil
+}
+
+func serviceInstalled() bool {
+	p, err := unitPath()
+	if err != nil {
+		return false
+	}
+
+	_, err = os.Stat(p)
+	return err == nil
+}
+
+func serviceRunning() (bool, error) {
+	err := systemctl("is-active", "--quiet", serviceUnit)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// unitFile returns the unit of the service, which runs the CLI at exe.
+func unitFile(exe string) ([]byte, error) {
+	var b bytes.Buffer
+	if err := unitTemplate.Execute(&b, map[string]string{
+		"Description": serviceDescription,
+		"Exec":        exe,
+	}); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+func installService() error {
+	p, err := unitPath()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+
+	b, err := unitFile(getCLIFullPath(CLIName))
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(p, b, 0o644); err != nil {
+		return err
+	}
+
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+
+	return systemctl("enable", serviceUnit)
+}
+
+func uninstallService() error {
+	p, err := unitPath()
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(p); err != nil {
+		return fmt.Errorf("the service isn't installed: %w", err)
+	}
+
+	if err := systemctl("disable", "--now", serviceUnit); err != nil {
+		return err
+	}
+
+	if err := os.Remove(p); err != nil {
+		return err
+	}
+
+	return systemctl("daemon-reload")
+}
+
+func startService() error {
+	return systemctl("start", serviceUnit)
+}
+
+func stopService() error {
+	return systemctl("stop", serviceUnit)
+}
+
+// runService isn't used on Linux, where systemd runs the server directly.
+func runService() error {
+	return errors.New("the service is run by systemd")
+}
@@ -0,0 +1,107 @@
+package lifecycle
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSystemdService(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	var calls []string
+	active := false
+	oldSystemctl := systemctl
+	defer func() { systemctl = oldSystemctl }()
+	systemctl = func(args ...string) error {
+		calls = append(calls, strings.Join(args, " "))
+		switch args[0] {
+		case "start":
+			active = true
+		case "stop":
+			active = false
+		case "is-active":
+			if !active {
+				return &exec.ExitError{}
+			}
+		}
+		return nil
+	}
+
+	if serviceInstalled() {
+		t.Fatal("expected the service not to be installed")
+	}
+
+	if err := ServiceCommand([]string{"install"}); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := unitPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(b), "\nExecStart=\""+getCLIFullPath(CLIName)+"\" serve\n") || !strings.Contains(string(b), "\nWantedBy=default.target\n") {
+		t.Errorf("unexpected unit\n%s", b)
+	}
+
+	if !serviceInstalled() {
+		t.Error("expected the service to be installed")
+	}
+
+	if running, err := serviceRunning(); err != nil || running {
+		t.Errorf("expected the service not to be running, got %v, %v", running, err)
+	}
+
+	done, err := useService(t.Context())
+	if err != nil || done == nil {
+		t.Fatalf("expected the service to be used, got %v", err)
+	}
+
+	if running, err := serviceRunning(); err != nil || !running {
+		t.Errorf("expected the service to be running, got %v, %v", running, err)
+	}
+
+	if err := ServiceCommand([]string{"uninstall"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Dir(p)); err != nil || serviceInstalled() {
+		t.Errorf("expected the unit to be removed, got %v", err)
+	}
+
+	expect := []string{"daemon-reload", "enable goobla.service", "is-active --quiet goobla.service", "is-active --quiet goobla.service", "start goobla.service", "is-active --quiet goobla.service", "disable --now goobla.service", "daemon-reload"}
+	if !slices.Equal(calls, expect) {
+		t.Errorf("expected systemctl %q, got %q", expect, calls)
+	}
+
+	if err := ServiceCommand([]string{"restart"}); err == nil {
+		t.Error("expected an unknown command to fail")
+	}
+}
+
+func TestUnitFile(t *testing.T) {
+	for exe, want := range map[string]string{
+		"/usr/bin/goobla":           `ExecStart="/usr/bin/goobla" serve`,
+		"/opt/My Apps/goobla":       `ExecStart="/opt/My Apps/goobla" serve`,
+		`/opt/a "b" \c/goobla`:      `ExecStart="/opt/a \"b\" \\c/goobla" serve`,
+		"/home/u/100%/$HOME/goobla": `ExecStart="/home/u/100%%/$$HOME/goobla" serve`,
+	} {
+		b, err := unitFile(exe)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(string(b), "\n"+want+"\n") {
+			t.Errorf("%q: expected %s in\n%s", exe, want, b)
+		}
+	}
+}
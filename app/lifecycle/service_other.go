@@ -0,0 +1,17 @@
+//go:build !windows && !linux
+
+package lifecycle
+
+import "errors"
+
+var errServiceUnsupported = errors.New("the server can't be installed as a service on this platform")
+
+func serviceInstalled() bool { return false }
+
+func serviceRunning() (bool, error) { return false, errServiceUnsupported }
+
+func installService() error   { return errServiceUnsupported }
+func uninstallService() error { return errServiceUnsupported }
+func startService() error     { return errServiceUnsupported }
+func stopService() error      { return errServiceUnsupported }
+func runService() error       { return errServiceUnsupported }
@@ -0,0 +1,199 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceStopTimeout is how long stopping the service waits for it to stop.
+const serviceStopTimeout = 30 * time.Second
+
+// openService opens the service with the access rights access. Unlike
+// mgr.Connect, it only connects to the service manager, so it doesn't need an
+// administrator.
+func openService(access uint32) (*mgr.Service, error) {
+	m, err := windows.OpenSCManager(nil, nil, windows.SC_MANAGER_CONNECT)
+	if err != nil {
+		return nil, err
+	}
+	//nolint:errcheck
+	defer windows.CloseServiceHandle(m)
+
+	name, err := windows.UTF16PtrFromString(serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := windows.OpenService(m, name, access)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mgr.Service{Name: serviceName, Handle: h}, nil
+}
+
+func serviceInstalled() bool {
+	s, err := openService(windows.SERVICE_QUERY_STATUS)
+	if err != nil {
+		return false
+	}
+	s.Close()
+	return true
+}
+
+func serviceRunning() (bool, error) {
+	s, err := openService(windows.SERVICE_QUERY_STATUS)
+	if err != nil {
+		return false, err
+	}
+	defer s.Close()
+
+	status, err := s.Query()
+	if err != nil {
+		return false, err
+	}
+
+	return status.State == svc.Running || status.State == svc.StartPending, nil
+}
+
+func installService() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service manager, which needs an administrator: %w", err)
+	}
+	//nolint:errcheck
+	defer m.Disconnect()
+
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: serviceName,
+		Description: serviceDescription,
+		StartType:   mgr.StartAutomatic,
+	}, "service", "run")
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	return s.Start()
+}
+
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service manager, which needs an administrator: %w", err)
+	}
+	//nolint:errcheck
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err := stop(s); err != nil {
+		return err
+	}
+
+	return s.Delete()
+}
+
+func startService() error {
+	s, err := openService(windows.SERVICE_START)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err := s.Start(); err != nil && !errors.Is(err, windows.ERROR_SERVICE_ALREADY_RUNNING) {
+		return err
+	}
+
+	return nil
+}
+
+func stopService() error {
+	s, err := openService(windows.SERVICE_STOP | windows.SERVICE_QUERY_STATUS)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	return stop(s)
+}
+
+// stop stops the service s and waits for it to stop.
+func stop(s *mgr.Service) error {
+	status, err := s.Control(svc.Stop)
+	if errors.Is(err, windows.ERROR_SERVICE_NOT_ACTIVE) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(serviceStopTimeout)
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return errors.New("timed out waiting for the service to stop")
+		}
+
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runService runs the server as the service when the service manager starts it.
+func runService() error {
+	InitLogging()
+	return svc.Run(serviceName, service{})
+}
+
+type service struct{}
+
+// Execute spawns the server and keeps it running until the service manager
+// stops the service.
+func (service) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done, err := SpawnServer(ctx, CLIName)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Failed to spawn goobla server %s", err))
+		return false, 1
+	}
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for r := range requests {
+		switch r.Cmd {
+		case svc.Interrogate:
+			status <- r.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			slog.Info("stopping the goobla service")
+			status <- svc.Status{State: svc.StopPending}
+			cancel()
+			<-done
+			return false, 0
+		}
+	}
+
+	return false, 0
+}
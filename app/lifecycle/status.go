@@ -0,0 +1,72 @@
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/app/tray/commontray"
+	"github.com/goobla/goobla/format"
+)
+
+// statusRetryInterval is how long watchStatus waits to reconnect to the
+// server after its status stream ends.
+const statusRetryInterval = 5 * time.Second
+
+// watchStatus shows the state of the server in the icon and tooltip of t as
+// it changes, until ctx is done.
+func watchStatus(ctx context.Context, t commontray.GooblaTray) {
+	for {
+		client, err := api.ClientFromEnvironment()
+		if err == nil {
+			err = client.Status(ctx, func(status api.StatusResponse) error {
+				if err := t.SetStatus(status.State, statusToolTip(status)); err != nil {
+					slog.Warn(fmt.Sprintf("failed to update the tray status: %s", err))
+				}
+				return nil
+			})
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		// the server is unreachable while it's starting or restarting, which
+		// isn't an error
+		slog.Debug(fmt.Sprintf("status stream ended: %v", err))
+		if err := t.SetStatus("idle", commontray.ToolTip); err != nil {
+			slog.Warn(fmt.Sprintf("failed to update the tray status: %s", err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(statusRetryInterval):
+		}
+	}
+}
+
+// statusToolTip returns the tooltip of the tray for status, such as
+//
+//	Goobla - generating
+//	qwen3, llama3.2
+//	6.0 GiB of 8.0 GiB VRAM
+func statusToolTip(status api.StatusResponse) string {
+	lines := []string{commontray.ToolTip + " - " + status.State}
+	if status.Message != "" {
+		lines = append(lines, status.Message)
+	}
+
+	if len(status.Models) > 0 {
+		lines = append(lines, strings.Join(status.Models, ", "))
+	}
+
+	if status.TotalVRAM > 0 {
+		lines = append(lines, fmt.Sprintf("%s of %s VRAM", format.HumanBytes2(uint64(status.VRAM)), format.HumanBytes2(uint64(status.TotalVRAM))))
+	}
+
+	return strings.Join(lines, "\n")
+}
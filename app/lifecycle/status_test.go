@@ -0,0 +1,22 @@
+package lifecycle
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/goobla/goobla/api"
+)
+
+func TestStatusToolTip(t *testing.T) {
+	require.Equal(t, "Goobla - idle", statusToolTip(api.StatusResponse{State: "idle"}))
+
+	require.Equal(t, "Goobla - generating\nllama3.2, qwen3\n6.0 GiB of 8.0 GiB VRAM", statusToolTip(api.StatusResponse{
+		State:     "generating",
+		Models:    []string{"llama3.2", "qwen3"},
+		VRAM:      6 << 30,
+		TotalVRAM: 8 << 30,
+	}))
+
+	require.Equal(t, "Goobla - error\ncuda GPU 1 is missing", statusToolTip(api.StatusResponse{State: "error", Message: "cuda GPU 1 is missing"}))
+}
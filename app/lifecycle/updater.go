@@ -15,10 +15,13 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/goobla/goobla/app/store"
+	"github.com/goobla/goobla/app/tray/commontray"
 	"github.com/goobla/goobla/auth"
 	"github.com/goobla/goobla/version"
 )
@@ -27,16 +30,71 @@ var (
 	UpdateCheckURLBase  = "https://goobla.com/api/update"
 	UpdateDownloaded    = false
 	UpdateCheckInterval = 60 * 60 * time.Second
+
+	// UpdateRemindInterval is how long "remind me later" defers an update
+	UpdateRemindInterval = 24 * time.Hour
+
+	// updateCheck checks for an update without waiting for the next
+	// UpdateCheckInterval
+	updateCheck = make(chan struct{}, 1)
 )
 
+// UpdateChannel returns the channel updates are installed from.
+func UpdateChannel() string {
+	channel := store.GetUpdateChannel()
+	if !slices.Contains(commontray.UpdateChannels, channel) {
+		return commontray.UpdateChannels[0]
+	}
+	return channel
+}
+
+// SetUpdateChannel switches the channel updates are installed from to channel,
+// discarding an update downloaded from the previous one, and checks for an
+// update from it.
+func SetUpdateChannel(channel string) error {
+	if !slices.Contains(commontray.UpdateChannels, channel) {
+		return fmt.Errorf("unknown update channel %q", channel)
+	}
+
+	if channel == UpdateChannel() {
+		return nil
+	}
+
+	slog.Info("switching update channel", "channel", channel)
+	store.SetUpdateChannel(channel)
+	store.SetUpdateRemindAt(time.Time{})
+	cleanupOldDownloads()
+	UpdateDownloaded = false
+
+	select {
+	case updateCheck <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// RemindLater defers notifying of an available update for UpdateRemindInterval.
+func RemindLater() {
+	store.SetUpdateRemindAt(time.Now().Add(UpdateRemindInterval))
+}
+
 // TODO - maybe move up to the API package?
 type UpdateResponse struct {
 	UpdateURL     string `json:"url"`
 	UpdateVersion string `json:"version"`
+
+	// SHA256 is the hash of the installer at UpdateURL, and Deltas patches
+	// to it from earlier installers
+	SHA256 string        `json:"sha256,omitempty"`
+	Deltas []UpdateDelta `json:"deltas,omitempty"`
 }
 
 func IsNewReleaseAvailable(ctx context.Context) (bool, UpdateResponse) {
 	var updateResp UpdateResponse
+	if offline() {
+		slog.Debug("offline, not checking for updates")
+		return false, updateResp
+	}
 
 	requestURL, err := url.Parse(UpdateCheckURLBase)
 	if err != nil {
@@ -47,6 +105,7 @@ func IsNewReleaseAvailable(ctx context.Context) (bool, UpdateResponse) {
 	query.Add("os", runtime.GOOS)
 	query.Add("arch", runtime.GOARCH)
 	query.Add("version", version.Version)
+	query.Add("channel", UpdateChannel())
 	query.Add("ts", strconv.FormatInt(time.Now().Unix(), 10))
 
 	nonce, err := auth.NewNonce(rand.Reader, 16)
@@ -72,7 +131,7 @@ func IsNewReleaseAvailable(ctx context.Context) (bool, UpdateResponse) {
 	req.Header.Set("User-Agent", fmt.Sprintf("goobla/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
 
 	slog.Debug("checking for available update", "requestURL", requestURL)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := updateClient.Do(req)
 	if err != nil {
 		slog.Warn(fmt.Sprintf("failed to check for update: %s", err))
 		return false, updateResp
@@ -111,7 +170,7 @@ func DownloadNewRelease(ctx context.Context, updateResp UpdateResponse) error {
 		return err
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := updateClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("error checking update: %w", err)
 	}
@@ -139,10 +198,17 @@ func DownloadNewRelease(ctx context.Context, updateResp UpdateResponse) error {
 		return nil
 	}
 
+	err = downloadDelta(ctx, updateResp, stageFilename)
+	if err == nil {
+		UpdateDownloaded = true
+		return nil
+	}
+	slog.Debug(fmt.Sprintf("downloading the full update: %s", err))
+
 	cleanupOldDownloads()
 
 	req.Method = http.MethodGet
-	resp, err = http.DefaultClient.Do(req)
+	resp, err = updateClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("error checking update: %w", err)
 	}
@@ -165,6 +231,11 @@ func DownloadNewRelease(ctx context.Context, updateResp UpdateResponse) error {
 	if err != nil {
 		return fmt.Errorf("failed to read body response: %w", err)
 	}
+	if updateResp.SHA256 != "" {
+		if err := verifyInstaller(payload, updateResp.SHA256); err != nil {
+			return err
+		}
+	}
 	fp, err := os.OpenFile(stageFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o755)
 	if err != nil {
 		return fmt.Errorf("write payload %s: %w", stageFilename, err)
@@ -211,17 +282,21 @@ func StartBackgroundUpdaterChecker(ctx context.Context, cb func(string) error) {
 				if err != nil {
 					slog.Error(fmt.Sprintf("failed to download new release: %s", err))
 				}
-				err = cb(resp.UpdateVersion)
-				if err != nil {
-					slog.Warn(fmt.Sprintf("failed to register update available with tray: %s", err))
+				if remindAt := store.GetUpdateRemindAt(); time.Now().Before(remindAt) {
+					slog.Debug("update available, but deferred", "until", remindAt)
+				} else {
+					err = cb(resp.UpdateVersion)
+					if err != nil {
+						slog.Warn(fmt.Sprintf("failed to register update available with tray: %s", err))
+					}
 				}
 			}
 			select {
 			case <-ctx.Done():
 				slog.Debug("stopping background update checker")
 				return
-			default:
-				time.Sleep(UpdateCheckInterval)
+			case <-updateCheck:
+			case <-time.After(UpdateCheckInterval):
 			}
 		}
 	}()
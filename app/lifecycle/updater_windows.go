@@ -53,6 +53,15 @@ func DoUpgrade(cancel context.CancelFunc, done chan int) error {
 		slog.Warn("done chan was nil, not actually waiting")
 	}
 
+	// The service runs the files the installer replaces, so it's stopped,
+	// and the upgraded app starts it again
+	if serviceInstalled() {
+		slog.Info("Stopping the goobla service")
+		if err := stopService(); err != nil {
+			slog.Warn(fmt.Sprintf("failed to stop the goobla service: %s", err))
+		}
+	}
+
 	slog.Debug(fmt.Sprintf("starting installer: %s %v", installerExe, installArgs))
 	os.Chdir(filepath.Dir(UpgradeLogFile)) //nolint:errcheck
 	cmd := execCommand(installerExe, installArgs...)
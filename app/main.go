@@ -4,9 +4,20 @@ package main
 // go build -ldflags="-H windowsgui" .
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/goobla/goobla/app/lifecycle"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "service" {
+		if err := lifecycle.ServiceCommand(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	lifecycle.Run()
 }
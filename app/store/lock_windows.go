@@ -0,0 +1,31 @@
+package store
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockStore takes an exclusive lock on the store at path, which the returned
+// function releases.
+func lockStore(path string) (func(), error) {
+	if err := mkdirStore(path); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, getStoreMode())
+	if err != nil {
+		return nil, err
+	}
+
+	var ol windows.Overlapped
+	if err := windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, &ol); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, &ol) //nolint:errcheck
+		f.Close()
+	}, nil
+}
@@ -7,91 +7,327 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+// The store is kept in a JSON file. Changes are written to a temporary file
+// that then replaces it, so a crash never leaves it partly written, while
+// holding a lock on a file next to it, and the store is read again under the
+// lock first so concurrent writers, such as another instance of the app, don't
+// undo each other's changes. Version is the version of the schema of the
+// store, and a store of an earlier version is migrated when it's read.
+
+// storeVersion is the version of the schema of the store.
+const storeVersion = 1
+
+// migrations migrate a store of the version of their index to the next version.
+var migrations = []func(*Store){
+	// a store before it had a version has the same fields as version 1
+	func(*Store) {},
+}
+
 type Store struct {
-	ID           string `json:"id"`
-	FirstTimeRun bool   `json:"first-time-run"`
+	Version             int    `json:"version"`
+	ID                  string `json:"id"`
+	FirstTimeRun        bool   `json:"first-time-run"`
+	DisableStartOnLogin bool   `json:"disable-start-on-login"`
+
+	// SetupComplete is whether the first use setup pulled StarterModel
+	SetupComplete bool   `json:"setup-complete"`
+	StarterModel  string `json:"starter-model"`
+
+	UpdateChannel  string    `json:"update-channel"`
+	UpdateRemindAt time.Time `json:"update-remind-at"`
+	UpdateOnQuit   bool      `json:"update-on-quit"`
+
+	Proxy   Proxy `json:"proxy"`
+	Offline bool  `json:"offline"`
+}
+
+// Proxy is the proxy the server and the updater connect through. PAC is the
+// URL of a proxy auto-config script, which takes the place of HTTP, HTTPS and
+// SOCKS5 when it's set.
+type Proxy struct {
+	HTTP    string `json:"http,omitempty"`
+	HTTPS   string `json:"https,omitempty"`
+	SOCKS5  string `json:"socks5,omitempty"`
+	NoProxy string `json:"no-proxy,omitempty"`
+	PAC     string `json:"pac,omitempty"`
+}
+
+// redacted returns p with the credentials in its URLs hidden, so it can be
+// logged.
+func (p Proxy) redacted() Proxy {
+	p.HTTP = redactURL(p.HTTP)
+	p.HTTPS = redactURL(p.HTTPS)
+	p.SOCKS5 = redactURL(p.SOCKS5)
+	p.PAC = redactURL(p.PAC)
+	return p
+}
+
+// redactURL hides the user info of the URL s, which may not have a scheme,
+// such as "user:password@proxy:3128".
+func redactURL(s string) string {
+	at := strings.LastIndex(s, "@")
+	if at < 0 {
+		return s
+	}
+
+	start := 0
+	if i := strings.Index(s[:at], "://"); i >= 0 {
+		start = i + len("://")
+	}
+
+	return s[:start] + "xxxxx" + s[at:]
 }
 
 var (
-	lock  sync.Mutex
-	store Store
+	lock   sync.Mutex
+	store  Store
+	loaded bool
+
+	// storePath and legacyStorePath return the paths of the store and of
+	// where it was kept by earlier versions, if it was elsewhere
+	storePath       = getStorePath
+	legacyStorePath = getLegacyStorePath
 )
 
 func GetID() string {
-	lock.Lock()
-	defer lock.Unlock()
-	if store.ID == "" {
-		initStore()
-	}
-	return store.ID
+	return get(func(s *Store) string { return s.ID })
 }
 
 func GetFirstTimeRun() bool {
+	return get(func(s *Store) bool { return s.FirstTimeRun })
+}
+
+func SetFirstTimeRun(val bool) {
+	update(func(s *Store) { s.FirstTimeRun = val })
+}
+
+func GetStartOnLogin() bool {
+	return get(func(s *Store) bool { return !s.DisableStartOnLogin })
+}
+
+func SetStartOnLogin(val bool) {
+	update(func(s *Store) { s.DisableStartOnLogin = !val })
+}
+
+// GetStarterModel returns the model pulled by the first use setup, or "" if
+// it isn't complete
+func GetStarterModel() string {
+	return get(func(s *Store) string {
+		if !s.SetupComplete {
+			return ""
+		}
+		return s.StarterModel
+	})
+}
+
+func SetStarterModel(val string) {
+	update(func(s *Store) {
+		s.SetupComplete = true
+		s.StarterModel = val
+	})
+}
+
+func GetUpdateChannel() string {
+	return get(func(s *Store) string { return s.UpdateChannel })
+}
+
+func SetUpdateChannel(val string) {
+	update(func(s *Store) { s.UpdateChannel = val })
+}
+
+// GetUpdateRemindAt returns when to remind about an available update again
+func GetUpdateRemindAt() time.Time {
+	return get(func(s *Store) time.Time { return s.UpdateRemindAt })
+}
+
+func SetUpdateRemindAt(val time.Time) {
+	update(func(s *Store) { s.UpdateRemindAt = val })
+}
+
+// GetUpdateOnQuit returns whether to install the downloaded update when the
+// app quits
+func GetUpdateOnQuit() bool {
+	return get(func(s *Store) bool { return s.UpdateOnQuit })
+}
+
+func SetUpdateOnQuit(val bool) {
+	update(func(s *Store) { s.UpdateOnQuit = val })
+}
+
+func GetProxy() Proxy {
+	return get(func(s *Store) Proxy { return s.Proxy })
+}
+
+func SetProxy(val Proxy) {
+	update(func(s *Store) { s.Proxy = val })
+}
+
+// GetOffline returns whether Goobla doesn't connect to the network
+func GetOffline() bool {
+	return get(func(s *Store) bool { return s.Offline })
+}
+
+func SetOffline(val bool) {
+	update(func(s *Store) { s.Offline = val })
+}
+
+func get[T any](fn func(*Store) T) T {
 	lock.Lock()
 	defer lock.Unlock()
-	if store.ID == "" {
+	if !loaded {
 		initStore()
 	}
-	return store.FirstTimeRun
+	return fn(&store)
 }
 
-func SetFirstTimeRun(val bool) {
+// update applies fn to the store and writes it if that changed it.
+func update(fn func(*Store)) {
 	lock.Lock()
 	defer lock.Unlock()
-	if store.FirstTimeRun == val {
+
+	path := storePath()
+	unlock, err := lockStore(path)
+	if err != nil {
+		slog.Error(fmt.Sprintf("failed to lock store %s: %v", path, err))
 		return
 	}
-	store.FirstTimeRun = val
-	writeStore(getStorePath())
+	defer unlock()
+
+	initStore()
+	prev := store
+	fn(&store)
+	if store != prev {
+		writeStore(path)
+	}
 }
 
 // lock must be held
 func initStore() {
-	storeFile, err := os.Open(getStorePath())
+	loaded = true
+	path := storePath()
+	s, err := readStore(path)
+	legacy := false
+	if errors.Is(err, os.ErrNotExist) && legacyStorePath() != "" {
+		s, err = readStore(legacyStorePath())
+		legacy = err == nil
+	}
+
 	if err == nil {
-		defer storeFile.Close()
-		err = json.NewDecoder(storeFile).Decode(&store)
-		if err == nil {
-			slog.Debug(fmt.Sprintf("loaded existing store %s - ID: %s", getStorePath(), store.ID))
-			return
-		}
+		slog.Debug(fmt.Sprintf("loaded existing store %s - ID: %s", path, s.ID))
 	} else if !errors.Is(err, os.ErrNotExist) {
 		slog.Debug(fmt.Sprintf("unexpected error searching for store: %s", err))
 	}
-	slog.Debug("initializing new store")
-	store.ID = uuid.NewString()
-	writeStore(getStorePath())
+
+	store = s
+	if store.Version > storeVersion {
+		slog.Warn(fmt.Sprintf("store %s is of a newer version %d, not writing it", path, store.Version))
+		return
+	}
+
+	changed := legacy || store.Version < storeVersion
+	for store.Version < storeVersion {
+		slog.Info(fmt.Sprintf("migrating store %s from version %d", path, store.Version))
+		migrations[store.Version](&store)
+		store.Version++
+	}
+
+	if store.ID == "" {
+		slog.Debug("initializing new store")
+		store.ID = uuid.NewString()
+		changed = true
+	}
+
+	if changed {
+		writeStore(path)
+	}
+}
+
+func readStore(path string) (Store, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Store{}, err
+	}
+
+	var s Store
+	if err := json.Unmarshal(b, &s); err != nil {
+		return Store{}, err
+	}
+
+	return s, nil
 }
 
+// lock must be held
 func writeStore(storeFilename string) {
-	gooblaDir := filepath.Dir(storeFilename)
-	_, err := os.Stat(gooblaDir)
-	if errors.Is(err, os.ErrNotExist) {
-		if err := os.MkdirAll(gooblaDir, 0o755); err != nil {
-			slog.Error(fmt.Sprintf("create goobla dir %s: %v", gooblaDir, err))
-			return
-		}
+	if store.Version > storeVersion {
+		return
 	}
+
+	if err := mkdirStore(storeFilename); err != nil {
+		slog.Error(fmt.Sprintf("create goobla dir %s: %v", filepath.Dir(storeFilename), err))
+		return
+	}
+
 	payload, err := json.Marshal(store)
 	if err != nil {
 		slog.Error(fmt.Sprintf("failed to marshal store: %s", err))
 		return
 	}
-	fp, err := os.OpenFile(storeFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o755)
-	if err != nil {
+
+	if err := writeFileAtomic(storeFilename, payload, getStoreMode()); err != nil {
 		slog.Error(fmt.Sprintf("write store payload %s: %v", storeFilename, err))
 		return
 	}
-	defer fp.Close()
-	if n, err := fp.Write(payload); err != nil || n != len(payload) {
-		slog.Error(fmt.Sprintf("write store payload %s: %d vs %d -- %v", storeFilename, n, len(payload), err))
-		return
+	logged := store
+	logged.Proxy = store.Proxy.redacted()
+	if b, err := json.Marshal(logged); err == nil {
+		slog.Debug("Store contents: " + string(b))
 	}
-	slog.Debug("Store contents: " + string(payload))
 	slog.Info(fmt.Sprintf("wrote store: %s", storeFilename))
 }
+
+// mkdirStore creates the directory of the store at path, which everyone can
+// read if they can read the store.
+func mkdirStore(path string) error {
+	mode := os.FileMode(0o700)
+	if getStoreMode()&0o004 != 0 {
+		mode = 0o755
+	}
+
+	return os.MkdirAll(filepath.Dir(path), mode)
+}
+
+// writeFileAtomic writes b to a temporary file next to name that then
+// replaces it.
+func writeFileAtomic(name string, b []byte, mode os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := f.Chmod(mode); err != nil {
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), name)
+}
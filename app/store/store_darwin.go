@@ -11,3 +11,11 @@ func getStorePath() string {
 	home := os.Getenv("HOME")
 	return filepath.Join(home, "Library", "Application Support", "Goobla", "config.json")
 }
+
+func getLegacyStorePath() string {
+	return ""
+}
+
+func getStoreMode() os.FileMode {
+	return 0o600
+}
@@ -7,10 +7,32 @@ import (
 
 func getStorePath() string {
 	if os.Geteuid() == 0 {
-		// TODO where should we store this on linux for system-wide operation?
 		return "/etc/goobla/config.json"
 	}
 
-	home := os.Getenv("HOME")
-	return filepath.Join(home, ".goobla", "config.json")
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+	return filepath.Join(dir, "goobla", "config.json")
+}
+
+// getLegacyStorePath returns where the store was kept before it followed the
+// XDG base directory specification.
+func getLegacyStorePath() string {
+	if os.Geteuid() == 0 {
+		return ""
+	}
+
+	return filepath.Join(os.Getenv("HOME"), ".goobla", "config.json")
+}
+
+// getStoreMode returns the permissions of the store, which everyone can read
+// when it's system-wide.
+func getStoreMode() os.FileMode {
+	if os.Geteuid() == 0 {
+		return 0o644
+	}
+
+	return 0o600
 }
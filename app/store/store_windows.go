@@ -9,3 +9,11 @@ func getStorePath() string {
 	localAppData := os.Getenv("LOCALAPPDATA")
 	return filepath.Join(localAppData, "Goobla", "config.json")
 }
+
+func getLegacyStorePath() string {
+	return ""
+}
+
+func getStoreMode() os.FileMode {
+	return 0o600
+}
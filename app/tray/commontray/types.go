@@ -6,6 +6,18 @@ var (
 
 	UpdateIconName = "tray_upgrade"
 	IconName       = "tray"
+
+	// StatusIconNames are the icons shown while the server is in a state
+	// other than idle
+	StatusIconNames = map[string]string{
+		"generating":  "tray_generating",
+		"downloading": "tray_downloading",
+		"error":       "tray_error",
+	}
+
+	// UpdateChannels are the channels updates are installed from, the first
+	// being the default
+	UpdateChannels = []string{"stable", "beta", "nightly"}
 )
 
 type Callbacks struct {
@@ -13,12 +25,49 @@ type Callbacks struct {
 	Update     chan struct{}
 	DoFirstUse chan struct{}
 	ShowLogs   chan struct{}
+	ShowModels chan struct{}
+
+	// LoadModel and UnloadModel receive the name of a model chosen from the
+	// models menu
+	LoadModel   chan string
+	UnloadModel chan string
+
+	// RemindLater and UpdateOnQuit defer installing an available update for
+	// a while or until the app quits
+	RemindLater  chan struct{}
+	UpdateOnQuit chan struct{}
+
+	// UpdateChannel receives the update channel chosen from the menu
+	UpdateChannel chan string
+
+	// ProxySettings receives when the proxy settings should be edited
+	ProxySettings chan struct{}
+
+	// StartOnLogin receives whether the app should be started on login when
+	// it's toggled
+	StartOnLogin chan bool
+
+	// Offline receives whether Goobla should be offline when it's toggled
+	Offline chan bool
+}
+
+// Model is an installed model of the models menu.
+type Model struct {
+	Name   string
+	Loaded bool
 }
 
 type GooblaTray interface {
 	GetCallbacks() Callbacks
 	Run()
 	UpdateAvailable(ver string) error
+	ClearUpdateAvailable() error
+	SetUpdateChannel(channel string) error
 	DisplayFirstUseNotification() error
+	DisplayNotification(title, message string) error
+	SetModels(models []Model) error
+	SetStartOnLogin(enabled bool) error
+	SetOffline(enabled bool) error
+	SetStatus(state, toolTip string) error
 	Quit()
 }
@@ -24,5 +24,14 @@ func NewTray() (commontray.GooblaTray, error) {
 		return nil, fmt.Errorf("failed to load icon %s: %w", iconName, err)
 	}
 
-	return InitPlatformTray(icon, updateIcon)
+	statusIcons := make(map[string][]byte)
+	for state, name := range commontray.StatusIconNames {
+		iconName = name + extension
+		statusIcons[state], err = assets.GetIcon(iconName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load icon %s: %w", iconName, err)
+		}
+	}
+
+	return InitPlatformTray(icon, updateIcon, statusIcons)
 }
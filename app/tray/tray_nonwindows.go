@@ -8,6 +8,6 @@ import (
 	"github.com/goobla/goobla/app/tray/commontray"
 )
 
-func InitPlatformTray(icon, updateIcon []byte) (commontray.GooblaTray, error) {
+func InitPlatformTray(icon, updateIcon []byte, statusIcons map[string][]byte) (commontray.GooblaTray, error) {
 	return nil, errors.New("not implemented")
 }
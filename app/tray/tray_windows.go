@@ -5,6 +5,6 @@ import (
 	"github.com/goobla/goobla/app/tray/wintray"
 )
 
-func InitPlatformTray(icon, updateIcon []byte) (commontray.GooblaTray, error) {
-	return wintray.InitTray(icon, updateIcon)
+func InitPlatformTray(icon, updateIcon []byte, statusIcons map[string][]byte) (commontray.GooblaTray, error) {
+	return wintray.InitTray(icon, updateIcon, statusIcons)
 }
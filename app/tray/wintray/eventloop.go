@@ -81,6 +81,23 @@ func (t *winTray) wndProc(hWnd windows.Handle, message uint32, wParam, lParam ui
 			default:
 				slog.Error("no listener on Update")
 			}
+		case updateOnQuitMenuID:
+			if err := t.setMenuItemChecked(updateOnQuitMenuID, true); err != nil {
+				slog.Warn(fmt.Sprintf("failed to check menu item: %s", err))
+			}
+			select {
+			case t.callbacks.UpdateOnQuit <- struct{}{}:
+			// should not happen but in case not listening
+			default:
+				slog.Error("no listener on UpdateOnQuit")
+			}
+		case remindLaterMenuID:
+			select {
+			case t.callbacks.RemindLater <- struct{}{}:
+			// should not happen but in case not listening
+			default:
+				slog.Error("no listener on RemindLater")
+			}
 		case diagLogsMenuID:
 			select {
 			case t.callbacks.ShowLogs <- struct{}{}:
@@ -88,8 +105,62 @@ func (t *winTray) wndProc(hWnd windows.Handle, message uint32, wParam, lParam ui
 			default:
 				slog.Error("no listener on ShowLogs")
 			}
+		case modelsFolderMenuID:
+			select {
+			case t.callbacks.ShowModels <- struct{}{}:
+			// should not happen but in case not listening
+			default:
+				slog.Error("no listener on ShowModels")
+			}
+		case proxyMenuID:
+			select {
+			case t.callbacks.ProxySettings <- struct{}{}:
+			// should not happen but in case not listening
+			default:
+				slog.Error("no listener on ProxySettings")
+			}
+		case offlineMenuID:
+			select {
+			case t.callbacks.Offline <- !t.offline:
+			// should not happen but in case not listening
+			default:
+				slog.Error("no listener on Offline")
+			}
+		case startOnLoginMenuID:
+			select {
+			case t.callbacks.StartOnLogin <- !t.startOnLogin:
+			// should not happen but in case not listening
+			default:
+				slog.Error("no listener on StartOnLogin")
+			}
 		default:
-			slog.Debug(fmt.Sprintf("Unexpected menu item id: %d", menuItemId))
+			if channel, ok := updateChannel(uint32(menuItemId)); ok {
+				select {
+				case t.callbacks.UpdateChannel <- channel:
+				// should not happen but in case not listening
+				default:
+					slog.Error("no listener on UpdateChannel")
+				}
+				break
+			}
+
+			m, ok := t.model(uint32(menuItemId))
+			if !ok {
+				slog.Debug(fmt.Sprintf("Unexpected menu item id: %d", menuItemId))
+				break
+			}
+
+			callback := t.callbacks.LoadModel
+			if m.Loaded {
+				callback = t.callbacks.UnloadModel
+			}
+
+			select {
+			case callback <- m.Name:
+			// should not happen but in case not listening
+			default:
+				slog.Error("no listener on LoadModel or UnloadModel")
+			}
 		}
 	case WM_CLOSE:
 		boolRet, _, err := pDestroyWindow.Call(uintptr(t.window))
@@ -5,22 +5,77 @@ package wintray
 import (
 	"fmt"
 	"log/slog"
+	"slices"
+	"strings"
 	"unsafe"
 
 	"golang.org/x/sys/windows"
+
+	"github.com/goobla/goobla/app/tray/commontray"
 )
 
 const (
 	_ = iota
 	updateAvailableMenuID
 	updateMenuID
+	updateOnQuitMenuID
+	remindLaterMenuID
 	separatorMenuID
+	modelsMenuID
+	noModelsMenuID
+	modelsFolderMenuID
+	startOnLoginMenuID
+	offlineMenuID
+	updateChannelMenuID
+	proxyMenuID
+	modelsSeparatorMenuID
 	diagLogsMenuID
 	diagSeparatorMenuID
 	quitMenuID
+
+	// modelMenuID is the ID of the first model of the models menu
+	modelMenuID = 1000
+	// channelMenuID is the ID of the first channel of the update channel
+	// menu, in the order of commontray.UpdateChannels
+	channelMenuID = 2000
 )
 
 func (t *winTray) initMenus() error {
+	if err := t.createSubmenu(modelsMenuID); err != nil {
+		return fmt.Errorf("unable to create menu entries %w", err)
+	}
+	if err := t.addOrUpdateMenuItem(modelsMenuID, 0, modelsMenuTitle, false); err != nil {
+		return fmt.Errorf("unable to create menu entries %w", err)
+	}
+	if err := t.addOrUpdateMenuItem(noModelsMenuID, modelsMenuID, noModelsMenuTitle, true); err != nil {
+		return fmt.Errorf("unable to create menu entries %w", err)
+	}
+	if err := t.addOrUpdateMenuItem(modelsFolderMenuID, 0, modelsFolderMenuTitle, false); err != nil {
+		return fmt.Errorf("unable to create menu entries %w", err)
+	}
+	if err := t.addOrUpdateMenuItem(startOnLoginMenuID, 0, startOnLoginMenuTitle, false); err != nil {
+		return fmt.Errorf("unable to create menu entries %w", err)
+	}
+	if err := t.addOrUpdateMenuItem(offlineMenuID, 0, offlineMenuTitle, false); err != nil {
+		return fmt.Errorf("unable to create menu entries %w", err)
+	}
+	if err := t.createSubmenu(updateChannelMenuID); err != nil {
+		return fmt.Errorf("unable to create menu entries %w", err)
+	}
+	if err := t.addOrUpdateMenuItem(updateChannelMenuID, 0, updateChannelMenuTitle, false); err != nil {
+		return fmt.Errorf("unable to create menu entries %w", err)
+	}
+	for i, channel := range commontray.UpdateChannels {
+		if err := t.addOrUpdateMenuItem(channelMenuID+uint32(i), updateChannelMenuID, strings.ToUpper(channel[:1])+channel[1:], false); err != nil {
+			return fmt.Errorf("unable to create menu entries %w", err)
+		}
+	}
+	if err := t.addOrUpdateMenuItem(proxyMenuID, 0, proxyMenuTitle, false); err != nil {
+		return fmt.Errorf("unable to create menu entries %w", err)
+	}
+	if err := t.addSeparatorMenuItem(modelsSeparatorMenuID, 0); err != nil {
+		return fmt.Errorf("unable to create menu entries %w", err)
+	}
 	if err := t.addOrUpdateMenuItem(diagLogsMenuID, 0, diagLogsMenuTitle, false); err != nil {
 		return fmt.Errorf("unable to create menu entries %w\n", err)
 	}
@@ -42,19 +97,21 @@ func (t *winTray) UpdateAvailable(ver string) error {
 		if err := t.addOrUpdateMenuItem(updateMenuID, 0, updateMenuTitle, false); err != nil {
 			return fmt.Errorf("unable to create menu entries %w", err)
 		}
-		if err := t.addSeparatorMenuItem(separatorMenuID, 0); err != nil {
+		if err := t.addOrUpdateMenuItem(updateOnQuitMenuID, 0, updateOnQuitMenuTitle, false); err != nil {
 			return fmt.Errorf("unable to create menu entries %w", err)
 		}
-		iconFilePath, err := iconBytesToFilePath(wt.updateIcon)
-		if err != nil {
-			return fmt.Errorf("unable to write icon data to temp file: %w", err)
+		if err := t.addOrUpdateMenuItem(remindLaterMenuID, 0, remindLaterMenuTitle, false); err != nil {
+			return fmt.Errorf("unable to create menu entries %w", err)
 		}
-		if err := wt.setIcon(iconFilePath); err != nil {
-			return fmt.Errorf("unable to set icon: %w", err)
+		if err := t.addSeparatorMenuItem(separatorMenuID, 0); err != nil {
+			return fmt.Errorf("unable to create menu entries %w", err)
 		}
 		t.updateNotified = true
 
 		t.pendingUpdate = true
+		if err := t.SetStatus(t.status, t.toolTip); err != nil {
+			return err
+		}
 		// Now pop up the notification
 		t.muNID.Lock()
 		defer t.muNID.Unlock()
@@ -63,10 +120,134 @@ func (t *winTray) UpdateAvailable(ver string) error {
 		t.nid.Flags |= NIF_INFO
 		t.nid.Timeout = 10
 		t.nid.Size = uint32(unsafe.Sizeof(*wt.nid))
-		err = t.nid.modify()
-		if err != nil {
+		if err := t.nid.modify(); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// ClearUpdateAvailable removes the update menu entries and icon of
+// UpdateAvailable, which notifies again the next time it's called.
+func (t *winTray) ClearUpdateAvailable() error {
+	if !t.updateNotified {
+		return nil
+	}
+
+	for _, id := range []uint32{updateAvailableMenuID, updateMenuID, updateOnQuitMenuID, remindLaterMenuID, separatorMenuID} {
+		if err := t.removeMenuItem(id, 0); err != nil {
+			return fmt.Errorf("unable to remove menu entries %w", err)
+		}
+	}
+	t.updateNotified = false
+	t.pendingUpdate = false
+	return t.SetStatus(t.status, t.toolTip)
+}
+
+// SetStatus shows the icon of the server state and toolTip. The update icon
+// is shown instead of the idle one while an update is pending.
+func (t *winTray) SetStatus(state, toolTip string) error {
+	t.status = state
+	t.toolTip = toolTip
+
+	icon, ok := t.statusIcons[state]
+	switch {
+	case ok:
+	case t.pendingUpdate:
+		icon = t.updateIcon
+	default:
+		icon = t.normalIcon
+	}
+
+	iconFilePath, err := iconBytesToFilePath(icon)
+	if err != nil {
+		return fmt.Errorf("unable to write icon data to temp file: %w", err)
+	}
+	if err := t.setIcon(iconFilePath); err != nil {
+		return fmt.Errorf("unable to set icon: %w", err)
+	}
+	return nil
+}
+
+// SetUpdateChannel checks channel in the update channel menu.
+func (t *winTray) SetUpdateChannel(channel string) error {
+	for i, c := range commontray.UpdateChannels {
+		if err := t.setMenuItemChecked(channelMenuID+uint32(i), c == channel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateChannel returns the channel of the update channel menu with the menu
+// item ID menuItemId.
+func updateChannel(menuItemId uint32) (string, bool) {
+	if menuItemId < channelMenuID || menuItemId >= channelMenuID+uint32(len(commontray.UpdateChannels)) {
+		return "", false
+	}
+
+	return commontray.UpdateChannels[menuItemId-channelMenuID], true
+}
+
+// SetModels replaces the models of the models menu with models, checking the
+// ones that are loaded.
+func (t *winTray) SetModels(models []commontray.Model) error {
+	t.muModels.Lock()
+	defer t.muModels.Unlock()
+	if slices.Equal(t.models, models) {
+		return nil
+	}
+
+	for i := range t.models {
+		if err := t.removeMenuItem(modelMenuID+uint32(i), modelsMenuID); err != nil {
+			return fmt.Errorf("unable to remove menu entries %w", err)
+		}
+	}
+
+	if len(t.models) == 0 {
+		if err := t.removeMenuItem(noModelsMenuID, modelsMenuID); err != nil {
+			return fmt.Errorf("unable to remove menu entries %w", err)
+		}
+	}
+
+	t.models = nil
+	if len(models) == 0 {
+		if err := t.addOrUpdateMenuItem(noModelsMenuID, modelsMenuID, noModelsMenuTitle, true); err != nil {
+			return fmt.Errorf("unable to create menu entries %w", err)
+		}
+	}
+
+	for i, m := range models {
+		id := modelMenuID + uint32(i)
+		if err := t.addOrUpdateMenuItem(id, modelsMenuID, m.Name, false); err != nil {
+			return fmt.Errorf("unable to create menu entries %w", err)
+		}
+		t.models = append(t.models, m)
+		if err := t.setMenuItemChecked(id, m.Loaded); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// model returns the model of the models menu with the menu item ID menuItemId.
+func (t *winTray) model(menuItemId uint32) (commontray.Model, bool) {
+	t.muModels.RLock()
+	defer t.muModels.RUnlock()
+	if menuItemId < modelMenuID || menuItemId >= modelMenuID+uint32(len(t.models)) {
+		return commontray.Model{}, false
+	}
+
+	return t.models[menuItemId-modelMenuID], true
+}
+
+func (t *winTray) SetStartOnLogin(enabled bool) error {
+	t.startOnLogin = enabled
+	return t.setMenuItemChecked(startOnLoginMenuID, enabled)
+}
+
+func (t *winTray) SetOffline(enabled bool) error {
+	t.offline = enabled
+	return t.setMenuItemChecked(offlineMenuID, enabled)
+}
@@ -11,5 +11,14 @@ const (
 	quitMenuTitle            = "Quit Goobla"
 	updateAvailableMenuTitle = "An update is available"
 	updateMenuTitle          = "Restart to update"
+	updateOnQuitMenuTitle    = "Update when I quit"
+	remindLaterMenuTitle     = "Remind me tomorrow"
+	updateChannelMenuTitle   = "Update channel"
 	diagLogsMenuTitle        = "View logs"
+	modelsMenuTitle          = "Models"
+	noModelsMenuTitle        = "No models installed"
+	modelsFolderMenuTitle    = "Open models folder"
+	startOnLoginMenuTitle    = "Start on login"
+	offlineMenuTitle         = "Offline mode"
+	proxyMenuTitle           = "Proxy settings..."
 )
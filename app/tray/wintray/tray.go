@@ -54,10 +54,23 @@ type winTray struct {
 
 	pendingUpdate  bool
 	updateNotified bool // Only pop up the notification once - TODO consider daily nag?
+
+	// models are the models of the models menu, in the order of their menu
+	// item IDs from modelMenuID
+	models       []commontray.Model
+	muModels     sync.RWMutex
+	startOnLogin bool
+	offline      bool
 	// Callbacks
 	callbacks  commontray.Callbacks
 	normalIcon []byte
 	updateIcon []byte
+
+	// statusIcons are the icons of the server states other than idle, and
+	// status and toolTip the state and tooltip last set
+	statusIcons map[string][]byte
+	status      string
+	toolTip     string
 }
 
 var wt winTray
@@ -66,13 +79,24 @@ func (t *winTray) GetCallbacks() commontray.Callbacks {
 	return t.callbacks
 }
 
-func InitTray(icon, updateIcon []byte) (*winTray, error) {
+func InitTray(icon, updateIcon []byte, statusIcons map[string][]byte) (*winTray, error) {
 	wt.callbacks.Quit = make(chan struct{})
 	wt.callbacks.Update = make(chan struct{})
 	wt.callbacks.ShowLogs = make(chan struct{})
 	wt.callbacks.DoFirstUse = make(chan struct{})
+	wt.callbacks.ShowModels = make(chan struct{})
+	wt.callbacks.LoadModel = make(chan string)
+	wt.callbacks.UnloadModel = make(chan string)
+	wt.callbacks.StartOnLogin = make(chan bool)
+	wt.callbacks.Offline = make(chan bool)
+	wt.callbacks.RemindLater = make(chan struct{})
+	wt.callbacks.UpdateOnQuit = make(chan struct{})
+	wt.callbacks.UpdateChannel = make(chan string)
+	wt.callbacks.ProxySettings = make(chan struct{})
 	wt.normalIcon = icon
 	wt.updateIcon = updateIcon
+	wt.statusIcons = statusIcons
+	wt.toolTip = commontray.ToolTip
 	if err := wt.initInstance(); err != nil {
 		return nil, fmt.Errorf("Unable to init instance: %w\n", err)
 	}
@@ -226,6 +250,18 @@ func (t *winTray) createMenu() error {
 	return nil
 }
 
+func (t *winTray) createSubmenu(menuItemId uint32) error {
+	menuHandle, _, err := pCreatePopupMenu.Call()
+	if menuHandle == 0 {
+		return err
+	}
+
+	t.muMenus.Lock()
+	t.menus[menuItemId] = windows.Handle(menuHandle)
+	t.muMenus.Unlock()
+	return nil
+}
+
 // Contains information about a menu item.
 // https://msdn.microsoft.com/en-us/library/windows/desktop/ms647578(v=vs.85).aspx
 type menuItemInfo struct {
@@ -329,6 +365,49 @@ func (t *winTray) addSeparatorMenuItem(menuItemId, parentId uint32) error {
 	return nil
 }
 
+func (t *winTray) setMenuItemChecked(menuItemId uint32, checked bool) error {
+	mi := menuItemInfo{
+		Mask:  MIIM_STATE,
+		State: MFS_UNCHECKED,
+	}
+	mi.Size = uint32(unsafe.Sizeof(mi))
+	if checked {
+		mi.State = MFS_CHECKED
+	}
+
+	t.muMenuOf.RLock()
+	menu := t.menuOf[menuItemId]
+	t.muMenuOf.RUnlock()
+	boolRet, _, err := pSetMenuItemInfo.Call(
+		uintptr(menu),
+		uintptr(menuItemId),
+		0,
+		uintptr(unsafe.Pointer(&mi)),
+	)
+	if boolRet == 0 {
+		return fmt.Errorf("failed to set menu item: %w", err)
+	}
+
+	return nil
+}
+
+func (t *winTray) removeMenuItem(menuItemId, parentId uint32) error {
+	t.muMenus.RLock()
+	menu := uintptr(t.menus[parentId])
+	t.muMenus.RUnlock()
+	boolRet, _, err := pRemoveMenu.Call(
+		menu,
+		uintptr(menuItemId),
+		MF_BYCOMMAND,
+	)
+	if boolRet == 0 {
+		return err
+	}
+	t.delFromVisibleItems(parentId, menuItemId)
+
+	return nil
+}
+
 // func (t *winTray) hideMenuItem(menuItemId, parentId uint32) error {
 // 	const ERROR_SUCCESS syscall.Errno = 0
 
@@ -435,11 +514,13 @@ func (t *winTray) setIcon(src string) error {
 	defer t.muNID.Unlock()
 	t.nid.Icon = h
 	t.nid.Flags |= NIF_ICON | NIF_TIP
-	if toolTipUTF16, err := syscall.UTF16FromString(commontray.ToolTip); err == nil {
-		copy(t.nid.Tip[:], toolTipUTF16)
-	} else {
+	toolTipUTF16, err := syscall.UTF16FromString(t.toolTip)
+	if err != nil {
 		return err
 	}
+	// the tooltip is truncated to fit, keeping its terminating NUL
+	clear(t.nid.Tip[:])
+	copy(t.nid.Tip[:len(t.nid.Tip)-1], toolTipUTF16)
 	t.nid.Size = uint32(unsafe.Sizeof(*t.nid))
 
 	return t.nid.modify()
@@ -486,3 +567,16 @@ func (t *winTray) DisplayFirstUseNotification() error {
 
 	return t.nid.modify()
 }
+
+func (t *winTray) DisplayNotification(title, message string) error {
+	t.muNID.Lock()
+	defer t.muNID.Unlock()
+	clear(t.nid.InfoTitle[:])
+	clear(t.nid.Info[:])
+	copy(t.nid.InfoTitle[:], windows.StringToUTF16(title))
+	copy(t.nid.Info[:], windows.StringToUTF16(message))
+	t.nid.Flags |= NIF_INFO
+	t.nid.Size = uint32(unsafe.Sizeof(*wt.nid))
+
+	return t.nid.modify()
+}
@@ -29,6 +29,7 @@ var (
 	pPostQuitMessage       = u32.NewProc("PostQuitMessage")
 	pRegisterClass         = u32.NewProc("RegisterClassExW")
 	pRegisterWindowMessage = u32.NewProc("RegisterWindowMessageW")
+	pRemoveMenu            = u32.NewProc("RemoveMenu")
 	pSetForegroundWindow   = u32.NewProc("SetForegroundWindow")
 	pSetMenuInfo           = u32.NewProc("SetMenuInfo")
 	pSetMenuItemInfo       = u32.NewProc("SetMenuItemInfoW")
@@ -50,7 +51,9 @@ const (
 	LR_DEFAULTSIZE      = 0x00000040 // Loads default-size icon for windows(SM_CXICON x SM_CYICON) if cx, cy are set to zero
 	LR_LOADFROMFILE     = 0x00000010 // Loads the stand-alone image from the file
 	MF_BYCOMMAND        = 0x00000000
+	MFS_CHECKED         = 0x00000008
 	MFS_DISABLED        = 0x00000003
+	MFS_UNCHECKED       = 0x00000000
 	MFT_SEPARATOR       = 0x00000800
 	MFT_STRING          = 0x00000000
 	MIIM_BITMAP         = 0x00000080
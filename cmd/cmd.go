@@ -2,15 +2,18 @@ package cmd
 
 import (
 	"bufio"
+	"cmp"
 	"context"
 	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"math"
 	"net"
 	"net/http"
@@ -93,7 +96,14 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 	var reader io.Reader
 
 	filename, err := getModelfileName(cmd)
-	if os.IsNotExist(err) {
+	if from, _ := cmd.Flags().GetString("from"); from != "" {
+		// the model is created from the model or repository alone
+		if cmd.Flags().Changed("file") {
+			return errors.New("--from can't be used with --file")
+		}
+		reader = strings.NewReader("FROM " + from + "\n")
+		filename = ""
+	} else if os.IsNotExist(err) {
 		if filename == "" {
 			reader = strings.NewReader("FROM .\n")
 		} else {
@@ -116,6 +126,27 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	quantize, _ := cmd.Flags().GetString("quantize")
+	buildArgs, _ := cmd.Flags().GetStringArray("build-arg")
+
+	vars := make(map[string]string)
+	for _, a := range buildArgs {
+		k, v, ok := strings.Cut(a, "=")
+		if !ok {
+			return fmt.Errorf("invalid build argument %q, must be of the form NAME=value", a)
+		}
+		vars[k] = v
+	}
+
+	modelfile, err = modelfile.Build(parser.BuildOptions{
+		Dir:      filepath.Dir(filename),
+		Args:     vars,
+		Quantize: quantize,
+	})
+	if err != nil {
+		return err
+	}
+
 	status := "gathering model components"
 	spinner := progress.NewSpinner(status)
 	p.Add(status, spinner)
@@ -127,10 +158,10 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 	spinner.Stop()
 
 	req.Model = args[0]
-	quantize, _ := cmd.Flags().GetString("quantize")
 	if quantize != "" {
 		req.Quantize = quantize
 	}
+	req.Check, _ = cmd.Flags().GetBool("check")
 
 	client, err := api.ClientFromEnvironment()
 	if err != nil {
@@ -251,6 +282,181 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// quantizedName returns the name of the model name quantized to quantize,
+// with the quantization appended to its tag such as llama3:8b-q4_K_M.
+func quantizedName(name, quantize string) string {
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		return name + "-" + quantize
+	}
+	return name + ":" + quantize
+}
+
+func QuantizeHandler(cmd *cobra.Command, args []string) error {
+	quantize, _ := cmd.Flags().GetString("to")
+	if quantize == "" {
+		return errors.New("the quantization must be set with --to, e.g. --to q4_K_M")
+	}
+
+	name := quantizedName(args[0], quantize)
+	if len(args) > 1 {
+		name = args[1]
+	}
+
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	p := progress.NewProgress(os.Stderr)
+	defer p.Stop()
+
+	req := &api.CreateRequest{Model: name, From: args[0], Quantize: quantize}
+
+	if imatrix, _ := cmd.Flags().GetString("imatrix"); imatrix != "" {
+		f, err := os.Open(imatrix)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+
+		req.ImportanceMatrix, err = createBlob(cmd, client, imatrix, fmt.Sprintf("sha256:%x", h.Sum(nil)), p)
+		if err != nil {
+			return err
+		}
+	}
+
+	var status string
+	var spinner *progress.Spinner
+	bars := make(map[string]*progress.Bar)
+	fn := func(resp api.ProgressResponse) error {
+		if resp.Digest != "" {
+			bar, ok := bars[resp.Digest]
+			if !ok {
+				bar = progress.NewBar(resp.Status, resp.Total, resp.Completed)
+				bars[resp.Digest] = bar
+				p.Add(resp.Digest, bar)
+			}
+
+			bar.Set(resp.Completed)
+		} else if status != resp.Status {
+			if spinner != nil {
+				spinner.Stop()
+			}
+
+			status = resp.Status
+			spinner = progress.NewSpinner(status)
+			p.Add(status, spinner)
+		}
+
+		return nil
+	}
+
+	if err := client.Create(cmd.Context(), req, fn); err != nil {
+		return err
+	}
+
+	p.Stop()
+	fmt.Printf("created %s\n", name)
+	return nil
+}
+
+// metadataEdits returns the metadata set with --set, as JSON values or
+// strings if they aren't JSON, and removed with --unset.
+func metadataEdits(cmd *cobra.Command) (map[string]any, error) {
+	edits := make(map[string]any)
+
+	sets, _ := cmd.Flags().GetStringArray("set")
+	for _, set := range sets {
+		key, value, ok := strings.Cut(set, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid metadata %q, expected KEY=VALUE", set)
+		}
+
+		var v any
+		if err := json.Unmarshal([]byte(value), &v); err != nil {
+			v = value
+		}
+		edits[key] = v
+	}
+
+	if path, _ := cmd.Flags().GetString("chat-template"); path != "" {
+		bts, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		edits["tokenizer.chat_template"] = string(bts)
+	}
+
+	unsets, _ := cmd.Flags().GetStringArray("unset")
+	for _, key := range unsets {
+		edits[key] = nil
+	}
+
+	if len(edits) == 0 {
+		return nil, errors.New("no metadata to edit, set it with --set KEY=VALUE or remove it with --unset KEY")
+	}
+	return edits, nil
+}
+
+func EditHandler(cmd *cobra.Command, args []string) error {
+	edits, err := metadataEdits(cmd)
+	if err != nil {
+		return err
+	}
+
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	p := progress.NewProgress(os.Stderr)
+	defer p.Stop()
+
+	req := &api.EditRequest{Model: args[0], Metadata: edits}
+	if len(args) > 1 {
+		req.Destination = args[1]
+	}
+
+	var status string
+	var spinner *progress.Spinner
+	bars := make(map[string]*progress.Bar)
+	fn := func(resp api.ProgressResponse) error {
+		if resp.Digest != "" {
+			bar, ok := bars[resp.Digest]
+			if !ok {
+				bar = progress.NewBar(resp.Status, resp.Total, resp.Completed)
+				bars[resp.Digest] = bar
+				p.Add(resp.Digest, bar)
+			}
+
+			bar.Set(resp.Completed)
+		} else if status != resp.Status {
+			if spinner != nil {
+				spinner.Stop()
+			}
+
+			status = resp.Status
+			spinner = progress.NewSpinner(status)
+			p.Add(status, spinner)
+		}
+
+		return nil
+	}
+
+	if err := client.Edit(cmd.Context(), req, fn); err != nil {
+		return err
+	}
+
+	p.Stop()
+	fmt.Printf("edited %s\n", cmp.Or(req.Destination, req.Model))
+	return nil
+}
+
 func createBlob(cmd *cobra.Command, client *api.Client, path string, digest string, p *progress.Progress) (string, error) {
 	realPath, err := filepath.EvalSymlinks(path)
 	if err != nil {
@@ -270,6 +476,14 @@ func createBlob(cmd *cobra.Command, client *api.Client, path string, digest stri
 	}
 	fileSize := fileInfo.Size()
 
+	// a server on the same machine can link the file instead of receiving
+	// a copy, fall back to uploading it if that isn't possible
+	if abs, err := filepath.Abs(realPath); err == nil {
+		if _, err := client.LinkBlob(cmd.Context(), digest, &api.LinkBlobRequest{Path: abs}); err == nil {
+			return digest, nil
+		}
+	}
+
 	var pw progressWriter
 	status := fmt.Sprintf("copying file %s 0%%", digest)
 	spinner := progress.NewSpinner(status)
@@ -481,6 +695,11 @@ func PushHandler(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	rateLimit, err := rateLimitFlag(cmd)
+	if err != nil {
+		return err
+	}
+
 	p := progress.NewProgress(os.Stderr)
 	defer p.Stop()
 
@@ -515,7 +734,7 @@ func PushHandler(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
-	request := api.PushRequest{Name: args[0], Insecure: insecure}
+	request := api.PushRequest{Name: args[0], Insecure: insecure, RateLimit: rateLimit}
 
 	n := model.ParseName(args[0])
 	if err := client.Push(cmd.Context(), &request, fn); err != nil {
@@ -547,6 +766,14 @@ func ListHandler(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	verbose, _ := cmd.Flags().GetBool("verbose")
+	filters, _ := cmd.Flags().GetStringArray("filter")
+
+	match, err := listFilter(filters)
+	if err != nil {
+		return err
+	}
+
 	models, err := client.List(cmd.Context())
 	if err != nil {
 		return err
@@ -555,13 +782,26 @@ func ListHandler(cmd *cobra.Command, args []string) error {
 	var data [][]string
 
 	for _, m := range models.Models {
+		if !match(m) {
+			continue
+		}
+
 		if len(args) == 0 || strings.HasPrefix(strings.ToLower(m.Name), strings.ToLower(args[0])) {
-			data = append(data, []string{m.Name, m.Digest[:12], format.HumanBytes(m.Size), format.HumanTime(m.ModifiedAt, "Never")})
+			row := []string{m.Name, m.Digest[:12], format.HumanBytes(m.Size), format.HumanTime(m.ModifiedAt, "Never")}
+			if verbose {
+				row = append(row, format.HumanBytes(m.SharedSize))
+			}
+			data = append(data, row)
 		}
 	}
 
+	header := []string{"NAME", "ID", "SIZE", "MODIFIED"}
+	if verbose {
+		header = append(header, "SHARED")
+	}
+
 	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"NAME", "ID", "SIZE", "MODIFIED"})
+	table.SetHeader(header)
 	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
 	table.SetAlignment(tablewriter.ALIGN_LEFT)
 	table.SetHeaderLine(false)
@@ -571,9 +811,60 @@ func ListHandler(cmd *cobra.Command, args []string) error {
 	table.AppendBulk(data)
 	table.Render()
 
+	if verbose && models.Storage != nil {
+		st := models.Storage
+		fmt.Printf("\nTotal size: %s\n", format.HumanBytes(st.Size))
+		fmt.Printf("Disk usage: %s\n", format.HumanBytes(st.UniqueSize-st.LinkedSize))
+		fmt.Printf("Saved by shared layers: %s\n", format.HumanBytes(st.Size-st.UniqueSize))
+		fmt.Printf("Saved by linked files: %s\n", format.HumanBytes(st.LinkedSize))
+	}
+
 	return nil
 }
 
+// listFields are the fields models can be filtered by in goobla list.
+var listFields = map[string]func(api.ListModelResponse) string{
+	"family":       func(m api.ListModelResponse) string { return m.Details.Family },
+	"format":       func(m api.ListModelResponse) string { return m.Details.Format },
+	"license":      func(m api.ListModelResponse) string { return m.Metadata.License },
+	"parameters":   func(m api.ListModelResponse) string { return m.Details.ParameterSize },
+	"pinned":       func(m api.ListModelResponse) string { return strconv.FormatBool(m.Pinned) },
+	"quantization": func(m api.ListModelResponse) string { return m.Details.QuantizationLevel },
+}
+
+// listFilter returns a function reporting whether a model matches all of
+// filters, each of the form field=value. Values are compared ignoring case.
+func listFilter(filters []string) (func(api.ListModelResponse) bool, error) {
+	type filter struct {
+		field func(api.ListModelResponse) string
+		value string
+	}
+
+	var fs []filter
+	for _, f := range filters {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid filter %q, must be of the form field=value", f)
+		}
+
+		field, ok := listFields[strings.ToLower(k)]
+		if !ok {
+			return nil, fmt.Errorf("unknown filter field %q, must be one of %s", k, strings.Join(slices.Sorted(maps.Keys(listFields)), ", "))
+		}
+
+		fs = append(fs, filter{field, v})
+	}
+
+	return func(m api.ListModelResponse) bool {
+		for _, f := range fs {
+			if !strings.EqualFold(f.field(m), f.value) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
 func ListRunningHandler(cmd *cobra.Command, args []string) error {
 	client, err := api.ClientFromEnvironment()
 	if err != nil {
@@ -610,12 +901,12 @@ func ListRunningHandler(cmd *cobra.Command, args []string) error {
 			} else {
 				until = format.HumanTime(m.ExpiresAt, "Never")
 			}
-			data = append(data, []string{m.Name, m.Digest[:12], format.HumanBytes(m.Size), procStr, until})
+			data = append(data, []string{m.Name, m.Digest[:12], format.HumanBytes(m.Size), procStr, strconv.Itoa(m.Sessions), until})
 		}
 	}
 
 	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"NAME", "ID", "SIZE", "PROCESSOR", "UNTIL"})
+	table.SetHeader([]string{"NAME", "ID", "SIZE", "PROCESSOR", "SESSIONS", "UNTIL"})
 	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
 	table.SetAlignment(tablewriter.ALIGN_LEFT)
 	table.SetHeaderLine(false)
@@ -625,6 +916,12 @@ func ListRunningHandler(cmd *cobra.Command, args []string) error {
 	table.AppendBulk(data)
 	table.Render()
 
+	for _, d := range models.Devices {
+		if d.Status != "available" {
+			fmt.Fprintf(os.Stderr, "warning: %s GPU %s is %s\n", d.Library, d.ID, d.Status)
+		}
+	}
+
 	return nil
 }
 
@@ -715,7 +1012,9 @@ func ShowHandler(cmd *cobra.Command, args []string) error {
 	if flagsSet == 1 {
 		switch showType {
 		case "license":
-			fmt.Println(resp.License)
+			// fall back to the license's identifier for models without
+			// the license text
+			fmt.Println(cmp.Or(resp.License, resp.Metadata.License))
 		case "modelfile":
 			fmt.Println(resp.Modelfile)
 		case "parameters":
@@ -763,6 +1062,12 @@ func showInfo(resp *api.ShowResponse, verbose bool, w io.Writer) error {
 			rows = append(rows, []string{"", "parameters", resp.Details.ParameterSize})
 		}
 		rows = append(rows, []string{"", "quantization", resp.Details.QuantizationLevel})
+		if resp.Metadata.License != "" {
+			rows = append(rows, []string{"", "license", resp.Metadata.License})
+		}
+		if resp.Metadata.Source != "" {
+			rows = append(rows, []string{"", "source", resp.Metadata.Source})
+		}
 		return
 	})
 
@@ -798,6 +1103,15 @@ func showInfo(resp *api.ShowResponse, verbose bool, w io.Writer) error {
 		})
 	}
 
+	if len(resp.Samplers) > 0 && verbose {
+		tableRender("Sampling", func() (rows [][]string) {
+			for i, name := range resp.Samplers {
+				rows = append(rows, []string{"", strconv.Itoa(i + 1), name})
+			}
+			return
+		})
+	}
+
 	if resp.ModelInfo != nil && verbose {
 		tableRender("Metadata", func() (rows [][]string) {
 			keys := make([]string, 0, len(resp.ModelInfo))
@@ -914,48 +1228,387 @@ func CopyHandler(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
-func PullHandler(cmd *cobra.Command, args []string) error {
-	insecure, err := cmd.Flags().GetBool("insecure")
+func PinHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	req := api.PinRequest{Model: args[0]}
+	if cmd.Name() == "unpin" {
+		if err := client.Unpin(cmd.Context(), &req); err != nil {
+			return err
+		}
+		fmt.Printf("unpinned '%s'\n", args[0])
+		return nil
+	}
+
+	if err := client.Pin(cmd.Context(), &req); err != nil {
+		return err
+	}
+	fmt.Printf("pinned '%s'\n", args[0])
+	return nil
+}
+
+func SignHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Sign(cmd.Context(), &api.SignRequest{Model: args[0]})
 	if err != nil {
 		return err
 	}
+	fmt.Printf("signed '%s' with %s\n", args[0], resp.PublicKey)
+	return nil
+}
 
+func ExportHandler(cmd *cobra.Command, args []string) error {
 	client, err := api.ClientFromEnvironment()
 	if err != nil {
 		return err
 	}
 
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if output == "" || output == "-" {
+		if term.IsTerminal(int(os.Stdout.Fd())) {
+			return errors.New("refusing to write an archive to a terminal, use --output")
+		}
+	} else {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
 	p := progress.NewProgress(os.Stderr)
 	defer p.Stop()
 
-	bars := make(map[string]*progress.Bar)
+	var pw progressWriter
+	status := fmt.Sprintf("exporting %s", args[0])
+	spinner := progress.NewSpinner(status)
+	p.Add(status, spinner)
 
-	var status string
-	var spinner *progress.Spinner
+	done := make(chan struct{})
+	defer close(done)
 
-	fn := func(resp api.ProgressResponse) error {
-		if resp.Digest != "" {
-			if resp.Completed == 0 {
-				// This is the initial status update for the
-				// layer, which the server sends before
-				// beginning the download, for clients to
-				// compute total size and prepare for
-				// downloads, if needed.
-				//
-				// Skipping this here to avoid showing a 0%
-				// progress bar, which *should* clue the user
-				// into the fact that many things are being
-				// downloaded and that the current active
-				// download is not that last. However, in rare
-				// cases it seems to be triggering to some, and
-				// it isn't worth explaining, so just ignore
-				// and regress to the old UI that keeps giving
-				// you the "But wait, there is more!" after
-				// each "100% done" bar, which is "better."
-				return nil
+	go func() {
+		ticker := time.NewTicker(60 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				spinner.SetMessage(fmt.Sprintf("%s %s", status, format.HumanBytes(pw.n.Load())))
+			case <-done:
+				return
 			}
+		}
+	}()
 
-			if spinner != nil {
+	if err := client.Export(cmd.Context(), &api.ExportRequest{Model: args[0]}, io.MultiWriter(w, &pw)); err != nil {
+		if output != "" && output != "-" {
+			os.Remove(output)
+		}
+		return err
+	}
+
+	if f, ok := w.(*os.File); ok && f != os.Stdout {
+		return f.Close()
+	}
+
+	return nil
+}
+
+func ImportHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var name string
+	if len(args) > 1 {
+		name = args[1]
+	}
+
+	p := progress.NewProgress(os.Stderr)
+	defer p.Stop()
+
+	var pw progressWriter
+	bar := progress.NewBar(fmt.Sprintf("importing %s", filepath.Base(args[0])), fi.Size(), 0)
+	p.Add(args[0], bar)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		ticker := time.NewTicker(60 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				bar.Set(pw.n.Load())
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	resp, err := client.Import(cmd.Context(), io.TeeReader(f, &pw), name)
+	if err != nil {
+		return err
+	}
+
+	bar.Set(fi.Size())
+	p.Stop()
+	fmt.Printf("imported '%s'\n", resp.Model)
+	return nil
+}
+
+func CreateAliasHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	req := api.AliasRequest{Alias: args[0], Target: args[1]}
+	if err := client.CreateAlias(cmd.Context(), &req); err != nil {
+		return err
+	}
+	fmt.Printf("created alias '%s' for '%s'\n", args[0], args[1])
+	return nil
+}
+
+func ListAliasesHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.ListAliases(cmd.Context())
+	if err != nil {
+		return err
+	}
+
+	var data [][]string
+	for _, a := range resp.Aliases {
+		data = append(data, []string{a.Alias, a.Target})
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"ALIAS", "MODEL"})
+	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetHeaderLine(false)
+	table.SetBorder(false)
+	table.SetNoWhiteSpace(true)
+	table.SetTablePadding("    ")
+	table.AppendBulk(data)
+	table.Render()
+
+	return nil
+}
+
+func DeleteAliasHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range args {
+		if err := client.DeleteAlias(cmd.Context(), &api.AliasRequest{Alias: name}); err != nil {
+			return err
+		}
+		fmt.Printf("deleted alias '%s'\n", name)
+	}
+	return nil
+}
+
+func CreateKeyHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	scopes, err := cmd.Flags().GetStringSlice("scope")
+	if err != nil {
+		return err
+	}
+
+	req := api.CreateKeyRequest{Name: args[0], Scopes: scopes}
+	if req.RequestsPerMinute, err = cmd.Flags().GetUint("rpm"); err != nil {
+		return err
+	}
+
+	if req.TokensPerMinute, err = cmd.Flags().GetUint("tpm"); err != nil {
+		return err
+	}
+
+	key, err := client.CreateKey(cmd.Context(), &req)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("created API key '%s' (%s) with scopes %s\n", key.Name, key.ID, strings.Join(key.Scopes, ", "))
+	fmt.Println("Save the key now, it won't be shown again:")
+	fmt.Println(key.Key)
+	return nil
+}
+
+func ListKeysHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.ListKeys(cmd.Context())
+	if err != nil {
+		return err
+	}
+
+	var data [][]string
+	for _, k := range resp.Keys {
+		var limits []string
+		if k.RequestsPerMinute > 0 {
+			limits = append(limits, fmt.Sprintf("%d rpm", k.RequestsPerMinute))
+		}
+		if k.TokensPerMinute > 0 {
+			limits = append(limits, fmt.Sprintf("%d tpm", k.TokensPerMinute))
+		}
+
+		data = append(data, []string{k.ID, k.Name, strings.Join(k.Scopes, ","), strings.Join(limits, ", "), format.HumanTime(k.CreatedAt, "Never")})
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"ID", "NAME", "SCOPES", "LIMITS", "CREATED"})
+	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetHeaderLine(false)
+	table.SetBorder(false)
+	table.SetNoWhiteSpace(true)
+	table.SetTablePadding("    ")
+	table.AppendBulk(data)
+	table.Render()
+
+	return nil
+}
+
+func RevokeKeyHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range args {
+		if err := client.DeleteKey(cmd.Context(), id); err != nil {
+			return err
+		}
+		fmt.Printf("revoked API key '%s'\n", id)
+	}
+	return nil
+}
+
+func TokenizeHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	req := api.TokenizeRequest{Model: args[0], Prompt: strings.Join(args[1:], " ")}
+	if len(args) == 1 && !term.IsTerminal(int(os.Stdin.Fd())) {
+		in, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		req.Prompt = string(in)
+	}
+
+	if req.Raw, err = cmd.Flags().GetBool("raw"); err != nil {
+		return err
+	}
+
+	if req.System, err = cmd.Flags().GetString("system"); err != nil {
+		return err
+	}
+
+	resp, err := client.Tokenize(cmd.Context(), &req)
+	if err != nil {
+		return err
+	}
+
+	if count, _ := cmd.Flags().GetBool("count"); count {
+		fmt.Println(resp.Count)
+		return nil
+	}
+
+	tokens := make([]string, len(resp.Tokens))
+	for i, t := range resp.Tokens {
+		tokens[i] = strconv.Itoa(t)
+	}
+	fmt.Println(strings.Join(tokens, " "))
+	return nil
+}
+
+func PullHandler(cmd *cobra.Command, args []string) error {
+	insecure, err := cmd.Flags().GetBool("insecure")
+	if err != nil {
+		return err
+	}
+
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	p := progress.NewProgress(os.Stderr)
+	defer p.Stop()
+
+	bars := make(map[string]*progress.Bar)
+
+	var status string
+	var spinner *progress.Spinner
+
+	fn := func(resp api.ProgressResponse) error {
+		if resp.Digest != "" {
+			if resp.Completed == 0 {
+				// This is the initial status update for the
+				// layer, which the server sends before
+				// beginning the download, for clients to
+				// compute total size and prepare for
+				// downloads, if needed.
+				//
+				// Skipping this here to avoid showing a 0%
+				// progress bar, which *should* clue the user
+				// into the fact that many things are being
+				// downloaded and that the current active
+				// download is not that last. However, in rare
+				// cases it seems to be triggering to some, and
+				// it isn't worth explaining, so just ignore
+				// and regress to the old UI that keeps giving
+				// you the "But wait, there is more!" after
+				// each "100% done" bar, which is "better."
+				return nil
+			}
+
+			if spinner != nil {
 				spinner.Stop()
 			}
 
@@ -985,10 +1638,88 @@ func PullHandler(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
-	request := api.PullRequest{Name: args[0], Insecure: insecure}
+	rateLimit, err := rateLimitFlag(cmd)
+	if err != nil {
+		return err
+	}
+
+	from, _ := cmd.Flags().GetString("from")
+
+	request := api.PullRequest{Name: args[0], Insecure: insecure, RateLimit: rateLimit, From: from}
 	return client.Pull(cmd.Context(), &request, fn)
 }
 
+// UpdateHandler pulls the newer version of a model, or of every model with
+// --all. Without either it lists the models that have one.
+func UpdateHandler(cmd *cobra.Command, args []string) error {
+	all, _ := cmd.Flags().GetBool("all")
+	if all && len(args) > 0 {
+		return errors.New("specify a model or --all, not both")
+	}
+
+	if len(args) > 0 {
+		return PullHandler(cmd, args)
+	}
+
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	updates, err := client.Updates(cmd.Context())
+	if err != nil {
+		return err
+	}
+
+	if len(updates.Models) == 0 {
+		fmt.Println("all models are up to date")
+		return nil
+	}
+
+	if !all {
+		var data [][]string
+		for _, u := range updates.Models {
+			data = append(data, []string{u.Model, u.Digest[:12], u.RemoteDigest[:12]})
+		}
+
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetHeader([]string{"NAME", "ID", "NEW ID"})
+		table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+		table.SetAlignment(tablewriter.ALIGN_LEFT)
+		table.SetHeaderLine(false)
+		table.SetBorder(false)
+		table.SetNoWhiteSpace(true)
+		table.SetTablePadding("    ")
+		table.AppendBulk(data)
+		table.Render()
+		return nil
+	}
+
+	for _, u := range updates.Models {
+		if err := PullHandler(cmd, []string{u.Model}); err != nil {
+			return fmt.Errorf("%s: %w", u.Model, err)
+		}
+	}
+
+	return nil
+}
+
+// rateLimitFlag returns the bandwidth limit set with --rate-limit in bytes
+// per second, or zero if there is none.
+func rateLimitFlag(cmd *cobra.Command) (int64, error) {
+	s, _ := cmd.Flags().GetString("rate-limit")
+	if s == "" {
+		return 0, nil
+	}
+
+	rateLimit, err := format.ParseBytes(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid --rate-limit: %w", err)
+	}
+
+	return rateLimit, nil
+}
+
 type generateContextKey string
 
 type runOptions struct {
@@ -1298,12 +2029,34 @@ func generate(cmd *cobra.Command, opts runOptions) error {
 	return nil
 }
 
-func RunServer(_ *cobra.Command, _ []string) error {
+func RunServer(cmd *cobra.Command, _ []string) error {
 	if err := initializeKeypair(); err != nil {
 		return err
 	}
 
-	ln, err := net.Listen("tcp", envconfig.Host().Host)
+	// the server reads its flags from the environment
+	for flag, key := range map[string]string{"drain-on": "GOOBLA_DRAIN_ON", "route-to": "GOOBLA_ROUTE_TO"} {
+		if !cmd.Flags().Changed(flag) {
+			continue
+		}
+
+		values, err := cmd.Flags().GetStringSlice(flag)
+		if err != nil {
+			return err
+		}
+
+		if err := os.Setenv(key, strings.Join(values, ",")); err != nil {
+			return err
+		}
+	}
+
+	var ln net.Listener
+	var err error
+	if host := envconfig.Host(); host.Scheme == "unix" {
+		ln, err = server.ListenUnix(host.Path)
+	} else {
+		ln, err = net.Listen("tcp", host.Host)
+	}
 	if err != nil {
 		return err
 	}
@@ -1451,6 +2204,34 @@ func NewCLI() *cobra.Command {
 
 	createCmd.Flags().StringP("file", "f", "", "Name of the Modelfile (default \"Modelfile\"")
 	createCmd.Flags().StringP("quantize", "q", "", "Quantize model to this level (e.g. q4_K_M)")
+	createCmd.Flags().StringArray("build-arg", nil, "Set a variable declared with ARG in the Modelfile, as NAME=value")
+	createCmd.Flags().String("from", "", "Create the model from a model or Hugging Face repository (e.g. hf.co/org/repo) without a Modelfile")
+	createCmd.Flags().Bool("check", false, "Render the template with sample conversations and fail if it's broken")
+
+	quantizeCmd := &cobra.Command{
+		Use:     "quantize MODEL [NEW_MODEL]",
+		Short:   "Create a quantized copy of a model",
+		Long:    "Create a quantized copy of an F16 or F32 model, named after the model with the quantization appended to its tag unless NEW_MODEL is given",
+		Args:    cobra.RangeArgs(1, 2),
+		PreRunE: checkServerHeartbeat,
+		RunE:    QuantizeHandler,
+	}
+
+	quantizeCmd.Flags().String("to", "", "Quantize model to this level (e.g. q4_K_M)")
+	quantizeCmd.Flags().String("imatrix", "", "Importance matrix computed by llama-imatrix from calibration data to weight the quantization with")
+
+	editCmd := &cobra.Command{
+		Use:     "edit MODEL [NEW_MODEL]",
+		Short:   "Edit the metadata of a model",
+		Long:    "Edit the GGUF metadata of a model, such as its chat template, context length, rope scaling or special tokens, without changing its weights. The model is edited in place unless NEW_MODEL is given",
+		Args:    cobra.RangeArgs(1, 2),
+		PreRunE: checkServerHeartbeat,
+		RunE:    EditHandler,
+	}
+
+	editCmd.Flags().StringArray("set", nil, "Set metadata as KEY=VALUE (e.g. context_length=8192 or tokenizer.ggml.eos_token_ids=[1,2])")
+	editCmd.Flags().StringArray("unset", nil, "Remove metadata KEY")
+	editCmd.Flags().String("chat-template", "", "Set the chat template to the contents of this file")
 
 	showCmd := &cobra.Command{
 		Use:     "show MODEL",
@@ -1499,6 +2280,9 @@ func NewCLI() *cobra.Command {
 		RunE:    RunServer,
 	}
 
+	serveCmd.Flags().StringSlice("drain-on", nil, "Signals that drain the server before it stops, such as SIGTERM")
+	serveCmd.Flags().StringSlice("route-to", nil, "Servers to proxy inference requests to, rather than running models")
+
 	pullCmd := &cobra.Command{
 		Use:     "pull MODEL",
 		Short:   "Pull a model from a registry",
@@ -1508,6 +2292,20 @@ func NewCLI() *cobra.Command {
 	}
 
 	pullCmd.Flags().Bool("insecure", false, "Use an insecure registry")
+	pullCmd.Flags().String("rate-limit", "", "Limit the download bandwidth per second (e.g. 10MB)")
+	pullCmd.Flags().String("from", "", "Pull from another Goobla server instead of the registry (e.g. http://other-host:11434)")
+
+	updateCmd := &cobra.Command{
+		Use:     "update [MODEL]",
+		Short:   "Pull newer versions of models",
+		Args:    cobra.MaximumNArgs(1),
+		PreRunE: checkServerHeartbeat,
+		RunE:    UpdateHandler,
+	}
+
+	updateCmd.Flags().Bool("all", false, "Update every model with a newer version")
+	updateCmd.Flags().Bool("insecure", false, "Use an insecure registry")
+	updateCmd.Flags().String("rate-limit", "", "Limit the download bandwidth per second (e.g. 10MB)")
 
 	pushCmd := &cobra.Command{
 		Use:     "push MODEL",
@@ -1518,6 +2316,7 @@ func NewCLI() *cobra.Command {
 	}
 
 	pushCmd.Flags().Bool("insecure", false, "Use an insecure registry")
+	pushCmd.Flags().String("rate-limit", "", "Limit the upload bandwidth per second (e.g. 10MB)")
 
 	listCmd := &cobra.Command{
 		Use:     "list",
@@ -1527,6 +2326,9 @@ func NewCLI() *cobra.Command {
 		RunE:    ListHandler,
 	}
 
+	listCmd.Flags().BoolP("verbose", "v", false, "Show layers shared between models and disk space saved")
+	listCmd.Flags().StringArray("filter", nil, "Only list models matching field=value, where field is one of family, format, license, parameters or quantization")
+
 	psCmd := &cobra.Command{
 		Use:     "ps",
 		Short:   "List running models",
@@ -1541,6 +2343,60 @@ func NewCLI() *cobra.Command {
 		RunE:    CopyHandler,
 	}
 
+	pinCmd := &cobra.Command{
+		Use:     "pin MODEL",
+		Short:   "Protect a model from being evicted to stay within the disk quota",
+		Args:    cobra.ExactArgs(1),
+		PreRunE: checkServerHeartbeat,
+		RunE:    PinHandler,
+	}
+
+	unpinCmd := &cobra.Command{
+		Use:     "unpin MODEL",
+		Short:   "Allow a pinned model to be evicted",
+		Args:    cobra.ExactArgs(1),
+		PreRunE: checkServerHeartbeat,
+		RunE:    PinHandler,
+	}
+
+	signCmd := &cobra.Command{
+		Use:     "sign MODEL",
+		Short:   "Sign a model with the server's signing key",
+		Args:    cobra.ExactArgs(1),
+		PreRunE: checkServerHeartbeat,
+		RunE:    SignHandler,
+	}
+
+	exportCmd := &cobra.Command{
+		Use:     "export MODEL",
+		Short:   "Export a model to an archive",
+		Args:    cobra.ExactArgs(1),
+		PreRunE: checkServerHeartbeat,
+		RunE:    ExportHandler,
+	}
+
+	exportCmd.Flags().StringP("output", "o", "", "Write the archive to a file instead of stdout (e.g. model.tar.zst)")
+
+	importCmd := &cobra.Command{
+		Use:     "import FILE [MODEL]",
+		Short:   "Import a model from an archive",
+		Args:    cobra.RangeArgs(1, 2),
+		PreRunE: checkServerHeartbeat,
+		RunE:    ImportHandler,
+	}
+
+	tokenizeCmd := &cobra.Command{
+		Use:     "tokenize MODEL [PROMPT]",
+		Short:   "Show the tokens of a prompt formatted for a model",
+		Args:    cobra.MinimumNArgs(1),
+		PreRunE: checkServerHeartbeat,
+		RunE:    TokenizeHandler,
+	}
+
+	tokenizeCmd.Flags().Bool("raw", false, "Don't format the prompt with the model's template")
+	tokenizeCmd.Flags().String("system", "", "System message to use instead of the model's")
+	tokenizeCmd.Flags().Bool("count", false, "Only show the number of tokens")
+
 	deleteCmd := &cobra.Command{
 		Use:     "rm MODEL [MODEL...]",
 		Short:   "Remove a model",
@@ -1549,6 +2405,73 @@ func NewCLI() *cobra.Command {
 		RunE:    DeleteHandler,
 	}
 
+	aliasCmd := &cobra.Command{
+		Use:   "alias",
+		Short: "Manage model aliases",
+	}
+
+	aliasCreateCmd := &cobra.Command{
+		Use:     "create ALIAS MODEL",
+		Short:   "Create or update an alias for a model",
+		Args:    cobra.ExactArgs(2),
+		PreRunE: checkServerHeartbeat,
+		RunE:    CreateAliasHandler,
+	}
+
+	aliasListCmd := &cobra.Command{
+		Use:     "list",
+		Aliases: []string{"ls"},
+		Short:   "List aliases",
+		Args:    cobra.NoArgs,
+		PreRunE: checkServerHeartbeat,
+		RunE:    ListAliasesHandler,
+	}
+
+	aliasDeleteCmd := &cobra.Command{
+		Use:     "rm ALIAS [ALIAS...]",
+		Short:   "Remove an alias",
+		Args:    cobra.MinimumNArgs(1),
+		PreRunE: checkServerHeartbeat,
+		RunE:    DeleteAliasHandler,
+	}
+
+	aliasCmd.AddCommand(aliasCreateCmd, aliasListCmd, aliasDeleteCmd)
+
+	keysCmd := &cobra.Command{
+		Use:   "keys",
+		Short: "Manage API keys",
+	}
+
+	keysCreateCmd := &cobra.Command{
+		Use:     "create NAME",
+		Short:   "Create an API key",
+		Args:    cobra.ExactArgs(1),
+		PreRunE: checkServerHeartbeat,
+		RunE:    CreateKeyHandler,
+	}
+	keysCreateCmd.Flags().StringSlice("scope", []string{api.ScopeGenerate}, "Scopes of the key ("+strings.Join(api.APIKeyScopes, ", ")+")")
+	keysCreateCmd.Flags().Uint("rpm", 0, "Requests the key can make a minute, instead of the server's limit")
+	keysCreateCmd.Flags().Uint("tpm", 0, "Tokens the key can use a minute, instead of the server's limit")
+
+	keysListCmd := &cobra.Command{
+		Use:     "list",
+		Aliases: []string{"ls"},
+		Short:   "List API keys",
+		Args:    cobra.NoArgs,
+		PreRunE: checkServerHeartbeat,
+		RunE:    ListKeysHandler,
+	}
+
+	keysRevokeCmd := &cobra.Command{
+		Use:     "revoke ID [ID...]",
+		Short:   "Revoke an API key",
+		Args:    cobra.MinimumNArgs(1),
+		PreRunE: checkServerHeartbeat,
+		RunE:    RevokeKeyHandler,
+	}
+
+	keysCmd.AddCommand(keysCreateCmd, keysListCmd, keysRevokeCmd)
+
 	runnerCmd := &cobra.Command{
 		Use:    "runner",
 		Hidden: true,
@@ -1563,24 +2486,45 @@ func NewCLI() *cobra.Command {
 
 	envVars := envconfig.AsMap()
 
-	envs := []envconfig.EnvVar{envVars["GOOBLA_HOST"]}
+	envs := []envconfig.EnvVar{
+		envVars["GOOBLA_HOST"],
+		envVars["GOOBLA_API_KEY"],
+		envVars["GOOBLA_TLS_CA_CERT"],
+		envVars["GOOBLA_TLS_CLIENT_CERT"],
+		envVars["GOOBLA_TLS_CLIENT_KEY"],
+	}
 
 	for _, cmd := range []*cobra.Command{
 		createCmd,
+		quantizeCmd,
+		editCmd,
 		showCmd,
 		runCmd,
 		stopCmd,
 		pullCmd,
+		updateCmd,
 		pushCmd,
 		listCmd,
 		psCmd,
 		copyCmd,
+		pinCmd,
+		unpinCmd,
+		signCmd,
+		exportCmd,
+		importCmd,
+		tokenizeCmd,
 		deleteCmd,
+		aliasCreateCmd,
+		aliasListCmd,
+		aliasDeleteCmd,
+		keysCreateCmd,
+		keysListCmd,
+		keysRevokeCmd,
 		serveCmd,
 	} {
 		switch cmd {
 		case runCmd:
-			appendEnvDocs(cmd, []envconfig.EnvVar{envVars["GOOBLA_HOST"], envVars["GOOBLA_NOHISTORY"]})
+			appendEnvDocs(cmd, append(envs, envVars["GOOBLA_NOHISTORY"]))
 		case serveCmd:
 			appendEnvDocs(cmd, []envconfig.EnvVar{
 				envVars["GOOBLA_DEBUG"],
@@ -1588,16 +2532,64 @@ func NewCLI() *cobra.Command {
 				envVars["GOOBLA_KEEP_ALIVE"],
 				envVars["GOOBLA_MAX_LOADED_MODELS"],
 				envVars["GOOBLA_MAX_QUEUE"],
+				envVars["GOOBLA_MAX_CLIENT_REQUESTS"],
+				envVars["GOOBLA_MAX_CLIENT_QUEUE"],
+				envVars["GOOBLA_RATE_LIMIT_RPM"],
+				envVars["GOOBLA_RATE_LIMIT_TPM"],
+				envVars["GOOBLA_MAX_GENERATION_TIME"],
+				envVars["GOOBLA_FAIR_SHARE"],
+				envVars["GOOBLA_MAX_BATCH"],
+				envVars["GOOBLA_PREFIX_CACHE"],
 				envVars["GOOBLA_MODELS"],
 				envVars["GOOBLA_NUM_PARALLEL"],
+				envVars["GOOBLA_PRELOAD"],
+				envVars["GOOBLA_DRAIN_ON"],
+				envVars["GOOBLA_DRAIN_TIMEOUT"],
+				envVars["GOOBLA_ROUTE_TO"],
 				envVars["GOOBLA_NOPRUNE"],
 				envVars["GOOBLA_ORIGINS"],
+				envVars["GOOBLA_CORS_CONFIG"],
 				envVars["GOOBLA_SCHED_SPREAD"],
+				envVars["GOOBLA_SERVE_PEERS"],
 				envVars["GOOBLA_FLASH_ATTENTION"],
 				envVars["GOOBLA_KV_CACHE_TYPE"],
 				envVars["GOOBLA_LLM_LIBRARY"],
+				envVars["GOOBLA_CPU_VARIANT"],
 				envVars["GOOBLA_GPU_OVERHEAD"],
+				envVars["GOOBLA_VRAM_HEADROOM"],
 				envVars["GOOBLA_LOAD_TIMEOUT"],
+				envVars["GOOBLA_LOGS"],
+				envVars["GOOBLA_MULTI_USER"],
+				envVars["GOOBLA_AUTHORIZED_KEYS"],
+				envVars["GOOBLA_LOCK_TEMPLATES"],
+				envVars["GOOBLA_TRUSTED_KEYS"],
+				envVars["GOOBLA_REQUIRE_SIGNED_MODELS"],
+				envVars["GOOBLA_SIGNING_KEY"],
+				envVars["GOOBLA_MAX_DISK"],
+				envVars["GOOBLA_EVICT_MODELS"],
+				envVars["GOOBLA_SESSION_MAX_SIZE"],
+				envVars["GOOBLA_SESSION_TTL"],
+				envVars["GOOBLA_UPDATE_INTERVAL"],
+				envVars["GOOBLA_WEBHOOKS"],
+				envVars["GOOBLA_WEBHOOKS_CONFIG"],
+				envVars["GOOBLA_AUDIT_LOG"],
+				envVars["GOOBLA_METRICS"],
+				envVars["GOOBLA_OTEL_ENDPOINT"],
+				envVars["GOOBLA_PRIORITIES_CONFIG"],
+				envVars["GOOBLA_OIDC_ISSUER"],
+				envVars["GOOBLA_OIDC_AUDIENCE"],
+				envVars["GOOBLA_OIDC_USER_CLAIM"],
+				envVars["GOOBLA_OIDC_SCOPES_CLAIM"],
+				envVars["GOOBLA_TLS_CERT"],
+				envVars["GOOBLA_TLS_KEY"],
+				envVars["GOOBLA_TLS_CLIENT_CA"],
+				envVars["GOOBLA_UNIX_SOCKET"],
+				envVars["GOOBLA_SOCKET_UIDS"],
+				envVars["GOOBLA_SOCKET_GIDS"],
+				envVars["GOOBLA_TOOLS"],
+				envVars["GOOBLA_TOOL_COMMANDS"],
+				envVars["GOOBLA_IMAGE_PATHS"],
+				envVars["GOOBLA_IMAGE_HOSTS"],
 			})
 		default:
 			appendEnvDocs(cmd, envs)
@@ -1607,15 +2599,26 @@ func NewCLI() *cobra.Command {
 	rootCmd.AddCommand(
 		serveCmd,
 		createCmd,
+		quantizeCmd,
+		editCmd,
 		showCmd,
 		runCmd,
 		stopCmd,
 		pullCmd,
+		updateCmd,
 		pushCmd,
 		listCmd,
 		psCmd,
 		copyCmd,
+		pinCmd,
+		unpinCmd,
+		signCmd,
+		exportCmd,
+		importCmd,
+		tokenizeCmd,
 		deleteCmd,
+		aliasCmd,
+		keysCmd,
 		runnerCmd,
 	)
 
@@ -84,6 +84,7 @@ func TestShowInfo(t *testing.T) {
 			},
 			Parameters: `
 			stop up`,
+			Samplers: []string{"penalties", "top_k", "temperature", "dist"},
 			ModelInfo: map[string]any{
 				"general.architecture":    "test",
 				"general.parameter_count": float64(8_000_000_000),
@@ -110,6 +111,12 @@ func TestShowInfo(t *testing.T) {
   Parameters
     stop    up    
 
+  Sampling
+    1    penalties      
+    2    top_k          
+    3    temperature    
+    4    dist           
+
   Metadata
     general.architecture       test     
     general.parameter_count    8e+09    
@@ -473,6 +480,10 @@ func TestPushHandler(t *testing.T) {
 						t.Errorf("expected model name 'test-model', got %s", req.Name)
 					}
 
+					if req.RateLimit != 10_000_000 {
+						t.Errorf("expected rate limit 10000000, got %d", req.RateLimit)
+					}
+
 					// Simulate progress updates
 					responses := []api.ProgressResponse{
 						{Status: "preparing manifest"},
@@ -525,6 +536,7 @@ func TestPushHandler(t *testing.T) {
 
 			cmd := &cobra.Command{}
 			cmd.Flags().Bool("insecure", false, "")
+			cmd.Flags().String("rate-limit", "10MB", "")
 			cmd.SetContext(t.Context())
 
 			// Redirect stderr to capture progress output
@@ -574,6 +586,7 @@ func TestListHandler(t *testing.T) {
 	tests := []struct {
 		name           string
 		args           []string
+		filters        []string
 		serverResponse []api.ListModelResponse
 		expectedError  string
 		expectedOutput string
@@ -599,6 +612,34 @@ func TestListHandler(t *testing.T) {
 			expectedOutput: "NAME      ID              SIZE      MODIFIED     \n" +
 				"model1    sha256:abc12    1.0 KB    24 hours ago    \n",
 		},
+		{
+			name:    "filter models by license",
+			args:    []string{},
+			filters: []string{"license=Apache-2.0"},
+			serverResponse: []api.ListModelResponse{
+				{Name: "model1", Digest: "sha256:abc123", Size: 1024, ModifiedAt: time.Now().Add(-24 * time.Hour), Metadata: api.ModelMetadata{License: "apache-2.0"}},
+				{Name: "model2", Digest: "sha256:def456", Size: 2048, ModifiedAt: time.Now().Add(-24 * time.Hour), Metadata: api.ModelMetadata{License: "mit"}},
+			},
+			expectedOutput: "NAME      ID              SIZE      MODIFIED     \n" +
+				"model1    sha256:abc12    1.0 KB    24 hours ago    \n",
+		},
+		{
+			name:    "filter pinned models",
+			args:    []string{},
+			filters: []string{"pinned=true"},
+			serverResponse: []api.ListModelResponse{
+				{Name: "model1", Digest: "sha256:abc123", Size: 1024, ModifiedAt: time.Now().Add(-24 * time.Hour)},
+				{Name: "model2", Digest: "sha256:def456", Size: 2048, ModifiedAt: time.Now().Add(-24 * time.Hour), Pinned: true},
+			},
+			expectedOutput: "NAME      ID              SIZE      MODIFIED     \n" +
+				"model2    sha256:def45    2.0 KB    24 hours ago    \n",
+		},
+		{
+			name:          "unknown filter field",
+			args:          []string{},
+			filters:       []string{"color=blue"},
+			expectedError: "unknown filter field",
+		},
 		{
 			name:          "server error",
 			args:          []string{},
@@ -631,6 +672,7 @@ func TestListHandler(t *testing.T) {
 
 			cmd := &cobra.Command{}
 			cmd.SetContext(t.Context())
+			cmd.Flags().StringArray("filter", tt.filters, "")
 
 			// Capture stdout
 			oldStdout := os.Stdout
@@ -660,6 +702,115 @@ func TestListHandler(t *testing.T) {
 	}
 }
 
+func TestUpdateHandler(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/updates" || r.Method != http.MethodGet {
+			t.Errorf("unexpected request to %s %s", r.Method, r.URL.Path)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		response := api.UpdatesResponse{Models: []api.ModelUpdate{
+			{Model: "llama3.2:latest", Digest: "a80c4f17acd55265feec403c7aef86be0c25983ab279d83f3bcd3abbcb5b8b72", RemoteDigest: "0a8c266910232fd3291e71e5ba1e058cc5af9d411192cf88b6d30e92b6e73163"},
+		}}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			t.Fatal(err)
+		}
+	}))
+	defer mockServer.Close()
+
+	t.Setenv("GOOBLA_HOST", mockServer.URL)
+
+	cmd := &cobra.Command{}
+	cmd.SetContext(t.Context())
+	cmd.Flags().Bool("all", false, "")
+
+	oldStdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+
+	err := UpdateHandler(cmd, nil)
+
+	w.Close()
+	os.Stdout = oldStdout
+	output, _ := io.ReadAll(r)
+
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	expected := "NAME               ID              NEW ID       \n" +
+		"llama3.2:latest    a80c4f17acd5    0a8c26691023    \n"
+	if got := string(output); got != expected {
+		t.Errorf("expected output:\n%s\ngot:\n%s", expected, got)
+	}
+
+	cmd.Flags().Set("all", "true")
+	if err := UpdateHandler(cmd, []string{"llama3.2"}); err == nil || !strings.Contains(err.Error(), "not both") {
+		t.Errorf("expected error for a model with --all, got %v", err)
+	}
+}
+
+func TestTokenizeHandler(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/tokenize" || r.Method != http.MethodPost {
+			t.Errorf("unexpected request to %s %s", r.Method, r.URL.Path)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		var req api.TokenizeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if req.Model != "test" || req.Prompt != "Why is the sky blue?" || !req.Raw {
+			t.Errorf("unexpected request %+v", req)
+		}
+
+		if err := json.NewEncoder(w).Encode(api.TokenizeResponse{Model: req.Model, Tokens: []int{10, 20, 30}, Count: 3}); err != nil {
+			t.Fatal(err)
+		}
+	}))
+	defer mockServer.Close()
+
+	t.Setenv("GOOBLA_HOST", mockServer.URL)
+
+	cmd := &cobra.Command{}
+	cmd.SetContext(t.Context())
+	cmd.Flags().Bool("raw", true, "")
+	cmd.Flags().String("system", "", "")
+	cmd.Flags().Bool("count", false, "")
+
+	run := func() string {
+		oldStdout := os.Stdout
+		r, w, _ := os.Pipe()
+		os.Stdout = w
+
+		err := TokenizeHandler(cmd, []string{"test", "Why", "is", "the", "sky", "blue?"})
+
+		w.Close()
+		os.Stdout = oldStdout
+		output, _ := io.ReadAll(r)
+
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		return string(output)
+	}
+
+	if got := run(); got != "10 20 30\n" {
+		t.Errorf("unexpected output %q", got)
+	}
+
+	cmd.Flags().Set("count", "true")
+	if got := run(); got != "3\n" {
+		t.Errorf("unexpected output %q", got)
+	}
+}
+
 func TestCreateHandler(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -915,3 +1066,142 @@ func TestNewCreateRequest(t *testing.T) {
 		})
 	}
 }
+
+func TestQuantizeHandler(t *testing.T) {
+	for name, want := range map[string]string{
+		"llama3":                "llama3:q4_K_M",
+		"llama3:8b":             "llama3:8b-q4_K_M",
+		"localhost:8080/llama3": "localhost:8080/llama3:q4_K_M",
+		"example.com/org/m:f16": "example.com/org/m:f16-q4_K_M",
+	} {
+		if got := quantizedName(name, "q4_K_M"); got != want {
+			t.Errorf("%s: expected %q, got %q", name, want, got)
+		}
+	}
+
+	var req api.CreateRequest
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/create" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(api.ProgressResponse{Status: "success"})
+	}))
+	t.Setenv("GOOBLA_HOST", mockServer.URL)
+	t.Cleanup(mockServer.Close)
+
+	cmd := &cobra.Command{}
+	cmd.Flags().String("to", "", "")
+	cmd.Flags().String("imatrix", "", "")
+	cmd.SetContext(t.Context())
+
+	if err := QuantizeHandler(cmd, []string{"llama3:8b"}); err == nil {
+		t.Error("expected an error without --to")
+	}
+
+	if err := cmd.Flags().Set("to", "q4_K_M"); err != nil {
+		t.Fatal(err)
+	}
+
+	oldStdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	err := QuantizeHandler(cmd, []string{"llama3:8b"})
+	w.Close()
+	os.Stdout = oldStdout
+	stdout, _ := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if req.Model != "llama3:8b-q4_K_M" || req.From != "llama3:8b" || req.Quantize != "q4_K_M" {
+		t.Errorf("unexpected request %+v", req)
+	}
+	if got := string(stdout); got != "created llama3:8b-q4_K_M\n" {
+		t.Errorf("unexpected output %q", got)
+	}
+}
+
+func TestEditHandler(t *testing.T) {
+	var req api.EditRequest
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/edit" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(api.ProgressResponse{Status: "success"})
+	}))
+	t.Setenv("GOOBLA_HOST", mockServer.URL)
+	t.Cleanup(mockServer.Close)
+
+	template := t.TempDir() + "/template.jinja"
+	if err := os.WriteFile(template, []byte("{{ messages }}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := &cobra.Command{}
+	cmd.Flags().StringArray("set", nil, "")
+	cmd.Flags().StringArray("unset", nil, "")
+	cmd.Flags().String("chat-template", "", "")
+	cmd.SetContext(t.Context())
+
+	if err := EditHandler(cmd, []string{"llama3"}); err == nil {
+		t.Error("expected an error without metadata")
+	}
+
+	for flag, value := range map[string]string{
+		"set":           "context_length=8192",
+		"unset":         "rope.scaling.type",
+		"chat-template": template,
+	} {
+		if err := cmd.Flags().Set(flag, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cmd.Flags().Set("set", "tokenizer.ggml.eos_token_ids=[1,2]"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Flags().Set("set", "rope.scaling.type=yarn"); err != nil {
+		t.Fatal(err)
+	}
+
+	oldStdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	err := EditHandler(cmd, []string{"llama3", "llama3-long"})
+	w.Close()
+	os.Stdout = oldStdout
+	stdout, _ := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]any{
+		"context_length":               float64(8192),
+		"tokenizer.ggml.eos_token_ids": []any{float64(1), float64(2)},
+		"tokenizer.chat_template":      "{{ messages }}",
+		// --unset takes precedence over --set
+		"rope.scaling.type": nil,
+	}
+	if req.Model != "llama3" || req.Destination != "llama3-long" {
+		t.Errorf("unexpected request %+v", req)
+	}
+	if diff := cmp.Diff(want, req.Metadata); diff != "" {
+		t.Errorf("metadata mismatch (-want +got):\n%s", diff)
+	}
+	if got := string(stdout); got != "edited llama3-long\n" {
+		t.Errorf("unexpected output %q", got)
+	}
+}
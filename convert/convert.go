@@ -101,6 +101,35 @@ type ModelConverter interface {
 	specialTokenTypes() []string
 }
 
+// modelConverters are the converters of the architectures a model's
+// config.json can list, which are passed the architecture they're for.
+var modelConverters = map[string]func(arch string) ModelConverter{
+	"LlamaForCausalLM":                   func(string) ModelConverter { return &llamaModel{} },
+	"MllamaForConditionalGeneration":     func(string) ModelConverter { return &mllamaModel{} },
+	"Llama4ForConditionalGeneration":     func(string) ModelConverter { return &llama4Model{} },
+	"Mistral3ForConditionalGeneration":   func(string) ModelConverter { return &mistral3Model{} },
+	"MixtralForCausalLM":                 func(string) ModelConverter { return &mixtralModel{} },
+	"GemmaForCausalLM":                   func(string) ModelConverter { return &gemmaModel{} },
+	"Gemma2ForCausalLM":                  func(string) ModelConverter { return &gemma2Model{} },
+	"Gemma3ForCausalLM":                  func(arch string) ModelConverter { return &gemma3Model{Architecture: arch} },
+	"Gemma3ForConditionalGeneration":     func(arch string) ModelConverter { return &gemma3Model{Architecture: arch} },
+	"Phi3ForCausalLM":                    func(string) ModelConverter { return &phi3Model{} },
+	"Qwen2ForCausalLM":                   func(string) ModelConverter { return &qwen2Model{} },
+	"Qwen2MoeForCausalLM":                func(string) ModelConverter { return &qwen2MoeModel{} },
+	"Qwen2_5_VLForConditionalGeneration": func(string) ModelConverter { return &qwen25VLModel{} },
+	"Qwen3ForCausalLM":                   func(string) ModelConverter { return &qwen3Model{} },
+	"Qwen3MoeForCausalLM":                func(string) ModelConverter { return &qwen3Model{moe: true} },
+	"BertModel":                          func(string) ModelConverter { return &bertModel{} },
+	"CohereForCausalLM":                  func(string) ModelConverter { return &commandrModel{} },
+}
+
+// adapterConverters are the converters of adapters for the architectures of
+// base models.
+var adapterConverters = map[string]func() AdapterConverter{
+	"llama":  func() AdapterConverter { return &llamaAdapter{} },
+	"gemma2": func() AdapterConverter { return &gemma2Adapter{} },
+}
+
 type moreParser interface {
 	parseMore(fs.FS) error
 }
@@ -131,15 +160,11 @@ func ConvertAdapter(fsys fs.FS, f *os.File, baseKV ggml.KV) error {
 		return errors.New("architecture not set for the base model")
 	}
 
-	var conv AdapterConverter
-	switch arch {
-	case "llama":
-		conv = &llamaAdapter{}
-	case "gemma2":
-		conv = &gemma2Adapter{}
-	default:
-		return errors.New("unsupported architecture")
+	newConverter, ok := adapterConverters[baseKV.Architecture()]
+	if !ok {
+		return fmt.Errorf("%w %q for adapters", ErrUnsupportedArchitecture, arch)
 	}
+	conv := newConverter()
 
 	ts, err := parseTensors(fsys, strings.NewReplacer(conv.Replacements()...))
 	if err != nil {
@@ -168,40 +193,16 @@ func ConvertModel(fsys fs.FS, f *os.File) error {
 		return err
 	}
 
-	if len(p.Architectures) < 1 {
-		return errors.New("unknown architecture")
+	var conv ModelConverter
+	for _, arch := range p.Architectures {
+		if newConverter, ok := modelConverters[arch]; ok {
+			conv = newConverter(arch)
+			break
+		}
 	}
 
-	var conv ModelConverter
-	switch p.Architectures[0] {
-	case "LlamaForCausalLM":
-		conv = &llamaModel{}
-	case "MllamaForConditionalGeneration":
-		conv = &mllamaModel{}
-	case "Llama4ForConditionalGeneration":
-		conv = &llama4Model{}
-	case "Mistral3ForConditionalGeneration":
-		conv = &mistral3Model{}
-	case "MixtralForCausalLM":
-		conv = &mixtralModel{}
-	case "GemmaForCausalLM":
-		conv = &gemmaModel{}
-	case "Gemma2ForCausalLM":
-		conv = &gemma2Model{}
-	case "Gemma3ForCausalLM", "Gemma3ForConditionalGeneration":
-		conv = &gemma3Model{Architecture: p.Architectures[0]}
-	case "Phi3ForCausalLM":
-		conv = &phi3Model{}
-	case "Qwen2ForCausalLM":
-		conv = &qwen2Model{}
-	case "Qwen2_5_VLForConditionalGeneration":
-		conv = &qwen25VLModel{}
-	case "BertModel":
-		conv = &bertModel{}
-	case "CohereForCausalLM":
-		conv = &commandrModel{}
-	default:
-		return fmt.Errorf("unsupported architecture %q", p.Architectures[0])
+	if conv == nil {
+		return unsupportedArchitecture(p.Architectures, bts)
 	}
 
 	if err := json.Unmarshal(bts, conv); err != nil {
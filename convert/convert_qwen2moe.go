@@ -0,0 +1,68 @@
+package convert
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/goobla/goobla/fs/ggml"
+)
+
+type qwen2MoeModel struct {
+	qwen2Model
+	NumExperts                   uint32 `json:"num_experts"`
+	NumExpertsPerToken           uint32 `json:"num_experts_per_tok"`
+	MoEIntermediateSize          uint32 `json:"moe_intermediate_size"`
+	SharedExpertIntermediateSize uint32 `json:"shared_expert_intermediate_size"`
+}
+
+var _ ModelConverter = (*qwen2MoeModel)(nil)
+
+func (q *qwen2MoeModel) KV(t *Tokenizer) ggml.KV {
+	kv := ggml.KV{}
+	for k, v := range q.qwen2Model.KV(t) {
+		if rest, ok := strings.CutPrefix(k, "qwen2."); ok {
+			k = "qwen2moe." + rest
+		}
+		kv[k] = v
+	}
+
+	kv["general.architecture"] = "qwen2moe"
+	kv["qwen2moe.expert_count"] = q.NumExperts
+	kv["qwen2moe.expert_used_count"] = q.NumExpertsPerToken
+	kv["qwen2moe.expert_feed_forward_length"] = q.MoEIntermediateSize
+	kv["qwen2moe.expert_shared_feed_forward_length"] = q.SharedExpertIntermediateSize
+	return kv
+}
+
+func (q *qwen2MoeModel) Tensors(ts []Tensor) []*ggml.Tensor {
+	merges := make([]merge, 0, q.HiddenLayers*3)
+	for i := range q.HiddenLayers {
+		merges = append(merges, merge{
+			fmt.Sprintf("blk.%d.ffn_exps.*.gate_proj.weight", i),
+			fmt.Sprintf("blk.%d.ffn_gate_exps.weight", i),
+		}, merge{
+			fmt.Sprintf("blk.%d.ffn_exps.*.up_proj.weight", i),
+			fmt.Sprintf("blk.%d.ffn_up_exps.weight", i),
+		}, merge{
+			fmt.Sprintf("blk.%d.ffn_exps.*.down_proj.weight", i),
+			fmt.Sprintf("blk.%d.ffn_down_exps.weight", i),
+		})
+	}
+
+	out, ts := mergeTensors(ts, merges...)
+	return append(out, q.qwen2Model.Tensors(ts)...)
+}
+
+func (q *qwen2MoeModel) Replacements() []string {
+	return append(
+		q.qwen2Model.Replacements(),
+		// the shared expert and its gate, which is applied to its output
+		"mlp.shared_expert_gate", "ffn_gate_inp_shexp",
+		"mlp.shared_expert.gate_proj", "ffn_gate_shexp",
+		"mlp.shared_expert.up_proj", "ffn_up_shexp",
+		"mlp.shared_expert.down_proj", "ffn_down_shexp",
+		// the router, which must come after gate_proj to not match it
+		"mlp.gate", "ffn_gate_inp",
+		"mlp.experts", "ffn_exps",
+	)
+}
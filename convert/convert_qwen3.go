@@ -0,0 +1,142 @@
+package convert
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/goobla/goobla/fs/ggml"
+)
+
+type qwen3Model struct {
+	ModelParameters
+	MaxPositionEmbeddings uint32  `json:"max_position_embeddings"`
+	HiddenSize            uint32  `json:"hidden_size"`
+	HiddenLayers          uint32  `json:"num_hidden_layers"`
+	IntermediateSize      uint32  `json:"intermediate_size"`
+	NumAttentionHeads     uint32  `json:"num_attention_heads"`
+	NumKeyValueHeads      uint32  `json:"num_key_value_heads"`
+	HeadDim               uint32  `json:"head_dim"`
+	RopeTheta             float32 `json:"rope_theta"`
+	RopeScaling           struct {
+		Type                          string  `json:"type"`
+		RopeType                      string  `json:"rope_type"`
+		Factor                        float32 `json:"factor"`
+		OriginalMaxPositionEmbeddings uint32  `json:"original_max_position_embeddings"`
+	} `json:"rope_scaling"`
+	RMSNormEPS float32 `json:"rms_norm_eps"`
+
+	// the experts of Qwen3MoeForCausalLM models
+	NumExperts          uint32   `json:"num_experts"`
+	NumExpertsPerToken  uint32   `json:"num_experts_per_tok"`
+	MoEIntermediateSize uint32   `json:"moe_intermediate_size"`
+	NormTopKProb        bool     `json:"norm_topk_prob"`
+	DecoderSparseStep   uint32   `json:"decoder_sparse_step"`
+	MLPOnlyLayers       []uint32 `json:"mlp_only_layers"`
+
+	moe bool
+}
+
+var _ ModelConverter = (*qwen3Model)(nil)
+
+func (q *qwen3Model) parseMore(fs.FS) error {
+	// every layer of a qwen3moe model is expected to be sparse
+	if q.moe && (q.DecoderSparseStep > 1 || len(q.MLPOnlyLayers) > 0) {
+		return errors.New("qwen3moe models with dense layers are not supported")
+	}
+	return nil
+}
+
+func (q *qwen3Model) KV(t *Tokenizer) ggml.KV {
+	arch := "qwen3"
+	if q.moe {
+		arch = "qwen3moe"
+	}
+
+	kv := q.ModelParameters.KV(t)
+	kv["general.architecture"] = arch
+	kv[arch+".block_count"] = q.HiddenLayers
+	kv[arch+".context_length"] = q.MaxPositionEmbeddings
+	kv[arch+".embedding_length"] = q.HiddenSize
+	kv[arch+".feed_forward_length"] = q.IntermediateSize
+	kv[arch+".attention.head_count"] = q.NumAttentionHeads
+	kv[arch+".attention.head_count_kv"] = cmp.Or(q.NumKeyValueHeads, q.NumAttentionHeads)
+
+	// the heads are explicitly sized rather than splitting the embedding
+	headDim := cmp.Or(q.HeadDim, q.HiddenSize/q.NumAttentionHeads)
+	kv[arch+".attention.key_length"] = headDim
+	kv[arch+".attention.value_length"] = headDim
+	kv[arch+".attention.layer_norm_rms_epsilon"] = q.RMSNormEPS
+	kv[arch+".rope.freq_base"] = q.RopeTheta
+
+	if cmp.Or(q.RopeScaling.Type, q.RopeScaling.RopeType) == "yarn" {
+		kv[arch+".rope.scaling.type"] = "yarn"
+		kv[arch+".rope.scaling.factor"] = q.RopeScaling.Factor
+		kv[arch+".rope.scaling.original_context_length"] = q.RopeScaling.OriginalMaxPositionEmbeddings
+	}
+
+	if q.moe {
+		kv[arch+".expert_count"] = q.NumExperts
+		kv[arch+".expert_used_count"] = q.NumExpertsPerToken
+		kv[arch+".expert_feed_forward_length"] = q.MoEIntermediateSize
+		kv[arch+".norm_top_k_prob"] = q.NormTopKProb
+	}
+
+	return kv
+}
+
+func (q *qwen3Model) Tensors(ts []Tensor) []*ggml.Tensor {
+	var out []*ggml.Tensor
+	if q.moe {
+		merges := make([]merge, 0, q.HiddenLayers*3)
+		for i := range q.HiddenLayers {
+			merges = append(merges, merge{
+				fmt.Sprintf("blk.%d.ffn_exps.*.gate_proj.weight", i),
+				fmt.Sprintf("blk.%d.ffn_gate_exps.weight", i),
+			}, merge{
+				fmt.Sprintf("blk.%d.ffn_exps.*.up_proj.weight", i),
+				fmt.Sprintf("blk.%d.ffn_up_exps.weight", i),
+			}, merge{
+				fmt.Sprintf("blk.%d.ffn_exps.*.down_proj.weight", i),
+				fmt.Sprintf("blk.%d.ffn_down_exps.weight", i),
+			})
+		}
+
+		out, ts = mergeTensors(ts, merges...)
+	}
+
+	for _, t := range ts {
+		out = append(out, &ggml.Tensor{
+			Name:     t.Name(),
+			Kind:     t.Kind(),
+			Shape:    t.Shape(),
+			WriterTo: t,
+		})
+	}
+
+	return out
+}
+
+func (q *qwen3Model) Replacements() []string {
+	return []string{
+		"lm_head", "output",
+		"model.embed_tokens", "token_embd",
+		"model.layers", "blk",
+		"input_layernorm", "attn_norm",
+		"self_attn.q_norm", "attn_q_norm",
+		"self_attn.k_norm", "attn_k_norm",
+		"self_attn.k_proj", "attn_k",
+		"self_attn.v_proj", "attn_v",
+		"self_attn.q_proj", "attn_q",
+		"self_attn.o_proj", "attn_output",
+		"mlp.down_proj", "ffn_down",
+		"mlp.gate_proj", "ffn_gate",
+		"mlp.up_proj", "ffn_up",
+		// the router, which must come after gate_proj to not match it
+		"mlp.gate", "ffn_gate_inp",
+		"mlp.experts", "ffn_exps",
+		"post_attention_layernorm", "ffn_norm",
+		"model.norm", "output_norm",
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -476,3 +477,153 @@ func generateLoraTestData(t *testing.T, tempDir string) {
 		t.Fatal(err)
 	}
 }
+
+// generateModel writes a safetensors model with the config, F32 tensors
+// with the shapes and an empty tokenizer to dir.
+func generateModel(t *testing.T, dir, config string, shapes map[string][]int) {
+	t.Helper()
+
+	header := make(map[string]*tensorData, len(shapes))
+	var offset int
+	names := maps.Keys(shapes)
+	slices.Sort(names)
+	for _, name := range names {
+		n := 4
+		for _, dim := range shapes[name] {
+			n *= dim
+		}
+		header[name] = &tensorData{Offsets: []int{offset, offset + n}, Type: "F32", Shape: shapes[name]}
+		offset += n
+	}
+
+	bts, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.LittleEndian, int64(len(bts))); err != nil {
+		t.Fatal(err)
+	}
+	b.Write(bts)
+	b.Write(make([]byte, offset))
+
+	for name, data := range map[string][]byte{
+		"model.safetensors": b.Bytes(),
+		"config.json":       []byte(config),
+		"tokenizer.json":    []byte(`{}`),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConvertQwen3Moe(t *testing.T) {
+	const experts = 12
+
+	shapes := map[string][]int{
+		"model.embed_tokens.weight":                      {16, 8},
+		"model.norm.weight":                              {8},
+		"model.layers.0.input_layernorm.weight":          {8},
+		"model.layers.0.post_attention_layernorm.weight": {8},
+		"model.layers.0.self_attn.q_proj.weight":         {8, 8},
+		"model.layers.0.self_attn.k_proj.weight":         {4, 8},
+		"model.layers.0.self_attn.v_proj.weight":         {4, 8},
+		"model.layers.0.self_attn.o_proj.weight":         {8, 8},
+		"model.layers.0.self_attn.q_norm.weight":         {4},
+		"model.layers.0.self_attn.k_norm.weight":         {4},
+		"model.layers.0.mlp.gate.weight":                 {experts, 8},
+	}
+	for i := range experts {
+		shapes[fmt.Sprintf("model.layers.0.mlp.experts.%d.gate_proj.weight", i)] = []int{6, 8}
+		shapes[fmt.Sprintf("model.layers.0.mlp.experts.%d.up_proj.weight", i)] = []int{6, 8}
+		shapes[fmt.Sprintf("model.layers.0.mlp.experts.%d.down_proj.weight", i)] = []int{8, 6}
+	}
+
+	dir := t.TempDir()
+	generateModel(t, dir, fmt.Sprintf(`{
+		"architectures": ["Qwen3MoeForCausalLM"],
+		"vocab_size": 16,
+		"hidden_size": 8,
+		"num_hidden_layers": 1,
+		"num_attention_heads": 2,
+		"num_key_value_heads": 1,
+		"head_dim": 4,
+		"num_experts": %d,
+		"num_experts_per_tok": 2,
+		"moe_intermediate_size": 6,
+		"norm_topk_prob": true
+	}`, experts), shapes)
+
+	_, kv, tensors := convertFull(t, os.DirFS(dir))
+
+	for k, want := range map[string]any{
+		"general.architecture":                "qwen3moe",
+		"qwen3moe.attention.head_count_kv":    uint32(1),
+		"qwen3moe.attention.key_length":       uint32(4),
+		"qwen3moe.expert_count":               uint32(experts),
+		"qwen3moe.expert_used_count":          uint32(2),
+		"qwen3moe.expert_feed_forward_length": uint32(6),
+		"qwen3moe.norm_top_k_prob":            true,
+	} {
+		if kv[k] != want {
+			t.Errorf("%s: expected %v, got %v", k, want, kv[k])
+		}
+	}
+
+	got := make(map[string][]uint64)
+	for _, tensor := range tensors.Items() {
+		got[tensor.Name] = tensor.Shape
+	}
+
+	for name, want := range map[string][]uint64{
+		"blk.0.attn_q_norm.weight":   {4},
+		"blk.0.attn_k.weight":        {8, 4},
+		"blk.0.ffn_gate_inp.weight":  {8, experts},
+		"blk.0.ffn_gate_exps.weight": {8, 6, experts},
+		"blk.0.ffn_down_exps.weight": {6, 8, experts},
+	} {
+		if !slices.Equal(got[name], want) {
+			t.Errorf("%s: expected shape %v, got %v", name, want, got[name])
+		}
+	}
+	if len(got) != 14 {
+		t.Errorf("expected 14 tensors, got %v", maps.Keys(got))
+	}
+}
+
+func TestConvertUnsupportedArchitecture(t *testing.T) {
+	dir := t.TempDir()
+	generateModel(t, dir, `{
+		"architectures": ["FooForConditionalGeneration"],
+		"text_config": {
+			"model_type": "foo",
+			"num_attention_heads": 32,
+			"num_key_value_heads": 8,
+			"num_experts": 64,
+			"num_experts_per_tok": 4
+		},
+		"vision_config": {},
+		"multi_modal_projector_bias": true,
+		"quantization_config": {"quant_method": "fp8"}
+	}`, map[string][]int{"model.embed_tokens.weight": {16, 8}})
+
+	f, err := os.CreateTemp(t.TempDir(), "f16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	err = ConvertModel(os.DirFS(dir), f)
+	if !errors.Is(err, ErrUnsupportedArchitecture) {
+		t.Fatalf("expected ErrUnsupportedArchitecture, got %v", err)
+	}
+
+	want := `unsupported architecture "FooForConditionalGeneration" (detected model type "foo", ` +
+		`mixture of experts with 64 experts, 4 per token, grouped-query attention with 32 query and 8 key-value heads, ` +
+		`vision tower, multimodal projector, fp8 quantized weights)`
+	if err.Error() != want {
+		t.Errorf("expected %q, got %q", want, err.Error())
+	}
+}
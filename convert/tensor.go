@@ -91,6 +91,12 @@ func mergeTensors(unmatched []Tensor, merges ...merge) (out []*ggml.Tensor, _ []
 		})
 
 		if len(matched) > 0 {
+			// tensors are read in name order, which puts expert 10 before
+			// expert 2, so they're ordered by their numbers instead
+			slices.SortStableFunc(matched, func(a, b Tensor) int {
+				return compareNumbered(a.Name(), b.Name())
+			})
+
 			out = append(out, &ggml.Tensor{
 				Name:     merges[i].name,
 				Kind:     matched[0].Kind(),
@@ -103,6 +109,41 @@ func mergeTensors(unmatched []Tensor, merges ...merge) (out []*ggml.Tensor, _ []
 	return out, unmatched
 }
 
+// compareNumbered compares the names a and b, ordering runs of digits by
+// their value.
+func compareNumbered(a, b string) int {
+	for a != "" && b != "" {
+		i := strings.IndexFunc(a, isNotDigit)
+		j := strings.IndexFunc(b, isNotDigit)
+		if i < 0 {
+			i = len(a)
+		}
+		if j < 0 {
+			j = len(b)
+		}
+
+		switch {
+		case i > 0 && j > 0:
+			// longer numbers are larger, ignoring leading zeros
+			na, nb := strings.TrimLeft(a[:i], "0"), strings.TrimLeft(b[:j], "0")
+			if c := cmp.Or(cmp.Compare(len(na), len(nb)), strings.Compare(na, nb)); c != 0 {
+				return c
+			}
+			a, b = a[i:], b[j:]
+		case a[0] != b[0]:
+			return cmp.Compare(a[0], b[0])
+		default:
+			a, b = a[1:], b[1:]
+		}
+	}
+
+	return cmp.Compare(len(a), len(b))
+}
+
+func isNotDigit(r rune) bool {
+	return r < '0' || r > '9'
+}
+
 // slicesSplitFunc splits a slice into two slices based on a predicate function.
 func slicesSplitFunc[S ~[]E, E comparable](s S, fn func(e E) bool) (matched, unmatched S) {
 	for _, e := range s {
@@ -389,6 +389,26 @@ func TestMerge(t *testing.T) {
 		checkMatched(t, 2, matched)
 	})
 
+	t.Run("numbered order", func(t *testing.T) {
+		var ts []Tensor
+		for _, name := range []string{"a.0.b", "a.1.b", "a.10.b", "a.11.b", "a.2.b"} {
+			ts = append(ts, &fakeTensor{name: name, shape: []uint64{1}, data: []float32{0}})
+		}
+
+		matched, _ := mergeTensors(ts, merge{"a.*.b", "a.b"})
+		if len(matched) != 1 {
+			t.Fatal("expected 1 merged tensor, got", len(matched))
+		}
+
+		var names []string
+		for _, t := range matched[0].WriterTo.(mergeGroup) {
+			names = append(names, t.Name())
+		}
+		if diff := cmp.Diff([]string{"a.0.b", "a.1.b", "a.2.b", "a.10.b", "a.11.b"}, names); diff != "" {
+			t.Errorf("unexpected order (-want +got):\n%s", diff)
+		}
+	})
+
 	t.Run("no match", func(t *testing.T) {
 		matched, unmatched := mergeTensors(unmatched, merge{"x.*.y", "x.y"})
 		if len(unmatched) != 5 {
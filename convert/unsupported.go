@@ -0,0 +1,102 @@
+package convert
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// ErrUnsupportedArchitecture is returned for models without a converter for
+// any of their architectures.
+var ErrUnsupportedArchitecture = errors.New("unsupported architecture")
+
+// unsupportedArchitecture returns an ErrUnsupportedArchitecture for the
+// architectures archs, listing the features detected in config, the model's
+// config.json, that a converter for them would need to handle.
+func unsupportedArchitecture(archs []string, config []byte) error {
+	if len(archs) == 0 {
+		return fmt.Errorf("%w: config.json lists no architectures", ErrUnsupportedArchitecture)
+	}
+
+	quoted := make([]string, len(archs))
+	for i, arch := range archs {
+		quoted[i] = fmt.Sprintf("%q", arch)
+	}
+
+	err := fmt.Errorf("%w %s", ErrUnsupportedArchitecture, strings.Join(quoted, ", "))
+	if features := detectFeatures(config); len(features) > 0 {
+		err = fmt.Errorf("%w (detected %s)", err, strings.Join(features, ", "))
+	}
+	return err
+}
+
+// detectFeatures returns descriptions of the features of the model in config
+// that conversion depends on, such as its experts, attention and towers for
+// other modalities.
+func detectFeatures(config []byte) []string {
+	var c map[string]any
+	if err := json.Unmarshal(config, &c); err != nil {
+		return nil
+	}
+
+	// the text model of multimodal models is configured separately
+	text := c
+	if t, ok := c["text_config"].(map[string]any); ok {
+		text = t
+	}
+
+	number := func(m map[string]any, keys ...string) int {
+		for _, key := range keys {
+			if n, ok := m[key].(float64); ok && n > 0 {
+				return int(n)
+			}
+		}
+		return 0
+	}
+
+	var features []string
+	if modelType, ok := text["model_type"].(string); ok {
+		features = append(features, fmt.Sprintf("model type %q", modelType))
+	}
+
+	if experts := number(text, "num_local_experts", "num_experts", "n_routed_experts", "moe_num_experts"); experts > 0 {
+		moe := fmt.Sprintf("mixture of experts with %d experts", experts)
+		if used := number(text, "num_experts_per_tok", "moe_k", "top_k"); used > 0 {
+			moe += fmt.Sprintf(", %d per token", used)
+		}
+		if number(text, "n_shared_experts", "shared_expert_intermediate_size", "num_shared_experts") > 0 {
+			moe += " and shared experts"
+		}
+		features = append(features, moe)
+	}
+
+	heads, kvHeads := number(text, "num_attention_heads", "n_head"), number(text, "num_key_value_heads", "n_head_kv")
+	switch {
+	case number(text, "kv_lora_rank") > 0:
+		features = append(features, "multi-head latent attention")
+	case kvHeads == 1:
+		features = append(features, fmt.Sprintf("multi-query attention with %d query heads", heads))
+	case kvHeads > 0 && kvHeads < heads:
+		features = append(features, fmt.Sprintf("grouped-query attention with %d query and %d key-value heads", heads, kvHeads))
+	}
+
+	if _, ok := c["vision_config"]; ok {
+		features = append(features, "vision tower")
+	}
+	if _, ok := c["audio_config"]; ok {
+		features = append(features, "audio tower")
+	}
+	if slices.ContainsFunc(slices.Collect(maps.Keys(c)), func(key string) bool { return strings.Contains(key, "projector") }) {
+		features = append(features, "multimodal projector")
+	}
+
+	if q, ok := c["quantization_config"].(map[string]any); ok {
+		method, _ := q["quant_method"].(string)
+		features = append(features, strings.TrimSpace(fmt.Sprintf("%s quantized weights", method)))
+	}
+
+	return features
+}
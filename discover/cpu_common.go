@@ -22,3 +22,10 @@ func IsNUMA() bool {
 	}
 	return len(ids) > 1
 }
+
+// NUMANodes returns the number of NUMA nodes, which is 1 if they can't be
+// detected.
+func NUMANodes() int {
+	nodes, _ := filepath.Glob("/sys/devices/system/node/node[0-9]*")
+	return max(1, len(nodes))
+}
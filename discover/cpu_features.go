@@ -0,0 +1,77 @@
+package discover
+
+import (
+	"runtime"
+	"slices"
+
+	"golang.org/x/sys/cpu"
+
+	"github.com/goobla/goobla/envconfig"
+)
+
+// cpuVariants are the builds of the CPU backend for x86, from the most to
+// the least capable, and the features each requires.
+var cpuVariants = []struct {
+	name     string
+	features []string
+}{
+	{"icelake", []string{"SSE42", "AVX", "AVX2", "BMI2", "FMA", "AVX512", "AVX512_VBMI", "AVX512_VNNI"}},
+	{"skylakex", []string{"SSE42", "AVX", "AVX2", "BMI2", "FMA", "AVX512"}},
+	{"alderlake", []string{"SSE42", "AVX", "AVX2", "BMI2", "FMA", "AVX_VNNI"}},
+	{"haswell", []string{"SSE42", "AVX", "AVX2", "BMI2", "FMA"}},
+	{"sandybridge", []string{"SSE42", "AVX"}},
+	{"sse42", []string{"SSE42"}},
+	{"x64", nil},
+}
+
+// CPUFeatures returns the instruction set extensions of the CPU that the
+// CPU backend can use, named as the backend names them.
+func CPUFeatures() []string {
+	var features []string
+	add := func(name string, ok bool) {
+		if ok {
+			features = append(features, name)
+		}
+	}
+
+	switch runtime.GOARCH {
+	case "amd64":
+		add("SSE42", cpu.X86.HasSSE42)
+		add("AVX", cpu.X86.HasAVX)
+		add("AVX2", cpu.X86.HasAVX2)
+		add("BMI2", cpu.X86.HasBMI2)
+		add("FMA", cpu.X86.HasFMA)
+		add("AVX512", cpu.X86.HasAVX512F)
+		add("AVX512_VBMI", cpu.X86.HasAVX512VBMI)
+		add("AVX512_VNNI", cpu.X86.HasAVX512VNNI)
+		add("AVX_VNNI", cpu.X86.HasAVXVNNI)
+	case "arm64":
+		add("NEON", cpu.ARM64.HasASIMD)
+		add("DOTPROD", cpu.ARM64.HasASIMDDP)
+		add("MATMUL_INT8", cpu.ARM64.HasI8MM)
+		add("SVE", cpu.ARM64.HasSVE)
+	}
+
+	return features
+}
+
+// CPUVariant returns the build of the CPU backend the runner loads for a CPU
+// with features, and whether GOOBLA_CPU_VARIANT forces it. It's empty on
+// architectures with a single build.
+func CPUVariant(features []string) (variant string, forced bool) {
+	if v := envconfig.CPUVariant(); v != "" {
+		return v, true
+	}
+
+	if runtime.GOARCH != "amd64" {
+		return "", false
+	}
+
+	for _, v := range cpuVariants {
+		if !slices.ContainsFunc(v.features, func(f string) bool { return !slices.Contains(features, f) }) {
+			return v.name, false
+		}
+	}
+
+	return "x64", false
+}
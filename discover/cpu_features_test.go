@@ -0,0 +1,39 @@
+package discover
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestCPUVariant(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("the CPU backend only has variants on amd64")
+	}
+
+	t.Setenv("GOOBLA_CPU_VARIANT", "")
+
+	cases := []struct {
+		features []string
+		want     string
+	}{
+		{nil, "x64"},
+		{[]string{"SSE42"}, "sse42"},
+		{[]string{"SSE42", "AVX"}, "sandybridge"},
+		{[]string{"SSE42", "AVX", "AVX2", "BMI2", "FMA"}, "haswell"},
+		{[]string{"SSE42", "AVX", "AVX2", "BMI2"}, "sandybridge"},
+		{[]string{"SSE42", "AVX", "AVX2", "BMI2", "FMA", "AVX_VNNI"}, "alderlake"},
+		{[]string{"SSE42", "AVX", "AVX2", "BMI2", "FMA", "AVX512"}, "skylakex"},
+		{[]string{"SSE42", "AVX", "AVX2", "BMI2", "FMA", "AVX512", "AVX512_VBMI", "AVX512_VNNI"}, "icelake"},
+	}
+
+	for _, tt := range cases {
+		if got, forced := CPUVariant(tt.features); got != tt.want || forced {
+			t.Errorf("%v: expected %q, got %q (forced %t)", tt.features, tt.want, got, forced)
+		}
+	}
+
+	t.Setenv("GOOBLA_CPU_VARIANT", "haswell")
+	if got, forced := CPUVariant(nil); got != "haswell" || !forced {
+		t.Errorf("expected the forced variant haswell, got %q (forced %t)", got, forced)
+	}
+}
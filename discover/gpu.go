@@ -202,6 +202,19 @@ func GetCPUInfo() GpuInfoList {
 	return GpuInfoList{cpus[0].GpuInfo}
 }
 
+// Rediscover makes the next call to GetGPUInfo look for GPUs again, finding
+// GPUs that were added, removed or recovered from a driver reset since they
+// were last discovered.
+func Rediscover() {
+	gpuMutex.Lock()
+	defer gpuMutex.Unlock()
+	bootstrapped = false
+	cudaGPUs = nil
+	rocmGPUs = nil
+	oneapiGPUs = nil
+	unsupportedGPUs = nil
+}
+
 func GetGPUInfo() GpuInfoList {
 	// TODO - consider exploring lspci (and equivalent on windows) to check for
 	// GPUs so we can report warnings if we see Nvidia/AMD but fail to load the libraries
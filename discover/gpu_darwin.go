@@ -54,6 +54,9 @@ func GetGPUInfo() GpuInfoList {
 	return []GpuInfo{info}
 }
 
+// Rediscover is a no-op on darwin, where the GPU can't change.
+func Rediscover() {}
+
 func GetCPUInfo() GpuInfoList {
 	mem, _ := GetCPUMem()
 	return []GpuInfo{
@@ -15,13 +15,16 @@ import (
 )
 
 // Host returns the scheme and host. Host can be configured via the GOOBLA_HOST environment variable.
-// Default is scheme "http" and host "127.0.0.1:11434"
+// Default is scheme "http" and host "127.0.0.1:11434". A unix socket, such as
+// "unix:///run/goobla.sock", is returned with scheme "unix" and its path.
 func Host() *url.URL {
 	defaultPort := "11434"
 
 	s := strings.TrimSpace(Var("GOOBLA_HOST"))
 	scheme, hostport, ok := strings.Cut(s, "://")
 	switch {
+	case ok && scheme == "unix":
+		return &url.URL{Scheme: scheme, Path: hostport}
 	case !ok:
 		scheme, hostport = "http", s
 	case scheme == "http":
@@ -79,20 +82,149 @@ func AllowedOrigins() (origins []string) {
 	return origins
 }
 
-// Models returns the path to the models directory. Models directory can be configured via the GOOBLA_MODELS environment variable.
+// Models returns the path to the writable models directory, where models are pulled and created. Models directory can be configured via the
+// GOOBLA_MODELS environment variable. If GOOBLA_MODELS is a list of directories, it is the last one.
 // Default is $HOME/.goobla/models
 func Models() (string, error) {
-	if s := Var("GOOBLA_MODELS"); s != "" {
-		return s, nil
+	dirs, err := ModelsDirs()
+	return dirs[len(dirs)-1], err
+}
+
+// ModelsDirs returns the paths to the models directories. GOOBLA_MODELS can be a list of directories separated by the OS path list
+// separator, ":" or ";" on Windows. All of them are searched for models but only the last one is written to, so the others can be
+// read-only stores shared between users or bundled with an image, such as /usr/share/goobla/models.
+// Default is $HOME/.goobla/models
+func ModelsDirs() ([]string, error) {
+	var dirs []string
+	for _, dir := range filepath.SplitList(Var("GOOBLA_MODELS")) {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	if len(dirs) > 0 {
+		return dirs, nil
 	}
 
 	home, err := os.UserHomeDir()
 	if err != nil {
 		// use a relative directory if we cannot determine the home
-		return filepath.Join(".goobla", "models"), err
+		return []string{filepath.Join(".goobla", "models")}, err
+	}
+
+	return []string{filepath.Join(home, ".goobla", "models")}, nil
+}
+
+// Logs returns the path to the logs directory, where crash reports of model runners are written.
+// The directory can be configured via the GOOBLA_LOGS environment variable.
+// Default is $HOME/.goobla/logs
+func Logs() string {
+	if s := Var("GOOBLA_LOGS"); s != "" {
+		return s
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".goobla", "logs")
+	}
+
+	return filepath.Join(home, ".goobla", "logs")
+}
+
+// PrioritiesConfig returns the path to the priorities config file, which sets the scheduling priority of API keys and users.
+// The file can be configured via the GOOBLA_PRIORITIES_CONFIG environment variable.
+// Default is $HOME/.goobla/priorities.json
+func PrioritiesConfig() string {
+	if s := Var("GOOBLA_PRIORITIES_CONFIG"); s != "" {
+		return s
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".goobla", "priorities.json")
+	}
+
+	return filepath.Join(home, ".goobla", "priorities.json")
+}
+
+// WebhooksConfig returns the path to the webhooks config file, which lists the URLs notified of model lifecycle events.
+// The file can be configured via the GOOBLA_WEBHOOKS_CONFIG environment variable.
+// Default is $HOME/.goobla/webhooks.json
+func WebhooksConfig() string {
+	if s := Var("GOOBLA_WEBHOOKS_CONFIG"); s != "" {
+		return s
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".goobla", "webhooks.json")
+	}
+
+	return filepath.Join(home, ".goobla", "webhooks.json")
+}
+
+// CORSConfig returns the path to the CORS config file, which sets the policy of requests from browsers by route.
+// The file can be configured via the GOOBLA_CORS_CONFIG environment variable.
+// Default is $HOME/.goobla/cors.json
+func CORSConfig() string {
+	if s := Var("GOOBLA_CORS_CONFIG"); s != "" {
+		return s
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".goobla", "cors.json")
+	}
+
+	return filepath.Join(home, ".goobla", "cors.json")
+}
+
+// RegistriesConfig returns the path to the registries config file, which holds per-registry connection settings.
+// The file can be configured via the GOOBLA_REGISTRIES_CONFIG environment variable.
+// Default is $HOME/.goobla/registries.json
+func RegistriesConfig() string {
+	if s := Var("GOOBLA_REGISTRIES_CONFIG"); s != "" {
+		return s
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".goobla", "registries.json")
+	}
+
+	return filepath.Join(home, ".goobla", "registries.json")
+}
+
+// AuthorizedKeys returns the path to the authorized keys file, which lists the users of a multi-user server and their keys.
+// The file can be configured via the GOOBLA_AUTHORIZED_KEYS environment variable.
+// Default is $HOME/.goobla/authorized_keys
+func AuthorizedKeys() string {
+	if s := Var("GOOBLA_AUTHORIZED_KEYS"); s != "" {
+		return s
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".goobla", "authorized_keys")
+	}
+
+	return filepath.Join(home, ".goobla", "authorized_keys")
+}
+
+// TrustedKeys returns the path to the trusted keys file, which lists the keys trusted to sign models.
+// The file can be configured via the GOOBLA_TRUSTED_KEYS environment variable.
+// Default is $HOME/.goobla/trusted_keys
+func TrustedKeys() string {
+	if s := Var("GOOBLA_TRUSTED_KEYS"); s != "" {
+		return s
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".goobla", "trusted_keys")
 	}
 
-	return filepath.Join(home, ".goobla", "models"), nil
+	return filepath.Join(home, ".goobla", "trusted_keys")
 }
 
 // KeepAlive returns the duration that models stay loaded in memory. KeepAlive can be configured via the GOOBLA_KEEP_ALIVE environment variable.
@@ -135,6 +267,103 @@ func LoadTimeout() (loadTimeout time.Duration) {
 	return loadTimeout
 }
 
+// MaxGenerationTime returns the longest a generate or chat request can generate for, after which it's stopped with the response so far. MaxGenerationTime can be configured via the GOOBLA_MAX_GENERATION_TIME environment variable.
+// Zero or negative values are treated as unlimited.
+// Default is 0.
+func MaxGenerationTime() (maxGenerationTime time.Duration) {
+	if s := Var("GOOBLA_MAX_GENERATION_TIME"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil {
+			maxGenerationTime = d
+		} else if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			maxGenerationTime = time.Duration(n) * time.Second
+		}
+	}
+
+	if maxGenerationTime < 0 {
+		return 0
+	}
+
+	return maxGenerationTime
+}
+
+// DrainTimeout returns the longest the server waits for requests in progress to finish when it's drained. DrainTimeout can be configured via the GOOBLA_DRAIN_TIMEOUT environment variable.
+// Zero or negative values are treated as unlimited.
+// Default is 5 minutes.
+func DrainTimeout() (drainTimeout time.Duration) {
+	drainTimeout = 5 * time.Minute
+	if s := Var("GOOBLA_DRAIN_TIMEOUT"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil {
+			drainTimeout = d
+		} else if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			drainTimeout = time.Duration(n) * time.Second
+		}
+	}
+
+	if drainTimeout < 0 {
+		return 0
+	}
+
+	return drainTimeout
+}
+
+// ScrubInterval returns how often blobs are re-hashed to detect corruption. ScrubInterval can be configured via the GOOBLA_SCRUB_INTERVAL environment variable.
+// Zero or negative values disable scrubbing.
+// Default is 0.
+func ScrubInterval() (scrubInterval time.Duration) {
+	if s := Var("GOOBLA_SCRUB_INTERVAL"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil {
+			scrubInterval = d
+		} else if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			scrubInterval = time.Duration(n) * time.Second
+		}
+	}
+
+	if scrubInterval < 0 {
+		return 0
+	}
+
+	return scrubInterval
+}
+
+// SessionTTL returns how long the saved cache of a chat session is kept after it was last used. SessionTTL can be configured via the GOOBLA_SESSION_TTL environment variable.
+// Zero or negative values keep caches until they're evicted to stay within GOOBLA_SESSION_MAX_SIZE.
+// Default is 7 days.
+func SessionTTL() (sessionTTL time.Duration) {
+	sessionTTL = 7 * 24 * time.Hour
+	if s := Var("GOOBLA_SESSION_TTL"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil {
+			sessionTTL = d
+		} else if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			sessionTTL = time.Duration(n) * time.Second
+		}
+	}
+
+	if sessionTTL < 0 {
+		return 0
+	}
+
+	return sessionTTL
+}
+
+// UpdateInterval returns how often pulled models are checked for newer versions in their registries, which are then pulled. UpdateInterval can be configured via the GOOBLA_UPDATE_INTERVAL environment variable.
+// Zero or negative values disable automatic updates.
+// Default is 0.
+func UpdateInterval() (updateInterval time.Duration) {
+	if s := Var("GOOBLA_UPDATE_INTERVAL"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil {
+			updateInterval = d
+		} else if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			updateInterval = time.Duration(n) * time.Second
+		}
+	}
+
+	if updateInterval < 0 {
+		return 0
+	}
+
+	return updateInterval
+}
+
 func Bool(k string) func() bool {
 	return func() bool {
 		if s := Var(k); s != "" {
@@ -176,6 +405,8 @@ var (
 	NoPrune = Bool("GOOBLA_NOPRUNE")
 	// SchedSpread allows scheduling models across all GPUs.
 	SchedSpread = Bool("GOOBLA_SCHED_SPREAD")
+	// ServePeers serves the manifests and blobs of models to other servers pulling with --from.
+	ServePeers = Bool("GOOBLA_SERVE_PEERS")
 	// IntelGPU enables experimental Intel GPU detection.
 	IntelGPU = Bool("GOOBLA_INTEL_GPU")
 	// MultiUserCache optimizes prompt caching for multi-user scenarios
@@ -189,6 +420,68 @@ var (
 	// PprofAddr configures the pprof server address. Set to "off" to disable
 	// pprof or specify a custom address (e.g. 127.0.0.1:6060).
 	PprofAddr = String("GOOBLA_PPROF")
+	// BlobStore is the URL of a blob store shared between servers, such as
+	// "s3://bucket/prefix" or "file:///mnt/models". Blobs missing locally are
+	// copied from the shared store before pulling them from a registry.
+	BlobStore = String("GOOBLA_BLOB_STORE")
+	// MaxBandwidth limits the combined bandwidth of model pulls and pushes, e.g. "50MB" per second.
+	MaxBandwidth = String("GOOBLA_MAX_BANDWIDTH")
+	// MultiUser requires requests to be signed by a user in the authorized keys file and keeps each user's models private.
+	MultiUser = Bool("GOOBLA_MULTI_USER")
+	// RequireSignedModels refuses to pull models that aren't signed by a key in the trusted keys file.
+	RequireSignedModels = Bool("GOOBLA_REQUIRE_SIGNED_MODELS")
+	// SigningKey is the path to the private key models are signed with, which should be kept apart from the key the server uses for the registry.
+	SigningKey = String("GOOBLA_SIGNING_KEY")
+	// PrefixCache sets the memory used to keep prompt prefixes evicted from the context, e.g. "2GB", so long system prompts don't need to be evaluated again.
+	PrefixCache = String("GOOBLA_PREFIX_CACHE")
+	// MaxDisk limits the size of the model store, e.g. "500GB".
+	MaxDisk = String("GOOBLA_MAX_DISK")
+	// SessionMaxSize limits the size of the saved caches of chat sessions, e.g. "10GB".
+	SessionMaxSize = String("GOOBLA_SESSION_MAX_SIZE")
+	// VRAMHeadroom is the VRAM models are never loaded into on each GPU, either a size (e.g. "512MB") or a percentage of the GPU's memory (e.g. "10%").
+	VRAMHeadroom = String("GOOBLA_VRAM_HEADROOM")
+	// EvictModels deletes the least recently used models that aren't pinned when the model store is over GOOBLA_MAX_DISK.
+	EvictModels = Bool("GOOBLA_EVICT_MODELS")
+	// FairShare shares the slots of the loaded models equally between the clients with requests in progress.
+	FairShare = Bool("GOOBLA_FAIR_SHARE")
+	// Offline disables network activity, such as pulling models and checking for updates.
+	Offline = Bool("GOOBLA_OFFLINE")
+	// Metrics serves Prometheus metrics at /metrics.
+	Metrics = Bool("GOOBLA_METRICS")
+	// LockTemplates stops requests from overriding the template and system prompt of every model, as if each was locked with LOCKED in its Modelfile.
+	LockTemplates = Bool("GOOBLA_LOCK_TEMPLATES")
+	// OTelEndpoint is the OTLP/HTTP endpoint traces are exported to. Tracing is disabled if it is empty.
+	OTelEndpoint = String("GOOBLA_OTEL_ENDPOINT")
+	// AuditLog is the path of the audit log recording API requests that change models or run inference. Auditing is disabled if it is empty.
+	AuditLog = String("GOOBLA_AUDIT_LOG")
+	// AuditLogMaxSize is the size the audit log is rotated at, e.g. "100MB".
+	AuditLogMaxSize = String("GOOBLA_AUDIT_LOG_MAX_SIZE")
+	// AuditLogBackups is the number of rotated audit logs kept.
+	AuditLogBackups = Uint("GOOBLA_AUDIT_LOG_BACKUPS", 5)
+	// APIKey is the API key the client makes requests with, for servers that require them.
+	APIKey = String("GOOBLA_API_KEY")
+	// OIDCIssuer is the issuer of the OpenID Connect provider whose tokens requests can be made with. OIDC is disabled if it is empty.
+	OIDCIssuer = String("GOOBLA_OIDC_ISSUER")
+	// OIDCAudience is the audience OIDC tokens must be issued for.
+	OIDCAudience = String("GOOBLA_OIDC_AUDIENCE")
+	// OIDCUserClaim is the claim of OIDC tokens naming their user, "sub" if it is empty.
+	OIDCUserClaim = String("GOOBLA_OIDC_USER_CLAIM")
+	// OIDCScopesClaim is the claim of OIDC tokens listing their scopes, "scope" if it is empty.
+	OIDCScopesClaim = String("GOOBLA_OIDC_SCOPES_CLAIM")
+	// TLSCert is the path of the certificate the server serves TLS with. TLS is disabled if it is empty.
+	TLSCert = String("GOOBLA_TLS_CERT")
+	// TLSKey is the path of the private key of TLSCert.
+	TLSKey = String("GOOBLA_TLS_KEY")
+	// TLSClientCA is the path of the CA certificates client certificates must be signed by. Client certificates aren't required if it is empty.
+	TLSClientCA = String("GOOBLA_TLS_CLIENT_CA")
+	// TLSCACert is the path of the CA certificates the client trusts the server's certificate from, in addition to the system's.
+	TLSCACert = String("GOOBLA_TLS_CA_CERT")
+	// TLSClientCert is the path of the certificate the client presents to servers that require one.
+	TLSClientCert = String("GOOBLA_TLS_CLIENT_CERT")
+	// TLSClientKey is the path of the private key of TLSClientCert.
+	TLSClientKey = String("GOOBLA_TLS_CLIENT_KEY")
+	// UnixSocket is the path of a unix socket the server listens on in addition to GOOBLA_HOST.
+	UnixSocket = String("GOOBLA_UNIX_SOCKET")
 )
 
 func String(s string) func() string {
@@ -197,8 +490,58 @@ func String(s string) func() string {
 	}
 }
 
+// Strings returns a function that splits the environment variable k on commas, discarding empty entries.
+func Strings(k string) func() []string {
+	return func() (values []string) {
+		if s := Var(k); s != "" {
+			for _, v := range strings.Split(s, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					values = append(values, v)
+				}
+			}
+		}
+
+		return values
+	}
+}
+
+var (
+	// RegistryMirrors is a prioritized list of registry mirrors to try before the default registry when pulling models.
+	// Each entry is a host optionally prefixed with a protocol scheme (e.g. "https://mirror.example.com,http://10.0.0.2:5000").
+	RegistryMirrors = Strings("GOOBLA_REGISTRY_MIRRORS")
+	// Webhooks is a list of URLs notified of every model lifecycle event, in addition to those in the webhooks config file.
+	Webhooks = Strings("GOOBLA_WEBHOOKS")
+	// OCIRegistries is a list of registry hosts that use the OCI distribution protocol (e.g. "ghcr.io,harbor.example.com").
+	OCIRegistries = Strings("GOOBLA_OCI_REGISTRIES")
+	// Tools is a list of built-in tools chat requests can have the server run for models (e.g. "calculator,http_fetch").
+	Tools = Strings("GOOBLA_TOOLS")
+	// ToolCommands is a list of the commands the run_command tool is allowed to run.
+	ToolCommands = Strings("GOOBLA_TOOL_COMMANDS")
+	// ImagePaths is a list of the directories the images of requests can be read from by path.
+	ImagePaths = Strings("GOOBLA_IMAGE_PATHS")
+	// ImageHosts is a list of the hosts the images of requests can be fetched from by URL, or "*" for any host.
+	ImageHosts = Strings("GOOBLA_IMAGE_HOSTS")
+	// SocketUIDs are the user ids allowed to connect to the server's unix socket. Any user can connect if it and SocketGIDs are empty.
+	SocketUIDs = Strings("GOOBLA_SOCKET_UIDS")
+	// SocketGIDs are the group ids allowed to connect to the server's unix socket.
+	SocketGIDs = Strings("GOOBLA_SOCKET_GIDS")
+	// Preload is a list of models loaded when the server starts and kept loaded regardless of keep alive.
+	Preload = Strings("GOOBLA_PRELOAD")
+	// DrainOn is a list of the signals that drain the server before it stops (e.g. "SIGTERM"), rather than stopping it immediately.
+	DrainOn = Strings("GOOBLA_DRAIN_ON")
+	// RouteTo is a list of the servers inference requests are proxied to, rather than run by this server (e.g. "10.0.0.2:11434,10.0.0.3:11434").
+	RouteTo = Strings("GOOBLA_ROUTE_TO")
+)
+
 var (
 	LLMLibrary = String("GOOBLA_LLM_LIBRARY")
+	// CPUVariant is the CPU build the runner loads (e.g. "haswell"), rather than the one that matches the features detected on the CPU.
+	CPUVariant = String("GOOBLA_CPU_VARIANT")
+
+	// WebhookSecret is the key used to sign the events sent to the URLs in GOOBLA_WEBHOOKS. It is left out of AsMap so it isn't logged.
+	WebhookSecret = String("GOOBLA_WEBHOOK_SECRET")
+	// HFToken is the Hugging Face access token used to download the models created from Hugging Face repositories. It is left out of AsMap so it isn't logged.
+	HFToken = String("HF_TOKEN")
 
 	CudaVisibleDevices    = String("CUDA_VISIBLE_DEVICES")
 	HipVisibleDevices     = String("HIP_VISIBLE_DEVICES")
@@ -228,6 +571,18 @@ var (
 	MaxRunners = Uint("GOOBLA_MAX_LOADED_MODELS", 0)
 	// MaxQueue sets the maximum number of queued requests. MaxQueue can be configured via the GOOBLA_MAX_QUEUE environment variable.
 	MaxQueue = Uint("GOOBLA_MAX_QUEUE", 512)
+	// MaxClientRequests sets the maximum number of requests each client can have in progress. MaxClientRequests can be configured via the GOOBLA_MAX_CLIENT_REQUESTS environment variable.
+	MaxClientRequests = Uint("GOOBLA_MAX_CLIENT_REQUESTS", 0)
+	// MaxClientQueue sets the maximum number of requests each client can have waiting for its others to finish. MaxClientQueue can be configured via the GOOBLA_MAX_CLIENT_QUEUE environment variable.
+	MaxClientQueue = Uint("GOOBLA_MAX_CLIENT_QUEUE", 0)
+	// RateLimitRPM sets the number of inference requests each client can make a minute. RateLimitRPM can be configured via the GOOBLA_RATE_LIMIT_RPM environment variable.
+	RateLimitRPM = Uint("GOOBLA_RATE_LIMIT_RPM", 0)
+	// RateLimitTPM sets the number of prompt and generated tokens each client can use a minute. RateLimitTPM can be configured via the GOOBLA_RATE_LIMIT_TPM environment variable.
+	RateLimitTPM = Uint("GOOBLA_RATE_LIMIT_TPM", 0)
+	// MaxBatch sets the maximum number of tokens evaluated at once across all requests to a model. MaxBatch can be configured via the GOOBLA_MAX_BATCH environment variable.
+	MaxBatch = Uint("GOOBLA_MAX_BATCH", 0)
+	// PullConcurrency sets the maximum number of parts of a blob downloaded at once. PullConcurrency can be configured via the GOOBLA_PULL_CONCURRENCY environment variable.
+	PullConcurrency = Uint("GOOBLA_PULL_CONCURRENCY", 16)
 )
 
 func Uint64(key string, defaultValue uint64) func() uint64 {
@@ -247,6 +602,10 @@ func Uint64(key string, defaultValue uint64) func() uint64 {
 // Set aside VRAM per GPU
 var GpuOverhead = Uint64("GOOBLA_GPU_OVERHEAD", 0)
 
+// ScrubRate sets the maximum number of bytes per second read while scrubbing blobs. ScrubRate can be configured via the GOOBLA_SCRUB_RATE environment variable.
+// Zero is unlimited.
+var ScrubRate = Uint64("GOOBLA_SCRUB_RATE", 64<<20)
+
 type EnvVar struct {
 	Name        string
 	Value       any
@@ -255,29 +614,93 @@ type EnvVar struct {
 
 func AsMap() map[string]EnvVar {
 	ret := map[string]EnvVar{
-		"GOOBLA_DEBUG":             {"GOOBLA_DEBUG", LogLevel(), "Show additional debug information (e.g. GOOBLA_DEBUG=1)"},
-		"GOOBLA_FLASH_ATTENTION":   {"GOOBLA_FLASH_ATTENTION", FlashAttention(), "Enabled flash attention"},
-		"GOOBLA_KV_CACHE_TYPE":     {"GOOBLA_KV_CACHE_TYPE", KvCacheType(), "Quantization type for the K/V cache (default: f16)"},
-		"GOOBLA_GPU_OVERHEAD":      {"GOOBLA_GPU_OVERHEAD", GpuOverhead(), "Reserve a portion of VRAM per GPU (bytes)"},
-		"GOOBLA_HOST":              {"GOOBLA_HOST", Host(), "IP Address for the goobla server (default 127.0.0.1:11434)"},
-		"GOOBLA_KEEP_ALIVE":        {"GOOBLA_KEEP_ALIVE", KeepAlive(), "The duration that models stay loaded in memory (default \"5m\")"},
-		"GOOBLA_LLM_LIBRARY":       {"GOOBLA_LLM_LIBRARY", LLMLibrary(), "Set LLM library to bypass autodetection"},
-		"GOOBLA_LOAD_TIMEOUT":      {"GOOBLA_LOAD_TIMEOUT", LoadTimeout(), "How long to allow model loads to stall before giving up (default \"5m\")"},
-		"GOOBLA_MAX_LOADED_MODELS": {"GOOBLA_MAX_LOADED_MODELS", MaxRunners(), "Maximum number of loaded models per GPU"},
-		"GOOBLA_MAX_QUEUE":         {"GOOBLA_MAX_QUEUE", MaxQueue(), "Maximum number of queued requests"},
-		func() EnvVar {
-			m, _ := Models()
-			return EnvVar{"GOOBLA_MODELS", m, "The path to the models directory"}
+		// only whether the API key is set is shown so it isn't logged
+		"GOOBLA_API_KEY":             {"GOOBLA_API_KEY", APIKey() != "", "The API key to make requests with"},
+		"GOOBLA_AUDIT_LOG":           {"GOOBLA_AUDIT_LOG", AuditLog(), "The path of the audit log of API requests, empty to disable"},
+		"GOOBLA_AUDIT_LOG_BACKUPS":   {"GOOBLA_AUDIT_LOG_BACKUPS", AuditLogBackups(), "Number of rotated audit logs to keep (default 5)"},
+		"GOOBLA_AUDIT_LOG_MAX_SIZE":  {"GOOBLA_AUDIT_LOG_MAX_SIZE", AuditLogMaxSize(), "Size to rotate the audit log at (default 100MB)"},
+		"GOOBLA_AUTHORIZED_KEYS":     {"GOOBLA_AUTHORIZED_KEYS", AuthorizedKeys(), "The path to the authorized keys file listing the users of a multi-user server"},
+		"GOOBLA_BLOB_STORE":          {"GOOBLA_BLOB_STORE", BlobStore(), "URL of a blob store shared between servers (e.g. s3://bucket/prefix)"},
+		"GOOBLA_CORS_CONFIG":         {"GOOBLA_CORS_CONFIG", CORSConfig(), "The path to the file setting the policy of browser requests by route"},
+		"GOOBLA_DEBUG":               {"GOOBLA_DEBUG", LogLevel(), "Show additional debug information (e.g. GOOBLA_DEBUG=1)"},
+		"GOOBLA_DRAIN_ON":            {"GOOBLA_DRAIN_ON", DrainOn(), "A comma separated list of signals that drain the server before it stops (e.g. SIGTERM)"},
+		"GOOBLA_DRAIN_TIMEOUT":       {"GOOBLA_DRAIN_TIMEOUT", DrainTimeout(), "How long draining waits for requests in progress to finish (default \"5m\")"},
+		"GOOBLA_EVICT_MODELS":        {"GOOBLA_EVICT_MODELS", EvictModels(), "Delete the least recently used models that aren't pinned to stay within GOOBLA_MAX_DISK"},
+		"GOOBLA_FAIR_SHARE":          {"GOOBLA_FAIR_SHARE", FairShare(), "Share the slots of loaded models equally between clients"},
+		"GOOBLA_FLASH_ATTENTION":     {"GOOBLA_FLASH_ATTENTION", FlashAttention(), "Enabled flash attention"},
+		"GOOBLA_KV_CACHE_TYPE":       {"GOOBLA_KV_CACHE_TYPE", KvCacheType(), "Quantization type for the K/V cache (default: f16)"},
+		"GOOBLA_GPU_OVERHEAD":        {"GOOBLA_GPU_OVERHEAD", GpuOverhead(), "Reserve a portion of VRAM per GPU (bytes)"},
+		"GOOBLA_VRAM_HEADROOM":       {"GOOBLA_VRAM_HEADROOM", VRAMHeadroom(), "VRAM to leave free on each GPU (e.g. 512MB or 10%)"},
+		"GOOBLA_HOST":                {"GOOBLA_HOST", Host(), "IP Address for the goobla server (default 127.0.0.1:11434)"},
+		"GOOBLA_KEEP_ALIVE":          {"GOOBLA_KEEP_ALIVE", KeepAlive(), "The duration that models stay loaded in memory (default \"5m\")"},
+		"GOOBLA_LLM_LIBRARY":         {"GOOBLA_LLM_LIBRARY", LLMLibrary(), "Set LLM library to bypass autodetection"},
+		"GOOBLA_CPU_VARIANT":         {"GOOBLA_CPU_VARIANT", CPUVariant(), "CPU build to use rather than autodetecting it (e.g. haswell)"},
+		"GOOBLA_LOAD_TIMEOUT":        {"GOOBLA_LOAD_TIMEOUT", LoadTimeout(), "How long to allow model loads to stall before giving up (default \"5m\")"},
+		"GOOBLA_LOGS":                {"GOOBLA_LOGS", Logs(), "The path to the logs directory, where crash reports are written"},
+		"GOOBLA_LOCK_TEMPLATES":      {"GOOBLA_LOCK_TEMPLATES", LockTemplates(), "Do not let requests override the template or system prompt of models"},
+		"GOOBLA_MAX_DISK":            {"GOOBLA_MAX_DISK", MaxDisk(), "Maximum size of the model store (e.g. 500GB)"},
+		"GOOBLA_MAX_BANDWIDTH":       {"GOOBLA_MAX_BANDWIDTH", MaxBandwidth(), "Maximum bandwidth per second for pulling and pushing models (e.g. 50MB)"},
+		"GOOBLA_MAX_BATCH":           {"GOOBLA_MAX_BATCH", MaxBatch(), "Maximum number of tokens evaluated at once across all requests to a model (default: batch size)"},
+		"GOOBLA_MAX_CLIENT_QUEUE":    {"GOOBLA_MAX_CLIENT_QUEUE", MaxClientQueue(), "Maximum number of requests each client can have waiting (default: unlimited)"},
+		"GOOBLA_MAX_CLIENT_REQUESTS": {"GOOBLA_MAX_CLIENT_REQUESTS", MaxClientRequests(), "Maximum number of requests each client can have in progress (default: unlimited)"},
+		"GOOBLA_MAX_GENERATION_TIME": {"GOOBLA_MAX_GENERATION_TIME", MaxGenerationTime(), "Maximum time a request can generate for (default: unlimited)"},
+		"GOOBLA_MAX_LOADED_MODELS":   {"GOOBLA_MAX_LOADED_MODELS", MaxRunners(), "Maximum number of loaded models per GPU"},
+		"GOOBLA_MAX_QUEUE":           {"GOOBLA_MAX_QUEUE", MaxQueue(), "Maximum number of queued requests"},
+		"GOOBLA_METRICS":             {"GOOBLA_METRICS", Metrics(), "Serve Prometheus metrics at /metrics"},
+		"GOOBLA_MODELS": func() EnvVar {
+			m, _ := ModelsDirs()
+			return EnvVar{"GOOBLA_MODELS", strings.Join(m, string(filepath.ListSeparator)), "The path to the models directory, or a list of directories where all but the last may be read-only"}
 		}(),
-		"GOOBLA_NOHISTORY":       {"GOOBLA_NOHISTORY", NoHistory(), "Do not preserve readline history"},
-		"GOOBLA_NOPRUNE":         {"GOOBLA_NOPRUNE", NoPrune(), "Do not prune model blobs on startup"},
-		"GOOBLA_NUM_PARALLEL":    {"GOOBLA_NUM_PARALLEL", NumParallel(), "Maximum number of parallel requests"},
-		"GOOBLA_ORIGINS":         {"GOOBLA_ORIGINS", AllowedOrigins(), "A comma separated list of allowed origins"},
-		"GOOBLA_SCHED_SPREAD":    {"GOOBLA_SCHED_SPREAD", SchedSpread(), "Always schedule model across all GPUs"},
-		"GOOBLA_MULTIUSER_CACHE": {"GOOBLA_MULTIUSER_CACHE", MultiUserCache(), "Optimize prompt caching for multi-user scenarios"},
-		"GOOBLA_CONTEXT_LENGTH":  {"GOOBLA_CONTEXT_LENGTH", ContextLength(), "Context length to use unless otherwise specified (default: 4096)"},
-		"GOOBLA_NEW_ENGINE":      {"GOOBLA_NEW_ENGINE", NewEngine(), "Enable the new Goobla engine"},
-		"GOOBLA_PPROF":           {"GOOBLA_PPROF", PprofAddr(), "Bind pprof to this address or 'off' to disable"},
+		"GOOBLA_MULTI_USER":            {"GOOBLA_MULTI_USER", MultiUser(), "Require signed requests from the users in the authorized keys file and keep their models private"},
+		"GOOBLA_NOHISTORY":             {"GOOBLA_NOHISTORY", NoHistory(), "Do not preserve readline history"},
+		"GOOBLA_NOPRUNE":               {"GOOBLA_NOPRUNE", NoPrune(), "Do not prune model blobs on startup"},
+		"GOOBLA_NUM_PARALLEL":          {"GOOBLA_NUM_PARALLEL", NumParallel(), "Maximum number of parallel requests"},
+		"GOOBLA_OFFLINE":               {"GOOBLA_OFFLINE", Offline(), "Do not connect to the network for anything, including models, updates, tools, webhooks, traces, OIDC and S3"},
+		"GOOBLA_OCI_REGISTRIES":        {"GOOBLA_OCI_REGISTRIES", OCIRegistries(), "A comma separated list of registries that use the OCI distribution protocol"},
+		"GOOBLA_OIDC_AUDIENCE":         {"GOOBLA_OIDC_AUDIENCE", OIDCAudience(), "The audience OIDC tokens must be issued for"},
+		"GOOBLA_OIDC_ISSUER":           {"GOOBLA_OIDC_ISSUER", OIDCIssuer(), "The issuer of the OpenID Connect provider to accept tokens from, empty to disable"},
+		"GOOBLA_OIDC_SCOPES_CLAIM":     {"GOOBLA_OIDC_SCOPES_CLAIM", OIDCScopesClaim(), "The claim of OIDC tokens listing their scopes (default \"scope\")"},
+		"GOOBLA_OIDC_USER_CLAIM":       {"GOOBLA_OIDC_USER_CLAIM", OIDCUserClaim(), "The claim of OIDC tokens naming their user (default \"sub\")"},
+		"GOOBLA_ORIGINS":               {"GOOBLA_ORIGINS", AllowedOrigins(), "A comma separated list of allowed origins"},
+		"GOOBLA_OTEL_ENDPOINT":         {"GOOBLA_OTEL_ENDPOINT", OTelEndpoint(), "The OTLP/HTTP endpoint to export traces to (e.g. http://localhost:4318), empty to disable"},
+		"GOOBLA_PREFIX_CACHE":          {"GOOBLA_PREFIX_CACHE", PrefixCache(), "Memory for prompt prefixes evicted from the context (e.g. 2GB), to avoid evaluating them again"},
+		"GOOBLA_PRELOAD":               {"GOOBLA_PRELOAD", Preload(), "A comma separated list of models to load at startup and keep loaded"},
+		"GOOBLA_PRIORITIES_CONFIG":     {"GOOBLA_PRIORITIES_CONFIG", PrioritiesConfig(), "The path to the file setting the scheduling priority of API keys and users"},
+		"GOOBLA_PULL_CONCURRENCY":      {"GOOBLA_PULL_CONCURRENCY", PullConcurrency(), "Maximum number of parts of a layer downloaded at once (default 16)"},
+		"GOOBLA_RATE_LIMIT_RPM":        {"GOOBLA_RATE_LIMIT_RPM", RateLimitRPM(), "Maximum number of inference requests each client can make a minute (default: unlimited)"},
+		"GOOBLA_RATE_LIMIT_TPM":        {"GOOBLA_RATE_LIMIT_TPM", RateLimitTPM(), "Maximum number of prompt and generated tokens each client can use a minute (default: unlimited)"},
+		"GOOBLA_REGISTRIES_CONFIG":     {"GOOBLA_REGISTRIES_CONFIG", RegistriesConfig(), "The path to the per-registry settings file"},
+		"GOOBLA_REGISTRY_MIRRORS":      {"GOOBLA_REGISTRY_MIRRORS", RegistryMirrors(), "A comma separated list of registry mirrors to pull from before the default registry"},
+		"GOOBLA_REQUIRE_SIGNED_MODELS": {"GOOBLA_REQUIRE_SIGNED_MODELS", RequireSignedModels(), "Refuse to pull models that aren't signed by a trusted key"},
+		"GOOBLA_SIGNING_KEY":           {"GOOBLA_SIGNING_KEY", SigningKey(), "The path to the private key to sign models with"},
+		"GOOBLA_SCRUB_INTERVAL":        {"GOOBLA_SCRUB_INTERVAL", ScrubInterval(), "How often to check model blobs for corruption, e.g. \"168h\" (default: disabled)"},
+		"GOOBLA_SCRUB_RATE":            {"GOOBLA_SCRUB_RATE", ScrubRate(), "Maximum bytes per second read while checking model blobs, 0 for unlimited"},
+		"GOOBLA_ROUTE_TO":              {"GOOBLA_ROUTE_TO", RouteTo(), "A comma separated list of servers to proxy inference requests to"},
+		"GOOBLA_SCHED_SPREAD":          {"GOOBLA_SCHED_SPREAD", SchedSpread(), "Always schedule model across all GPUs"},
+		"GOOBLA_SERVE_PEERS":           {"GOOBLA_SERVE_PEERS", ServePeers(), "Serve models to other servers pulling with --from"},
+		"GOOBLA_SESSION_MAX_SIZE":      {"GOOBLA_SESSION_MAX_SIZE", SessionMaxSize(), "Maximum size of the saved caches of chat sessions (default 10GB)"},
+		"GOOBLA_SESSION_TTL":           {"GOOBLA_SESSION_TTL", SessionTTL(), "How long to keep the saved cache of a chat session after it was last used (default \"168h\")"},
+		"GOOBLA_SOCKET_GIDS":           {"GOOBLA_SOCKET_GIDS", SocketGIDs(), "A comma separated list of group ids allowed to connect to the unix socket"},
+		"GOOBLA_SOCKET_UIDS":           {"GOOBLA_SOCKET_UIDS", SocketUIDs(), "A comma separated list of user ids allowed to connect to the unix socket"},
+		"GOOBLA_TLS_CA_CERT":           {"GOOBLA_TLS_CA_CERT", TLSCACert(), "The path to CA certificates the client trusts the server's certificate from"},
+		"GOOBLA_TLS_CERT":              {"GOOBLA_TLS_CERT", TLSCert(), "The path to the certificate to serve TLS with, empty to serve plain HTTP"},
+		"GOOBLA_TLS_CLIENT_CA":         {"GOOBLA_TLS_CLIENT_CA", TLSClientCA(), "The path to CA certificates clients must present a certificate signed by"},
+		"GOOBLA_TLS_CLIENT_CERT":       {"GOOBLA_TLS_CLIENT_CERT", TLSClientCert(), "The path to the certificate the client presents to the server"},
+		"GOOBLA_TLS_CLIENT_KEY":        {"GOOBLA_TLS_CLIENT_KEY", TLSClientKey(), "The path to the private key of GOOBLA_TLS_CLIENT_CERT"},
+		"GOOBLA_TLS_KEY":               {"GOOBLA_TLS_KEY", TLSKey(), "The path to the private key of GOOBLA_TLS_CERT"},
+		"GOOBLA_TOOLS":                 {"GOOBLA_TOOLS", Tools(), "A comma separated list of built-in tools the server can run for models: calculator, http_fetch and run_command"},
+		"GOOBLA_TOOL_COMMANDS":         {"GOOBLA_TOOL_COMMANDS", ToolCommands(), "A comma separated list of the commands run_command can run"},
+		"GOOBLA_IMAGE_PATHS":           {"GOOBLA_IMAGE_PATHS", ImagePaths(), "A comma separated list of the directories images can be read from by path"},
+		"GOOBLA_IMAGE_HOSTS":           {"GOOBLA_IMAGE_HOSTS", ImageHosts(), "A comma separated list of the hosts images can be fetched from by URL, or * for any host"},
+		"GOOBLA_TRUSTED_KEYS":          {"GOOBLA_TRUSTED_KEYS", TrustedKeys(), "The path to the file listing the keys trusted to sign models"},
+		"GOOBLA_UNIX_SOCKET":           {"GOOBLA_UNIX_SOCKET", UnixSocket(), "The path to a unix socket to listen on in addition to GOOBLA_HOST"},
+		"GOOBLA_UPDATE_INTERVAL":       {"GOOBLA_UPDATE_INTERVAL", UpdateInterval(), "How often to check pulled models for updates and pull them, 0 to disable"},
+		"GOOBLA_WEBHOOKS":              {"GOOBLA_WEBHOOKS", Webhooks(), "A comma separated list of URLs notified of model lifecycle events"},
+		"GOOBLA_WEBHOOKS_CONFIG":       {"GOOBLA_WEBHOOKS_CONFIG", WebhooksConfig(), "The path to the webhooks config file"},
+		"GOOBLA_MULTIUSER_CACHE":       {"GOOBLA_MULTIUSER_CACHE", MultiUserCache(), "Optimize prompt caching for multi-user scenarios"},
+		"GOOBLA_CONTEXT_LENGTH":        {"GOOBLA_CONTEXT_LENGTH", ContextLength(), "Context length to use unless otherwise specified (default: 4096)"},
+		"GOOBLA_NEW_ENGINE":            {"GOOBLA_NEW_ENGINE", NewEngine(), "Enable the new Goobla engine"},
+		"GOOBLA_PPROF":                 {"GOOBLA_PPROF", PprofAddr(), "Bind pprof to this address or 'off' to disable"},
 
 		// Informational
 		"HTTP_PROXY":  {"HTTP_PROXY", String("HTTP_PROXY")(), "HTTP proxy"},
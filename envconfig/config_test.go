@@ -3,6 +3,8 @@ package envconfig
 import (
 	"log/slog"
 	"math"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -37,6 +39,7 @@ func TestHost(t *testing.T) {
 		"https":               {"https://1.2.3.4", "https://1.2.3.4:443"},
 		"https port":          {"https://1.2.3.4:4321", "https://1.2.3.4:4321"},
 		"proxy path":          {"https://example.com/goobla", "https://example.com:443/goobla"},
+		"unix socket":         {"unix:///run/goobla.sock", "unix:///run/goobla.sock"},
 	}
 
 	for name, tt := range cases {
@@ -147,6 +150,24 @@ func TestOrigins(t *testing.T) {
 	}
 }
 
+func TestStrings(t *testing.T) {
+	cases := map[string][]string{
+		"":                            nil,
+		"mirror.example.com":          {"mirror.example.com"},
+		"a.example.com,b.example.com": {"a.example.com", "b.example.com"},
+		" http://10.0.0.2:5000 , https://mirror.example.com,": {"http://10.0.0.2:5000", "https://mirror.example.com"},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			t.Setenv("GOOBLA_STRINGS", k)
+			if diff := cmp.Diff(v, Strings("GOOBLA_STRINGS")()); diff != "" {
+				t.Errorf("%s: mismatch (-want +got):\n%s", k, diff)
+			}
+		})
+	}
+}
+
 func TestBool(t *testing.T) {
 	cases := map[string]bool{
 		"":      false,
@@ -259,6 +280,141 @@ func TestLoadTimeout(t *testing.T) {
 	}
 }
 
+func TestMaxGenerationTime(t *testing.T) {
+	cases := map[string]time.Duration{
+		"":    0,
+		"30s": 30 * time.Second,
+		"10m": 10 * time.Minute,
+		"60":  time.Minute,
+		"0":   0,
+		"-1m": 0,
+		// invalid values
+		"???": 0,
+		"1d":  0,
+	}
+
+	for tt, expect := range cases {
+		t.Run(tt, func(t *testing.T) {
+			t.Setenv("GOOBLA_MAX_GENERATION_TIME", tt)
+			if actual := MaxGenerationTime(); actual != expect {
+				t.Errorf("%s: expected %s, got %s", tt, expect, actual)
+			}
+		})
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	cases := map[string]time.Duration{
+		"":    5 * time.Minute,
+		"30s": 30 * time.Second,
+		"60":  time.Minute,
+		"0":   0,
+		"-1m": 0,
+		// invalid values
+		"???": 5 * time.Minute,
+	}
+
+	for tt, expect := range cases {
+		t.Run(tt, func(t *testing.T) {
+			t.Setenv("GOOBLA_DRAIN_TIMEOUT", tt)
+			if actual := DrainTimeout(); actual != expect {
+				t.Errorf("%s: expected %s, got %s", tt, expect, actual)
+			}
+		})
+	}
+}
+
+func TestSessionTTL(t *testing.T) {
+	defaultTTL := 7 * 24 * time.Hour
+	cases := map[string]time.Duration{
+		"":     defaultTTL,
+		"24h":  24 * time.Hour,
+		"3600": time.Hour,
+		"0":    0,
+		"-1h":  0,
+		// invalid values
+		"???": defaultTTL,
+		"1w":  defaultTTL,
+	}
+
+	for tt, expect := range cases {
+		t.Run(tt, func(t *testing.T) {
+			t.Setenv("GOOBLA_SESSION_TTL", tt)
+			if actual := SessionTTL(); actual != expect {
+				t.Errorf("%s: expected %s, got %s", tt, expect, actual)
+			}
+		})
+	}
+}
+
+func TestScrubInterval(t *testing.T) {
+	cases := map[string]time.Duration{
+		"":     0,
+		"24h":  24 * time.Hour,
+		"3600": time.Hour,
+		"0":    0,
+		"-1h":  0,
+		// invalid values
+		"???": 0,
+		"1w":  0,
+	}
+
+	for tt, expect := range cases {
+		t.Run(tt, func(t *testing.T) {
+			t.Setenv("GOOBLA_SCRUB_INTERVAL", tt)
+			if actual := ScrubInterval(); actual != expect {
+				t.Errorf("%s: expected %s, got %s", tt, expect, actual)
+			}
+		})
+	}
+}
+
+func TestUpdateInterval(t *testing.T) {
+	cases := map[string]time.Duration{
+		"":     0,
+		"24h":  24 * time.Hour,
+		"3600": time.Hour,
+		"-1h":  0,
+		"???":  0,
+	}
+
+	for tt, expect := range cases {
+		t.Run(tt, func(t *testing.T) {
+			t.Setenv("GOOBLA_UPDATE_INTERVAL", tt)
+			if actual := UpdateInterval(); actual != expect {
+				t.Errorf("%s: expected %s, got %s", tt, expect, actual)
+			}
+		})
+	}
+}
+
+func TestModelsDirs(t *testing.T) {
+	sep := string(filepath.ListSeparator)
+	cases := map[string][]string{
+		filepath.Join("a", "models"):                          {filepath.Join("a", "models")},
+		strings.Join([]string{"system", "user"}, sep):         {"system", "user"},
+		strings.Join([]string{"system", "", "user", ""}, sep): {"system", "user"},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			t.Setenv("GOOBLA_MODELS", k)
+			dirs, err := ModelsDirs()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(v, dirs); diff != "" {
+				t.Errorf("%s: mismatch (-want +got):\n%s", k, diff)
+			}
+
+			if m, _ := Models(); m != v[len(v)-1] {
+				t.Errorf("%s: expected the last directory to be writable, got %q", k, m)
+			}
+		})
+	}
+}
+
 func TestVar(t *testing.T) {
 	cases := map[string]string{
 		"value":       "value",
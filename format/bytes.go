@@ -3,6 +3,8 @@ package format
 import (
 	"fmt"
 	"math"
+	"strconv"
+	"strings"
 )
 
 const (
@@ -61,3 +63,48 @@ func HumanBytes2(b uint64) string {
 		return fmt.Sprintf("%d B", b)
 	}
 }
+
+var byteUnits = map[string]float64{
+	"":    Byte,
+	"b":   Byte,
+	"k":   KiloByte,
+	"kb":  KiloByte,
+	"m":   MegaByte,
+	"mb":  MegaByte,
+	"g":   GigaByte,
+	"gb":  GigaByte,
+	"t":   TeraByte,
+	"tb":  TeraByte,
+	"ki":  KibiByte,
+	"kib": KibiByte,
+	"mi":  MebiByte,
+	"mib": MebiByte,
+	"gi":  GibiByte,
+	"gib": GibiByte,
+	"ti":  GibiByte * 1024,
+	"tib": GibiByte * 1024,
+}
+
+// ParseBytes parses a size such as "512", "10MB" or "1.5 GiB" into a number
+// of bytes. Units are case insensitive and the trailing "B" is optional.
+func ParseBytes(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+
+	value, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	unit, ok := byteUnits[strings.ToLower(strings.TrimSpace(s[i:]))]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q: unknown unit %q", s, strings.TrimSpace(s[i:]))
+	}
+
+	return int64(value * unit), nil
+}
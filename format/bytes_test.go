@@ -89,3 +89,40 @@ func TestHumanBytes2(t *testing.T) {
 		})
 	}
 }
+
+func TestParseBytes(t *testing.T) {
+	tests := map[string]int64{
+		"0":       0,
+		"512":     512,
+		"512B":    512,
+		"1KB":     1000,
+		"1.5 MB":  1500000,
+		"10mb":    10000000,
+		"10M":     10000000,
+		"2GB":     2000000000,
+		"1TB":     1000000000000,
+		"1KiB":    1024,
+		"1.5 MiB": 1572864,
+		"1GiB":    1073741824,
+	}
+
+	for input, expected := range tests {
+		t.Run(input, func(t *testing.T) {
+			result, err := ParseBytes(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != expected {
+				t.Errorf("Expected %d, got %d", expected, result)
+			}
+		})
+	}
+
+	for _, input := range []string{"", "MB", "10XB", "-1MB", "1.2.3"} {
+		t.Run(input, func(t *testing.T) {
+			if _, err := ParseBytes(input); err == nil {
+				t.Errorf("expected error for %q", input)
+			}
+		})
+	}
+}
@@ -85,6 +85,16 @@ func (kv KV) ContextLength() uint64 {
 	return uint64(kv.Uint("context_length"))
 }
 
+// VocabSize returns the number of tokens in the vocabulary, which is known
+// even if the tokens themselves weren't read.
+func (kv KV) VocabSize() uint64 {
+	if a, ok := kv["tokenizer.ggml.tokens"].(*array[string]); ok {
+		return uint64(a.size)
+	}
+
+	return 0
+}
+
 func (kv KV) ChatTemplate() string {
 	return kv.String("tokenizer.chat_template")
 }
@@ -674,9 +684,15 @@ func (llm GGML) VisionGraphSize() (weights, graphSize uint64) {
 	return weights, graphSize
 }
 
-// SupportsKVCacheType checks if the requested cache type is supported
+// SupportsKVCacheType checks if the requested cache type is supported.
+// Quantized caches need flash attention, so they're only supported by
+// models that support it.
 func (f GGML) SupportsKVCacheType(cacheType string) bool {
-	return slices.Contains([]string{"f16", "q8_0", "q4_0"}, cacheType)
+	if cacheType == "f16" {
+		return true
+	}
+
+	return slices.Contains([]string{"q8_0", "q4_0"}, cacheType) && f.SupportsFlashAttention()
 }
 
 // SupportsFlashAttention checks if the model supports flash attention
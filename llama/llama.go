@@ -61,6 +61,25 @@ func BackendInit() {
 	C.llama_backend_init()
 }
 
+// NumaInit places the threads of the CPU backend on the nodes of a NUMA
+// system with a strategy of "distribute", "isolate" or "numactl". It must be
+// called once after BackendInit.
+func NumaInit(strategy string) {
+	var numa C.enum_ggml_numa_strategy
+	switch strategy {
+	case "distribute":
+		numa = C.GGML_NUMA_STRATEGY_DISTRIBUTE
+	case "isolate":
+		numa = C.GGML_NUMA_STRATEGY_ISOLATE
+	case "numactl":
+		numa = C.GGML_NUMA_STRATEGY_NUMACTL
+	default:
+		return
+	}
+
+	C.llama_numa_init(numa)
+}
+
 func GetModelArch(modelPath string) (string, error) {
 	mp := C.CString(modelPath)
 	defer C.free(unsafe.Pointer(mp))
@@ -171,15 +190,43 @@ func (c *Context) KvCacheCanShift() bool {
 	return bool(C.llama_kv_self_can_shift(c.c))
 }
 
-// Get the embeddings for a sequence id
+// StateSeqGetData returns a copy of the KV cache of the sequence seqId
+func (c *Context) StateSeqGetData(seqId int) []byte {
+	size := C.llama_state_seq_get_size(c.c, C.int(seqId))
+	if size == 0 {
+		return nil
+	}
+
+	data := make([]byte, size)
+	n := C.llama_state_seq_get_data(c.c, (*C.uint8_t)(unsafe.Pointer(&data[0])), size, C.int(seqId))
+	return data[:n]
+}
+
+// StateSeqSetData replaces the KV cache of the sequence seqId with data
+// previously returned by StateSeqGetData
+func (c *Context) StateSeqSetData(seqId int, data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+
+	return C.llama_state_seq_set_data(c.c, (*C.uint8_t)(unsafe.Pointer(&data[0])), C.size_t(len(data)), C.int(seqId)) > 0
+}
+
+// Get the embeddings for a sequence id. Models with rank pooling have a
+// single score for the sequence instead.
 func (c *Context) GetEmbeddingsSeq(seqId int) []float32 {
 	e := unsafe.Pointer(C.llama_get_embeddings_seq(c.c, C.int(seqId)))
 	if e == nil {
 		return nil
 	}
 
-	embeddings := make([]float32, c.Model().NEmbd())
-	_ = copy(embeddings, unsafe.Slice((*float32)(e), c.Model().NEmbd()))
+	n := c.Model().NEmbd()
+	if C.llama_pooling_type(c.c) == C.LLAMA_POOLING_TYPE_RANK {
+		n = 1
+	}
+
+	embeddings := make([]float32, n)
+	_ = copy(embeddings, unsafe.Slice((*float32)(e), n))
 	return embeddings
 }
 
@@ -194,6 +241,18 @@ func (c *Context) GetEmbeddingsIth(i int) []float32 {
 	return embeddings
 }
 
+// GetLogitsIth returns the logits for the i-th token of the last batch
+// decoded, which must have had its logits requested. The slice is only valid
+// until the next call to Decode.
+func (c *Context) GetLogitsIth(i int) []float32 {
+	l := unsafe.Pointer(C.llama_get_logits_ith(c.c, C.int32_t(i)))
+	if l == nil {
+		return nil
+	}
+
+	return unsafe.Slice((*float32)(l), c.Model().NumVocab())
+}
+
 type ModelParams struct {
 	NumGpuLayers int
 	MainGpu      int
@@ -276,21 +335,37 @@ func (m *Model) AddBOSToken() bool {
 	return bool(C.llama_vocab_get_add_bos(m.Vocab()))
 }
 
-func (m *Model) ApplyLoraFromFile(context *Context, loraPath string, scale float32, threads int) error {
-	cLoraPath := C.CString(loraPath)
-	defer C.free(unsafe.Pointer(cLoraPath))
+// LoraAdapter is a LoRA adapter loaded for a model, which applies to the
+// contexts it's set on.
+type LoraAdapter struct {
+	c *C.struct_llama_adapter_lora
+}
 
-	loraAdapter := C.llama_adapter_lora_init(m.c, cLoraPath)
-	if loraAdapter == nil {
-		return errors.New("unable to load lora")
-	}
+// LoadLoraAdapter loads the LoRA adapter at path for m without applying it.
+func (m *Model) LoadLoraAdapter(path string) (*LoraAdapter, error) {
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
 
-	err := -1
-	if loraAdapter != nil {
-		err = int(C.llama_set_adapter_lora(context.c, loraAdapter, C.float(scale)))
+	a := C.llama_adapter_lora_init(m.c, cPath)
+	if a == nil {
+		return nil, errors.New("unable to load lora")
 	}
-	if err != 0 {
-		return errors.New("error applying lora from file")
+
+	return &LoraAdapter{c: a}, nil
+}
+
+// SetLoraAdapters applies adapters to c with scales, in place of the adapters
+// applied before. Adapters with scale 0 aren't applied.
+func (c *Context) SetLoraAdapters(adapters []*LoraAdapter, scales []float32) error {
+	C.llama_clear_adapter_lora(c.c)
+	for i, a := range adapters {
+		if scales[i] == 0 {
+			continue
+		}
+
+		if C.llama_set_adapter_lora(c.c, a.c, C.float(scales[i])) != 0 {
+			return errors.New("error applying lora")
+		}
 	}
 
 	return nil
@@ -532,6 +607,26 @@ type SamplingParams struct {
 	PenalizeNl     bool
 	Seed           uint32
 	Grammar        string
+	LogitBias      map[int]float32
+
+	// Samplers is the order the samplers are applied in, by their names in
+	// llama.cpp, such as "top_k" and "typ_p"
+	Samplers []string
+
+	DynatempRange    float32
+	DynatempExponent float32
+
+	// Mirostat enables mirostat 2.0 sampling if it's 2
+	Mirostat    int
+	MirostatTau float32
+	MirostatEta float32
+
+	// DryMultiplier enables DRY sampling if it's positive
+	DryMultiplier       float32
+	DryBase             float32
+	DryAllowedLength    int
+	DryPenaltyLastN     int
+	DrySequenceBreakers []string
 }
 
 func NewSamplingContext(model *Model, params SamplingParams) (*SamplingContext, error) {
@@ -546,11 +641,72 @@ func NewSamplingContext(model *Model, params SamplingParams) (*SamplingContext,
 	cparams.penalty_freq = C.float(params.PenaltyFreq)
 	cparams.penalty_present = C.float(params.PenaltyPresent)
 	cparams.seed = C.uint32_t(params.Seed)
+	cparams.dynatemp_range = C.float(params.DynatempRange)
+	cparams.dynatemp_exponent = C.float(params.DynatempExponent)
+	if params.Mirostat == 2 {
+		cparams.mirostat = 2
+	}
+	cparams.mirostat_tau = C.float(params.MirostatTau)
+	cparams.mirostat_eta = C.float(params.MirostatEta)
+	cparams.dry_multiplier = C.float(params.DryMultiplier)
+	cparams.dry_base = C.float(params.DryBase)
+	cparams.dry_allowed_length = C.int32_t(params.DryAllowedLength)
+	cparams.dry_penalty_last_n = C.int32_t(params.DryPenaltyLastN)
 
 	grammar := C.CString(params.Grammar)
 	defer C.free(unsafe.Pointer(grammar))
 
 	cparams.grammar = grammar
+
+	if len(params.LogitBias) > 0 {
+		n := len(params.LogitBias)
+		tokens := (*C.int32_t)(C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof(C.int32_t(0)))))
+		defer C.free(unsafe.Pointer(tokens))
+		values := (*C.float)(C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof(C.float(0)))))
+		defer C.free(unsafe.Pointer(values))
+
+		ts := unsafe.Slice(tokens, n)
+		vs := unsafe.Slice(values, n)
+		i := 0
+		for token, bias := range params.LogitBias {
+			ts[i] = C.int32_t(token)
+			vs[i] = C.float(bias)
+			i++
+		}
+
+		cparams.logit_bias_tokens = tokens
+		cparams.logit_bias_values = values
+		cparams.n_logit_bias = C.size_t(n)
+	}
+	if len(params.Samplers) > 0 {
+		n := len(params.Samplers)
+		names := (**C.char)(C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof((*C.char)(nil)))))
+		defer C.free(unsafe.Pointer(names))
+
+		ns := unsafe.Slice(names, n)
+		for i, name := range params.Samplers {
+			ns[i] = C.CString(name)
+			defer C.free(unsafe.Pointer(ns[i]))
+		}
+
+		cparams.samplers = names
+		cparams.n_samplers = C.size_t(n)
+	}
+	if len(params.DrySequenceBreakers) > 0 {
+		n := len(params.DrySequenceBreakers)
+		breakers := (**C.char)(C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof((*C.char)(nil)))))
+		defer C.free(unsafe.Pointer(breakers))
+
+		bs := unsafe.Slice(breakers, n)
+		for i, b := range params.DrySequenceBreakers {
+			bs[i] = C.CString(b)
+			defer C.free(unsafe.Pointer(bs[i]))
+		}
+
+		cparams.dry_sequence_breakers = breakers
+		cparams.n_dry_sequence_breakers = C.size_t(n)
+	}
+
 	context := &SamplingContext{c: C.common_sampler_cinit(model.c, &cparams)}
 	if context.c == nil {
 		return nil, errors.New("unable to create sampling context")
@@ -592,6 +748,14 @@ func SchemaToGrammar(schema []byte) []byte {
 	return buf[:n]
 }
 
+// ValidGrammar reports whether grammar is a GBNF grammar with a root rule
+func ValidGrammar(grammar string) bool {
+	cStr := C.CString(grammar)
+	defer C.free(unsafe.Pointer(cStr))
+
+	return C.grammar_validate(cStr) != 0
+}
+
 type TokenData struct {
 	ID    int32
 	Logit float32
@@ -15,12 +15,31 @@ struct common_sampler *common_sampler_cinit(const struct llama_model *model, str
         sparams.min_p = params->min_p;
         sparams.typ_p = params->typical_p;
         sparams.temp = params->temp;
+        sparams.dynatemp_range = params->dynatemp_range;
+        sparams.dynatemp_exponent = params->dynatemp_exponent;
+        sparams.mirostat = params->mirostat;
+        sparams.mirostat_tau = params->mirostat_tau;
+        sparams.mirostat_eta = params->mirostat_eta;
         sparams.penalty_last_n = params->penalty_last_n;
         sparams.penalty_repeat = params->penalty_repeat;
         sparams.penalty_freq = params->penalty_freq;
         sparams.penalty_present = params->penalty_present;
+        sparams.dry_multiplier = params->dry_multiplier;
+        sparams.dry_base = params->dry_base;
+        sparams.dry_allowed_length = params->dry_allowed_length;
+        sparams.dry_penalty_last_n = params->dry_penalty_last_n;
+        if (params->n_dry_sequence_breakers > 0) {
+            sparams.dry_sequence_breakers.assign(params->dry_sequence_breakers, params->dry_sequence_breakers + params->n_dry_sequence_breakers);
+        }
         sparams.seed = params->seed;
         sparams.grammar = params->grammar;
+        for (size_t i = 0; i < params->n_logit_bias; i++) {
+            sparams.logit_bias.push_back({params->logit_bias_tokens[i], params->logit_bias_values[i]});
+        }
+        if (params->n_samplers > 0) {
+            std::vector<std::string> names(params->samplers, params->samplers + params->n_samplers);
+            sparams.samplers = common_sampler_types_from_names(names, true);
+        }
         sparams.xtc_probability = 0.0;
         sparams.xtc_threshold = 0.5;
         return common_sampler_init(model, sparams);
@@ -66,6 +85,24 @@ int schema_to_grammar(const char *json_schema, char *grammar, size_t max_len)
     }
 }
 
+int grammar_validate(const char *grammar)
+{
+    try
+    {
+        llama_grammar_parser parser;
+        if (!parser.parse(grammar) || parser.rules.empty())
+        {
+            return 0;
+        }
+
+        return parser.symbol_ids.find("root") != parser.symbol_ids.end();
+    }
+    catch (const std::exception &e)
+    {
+        return 0;
+    }
+}
+
 struct llama_vocab * llama_load_vocab_from_file(const char * fname) {
     llama_vocab * vocab = new llama_vocab();
     try {
@@ -16,12 +16,28 @@ extern "C"
         float min_p;
         float typical_p;
         float temp;
+        float dynatemp_range;
+        float dynatemp_exponent;
+        int32_t mirostat;
+        float mirostat_tau;
+        float mirostat_eta;
         int32_t penalty_last_n;
         float penalty_repeat;
         float penalty_freq;
         float penalty_present;
+        float dry_multiplier;
+        float dry_base;
+        int32_t dry_allowed_length;
+        int32_t dry_penalty_last_n;
+        const char **dry_sequence_breakers;
+        size_t n_dry_sequence_breakers;
         uint32_t seed;
         char *grammar;
+        int32_t *logit_bias_tokens;
+        float *logit_bias_values;
+        size_t n_logit_bias;
+        const char **samplers;
+        size_t n_samplers;
     };
 
     struct common_sampler *common_sampler_cinit(const struct llama_model *model, struct common_sampler_cparams *params);
@@ -31,6 +47,7 @@ extern "C"
     llama_token common_sampler_csample(struct common_sampler *sampler, struct llama_context *ctx, int idx);
 
     int schema_to_grammar(const char *json_schema, char *grammar, size_t max_len);
+    int grammar_validate(const char *grammar);
 
 
     struct llama_grammar *grammar_init(char* grammar, uint32_t* tokens, size_t n_tokens, const char** pieces, uint32_t* eog_tokens, size_t n_eog_tokens);
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -14,12 +16,41 @@ import (
 	"github.com/goobla/goobla/fs/ggml"
 )
 
+// vramHeadroom returns the VRAM of a GPU with total memory that
+// GOOBLA_VRAM_HEADROOM leaves free, either a size or a percentage of total.
+func vramHeadroom(total uint64) uint64 {
+	s := envconfig.VRAMHeadroom()
+	if s == "" {
+		return 0
+	}
+
+	if pct, ok := strings.CutSuffix(s, "%"); ok {
+		f, err := strconv.ParseFloat(strings.TrimSpace(pct), 64)
+		if err != nil || f < 0 || f > 100 {
+			slog.Warn("invalid GOOBLA_VRAM_HEADROOM, ignoring", "value", s)
+			return 0
+		}
+
+		return uint64(float64(total) * f / 100)
+	}
+
+	n, err := format.ParseBytes(s)
+	if err != nil || n < 0 {
+		slog.Warn("invalid GOOBLA_VRAM_HEADROOM, ignoring", "value", s)
+		return 0
+	}
+
+	return uint64(n)
+}
+
 // This algorithm looks for a complete fit to determine if we need to unload other models
 func PredictServerFit(allGpus discover.GpuInfoList, f *ggml.GGML, adapters, projectors []string, opts api.Options, numParallel int) (bool, uint64) {
 	// Split up the GPUs by type and try them
 	var estimatedVRAM uint64
 	for _, gpus := range allGpus.ByLibrary() {
 		var layerCount int
+		opts := opts
+		opts.TensorSplit = TensorSplitFor(opts.TensorSplit, allGpus, gpus)
 		estimate := EstimateGPULayers(gpus, f, projectors, opts, numParallel)
 		layerCount, estimatedVRAM = estimate.Layers, estimate.VRAMSize
 		if opts.NumGPU < 0 {
@@ -35,6 +66,121 @@ func PredictServerFit(allGpus discover.GpuInfoList, f *ggml.GGML, adapters, proj
 	return false, estimatedVRAM
 }
 
+// ParseTensorSplit parses a comma separated list of the proportions of a
+// model to place on each GPU.
+func ParseTensorSplit(s string) ([]float64, error) {
+	var proportions []float64
+	var total float64
+	for _, v := range strings.Split(s, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || f < 0 {
+			return nil, fmt.Errorf("invalid tensor_split %q: proportions must be non-negative numbers", s)
+		}
+
+		proportions = append(proportions, f)
+		total += f
+	}
+
+	if total == 0 {
+		return nil, fmt.Errorf("invalid tensor_split %q: at least one proportion must be greater than zero", s)
+	}
+
+	return proportions, nil
+}
+
+// TensorSplitFor returns the proportions of split, which is given for the
+// GPUs in from, for the GPUs in to, in their order. It returns "" if split
+// isn't valid for from, or gives none of the model to the GPUs in to.
+func TensorSplitFor(split string, from, to discover.GpuInfoList) string {
+	if split == "" {
+		return ""
+	}
+
+	proportions, err := ParseTensorSplit(split)
+	if err != nil || len(proportions) != len(from) {
+		return ""
+	}
+
+	var total float64
+	s := make([]string, len(to))
+	for i, g := range to {
+		j := slices.IndexFunc(from, func(o discover.GpuInfo) bool { return o.Library == g.Library && o.ID == g.ID })
+		if j < 0 {
+			return ""
+		}
+
+		total += proportions[j]
+		s[i] = strconv.FormatFloat(proportions[j], 'f', -1, 64)
+	}
+
+	if total == 0 {
+		return ""
+	}
+
+	return strings.Join(s, ",")
+}
+
+// minAutoContextLength and maxAutoContextLength bound the context length
+// chosen for num_ctx auto. The maximum applies to models that don't report
+// the length they were trained with.
+const (
+	minAutoContextLength = 2048
+	maxAutoContextLength = 128 * 1024
+)
+
+// FitContextLength returns the largest context length per sequence that fits
+// model f in memory: entirely in the VRAM of gpus if it can, and otherwise in
+// their VRAM and systemFree bytes of system memory. It's at most the length
+// the model was trained with, and minAutoContextLength if even that doesn't
+// fit.
+func FitContextLength(gpus discover.GpuInfoList, f *ggml.GGML, projectors []string, opts api.Options, numParallel int, systemFree uint64) int {
+	maxCtx := int(f.KV().ContextLength())
+	if maxCtx <= 0 {
+		maxCtx = maxAutoContextLength
+	}
+	if maxCtx <= minAutoContextLength {
+		return maxCtx
+	}
+
+	inVRAM := func(numCtx int) bool {
+		opts.NumCtx = numCtx * numParallel
+		ok, _ := PredictServerFit(gpus, f, nil, projectors, opts, numParallel)
+		return ok
+	}
+
+	inMemory := func(numCtx int) bool {
+		opts.NumCtx = numCtx * numParallel
+		estimate := EstimateGPULayers(gpus, f, projectors, opts, numParallel)
+		return estimate.TotalSize-estimate.VRAMSize <= systemFree
+	}
+
+	fits := inMemory
+	if gpus[0].Library != "cpu" && inVRAM(minAutoContextLength) {
+		fits = inVRAM
+	}
+
+	if fits(maxCtx) {
+		return maxCtx
+	}
+
+	// search in steps of 256 for the first length that doesn't fit
+	const step = 256
+	n := sort.Search((maxCtx-minAutoContextLength)/step, func(i int) bool {
+		return !fits(minAutoContextLength + (i+1)*step)
+	})
+	return minAutoContextLength + n*step
+}
+
+// WeightPaths returns the files loaded onto the first GPU along with a model's
+// layers: its projectors, and its draft model if it has one.
+func WeightPaths(projectors []string, draft string) []string {
+	if draft == "" {
+		return projectors
+	}
+
+	return append(slices.Clip(projectors), draft)
+}
+
 type MemoryEstimate struct {
 	// How many layers we predict we can load
 	Layers int
@@ -103,9 +249,11 @@ func EstimateGPULayers(gpus []discover.GpuInfo, f *ggml.GGML, projectors []strin
 	// Overflow that didn't fit into the GPU
 	var overflow uint64
 
-	overhead := envconfig.GpuOverhead()
+	// VRAM set aside on each GPU
+	overheads := make([]uint64, len(gpus))
 	availableList := make([]string, len(gpus))
 	for i, gpu := range gpus {
+		overheads[i] = envconfig.GpuOverhead() + vramHeadroom(gpu.TotalMemory)
 		availableList[i] = format.HumanBytes2(gpu.FreeMemory)
 	}
 	slog.Debug("evaluating", "library", gpus[0].Library, "gpu_count", len(gpus), "available", availableList)
@@ -129,15 +277,8 @@ func EstimateGPULayers(gpus []discover.GpuInfo, f *ggml.GGML, projectors []strin
 		slog.Warn("model missing blk.0 layer size")
 	}
 
-	var kvct string
-	if envconfig.FlashAttention() &&
-		discover.GetGPUInfo().FlashAttentionSupported() &&
-		f.SupportsFlashAttention() {
-		requested := strings.ToLower(envconfig.KvCacheType())
-		if requested != "" && f.SupportsKVCacheType(requested) {
-			kvct = requested
-		}
-	}
+	// invalid cache types are reported when the model is loaded
+	_, kvct, _ := kvCacheType(f, gpus, opts.KVCacheType)
 
 	kv, graphPartialOffload, graphFullOffload := f.GraphSize(uint64(opts.NumCtx), uint64(min(opts.NumCtx, opts.NumBatch)), numParallel, kvct)
 
@@ -192,7 +333,7 @@ func EstimateGPULayers(gpus []discover.GpuInfo, f *ggml.GGML, projectors []strin
 			gzo = gpuZeroOverhead
 		}
 		// Only include GPUs that can fit the graph, gpu minimum, the layer buffer and at least more layer
-		if gpus[i].FreeMemory < overhead+gzo+max(graphPartialOffload, graphFullOffload)+gpus[i].MinimumMemory+2*layerSize {
+		if gpus[i].FreeMemory < overheads[i]+gzo+max(graphPartialOffload, graphFullOffload)+gpus[i].MinimumMemory+2*layerSize {
 			slog.Debug("gpu has too little memory to allocate any layers",
 				"id", gpus[i].ID,
 				"library", gpus[i].Library,
@@ -205,6 +346,7 @@ func EstimateGPULayers(gpus []discover.GpuInfo, f *ggml.GGML, projectors []strin
 				"minimum_memory", gpus[i].MinimumMemory,
 				"layer_size", format.HumanBytes2(layerSize),
 				"gpu_zer_overhead", format.HumanBytes2(gzo),
+				"reserved", format.HumanBytes2(overheads[i]),
 				"partial_offload", format.HumanBytes2(graphPartialOffload),
 				"full_offload", format.HumanBytes2(graphFullOffload),
 			)
@@ -214,6 +356,29 @@ func EstimateGPULayers(gpus []discover.GpuInfo, f *ggml.GGML, projectors []strin
 		gpuAllocations[i] += gpus[i].MinimumMemory + layerSize // We hold off on graph until we know partial vs. full
 	}
 
+	// With a tensor split, each layer goes to the GPU furthest below its
+	// share of the layers placed so far, and once that GPU is full the rest
+	// of the layers stay on the CPU rather than skewing the split further
+	var proportions []float64
+	if len(gpus) > 1 && opts.TensorSplit != "" {
+		if p, err := ParseTensorSplit(opts.TensorSplit); err == nil && len(p) == len(gpus) {
+			proportions = p
+			gpusWithSpace = slices.DeleteFunc(gpusWithSpace, func(g gs) bool { return p[g.i] == 0 })
+		}
+	}
+
+	// nextSplitGPU returns the index in gpusWithSpace of the GPU to place the
+	// next layer on with a tensor split
+	nextSplitGPU := func() int {
+		next := -1
+		for j, g := range gpusWithSpace {
+			if next < 0 || float64(layerCounts[g.i])/proportions[g.i] < float64(layerCounts[gpusWithSpace[next].i])/proportions[gpusWithSpace[next].i] {
+				next = j
+			}
+		}
+		return next
+	}
+
 	var gpuZeroID int
 	if len(gpusWithSpace) > 0 {
 		gpuZeroID = gpusWithSpace[0].i
@@ -237,11 +402,23 @@ func EstimateGPULayers(gpus []discover.GpuInfo, f *ggml.GGML, projectors []strin
 			continue
 		}
 
+		if proportions != nil && len(gpusWithSpace) > 0 {
+			g := gpusWithSpace[nextSplitGPU()]
+			used := gpuAllocations[g.i] + max(graphPartialOffload, graphFullOffload)
+			if g.g.FreeMemory > overheads[g.i]+used+layerSize {
+				gpuAllocations[g.i] += layerSize
+				layerCounts[g.i]++
+				layerCount++
+			} else {
+				gpusWithSpace = nil
+			}
+		}
+
 		// distribute the layers across the GPU(s) that have space
-		for j := len(gpusWithSpace); j > 0; j-- {
+		for j := len(gpusWithSpace); proportions == nil && j > 0; j-- {
 			g := gpusWithSpace[i%j]
 			used := gpuAllocations[g.i] + max(graphPartialOffload, graphFullOffload)
-			if g.g.FreeMemory > overhead+used+layerSize {
+			if g.g.FreeMemory > overheads[g.i]+used+layerSize {
 				gpuAllocations[g.i] += layerSize
 				layerCounts[g.i]++
 				layerCount++
@@ -262,11 +439,19 @@ func EstimateGPULayers(gpus []discover.GpuInfo, f *ggml.GGML, projectors []strin
 	// Determine if we need to consider output then find where it fits
 	memoryLastLayer := memoryLayerOutput + gooblaEngineProjectorWeights + gooblaEngineProjectorGraph
 	if memoryLastLayer > 0 {
-		if opts.NumGPU < 0 || layerCount < opts.NumGPU {
+		if (opts.NumGPU < 0 || layerCount < opts.NumGPU) && proportions != nil && len(gpusWithSpace) > 0 {
+			g := gpusWithSpace[nextSplitGPU()]
+			used := gpuAllocations[g.i] + max(graphPartialOffload, graphFullOffload)
+			if g.g.FreeMemory > overheads[g.i]+used+memoryLastLayer {
+				gpuAllocations[g.i] += memoryLastLayer
+				layerCounts[g.i]++
+				layerCount++
+			}
+		} else if opts.NumGPU < 0 || layerCount < opts.NumGPU {
 			for j := len(gpusWithSpace); j > 0; j-- {
 				g := gpusWithSpace[layerCount%j]
 				used := gpuAllocations[g.i] + max(graphPartialOffload, graphFullOffload)
-				if g.g.FreeMemory > overhead+used+memoryLastLayer {
+				if g.g.FreeMemory > overheads[g.i]+used+memoryLastLayer {
 					gpuAllocations[g.i] += memoryLastLayer
 					layerCounts[g.i]++
 					layerCount++
@@ -374,6 +559,7 @@ func (m MemoryEstimate) LogValue() slog.Value {
 			// memory available by GPU for offloading
 			"available", m.availableList,
 			"gpu_overhead", format.HumanBytes2(envconfig.GpuOverhead()),
+			"vram_headroom", envconfig.VRAMHeadroom(),
 			slog.Group(
 				"required",
 				// memory required for full offloading
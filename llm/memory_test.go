@@ -128,4 +128,162 @@ func TestEstimateGPULayers(t *testing.T) {
 			}
 		})
 	}
+
+	t.Run("headroom", func(t *testing.T) {
+		t.Setenv("GOOBLA_VRAM_HEADROOM", fmt.Sprintf("%dB", layerSize))
+		for i := range gpus {
+			gpus[i].FreeMemory = gpuMinimumMemory + layerSize + 3*layerSize + 1 + max(graphFullOffload, graphPartialOffload)
+		}
+		gpus[0].FreeMemory += memoryLayerOutput
+
+		// each GPU holds one layer less than without headroom
+		estimate := EstimateGPULayers(gpus, ggml, projectors, opts, 1)
+		assert.Equal(t, "2,2", estimate.TensorSplit)
+	})
+
+	t.Run("tensor_split", func(t *testing.T) {
+		free := func(layers uint64) uint64 {
+			return gpuMinimumMemory + layerSize + layers*layerSize + 1 + max(graphFullOffload, graphPartialOffload) + memoryLayerOutput
+		}
+
+		opts := opts
+		opts.TensorSplit = "2,1"
+		gpus[0].FreeMemory, gpus[1].FreeMemory = free(6), free(6)
+		estimate := EstimateGPULayers(gpus, ggml, projectors, opts, 1)
+		assert.Equal(t, inputLayerCount+1, estimate.Layers)
+		assert.Equal(t, "4,2", estimate.TensorSplit)
+
+		// a GPU without room for its share of the layers leaves the rest on
+		// the CPU rather than running out of memory
+		opts.TensorSplit = "3,1"
+		gpus[0].FreeMemory = free(2)
+		estimate = EstimateGPULayers(gpus, ggml, projectors, opts, 1)
+		assert.Equal(t, 3, estimate.Layers)
+		assert.Equal(t, "2,1", estimate.TensorSplit)
+
+		ok, _ := PredictServerFit(gpus, ggml, nil, projectors, opts, 1)
+		assert.False(t, ok)
+
+		// GPUs without a share of the layers get none
+		opts.TensorSplit = "0,1"
+		estimate = EstimateGPULayers(gpus, ggml, projectors, opts, 1)
+		assert.Equal(t, inputLayerCount+1, estimate.Layers)
+		assert.Equal(t, "0,6", estimate.TensorSplit)
+	})
+}
+
+func TestTensorSplitFor(t *testing.T) {
+	gpus := discover.GpuInfoList{
+		{Library: "cuda", ID: "0"},
+		{Library: "cuda", ID: "1"},
+		{Library: "cuda", ID: "2"},
+	}
+
+	cases := []struct {
+		split string
+		to    discover.GpuInfoList
+		want  string
+	}{
+		{"1,2,3", gpus, "1,2,3"},
+		{"1,2,3", gpus[1:], "2,3"},
+		{"1,2,3", discover.GpuInfoList{gpus[2], gpus[0]}, "3,1"},
+		{"0.5, 0, 0.5", gpus[1:2], ""},
+		{"1,2", gpus, ""},
+		{"1,2,3", discover.GpuInfoList{{Library: "rocm", ID: "0"}}, ""},
+		{"", gpus, ""},
+	}
+
+	for _, tt := range cases {
+		if got := TensorSplitFor(tt.split, gpus, tt.to); got != tt.want {
+			t.Errorf("TensorSplitFor(%q, %v): expected %q, got %q", tt.split, tt.to, tt.want, got)
+		}
+	}
+}
+
+func TestVRAMHeadroom(t *testing.T) {
+	cases := []struct {
+		value string
+		total uint64
+		want  uint64
+	}{
+		{"", 1000, 0},
+		{"512MB", 1000, 512 * 1000 * 1000},
+		{"10%", 1000, 100},
+		{"0%", 1000, 0},
+		{"150%", 1000, 0},
+		{"lots", 1000, 0},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("GOOBLA_VRAM_HEADROOM", tt.value)
+			assert.Equal(t, tt.want, vramHeadroom(tt.total))
+		})
+	}
+}
+
+func TestFitContextLength(t *testing.T) {
+	t.Setenv("GOOBLA_KV_CACHE_TYPE", "")
+
+	f, err := os.CreateTemp(t.TempDir(), "model")
+	require.NoError(t, err)
+	defer f.Close()
+
+	require.NoError(t, ggml.WriteGGUF(f, ggml.KV{
+		"general.architecture":          "llama",
+		"llama.context_length":          uint32(32768),
+		"llama.embedding_length":        uint32(4096),
+		"llama.block_count":             uint32(2),
+		"llama.attention.head_count":    uint32(32),
+		"llama.attention.head_count_kv": uint32(8),
+		"tokenizer.ggml.tokens":         []string{" "},
+		"tokenizer.ggml.scores":         []float32{0},
+		"tokenizer.ggml.token_type":     []int32{0},
+	}, []*ggml.Tensor{
+		{Name: "blk.0.attn.weight", Kind: uint32(0), Offset: uint64(0), Shape: []uint64{1, 1, 1, 1}, WriterTo: bytes.NewReader(make([]byte, 32))},
+		{Name: "blk.1.attn.weight", Kind: uint32(0), Offset: uint64(0), Shape: []uint64{1, 1, 1, 1}, WriterTo: bytes.NewReader(make([]byte, 32))},
+		{Name: "output.weight", Kind: uint32(0), Offset: uint64(0), Shape: []uint64{1, 1, 1, 1}, WriterTo: bytes.NewReader(make([]byte, 32))},
+	}))
+
+	model, err := LoadModel(f.Name(), 0)
+	require.NoError(t, err)
+
+	cpu := discover.GpuInfoList{{Library: "cpu"}}
+	opts := api.DefaultOptions()
+	size := func(numCtx int) uint64 {
+		opts := opts
+		opts.NumCtx = numCtx
+		return EstimateGPULayers(cpu, model, nil, opts, 1).TotalSize
+	}
+
+	t.Run("everything fits", func(t *testing.T) {
+		assert.Equal(t, 32768, FitContextLength(cpu, model, nil, opts, 1, size(32768)))
+	})
+
+	t.Run("nothing fits", func(t *testing.T) {
+		assert.Equal(t, minAutoContextLength, FitContextLength(cpu, model, nil, opts, 1, 0))
+	})
+
+	t.Run("partial", func(t *testing.T) {
+		got := FitContextLength(cpu, model, nil, opts, 1, size(10000))
+		assert.Equal(t, 9984, got)
+		assert.LessOrEqual(t, size(got), size(10000))
+	})
+
+	t.Run("parallel", func(t *testing.T) {
+		opts := opts
+		opts.NumCtx = 8192 * 2
+		total := EstimateGPULayers(cpu, model, nil, opts, 2).TotalSize
+		assert.Equal(t, 8192, FitContextLength(cpu, model, nil, opts, 2, total))
+	})
+
+	t.Run("gpu", func(t *testing.T) {
+		gpus := discover.GpuInfoList{{Library: "cuda"}}
+		gpus[0].TotalMemory = 8 * 1024 * 1024 * 1024
+		gpus[0].FreeMemory = 8 * 1024 * 1024 * 1024
+		opts := opts
+		opts.NumCtx = 32768
+		require.Equal(t, 3, EstimateGPULayers(gpus, model, nil, opts, 1).Layers)
+		assert.Equal(t, 32768, FitContextLength(gpus, model, nil, opts, 1, 0))
+	})
 }
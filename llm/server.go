@@ -3,6 +3,7 @@ package llm
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
@@ -10,6 +11,7 @@ import (
 	"io"
 	"log"
 	"log/slog"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
@@ -23,6 +25,10 @@ import (
 	"sync"
 	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/semaphore"
 
 	"github.com/goobla/goobla/api"
@@ -35,6 +41,39 @@ import (
 	"github.com/goobla/goobla/model"
 )
 
+var tracer = otel.Tracer("github.com/goobla/goobla/llm")
+
+// ErrRunnerStopped is returned by a request to a runner which stopped, such
+// as by crashing, before responding to it.
+var ErrRunnerStopped = errors.New("model runner has unexpectedly stopped")
+
+// CrashError is the error of a request to a runner that crashed, with what
+// the runner left behind for a crash report. It wraps an [ErrRunnerStopped]
+// error.
+type CrashError struct {
+	Err error
+
+	// ExitCode is the runner's exit code, or -1 if it hadn't exited
+	ExitCode int
+
+	// Stderr is the last lines the runner wrote to stderr
+	Stderr string
+
+	// ID is the id of the crash's report, once it has been written
+	ID string
+}
+
+func (e *CrashError) Error() string {
+	if e.ID != "" {
+		return fmt.Sprintf("%v (crash report %s)", e.Err, e.ID)
+	}
+	return e.Err.Error()
+}
+
+func (e *CrashError) Unwrap() error {
+	return e.Err
+}
+
 type filteredEnv []string
 
 func (e filteredEnv) LogValue() slog.Value {
@@ -73,9 +112,21 @@ type LlamaServer interface {
 	EstimatedVRAM() uint64 // Total VRAM across all GPUs
 	EstimatedTotal() uint64
 	EstimatedVRAMByGPU(gpuID string) uint64
+	EstimatedKVCache() uint64
+	Backend() Backend
 	Pid() int
 }
 
+// Backend is what a model is running on, which affects the numerical results
+// of its computations.
+type Backend struct {
+	Engine    string // goobla or llama.cpp
+	Library   string // the runner library, such as cuda_v12 or cpu
+	GPULayers int    // the number of layers offloaded to GPUs
+
+	KVCacheType string // the type of the KV cache, such as f16 or q8_0
+}
+
 // llmServer is an instance of the llama.cpp server
 type llmServer struct {
 	port        int
@@ -96,6 +147,7 @@ type llmServer struct {
 	textProcessor model.TextProcessor
 
 	estimate    MemoryEstimate
+	kvCacheType string
 	totalLayers uint64
 	// gpuCount     int
 	gpus         discover.GpuInfoList // Recorded just before the model loaded, free space will be incorrect
@@ -125,9 +177,61 @@ func LoadModel(model string, maxArraySize int) (*ggml.GGML, error) {
 	return ggml, err
 }
 
+// isNUMA reports whether the system has more than one NUMA node
+var isNUMA = discover.IsNUMA
+
+// numaStrategy returns how the runner for a model loaded on gpus places its
+// threads on NUMA nodes. Models on the CPU are spread across the nodes of
+// NUMA systems by default, rather than competing for one node's memory.
+func numaStrategy(numa string, gpus discover.GpuInfoList) (string, error) {
+	switch numa {
+	case "":
+		if gpus[0].Library == "cpu" && isNUMA() {
+			return "distribute", nil
+		}
+		return "", nil
+	case "distribute", "isolate", "numactl":
+		return numa, nil
+	case "disabled":
+		return "", nil
+	default:
+		return "", fmt.Errorf("invalid numa %q: must be distribute, isolate, numactl or disabled", numa)
+	}
+}
+
+// kvCacheType returns whether flash attention is enabled for model f loaded
+// on gpus, and the type of its KV cache, or "" for the default. The cache is
+// quantized to the type requested with the kv_cache_type option or
+// GOOBLA_KV_CACHE_TYPE when flash attention is enabled, and requesting a
+// quantized type with the option enables flash attention for the model.
+func kvCacheType(f *ggml.GGML, gpus discover.GpuInfoList, requested string) (fa bool, kvct string, err error) {
+	fa = envconfig.FlashAttention()
+	kvct = strings.ToLower(envconfig.KvCacheType())
+	if requested != "" {
+		kvct = strings.ToLower(requested)
+		switch kvct {
+		case "f16":
+		case "q8_0", "q4_0":
+			if !f.SupportsKVCacheType(kvct) {
+				return false, "", fmt.Errorf("kv_cache_type %s is not supported by %s models", kvct, f.KV().Architecture())
+			}
+			fa = true
+		default:
+			return false, "", fmt.Errorf("invalid kv_cache_type %q: must be f16, q8_0 or q4_0", requested)
+		}
+	}
+
+	fa = fa && gpus.FlashAttentionSupported() && f.SupportsFlashAttention()
+	if !fa || !f.SupportsKVCacheType(kvct) {
+		kvct = ""
+	}
+
+	return fa, kvct, nil
+}
+
 // NewLlamaServer will run a server for the given GPUs
 // The gpu list must be a single family.
-func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, adapters, projectors []string, opts api.Options, numParallel int) (LlamaServer, error) {
+func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, adapters, projectors []string, draft string, opts api.Options, numParallel int) (LlamaServer, error) {
 	systemInfo := discover.GetSystemInfo()
 	systemTotalMemory := systemInfo.System.TotalMemory
 	systemFreeMemory := systemInfo.System.FreeMemory
@@ -135,8 +239,9 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 	slog.Info("system memory", "total", format.HumanBytes2(systemTotalMemory), "free", format.HumanBytes2(systemFreeMemory), "free_swap", format.HumanBytes2(systemSwapFreeMemory))
 
 	// If the user wants zero GPU layers, reset the gpu list to be CPU/system ram info
-	if opts.NumGPU == 0 {
+	if opts.NumGPU == 0 || opts.Device == "cpu" {
 		gpus = discover.GetCPUInfo()
+		opts.NumGPU = 0
 	}
 
 	// Verify the requested context size is <= the model training size
@@ -146,7 +251,7 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 		opts.NumCtx = int(trainCtx) * numParallel
 	}
 
-	estimate := EstimateGPULayers(gpus, f, projectors, opts, numParallel)
+	estimate := EstimateGPULayers(gpus, f, WeightPaths(projectors, draft), opts, numParallel)
 	if len(gpus) > 1 || gpus[0].Library != "cpu" {
 		switch {
 		case gpus[0].Library == "metal" && estimate.VRAMSize > systemTotalMemory:
@@ -194,39 +299,51 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 		}
 	}
 
+	numa, err := numaStrategy(opts.NUMA, gpus)
+	if err != nil {
+		return nil, err
+	}
+
+	if numa != "" {
+		params = append(params, "--numa", numa)
+	}
+
 	defaultThreads := systemInfo.GetOptimalThreadCount()
+	if numa == "isolate" {
+		// the threads are pinned to a single node
+		defaultThreads = max(1, defaultThreads/discover.NUMANodes())
+	}
+
 	if opts.NumThread > 0 {
 		params = append(params, "--threads", strconv.Itoa(opts.NumThread))
 	} else if defaultThreads > 0 {
 		params = append(params, "--threads", strconv.Itoa(defaultThreads))
 	}
 
-	fa := envconfig.FlashAttention()
-	if fa && !gpus.FlashAttentionSupported() {
-		slog.Warn("flash attention enabled but not supported by gpu")
-		fa = false
+	fa, kvct, err := kvCacheType(f, gpus, opts.KVCacheType)
+	if err != nil {
+		return nil, err
 	}
 
-	if fa && !f.SupportsFlashAttention() {
+	switch {
+	case envconfig.FlashAttention() && !gpus.FlashAttentionSupported():
+		slog.Warn("flash attention enabled but not supported by gpu")
+	case envconfig.FlashAttention() && !f.SupportsFlashAttention():
 		slog.Warn("flash attention enabled but not supported by model")
-		fa = false
 	}
 
-	kvct := strings.ToLower(envconfig.KvCacheType())
-
 	if fa {
 		slog.Info("enabling flash attention")
 		params = append(params, "--flash-attn")
 
 		// Flash Attention also supports kv cache quantization
-		// Enable if the requested and kv cache type is supported by the model
-		if kvct != "" && f.SupportsKVCacheType(kvct) {
+		if kvct != "" {
 			params = append(params, "--kv-cache-type", kvct)
-		} else {
-			slog.Warn("kv cache type not supported by model", "type", kvct)
 		}
-	} else if kvct != "" && kvct != "f16" {
-		slog.Warn("quantized kv cache requested but flash attention disabled", "type", kvct)
+	}
+
+	if requested := strings.ToLower(cmp.Or(opts.KVCacheType, envconfig.KvCacheType())); requested != "" && requested != "f16" && kvct != requested {
+		slog.Warn("quantized kv cache requested but flash attention disabled", "type", requested)
 	}
 
 	// mmap has issues with partial offloading on metal
@@ -251,6 +368,12 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 
 	params = append(params, "--parallel", strconv.Itoa(numParallel))
 
+	if n := envconfig.MaxBatch(); n > 0 {
+		params = append(params, "--max-batch", strconv.Itoa(int(n)))
+	}
+
+	// the estimate follows tensor_split, placing no more layers on each
+	// GPU than fit, so its split is used rather than tensor_split itself
 	if estimate.TensorSplit != "" {
 		params = append(params, "--tensor-split", estimate.TensorSplit)
 	}
@@ -316,6 +439,32 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 		params = append(params, "--mmproj", projectors[0])
 	}
 
+	if draft != "" {
+		if llamaModel != nil {
+			params = append(params, "--draft", draft)
+
+			// the draft model is only offloaded if the model is, as it is
+			// used for every token
+			if estimate.Layers >= int(f.KV().BlockCount())+1 {
+				params = append(params, "--draft-n-gpu-layers", strconv.Itoa(math.MaxInt32))
+			}
+		} else {
+			slog.Warn("draft models aren't supported by the Goobla engine, ignoring", "draft", draft)
+		}
+	}
+
+	if s := envconfig.PrefixCache(); s != "" {
+		n, err := format.ParseBytes(s)
+		switch {
+		case err != nil:
+			slog.Warn("invalid GOOBLA_PREFIX_CACHE, ignoring", "error", err)
+		case llamaModel == nil:
+			slog.Debug("prefix caching isn't supported by the Goobla engine, ignoring")
+		case n > 0:
+			params = append(params, "--prefix-cache-size", strconv.FormatInt(n, 10))
+		}
+	}
+
 	// iterate through compatible GPU libraries such as 'cuda_v12', 'rocm', etc.
 	// adding each library's respective path to the LD_LIBRARY_PATH, until finally running
 	// without any LD_LIBRARY_PATH flags
@@ -386,6 +535,7 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 			llamaModel:    llamaModel,
 			textProcessor: textProcessor,
 			estimate:      estimate,
+			kvCacheType:   cmp.Or(kvct, "f16"),
 			numParallel:   numParallel,
 			sem:           semaphore.NewWeighted(int64(numParallel)),
 			totalLayers:   f.KV().BlockCount() + 1,
@@ -399,6 +549,9 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 		s.cmd.SysProcAttr = LlamaServerSysProcAttr
 
 		s.cmd.Env = append(s.cmd.Env, "GOOBLA_LIBRARY_PATH="+strings.Join(ggmlPaths, string(filepath.ListSeparator)))
+		if v := envconfig.CPUVariant(); v != "" {
+			s.cmd.Env = append(s.cmd.Env, "GGML_CPU_VARIANT="+v)
+		}
 
 		envWorkarounds := [][2]string{}
 		for _, gpu := range gpus {
@@ -694,7 +847,27 @@ type CompletionRequest struct {
 	Images  []ImageData
 	Options *api.Options
 
-	Grammar string // set before sending the request to the subprocess
+	// StatsInterval is the interval to send the progress of the completion
+	// at, if set.
+	StatsInterval time.Duration
+
+	// Session is the path of the file to restore the KV cache from before
+	// the completion and save it to after, if set.
+	Session string
+
+	// Grammar is a GBNF grammar that output is constrained to. It is set
+	// from Format if that is set instead.
+	Grammar string
+
+	// Logprobs returns the log probability of each token generated, along
+	// with the TopLogprobs most likely tokens at its position.
+	Logprobs    bool
+	TopLogprobs int
+
+	// Score is a completion of Prompt to return the log probabilities of,
+	// in the Logprobs of the final response, instead of generating one.
+	// TopLogprobs applies to them as it does to generated tokens.
+	Score string
 }
 
 // DoneReason represents the reason why a completion response is done
@@ -707,6 +880,8 @@ const (
 	DoneReasonLength
 	// DoneReasonConnectionClosed indicates the completion stopped due to the connection being closed
 	DoneReasonConnectionClosed
+	// DoneReasonTimeout indicates the completion stopped due to taking too long
+	DoneReasonTimeout
 )
 
 func (d DoneReason) String() string {
@@ -715,6 +890,8 @@ func (d DoneReason) String() string {
 		return "length"
 	case DoneReasonStop:
 		return "stop"
+	case DoneReasonTimeout:
+		return "timeout"
 	default:
 		return "" // closed
 	}
@@ -728,33 +905,122 @@ type CompletionResponse struct {
 	PromptEvalDuration time.Duration `json:"prompt_eval_duration"`
 	EvalCount          int           `json:"eval_count"`
 	EvalDuration       time.Duration `json:"eval_duration"`
+
+	// PromptCachedCount is the number of prompt tokens that were in the
+	// cache, so didn't need to be evaluated.
+	PromptCachedCount int `json:"prompt_cached_count,omitempty"`
+
+	// PromptImageCount is the number of prompt tokens that were images.
+	PromptImageCount int `json:"prompt_image_count,omitempty"`
+
+	// Logprobs holds the log probabilities of the tokens in Content when
+	// CompletionRequest.Logprobs is set.
+	Logprobs []api.Logprob `json:"logprobs,omitempty"`
+
+	// Progress is set on the responses sent every
+	// CompletionRequest.StatsInterval, which hold the counts and durations
+	// so far. PromptTokens is the number of prompt tokens to evaluate.
+	Progress     bool `json:"progress,omitempty"`
+	PromptTokens int  `json:"prompt_tokens,omitempty"`
 }
 
 func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) error {
+	ctx, span := tracer.Start(ctx, "completion", trace.WithAttributes(
+		attribute.Int("goobla.prompt_bytes", len(req.Prompt)),
+		attribute.Int("goobla.images", len(req.Images)),
+	))
+	defer span.End()
+
+	var first bool
+	err := s.completion(ctx, req, func(c CompletionResponse) {
+		if !first && !c.Progress {
+			first = true
+			span.AddEvent("first token")
+		}
+
+		if c.Done {
+			span.SetAttributes(
+				attribute.Int("goobla.prompt_eval_count", c.PromptEvalCount),
+				attribute.Int("goobla.eval_count", c.EvalCount),
+				attribute.String("goobla.done_reason", c.DoneReason.String()),
+			)
+		}
+
+		fn(c)
+	})
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return err
+}
+
+// FormatGrammar returns the grammar that constrains sampling to output
+// matching format, which is "json" or a JSON Schema, or "" if format isn't
+// set. The grammar for a schema only allows output that validates against
+// it, so it can be checked before a request is scheduled.
+func FormatGrammar(format json.RawMessage) (string, error) {
+	format = bytes.TrimSpace(format)
+	switch string(format) {
+	case ``, `null`, `""`:
+		// Field was set, but "missing" a value. We accept
+		// these as "not set".
+		return "", nil
+	case `"json"`:
+		return grammarJSON, nil
+	}
+
+	if format[0] != '{' {
+		return "", fmt.Errorf("invalid format: %q; expected \"json\" or a valid JSON Schema object", format)
+	}
+
+	if !json.Valid(format) {
+		return "", fmt.Errorf("invalid JSON schema in format")
+	}
+
+	// User provided a JSON schema
+	g := llama.SchemaToGrammar(format)
+	if g == nil {
+		return "", fmt.Errorf("invalid JSON schema in format")
+	}
+
+	return string(g), nil
+}
+
+// CompletionGrammar returns the grammar that constrains sampling to format,
+// as in FormatGrammar, or to grammar, a GBNF grammar. Only one of them can be
+// set.
+func CompletionGrammar(format json.RawMessage, grammar string) (string, error) {
+	g, err := FormatGrammar(format)
+	if err != nil {
+		return "", err
+	}
+
+	if grammar == "" {
+		return g, nil
+	}
+
+	if g != "" {
+		return "", errors.New("format and grammar can't both be set")
+	}
+
+	if !llama.ValidGrammar(grammar) {
+		return "", errors.New("invalid grammar: expected a GBNF grammar with a root rule")
+	}
+
+	return grammar, nil
+}
+
+func (s *llmServer) completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) error {
 	slog.Debug("completion request", "images", len(req.Images), "prompt", len(req.Prompt), "format", string(req.Format))
 	slog.Log(ctx, logutil.LevelTrace, "completion request", "prompt", req.Prompt)
 
-	if len(req.Format) > 0 {
-		switch string(req.Format) {
-		case `null`, `""`:
-			// Field was set, but "missing" a value. We accept
-			// these as "not set".
-			break
-		case `"json"`:
-			req.Grammar = grammarJSON
-		default:
-			if req.Format[0] != '{' {
-				return fmt.Errorf("invalid format: %q; expected \"json\" or a valid JSON Schema object", req.Format)
-			}
-
-			// User provided a JSON schema
-			g := llama.SchemaToGrammar(req.Format)
-			if g == nil {
-				return fmt.Errorf("invalid JSON schema in format")
-			}
-			req.Grammar = string(g)
-		}
+	grammar, err := CompletionGrammar(req.Format, req.Grammar)
+	if err != nil {
+		return err
 	}
+	req.Grammar = grammar
 
 	if req.Options == nil {
 		opts := api.DefaultOptions()
@@ -770,6 +1036,7 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 		return err
 	}
 	defer s.sem.Release(1)
+	trace.SpanFromContext(ctx).AddEvent("acquired slot")
 
 	// put an upper limit on num_predict to avoid the model running on forever
 	if req.Options.NumPredict < 0 || req.Options.NumPredict > 10*s.options.NumCtx {
@@ -803,7 +1070,7 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 	res, err := http.DefaultClient.Do(serverReq)
 	if err != nil {
 		slog.Error("post predict", "error", err)
-		return errors.New("model runner has unexpectedly stopped, this may be due to resource limitations or an internal error, check goobla server logs for details")
+		return s.crashed(fmt.Errorf("%w, this may be due to resource limitations or an internal error, check goobla server logs for details", ErrRunnerStopped))
 	}
 	defer res.Body.Close()
 
@@ -844,6 +1111,12 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 			if err := json.Unmarshal(evt, &c); err != nil {
 				return fmt.Errorf("error unmarshalling llm prediction response: %v", err)
 			}
+
+			if c.Progress {
+				fn(c)
+				continue
+			}
+
 			switch {
 			case strings.TrimSpace(c.Content) == lastToken:
 				tokenRepeat++
@@ -860,7 +1133,8 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 
 			if c.Content != "" {
 				fn(CompletionResponse{
-					Content: c.Content,
+					Content:  c.Content,
+					Logprobs: c.Logprobs,
 				})
 			}
 
@@ -872,6 +1146,10 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 	}
 
 	if err := scanner.Err(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
 		if strings.Contains(err.Error(), "unexpected EOF") || strings.Contains(err.Error(), "forcibly closed") {
 			s.Close()
 			var msg string
@@ -880,13 +1158,35 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 			} else {
 				msg = err.Error()
 			}
-			return fmt.Errorf("an error was encountered while running the model: %s", msg)
+			return s.crashed(fmt.Errorf("%w while running the model: %s", ErrRunnerStopped, msg))
 		}
 
 		return fmt.Errorf("error reading llm response: %v", err)
 	}
 
-	return nil
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// the runner closed the response without finishing it
+	if s.status != nil && s.status.LastErrMsg != "" {
+		return s.crashed(fmt.Errorf("%w while running the model: %s", ErrRunnerStopped, s.status.LastErrMsg))
+	}
+
+	return s.crashed(fmt.Errorf("%w while running the model", ErrRunnerStopped))
+}
+
+// crashed returns a [CrashError] for err, the error of a request the runner
+// stopped during.
+func (s *llmServer) crashed(err error) error {
+	crash := &CrashError{Err: err, ExitCode: -1}
+	if s.cmd != nil && s.cmd.ProcessState != nil {
+		crash.ExitCode = s.cmd.ProcessState.ExitCode()
+	}
+	if s.status != nil {
+		crash.Stderr = s.status.Tail()
+	}
+	return crash
 }
 
 type EmbeddingRequest struct {
@@ -1050,6 +1350,26 @@ func (s *llmServer) EstimatedTotal() uint64 {
 	return s.estimate.TotalSize
 }
 
+func (s *llmServer) EstimatedKVCache() uint64 {
+	return s.estimate.kv
+}
+
+func (s *llmServer) Backend() Backend {
+	b := Backend{Engine: "llama.cpp", Library: s.gpus[0].RunnerName(), KVCacheType: s.kvCacheType}
+	if s.textProcessor != nil {
+		b.Engine = "goobla"
+	}
+
+	if s.gpus[0].Library != "cpu" {
+		b.GPULayers = s.estimate.Layers
+		if s.options.NumGPU >= 0 {
+			b.GPULayers = min(s.options.NumGPU, int(s.totalLayers))
+		}
+	}
+
+	return b
+}
+
 func (s *llmServer) EstimatedVRAMByGPU(gpuID string) uint64 {
 	for i, gpu := range s.gpus {
 		if gpu.ID == gpuID {
@@ -1,13 +1,17 @@
 package llm
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"os"
 	"strings"
 	"testing"
 
 	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/discover"
+	"github.com/goobla/goobla/fs/ggml"
 	"golang.org/x/sync/semaphore"
 )
 
@@ -70,3 +74,217 @@ func TestLLMServerCompletionFormat(t *testing.T) {
 	}, nil)
 	checkValid(err)
 }
+
+func TestFormatGrammar(t *testing.T) {
+	for _, format := range []string{``, `null`, `""`, ` null `} {
+		if g, err := FormatGrammar([]byte(format)); err != nil || g != "" {
+			t.Errorf("%q: got %q, %v; want no grammar", format, g, err)
+		}
+	}
+
+	if g, err := FormatGrammar([]byte(`"json"`)); err != nil || g != grammarJSON {
+		t.Errorf("json: got %q, %v; want the JSON grammar", g, err)
+	}
+
+	g, err := FormatGrammar([]byte(` {"type":"object","properties":{"n":{"type":"integer"}},"required":["n"]}`))
+	if err != nil || !strings.Contains(g, "root") {
+		t.Errorf("schema: got %q, %v; want a grammar", g, err)
+	}
+
+	for _, format := range []string{`"yaml"`, `[1]`, `{"type":`} {
+		if _, err := FormatGrammar([]byte(format)); err == nil {
+			t.Errorf("%q: expected an error", format)
+		}
+	}
+}
+
+func TestCompletionGrammar(t *testing.T) {
+	sql := `root ::= "SELECT " [a-z]+ " FROM " [a-z]+ ";"`
+	if g, err := CompletionGrammar(nil, sql); err != nil || g != sql {
+		t.Errorf("grammar: got %q, %v; want %q", g, err, sql)
+	}
+
+	if g, err := CompletionGrammar([]byte(`"json"`), ""); err != nil || g != grammarJSON {
+		t.Errorf("format: got %q, %v; want the JSON grammar", g, err)
+	}
+
+	if _, err := CompletionGrammar([]byte(`"json"`), sql); err == nil {
+		t.Error("expected an error for both format and grammar")
+	}
+
+	for _, grammar := range []string{`root ::= (`, `answer ::= "yes"`, `root ::= missing`} {
+		if _, err := CompletionGrammar(nil, grammar); err == nil {
+			t.Errorf("%q: expected an error", grammar)
+		}
+	}
+}
+
+func TestParseTensorSplit(t *testing.T) {
+	cases := []struct {
+		value string
+		want  []float64
+		err   bool
+	}{
+		{"3,1", []float64{3, 1}, false},
+		{"0.75, 0.25", []float64{0.75, 0.25}, false},
+		{"24,0,8", []float64{24, 0, 8}, false},
+		{"1", []float64{1}, false},
+		{"0,0", nil, true},
+		{"3,-1", nil, true},
+		{"3,", nil, true},
+		{"a,b", nil, true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseTensorSplit(tt.value)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNUMAStrategy(t *testing.T) {
+	numa := true
+	isNUMA = func() bool { return numa }
+	t.Cleanup(func() { isNUMA = discover.IsNUMA })
+
+	cpu := discover.GpuInfoList{{Library: "cpu"}}
+	gpu := discover.GpuInfoList{{Library: "cuda"}}
+
+	cases := []struct {
+		name   string
+		numa   string
+		gpus   discover.GpuInfoList
+		isNUMA bool
+		want   string
+		err    bool
+	}{
+		{"default cpu", "", cpu, true, "distribute", false},
+		{"default gpu", "", gpu, true, "", false},
+		{"default not numa", "", cpu, false, "", false},
+		{"isolate", "isolate", gpu, false, "isolate", false},
+		{"numactl", "numactl", cpu, true, "numactl", false},
+		{"disabled", "disabled", cpu, true, "", false},
+		{"invalid", "mirror", cpu, true, "", true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			numa = tt.isNUMA
+			got, err := numaStrategy(tt.numa, tt.gpus)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestKVCacheType(t *testing.T) {
+	t.Setenv("GOOBLA_FLASH_ATTENTION", "")
+	t.Setenv("GOOBLA_KV_CACHE_TYPE", "")
+
+	writeModel := func(t *testing.T, kv ggml.KV) *ggml.GGML {
+		t.Helper()
+		f, err := os.CreateTemp(t.TempDir(), "model")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		if err := ggml.WriteGGUF(f, kv, []*ggml.Tensor{
+			{Name: "blk.0.attn.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := LoadModel(f.Name(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	llama := writeModel(t, ggml.KV{
+		"general.architecture":          "llama",
+		"llama.embedding_length":        uint32(4096),
+		"llama.block_count":             uint32(1),
+		"llama.attention.head_count":    uint32(32),
+		"llama.attention.head_count_kv": uint32(32),
+	})
+	bert := writeModel(t, ggml.KV{
+		"general.architecture":         "bert",
+		"bert.embedding_length":        uint32(384),
+		"bert.block_count":             uint32(1),
+		"bert.attention.head_count":    uint32(12),
+		"bert.attention.head_count_kv": uint32(12),
+		"bert.pooling_type":            uint32(1),
+	})
+
+	cuda := discover.GpuInfoList{{Library: "cuda", DriverMajor: 8}}
+	cpu := discover.GpuInfoList{{Library: "cpu"}}
+
+	cases := []struct {
+		name      string
+		f         *ggml.GGML
+		gpus      discover.GpuInfoList
+		env       string
+		requested string
+		fa        bool
+		want      string
+		err       bool
+	}{
+		{"default", llama, cuda, "", "", false, "", false},
+		{"env without flash attention", llama, cuda, "q8_0", "", false, "", false},
+		{"option", llama, cuda, "", "q8_0", true, "q8_0", false},
+		{"option overrides env", llama, cuda, "q8_0", "Q4_0", true, "q4_0", false},
+		{"f16", llama, cuda, "q8_0", "f16", false, "", false},
+		{"cpu", llama, cpu, "", "q8_0", false, "", false},
+		{"unsupported architecture", bert, cuda, "", "q8_0", false, "", true},
+		{"invalid", llama, cuda, "", "q2_k", false, "", true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GOOBLA_KV_CACHE_TYPE", tt.env)
+			fa, got, err := kvCacheType(tt.f, tt.gpus, tt.requested)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if fa != tt.fa || got != tt.want {
+				t.Errorf("expected flash attention %t and %q, got %t and %q", tt.fa, tt.want, fa, got)
+			}
+		})
+	}
+}
@@ -3,12 +3,27 @@ package llm
 import (
 	"bytes"
 	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// statusTailLines is the number of lines of the runner's output kept for a
+// crash report, and statusLineSize the size each is truncated to.
+const (
+	statusTailLines = 100
+	statusLineSize  = 4096
 )
 
 // StatusWriter is a writer that captures error messages from the llama runner process
 type StatusWriter struct {
 	LastErrMsg string
 	out        *os.File
+
+	mu   sync.Mutex
+	tail []string
+	// partial is the last line written, until it's been written in full
+	partial []byte
 }
 
 func NewStatusWriter(out *os.File) *StatusWriter {
@@ -41,5 +56,34 @@ func (w *StatusWriter) Write(b []byte) (int, error) {
 		w.LastErrMsg = errMsg
 	}
 
+	w.mu.Lock()
+	w.partial = append(w.partial, b...)
+	for {
+		line, rest, ok := bytes.Cut(w.partial, []byte("\n"))
+		if !ok {
+			break
+		}
+
+		w.tail = append(w.tail, string(line[:min(len(line), statusLineSize)]))
+		if len(w.tail) > statusTailLines {
+			w.tail = w.tail[len(w.tail)-statusTailLines:]
+		}
+		w.partial = rest
+	}
+	w.partial = bytes.Clone(w.partial[:min(len(w.partial), statusLineSize)])
+	w.mu.Unlock()
+
 	return w.out.Write(b)
 }
+
+// Tail returns the last lines the runner wrote.
+func (w *StatusWriter) Tail() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	lines := w.tail
+	if len(w.partial) > 0 {
+		lines = append(slices.Clone(lines), string(w.partial))
+	}
+	return strings.Join(lines, "\n")
+}
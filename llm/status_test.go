@@ -0,0 +1,32 @@
+package llm
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestStatusWriterTail(t *testing.T) {
+	devnull, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devnull.Close()
+
+	w := NewStatusWriter(devnull)
+	for i := range statusTailLines + 10 {
+		fmt.Fprintf(w, "line %d\n", i)
+	}
+	fmt.Fprint(w, "CUDA error: out of")
+	fmt.Fprint(w, " memory")
+
+	lines := strings.Split(w.Tail(), "\n")
+	if len(lines) != statusTailLines+1 || lines[0] != "line 10" || lines[len(lines)-1] != "CUDA error: out of memory" {
+		t.Errorf("unexpected tail %q", lines)
+	}
+
+	if w.LastErrMsg != "CUDA error: out of" {
+		t.Errorf("unexpected error message %q", w.LastErrMsg)
+	}
+}
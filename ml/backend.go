@@ -60,6 +60,10 @@ type BackendParams struct {
 	// NumThreads sets the number of threads to use if running on the CPU
 	NumThreads int
 
+	// NUMA is how the threads on the CPU are placed on the nodes of a NUMA
+	// system: "distribute", "isolate", "numactl", or empty to not place them
+	NUMA string
+
 	// MainGPU is the index of the primary GPU to use
 	MainGPU int
 
@@ -6,6 +6,13 @@ package ggml
 // #include "ggml.h"
 // #include "ggml-cpu.h"
 // #include "ggml-backend.h"
+//
+// static void numa_init(ggml_backend_dev_t dev, enum ggml_numa_strategy numa) {
+//     void (*fn)(enum ggml_numa_strategy) = ggml_backend_reg_get_proc_address(ggml_backend_dev_backend_reg(dev), "ggml_backend_cpu_numa_init");
+//     if (fn != NULL) {
+//         fn(numa);
+//     }
+// }
 import "C"
 
 import (
@@ -19,6 +26,7 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"unicode"
 	"unsafe"
@@ -43,6 +51,28 @@ func devices() []*C.struct_ggml_backend_device {
 	return ds
 }
 
+var numaOnce sync.Once
+
+// numaInit places the threads of the CPU backend on the nodes of a NUMA
+// system with strategy. The placement can only be set once.
+func numaInit(dev *C.struct_ggml_backend_device, strategy string) {
+	var numa C.enum_ggml_numa_strategy
+	switch strategy {
+	case "distribute":
+		numa = C.GGML_NUMA_STRATEGY_DISTRIBUTE
+	case "isolate":
+		numa = C.GGML_NUMA_STRATEGY_ISOLATE
+	case "numactl":
+		numa = C.GGML_NUMA_STRATEGY_NUMACTL
+	default:
+		return
+	}
+
+	numaOnce.Do(func() {
+		C.numa_init(dev, numa)
+	})
+}
+
 type Backend struct {
 	// modelPath is the location of the model data
 	modelPath string
@@ -122,6 +152,10 @@ func New(modelPath string, params ml.BackendParams) (ml.Backend, error) {
 		}
 	}
 
+	if len(cpus) > 0 {
+		numaInit(cpus[0], params.NUMA)
+	}
+
 	blocks := int(meta.KV().BlockCount())
 
 	// create list of buffer types for the cpu
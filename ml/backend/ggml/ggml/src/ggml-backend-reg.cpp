@@ -505,6 +505,22 @@ static ggml_backend_reg_t ggml_backend_load_best(const char * name, bool silent,
         search_paths.push_back(fs::u8path(user_search_path));
     }
 
+    // allow forcing a variant when the features of the CPU are misdetected
+    if (strcmp(name, "cpu") == 0) {
+        if (const char * variant = std::getenv("GGML_CPU_VARIANT")) {
+            fs::path filename = file_prefix;
+            filename += fs::u8path(variant);
+            filename += file_extension;
+            for (const auto & search_path : search_paths) {
+                fs::path path = search_path / filename;
+                if (fs::exists(path)) {
+                    return get_reg().load_backend(path, silent);
+                }
+            }
+            GGML_LOG_WARN("%s: cpu variant %s not found, using the best match\n", __func__, variant);
+        }
+    }
+
     int best_score = 0;
     fs::path best_path;
 
@@ -50,7 +50,10 @@ func ConvertToF32(data []byte, dtype uint32, nelements uint64) []float32 {
 	return f32s
 }
 
-func Quantize(newType fsggml.TensorType, f32s []float32, shape []uint64) []byte {
+// Quantize quantizes f32s to newType. imatrix, if it isn't nil, holds the
+// importance of each column of every matrix in f32s, weighting the error
+// of quantizing them.
+func Quantize(newType fsggml.TensorType, f32s []float32, shape []uint64, imatrix []float32) []byte {
 	buf := make([]byte, len(f32s)*4) // upper bound on size
 	nPerRow := C.int64_t(shape[0])
 	nrows := C.int64_t(1)
@@ -66,6 +69,10 @@ func Quantize(newType fsggml.TensorType, f32s []float32, shape []uint64) []byte
 	for i03 := C.int64_t(0); i03 < shape2; i03++ {
 		f32s_03 := i03 * nelements_matrix
 		buf_03 := C.int64_t(C.ggml_row_size(uint32(newType), nPerRow)) * i03 * nrows
+		var imatrix_03 *C.float
+		if imatrix != nil {
+			imatrix_03 = (*C.float)(&imatrix[i03*nPerRow])
+		}
 		newSize += C.ggml_quantize_chunk(
 			uint32(newType),
 			(*C.float)(&f32s[f32s_03]),
@@ -73,7 +80,7 @@ func Quantize(newType fsggml.TensorType, f32s []float32, shape []uint64) []byte
 			0,
 			nrows,
 			nPerRow,
-			nil)
+			imatrix_03)
 	}
 	return buf[:newSize]
 }
@@ -247,7 +247,7 @@ func BenchmarkBytePairEncoding(b *testing.B) {
 		b.Run("split"+strconv.Itoa(n), func(b *testing.B) {
 			b.ResetTimer()
 			for range b.N {
-				slices.Collect(tokenizer.split(string(bts)))
+				_ = slices.Collect(tokenizer.split(string(bts)))
 			}
 		})
 	}
@@ -7,6 +7,8 @@ import (
 	"io"
 	"math/rand"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 
@@ -26,12 +28,15 @@ func ListMiddleware() gin.HandlerFunc {
 func RetrieveMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var b bytes.Buffer
-		if err := json.NewEncoder(&b).Encode(api.ShowRequest{Name: c.Param("model")}); err != nil {
+		// the model is matched by a wildcard so names with a namespace,
+		// which have a slash, can be retrieved
+		name := strings.TrimPrefix(c.Param("model"), "/")
+		if err := json.NewEncoder(&b).Encode(api.ShowRequest{Name: name}); err != nil {
 			c.AbortWithStatusJSON(http.StatusInternalServerError, opentypes.NewError(http.StatusInternalServerError, err.Error()))
 			return
 		}
 		c.Request.Body = io.NopCloser(&b)
-		w := &writer.RetrieveWriter{BaseWriter: writer.BaseWriter{ResponseWriter: c.Writer}, Model: c.Param("model")}
+		w := &writer.RetrieveWriter{BaseWriter: writer.BaseWriter{ResponseWriter: c.Writer}, Model: name}
 		c.Writer = w
 		c.Next()
 	}
@@ -84,13 +89,96 @@ func EmbeddingsMiddleware() gin.HandlerFunc {
 			c.AbortWithStatusJSON(http.StatusBadRequest, opentypes.NewError(http.StatusBadRequest, "invalid input"))
 			return
 		}
+		if req.EncodingFormat != "" && req.EncodingFormat != "float" && req.EncodingFormat != "base64" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, opentypes.NewError(http.StatusBadRequest, fmt.Sprintf("invalid encoding_format %q, must be float or base64", req.EncodingFormat)))
+			return
+		}
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(api.EmbedRequest{Model: req.Model, Input: req.Input, Dimensions: req.Dimensions}); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, opentypes.NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+		c.Request.Body = io.NopCloser(&b)
+		w := &writer.EmbedWriter{BaseWriter: writer.BaseWriter{ResponseWriter: c.Writer}, Model: req.Model, EncodingFormat: req.EncodingFormat}
+		c.Writer = w
+		c.Next()
+	}
+}
+
+func RerankMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req opentypes.RerankRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, opentypes.NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+		if req.Query == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, opentypes.NewError(http.StatusBadRequest, "query is required"))
+			return
+		}
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(opentypes.FromRerankRequest(req)); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, opentypes.NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+		c.Request.Body = io.NopCloser(&b)
+		w := &writer.RerankWriter{BaseWriter: writer.BaseWriter{ResponseWriter: c.Writer}, Model: req.Model}
+		c.Writer = w
+		c.Next()
+	}
+}
+
+// TranscriptionsMiddleware turns a transcription request into a chat request
+// that sends the audio to the model.
+func TranscriptionsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req := opentypes.TranscriptionRequest{
+			Model:          c.PostForm("model"),
+			Prompt:         c.PostForm("prompt"),
+			Language:       c.PostForm("language"),
+			ResponseFormat: c.PostForm("response_format"),
+		}
+		if req.Model == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, opentypes.NewError(http.StatusBadRequest, "model is required"))
+			return
+		}
+		switch req.ResponseFormat {
+		case "", "json", "text":
+		default:
+			c.AbortWithStatusJSON(http.StatusBadRequest, opentypes.NewError(http.StatusBadRequest, fmt.Sprintf("invalid response_format %q, must be json or text", req.ResponseFormat)))
+			return
+		}
+		if t := c.PostForm("temperature"); t != "" {
+			temperature, err := strconv.ParseFloat(t, 64)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, opentypes.NewError(http.StatusBadRequest, fmt.Sprintf("invalid temperature %q", t)))
+				return
+			}
+			req.Temperature = &temperature
+		}
+		fh, err := c.FormFile("file")
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, opentypes.NewError(http.StatusBadRequest, "file is required"))
+			return
+		}
+		f, err := fh.Open()
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, opentypes.NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+		defer f.Close()
+		if req.File, err = io.ReadAll(f); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, opentypes.NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
 		var b bytes.Buffer
-		if err := json.NewEncoder(&b).Encode(api.EmbedRequest{Model: req.Model, Input: req.Input}); err != nil {
+		if err := json.NewEncoder(&b).Encode(opentypes.FromTranscriptionRequest(req)); err != nil {
 			c.AbortWithStatusJSON(http.StatusInternalServerError, opentypes.NewError(http.StatusInternalServerError, err.Error()))
 			return
 		}
 		c.Request.Body = io.NopCloser(&b)
-		w := &writer.EmbedWriter{BaseWriter: writer.BaseWriter{ResponseWriter: c.Writer}, Model: req.Model}
+		c.Request.Header.Set("Content-Type", gin.MIMEJSON)
+		w := &writer.TranscriptionWriter{BaseWriter: writer.BaseWriter{ResponseWriter: c.Writer}, ResponseFormat: req.ResponseFormat}
 		c.Writer = w
 		c.Next()
 	}
@@ -128,3 +216,63 @@ func ChatMiddleware() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+func ResponsesMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req opentypes.ResponsesRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, opentypes.NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+		if len(req.Input) == 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, opentypes.NewError(http.StatusBadRequest, "input is required"))
+			return
+		}
+		var b bytes.Buffer
+		chatReq, err := opentypes.FromResponsesRequest(req)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, opentypes.NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+		if err := json.NewEncoder(&b).Encode(chatReq); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, opentypes.NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+		c.Request.Body = io.NopCloser(&b)
+		id := fmt.Sprintf("resp_%d", rand.Intn(999))
+		w := &writer.ResponsesWriter{
+			BaseWriter: writer.BaseWriter{ResponseWriter: c.Writer},
+			Stream:     req.Stream,
+			ID:         id,
+			Responses:  opentypes.NewResponseStream(id),
+		}
+		c.Writer = w
+		c.Next()
+	}
+}
+
+// UnsupportedMiddleware responds to requests for endpoints of the OpenAI
+// API that aren't supported with an error in the format clients expect,
+// instead of a plain 404. Requests naming a model, such as to generate
+// images, are told it doesn't exist, as no model can serve them.
+func UnsupportedMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		model := c.PostForm("model")
+		if model == "" {
+			var req struct {
+				Model string `json:"model"`
+			}
+			if c.ContentType() == gin.MIMEJSON {
+				_ = c.ShouldBindJSON(&req)
+			}
+			model = req.Model
+		}
+
+		if model != "" {
+			c.AbortWithStatusJSON(http.StatusNotFound, opentypes.NewModelNotFoundError(fmt.Sprintf("the model %q does not exist or doesn't support %s", model, c.Request.URL.Path)))
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusNotFound, opentypes.NewUnsupportedError(c.Request.URL.Path))
+	}
+}
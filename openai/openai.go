@@ -423,6 +423,12 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 						}
 					}
 
+					// URLs are loaded by the server
+					if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+						messages = append(messages, api.Message{Role: msg.Role, Images: []api.ImageData{api.ImageData(url)}})
+						continue
+					}
+
 					types := []string{"jpeg", "jpg", "png"}
 					valid := false
 					for _, t := range types {
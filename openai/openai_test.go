@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
@@ -76,6 +77,61 @@ func TestChatMiddleware(t *testing.T) {
 				Stream: &False,
 			},
 		},
+		{
+			name: "chat handler with logit bias",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"logit_bias": {"50256": -100, "1234": 5}
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{
+						Role:    "user",
+						Content: "Hello",
+					},
+				},
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+					"logit_bias": map[string]any{
+						"50256": -100.0,
+						"1234":  5.0,
+					},
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "chat handler with logprobs",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"logprobs": true,
+				"top_logprobs": 3
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{
+						Role:    "user",
+						Content: "Hello",
+					},
+				},
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Stream:      &False,
+				Logprobs:    true,
+				TopLogprobs: 3,
+			},
+		},
 		{
 			name: "chat handler with options",
 			body: `{
@@ -330,7 +386,7 @@ func TestChatMiddleware(t *testing.T) {
 				]
 			}`,
 			err: typ.ErrorResponse{
-				Error: Error{
+				Error: typ.Error{
 					Message: "invalid message content type: float64",
 					Type:    "invalid_request_error",
 				},
@@ -408,6 +464,27 @@ func TestCompletionsMiddleware(t *testing.T) {
 				Stream: &False,
 			},
 		},
+		{
+			name: "completions handler with logprobs",
+			body: `{
+                                "model": "test-model",
+                                "prompt": "Hello",
+                                "logprobs": 2
+                        }`,
+			req: api.GenerateRequest{
+				Model:  "test-model",
+				Prompt: "Hello",
+				Options: map[string]any{
+					"frequency_penalty": 0.0,
+					"presence_penalty":  0.0,
+					"temperature":       1.0,
+					"top_p":             1.0,
+				},
+				Stream:      &False,
+				Logprobs:    true,
+				TopLogprobs: 2,
+			},
+		},
 		{
 			name: "completions handler prompt array strings",
 			body: `{
@@ -524,7 +601,7 @@ func TestCompletionsMiddleware(t *testing.T) {
 				"suffix": "suffix"
 			}`,
 			err: typ.ErrorResponse{
-				Error: Error{
+				Error: typ.Error{
 					Message: "invalid type for 'stop' field: float64",
 					Type:    "invalid_request_error",
 				},
@@ -675,7 +752,7 @@ func TestEmbeddingsMiddleware(t *testing.T) {
 				"model": "test-model"
 			}`,
 			err: typ.ErrorResponse{
-				Error: Error{
+				Error: typ.Error{
 					Message: "invalid input",
 					Type:    "invalid_request_error",
 				},
@@ -720,6 +797,111 @@ func TestEmbeddingsMiddleware(t *testing.T) {
 	}
 }
 
+func TestTranscriptionsMiddleware(t *testing.T) {
+	form := func(fields map[string]string, file []byte) (*bytes.Buffer, string) {
+		var b bytes.Buffer
+		w := multipart.NewWriter(&b)
+		for k, v := range fields {
+			w.WriteField(k, v)
+		}
+		if file != nil {
+			fw, _ := w.CreateFormFile("file", "audio.wav")
+			fw.Write(file)
+		}
+		w.Close()
+		return &b, w.FormDataContentType()
+	}
+
+	var capturedRequest *api.ChatRequest
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(mid.TranscriptionsMiddleware(), captureRequestMiddleware(&capturedRequest))
+	router.Handle(http.MethodPost, "/v1/audio/transcriptions", func(c *gin.Context) {
+		c.JSON(http.StatusOK, api.ChatResponse{
+			Message: api.Message{Role: "assistant", Content: " Hello! "},
+			Done:    true,
+			Metrics: api.Metrics{PromptEvalCount: 10, EvalCount: 2},
+		})
+	})
+
+	t.Run("json", func(t *testing.T) {
+		body, contentType := form(map[string]string{"model": "test-model", "language": "en"}, []byte("audio"))
+		req, _ := http.NewRequest(http.MethodPost, "/v1/audio/transcriptions", body)
+		req.Header.Set("Content-Type", contentType)
+
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+
+		if resp.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body)
+		}
+
+		if capturedRequest.Model != "test-model" || len(capturedRequest.Messages) != 1 {
+			t.Fatalf("unexpected request %+v", capturedRequest)
+		}
+
+		msg := capturedRequest.Messages[0]
+		if len(msg.Audio) != 1 || string(msg.Audio[0]) != "audio" {
+			t.Errorf("expected the audio in the message, got %q", msg.Audio)
+		}
+
+		if !strings.Contains(msg.Content, `"en"`) {
+			t.Errorf("expected the language in the message, got %q", msg.Content)
+		}
+
+		if capturedRequest.Options["temperature"] != 0.0 {
+			t.Errorf("expected temperature 0, got %v", capturedRequest.Options["temperature"])
+		}
+
+		var transcription typ.Transcription
+		if err := json.Unmarshal(resp.Body.Bytes(), &transcription); err != nil {
+			t.Fatal(err)
+		}
+
+		want := typ.Transcription{Text: "Hello!", Usage: typ.TranscriptionUsage{Type: "tokens", InputTokens: 10, OutputTokens: 2, TotalTokens: 12}}
+		if diff := cmp.Diff(want, transcription); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("text", func(t *testing.T) {
+		body, contentType := form(map[string]string{"model": "test-model", "response_format": "text"}, []byte("audio"))
+		req, _ := http.NewRequest(http.MethodPost, "/v1/audio/transcriptions", body)
+		req.Header.Set("Content-Type", contentType)
+
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+
+		if resp.Body.String() != "Hello!\n" {
+			t.Errorf("expected the text, got %q", resp.Body)
+		}
+	})
+
+	for _, tt := range []struct {
+		name   string
+		fields map[string]string
+		file   []byte
+	}{
+		{"missing model", map[string]string{}, []byte("audio")},
+		{"missing file", map[string]string{"model": "test-model"}, nil},
+		{"unsupported format", map[string]string{"model": "test-model", "response_format": "srt"}, []byte("audio")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			body, contentType := form(tt.fields, tt.file)
+			req, _ := http.NewRequest(http.MethodPost, "/v1/audio/transcriptions", body)
+			req.Header.Set("Content-Type", contentType)
+
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+
+			if resp.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d", resp.Code)
+			}
+		})
+	}
+}
+
 func TestListMiddleware(t *testing.T) {
 	type testCase struct {
 		name     string
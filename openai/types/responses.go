@@ -0,0 +1,571 @@
+package types
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/goobla/goobla/api"
+)
+
+// ResponsesRequest is a request to the Responses API, which is converted
+// to a chat request.
+type ResponsesRequest struct {
+	Model              string              `json:"model"`
+	Input              json.RawMessage     `json:"input"`
+	Instructions       string              `json:"instructions"`
+	Stream             bool                `json:"stream"`
+	Tools              []ResponsesTool     `json:"tools"`
+	ParallelToolCalls  *bool               `json:"parallel_tool_calls"`
+	MaxOutputTokens    *int                `json:"max_output_tokens"`
+	Temperature        *float64            `json:"temperature"`
+	TopP               *float64            `json:"top_p"`
+	Text               *ResponsesText      `json:"text"`
+	Reasoning          *ResponsesReasoning `json:"reasoning"`
+	PreviousResponseID string              `json:"previous_response_id"`
+}
+
+// ResponsesInputItem is an item of the input of a [ResponsesRequest]: a
+// message, a function call the model made or its output.
+type ResponsesInputItem struct {
+	Type string `json:"type"`
+
+	// message
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+
+	// function_call and function_call_output
+	CallID    string `json:"call_id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+	Output    string `json:"output"`
+}
+
+// ResponsesInputContent is a part of the content of an input message.
+type ResponsesInputContent struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	ImageURL string `json:"image_url"`
+}
+
+// ResponsesTool is a tool in a [ResponsesRequest]. Unlike in chat
+// completions, the function's fields aren't nested.
+type ResponsesTool struct {
+	Type        string          `json:"type"`
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+type ResponsesText struct {
+	Format struct {
+		Type   string          `json:"type"`
+		Schema json.RawMessage `json:"schema"`
+	} `json:"format"`
+}
+
+type ResponsesReasoning struct {
+	Effort string `json:"effort"`
+}
+
+// Response is a response of the Responses API.
+type Response struct {
+	ID                string             `json:"id"`
+	Object            string             `json:"object"`
+	CreatedAt         int64              `json:"created_at"`
+	Status            string             `json:"status"`
+	Model             string             `json:"model"`
+	Output            []ResponseItem     `json:"output"`
+	IncompleteDetails *IncompleteDetails `json:"incomplete_details"`
+	Usage             *ResponseUsage     `json:"usage"`
+}
+
+type IncompleteDetails struct {
+	Reason string `json:"reason"`
+}
+
+type ResponseUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+// ResponseItem is an item of the output of a [Response]: a message, a
+// function call or the model's reasoning.
+type ResponseItem struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Status string `json:"status,omitempty"`
+
+	// message
+	Role    string            `json:"role,omitempty"`
+	Content []ResponseContent `json:"content,omitempty"`
+
+	// function_call
+	CallID    string `json:"call_id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments,omitempty"`
+
+	// reasoning
+	Summary []ResponseContent `json:"summary,omitempty"`
+}
+
+// MarshalJSON includes the fields of the item's type even when they're
+// empty, such as the content of a message that was just added.
+func (i ResponseItem) MarshalJSON() ([]byte, error) {
+	switch i.Type {
+	case "message":
+		return json.Marshal(struct {
+			Type    string            `json:"type"`
+			ID      string            `json:"id"`
+			Status  string            `json:"status"`
+			Role    string            `json:"role"`
+			Content []ResponseContent `json:"content"`
+		}{i.Type, i.ID, i.Status, i.Role, nonNil(i.Content)})
+	case "function_call":
+		return json.Marshal(struct {
+			Type      string `json:"type"`
+			ID        string `json:"id"`
+			Status    string `json:"status"`
+			CallID    string `json:"call_id"`
+			Name      string `json:"name"`
+			Arguments string `json:"arguments"`
+		}{i.Type, i.ID, i.Status, i.CallID, i.Name, i.Arguments})
+	case "reasoning":
+		return json.Marshal(struct {
+			Type    string            `json:"type"`
+			ID      string            `json:"id"`
+			Summary []ResponseContent `json:"summary"`
+		}{i.Type, i.ID, nonNil(i.Summary)})
+	}
+
+	type item ResponseItem
+	return json.Marshal(item(i))
+}
+
+// ResponseContent is a part of the content of an output message, or of the
+// summary of the model's reasoning.
+type ResponseContent struct {
+	Type        string `json:"type"`
+	Text        string `json:"text"`
+	Annotations []any  `json:"annotations,omitempty"`
+}
+
+// MarshalJSON includes the annotations of output text, which are always
+// empty.
+func (c ResponseContent) MarshalJSON() ([]byte, error) {
+	if c.Type == "output_text" {
+		return json.Marshal(struct {
+			Type        string `json:"type"`
+			Text        string `json:"text"`
+			Annotations []any  `json:"annotations"`
+		}{c.Type, c.Text, nonNil(c.Annotations)})
+	}
+
+	type content ResponseContent
+	return json.Marshal(content(c))
+}
+
+func nonNil[S ~[]E, E any](s S) S {
+	if s == nil {
+		return S{}
+	}
+	return s
+}
+
+// ResponseEvent is an event of a streamed [Response]. Only the fields of
+// the event's type are set.
+type ResponseEvent struct {
+	Type           string `json:"type"`
+	SequenceNumber int    `json:"sequence_number"`
+
+	Response     *Response        `json:"response,omitempty"`
+	OutputIndex  *int             `json:"output_index,omitempty"`
+	Item         *ResponseItem    `json:"item,omitempty"`
+	ItemID       string           `json:"item_id,omitempty"`
+	ContentIndex *int             `json:"content_index,omitempty"`
+	SummaryIndex *int             `json:"summary_index,omitempty"`
+	Part         *ResponseContent `json:"part,omitempty"`
+	Delta        string           `json:"delta,omitempty"`
+	Text         *string          `json:"text,omitempty"`
+	Arguments    *string          `json:"arguments,omitempty"`
+}
+
+// ResponseStream builds a [Response] from the responses of a chat, and the
+// events to stream it with. Text is streamed to the message or reasoning
+// item it's part of, which is done once the model moves on to something
+// else, and tool calls to function call items of their own.
+type ResponseStream struct {
+	response Response
+	started  bool
+	seq      int
+
+	// open is the index of the output item text is streamed to, or -1
+	open int
+
+	// calls maps the indices of tool calls to their output items
+	calls map[int]int
+}
+
+// NewResponseStream returns a stream for the response id.
+func NewResponseStream(id string) *ResponseStream {
+	return &ResponseStream{
+		response: Response{
+			ID:        id,
+			Object:    "response",
+			CreatedAt: time.Now().Unix(),
+			Status:    "in_progress",
+			Output:    []ResponseItem{},
+		},
+		open:  -1,
+		calls: make(map[int]int),
+	}
+}
+
+// Response returns the response built so far.
+func (s *ResponseStream) Response() Response {
+	r := s.response
+	r.Output = slices.Clone(r.Output)
+	for i := range r.Output {
+		r.Output[i].Content = slices.Clone(r.Output[i].Content)
+		r.Output[i].Summary = slices.Clone(r.Output[i].Summary)
+	}
+	return r
+}
+
+// Events adds the chat response r to the response, returning the events
+// for it.
+func (s *ResponseStream) Events(r api.ChatResponse) []ResponseEvent {
+	var events []ResponseEvent
+	emit := func(e ResponseEvent) {
+		e.SequenceNumber = s.seq
+		s.seq++
+		events = append(events, e)
+	}
+
+	if s.response.Model == "" {
+		s.response.Model = r.Model
+	}
+
+	if !s.started {
+		s.started = true
+		created := s.Response()
+		emit(ResponseEvent{Type: "response.created", Response: &created})
+		inProgress := s.Response()
+		emit(ResponseEvent{Type: "response.in_progress", Response: &inProgress})
+	}
+
+	if r.Message.Thinking != "" {
+		s.text("reasoning", r.Message.Thinking, emit)
+	}
+
+	if r.Message.Content != "" {
+		s.text("message", r.Message.Content, emit)
+	}
+
+	for _, d := range r.Message.ToolCallDeltas {
+		i := s.call(d.Index, d.Name, emit)
+		if d.Arguments != "" {
+			s.response.Output[i].Arguments += d.Arguments
+			emit(ResponseEvent{Type: "response.function_call_arguments.delta", ItemID: s.response.Output[i].ID, OutputIndex: &i, Delta: d.Arguments})
+		}
+	}
+
+	for _, tc := range r.Message.ToolCalls {
+		args, err := json.Marshal(tc.Function.Arguments)
+		if err != nil {
+			slog.Error("could not marshall function arguments to json", "error", err)
+			continue
+		}
+
+		i := s.call(tc.Function.Index, tc.Function.Name, emit)
+		if s.response.Output[i].Arguments == "" {
+			emit(ResponseEvent{Type: "response.function_call_arguments.delta", ItemID: s.response.Output[i].ID, OutputIndex: &i, Delta: string(args)})
+		}
+		s.response.Output[i].Arguments = string(args)
+		s.finish(i, emit)
+	}
+
+	if r.Done {
+		s.finish(s.open, emit)
+
+		// calls that were started but not completed
+		for _, i := range slices.Sorted(maps.Values(s.calls)) {
+			s.finish(i, emit)
+		}
+
+		s.response.Status = "completed"
+		if r.DoneReason == "length" {
+			s.response.Status = "incomplete"
+			s.response.IncompleteDetails = &IncompleteDetails{Reason: "max_output_tokens"}
+		}
+
+		s.response.Usage = &ResponseUsage{
+			InputTokens:  r.PromptEvalCount,
+			OutputTokens: r.EvalCount,
+			TotalTokens:  r.PromptEvalCount + r.EvalCount,
+		}
+
+		done := s.Response()
+		emit(ResponseEvent{Type: "response." + s.response.Status, Response: &done})
+	}
+
+	return events
+}
+
+// text adds text to the output item of kind, which is a message or
+// reasoning, adding the item if the last one is of another kind.
+func (s *ResponseStream) text(kind, text string, emit func(ResponseEvent)) {
+	if s.open < 0 || s.response.Output[s.open].Type != kind {
+		s.finish(s.open, emit)
+
+		item := ResponseItem{Type: kind, Status: "in_progress"}
+		part := ResponseContent{Type: "summary_text"}
+		if kind == "message" {
+			item.ID = "msg_" + randomID()
+			item.Role = "assistant"
+			part.Type = "output_text"
+		} else {
+			item.ID = "rs_" + randomID()
+		}
+
+		s.open = s.add(item, emit)
+		i := s.open
+		if kind == "message" {
+			s.response.Output[i].Content = []ResponseContent{part}
+			emit(ResponseEvent{Type: "response.content_part.added", ItemID: item.ID, OutputIndex: &i, ContentIndex: new(int), Part: &part})
+		} else {
+			s.response.Output[i].Summary = []ResponseContent{part}
+			emit(ResponseEvent{Type: "response.reasoning_summary_part.added", ItemID: item.ID, OutputIndex: &i, SummaryIndex: new(int), Part: &part})
+		}
+	}
+
+	i := s.open
+	item := &s.response.Output[i]
+	if kind == "message" {
+		item.Content[0].Text += text
+		emit(ResponseEvent{Type: "response.output_text.delta", ItemID: item.ID, OutputIndex: &i, ContentIndex: new(int), Delta: text})
+	} else {
+		item.Summary[0].Text += text
+		emit(ResponseEvent{Type: "response.reasoning_summary_text.delta", ItemID: item.ID, OutputIndex: &i, SummaryIndex: new(int), Delta: text})
+	}
+}
+
+// call returns the output item of the tool call with the index, adding it
+// if it's new.
+func (s *ResponseStream) call(index int, name string, emit func(ResponseEvent)) int {
+	if i, ok := s.calls[index]; ok {
+		return i
+	}
+
+	s.finish(s.open, emit)
+	i := s.add(ResponseItem{Type: "function_call", ID: "fc_" + randomID(), Status: "in_progress", CallID: toolCallID(), Name: name}, emit)
+	s.calls[index] = i
+	return i
+}
+
+// add adds item to the output, returning its index.
+func (s *ResponseStream) add(item ResponseItem, emit func(ResponseEvent)) int {
+	i := len(s.response.Output)
+	s.response.Output = append(s.response.Output, item)
+	emit(ResponseEvent{Type: "response.output_item.added", OutputIndex: &i, Item: &item})
+	return i
+}
+
+// finish completes the output item at i if it's still in progress.
+func (s *ResponseStream) finish(i int, emit func(ResponseEvent)) {
+	if i < 0 || s.response.Output[i].Status != "in_progress" {
+		return
+	}
+
+	if i == s.open {
+		s.open = -1
+	}
+
+	item := &s.response.Output[i]
+	item.Status = "completed"
+	switch item.Type {
+	case "message":
+		part := item.Content[0]
+		emit(ResponseEvent{Type: "response.output_text.done", ItemID: item.ID, OutputIndex: &i, ContentIndex: new(int), Text: &part.Text})
+		emit(ResponseEvent{Type: "response.content_part.done", ItemID: item.ID, OutputIndex: &i, ContentIndex: new(int), Part: &part})
+	case "reasoning":
+		part := item.Summary[0]
+		emit(ResponseEvent{Type: "response.reasoning_summary_text.done", ItemID: item.ID, OutputIndex: &i, SummaryIndex: new(int), Text: &part.Text})
+		emit(ResponseEvent{Type: "response.reasoning_summary_part.done", ItemID: item.ID, OutputIndex: &i, SummaryIndex: new(int), Part: &part})
+	case "function_call":
+		args := item.Arguments
+		emit(ResponseEvent{Type: "response.function_call_arguments.done", ItemID: item.ID, OutputIndex: &i, Arguments: &args})
+	}
+
+	done := s.Response().Output[i]
+	emit(ResponseEvent{Type: "response.output_item.done", OutputIndex: &i, Item: &done})
+}
+
+// ToResponse converts a complete chat response to a [Response].
+func ToResponse(id string, r api.ChatResponse) Response {
+	s := NewResponseStream(id)
+	s.Events(r)
+	return s.Response()
+}
+
+func randomID() string {
+	return strings.TrimPrefix(toolCallID(), "call_")
+}
+
+// FromResponsesRequest converts a request to the Responses API to a chat
+// request.
+func FromResponsesRequest(r ResponsesRequest) (*api.ChatRequest, error) {
+	if r.PreviousResponseID != "" {
+		return nil, errors.New("previous_response_id isn't supported, send the conversation in input")
+	}
+
+	var messages []api.Message
+	if r.Instructions != "" {
+		messages = append(messages, api.Message{Role: "system", Content: r.Instructions})
+	}
+
+	var text string
+	var items []ResponsesInputItem
+	if err := json.Unmarshal(r.Input, &text); err == nil {
+		items = []ResponsesInputItem{{Type: "message", Role: "user", Content: r.Input}}
+	} else if err := json.Unmarshal(r.Input, &items); err != nil {
+		return nil, errors.New("input must be a string or a list of items")
+	}
+
+	// the names of the functions called, which tool messages are for
+	names := make(map[string]string)
+	for _, item := range items {
+		switch item.Type {
+		case "", "message":
+			msg, err := fromResponsesMessage(item)
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, msg)
+		case "function_call":
+			var tc api.ToolCall
+			tc.Function.Name = item.Name
+			if err := json.Unmarshal([]byte(item.Arguments), &tc.Function.Arguments); err != nil {
+				return nil, errors.New("invalid tool call arguments")
+			}
+			names[item.CallID] = item.Name
+
+			// consecutive calls are part of the same assistant message
+			if n := len(messages); n > 0 && messages[n-1].Role == "assistant" {
+				tc.Function.Index = len(messages[n-1].ToolCalls)
+				messages[n-1].ToolCalls = append(messages[n-1].ToolCalls, tc)
+			} else {
+				messages = append(messages, api.Message{Role: "assistant", ToolCalls: []api.ToolCall{tc}})
+			}
+		case "function_call_output":
+			if _, ok := names[item.CallID]; !ok {
+				return nil, fmt.Errorf("no function call for output with call_id %q", item.CallID)
+			}
+			messages = append(messages, api.Message{Role: "tool", Content: item.Output})
+		default:
+			return nil, fmt.Errorf("input item type %q isn't supported", item.Type)
+		}
+	}
+
+	var tools []api.Tool
+	for _, t := range r.Tools {
+		if t.Type != "function" {
+			return nil, fmt.Errorf("tool type %q isn't supported", t.Type)
+		}
+
+		tool := api.Tool{Type: "function"}
+		tool.Function.Name = t.Name
+		tool.Function.Description = t.Description
+		if len(t.Parameters) > 0 {
+			if err := json.Unmarshal(t.Parameters, &tool.Function.Parameters); err != nil {
+				return nil, fmt.Errorf("invalid parameters for tool %q: %w", t.Name, err)
+			}
+		}
+		tools = append(tools, tool)
+	}
+
+	options := make(map[string]any)
+	if r.MaxOutputTokens != nil {
+		options["num_predict"] = *r.MaxOutputTokens
+	}
+	if r.Temperature != nil {
+		options["temperature"] = *r.Temperature
+	} else {
+		options["temperature"] = 1.0
+	}
+	if r.TopP != nil {
+		options["top_p"] = *r.TopP
+	} else {
+		options["top_p"] = 1.0
+	}
+
+	var format json.RawMessage
+	if r.Text != nil {
+		switch r.Text.Format.Type {
+		case "json_object":
+			format = json.RawMessage(`"json"`)
+		case "json_schema":
+			format = r.Text.Format.Schema
+		}
+	}
+
+	var think *bool
+	if r.Reasoning != nil {
+		think = new(bool)
+		*think = true
+	}
+
+	return &api.ChatRequest{
+		Model:    r.Model,
+		Messages: messages,
+		Format:   format,
+		Options:  options,
+		Stream:   &r.Stream,
+		Tools:    tools,
+		Think:    think,
+
+		ParallelToolCalls: r.ParallelToolCalls,
+	}, nil
+}
+
+func fromResponsesMessage(item ResponsesInputItem) (api.Message, error) {
+	role := item.Role
+	if role == "developer" {
+		role = "system"
+	}
+
+	msg := api.Message{Role: role}
+	if err := json.Unmarshal(item.Content, &msg.Content); err == nil {
+		return msg, nil
+	}
+
+	var parts []ResponsesInputContent
+	if err := json.Unmarshal(item.Content, &parts); err != nil {
+		return api.Message{}, errors.New("invalid message format")
+	}
+
+	var sb strings.Builder
+	for _, p := range parts {
+		switch p.Type {
+		case "input_text", "output_text":
+			sb.WriteString(p.Text)
+		case "input_image":
+			img, err := decodeImageURL(p.ImageURL)
+			if err != nil {
+				return api.Message{}, err
+			}
+			msg.Images = append(msg.Images, img)
+		default:
+			return api.Message{}, fmt.Errorf("content type %q isn't supported", p.Type)
+		}
+	}
+	msg.Content = sb.String()
+
+	return msg, nil
+}
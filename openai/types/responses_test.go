@@ -0,0 +1,149 @@
+package types
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/goobla/goobla/api"
+)
+
+func TestFromResponsesRequest(t *testing.T) {
+	var req ResponsesRequest
+	if err := json.Unmarshal([]byte(`{
+		"model": "test",
+		"instructions": "Be brief.",
+		"input": [
+			{"role": "user", "content": [{"type": "input_text", "text": "What's the weather in Paris?"}]},
+			{"type": "function_call", "call_id": "call_1", "name": "get_weather", "arguments": "{\"city\": \"Paris\"}"},
+			{"type": "function_call_output", "call_id": "call_1", "output": "sunny"}
+		],
+		"tools": [{"type": "function", "name": "get_weather", "parameters": {"type": "object", "required": ["city"], "properties": {"city": {"type": "string"}}}}],
+		"max_output_tokens": 64,
+		"text": {"format": {"type": "json_object"}}
+	}`), &req); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := FromResponsesRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []api.Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "What's the weather in Paris?"},
+		{Role: "assistant", ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"city": "Paris"}}}}},
+		{Role: "tool", Content: "sunny"},
+	}
+	if diff := cmp.Diff(want, got.Messages); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	if len(got.Tools) != 1 || got.Tools[0].Function.Name != "get_weather" || got.Tools[0].Function.Parameters.Required[0] != "city" {
+		t.Errorf("unexpected tools %+v", got.Tools)
+	}
+
+	if got.Options["num_predict"] != 64 || string(got.Format) != `"json"` {
+		t.Errorf("unexpected options %v and format %s", got.Options, got.Format)
+	}
+
+	req = ResponsesRequest{Model: "test", Input: json.RawMessage(`"Hello!"`)}
+	if got, err := FromResponsesRequest(req); err != nil || len(got.Messages) != 1 || got.Messages[0].Content != "Hello!" {
+		t.Errorf("unexpected request %+v, %v", got, err)
+	}
+
+	for _, input := range []string{
+		`42`,
+		`[{"type": "function_call_output", "call_id": "call_1", "output": "sunny"}]`,
+		`[{"type": "web_search_call"}]`,
+	} {
+		if _, err := FromResponsesRequest(ResponsesRequest{Input: json.RawMessage(input)}); err == nil {
+			t.Errorf("%s: expected an error", input)
+		}
+	}
+}
+
+func TestResponseStream(t *testing.T) {
+	s := NewResponseStream("resp_1")
+
+	var events []string
+	for _, r := range []api.ChatResponse{
+		{Model: "test", Message: api.Message{Role: "assistant", Thinking: "Checking."}},
+		{Message: api.Message{Role: "assistant", Content: "Let me "}},
+		{Message: api.Message{Role: "assistant", Content: "look."}},
+		{Message: api.Message{Role: "assistant", ToolCallDeltas: []api.ToolCallDelta{{Index: 0, Name: "get_weather", Arguments: `{"city": `}}}},
+		{Message: api.Message{Role: "assistant", ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"city": "Paris"}}}}}},
+		{Message: api.Message{Role: "assistant"}, Done: true, DoneReason: "stop", Metrics: api.Metrics{PromptEvalCount: 3, EvalCount: 5}},
+	} {
+		for _, e := range s.Events(r) {
+			if e.SequenceNumber != len(events) {
+				t.Errorf("%s has sequence number %d, want %d", e.Type, e.SequenceNumber, len(events))
+			}
+			events = append(events, e.Type)
+		}
+	}
+
+	want := []string{
+		"response.created",
+		"response.in_progress",
+		"response.output_item.added",
+		"response.reasoning_summary_part.added",
+		"response.reasoning_summary_text.delta",
+		"response.reasoning_summary_text.done",
+		"response.reasoning_summary_part.done",
+		"response.output_item.done",
+		"response.output_item.added",
+		"response.content_part.added",
+		"response.output_text.delta",
+		"response.output_text.delta",
+		"response.output_text.done",
+		"response.content_part.done",
+		"response.output_item.done",
+		"response.output_item.added",
+		"response.function_call_arguments.delta",
+		"response.function_call_arguments.done",
+		"response.output_item.done",
+		"response.completed",
+	}
+	if diff := cmp.Diff(want, events); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	r := s.Response()
+	if r.Status != "completed" || r.Model != "test" || r.Usage == nil || r.Usage.TotalTokens != 8 {
+		t.Errorf("unexpected response %+v", r)
+	}
+
+	if len(r.Output) != 3 {
+		t.Fatalf("expected 3 output items, got %d", len(r.Output))
+	}
+
+	if r.Output[0].Summary[0].Text != "Checking." || r.Output[1].Content[0].Text != "Let me look." {
+		t.Errorf("unexpected text %+v", r.Output[:2])
+	}
+
+	if call := r.Output[2]; call.Name != "get_weather" || call.Arguments != `{"city":"Paris"}` || call.Status != "completed" {
+		t.Errorf("unexpected call %+v", call)
+	}
+
+	b, err := json.Marshal(ToResponse("resp_2", api.ChatResponse{Message: api.Message{Role: "assistant", Content: "Hi"}, Done: true, DoneReason: "length"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got["status"] != "incomplete" {
+		t.Errorf("expected an incomplete response, got %s", b)
+	}
+
+	content := got["output"].([]any)[0].(map[string]any)["content"].([]any)[0].(map[string]any)
+	if content["text"] != "Hi" || content["annotations"] == nil {
+		t.Errorf("unexpected content %v", content)
+	}
+}
@@ -2,10 +2,12 @@ package types
 
 import (
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"math"
 	"math/rand"
 	"net/http"
 	"strings"
@@ -35,21 +37,37 @@ type Message struct {
 }
 
 type Choice struct {
-	Index        int     `json:"index"`
-	Message      Message `json:"message"`
-	FinishReason *string `json:"finish_reason"`
+	Index        int             `json:"index"`
+	Message      Message         `json:"message"`
+	Logprobs     *ChoiceLogprobs `json:"logprobs,omitempty"`
+	FinishReason *string         `json:"finish_reason"`
 }
 
 type ChunkChoice struct {
-	Index        int     `json:"index"`
-	Delta        Message `json:"delta"`
-	FinishReason *string `json:"finish_reason"`
+	Index        int             `json:"index"`
+	Delta        Message         `json:"delta"`
+	Logprobs     *ChoiceLogprobs `json:"logprobs,omitempty"`
+	FinishReason *string         `json:"finish_reason"`
 }
 
 type CompleteChunkChoice struct {
-	Text         string  `json:"text"`
-	Index        int     `json:"index"`
-	FinishReason *string `json:"finish_reason"`
+	Text         string              `json:"text"`
+	Index        int                 `json:"index"`
+	Logprobs     *CompletionLogprobs `json:"logprobs,omitempty"`
+	FinishReason *string             `json:"finish_reason"`
+}
+
+// ChoiceLogprobs is the log probabilities of the tokens in a chat choice.
+type ChoiceLogprobs struct {
+	Content []api.Logprob `json:"content"`
+}
+
+// CompletionLogprobs is the log probabilities of the tokens in a completion
+// choice, in the legacy completions format.
+type CompletionLogprobs struct {
+	Tokens        []string             `json:"tokens"`
+	TokenLogprobs []float64            `json:"token_logprobs"`
+	TopLogprobs   []map[string]float64 `json:"top_logprobs"`
 }
 
 type Usage struct {
@@ -68,8 +86,47 @@ type JsonSchema struct {
 }
 
 type EmbedRequest struct {
-	Input any    `json:"input"`
-	Model string `json:"model"`
+	Input          any    `json:"input"`
+	Model          string `json:"model"`
+	EncodingFormat string `json:"encoding_format,omitempty"`
+	Dimensions     int    `json:"dimensions,omitempty"`
+	User           string `json:"user,omitempty"`
+}
+
+// RerankRequest is a request to rerank documents in the format of the Cohere
+// and Jina rerank APIs.
+type RerankRequest struct {
+	Model           string           `json:"model"`
+	Query           string           `json:"query"`
+	Documents       []RerankDocument `json:"documents"`
+	TopN            int              `json:"top_n,omitempty"`
+	ReturnDocuments bool             `json:"return_documents,omitempty"`
+}
+
+// TranscriptionRequest is a request to transcribe audio, which is sent as a
+// multipart form.
+type TranscriptionRequest struct {
+	Model          string
+	File           []byte
+	Prompt         string
+	Language       string
+	ResponseFormat string
+	Temperature    *float64
+}
+
+// RerankDocument is a document to rerank, sent as a string or as an object
+// with its text.
+type RerankDocument struct {
+	Text string `json:"text"`
+}
+
+func (d *RerankDocument) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &d.Text); err == nil {
+		return nil
+	}
+
+	type document RerankDocument
+	return json.Unmarshal(b, (*document)(d))
 }
 
 type StreamOptions struct {
@@ -77,19 +134,23 @@ type StreamOptions struct {
 }
 
 type ChatCompletionRequest struct {
-	Model            string          `json:"model"`
-	Messages         []Message       `json:"messages"`
-	Stream           bool            `json:"stream"`
-	StreamOptions    *StreamOptions  `json:"stream_options"`
-	MaxTokens        *int            `json:"max_tokens"`
-	Seed             *int            `json:"seed"`
-	Stop             any             `json:"stop"`
-	Temperature      *float64        `json:"temperature"`
-	FrequencyPenalty *float64        `json:"frequency_penalty"`
-	PresencePenalty  *float64        `json:"presence_penalty"`
-	TopP             *float64        `json:"top_p"`
-	ResponseFormat   *ResponseFormat `json:"response_format"`
-	Tools            []api.Tool      `json:"tools"`
+	Model             string             `json:"model"`
+	Messages          []Message          `json:"messages"`
+	Stream            bool               `json:"stream"`
+	StreamOptions     *StreamOptions     `json:"stream_options"`
+	MaxTokens         *int               `json:"max_tokens"`
+	Seed              *int               `json:"seed"`
+	Stop              any                `json:"stop"`
+	Temperature       *float64           `json:"temperature"`
+	FrequencyPenalty  *float64           `json:"frequency_penalty"`
+	PresencePenalty   *float64           `json:"presence_penalty"`
+	TopP              *float64           `json:"top_p"`
+	ResponseFormat    *ResponseFormat    `json:"response_format"`
+	Tools             []api.Tool         `json:"tools"`
+	ParallelToolCalls *bool              `json:"parallel_tool_calls"`
+	LogitBias         map[string]float32 `json:"logit_bias"`
+	Logprobs          bool               `json:"logprobs"`
+	TopLogprobs       int                `json:"top_logprobs"`
 }
 
 type ChatCompletion struct {
@@ -115,18 +176,20 @@ type ChatCompletionChunk struct {
 // Supports using string, []string, []int, or [][]int for the Prompt field.
 
 type CompletionRequest struct {
-	Model            string         `json:"model"`
-	Prompt           any            `json:"prompt"`
-	FrequencyPenalty float32        `json:"frequency_penalty"`
-	MaxTokens        *int           `json:"max_tokens"`
-	PresencePenalty  float32        `json:"presence_penalty"`
-	Seed             *int           `json:"seed"`
-	Stop             any            `json:"stop"`
-	Stream           bool           `json:"stream"`
-	StreamOptions    *StreamOptions `json:"stream_options"`
-	Temperature      *float32       `json:"temperature"`
-	TopP             float32        `json:"top_p"`
-	Suffix           string         `json:"suffix"`
+	Model            string             `json:"model"`
+	Prompt           any                `json:"prompt"`
+	FrequencyPenalty float32            `json:"frequency_penalty"`
+	MaxTokens        *int               `json:"max_tokens"`
+	PresencePenalty  float32            `json:"presence_penalty"`
+	Seed             *int               `json:"seed"`
+	Stop             any                `json:"stop"`
+	Stream           bool               `json:"stream"`
+	StreamOptions    *StreamOptions     `json:"stream_options"`
+	Temperature      *float32           `json:"temperature"`
+	TopP             float32            `json:"top_p"`
+	Suffix           string             `json:"suffix"`
+	LogitBias        map[string]float32 `json:"logit_bias"`
+	Logprobs         *int               `json:"logprobs"`
 }
 
 type Completion struct {
@@ -149,12 +212,14 @@ type CompletionChunk struct {
 	Usage             *Usage                `json:"usage,omitempty"`
 }
 
+// ToolCall is a tool call, or when streaming part of one: the first part
+// has its ID, type and name, and the others add to its arguments.
 type ToolCall struct {
-	ID       string `json:"id"`
+	ID       string `json:"id,omitempty"`
 	Index    int    `json:"index"`
-	Type     string `json:"type"`
+	Type     string `json:"type,omitempty"`
 	Function struct {
-		Name      string `json:"name"`
+		Name      string `json:"name,omitempty"`
 		Arguments string `json:"arguments"`
 	} `json:"function"`
 }
@@ -164,12 +229,41 @@ type Model struct {
 	Object  string `json:"object"`
 	Created int64  `json:"created"`
 	OwnedBy string `json:"owned_by"`
+
+	// Details, Capabilities and ContextLength describe the model beyond
+	// the fields of OpenAI's model object, for clients discovering models.
+	// Only Details are set when listing models.
+	Details       api.ModelDetails   `json:"details,omitzero"`
+	Capabilities  []model.Capability `json:"capabilities,omitempty"`
+	ContextLength int                `json:"context_length,omitempty"`
 }
 
 type Embedding struct {
 	Object    string    `json:"object"`
 	Embedding []float32 `json:"embedding"`
 	Index     int       `json:"index"`
+
+	// base64 is whether the embedding is encoded as a base64 string of its
+	// little-endian float32 values instead of an array
+	base64 bool
+}
+
+func (e Embedding) MarshalJSON() ([]byte, error) {
+	type embedding Embedding
+	if !e.base64 {
+		return json.Marshal(embedding(e))
+	}
+
+	b := make([]byte, 0, 4*len(e.Embedding))
+	for _, v := range e.Embedding {
+		b = binary.LittleEndian.AppendUint32(b, math.Float32bits(v))
+	}
+
+	return json.Marshal(struct {
+		Object    string `json:"object"`
+		Embedding string `json:"embedding"`
+		Index     int    `json:"index"`
+	}{e.Object, base64.StdEncoding.EncodeToString(b), e.Index})
 }
 
 type ListCompletion struct {
@@ -189,6 +283,31 @@ type EmbeddingUsage struct {
 	TotalTokens  int `json:"total_tokens"`
 }
 
+type RerankResponse struct {
+	Model   string         `json:"model"`
+	Object  string         `json:"object"`
+	Results []RerankResult `json:"results"`
+	Usage   EmbeddingUsage `json:"usage"`
+}
+
+type Transcription struct {
+	Text  string             `json:"text"`
+	Usage TranscriptionUsage `json:"usage"`
+}
+
+type TranscriptionUsage struct {
+	Type         string `json:"type"`
+	InputTokens  int    `json:"input_tokens"`
+	OutputTokens int    `json:"output_tokens"`
+	TotalTokens  int    `json:"total_tokens"`
+}
+
+type RerankResult struct {
+	Index          int             `json:"index"`
+	RelevanceScore float64         `json:"relevance_score"`
+	Document       *RerankDocument `json:"document,omitempty"`
+}
+
 func NewError(code int, message string) ErrorResponse {
 	var etype string
 	switch code {
@@ -245,8 +364,9 @@ func ToChatCompletion(id string, r api.ChatResponse) ChatCompletion {
 		Model:             r.Model,
 		SystemFingerprint: "fp_goobla",
 		Choices: []Choice{{
-			Index:   0,
-			Message: Message{Role: r.Message.Role, Content: r.Message.Content, ToolCalls: toolCalls},
+			Index:    0,
+			Message:  Message{Role: r.Message.Role, Content: r.Message.Content, ToolCalls: toolCalls},
+			Logprobs: toChoiceLogprobs(r.Logprobs),
 			FinishReason: func(reason string) *string {
 				if len(toolCalls) > 0 {
 					reason = "tool_calls"
@@ -261,8 +381,56 @@ func ToChatCompletion(id string, r api.ChatResponse) ChatCompletion {
 	}
 }
 
-func ToChunk(id string, r api.ChatResponse, toolCallSent bool) ChatCompletionChunk {
-	toolCalls := toToolCalls(r.Message.ToolCalls)
+// ToolCallStream tracks the tool calls of a streamed chat completion,
+// which are sent in parts while they're generated, so each call gets one
+// ID and complete calls that were already streamed aren't sent again.
+type ToolCallStream struct {
+	ids map[int]string
+}
+
+// Sent reports whether any tool calls have been streamed.
+func (s *ToolCallStream) Sent() bool {
+	return len(s.ids) > 0
+}
+
+// toolCalls returns the parts of tool calls to stream for message m.
+func (s *ToolCallStream) toolCalls(m api.Message) []ToolCall {
+	if s.ids == nil {
+		s.ids = make(map[int]string)
+	}
+
+	var toolCalls []ToolCall
+	for _, d := range m.ToolCallDeltas {
+		if n := len(toolCalls); n > 0 && toolCalls[n-1].Index == d.Index {
+			toolCalls[n-1].Function.Arguments += d.Arguments
+			continue
+		}
+
+		var tc ToolCall
+		tc.Index = d.Index
+		tc.Function.Arguments = d.Arguments
+		if _, ok := s.ids[d.Index]; !ok {
+			s.ids[d.Index] = toolCallID()
+			tc.ID = s.ids[d.Index]
+			tc.Type = "function"
+			tc.Function.Name = d.Name
+		}
+		toolCalls = append(toolCalls, tc)
+	}
+
+	for _, tc := range toToolCalls(m.ToolCalls) {
+		if _, ok := s.ids[tc.Index]; !ok {
+			s.ids[tc.Index] = tc.ID
+			toolCalls = append(toolCalls, tc)
+		}
+	}
+
+	return toolCalls
+}
+
+func ToChunk(id string, r api.ChatResponse, calls *ToolCallStream) ChatCompletionChunk {
+	toolCalls := calls.toolCalls(r.Message)
+	toolCallSent := calls.Sent()
 	return ChatCompletionChunk{
 		Id:                id,
 		Object:            "chat.completion.chunk",
@@ -270,8 +438,9 @@ func ToChunk(id string, r api.ChatResponse, toolCallSent bool) ChatCompletionChu
 		Model:             r.Model,
 		SystemFingerprint: "fp_goobla",
 		Choices: []ChunkChoice{{
-			Index: 0,
-			Delta: Message{Role: "assistant", Content: r.Message.Content, ToolCalls: toolCalls},
+			Index:    0,
+			Delta:    Message{Role: "assistant", Content: r.Message.Content, ToolCalls: toolCalls},
+			Logprobs: toChoiceLogprobs(r.Logprobs),
 			FinishReason: func(reason string) *string {
 				if len(reason) > 0 {
 					if toolCallSent {
@@ -285,6 +454,34 @@ func ToChunk(id string, r api.ChatResponse, toolCallSent bool) ChatCompletionChu
 	}
 }
 
+func toChoiceLogprobs(logprobs []api.Logprob) *ChoiceLogprobs {
+	if len(logprobs) == 0 {
+		return nil
+	}
+
+	return &ChoiceLogprobs{Content: logprobs}
+}
+
+func toCompletionLogprobs(logprobs []api.Logprob) *CompletionLogprobs {
+	if len(logprobs) == 0 {
+		return nil
+	}
+
+	var c CompletionLogprobs
+	for _, lp := range logprobs {
+		c.Tokens = append(c.Tokens, lp.Token)
+		c.TokenLogprobs = append(c.TokenLogprobs, lp.Logprob)
+
+		top := make(map[string]float64, len(lp.TopLogprobs))
+		for _, t := range lp.TopLogprobs {
+			top[t.Token] = t.Logprob
+		}
+		c.TopLogprobs = append(c.TopLogprobs, top)
+	}
+
+	return &c
+}
+
 func ToUsageGenerate(r api.GenerateResponse) Usage {
 	return Usage{
 		PromptTokens:     r.PromptEvalCount,
@@ -301,8 +498,9 @@ func ToCompletion(id string, r api.GenerateResponse) Completion {
 		Model:             r.Model,
 		SystemFingerprint: "fp_goobla",
 		Choices: []CompleteChunkChoice{{
-			Text:  r.Response,
-			Index: 0,
+			Text:     r.Response,
+			Index:    0,
+			Logprobs: toCompletionLogprobs(r.Logprobs),
 			FinishReason: func(reason string) *string {
 				if len(reason) > 0 {
 					return &reason
@@ -322,8 +520,9 @@ func ToCompleteChunk(id string, r api.GenerateResponse) CompletionChunk {
 		Model:             r.Model,
 		SystemFingerprint: "fp_goobla",
 		Choices: []CompleteChunkChoice{{
-			Text:  r.Response,
-			Index: 0,
+			Text:     r.Response,
+			Index:    0,
+			Logprobs: toCompletionLogprobs(r.Logprobs),
 			FinishReason: func(reason string) *string {
 				if len(reason) > 0 {
 					return &reason
@@ -342,16 +541,19 @@ func ToListCompletion(r api.ListResponse) ListCompletion {
 			Object:  "model",
 			Created: m.ModifiedAt.Unix(),
 			OwnedBy: model.ParseName(m.Name).Namespace,
+			Details: m.Details,
 		})
 	}
 	return ListCompletion{Object: "list", Data: data}
 }
 
-func ToEmbeddingList(model string, r api.EmbedResponse) EmbeddingList {
+// ToEmbeddingList converts r to an embedding list, with its embeddings
+// encoded as base64 strings if encodingFormat is "base64".
+func ToEmbeddingList(model string, r api.EmbedResponse, encodingFormat string) EmbeddingList {
 	if r.Embeddings != nil {
 		var data []Embedding
 		for i, e := range r.Embeddings {
-			data = append(data, Embedding{Object: "embedding", Embedding: e, Index: i})
+			data = append(data, Embedding{Object: "embedding", Embedding: e, Index: i, base64: encodingFormat == "base64"})
 		}
 		return EmbeddingList{
 			Object: "list",
@@ -366,15 +568,150 @@ func ToEmbeddingList(model string, r api.EmbedResponse) EmbeddingList {
 	return EmbeddingList{}
 }
 
+// FromRerankRequest converts a rerank request to an [api.RerankRequest].
+func FromRerankRequest(r RerankRequest) api.RerankRequest {
+	documents := make([]string, len(r.Documents))
+	for i, d := range r.Documents {
+		documents[i] = d.Text
+	}
+
+	return api.RerankRequest{
+		Model:           r.Model,
+		Query:           r.Query,
+		Documents:       documents,
+		TopN:            r.TopN,
+		ReturnDocuments: r.ReturnDocuments,
+	}
+}
+
+func ToRerankResponse(model string, r api.RerankResponse) RerankResponse {
+	results := make([]RerankResult, len(r.Results))
+	for i, result := range r.Results {
+		results[i] = RerankResult{Index: result.Index, RelevanceScore: result.RelevanceScore}
+		if result.Document != "" {
+			results[i].Document = &RerankDocument{Text: result.Document}
+		}
+	}
+
+	return RerankResponse{
+		Model:   model,
+		Object:  "list",
+		Results: results,
+		Usage: EmbeddingUsage{
+			PromptTokens: r.PromptEvalCount,
+			TotalTokens:  r.PromptEvalCount,
+		},
+	}
+}
+
+// FromTranscriptionRequest converts a transcription request to an
+// [api.ChatRequest] that asks the model to transcribe the audio.
+func FromTranscriptionRequest(r TranscriptionRequest) api.ChatRequest {
+	content := "Transcribe this audio"
+	if r.Language != "" {
+		content += fmt.Sprintf(" in the language with the ISO-639-1 code %q", r.Language)
+	}
+	content += ". Reply with only the transcription."
+	if r.Prompt != "" {
+		content += " The audio follows this text, which has the spelling and style to use:\n\n" + r.Prompt
+	}
+
+	// transcriptions are greedy unless asked otherwise, like OpenAI's
+	options := map[string]any{"temperature": 0.0}
+	if r.Temperature != nil {
+		options["temperature"] = *r.Temperature
+	}
+
+	stream := false
+	return api.ChatRequest{
+		Model:    r.Model,
+		Messages: []api.Message{{Role: "user", Content: content, Audio: []api.AudioData{r.File}}},
+		Stream:   &stream,
+		Options:  options,
+	}
+}
+
+func ToTranscription(r api.ChatResponse) Transcription {
+	return Transcription{
+		Text: strings.TrimSpace(r.Message.Content),
+		Usage: TranscriptionUsage{
+			Type:         "tokens",
+			InputTokens:  r.PromptEvalCount,
+			OutputTokens: r.EvalCount,
+			TotalTokens:  r.PromptEvalCount + r.EvalCount,
+		},
+	}
+}
+
 func ToModel(r api.ShowResponse, m string) Model {
+	var contextLength int
+	if arch, ok := r.ModelInfo["general.architecture"].(string); ok {
+		switch n := r.ModelInfo[arch+".context_length"].(type) {
+		case float64:
+			contextLength = int(n)
+		case uint32:
+			contextLength = int(n)
+		}
+	}
+
 	return Model{
-		Id:      m,
-		Object:  "model",
-		Created: r.ModifiedAt.Unix(),
-		OwnedBy: model.ParseName(m).Namespace,
+		Id:            m,
+		Object:        "model",
+		Created:       r.ModifiedAt.Unix(),
+		OwnedBy:       model.ParseName(m).Namespace,
+		Details:       r.Details,
+		Capabilities:  r.Capabilities,
+		ContextLength: contextLength,
 	}
 }
 
+// NewModelNotFoundError returns the error for a model that doesn't exist,
+// with the model_not_found code clients check for.
+func NewModelNotFoundError(message string) ErrorResponse {
+	code := "model_not_found"
+	e := NewError(http.StatusNotFound, message)
+	e.Error.Code = &code
+	return e
+}
+
+// NewUnsupportedError returns the error for an endpoint of the OpenAI API
+// that isn't supported, which like OpenAI's for an invalid URL is an
+// invalid request.
+func NewUnsupportedError(path string) ErrorResponse {
+	code := "unsupported"
+	e := NewError(http.StatusNotFound, fmt.Sprintf("%s isn't supported", path))
+	e.Error.Type = "invalid_request_error"
+	e.Error.Code = &code
+	return e
+}
+
+// decodeImageURL returns the image in a base64 data URL, or the URL itself
+// for the server to load if it's an http(s) URL.
+func decodeImageURL(url string) (api.ImageData, error) {
+	if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+		return api.ImageData(url), nil
+	}
+
+	types := []string{"jpeg", "jpg", "png"}
+	valid := false
+	for _, t := range types {
+		prefix := "data:image/" + t + ";base64,"
+		if strings.HasPrefix(url, prefix) {
+			url = strings.TrimPrefix(url, prefix)
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, errors.New("invalid image input")
+	}
+	img, err := base64.StdEncoding.DecodeString(url)
+	if err != nil {
+		return nil, errors.New("invalid message format")
+	}
+	return img, nil
+}
+
 func FromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 	var messages []api.Message
 	for _, msg := range r.Messages {
@@ -405,24 +742,25 @@ func FromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 							return nil, errors.New("invalid message format")
 						}
 					}
-					types := []string{"jpeg", "jpg", "png"}
-					valid := false
-					for _, t := range types {
-						prefix := "data:image/" + t + ";base64,"
-						if strings.HasPrefix(url, prefix) {
-							url = strings.TrimPrefix(url, prefix)
-							valid = true
-							break
-						}
+					img, err := decodeImageURL(url)
+					if err != nil {
+						return nil, err
 					}
-					if !valid {
-						return nil, errors.New("invalid image input")
+					messages = append(messages, api.Message{Role: msg.Role, Images: []api.ImageData{img}})
+				case "input_audio":
+					input, ok := data["input_audio"].(map[string]any)
+					if !ok {
+						return nil, errors.New("invalid message format")
 					}
-					img, err := base64.StdEncoding.DecodeString(url)
-					if err != nil {
+					encoded, ok := input["data"].(string)
+					if !ok {
 						return nil, errors.New("invalid message format")
 					}
-					messages = append(messages, api.Message{Role: msg.Role, Images: []api.ImageData{img}})
+					audio, err := base64.StdEncoding.DecodeString(encoded)
+					if err != nil {
+						return nil, errors.New("invalid audio input")
+					}
+					messages = append(messages, api.Message{Role: msg.Role, Audio: []api.AudioData{audio}})
 				default:
 					return nil, errors.New("invalid message format")
 				}
@@ -477,6 +815,10 @@ func FromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 	} else {
 		options["top_p"] = 1.0
 	}
+
+	if len(r.LogitBias) > 0 {
+		options["logit_bias"] = r.LogitBias
+	}
 	var format json.RawMessage
 	if r.ResponseFormat != nil {
 		switch strings.ToLower(strings.TrimSpace(r.ResponseFormat.Type)) {
@@ -489,12 +831,16 @@ func FromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 		}
 	}
 	return &api.ChatRequest{
-		Model:    r.Model,
-		Messages: messages,
-		Format:   format,
-		Options:  options,
-		Stream:   &r.Stream,
-		Tools:    r.Tools,
+		Model:       r.Model,
+		Messages:    messages,
+		Format:      format,
+		Options:     options,
+		Stream:      &r.Stream,
+		Tools:       r.Tools,
+		Logprobs:    r.Logprobs,
+		TopLogprobs: r.TopLogprobs,
+
+		ParallelToolCalls: r.ParallelToolCalls,
 	}, nil
 }
 
@@ -532,6 +878,10 @@ func FromCompleteRequest(r CompletionRequest) (api.GenerateRequest, error) {
 	} else {
 		options["top_p"] = 1.0
 	}
+
+	if len(r.LogitBias) > 0 {
+		options["logit_bias"] = r.LogitBias
+	}
 	var prompt string
 	var context []int
 	switch p := r.Prompt.(type) {
@@ -590,12 +940,20 @@ func FromCompleteRequest(r CompletionRequest) (api.GenerateRequest, error) {
 	default:
 		return api.GenerateRequest{}, fmt.Errorf("invalid type for 'prompt' field: %T", r.Prompt)
 	}
-	return api.GenerateRequest{
+	req := api.GenerateRequest{
 		Model:   r.Model,
 		Prompt:  prompt,
 		Context: context,
 		Options: options,
 		Stream:  &r.Stream,
 		Suffix:  r.Suffix,
-	}, nil
+	}
+
+	// logprobs is the number of alternatives to return with each token
+	if r.Logprobs != nil {
+		req.Logprobs = true
+		req.TopLogprobs = *r.Logprobs
+	}
+
+	return req, nil
 }
@@ -1,6 +1,10 @@
 package types
 
 import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -76,3 +80,160 @@ func TestFromCompleteRequestPromptTypes(t *testing.T) {
 		})
 	}
 }
+
+func TestToCompletionLogprobs(t *testing.T) {
+	logprobs := []api.Logprob{
+		{
+			TokenLogprob: api.TokenLogprob{Token: "Hello", Logprob: -0.5},
+			TopLogprobs:  []api.TokenLogprob{{Token: "Hello", Logprob: -0.5}, {Token: "Hi", Logprob: -1.5}},
+		},
+		{
+			TokenLogprob: api.TokenLogprob{Token: "!", Logprob: -0.25},
+		},
+	}
+
+	got := ToCompletion("id", api.GenerateResponse{Response: "Hello!", Logprobs: logprobs}).Choices[0].Logprobs
+	if diff := cmp.Diff(got, &CompletionLogprobs{
+		Tokens:        []string{"Hello", "!"},
+		TokenLogprobs: []float64{-0.5, -0.25},
+		TopLogprobs:   []map[string]float64{{"Hello": -0.5, "Hi": -1.5}, {}},
+	}); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	chat := ToChatCompletion("id", api.ChatResponse{Message: api.Message{Role: "assistant", Content: "Hello!"}, Logprobs: logprobs})
+	if diff := cmp.Diff(chat.Choices[0].Logprobs, &ChoiceLogprobs{Content: logprobs}); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	if got := ToCompletion("id", api.GenerateResponse{Response: "Hello!"}).Choices[0].Logprobs; got != nil {
+		t.Errorf("expected no logprobs, got %v", got)
+	}
+}
+
+func TestToChunkToolCalls(t *testing.T) {
+	var calls ToolCallStream
+	chunk := func(m api.Message) []ToolCall {
+		return ToChunk("id", api.ChatResponse{Message: m}, &calls).Choices[0].Delta.ToolCalls
+	}
+
+	first := chunk(api.Message{ToolCallDeltas: []api.ToolCallDelta{
+		{Index: 0, Name: "get_weather"},
+		{Index: 0, Arguments: `{"location": "Sea`},
+	}})
+	if len(first) != 1 || first[0].ID == "" || first[0].Type != "function" || first[0].Function.Name != "get_weather" || first[0].Function.Arguments != `{"location": "Sea` {
+		t.Fatalf("unexpected first tool call chunk %+v", first)
+	}
+
+	// the rest of a call only adds to its arguments, and once it's
+	// complete it isn't sent again
+	rest := chunk(api.Message{
+		ToolCallDeltas: []api.ToolCallDelta{{Index: 0, Arguments: `ttle"}`}},
+		ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{
+			Name:      "get_weather",
+			Arguments: api.ToolCallFunctionArguments{"location": "Seattle"},
+		}}},
+	})
+
+	want := ToolCall{Index: 0}
+	want.Function.Arguments = `ttle"}`
+	if diff := cmp.Diff(rest, []ToolCall{want}); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	// calls that weren't streamed are sent whole
+	whole := chunk(api.Message{ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{
+		Index:     1,
+		Name:      "get_weather",
+		Arguments: api.ToolCallFunctionArguments{"location": "Paris"},
+	}}}})
+	if len(whole) != 1 || whole[0].Index != 1 || whole[0].ID == "" || whole[0].Function.Arguments != `{"location":"Paris"}` {
+		t.Errorf("unexpected tool call chunk %+v", whole)
+	}
+
+	if reason := ToChunk("id", api.ChatResponse{DoneReason: "stop"}, &calls).Choices[0].FinishReason; reason == nil || *reason != FinishReasonToolCalls {
+		t.Errorf("expected finish reason %q, got %v", FinishReasonToolCalls, reason)
+	}
+}
+
+func TestToEmbeddingListEncodingFormat(t *testing.T) {
+	r := api.EmbedResponse{Embeddings: [][]float32{{1, -0.5}, {0.25}}, PromptEvalCount: 3}
+
+	b, err := json.Marshal(ToEmbeddingList("test", r, "base64"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got struct {
+		Data []struct {
+			Embedding string `json:"embedding"`
+			Index     int    `json:"index"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got.Data) != len(r.Embeddings) {
+		t.Fatalf("expected %d embeddings, got %d", len(r.Embeddings), len(got.Data))
+	}
+
+	for i, d := range got.Data {
+		if d.Index != i {
+			t.Errorf("embedding %d has index %d", i, d.Index)
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(d.Embedding)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var e []float32
+		for j := 0; j < len(raw); j += 4 {
+			e = append(e, math.Float32frombits(binary.LittleEndian.Uint32(raw[j:])))
+		}
+
+		if diff := cmp.Diff(r.Embeddings[i], e); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	}
+
+	b, err = json.Marshal(ToEmbeddingList("test", r, "float"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var list EmbeddingList
+	if err := json.Unmarshal(b, &list); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(r.Embeddings[0], list.Data[0].Embedding); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRerank(t *testing.T) {
+	var req RerankRequest
+	if err := json.Unmarshal([]byte(`{"model": "test", "query": "goobla", "documents": ["a llama", {"text": "goobla runs models"}], "top_n": 1, "return_documents": true}`), &req); err != nil {
+		t.Fatal(err)
+	}
+
+	want := api.RerankRequest{Model: "test", Query: "goobla", Documents: []string{"a llama", "goobla runs models"}, TopN: 1, ReturnDocuments: true}
+	if diff := cmp.Diff(want, FromRerankRequest(req)); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	b, err := json.Marshal(ToRerankResponse("test", api.RerankResponse{
+		Results:         []api.RerankResult{{Index: 1, Document: "goobla runs models", RelevanceScore: 0.9}, {Index: 0, RelevanceScore: 0.1}},
+		PromptEvalCount: 12,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const wantJSON = `{"model":"test","object":"list","results":[{"index":1,"relevance_score":0.9,"document":{"text":"goobla runs models"}},{"index":0,"relevance_score":0.1}],"usage":{"prompt_tokens":12,"total_tokens":12}}`
+	if string(b) != wantJSON {
+		t.Errorf("got %s, want %s", b, wantJSON)
+	}
+}
@@ -19,7 +19,16 @@ type ChatWriter struct {
 	Stream        bool
 	StreamOptions *opentypes.StreamOptions
 	ID            string
-	ToolCallSent  bool
+	ToolCalls     opentypes.ToolCallStream
+	BaseWriter
+}
+
+// ResponsesWriter writes chat responses as responses of the Responses API,
+// streaming them as events.
+type ResponsesWriter struct {
+	Stream    bool
+	ID        string
+	Responses *opentypes.ResponseStream
 	BaseWriter
 }
 
@@ -40,10 +49,21 @@ type RetrieveWriter struct {
 }
 
 type EmbedWriter struct {
+	BaseWriter
+	Model          string
+	EncodingFormat string
+}
+
+type RerankWriter struct {
 	BaseWriter
 	Model string
 }
 
+type TranscriptionWriter struct {
+	BaseWriter
+	ResponseFormat string
+}
+
 func (w *BaseWriter) writeError(data []byte) (int, error) {
 	var serr api.StatusError
 	if err := json.Unmarshal(data, &serr); err != nil {
@@ -62,14 +82,11 @@ func (w *ChatWriter) writeResponse(data []byte) (int, error) {
 		return 0, err
 	}
 	if w.Stream {
-		c := opentypes.ToChunk(w.ID, r, w.ToolCallSent)
+		c := opentypes.ToChunk(w.ID, r, &w.ToolCalls)
 		d, err := json.Marshal(c)
 		if err != nil {
 			return 0, err
 		}
-		if !w.ToolCallSent && len(c.Choices) > 0 && len(c.Choices[0].Delta.ToolCalls) > 0 {
-			w.ToolCallSent = true
-		}
 		w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
 		if _, err = w.ResponseWriter.Write([]byte(fmt.Sprintf("data: %s\n\n", d))); err != nil {
 			return 0, err
@@ -107,6 +124,38 @@ func (w *ChatWriter) Write(data []byte) (int, error) {
 	return w.writeResponse(data)
 }
 
+func (w *ResponsesWriter) writeResponse(data []byte) (int, error) {
+	var r api.ChatResponse
+	if err := json.Unmarshal(data, &r); err != nil {
+		return 0, err
+	}
+	if w.Stream {
+		w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
+		for _, e := range w.Responses.Events(r) {
+			d, err := json.Marshal(e)
+			if err != nil {
+				return 0, err
+			}
+			if _, err = w.ResponseWriter.Write([]byte(fmt.Sprintf("event: %s\ndata: %s\n\n", e.Type, d))); err != nil {
+				return 0, err
+			}
+		}
+		return len(data), nil
+	}
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w.ResponseWriter).Encode(opentypes.ToResponse(w.ID, r)); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (w *ResponsesWriter) Write(data []byte) (int, error) {
+	if w.ResponseWriter.Status() != http.StatusOK {
+		return w.writeError(data)
+	}
+	return w.writeResponse(data)
+}
+
 func (w *CompleteWriter) writeResponse(data []byte) (int, error) {
 	var r api.GenerateResponse
 	if err := json.Unmarshal(data, &r); err != nil {
@@ -202,7 +251,7 @@ func (w *EmbedWriter) writeResponse(data []byte) (int, error) {
 		return 0, err
 	}
 	w.ResponseWriter.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w.ResponseWriter).Encode(opentypes.ToEmbeddingList(w.Model, r)); err != nil {
+	if err := json.NewEncoder(w.ResponseWriter).Encode(opentypes.ToEmbeddingList(w.Model, r, w.EncodingFormat)); err != nil {
 		return 0, err
 	}
 	return len(data), nil
@@ -214,3 +263,49 @@ func (w *EmbedWriter) Write(data []byte) (int, error) {
 	}
 	return w.writeResponse(data)
 }
+
+func (w *RerankWriter) writeResponse(data []byte) (int, error) {
+	var r api.RerankResponse
+	if err := json.Unmarshal(data, &r); err != nil {
+		return 0, err
+	}
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w.ResponseWriter).Encode(opentypes.ToRerankResponse(w.Model, r)); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (w *RerankWriter) Write(data []byte) (int, error) {
+	if w.ResponseWriter.Status() != http.StatusOK {
+		return w.writeError(data)
+	}
+	return w.writeResponse(data)
+}
+
+func (w *TranscriptionWriter) writeResponse(data []byte) (int, error) {
+	var r api.ChatResponse
+	if err := json.Unmarshal(data, &r); err != nil {
+		return 0, err
+	}
+	t := opentypes.ToTranscription(r)
+	if w.ResponseFormat == "text" {
+		w.ResponseWriter.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if _, err := w.ResponseWriter.Write([]byte(t.Text + "\n")); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w.ResponseWriter).Encode(t); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (w *TranscriptionWriter) Write(data []byte) (int, error) {
+	if w.ResponseWriter.Status() != http.StatusOK {
+		return w.writeError(data)
+	}
+	return w.writeResponse(data)
+}
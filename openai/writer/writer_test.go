@@ -190,7 +190,7 @@ func TestEmbedWriter(t *testing.T) {
 	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
 		t.Fatal(err)
 	}
-	want := opentypes.ToEmbeddingList("test-model", resp)
+	want := opentypes.ToEmbeddingList("test-model", resp, "")
 	if !reflect.DeepEqual(got, want) {
 		t.Fatalf("unexpected response: %#v", got)
 	}
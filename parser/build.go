@@ -0,0 +1,248 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// A Modelfile can be parameterized with directives that [Modelfile.Build]
+// evaluates before it's used:
+//
+//	ARG NAME=default  declares the variable NAME, which BuildOptions.Args sets
+//	INCLUDE path      includes the commands of another Modelfile
+//	IF NAME == value  keeps the commands up to ELSE or ENDIF if NAME is value,
+//	ELSE              or isn't with !=, or isn't empty without a comparison,
+//	ENDIF             and the commands from ELSE to ENDIF otherwise
+//
+// ${NAME} in the value of a command is replaced with the variable NAME once
+// it's declared, and left as is otherwise. The variables QUANTIZE, the
+// quantization the model is created with, and ARCH, the architecture of the
+// machine creating it such as amd64 or arm64, are always declared. Values are
+// compared ignoring case.
+
+var (
+	variableNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	variableRegexp     = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+)
+
+// BuildOptions are the options of [Modelfile.Build].
+type BuildOptions struct {
+	// Dir is the directory of the Modelfile, which the paths of its INCLUDE
+	// directives are relative to.
+	Dir string
+
+	// Args are the values of variables declared with ARG, in place of their
+	// defaults.
+	Args map[string]string
+
+	// Quantize is the quantization the model is created with.
+	Quantize string
+}
+
+// Build returns f with its ARG, INCLUDE and IF directives evaluated and the
+// variables in the values of its commands replaced.
+func (f Modelfile) Build(opts BuildOptions) (*Modelfile, error) {
+	b := builder{
+		opts: opts,
+		vars: map[string]string{
+			"QUANTIZE": opts.Quantize,
+			"ARCH":     runtime.GOARCH,
+		},
+	}
+
+	var built Modelfile
+	if err := b.build(&built, f.Commands, opts.Dir, nil); err != nil {
+		return nil, err
+	}
+
+	if !slices.ContainsFunc(built.Commands, func(c Command) bool { return c.Name == "model" }) {
+		return nil, errMissingFrom
+	}
+
+	return &built, nil
+}
+
+type builder struct {
+	opts BuildOptions
+	vars map[string]string
+}
+
+// condition is an IF directive being evaluated.
+type condition struct {
+	value bool
+	// inElse is whether its ELSE has been reached
+	inElse bool
+}
+
+// build appends the commands cmds of the Modelfile in dir to f. included are
+// the Modelfiles that included it.
+func (b *builder) build(f *Modelfile, cmds []Command, dir string, included []string) error {
+	var conditions []condition
+	active := func(conditions []condition) bool {
+		return !slices.ContainsFunc(conditions, func(c condition) bool { return !c.value })
+	}
+
+	for _, c := range cmds {
+		switch c.Name {
+		case "if":
+			var value bool
+			if active(conditions) {
+				var err error
+				if value, err = b.eval(b.expand(c.Args)); err != nil {
+					return err
+				}
+			}
+			conditions = append(conditions, condition{value: value})
+		case "else":
+			if len(conditions) == 0 {
+				return errors.New("ELSE without IF")
+			}
+
+			last := &conditions[len(conditions)-1]
+			if last.inElse {
+				return errors.New("ELSE after ELSE")
+			}
+
+			last.inElse = true
+			// the ELSE of an IF inside an inactive block isn't active either
+			last.value = !last.value && active(conditions[:len(conditions)-1])
+		case "endif":
+			if len(conditions) == 0 {
+				return errors.New("ENDIF without IF")
+			}
+			conditions = conditions[:len(conditions)-1]
+		default:
+			if !active(conditions) {
+				continue
+			}
+
+			switch c.Name {
+			case "arg":
+				if err := b.declare(c.Args); err != nil {
+					return err
+				}
+			case "include":
+				if err := b.include(f, b.expand(c.Args), dir, included); err != nil {
+					return err
+				}
+			default:
+				c.Args = b.expand(c.Args)
+				if (c.Name == "model" || c.Name == "adapter") && dir != b.opts.Dir {
+					c.Args = includedPath(c.Args, dir)
+				}
+				f.Commands = append(f.Commands, c)
+			}
+		}
+	}
+
+	if len(conditions) > 0 {
+		return errors.New("IF without ENDIF")
+	}
+
+	return nil
+}
+
+// declare declares the variable of the ARG directive args, NAME or
+// NAME=default.
+func (b *builder) declare(args string) error {
+	name, value, _ := strings.Cut(args, "=")
+	name = strings.TrimSpace(name)
+	if !variableNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid ARG name %q", name)
+	}
+
+	if v, ok := b.opts.Args[name]; ok {
+		value = v
+	} else {
+		value, _ = unquote(strings.TrimSpace(b.expand(value)))
+	}
+
+	b.vars[name] = value
+	return nil
+}
+
+// include appends the commands of the Modelfile at path, relative to dir, to
+// f.
+func (b *builder) include(f *Modelfile, path, dir string, included []string) error {
+	path, err := expandPath(path, dir)
+	if err != nil {
+		return err
+	}
+
+	if slices.Contains(included, path) {
+		return fmt.Errorf("%s includes itself", path)
+	}
+
+	r, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	inc, err := parseFile(r)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	if err := b.build(f, inc.Commands, filepath.Dir(path), append(included, path)); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
+// eval evaluates the condition of the IF directive args, NAME, NAME == value
+// or NAME != value.
+func (b *builder) eval(args string) (bool, error) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return false, errors.New("IF requires a condition")
+	}
+
+	value, ok := b.vars[fields[0]]
+	if !ok {
+		return false, fmt.Errorf("undefined variable %q", fields[0])
+	}
+
+	switch {
+	case len(fields) == 1:
+		return value != "", nil
+	case len(fields) == 3 && fields[1] == "==":
+		return strings.EqualFold(value, fields[2]), nil
+	case len(fields) == 3 && fields[1] == "!=":
+		return !strings.EqualFold(value, fields[2]), nil
+	default:
+		return false, fmt.Errorf("invalid condition %q", args)
+	}
+}
+
+// expand replaces the declared variables in s.
+func (b *builder) expand(s string) string {
+	return variableRegexp.ReplaceAllStringFunc(s, func(ref string) string {
+		if v, ok := b.vars[ref[2:len(ref)-1]]; ok {
+			return v
+		}
+		return ref
+	})
+}
+
+// includedPath returns the path of the model or adapter path of a Modelfile
+// in dir, made absolute if it's a file relative to dir so it doesn't resolve
+// relative to the Modelfile that included it, or path if it's a model name.
+func includedPath(path, dir string) string {
+	p, err := expandPath(path, dir)
+	if err != nil {
+		return path
+	}
+
+	if _, err := os.Stat(p); err != nil {
+		return path
+	}
+	return p
+}
@@ -0,0 +1,217 @@
+package parser
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBuild(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+		opts  BuildOptions
+		want  []Command
+	}{
+		{
+			name: "arg",
+			input: `ARG MODEL=llama3.2
+ARG CTX="4096"
+FROM ${MODEL}
+PARAMETER num_ctx ${CTX}
+SYSTEM """You are ${NAME}"""`,
+			want: []Command{
+				{Name: "model", Args: "llama3.2"},
+				{Name: "num_ctx", Args: "4096"},
+				{Name: "system", Args: "You are ${NAME}"},
+			},
+		},
+		{
+			name: "arg override",
+			input: `ARG MODEL=llama3.2
+ARG SIZE
+FROM ${MODEL}:${SIZE}`,
+			opts: BuildOptions{Args: map[string]string{"MODEL": "qwen3", "SIZE": "8b"}},
+			want: []Command{{Name: "model", Args: "qwen3:8b"}},
+		},
+		{
+			name: "if",
+			input: `FROM llama3.2
+IF QUANTIZE == q4_K_M
+PARAMETER num_ctx 8192
+ELSE
+PARAMETER num_ctx 4096
+ENDIF`,
+			opts: BuildOptions{Quantize: "Q4_K_M"},
+			want: []Command{
+				{Name: "model", Args: "llama3.2"},
+				{Name: "num_ctx", Args: "8192"},
+			},
+		},
+		{
+			name: "else",
+			input: `FROM llama3.2
+IF QUANTIZE
+PARAMETER num_ctx 8192
+ELSE
+PARAMETER num_ctx 4096
+ENDIF`,
+			want: []Command{
+				{Name: "model", Args: "llama3.2"},
+				{Name: "num_ctx", Args: "4096"},
+			},
+		},
+		{
+			name: "nested",
+			input: `ARG GPU=cuda
+IF ARCH == ` + runtime.GOARCH + `
+IF GPU != cuda
+FROM cpu
+ELSE
+FROM gpu
+ENDIF
+ELSE
+IF GPU == cuda
+FROM other
+ENDIF
+ENDIF`,
+			want: []Command{{Name: "model", Args: "gpu"}},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := ParseFile(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			built, err := f.Build(tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.want, built.Commands); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	cases := map[string]string{
+		"ELSE without IF":   "FROM a\nELSE",
+		"ENDIF without IF":  "FROM a\nENDIF",
+		"ELSE after ELSE":   "FROM a\nIF ARCH\nELSE\nELSE\nENDIF",
+		"IF without ENDIF":  "FROM a\nIF ARCH",
+		"undefined":         "FROM a\nIF GPU == cuda\nENDIF",
+		"invalid condition": "FROM a\nIF ARCH = amd64\nENDIF",
+		"invalid ARG name":  "ARG 1=a\nFROM a",
+		"no FROM":           "ARG QUANTIZE\nIF QUANTIZE\nFROM a\nENDIF",
+	}
+
+	for name, input := range cases {
+		t.Run(name, func(t *testing.T) {
+			f, err := ParseFile(strings.NewReader(input))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := f.Build(BuildOptions{}); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestBuildInclude(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "base"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"base/Modelfile":  "FROM ./model.gguf\nPARAMETER temperature ${TEMP}",
+		"base/model.gguf": "",
+		"loop/a":          "INCLUDE b",
+		"loop/b":          "INCLUDE a",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := ParseFile(strings.NewReader("ARG TEMP=0.2\nINCLUDE ./base/Modelfile\nSYSTEM hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	built, err := f.Build(BuildOptions{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Command{
+		{Name: "model", Args: filepath.Join(dir, "base", "model.gguf")},
+		{Name: "temperature", Args: "0.2"},
+		{Name: "system", Args: "hi"},
+	}
+	if diff := cmp.Diff(want, built.Commands); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	f, err = ParseFile(strings.NewReader("FROM a\nINCLUDE loop/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Build(BuildOptions{Dir: dir}); err == nil || !strings.Contains(err.Error(), "includes itself") {
+		t.Errorf("expected an include cycle error, got %v", err)
+	}
+}
+
+func TestParseFileDirectives(t *testing.T) {
+	input := `ARG SIZE=8b
+INCLUDE base.Modelfile
+IF QUANTIZE == q8_0
+FROM a:${SIZE}
+ELSE
+FROM b
+ENDIF
+`
+
+	f, err := ParseFile(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Command{
+		{Name: "arg", Args: "SIZE=8b"},
+		{Name: "include", Args: "base.Modelfile"},
+		{Name: "if", Args: "QUANTIZE == q8_0"},
+		{Name: "model", Args: "a:${SIZE}"},
+		{Name: "else"},
+		{Name: "model", Args: "b"},
+		{Name: "endif"},
+	}
+	if diff := cmp.Diff(want, f.Commands); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	if got := f.String(); got != input {
+		t.Errorf("expected %q, got %q", input, got)
+	}
+
+	if _, err := f.CreateRequest(""); err == nil {
+		t.Error("expected directives to require Build")
+	}
+}
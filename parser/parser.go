@@ -93,16 +93,32 @@ func (f Modelfile) CreateRequest(relativeDir string) (*api.CreateRequest, error)
 				return nil, err
 			}
 
-			req.Adapters = digestMap
+			if req.Adapters == nil {
+				req.Adapters = digestMap
+			} else {
+				for k, v := range digestMap {
+					req.Adapters[k] = v
+				}
+			}
 		case "template":
 			req.Template = c.Args
 		case "system":
 			req.System = c.Args
+		case "draft":
+			req.Draft = c.Args
+		case "locked":
+			locked, err := strconv.ParseBool(c.Args)
+			if err != nil {
+				return nil, fmt.Errorf("LOCKED must be true or false, got %q", c.Args)
+			}
+			req.Locked = locked
 		case "license":
 			licenses = append(licenses, c.Args)
 		case "message":
 			role, msg, _ := strings.Cut(c.Args, ": ")
 			messages = append(messages, api.Message{Role: role, Content: msg})
+		case "arg", "include", "if", "else", "endif":
+			return nil, fmt.Errorf("%s must be evaluated with Build", strings.ToUpper(c.Name))
 		default:
 			if slices.Contains(deprecatedParameters, c.Name) {
 				fmt.Printf("warning: parameter %s is deprecated\n", c.Name)
@@ -338,9 +354,19 @@ func (c Command) String() string {
 		fmt.Fprintf(&sb, "FROM %s", c.Args)
 	case "license", "template", "system", "adapter":
 		fmt.Fprintf(&sb, "%s %s", strings.ToUpper(c.Name), quote(c.Args))
+	case "draft":
+		fmt.Fprintf(&sb, "DRAFT %s", c.Args)
+	case "locked":
+		fmt.Fprintf(&sb, "LOCKED %s", c.Args)
+	case "device":
+		fmt.Fprintf(&sb, "DEVICE %s", c.Args)
 	case "message":
 		role, message, _ := strings.Cut(c.Args, ": ")
 		fmt.Fprintf(&sb, "MESSAGE %s %s", role, quote(message))
+	case "arg", "include", "if":
+		fmt.Fprintf(&sb, "%s %s", strings.ToUpper(c.Name), c.Args)
+	case "else", "endif":
+		sb.WriteString(strings.ToUpper(c.Name))
 	default:
 		fmt.Fprintf(&sb, "PARAMETER %s %s", c.Name, quote(c.Args))
 	}
@@ -362,7 +388,7 @@ const (
 var (
 	errMissingFrom        = errors.New("no FROM line")
 	errInvalidMessageRole = errors.New("message role must be one of \"system\", \"user\", or \"assistant\"")
-	errInvalidCommand     = errors.New("command must be one of \"from\", \"license\", \"template\", \"system\", \"adapter\", \"parameter\", or \"message\"")
+	errInvalidCommand     = errors.New("command must be one of \"from\", \"license\", \"template\", \"system\", \"adapter\", \"draft\", \"locked\", \"device\", \"parameter\", \"message\", \"arg\", \"include\", \"if\", \"else\", or \"endif\"")
 )
 
 type ParserError struct {
@@ -377,7 +403,25 @@ func (e *ParserError) Error() string {
 	return e.Msg
 }
 
+// ParseFile parses the Modelfile r. Its ARG, INCLUDE and IF directives are
+// kept as commands for [Modelfile.Build] to evaluate.
 func ParseFile(r io.Reader) (*Modelfile, error) {
+	f, err := parseFile(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// the FROM line may be in an included file
+	for _, cmd := range f.Commands {
+		if cmd.Name == "model" || cmd.Name == "include" {
+			return f, nil
+		}
+	}
+
+	return nil, errMissingFrom
+}
+
+func parseFile(r io.Reader) (*Modelfile, error) {
 	var cmd Command
 	var curr state
 	var currLine int = 1
@@ -422,6 +466,19 @@ func ParseFile(r io.Reader) (*Modelfile, error) {
 					}
 				}
 
+				// a command without a value ends at the end of the line
+				if next == stateNil {
+					if !isBareCommand(b.String()) {
+						return nil, &ParserError{
+							LineNumber: currLine,
+							Msg:        errInvalidCommand.Error(),
+						}
+					}
+
+					f.Commands = append(f.Commands, Command{Name: strings.ToLower(b.String())})
+					break
+				}
+
 				// next state sometimes depends on the current buffer value
 				switch s := strings.ToLower(b.String()); s {
 				case "from":
@@ -483,6 +540,12 @@ func ParseFile(r io.Reader) (*Modelfile, error) {
 	switch curr {
 	case stateComment, stateNil:
 		// pass; nothing to flush
+	case stateName:
+		if !isBareCommand(b.String()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		f.Commands = append(f.Commands, Command{Name: strings.ToLower(b.String())})
 	case stateValue:
 		s, ok := unquote(strings.TrimSpace(b.String()))
 		if !ok {
@@ -499,13 +562,7 @@ func ParseFile(r io.Reader) (*Modelfile, error) {
 		return nil, io.ErrUnexpectedEOF
 	}
 
-	for _, cmd := range f.Commands {
-		if cmd.Name == "model" {
-			return &f, nil
-		}
-	}
-
-	return nil, errMissingFrom
+	return &f, nil
 }
 
 func parseRuneForState(r rune, cs state) (state, rune, error) {
@@ -525,6 +582,8 @@ func parseRuneForState(r rune, cs state) (state, rune, error) {
 			return stateName, r, nil
 		case isSpace(r):
 			return stateValue, 0, nil
+		case isNewline(r):
+			return stateNil, 0, nil
 		default:
 			return stateNil, 0, errInvalidCommand
 		}
@@ -629,7 +688,18 @@ func isValidMessageRole(role string) bool {
 
 func isValidCommand(cmd string) bool {
 	switch strings.ToLower(cmd) {
-	case "from", "license", "template", "system", "adapter", "parameter", "message":
+	case "from", "license", "template", "system", "adapter", "draft", "locked", "device", "parameter", "message",
+		"arg", "include", "if", "else", "endif":
+		return true
+	default:
+		return false
+	}
+}
+
+// isBareCommand reports whether cmd is a command without a value.
+func isBareCommand(cmd string) bool {
+	switch strings.ToLower(cmd) {
+	case "else", "endif":
 		return true
 	default:
 		return false
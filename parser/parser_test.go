@@ -479,6 +479,8 @@ func TestParseFileParameters(t *testing.T) {
 		"num_gqa 1":                    {"num_gqa", "1"},
 		"num_gpu 1":                    {"num_gpu", "1"},
 		"main_gpu 1":                   {"main_gpu", "1"},
+		"tensor_split 3,1":             {"tensor_split", "3,1"},
+		"kv_cache_type q8_0":           {"kv_cache_type", "q8_0"},
 		"use_mmap true":                {"use_mmap", "true"},
 		"num_thread 1":                 {"num_thread", "1"},
 		"num_keep 1":                   {"num_keep", "1"},
@@ -488,6 +490,20 @@ func TestParseFileParameters(t *testing.T) {
 		"top_p 1.0":                    {"top_p", "1.0"},
 		"min_p 0.05":                   {"min_p", "0.05"},
 		"typical_p 1.0":                {"typical_p", "1.0"},
+		"dynatemp_range 0.5":           {"dynatemp_range", "0.5"},
+		"dynatemp_exponent 1.0":        {"dynatemp_exponent", "1.0"},
+		"mirostat 2":                   {"mirostat", "2"},
+		"mirostat_tau 5.0":             {"mirostat_tau", "5.0"},
+		"mirostat_eta 0.1":             {"mirostat_eta", "0.1"},
+		"dry_multiplier 0.8":           {"dry_multiplier", "0.8"},
+		"dry_base 1.75":                {"dry_base", "1.75"},
+		"dry_allowed_length 2":         {"dry_allowed_length", "2"},
+		"dry_penalty_last_n 512":       {"dry_penalty_last_n", "512"},
+		"dry_sequence_breakers :":      {"dry_sequence_breakers", ":"},
+		"samplers top_k":               {"samplers", "top_k"},
+		"deterministic true":           {"deterministic", "true"},
+		"num_beams 4":                  {"num_beams", "4"},
+		"length_penalty 1.0":           {"length_penalty", "1.0"},
 		"repeat_last_n 1":              {"repeat_last_n", "1"},
 		"temperature 1.0":              {"temperature", "1.0"},
 		"repeat_penalty 1.0":           {"repeat_penalty", "1.0"},
@@ -727,6 +743,26 @@ MESSAGE assistant Hi! How are you?
 				},
 			},
 		},
+		{
+			`FROM test
+DEVICE cuda:1
+`,
+			&api.CreateRequest{
+				From:       "test",
+				Parameters: map[string]any{"device": "cuda:1"},
+			},
+		},
+		{
+			`FROM test
+SYSTEM Only answer questions about cooking.
+LOCKED true
+`,
+			&api.CreateRequest{
+				From:   "test",
+				System: "Only answer questions about cooking.",
+				Locked: true,
+			},
+		},
 	}
 
 	for _, c := range cases {
@@ -751,6 +787,26 @@ MESSAGE assistant Hi! How are you?
 	}
 }
 
+func TestCreateRequestLocked(t *testing.T) {
+	p, err := ParseFile(strings.NewReader("FROM test\nLOCKED yes\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.CreateRequest(""); err == nil {
+		t.Error("expected an error for an invalid LOCKED value")
+	}
+
+	p, err = ParseFile(strings.NewReader("FROM test\nLOCKED true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := p.String(); s != "FROM test\nLOCKED true\n" {
+		t.Errorf("unexpected modelfile %q", s)
+	}
+}
+
 func getSHA256Digest(t *testing.T, r io.Reader) (string, int64) {
 	t.Helper()
 
@@ -801,6 +857,10 @@ func TestCreateRequestFiles(t *testing.T) {
 			fmt.Sprintf("FROM %s\nFROM %s", n1, n2),
 			&api.CreateRequest{Files: map[string]string{n1: d1, n2: d2}},
 		},
+		{
+			fmt.Sprintf("FROM %s\nADAPTER %s\nADAPTER %s", n1, n1, n2),
+			&api.CreateRequest{Files: map[string]string{n1: d1}, Adapters: map[string]string{n1: d1, n2: d2}},
+		},
 	}
 
 	for _, c := range cases {
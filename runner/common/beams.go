@@ -0,0 +1,133 @@
+package common
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"strings"
+)
+
+// Beam is a hypothesis of beam search: the tokens generated so far and the
+// sum of their log probabilities.
+type Beam struct {
+	Tokens  []int
+	Logprob float64
+}
+
+// Text returns the text of the beam's tokens up to the first of the stop
+// sequences, and whether one was found. piece returns the text of a token.
+func (b Beam) Text(stop []string, piece func(int) string) (string, bool) {
+	pieces := make([]string, len(b.Tokens))
+	for i, token := range b.Tokens {
+		pieces[i] = piece(token)
+	}
+
+	found, s := FindStop(strings.Join(pieces, ""), stop)
+	if found {
+		pieces, _ = TruncateStop(pieces, s)
+	}
+
+	return strings.Join(pieces, ""), found
+}
+
+// BeamSearch decodes the most likely response instead of sampling one, by
+// keeping the Width most likely hypotheses at each step. Finished hypotheses
+// are ranked by their log probability divided by their length to the power
+// of LengthPenalty, so higher values favor longer responses.
+type BeamSearch struct {
+	Width         int
+	LengthPenalty float32
+
+	// Beams are the hypotheses that are still generating, in descending
+	// order of log probability
+	Beams []Beam
+
+	finished []Beam
+}
+
+// NewBeamSearch returns a beam search starting from a single empty beam.
+func NewBeamSearch(width int, lengthPenalty float32) *BeamSearch {
+	return &BeamSearch{
+		Width:         width,
+		LengthPenalty: lengthPenalty,
+		Beams:         []Beam{{}},
+	}
+}
+
+func (bs *BeamSearch) score(b Beam) float64 {
+	return b.Logprob / math.Pow(float64(max(len(b.Tokens), 1)), float64(bs.LengthPenalty))
+}
+
+// Step extends the beams with their most likely next tokens, given the
+// logits of the next token for each of them. A hypothesis finishes at a token
+// for which end returns true, without it. Step returns the index of the beam
+// each of the new beams continues.
+func (bs *BeamSearch) Step(logits [][]float32, end func(int) bool) []int {
+	type candidate struct {
+		parent, token int
+		logprob       float64
+	}
+
+	// each beam is extended with its 2*Width most likely tokens, so
+	// there are still Width to continue if all of the others end
+	var candidates []candidate
+	for i, beam := range bs.Beams {
+		norm := logNorm(logits[i])
+		for _, token := range topTokens(logits[i], 2*bs.Width) {
+			candidates = append(candidates, candidate{
+				parent:  i,
+				token:   token,
+				logprob: beam.Logprob + float64(logits[i][token]) - norm,
+			})
+		}
+	}
+
+	slices.SortStableFunc(candidates, func(a, b candidate) int {
+		return cmp.Compare(b.logprob, a.logprob)
+	})
+
+	var beams []Beam
+	var parents []int
+	for rank, c := range candidates {
+		if len(beams) == bs.Width {
+			break
+		}
+
+		tokens := bs.Beams[c.parent].Tokens
+		if end(c.token) {
+			// only hypotheses among the most likely can finish
+			if rank < bs.Width {
+				bs.finished = append(bs.finished, Beam{Tokens: slices.Clone(tokens), Logprob: c.logprob})
+			}
+			continue
+		}
+
+		beams = append(beams, Beam{Tokens: append(slices.Clone(tokens), c.token), Logprob: c.logprob})
+		parents = append(parents, c.parent)
+	}
+
+	bs.Beams = beams
+	return parents
+}
+
+// Done reports whether Width hypotheses have finished, or none of them are
+// still generating.
+func (bs *BeamSearch) Done() bool {
+	return len(bs.finished) >= bs.Width || len(bs.Beams) == 0
+}
+
+// Best returns the best finished hypothesis and true, or if none have
+// finished, such as when the search is stopped at a length limit, the most
+// likely beam and false.
+func (bs *BeamSearch) Best() (Beam, bool) {
+	if len(bs.finished) == 0 {
+		if len(bs.Beams) == 0 {
+			return Beam{}, false
+		}
+		return bs.Beams[0], false
+	}
+
+	return slices.MaxFunc(bs.finished, func(a, b Beam) int {
+		return cmp.Compare(bs.score(a), bs.score(b))
+	}), true
+}
@@ -0,0 +1,109 @@
+package common
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestBeamSearch(t *testing.T) {
+	const end = 2
+
+	// the most likely first token leads to unlikely continuations, so
+	// greedy decoding would miss the more likely response [1]
+	probs := map[string][]float64{
+		"[]":    {0.5, 0.4, 0.1},
+		"[0]":   {0.34, 0.33, 0.33},
+		"[1]":   {0.05, 0.05, 0.9},
+		"[0 0]": {0.2, 0.2, 0.6},
+		"[0 1]": {0.2, 0.2, 0.6},
+	}
+
+	logits := func(tokens []int) []float32 {
+		p, ok := probs[fmt.Sprint(tokens)]
+		if !ok {
+			t.Fatalf("unexpected beam %v", tokens)
+		}
+
+		l := make([]float32, len(p))
+		for i := range p {
+			l[i] = float32(math.Log(p[i]))
+		}
+		return l
+	}
+
+	bs := NewBeamSearch(2, 1)
+	var steps int
+	for !bs.Done() {
+		var l [][]float32
+		for _, b := range bs.Beams {
+			l = append(l, logits(b.Tokens))
+		}
+
+		prev := bs.Beams
+		parents := bs.Step(l, func(token int) bool { return token == end })
+		if len(parents) != len(bs.Beams) {
+			t.Fatalf("got %d parents for %d beams", len(parents), len(bs.Beams))
+		}
+
+		for i, b := range bs.Beams {
+			if len(b.Tokens) != steps+1 {
+				t.Fatalf("beam %v has %d tokens after step %d", b.Tokens, len(b.Tokens), steps)
+			}
+
+			if !slices.Equal(b.Tokens[:steps], prev[parents[i]].Tokens) {
+				t.Fatalf("beam %v doesn't continue its parent %v", b.Tokens, prev[parents[i]].Tokens)
+			}
+		}
+
+		steps++
+		if steps > 3 {
+			t.Fatal("search didn't finish")
+		}
+	}
+
+	best, finished := bs.Best()
+	if !finished {
+		t.Error("expected a finished hypothesis")
+	}
+
+	if !slices.Equal(best.Tokens, []int{1}) {
+		t.Errorf("best = %v, want [1]", best.Tokens)
+	}
+
+	if want := math.Log(0.4 * 0.9); math.Abs(best.Logprob-want) > 1e-6 {
+		t.Errorf("logprob = %f, want %f", best.Logprob, want)
+	}
+}
+
+func TestBeamSearchLengthPenalty(t *testing.T) {
+	bs := NewBeamSearch(2, 1)
+	bs.finished = []Beam{
+		{Tokens: []int{1}, Logprob: -2},
+		{Tokens: []int{1, 1, 1, 1}, Logprob: -4},
+	}
+
+	if best, _ := bs.Best(); len(best.Tokens) != 4 {
+		t.Errorf("expected the longer hypothesis, got %v", best.Tokens)
+	}
+
+	bs.LengthPenalty = 0
+	if best, _ := bs.Best(); len(best.Tokens) != 1 {
+		t.Errorf("expected the more likely hypothesis, got %v", best.Tokens)
+	}
+}
+
+func TestBeamText(t *testing.T) {
+	pieces := []string{"Hello", ",", " world", "!"}
+	piece := func(id int) string { return pieces[id] }
+
+	b := Beam{Tokens: []int{0, 1, 2, 3}}
+	if text, found := b.Text(nil, piece); text != "Hello, world!" || found {
+		t.Errorf("text = %q, %t", text, found)
+	}
+
+	if text, found := b.Text([]string{"wor"}, piece); text != "Hello, " || !found {
+		t.Errorf("text = %q, %t", text, found)
+	}
+}
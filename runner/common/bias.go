@@ -0,0 +1,45 @@
+package common
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// LogitBias returns the bias of each token in bias, which is keyed by token
+// ID or by text that tokenize splits into the tokens to bias. Biases for the
+// same token add up, and tokens with a bias of -100 or less are banned.
+func LogitBias(bias map[string]float32, numVocab int, tokenize func(string) ([]int, error)) (map[int]float32, error) {
+	if len(bias) == 0 {
+		return nil, nil
+	}
+
+	tokens := make(map[int]float32)
+	for k, v := range bias {
+		if id, err := strconv.Atoi(k); err == nil {
+			if id < 0 || id >= numVocab {
+				return nil, fmt.Errorf("logit_bias token %d is out of range", id)
+			}
+
+			tokens[id] += v
+			continue
+		}
+
+		ids, err := tokenize(k)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, id := range ids {
+			tokens[id] += v
+		}
+	}
+
+	for id, v := range tokens {
+		if v <= -100 {
+			tokens[id] = float32(math.Inf(-1))
+		}
+	}
+
+	return tokens, nil
+}
@@ -0,0 +1,37 @@
+package common
+
+import (
+	"maps"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestLogitBias(t *testing.T) {
+	vocab := map[string]int{"hello": 10, "world": 11}
+	tokenize := func(s string) ([]int, error) {
+		var ids []int
+		for _, w := range strings.Fields(s) {
+			ids = append(ids, vocab[w])
+		}
+		return ids, nil
+	}
+
+	got, err := LogitBias(map[string]float32{"5": -100, "hello world": 2, "10": 1}, 20, tokenize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[int]float32{5: float32(math.Inf(-1)), 10: 3, 11: 2}
+	if !maps.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, err := LogitBias(map[string]float32{"20": 1}, 20, tokenize); err == nil {
+		t.Error("expected an error for a token out of range")
+	}
+
+	if got, err := LogitBias(nil, 20, tokenize); err != nil || got != nil {
+		t.Errorf("got %v, %v; want no bias", got, err)
+	}
+}
@@ -0,0 +1,25 @@
+package common
+
+import "strings"
+
+// SequenceBreakers returns the IDs of the tokens among the first numVocab
+// whose text, given by piece, contains one of breakers. DRY sampling doesn't
+// penalize repetitions across them.
+func SequenceBreakers(breakers []string, numVocab int, piece func(int) string) []int32 {
+	if len(breakers) == 0 {
+		return nil
+	}
+
+	var ids []int32
+	for id := range numVocab {
+		text := piece(id)
+		for _, b := range breakers {
+			if b != "" && strings.Contains(text, b) {
+				ids = append(ids, int32(id))
+				break
+			}
+		}
+	}
+
+	return ids
+}
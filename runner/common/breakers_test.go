@@ -0,0 +1,20 @@
+package common
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSequenceBreakers(t *testing.T) {
+	pieces := []string{"Hello", ":", " world", ".\n", "\"", ""}
+	piece := func(id int) string { return pieces[id] }
+
+	got := SequenceBreakers([]string{"\n", ":", "\"", ""}, len(pieces), piece)
+	if want := []int32{1, 3, 4}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if got := SequenceBreakers(nil, len(pieces), piece); got != nil {
+		t.Errorf("got %v, want no breakers", got)
+	}
+}
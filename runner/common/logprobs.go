@@ -0,0 +1,81 @@
+package common
+
+import (
+	"math"
+	"slices"
+
+	"github.com/goobla/goobla/api"
+)
+
+// Logprobs returns the log probability of token under logits, the model's
+// output for its position, along with the top most likely tokens. piece
+// returns the text of a token.
+func Logprobs(logits []float32, token int, top int, piece func(int) string) api.Logprob {
+	norm := logNorm(logits)
+
+	tokenLogprob := func(id int) api.TokenLogprob {
+		p := piece(id)
+		bytes := make([]int, len(p))
+		for i := range len(p) {
+			bytes[i] = int(p[i])
+		}
+
+		return api.TokenLogprob{
+			Token:   p,
+			Logprob: float64(logits[id]) - norm,
+			Bytes:   bytes,
+		}
+	}
+
+	lp := api.Logprob{TokenLogprob: tokenLogprob(token)}
+	for _, id := range topTokens(logits, top) {
+		lp.TopLogprobs = append(lp.TopLogprobs, tokenLogprob(id))
+	}
+
+	return lp
+}
+
+// logNorm returns the log of the sum of the exponentials of logits, which is
+// subtracted from a logit for its log probability.
+func logNorm(logits []float32) float64 {
+	// offset by the largest logit to avoid overflow
+	maxLogit := float32(math.Inf(-1))
+	for _, l := range logits {
+		maxLogit = max(maxLogit, l)
+	}
+
+	var sum float64
+	for _, l := range logits {
+		sum += math.Exp(float64(l - maxLogit))
+	}
+
+	return float64(maxLogit) + math.Log(sum)
+}
+
+// topTokens returns the IDs of the top tokens with the largest logits, sorted
+// by descending logit.
+func topTokens(logits []float32, top int) []int {
+	if top <= 0 {
+		return nil
+	}
+
+	ids := make([]int, 0, top+1)
+	for id, l := range logits {
+		if len(ids) == top && l <= logits[ids[top-1]] {
+			continue
+		}
+
+		i, _ := slices.BinarySearchFunc(ids, l, func(id int, l float32) int {
+			if logits[id] >= l {
+				return -1
+			}
+			return 1
+		})
+		ids = slices.Insert(ids, i, id)
+		if len(ids) > top {
+			ids = ids[:top]
+		}
+	}
+
+	return ids
+}
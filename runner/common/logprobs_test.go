@@ -0,0 +1,41 @@
+package common
+
+import (
+	"math"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestLogprobs(t *testing.T) {
+	logits := []float32{1, 3, 2, 3, 0}
+	piece := func(id int) string { return strconv.Itoa(id) }
+
+	var sum float64
+	for _, l := range logits {
+		sum += math.Exp(float64(l))
+	}
+
+	lp := Logprobs(logits, 2, 3, piece)
+	if lp.Token != "2" || len(lp.Bytes) != 1 || lp.Bytes[0] != '2' {
+		t.Errorf("unexpected token %q %v", lp.Token, lp.Bytes)
+	}
+
+	if want := 2 - math.Log(sum); math.Abs(lp.Logprob-want) > 1e-6 {
+		t.Errorf("logprob = %f, want %f", lp.Logprob, want)
+	}
+
+	var top []string
+	for _, tlp := range lp.TopLogprobs {
+		top = append(top, tlp.Token)
+	}
+
+	// ties keep the order of the vocabulary
+	if want := []string{"1", "3", "2"}; !slices.Equal(top, want) {
+		t.Errorf("top = %v, want %v", top, want)
+	}
+
+	if lp := Logprobs(logits, 0, 0, piece); lp.TopLogprobs != nil {
+		t.Errorf("unexpected top logprobs %v", lp.TopLogprobs)
+	}
+}
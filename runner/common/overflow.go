@@ -0,0 +1,34 @@
+package common
+
+import "github.com/goobla/goobla/api"
+
+// attentionSinks is the fewest inputs at the start of a sequence that are
+// kept when its context slides with api.ContextOverflowShift. Models attend
+// heavily to their first few inputs whatever they are, and become unstable
+// when they're dropped.
+const attentionSinks = 4
+
+// NumKeep returns the number of inputs at the start of a sequence to keep when
+// its context shifts, for the num_keep option and the context_overflow
+// policy.
+func NumKeep(numKeep int, policy string) int {
+	if policy == api.ContextOverflowShift {
+		return max(numKeep, attentionSinks)
+	}
+
+	return numKeep
+}
+
+// ShiftsContext reports whether the context of a sequence with the
+// context_overflow policy shifts when it's full, rather than the sequence
+// ending or failing.
+func ShiftsContext(policy string) bool {
+	return policy != api.ContextOverflowError
+}
+
+// SlidesContext reports whether the context of a sequence with the
+// context_overflow policy slides when it's full, discarding as few inputs as
+// possible after its attention sinks, rather than discarding half of it.
+func SlidesContext(policy string) bool {
+	return policy == api.ContextOverflowShift
+}
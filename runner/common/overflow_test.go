@@ -0,0 +1,52 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/goobla/goobla/api"
+)
+
+func TestNumKeep(t *testing.T) {
+	tests := []struct {
+		numKeep  int
+		policy   string
+		expected int
+	}{
+		{4, "", 4},
+		{0, "", 0},
+		{0, api.ContextOverflowTruncateOldest, 0},
+		{0, api.ContextOverflowShift, 4},
+		{2, api.ContextOverflowShift, 4},
+		{24, api.ContextOverflowShift, 24},
+	}
+
+	for _, tt := range tests {
+		if got := NumKeep(tt.numKeep, tt.policy); got != tt.expected {
+			t.Errorf("NumKeep(%d, %q): expected %d, got %d", tt.numKeep, tt.policy, tt.expected, got)
+		}
+	}
+}
+
+func TestShiftsContext(t *testing.T) {
+	for _, policy := range []string{"", api.ContextOverflowTruncateOldest, api.ContextOverflowShift} {
+		if !ShiftsContext(policy) {
+			t.Errorf("expected %q to shift the context", policy)
+		}
+	}
+
+	if ShiftsContext(api.ContextOverflowError) {
+		t.Error("expected error not to shift the context")
+	}
+}
+
+func TestSlidesContext(t *testing.T) {
+	for _, policy := range []string{"", api.ContextOverflowTruncateOldest, api.ContextOverflowError} {
+		if SlidesContext(policy) {
+			t.Errorf("expected %q not to slide the context", policy)
+		}
+	}
+
+	if !SlidesContext(api.ContextOverflowShift) {
+		t.Error("expected shift_with_attention_sink to slide the context")
+	}
+}
@@ -0,0 +1,139 @@
+package gooblarunner
+
+import (
+	"log/slog"
+	"math"
+	"slices"
+
+	"github.com/goobla/goobla/llm"
+	"github.com/goobla/goobla/model"
+	"github.com/goobla/goobla/model/input"
+)
+
+// Beam search keeps each of its beams in a cache slot of its own: the
+// sequence's slot and ones reserved for it, which are given the prompt once
+// it's evaluated. Beams are continued in the slot of the beam they extend,
+// or a copy of it, so the prompt is only evaluated once and each step runs
+// a token for each of the beams in the same batch.
+
+// addBeams adds the last token of each of the beams of seq to the batch,
+// reporting whether there was room for them.
+func (s *Server) addBeams(seq *Sequence, batchInputs *[]int32, batch *input.Batch) bool {
+	if len(*batchInputs)+len(seq.beams.Beams) > s.batchLimit() {
+		return false
+	}
+
+	seq.beamBatch = seq.beamBatch[:0]
+	for i, beam := range seq.beams.Beams {
+		*batchInputs = append(*batchInputs, int32(beam.Tokens[len(beam.Tokens)-1]))
+		batch.Positions = append(batch.Positions, int32(len(seq.cache.Inputs)+len(beam.Tokens)-1))
+		batch.Sequences = append(batch.Sequences, seq.beamSlots[i].Id)
+
+		seq.beamBatch = append(seq.beamBatch, len(batch.Outputs))
+		batch.Outputs = append(batch.Outputs, int32(len(*batchInputs)-1))
+	}
+
+	return true
+}
+
+// stepBeams extends the beams of the sequence at seqIndex with the logits of
+// the last batch, finishing it once the search is done.
+func (s *Server) stepBeams(seqIndex int, seq *Sequence, logits []float32, vocabSize int) {
+	select {
+	case <-seq.quit:
+		s.removeSequence(seqIndex, llm.DoneReasonConnectionClosed)
+		return
+	default:
+	}
+
+	numPast := int32(len(seq.cache.Inputs))
+
+	var beamLogits [][]float32
+	if len(seq.beamBatch) == 0 {
+		// the prompt was just evaluated
+		beamLogits = append(beamLogits, logits[seq.iBatch*vocabSize:(seq.iBatch+1)*vocabSize])
+		for _, slot := range seq.beamSlots[1:] {
+			s.cache.cache.CopyPrefix(seq.cache.Id, slot.Id, numPast)
+		}
+	} else {
+		for _, i := range seq.beamBatch {
+			beamLogits = append(beamLogits, logits[i*vocabSize:(i+1)*vocabSize])
+		}
+	}
+	seq.beamBatch = seq.beamBatch[:0]
+
+	tp := s.model.(model.TextProcessor)
+	parents := seq.beams.Step(beamLogits, func(token int) bool {
+		return tp.Is(int32(token), model.SpecialEOS) || slices.Contains(seq.stopTokenIDs, token)
+	})
+
+	// the first beam extending each beam continues in its slot, and the
+	// others in the slots of beams that weren't extended
+	slots := make([]*InputCacheSlot, len(parents))
+	kept := make([]bool, len(seq.beamSlots))
+	for i, parent := range parents {
+		if !kept[parent] {
+			slots[i] = seq.beamSlots[parent]
+			kept[parent] = true
+		}
+	}
+
+	var free []*InputCacheSlot
+	for i, slot := range seq.beamSlots {
+		if !kept[i] {
+			if err := s.cache.cache.Remove(slot.Id, numPast, math.MaxInt32); err != nil {
+				slog.Warn("model doesn't support beam search, stopping early", "error", err)
+				s.finishBeams(seqIndex, seq)
+				return
+			}
+			free = append(free, slot)
+		}
+	}
+
+	for i, parent := range parents {
+		if slots[i] == nil {
+			slots[i], free = free[0], free[1:]
+			s.cache.cache.CopyPrefix(seq.beamSlots[parent].Id, slots[i].Id, math.MaxInt32)
+		}
+	}
+	seq.beamSlots = append(slots, free...)
+
+	if seq.beams.Done() ||
+		(seq.numPredict > 0 && seq.numPredicted >= seq.numPredict) ||
+		numPast+int32(seq.numPredicted) >= s.cache.numCtx {
+		s.finishBeams(seqIndex, seq)
+	}
+}
+
+// finishBeams returns the best response found by the beam search of the
+// sequence at seqIndex, and removes it.
+func (s *Server) finishBeams(seqIndex int, seq *Sequence) {
+	best, finished := seq.beams.Best()
+	text, stopped := best.Text(seq.stop, s.tokenPiece)
+	seq.pendingResponses = append(seq.pendingResponses, text)
+
+	reason := llm.DoneReasonLength
+	if finished || stopped {
+		reason = llm.DoneReasonStop
+	}
+
+	s.removeSequence(seqIndex, reason)
+}
+
+// releaseBeams frees the cache slots reserved for the beams of seq, leaving
+// only the prompt in its own.
+func (s *Server) releaseBeams(seq *Sequence) {
+	for _, slot := range seq.beamSlots {
+		if slot == seq.cache {
+			if err := s.cache.cache.Remove(slot.Id, int32(len(slot.Inputs)), math.MaxInt32); err != nil {
+				s.cache.cache.Remove(slot.Id, 0, math.MaxInt32)
+				slot.Inputs = nil
+			}
+			continue
+		}
+
+		s.cache.cache.Remove(slot.Id, 0, math.MaxInt32)
+		slot.Inputs = nil
+		slot.InUse = false
+	}
+}
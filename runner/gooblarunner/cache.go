@@ -144,6 +144,33 @@ func (c *InputCache) LoadCacheSlot(prompt []input.Input) (*InputCacheSlot, []inp
 	return slot, prompt, nil
 }
 
+// ReserveSlots marks n slots that aren't in use as in use and empties them,
+// such as for the beams of a sequence. The caller must ensure there are enough
+// slots free.
+func (c *InputCache) ReserveSlots(n int) []*InputCacheSlot {
+	var slots []*InputCacheSlot
+	for i := range c.slots {
+		if len(slots) == n {
+			break
+		}
+
+		slot := &c.slots[i]
+		if slot.InUse {
+			continue
+		}
+
+		if c.cache != nil {
+			c.cache.Remove(slot.Id, 0, math.MaxInt32)
+		}
+		slot.Inputs = nil
+		slot.InUse = true
+		slot.lastUsed = time.Now()
+		slots = append(slots, slot)
+	}
+
+	return slots
+}
+
 func (c *InputCache) findLongestCacheSlot(prompt []input.Input) (*InputCacheSlot, int32, error) {
 	longest := int32(-1)
 	var longestSlot *InputCacheSlot
@@ -247,6 +274,14 @@ func (c *InputCache) ShiftDiscard(inputLen int32, numKeep int32) int32 {
 	return discard
 }
 
+// SlideDiscard returns the number of inputs to discard from a slot holding
+// inputLen inputs so that n more fit, discarding as few as possible while
+// keeping the first numKeep.
+func (c *InputCache) SlideDiscard(inputLen int32, numKeep int32, n int32) int32 {
+	discard := min(inputLen+n-c.numCtx, inputLen-numKeep)
+	return max(discard, 0)
+}
+
 type ErrReprocessInputs struct {
 	Inputs []input.Input
 }
@@ -260,12 +295,23 @@ func (e *ErrReprocessInputs) Error() string {
 //
 // Assumes that at least 1 entry can be freed up by shifting (i.e. numKeep < numCtx)
 func (c *InputCache) ShiftCacheSlot(slot *InputCacheSlot, numKeep int32) error {
+	return c.discardCacheSlot(slot, numKeep, c.ShiftDiscard(int32(len(slot.Inputs)), numKeep))
+}
+
+// SlideCacheSlot frees up space in the KV cache for n more inputs by deleting
+// as few of the oldest inputs after the first numKeep as possible. The first
+// inputs act as attention sinks, so the model stays stable while it attends
+// to them and a window of the latest inputs.
+func (c *InputCache) SlideCacheSlot(slot *InputCacheSlot, numKeep int32, n int32) error {
+	return c.discardCacheSlot(slot, numKeep, c.SlideDiscard(int32(len(slot.Inputs)), numKeep, n))
+}
+
+func (c *InputCache) discardCacheSlot(slot *InputCacheSlot, numKeep int32, discard int32) error {
 	if numKeep >= c.numCtx {
 		return fmt.Errorf("unable to shift context - keep exceeds context (keep: %v context: %v)", numKeep, c.numCtx)
 	}
 
 	inputLen := int32(len(slot.Inputs))
-	discard := c.ShiftDiscard(inputLen, numKeep)
 
 	if discard <= 0 {
 		return nil
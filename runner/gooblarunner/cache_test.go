@@ -296,6 +296,60 @@ func TestShiftDiscard(t *testing.T) {
 	}
 }
 
+func TestSlideDiscard(t *testing.T) {
+	tests := []struct {
+		name     string
+		numCtx   int32
+		numKeep  int32
+		inputLen int32
+		n        int32
+		expected int32
+	}{
+		{
+			name:     "Next Token",
+			numCtx:   2048,
+			numKeep:  4,
+			inputLen: 2048,
+			n:        1,
+			expected: 1,
+		},
+		{
+			name:     "Remaining Prompt",
+			numCtx:   2048,
+			numKeep:  4,
+			inputLen: 2040,
+			n:        100,
+			expected: 92,
+		},
+		{
+			name:     "Keep Sinks",
+			numCtx:   2048,
+			numKeep:  4,
+			inputLen: 2048,
+			n:        4000,
+			expected: 2044,
+		},
+		{
+			name:     "No Op",
+			numCtx:   2048,
+			numKeep:  4,
+			inputLen: 512,
+			n:        1,
+			expected: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := InputCache{numCtx: tt.numCtx}
+			result := c.SlideDiscard(tt.inputLen, tt.numKeep, tt.n)
+			if result != tt.expected {
+				t.Errorf("slideDiscard(ctx: %v, keep: %v input: %v n: %v): have %v; want %v", tt.numCtx, tt.numKeep, tt.inputLen, tt.n, result, tt.expected)
+			}
+		})
+	}
+}
+
 func TestLoadCacheSlot(t *testing.T) {
 	tests := []struct {
 		name           string
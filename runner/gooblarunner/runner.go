@@ -16,6 +16,7 @@ import (
 	"os"
 	"regexp"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -58,11 +59,28 @@ type Sequence struct {
 	// tokens that have been generated but not returned yet (e.g. for stop sequences)
 	pendingResponses []string
 
+	// log probabilities of the tokens in pendingResponses, if requested
+	pendingLogprobs []api.Logprob
+
 	// input cache being used by this sequence
 	cache *InputCacheSlot
 
+	// tokens of a completion to score instead of generating one, at the end
+	// of inputs, their log probabilities so far, and the output indexes of
+	// the logits predicting them in the current batch
+	score      []int32
+	scored     []api.Logprob
+	scoreBatch []int
+
+	// beam search decoding in place of sampling, if enabled, with the cache
+	// slot of each beam, starting with the sequence's own, and the output
+	// indexes of their last tokens
+	beams     *common.BeamSearch
+	beamSlots []*InputCacheSlot
+	beamBatch []int
+
 	// channel to send responses over
-	responses chan string
+	responses chan llm.CompletionResponse
 
 	// channel to stop decoding (such as if the remote connection is closed)
 	quit chan bool
@@ -79,9 +97,25 @@ type Sequence struct {
 	// stop sequences
 	stop []string
 
+	// tokens that end the response, in addition to end of sequence tokens
+	stopTokenIDs []int
+
+	// whether to return the log probabilities of generated tokens, and how
+	// many of the most likely alternatives to return with them
+	logprobs    bool
+	topLogprobs int
+
 	// number of inputs to keep at the beginning when shifting context window
 	numKeep int32
 
+	// whether the context shifts when it's full, or the sequence ends
+	shift bool
+
+	// whether the context slides by as few inputs as possible when it's
+	// full, keeping numKeep inputs as attention sinks, rather than
+	// discarding half of it
+	slide bool
+
 	// true if an embedding are to be returned instead of text generation
 	embeddingOnly bool
 
@@ -92,14 +126,46 @@ type Sequence struct {
 	startGenerationTime time.Time
 	numPredicted        int
 	numPromptInputs     int
+	numCachedInputs     int
+	numImageInputs      int
+}
+
+// progress returns the counts of the sequence so far. s.mu must be held.
+func (seq *Sequence) progress() llm.CompletionResponse {
+	resp := llm.CompletionResponse{
+		Progress:        true,
+		PromptTokens:    seq.numPromptInputs,
+		PromptEvalCount: seq.numPromptInputs,
+		EvalCount:       seq.numPredicted,
+	}
+
+	if seq.numPredicted == 0 {
+		// still processing the prompt
+		resp.PromptEvalCount = max(seq.numPromptInputs-len(seq.inputs), 0)
+		resp.PromptEvalDuration = time.Since(seq.startProcessingTime)
+	} else {
+		resp.PromptEvalDuration = seq.startGenerationTime.Sub(seq.startProcessingTime)
+		resp.EvalDuration = time.Since(seq.startGenerationTime)
+	}
+
+	return resp
 }
 
 type NewSequenceParams struct {
-	numPredict int
-	stop       []string
-	numKeep    int32
-	sampler    sample.Sampler
-	embedding  bool
+	numPredict    int
+	stop          []string
+	stopTokenIDs  []int
+	logprobs      bool
+	topLogprobs   int
+	numBeams      int
+	lengthPenalty float32
+	numKeep       int32
+	sampler       sample.Sampler
+	score         string
+	embedding     bool
+
+	// contextOverflow is the context_overflow policy of the request
+	contextOverflow string
 }
 
 func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSequenceParams) (*Sequence, error) {
@@ -107,21 +173,41 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 
 	startTime := time.Now()
 
-	inputs, ctxs, mmStore, err := s.inputs(prompt, images)
+	inputs, ctxs, mmStore, numImageInputs, err := s.inputs(prompt, images)
 	if err != nil {
 		return nil, fmt.Errorf("failed to process inputs: %w", err)
 	} else if len(inputs) == 0 {
 		return nil, errors.New("no input provided")
 	}
 
+	var score []int32
+	if params.score != "" {
+		score, err = s.model.(model.TextProcessor).Encode(params.score, false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to process completion: %w", err)
+		} else if len(score) == 0 {
+			return nil, errors.New("no completion provided")
+		}
+
+		// unlike a prompt, a completion being scored can't be truncated
+		if int32(len(inputs)+len(score)) > s.cache.numCtx {
+			return nil, fmt.Errorf("prompt and completion of %d tokens exceed the context length of %d", len(inputs)+len(score), s.cache.numCtx)
+		}
+	}
+
 	if params.numKeep < 0 {
 		params.numKeep = int32(len(inputs))
 	}
+	params.numKeep = int32(common.NumKeep(int(params.numKeep), params.contextOverflow))
 
 	// Ensure that at least 1 input can be discarded during shift
 	params.numKeep = min(params.numKeep, s.cache.numCtx-1)
 
 	if int32(len(inputs)) > s.cache.numCtx {
+		if !common.ShiftsContext(params.contextOverflow) {
+			return nil, fmt.Errorf("prompt of %d tokens exceeds the context length of %d", len(inputs), s.cache.numCtx)
+		}
+
 		discard := int32(len(inputs)) - s.cache.numCtx
 		promptStart := params.numKeep + discard
 
@@ -159,30 +245,79 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 	}
 
 	// TODO(jessegross): Ingest cached history for grammar
+	for _, inp := range inputs {
+		if inp.Multimodal == nil {
+			params.sampler.Accept(inp.Token)
+		}
+	}
+
+	var beams *common.BeamSearch
+	if params.numBeams > 1 && score == nil {
+		beams = common.NewBeamSearch(params.numBeams, params.lengthPenalty)
+	}
 
 	return &Sequence{
 		ctxs:                ctxs,
 		mmStore:             mmStore,
 		inputs:              inputs,
-		numPromptInputs:     len(inputs),
+		score:               score,
+		numPromptInputs:     len(inputs) + len(score),
+		numImageInputs:      numImageInputs,
 		startProcessingTime: startTime,
 		numPredict:          params.numPredict,
 		pendingResponses:    make([]string, 0),
-		responses:           make(chan string, 100),
+		responses:           make(chan llm.CompletionResponse, 100),
 		quit:                make(chan bool, 1),
 		embedding:           make(chan []float32, 1),
 		sampler:             params.sampler,
 		embeddingOnly:       params.embedding,
 		stop:                params.stop,
+		stopTokenIDs:        params.stopTokenIDs,
+		logprobs:            params.logprobs,
+		topLogprobs:         params.topLogprobs,
+		beams:               beams,
 		numKeep:             params.numKeep,
+		shift:               common.ShiftsContext(params.contextOverflow),
+		slide:               common.SlidesContext(params.contextOverflow),
 	}, nil
 }
 
+// predictsScore reports whether the input at i predicts the next token of
+// the completion being scored, which is the input after it.
+func (seq *Sequence) predictsScore(i int) bool {
+	// the tokens being scored are the last of the inputs left
+	first := len(seq.inputs) - min(len(seq.score)-len(seq.scored)-len(seq.scoreBatch), len(seq.inputs))
+	return i+1 >= first && i+1 < len(seq.inputs)
+}
+
+// canceled reports whether the request of the sequence has gone, such as by
+// its client disconnecting.
+func (seq *Sequence) canceled() bool {
+	select {
+	case <-seq.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// slots returns the number of cache slots the sequence uses.
+func (seq *Sequence) slots() int {
+	if seq.beams != nil {
+		return seq.beams.Width
+	}
+
+	return 1
+}
+
 // inputs processes the prompt and images into a list of inputs
 // by splitting the prompt on [img-<n>] tags, tokenizing text and
 // decoding images
-func (s *Server) inputs(prompt string, images []llm.ImageData) ([]input.Input, []ml.Context, multimodalStore, error) {
+// inputs returns the inputs of prompt and its images, along with the number
+// of the inputs that are images.
+func (s *Server) inputs(prompt string, images []llm.ImageData) ([]input.Input, []ml.Context, multimodalStore, int, error) {
 	var inputs []input.Input
+	var numText int
 	var ctxs []ml.Context
 	var mmStore multimodalStore
 
@@ -205,12 +340,13 @@ func (s *Server) inputs(prompt string, images []llm.ImageData) ([]input.Input, [
 		// text - tokenize
 		tokens, err := s.model.(model.TextProcessor).Encode(part, i == 0)
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, nil, nil, 0, err
 		}
 
 		for _, t := range tokens {
 			inputs = append(inputs, input.Input{Token: t})
 		}
+		numText += len(tokens)
 
 		// image - decode and store
 		if i < len(matches) {
@@ -225,7 +361,7 @@ func (s *Server) inputs(prompt string, images []llm.ImageData) ([]input.Input, [
 			}
 
 			if imageIndex < 0 {
-				return nil, nil, nil, fmt.Errorf("invalid image index: %d", n)
+				return nil, nil, nil, 0, fmt.Errorf("invalid image index: %d", n)
 			}
 
 			ctx := s.model.Backend().NewContext()
@@ -233,7 +369,7 @@ func (s *Server) inputs(prompt string, images []llm.ImageData) ([]input.Input, [
 			ctxs = append(ctxs, ctx)
 			imageEmbeddings, err := multimodalProcessor.EncodeMultimodal(ctx, images[imageIndex].Data)
 			if err != nil {
-				return nil, nil, nil, err
+				return nil, nil, nil, 0, err
 			}
 
 			s.multimodalHash.Reset()
@@ -251,11 +387,11 @@ func (s *Server) inputs(prompt string, images []llm.ImageData) ([]input.Input, [
 		var err error
 		inputs, err = multimodalProcessor.PostTokenize(inputs)
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, nil, nil, 0, err
 		}
 	}
 
-	return inputs, ctxs, mmStore, nil
+	return inputs, ctxs, mmStore, len(inputs) - numText, nil
 }
 
 type Server struct {
@@ -279,6 +415,10 @@ type Server struct {
 	// TODO (jmorganca): make this n_batch
 	batchSize int
 
+	// maximum number of inputs in a batch across all sequences, or 0 to
+	// use batchSize
+	maxBatch int
+
 	// protects access to everything below this line
 	// this is context state needed for decoding
 	mu sync.Mutex
@@ -313,9 +453,22 @@ func (s *Server) allNil() bool {
 	return true
 }
 
+// tokenPiece returns the text of token, or an empty string if it can't be
+// decoded.
+func (s *Server) tokenPiece(token int) string {
+	piece, err := s.model.(model.TextProcessor).Decode([]int32{int32(token)})
+	if err != nil {
+		return ""
+	}
+
+	return piece
+}
+
 func flushPending(seq *Sequence) bool {
 	joined := strings.Join(seq.pendingResponses, "")
+	logprobs := seq.pendingLogprobs
 	seq.pendingResponses = []string{}
+	seq.pendingLogprobs = nil
 
 	// Check if there are any partial UTF-8 characters remaining.
 	// We already check and queue as we are generating but some may
@@ -332,7 +485,7 @@ func flushPending(seq *Sequence) bool {
 	}
 
 	select {
-	case seq.responses <- joined:
+	case seq.responses <- llm.CompletionResponse{Content: joined, Logprobs: logprobs}:
 		return true
 	case <-seq.quit:
 		return false
@@ -344,11 +497,16 @@ func (s *Server) removeSequence(seqIndex int, reason llm.DoneReason) {
 
 	flushPending(seq)
 	seq.doneReason = reason
+
+	if seq.beams != nil {
+		s.releaseBeams(seq)
+	}
+
 	close(seq.responses)
 	close(seq.embedding)
 	seq.cache.InUse = false
 	s.seqs[seqIndex] = nil
-	s.seqsSem.Release(1)
+	s.seqsSem.Release(int64(seq.slots()))
 }
 
 func (s *Server) run(ctx context.Context) {
@@ -367,6 +525,36 @@ func (s *Server) run(ctx context.Context) {
 	}
 }
 
+// batchOrder returns the indexes of the sequences in the order their inputs
+// are added to the next batch. Sequences that are generating come first, so
+// their next tokens aren't held up by long prompts, and each group starts
+// from s.nextSeq to avoid starvation.
+func (s *Server) batchOrder() []int {
+	var generating, prompts []int
+	for i := range s.seqs {
+		seqIdx := (s.nextSeq + i) % len(s.seqs)
+		switch seq := s.seqs[seqIdx]; {
+		case seq == nil:
+		case seq.numPredicted > 0:
+			generating = append(generating, seqIdx)
+		default:
+			prompts = append(prompts, seqIdx)
+		}
+	}
+
+	return append(generating, prompts...)
+}
+
+// batchLimit returns the maximum number of inputs in a batch across all
+// sequences.
+func (s *Server) batchLimit() int {
+	if s.maxBatch > 0 {
+		return min(s.batchSize, s.maxBatch)
+	}
+
+	return s.batchSize
+}
+
 func (s *Server) processBatch() error {
 	s.mu.Lock()
 	for s.allNil() {
@@ -382,11 +570,13 @@ func (s *Server) processBatch() error {
 
 	resumeSeq := -1
 	seqIdx := s.nextSeq - 1
-	for range s.seqs {
-		seqIdx = (seqIdx + 1) % len(s.seqs)
+	for _, seqIdx = range s.batchOrder() {
 		seq := s.seqs[seqIdx]
 
-		if seq == nil {
+		// the request has gone, so its sequence ends now rather than when
+		// its next response can't be sent, which may be many steps away
+		if seq.canceled() {
+			s.removeSequence(seqIdx, llm.DoneReasonConnectionClosed)
 			continue
 		}
 
@@ -401,7 +591,16 @@ func (s *Server) processBatch() error {
 			seq.cache.Inputs = []input.Input{}
 		}
 
-		batchSize := s.batchSize
+		if seq.beams != nil && seq.numPredicted > 0 {
+			if !s.addBeams(seq, &batchInputs, &batch) && resumeSeq == -1 {
+				resumeSeq = seqIdx
+			}
+			continue
+		}
+
+		// prompts are only evaluated in the room left by the sequences
+		// that are generating
+		batchSize := s.batchLimit()
 
 		for i, inp := range seq.inputs {
 			// If we are required to put following inputs into a single batch then extend the
@@ -431,7 +630,17 @@ func (s *Server) processBatch() error {
 					break
 				}
 
-				err := s.cache.ShiftCacheSlot(seq.cache, seq.numKeep)
+				if !seq.shift {
+					s.removeSequence(seqIdx, llm.DoneReasonLength)
+					break
+				}
+
+				var err error
+				if seq.slide {
+					err = s.cache.SlideCacheSlot(seq.cache, seq.numKeep, int32(len(seq.inputs)-i))
+				} else {
+					err = s.cache.ShiftCacheSlot(seq.cache, seq.numKeep)
+				}
 				if err != nil {
 					var reprocess *ErrReprocessInputs
 					if errors.As(err, &reprocess) {
@@ -458,7 +667,10 @@ func (s *Server) processBatch() error {
 			batch.Sequences = append(batch.Sequences, seq.cache.Id)
 
 			seq.iBatch = len(batch.Outputs)
-			if i+1 == len(seq.inputs) {
+			if seq.predictsScore(i) {
+				seq.scoreBatch = append(seq.scoreBatch, len(batch.Outputs))
+				batch.Outputs = append(batch.Outputs, int32(len(batchInputs)-1))
+			} else if i+1 == len(seq.inputs) {
 				batch.Outputs = append(batch.Outputs, int32(len(batchInputs)-1))
 			}
 			seq.pendingInputs = append(seq.pendingInputs, inp)
@@ -495,6 +707,13 @@ func (s *Server) processBatch() error {
 			seq.pendingInputs = []input.Input{}
 		}
 
+		for _, idx := range seq.scoreBatch {
+			vocabSize := len(logits) / len(batch.Outputs)
+			token := seq.score[len(seq.scored)]
+			seq.scored = append(seq.scored, common.Logprobs(logits[idx*vocabSize:(idx+1)*vocabSize], int(token), seq.topLogprobs, s.tokenPiece))
+		}
+		seq.scoreBatch = nil
+
 		// don't sample prompt processing
 		if len(seq.inputs) != 0 {
 			if !s.cache.enabled {
@@ -503,6 +722,11 @@ func (s *Server) processBatch() error {
 			continue
 		}
 
+		// or beams that weren't in the batch
+		if seq.beams != nil && seq.numPredicted > 0 && len(seq.beamBatch) == 0 {
+			continue
+		}
+
 		seq.numPredicted++
 		if seq.numPredicted == 1 {
 			seq.startGenerationTime = time.Now()
@@ -516,16 +740,28 @@ func (s *Server) processBatch() error {
 			continue
 		}
 
-		// sample a token
+		// or, once its completion is scored, return the log probabilities
+		// with the final response
+		if seq.score != nil {
+			s.removeSequence(i, llm.DoneReasonStop)
+			continue
+		}
+
 		vocabSize := len(logits) / len(batch.Outputs)
+		if seq.beams != nil {
+			s.stepBeams(i, seq, logits, vocabSize)
+			continue
+		}
 
-		token, err := seq.sampler.Sample(logits[seq.iBatch*vocabSize : (seq.iBatch+1)*vocabSize])
+		// sample a token
+		seqLogits := logits[seq.iBatch*vocabSize : (seq.iBatch+1)*vocabSize]
+		token, err := seq.sampler.Sample(seqLogits)
 		if err != nil {
 			return fmt.Errorf("failed to sample token: %w", err)
 		}
 
 		// if it's an end of sequence token, break
-		if s.model.(model.TextProcessor).Is(token, model.SpecialEOS) {
+		if s.model.(model.TextProcessor).Is(token, model.SpecialEOS) || slices.Contains(seq.stopTokenIDs, int(token)) {
 			// TODO (jmorganca): we should send this back
 			// as it's important for the /api/generate context
 			// seq.responses <- piece
@@ -542,6 +778,9 @@ func (s *Server) processBatch() error {
 		seq.inputs = []input.Input{{Token: token}}
 
 		seq.pendingResponses = append(seq.pendingResponses, piece)
+		if seq.logprobs {
+			seq.pendingLogprobs = append(seq.pendingLogprobs, common.Logprobs(seqLogits, int(token), seq.topLogprobs, s.tokenPiece))
+		}
 		sequence := strings.Join(seq.pendingResponses, "")
 
 		if ok, stop := common.FindStop(sequence, seq.stop); ok {
@@ -551,6 +790,7 @@ func (s *Server) processBatch() error {
 			origLen := len(seq.pendingResponses)
 			seq.pendingResponses, tokenTruncated = common.TruncateStop(seq.pendingResponses, stop)
 			newLen := len(seq.pendingResponses)
+			seq.pendingLogprobs = seq.pendingLogprobs[:min(len(seq.pendingLogprobs), newLen)]
 
 			// Update the cache based on the tokens that will be returned:
 			// - We have 1 token more than is currently in the cache because
@@ -619,28 +859,83 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		defer grammar.Free()
 	}
 
-	sampler := sample.NewSamplerFromConfig(sample.Config{
-		Temperature: req.Options.Temperature,
-		TopK:        req.Options.TopK,
-		TopP:        req.Options.TopP,
-		MinP:        req.Options.MinP,
-		Seed:        req.Options.Seed,
-	}, grammar)
+	tp := s.model.(model.TextProcessor)
+	bias, err := common.LogitBias(req.Options.LogitBias, len(tp.Vocabulary().Values), func(text string) ([]int, error) {
+		ids, err := tp.Encode(text, false)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens := make([]int, len(ids))
+		for i, id := range ids {
+			tokens[i] = int(id)
+		}
+		return tokens, nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var logitBias map[int32]float32
+	if len(bias) > 0 {
+		logitBias = make(map[int32]float32, len(bias))
+		for id, v := range bias {
+			logitBias[int32(id)] = v
+		}
+	}
+
+	if req.Options.NumBeams > 1 {
+		if req.Options.NumBeams > s.parallel {
+			http.Error(w, fmt.Sprintf("num_beams can be at most %d, the number of parallel sequences", s.parallel), http.StatusBadRequest)
+			return
+		}
+
+		if grammar != nil {
+			http.Error(w, "num_beams can't be used with a format or grammar", http.StatusBadRequest)
+			return
+		}
+
+		if !s.cache.enabled {
+			http.Error(w, "num_beams isn't supported by this model", http.StatusBadRequest)
+			return
+		}
+	}
+
+	cfg := sample.ConfigFromOptions(*req.Options)
+	cfg.LogitBias = logitBias
+	if cfg.DryMultiplier > 0 {
+		cfg.DryBreakers = common.SequenceBreakers(req.Options.DrySequenceBreakers, len(tp.Vocabulary().Values), s.tokenPiece)
+	}
+	sampler, err := sample.NewSamplerFromConfig(cfg, grammar)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	seq, err := s.NewSequence(req.Prompt, req.Images, NewSequenceParams{
-		numPredict: req.Options.NumPredict,
-		stop:       req.Options.Stop,
-		numKeep:    int32(req.Options.NumKeep),
-		sampler:    sampler,
-		embedding:  false,
+		numPredict:    req.Options.NumPredict,
+		stop:          req.Options.Stop,
+		stopTokenIDs:  req.Options.StopTokenIDs,
+		logprobs:      req.Logprobs,
+		topLogprobs:   req.TopLogprobs,
+		numBeams:      req.Options.NumBeams,
+		lengthPenalty: req.Options.LengthPenalty,
+		numKeep:       int32(req.Options.NumKeep),
+		sampler:       sampler,
+		score:         req.Score,
+		embedding:     false,
+
+		contextOverflow: req.Options.ContextOverflow,
 	})
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Ensure there is a place to put the sequence, released when removed from s.seqs
-	if err := s.seqsSem.Acquire(r.Context(), 1); err != nil {
+	// Ensure there is a place to put the sequence, and each of its beams,
+	// released when removed from s.seqs
+	if err := s.seqsSem.Acquire(r.Context(), int64(seq.slots())); err != nil {
 		if errors.Is(err, context.Canceled) {
 			slog.Info("aborting completion request due to client closing the connection")
 		} else {
@@ -656,11 +951,23 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs)
 			if err != nil {
 				s.mu.Unlock()
-				s.seqsSem.Release(1)
+				s.seqsSem.Release(int64(seq.slots()))
 				http.Error(w, fmt.Sprintf("Failed to load cache: %v", err), http.StatusInternalServerError)
 				return
 			}
 
+			// the completion is scored after the prompt, whatever of it is
+			// cached, so its tokens are always evaluated
+			for _, token := range seq.score {
+				seq.inputs = append(seq.inputs, input.Input{Token: token})
+			}
+
+			seq.numCachedInputs = seq.numPromptInputs - len(seq.inputs)
+
+			if seq.beams != nil {
+				seq.beamSlots = append([]*InputCacheSlot{seq.cache}, s.cache.ReserveSlots(seq.beams.Width-1)...)
+			}
+
 			s.seqs[i] = seq
 			s.cond.Signal()
 			found = true
@@ -670,21 +977,38 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 	s.mu.Unlock()
 
 	if !found {
-		s.seqsSem.Release(1)
+		s.seqsSem.Release(int64(seq.slots()))
 		http.Error(w, "could not find an available sequence", http.StatusInternalServerError)
 		return
 	}
 
+	var stats <-chan time.Time
+	if req.StatsInterval > 0 {
+		ticker := time.NewTicker(req.StatsInterval)
+		defer ticker.Stop()
+		stats = ticker.C
+	}
+
 	for {
 		select {
 		case <-r.Context().Done():
 			close(seq.quit)
 			return
-		case content, ok := <-seq.responses:
+		case <-stats:
+			s.mu.Lock()
+			progress := seq.progress()
+			s.mu.Unlock()
+
+			if err := json.NewEncoder(w).Encode(&progress); err != nil {
+				http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+				close(seq.quit)
+				return
+			}
+
+			flusher.Flush()
+		case resp, ok := <-seq.responses:
 			if ok {
-				if err := json.NewEncoder(w).Encode(&llm.CompletionResponse{
-					Content: content,
-				}); err != nil {
+				if err := json.NewEncoder(w).Encode(&resp); err != nil {
 					http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
 					close(seq.quit)
 					return
@@ -696,9 +1020,12 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 					Done:               true,
 					DoneReason:         seq.doneReason,
 					PromptEvalCount:    seq.numPromptInputs,
+					PromptCachedCount:  seq.numCachedInputs,
+					PromptImageCount:   seq.numImageInputs,
 					PromptEvalDuration: seq.startGenerationTime.Sub(seq.startProcessingTime),
 					EvalCount:          seq.numPredicted,
 					EvalDuration:       time.Since(seq.startGenerationTime),
+					Logprobs:           seq.scored,
 				}); err != nil {
 					http.Error(w, fmt.Sprintf("failed to encode final response: %v", err), http.StatusInternalServerError)
 				}
@@ -905,10 +1232,12 @@ func Execute(args []string) error {
 	kvCacheType := fs.String("kv-cache-type", "", "quantization type for KV cache (default: f16)")
 	port := fs.Int("port", 8080, "Port to expose the server on")
 	threads := fs.Int("threads", runtime.NumCPU(), "Number of threads to use during generation")
+	numa := fs.String("numa", "", "NUMA strategy: distribute, isolate or numactl (default: disabled)")
 	_ = fs.Bool("verbose", false, "verbose output (default: disabled)")
 	_ = fs.Bool("no-mmap", false, "do not memory-map model (slower load but may reduce pageouts if not using mlock)")
 	tensorSplit := fs.String("tensor-split", "", "fraction of the model to offload to each GPU, comma-separated list of proportions")
 	multiUserCache := fs.Bool("multiuser-cache", false, "optimize input cache algorithm for multiple users")
+	maxBatch := fs.Int("max-batch", 0, "Maximum number of inputs to evaluate at once across all sequences (default: no limit beyond the batch size)")
 
 	var lpaths multiLPath
 	fs.Var(&lpaths, "lora", "Path to lora layer file (can be specified multiple times)")
@@ -925,6 +1254,7 @@ func Execute(args []string) error {
 
 	server := &Server{
 		batchSize: *batchSize,
+		maxBatch:  *maxBatch,
 		status:    llm.ServerStatusLoadingModel,
 	}
 
@@ -949,6 +1279,7 @@ func Execute(args []string) error {
 
 	params := ml.BackendParams{
 		NumThreads:     *threads,
+		NUMA:           *numa,
 		NumGPULayers:   *numGPULayers,
 		MainGPU:        *mainGPU,
 		TensorSplit:    tensorSplitFloats,
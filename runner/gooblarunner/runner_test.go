@@ -0,0 +1,20 @@
+package gooblarunner
+
+import "testing"
+
+func TestBatchLimit(t *testing.T) {
+	cases := []struct {
+		batchSize, maxBatch, want int
+	}{
+		{512, 0, 512},
+		{512, 128, 128},
+		{512, 1024, 512},
+	}
+
+	for _, tt := range cases {
+		s := &Server{batchSize: tt.batchSize, maxBatch: tt.maxBatch}
+		if got := s.batchLimit(); got != tt.want {
+			t.Errorf("batchSize %d, maxBatch %d: got %d, want %d", tt.batchSize, tt.maxBatch, got, tt.want)
+		}
+	}
+}
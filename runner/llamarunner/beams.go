@@ -0,0 +1,134 @@
+package llamarunner
+
+import (
+	"log/slog"
+	"slices"
+
+	"github.com/goobla/goobla/llama"
+	"github.com/goobla/goobla/llm"
+)
+
+// Beam search keeps each of its beams in a cache slot of its own: the
+// sequence's slot and ones reserved for it, which are given the prompt once
+// it's evaluated. Beams are continued in the slot of the beam they extend,
+// or a copy of it, so the prompt is only evaluated once and each step decodes
+// a token for each of the beams in the same batch.
+
+// addBeams adds the last token of each of the beams of seq to batch,
+// reporting whether there was room for them.
+func (s *Server) addBeams(seq *Sequence, batch *llama.Batch) bool {
+	if batch.NumTokens()+len(seq.beams.Beams) > batch.Size() {
+		return false
+	}
+
+	seq.beamBatch = seq.beamBatch[:0]
+	for i, beam := range seq.beams.Beams {
+		pos := len(seq.cache.Inputs) + len(beam.Tokens) - 1
+		batch.Add(beam.Tokens[len(beam.Tokens)-1], nil, pos, true, seq.beamSlots[i].Id)
+		seq.beamBatch = append(seq.beamBatch, batch.NumTokens()-1)
+	}
+
+	return true
+}
+
+// stepBeams extends the beams of the sequence at seqIndex with the logits of
+// the last batch, finishing it once the search is done.
+func (s *Server) stepBeams(seqIndex int, seq *Sequence) {
+	select {
+	case <-seq.quit:
+		s.removeSequence(seqIndex, llm.DoneReasonConnectionClosed)
+		return
+	default:
+	}
+
+	numPast := len(seq.cache.Inputs)
+
+	var logits [][]float32
+	if len(seq.beamBatch) == 0 {
+		// the prompt was just evaluated
+		logits = append(logits, s.lc.GetLogitsIth(seq.iBatch))
+		for _, slot := range seq.beamSlots[1:] {
+			s.lc.KvCacheSeqCp(seq.cache.Id, slot.Id, 0, numPast)
+		}
+	} else {
+		for _, i := range seq.beamBatch {
+			logits = append(logits, s.lc.GetLogitsIth(i))
+		}
+	}
+	seq.beamBatch = seq.beamBatch[:0]
+
+	parents := seq.beams.Step(logits, func(token int) bool {
+		return s.model.TokenIsEog(token) || slices.Contains(seq.stopTokenIDs, token)
+	})
+	seq.numPredicted++
+
+	// the first beam extending each beam continues in its slot, and the
+	// others in the slots of beams that weren't extended
+	slots := make([]*InputCacheSlot, len(parents))
+	kept := make([]bool, len(seq.beamSlots))
+	for i, parent := range parents {
+		if !kept[parent] {
+			slots[i] = seq.beamSlots[parent]
+			kept[parent] = true
+		}
+	}
+
+	var free []*InputCacheSlot
+	for i, slot := range seq.beamSlots {
+		if !kept[i] {
+			if !s.lc.KvCacheSeqRm(slot.Id, numPast, -1) {
+				slog.Warn("model doesn't support beam search, stopping early")
+				s.finishBeams(seqIndex, seq)
+				return
+			}
+			free = append(free, slot)
+		}
+	}
+
+	for i, parent := range parents {
+		if slots[i] == nil {
+			slots[i], free = free[0], free[1:]
+			s.lc.KvCacheSeqCp(seq.beamSlots[parent].Id, slots[i].Id, numPast, -1)
+		}
+	}
+	seq.beamSlots = append(slots, free...)
+
+	if seq.beams.Done() ||
+		(seq.numPredict > 0 && seq.numPredicted >= seq.numPredict) ||
+		numPast+seq.numPredicted >= s.cache.numCtx {
+		s.finishBeams(seqIndex, seq)
+	}
+}
+
+// finishBeams returns the best response found by the beam search of the
+// sequence at seqIndex, and removes it.
+func (s *Server) finishBeams(seqIndex int, seq *Sequence) {
+	best, finished := seq.beams.Best()
+	text, stopped := best.Text(seq.stop, s.model.TokenToPiece)
+	seq.pendingResponses = append(seq.pendingResponses, text)
+
+	reason := llm.DoneReasonLength
+	if finished || stopped {
+		reason = llm.DoneReasonStop
+	}
+
+	s.removeSequence(seqIndex, reason)
+}
+
+// releaseBeams frees the cache slots reserved for the beams of seq, leaving
+// only the prompt in its own.
+func (s *Server) releaseBeams(seq *Sequence) {
+	for _, slot := range seq.beamSlots {
+		if slot == seq.cache {
+			if !s.lc.KvCacheSeqRm(slot.Id, len(slot.Inputs), -1) {
+				s.lc.KvCacheSeqRm(slot.Id, 0, -1)
+				slot.Inputs = nil
+			}
+			continue
+		}
+
+		s.lc.KvCacheSeqRm(slot.Id, 0, -1)
+		slot.Inputs = nil
+		slot.InUse = false
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log/slog"
 	"reflect"
+	"slices"
 	"time"
 
 	"github.com/goobla/goobla/llama"
@@ -20,10 +21,13 @@ type InputCache struct {
 	// optimize cache eviction for multiple users
 	multiUserCache bool
 
+	// prompt prefixes evicted from the slots, or nil if disabled
+	prefixes *PrefixCache
+
 	lc *llama.Context
 }
 
-func NewInputCache(lc *llama.Context, kvSize int, numSlots int, multiUserCache bool) (*InputCache, error) {
+func NewInputCache(lc *llama.Context, kvSize int, numSlots int, multiUserCache bool, prefixCacheSize int) (*InputCache, error) {
 	if kvSize/numSlots < 1 {
 		return nil, fmt.Errorf("must have at least one kv cache entry per parallel sequence (kv: %v parallel: %v)", kvSize, numSlots)
 	}
@@ -37,10 +41,16 @@ func NewInputCache(lc *llama.Context, kvSize int, numSlots int, multiUserCache b
 		}
 	}
 
+	var prefixes *PrefixCache
+	if prefixCacheSize > 0 {
+		prefixes = NewPrefixCache(prefixCacheSize)
+	}
+
 	return &InputCache{
 		numCtx:         kvSize / numSlots,
 		slots:          slots,
 		multiUserCache: multiUserCache,
+		prefixes:       prefixes,
 		lc:             lc,
 	}, nil
 }
@@ -56,6 +66,10 @@ type InputCacheSlot struct {
 	// Inputs that are stored in the KV cache
 	Inputs []input
 
+	// scales of the LoRA adapters Inputs were evaluated with, or nil for
+	// the model's default
+	Adapters []float32
+
 	// is this cache actively being processed as part of a sequence?
 	InUse bool
 
@@ -63,7 +77,12 @@ type InputCacheSlot struct {
 	lastUsed time.Time
 }
 
-func (c *InputCache) LoadCacheSlot(prompt []input, cachePrompt bool) (*InputCacheSlot, []input, error) {
+// LoadCacheSlot finds a slot for prompt, evaluated with the LoRA adapters
+// scaled by adapters, and returns it with the inputs of prompt that aren't in
+// its cache. If session is set, the cache is restored from that session file
+// if it has more of prompt. Prompt prefixes and sessions are only restored
+// for the model's default adapters.
+func (c *InputCache) LoadCacheSlot(prompt []input, adapters []float32, cachePrompt bool, session string) (*InputCacheSlot, []input, error) {
 	var slot *InputCacheSlot
 	var numPast int
 	var err error
@@ -75,9 +94,9 @@ func (c *InputCache) LoadCacheSlot(prompt []input, cachePrompt bool) (*InputCach
 	// at the cost of worse performance when we miss the input cache (because it causes
 	// GPU L2 cache misses due to spreading out accesses across VRAM).
 	if !c.multiUserCache {
-		slot, numPast, err = c.findLongestCacheSlot(prompt)
+		slot, numPast, err = c.findLongestCacheSlot(prompt, adapters)
 	} else {
-		slot, numPast, err = c.findBestCacheSlot(prompt)
+		slot, numPast, err = c.findBestCacheSlot(prompt, adapters)
 	}
 	if err != nil {
 		return nil, nil, err
@@ -85,8 +104,21 @@ func (c *InputCache) LoadCacheSlot(prompt []input, cachePrompt bool) (*InputCach
 
 	if !cachePrompt {
 		numPast = 0
+	} else {
+		if c.prefixes != nil {
+			c.savePrefix(slot, numPast)
+		}
+
+		if session != "" && adapters == nil {
+			numPast = c.loadSession(slot, prompt, numPast, session)
+		}
+
+		if c.prefixes != nil && adapters == nil {
+			numPast = c.restorePrefix(slot, prompt, numPast)
+		}
 	}
 
+	slot.Adapters = adapters
 	slot.InUse = true
 	slot.lastUsed = time.Now()
 
@@ -110,7 +142,33 @@ func (c *InputCache) LoadCacheSlot(prompt []input, cachePrompt bool) (*InputCach
 	return slot, prompt, nil
 }
 
-func (c *InputCache) findLongestCacheSlot(prompt []input) (*InputCacheSlot, int, error) {
+// ReserveSlots marks n slots that aren't in use as in use and empties them,
+// such as for the beams of a sequence evaluated with the LoRA adapters scaled
+// by adapters. The caller must ensure there are enough slots free.
+func (c *InputCache) ReserveSlots(n int, adapters []float32) []*InputCacheSlot {
+	var slots []*InputCacheSlot
+	for i := range c.slots {
+		if len(slots) == n {
+			break
+		}
+
+		slot := &c.slots[i]
+		if slot.InUse {
+			continue
+		}
+
+		c.lc.KvCacheSeqRm(slot.Id, 0, -1)
+		slot.Inputs = nil
+		slot.Adapters = adapters
+		slot.InUse = true
+		slot.lastUsed = time.Now()
+		slots = append(slots, slot)
+	}
+
+	return slots
+}
+
+func (c *InputCache) findLongestCacheSlot(prompt []input, adapters []float32) (*InputCacheSlot, int, error) {
 	longest := -1
 	var longestSlot *InputCacheSlot
 
@@ -119,7 +177,7 @@ func (c *InputCache) findLongestCacheSlot(prompt []input) (*InputCacheSlot, int,
 			continue
 		}
 
-		count := countCommonPrefix(s.Inputs, prompt)
+		count := s.commonPrefix(prompt, adapters)
 		if count > longest {
 			longest = count
 			longestSlot = &c.slots[i]
@@ -133,7 +191,7 @@ func (c *InputCache) findLongestCacheSlot(prompt []input) (*InputCacheSlot, int,
 	return longestSlot, longest, nil
 }
 
-func (c *InputCache) findBestCacheSlot(prompt []input) (*InputCacheSlot, int, error) {
+func (c *InputCache) findBestCacheSlot(prompt []input, adapters []float32) (*InputCacheSlot, int, error) {
 	oldest := time.Now()
 	var oldestSlot *InputCacheSlot
 
@@ -141,7 +199,7 @@ func (c *InputCache) findBestCacheSlot(prompt []input) (*InputCacheSlot, int, er
 	var longestSlot *InputCacheSlot
 
 	for i, s := range c.slots {
-		count := countCommonPrefix(s.Inputs, prompt)
+		count := s.commonPrefix(prompt, adapters)
 		if count > longest {
 			longest = count
 			longestSlot = &c.slots[i]
@@ -167,6 +225,10 @@ func (c *InputCache) findBestCacheSlot(prompt []input) (*InputCacheSlot, int, er
 	}
 
 	if longest > 0 && longestSlot != oldestSlot {
+		if c.prefixes != nil {
+			c.savePrefix(oldestSlot, 0)
+		}
+
 		slog.Debug("forking cache slot", "src", longestSlot.Id, "dst", oldestSlot.Id, "inputs", longest, "total",
 			len(longestSlot.Inputs))
 		oldestSlot.Inputs = make([]input, longest)
@@ -181,6 +243,55 @@ func (c *InputCache) findBestCacheSlot(prompt []input) (*InputCacheSlot, int, er
 	return oldestSlot, longest, nil
 }
 
+// savePrefix stores the inputs of slot beyond the first keep in the prefix
+// cache before they are removed, so they can be restored for a later prompt.
+func (c *InputCache) savePrefix(slot *InputCacheSlot, keep int) {
+	n := len(prefixHashes(slot.Inputs)) * prefixBlock
+	if n <= keep || slot.Adapters != nil || c.prefixes.Contains(slot.Inputs[:n]) {
+		return
+	}
+
+	// only store whole blocks
+	if !c.lc.KvCacheSeqRm(slot.Id, n, -1) {
+		return
+	}
+	slot.Inputs = slot.Inputs[:n]
+
+	c.prefixes.Store(slot.Inputs, c.lc.StateSeqGetData(slot.Id))
+}
+
+// restorePrefix loads the longest prefix of prompt in the prefix cache into
+// slot if it is longer than the numPast inputs already there, and returns
+// the number of inputs of prompt in slot.
+func (c *InputCache) restorePrefix(slot *InputCacheSlot, prompt []input, numPast int) int {
+	e, n := c.prefixes.Lookup(prompt)
+	if e == nil || n <= numPast {
+		return numPast
+	}
+
+	c.lc.KvCacheSeqRm(slot.Id, 0, -1)
+	if !c.lc.StateSeqSetData(slot.Id, e.data) {
+		slog.Debug("couldn't restore prompt prefix", "id", slot.Id, "inputs", len(e.inputs))
+		c.lc.KvCacheSeqRm(slot.Id, 0, -1)
+		slot.Inputs = []input{}
+		return 0
+	}
+
+	slog.Debug("restoring prompt prefix", "id", slot.Id, "inputs", n, "prompt", len(prompt))
+	slot.Inputs = slices.Clone(e.inputs)
+	return n
+}
+
+// commonPrefix returns the number of inputs at the start of prompt in the
+// slot, which is 0 if they were evaluated with other adapters.
+func (s *InputCacheSlot) commonPrefix(prompt []input, adapters []float32) int {
+	if !slices.Equal(s.Adapters, adapters) {
+		return 0
+	}
+
+	return countCommonPrefix(s.Inputs, prompt)
+}
+
 func countCommonPrefix(a []input, b []input) int {
 	var count int
 
@@ -213,6 +324,14 @@ func (c *InputCache) ShiftDiscard(inputLen int, numKeep int) int {
 	return discard
 }
 
+// SlideDiscard returns the number of inputs to discard from a slot holding
+// inputLen inputs so that n more fit, discarding as few as possible while
+// keeping the first numKeep.
+func (c *InputCache) SlideDiscard(inputLen int, numKeep int, n int) int {
+	discard := min(inputLen+n-c.numCtx, inputLen-numKeep)
+	return max(discard, 0)
+}
+
 type ErrReprocessInputs struct {
 	Inputs []input
 }
@@ -226,12 +345,23 @@ func (e *ErrReprocessInputs) Error() string {
 //
 // Assumes that at least 1 entry can be freed up by shifting (i.e. numKeep < numCtx)
 func (c *InputCache) ShiftCacheSlot(slot *InputCacheSlot, numKeep int) error {
+	return c.discardCacheSlot(slot, numKeep, c.ShiftDiscard(len(slot.Inputs), numKeep))
+}
+
+// SlideCacheSlot frees up space in the KV cache for n more inputs by deleting
+// as few of the oldest inputs after the first numKeep as possible. The first
+// inputs act as attention sinks, so the model stays stable while it attends
+// to them and a window of the latest inputs.
+func (c *InputCache) SlideCacheSlot(slot *InputCacheSlot, numKeep int, n int) error {
+	return c.discardCacheSlot(slot, numKeep, c.SlideDiscard(len(slot.Inputs), numKeep, n))
+}
+
+func (c *InputCache) discardCacheSlot(slot *InputCacheSlot, numKeep int, discard int) error {
 	if numKeep >= c.numCtx {
 		return fmt.Errorf("unable to shift context - keep exceeds context (keep: %v context: %v)", numKeep, c.numCtx)
 	}
 
 	inputLen := len(slot.Inputs)
-	discard := c.ShiftDiscard(inputLen, numKeep)
 
 	if discard <= 0 {
 		return nil
@@ -205,7 +205,7 @@ func TestFindCacheSlot(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run("Longest-"+tt.name, func(t *testing.T) {
-			result, resultLen, err := tt.cache.findLongestCacheSlot(tt.prompt)
+			result, resultLen, err := tt.cache.findLongestCacheSlot(tt.prompt, nil)
 			if err != nil {
 				t.Errorf("findLongestCacheSlot: err %v", err)
 			} else if result.Id != tt.longest.result || resultLen != tt.longest.len {
@@ -217,7 +217,7 @@ func TestFindCacheSlot(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run("Best-"+tt.name, func(t *testing.T) {
-			result, resultLen, err := tt.cache.findBestCacheSlot(tt.prompt)
+			result, resultLen, err := tt.cache.findBestCacheSlot(tt.prompt, nil)
 			if err != nil {
 				t.Errorf("findBestCacheSlot: err %v", err)
 			} else if result.Id != tt.best.result || resultLen != tt.best.len {
@@ -228,6 +228,44 @@ func TestFindCacheSlot(t *testing.T) {
 	}
 }
 
+func TestFindCacheSlotAdapters(t *testing.T) {
+	cache := InputCache{slots: []InputCacheSlot{
+		{
+			Id:       0,
+			Inputs:   []input{{token: 1}, {token: 2}},
+			Adapters: []float32{0, 1},
+			lastUsed: time.Now().Add(-time.Second),
+		},
+		{
+			Id:       1,
+			Inputs:   []input{{token: 1}},
+			lastUsed: time.Now().Add(-2 * time.Second),
+		},
+	}}
+	prompt := []input{{token: 1}, {token: 2}, {token: 3}}
+
+	// the inputs of a slot are only used with the adapters they were
+	// evaluated with
+	for _, tt := range []struct {
+		adapters []float32
+		slot     int
+		len      int
+	}{
+		{nil, 1, 1},
+		{[]float32{0, 1}, 0, 2},
+		{[]float32{1, 0}, 0, 0},
+	} {
+		slot, n, err := cache.findLongestCacheSlot(prompt, tt.adapters)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if slot.Id != tt.slot || n != tt.len {
+			t.Errorf("adapters %v: got slot %d with %d inputs, want slot %d with %d", tt.adapters, slot.Id, n, tt.slot, tt.len)
+		}
+	}
+}
+
 func TestShiftDiscard(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -290,3 +328,57 @@ func TestShiftDiscard(t *testing.T) {
 		})
 	}
 }
+
+func TestSlideDiscard(t *testing.T) {
+	tests := []struct {
+		name     string
+		numCtx   int
+		numKeep  int
+		inputLen int
+		n        int
+		expected int
+	}{
+		{
+			name:     "Next Token",
+			numCtx:   2048,
+			numKeep:  4,
+			inputLen: 2048,
+			n:        1,
+			expected: 1,
+		},
+		{
+			name:     "Remaining Prompt",
+			numCtx:   2048,
+			numKeep:  4,
+			inputLen: 2040,
+			n:        100,
+			expected: 92,
+		},
+		{
+			name:     "Keep Sinks",
+			numCtx:   2048,
+			numKeep:  4,
+			inputLen: 2048,
+			n:        4000,
+			expected: 2044,
+		},
+		{
+			name:     "No Op",
+			numCtx:   2048,
+			numKeep:  4,
+			inputLen: 512,
+			n:        1,
+			expected: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := InputCache{numCtx: tt.numCtx}
+			result := c.SlideDiscard(tt.inputLen, tt.numKeep, tt.n)
+			if result != tt.expected {
+				t.Errorf("slideDiscard(ctx: %v, keep: %v input: %v n: %v): have %v; want %v", tt.numCtx, tt.numKeep, tt.inputLen, tt.n, result, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package llamarunner
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/goobla/goobla/llama"
+)
+
+// maxDraftTokens is the most tokens proposed by the draft model at once
+const maxDraftTokens = 8
+
+// draftContext proposes the next tokens of sequences with a smaller model
+// sharing the model's vocabulary. The proposals are added to the batch after
+// the sequence's next input, and kept for as long as they match the tokens
+// sampled from the model, so several tokens can be generated for the cost of
+// one decode of the model.
+type draftContext struct {
+	model   *llama.Model
+	lc      *llama.Context
+	sampler *llama.SamplingContext
+	batch   *llama.Batch
+
+	// inputs in the draft model's KV cache for each cache slot
+	inputs [][]input
+}
+
+func newDraftContext(target *llama.Model, path string, params llama.ModelParams, ctxParams llama.ContextParams, batchSize int, numSlots int) (*draftContext, error) {
+	model, err := llama.LoadModelFromFile(path, params)
+	if err != nil {
+		return nil, err
+	}
+
+	if model.NumVocab() != target.NumVocab() || model.AddBOSToken() != target.AddBOSToken() {
+		llama.FreeModel(model)
+		return nil, errors.New("draft model vocabulary doesn't match the model")
+	}
+
+	lc, err := llama.NewContextWithModel(model, ctxParams)
+	if err != nil {
+		llama.FreeModel(model)
+		return nil, err
+	}
+
+	// proposals are the draft model's most likely tokens
+	sampler, err := llama.NewSamplingContext(model, llama.SamplingParams{TopK: 1})
+	if err != nil {
+		llama.FreeModel(model)
+		return nil, err
+	}
+
+	batch, err := llama.NewBatch(batchSize, 1, 0)
+	if err != nil {
+		llama.FreeModel(model)
+		return nil, err
+	}
+
+	return &draftContext{
+		model:   model,
+		lc:      lc,
+		sampler: sampler,
+		batch:   batch,
+		inputs:  make([][]input, numSlots),
+	}, nil
+}
+
+// propose returns up to n tokens to follow the inputs in cache slot id and
+// next, the sequence's next input. Sequences with images can't be drafted.
+func (d *draftContext) propose(id int, cached []input, next input, n int) ([]int, error) {
+	if n <= 0 || next.embed != nil {
+		return nil, nil
+	}
+
+	for _, input := range cached {
+		if input.embed != nil {
+			return nil, nil
+		}
+	}
+
+	// reuse what's already in the draft model's cache, but evaluate at
+	// least next for the logits of the first proposal
+	numPast := 0
+	for numPast < min(len(d.inputs[id]), len(cached)) && d.inputs[id][numPast].token == cached[numPast].token {
+		numPast++
+	}
+
+	if !d.lc.KvCacheSeqRm(id, numPast, -1) {
+		d.lc.KvCacheSeqRm(id, 0, -1)
+		numPast = 0
+	}
+	d.inputs[id] = d.inputs[id][:numPast]
+
+	if err := d.decode(id, append(slices.Clip(cached[numPast:]), next)); err != nil {
+		return nil, err
+	}
+
+	var tokens []int
+	for {
+		token := d.sampler.Sample(d.lc, d.batch.NumTokens()-1)
+		if d.model.TokenIsEog(token) {
+			break
+		}
+
+		tokens = append(tokens, token)
+		if len(tokens) == n {
+			break
+		}
+
+		if err := d.decode(id, []input{{token: token}}); err != nil {
+			return nil, err
+		}
+	}
+
+	return tokens, nil
+}
+
+// decode adds inputs to the draft model's cache for slot id, leaving the
+// logits of the last one in d.lc.
+func (d *draftContext) decode(id int, inputs []input) error {
+	for len(inputs) > 0 {
+		d.batch.Clear()
+
+		n := min(len(inputs), d.batch.Size())
+		for i, input := range inputs[:n] {
+			d.batch.Add(input.token, nil, len(d.inputs[id])+i, i+1 == n, id)
+		}
+
+		if err := d.lc.Decode(d.batch); err != nil {
+			// the draft model's cache no longer matches its inputs
+			d.lc.KvCacheSeqRm(id, 0, -1)
+			d.inputs[id] = nil
+			return fmt.Errorf("failed to decode draft batch: %w", err)
+		}
+
+		d.inputs[id] = append(d.inputs[id], inputs[:n]...)
+		inputs = inputs[n:]
+	}
+
+	return nil
+}
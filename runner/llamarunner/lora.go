@@ -0,0 +1,65 @@
+package llamarunner
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+)
+
+// The LoRA adapters of a model are all loaded with it, and each request can
+// apply a different set of them with different scales. The adapters apply to
+// the whole context, so each batch only evaluates sequences with the same
+// adapters, and they are set again when the next batch's differ.
+
+// adapterScales returns the scales of the LoRA adapters for the adapter
+// option of a request, which has the scale of each adapter by its index, or
+// nil if all of them are applied with scale 1.
+func (s *Server) adapterScales(adapter map[string]float32) ([]float32, error) {
+	if adapter == nil {
+		return nil, nil
+	}
+
+	scales := make([]float32, len(s.loras))
+	for k, scale := range adapter {
+		i, err := strconv.Atoi(k)
+		if err != nil || i < 0 || i >= len(scales) {
+			return nil, fmt.Errorf("model has no adapter %q", k)
+		}
+		scales[i] = scale
+	}
+
+	if !slices.ContainsFunc(scales, func(s float32) bool { return s != 1 }) {
+		return nil, nil
+	}
+
+	return scales, nil
+}
+
+// setAdapters applies the LoRA adapters with scales to the context, or all of
+// them with scale 1 if scales is nil, unless they already are.
+func (s *Server) setAdapters(scales []float32) error {
+	if slices.Equal(s.adapters, scales) {
+		return nil
+	}
+
+	apply := scales
+	if apply == nil {
+		apply = defaultAdapterScales(len(s.loras))
+	}
+
+	if err := s.lc.SetLoraAdapters(s.loras, apply); err != nil {
+		return err
+	}
+
+	s.adapters = scales
+	return nil
+}
+
+// defaultAdapterScales returns the scales that apply n adapters as they are.
+func defaultAdapterScales(n int) []float32 {
+	scales := make([]float32, n)
+	for i := range scales {
+		scales[i] = 1
+	}
+	return scales
+}
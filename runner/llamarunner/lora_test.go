@@ -0,0 +1,39 @@
+package llamarunner
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/goobla/goobla/llama"
+)
+
+func TestAdapterScales(t *testing.T) {
+	s := Server{loras: make([]*llama.LoraAdapter, 2)}
+
+	cases := []struct {
+		adapter map[string]float32
+		want    []float32
+	}{
+		{nil, nil},
+		{map[string]float32{"0": 1, "1": 1}, nil},
+		{map[string]float32{"1": 0.5}, []float32{0, 0.5}},
+		{map[string]float32{}, []float32{0, 0}},
+	}
+
+	for _, tt := range cases {
+		got, err := s.adapterScales(tt.adapter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !slices.Equal(got, tt.want) || (got == nil) != (tt.want == nil) {
+			t.Errorf("%v: got %v, want %v", tt.adapter, got, tt.want)
+		}
+	}
+
+	for _, adapter := range []string{"2", "-1", "support"} {
+		if _, err := s.adapterScales(map[string]float32{adapter: 1}); err == nil {
+			t.Errorf("%s: expected an error", adapter)
+		}
+	}
+}
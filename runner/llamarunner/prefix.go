@@ -0,0 +1,165 @@
+package llamarunner
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// prefixBlock is the number of inputs prompt prefixes are stored and
+// matched in multiples of.
+const prefixBlock = 64
+
+// PrefixCache holds copies of the KV cache for prompt prefixes that are no
+// longer in a cache slot, such as a long system prompt shared by many
+// conversations, so they can be restored instead of evaluated again.
+//
+// Prefixes are found by the hash of their tokens at each multiple of
+// prefixBlock, so an entry can also be restored for a prompt that only
+// shares its beginning.
+type PrefixCache struct {
+	// maximum size in bytes of the stored KV caches
+	maxSize int
+	size    int
+
+	entries []*prefixEntry
+
+	// index maps the hash of each prefix of an entry to the entry and
+	// the number of inputs in the prefix
+	index map[uint64]prefixRef
+}
+
+type prefixEntry struct {
+	inputs   []input
+	hashes   []uint64
+	data     []byte
+	lastUsed time.Time
+}
+
+type prefixRef struct {
+	entry *prefixEntry
+	n     int
+}
+
+func NewPrefixCache(maxSize int) *PrefixCache {
+	return &PrefixCache{
+		maxSize: maxSize,
+		index:   make(map[uint64]prefixRef),
+	}
+}
+
+// prefixHashes returns the hash of inputs up to each multiple of
+// prefixBlock. Image embeddings aren't hashed, so prefixes stop at the
+// first one.
+func prefixHashes(inputs []input) []uint64 {
+	var hashes []uint64
+
+	h := fnv.New64a()
+	var b [8]byte
+	for i, inp := range inputs {
+		if inp.embed != nil {
+			break
+		}
+
+		binary.LittleEndian.PutUint64(b[:], uint64(inp.token))
+		h.Write(b[:])
+
+		if (i+1)%prefixBlock == 0 {
+			hashes = append(hashes, h.Sum64())
+		}
+	}
+
+	return hashes
+}
+
+// Lookup returns the entry with the longest prefix in common with prompt
+// and the number of inputs in that prefix, or nil if there isn't one.
+func (c *PrefixCache) Lookup(prompt []input) (*prefixEntry, int) {
+	hashes := prefixHashes(prompt)
+	for i := len(hashes) - 1; i >= 0; i-- {
+		ref, ok := c.index[hashes[i]]
+		// check the inputs in case of a hash collision
+		if !ok || countCommonPrefix(ref.entry.inputs[:ref.n], prompt) < ref.n {
+			continue
+		}
+
+		ref.entry.lastUsed = time.Now()
+		return ref.entry, ref.n
+	}
+
+	return nil, 0
+}
+
+// Contains reports whether all of inputs can be restored from the cache.
+func (c *PrefixCache) Contains(inputs []input) bool {
+	hashes := prefixHashes(inputs)
+	if len(hashes) == 0 || len(hashes)*prefixBlock != len(inputs) {
+		return false
+	}
+
+	ref, ok := c.index[hashes[len(hashes)-1]]
+	return ok && ref.n == len(inputs)
+}
+
+// Store adds data, the KV cache for inputs, evicting the least recently used
+// entries to make room. inputs should be a multiple of prefixBlock long.
+func (c *PrefixCache) Store(inputs []input, data []byte) {
+	hashes := prefixHashes(inputs)
+	if len(hashes) == 0 || len(data) > c.maxSize {
+		return
+	}
+
+	for c.size+len(data) > c.maxSize {
+		c.evict()
+	}
+
+	e := &prefixEntry{
+		inputs:   slices.Clone(inputs[:len(hashes)*prefixBlock]),
+		hashes:   hashes,
+		data:     data,
+		lastUsed: time.Now(),
+	}
+
+	c.entries = append(c.entries, e)
+	c.size += len(data)
+
+	// later entries take over prefixes they share with earlier ones
+	for i, h := range hashes {
+		c.index[h] = prefixRef{entry: e, n: (i + 1) * prefixBlock}
+	}
+
+	slog.Debug("storing prompt prefix", "inputs", len(e.inputs), "size", len(data), "entries", len(c.entries), "total", c.size)
+}
+
+// evict removes the least recently used entry.
+func (c *PrefixCache) evict() {
+	i := 0
+	for j, e := range c.entries {
+		if e.lastUsed.Before(c.entries[i].lastUsed) {
+			i = j
+		}
+	}
+
+	e := c.entries[i]
+	c.entries = slices.Delete(c.entries, i, i+1)
+	c.size -= len(e.data)
+
+	for _, h := range e.hashes {
+		if ref, ok := c.index[h]; ok && ref.entry == e {
+			delete(c.index, h)
+		}
+	}
+
+	// hand prefixes the entry took over back to the others that share them
+	for _, other := range c.entries {
+		for i, h := range other.hashes {
+			if _, ok := c.index[h]; !ok {
+				c.index[h] = prefixRef{entry: other, n: (i + 1) * prefixBlock}
+			}
+		}
+	}
+
+	slog.Debug("evicting prompt prefix", "inputs", len(e.inputs), "size", len(e.data), "used", e.lastUsed)
+}
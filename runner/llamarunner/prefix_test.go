@@ -0,0 +1,87 @@
+package llamarunner
+
+import (
+	"testing"
+)
+
+func tokens(start, n int) []input {
+	inputs := make([]input, n)
+	for i := range inputs {
+		inputs[i] = input{token: start + i}
+	}
+	return inputs
+}
+
+func TestPrefixHashes(t *testing.T) {
+	if got := len(prefixHashes(tokens(0, prefixBlock-1))); got != 0 {
+		t.Errorf("partial block: got %d hashes, want 0", got)
+	}
+
+	a := prefixHashes(tokens(0, 3*prefixBlock+5))
+	if len(a) != 3 {
+		t.Fatalf("got %d hashes, want 3", len(a))
+	}
+
+	// prompts that share their first block share its hash
+	b := prefixHashes(append(tokens(0, prefixBlock), tokens(1000, prefixBlock)...))
+	if a[0] != b[0] || a[1] == b[1] {
+		t.Errorf("got %v and %v, want only the first hash shared", a, b)
+	}
+
+	// hashes stop at image embeddings
+	withEmbed := append(tokens(0, prefixBlock+1), input{embed: []float32{1}})
+	withEmbed = append(withEmbed, tokens(0, prefixBlock)...)
+	if got := len(prefixHashes(withEmbed)); got != 1 {
+		t.Errorf("embedding: got %d hashes, want 1", got)
+	}
+}
+
+func TestPrefixCache(t *testing.T) {
+	c := NewPrefixCache(250)
+
+	system := tokens(0, 2*prefixBlock)
+	c.Store(append(system, tokens(1000, prefixBlock)...), make([]byte, 100))
+
+	if !c.Contains(append(system, tokens(1000, prefixBlock)...)) {
+		t.Error("stored prefix not found")
+	}
+
+	if !c.Contains(system) {
+		t.Error("start of stored prefix not found")
+	}
+
+	// a prompt sharing only the system prompt restores that much
+	e, n := c.Lookup(append(system, tokens(2000, 10)...))
+	if e == nil || n != len(system) {
+		t.Errorf("shared prefix: got %d inputs, want %d", n, len(system))
+	}
+
+	if e, _ := c.Lookup(tokens(5000, 3*prefixBlock)); e != nil {
+		t.Error("unrelated prompt found an entry")
+	}
+
+	// storing more than fits evicts the least recently used entry
+	c.Store(append(system, tokens(2000, prefixBlock)...), make([]byte, 100))
+	c.Lookup(append(system, tokens(1000, prefixBlock)...))
+	c.Store(tokens(3000, prefixBlock), make([]byte, 100))
+
+	if c.size != 200 || len(c.entries) != 2 {
+		t.Fatalf("got %d entries of %d bytes, want 2 of 200", len(c.entries), c.size)
+	}
+
+	if c.Contains(append(system, tokens(2000, prefixBlock)...)) {
+		t.Error("least recently used entry wasn't evicted")
+	}
+
+	// the system prompt is still found in the remaining entry
+	e, n = c.Lookup(system)
+	if e == nil || n != len(system) {
+		t.Errorf("after eviction: got %d inputs, want %d", n, len(system))
+	}
+
+	// entries larger than the cache aren't stored
+	c.Store(tokens(4000, prefixBlock), make([]byte, 300))
+	if c.Contains(tokens(4000, prefixBlock)) {
+		t.Error("oversized entry was stored")
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"os"
 	"regexp"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -27,6 +28,7 @@ import (
 	"github.com/goobla/goobla/llm"
 	"github.com/goobla/goobla/logutil"
 	"github.com/goobla/goobla/runner/common"
+	"github.com/goobla/goobla/sample"
 )
 
 // input is an element of the prompt to process, either
@@ -54,11 +56,35 @@ type Sequence struct {
 	// tokens that have been generated but not returned yet (e.g. for stop sequences)
 	pendingResponses []string
 
+	// log probabilities of the tokens in pendingResponses, if requested
+	pendingLogprobs []api.Logprob
+
+	// tokens proposed by the draft model, at the end of inputs
+	drafts []int
+
+	// tokens of a completion to score instead of generating one, at the end
+	// of inputs, their log probabilities so far, and the batch indexes of
+	// the logits predicting them in the current batch
+	score      []int
+	scored     []api.Logprob
+	scoreBatch []int
+
+	// beam search decoding in place of sampling, if enabled, with the cache
+	// slot of each beam, starting with the sequence's own, and the batch
+	// indexes of their last tokens
+	beams     *common.BeamSearch
+	beamSlots []*InputCacheSlot
+	beamBatch []int
+
 	// input cache being used by this sequence
 	cache *InputCacheSlot
 
+	// scales of the LoRA adapters the sequence is evaluated with, or nil for
+	// all of them with scale 1
+	adapters []float32
+
 	// channel to send responses over
-	responses chan string
+	responses chan llm.CompletionResponse
 
 	// channel to stop decoding (such as if the remote connection is closed)
 	quit chan bool
@@ -74,12 +100,31 @@ type Sequence struct {
 	// stop sequences
 	stop []string
 
+	// tokens that end the response, in addition to end of sequence tokens
+	stopTokenIDs []int
+
+	// whether to return the log probabilities of generated tokens, and how
+	// many of the most likely alternatives to return with them
+	logprobs    bool
+	topLogprobs int
+
 	// number of inputs to keep at the beginning when shifting context window
 	numKeep int
 
+	// whether the context shifts when it's full, or the sequence ends
+	shift bool
+
+	// whether the context slides by as few inputs as possible when it's
+	// full, keeping numKeep inputs as attention sinks, rather than
+	// discarding half of it
+	slide bool
+
 	// true if an embedding are to be returned instead of text generation
 	embeddingOnly bool
 
+	// path of the session file to save the cache to when done, if set
+	session string
+
 	doneReason llm.DoneReason
 
 	// Metrics
@@ -87,6 +132,29 @@ type Sequence struct {
 	startGenerationTime time.Time
 	numDecoded          int
 	numPromptInputs     int
+	numCachedInputs     int
+	numImageInputs      int
+}
+
+// progress returns the counts of the sequence so far. s.mu must be held.
+func (seq *Sequence) progress() llm.CompletionResponse {
+	resp := llm.CompletionResponse{
+		Progress:        true,
+		PromptTokens:    seq.numPromptInputs,
+		PromptEvalCount: seq.numPromptInputs,
+		EvalCount:       seq.numDecoded,
+	}
+
+	if seq.numDecoded == 0 {
+		// still processing the prompt
+		resp.PromptEvalCount = max(seq.numPromptInputs-len(seq.inputs), 0)
+		resp.PromptEvalDuration = time.Since(seq.startProcessingTime)
+	} else {
+		resp.PromptEvalDuration = seq.startGenerationTime.Sub(seq.startProcessingTime)
+		resp.EvalDuration = time.Since(seq.startGenerationTime)
+	}
+
+	return resp
 }
 
 type NewSequenceParams struct {
@@ -94,7 +162,20 @@ type NewSequenceParams struct {
 	stop           []string
 	numKeep        int
 	samplingParams *llama.SamplingParams
+	logitBias      map[string]float32
+	stopTokenIDs   []int
+	logprobs       bool
+	topLogprobs    int
+	numBeams       int
+	lengthPenalty  float32
+	score          string
 	embedding      bool
+
+	// contextOverflow is the context_overflow policy of the request
+	contextOverflow string
+
+	// adapter is the adapter option of the request, by index
+	adapter map[string]float32
 }
 
 func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSequenceParams) (*Sequence, error) {
@@ -102,6 +183,11 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 
 	startTime := time.Now()
 
+	adapters, err := s.adapterScales(params.adapter)
+	if err != nil {
+		return nil, err
+	}
+
 	inputs, err := s.inputs(prompt, images)
 	if err != nil {
 		return nil, fmt.Errorf("failed to process inputs: %w", err)
@@ -109,9 +195,25 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 		return nil, errors.New("no input provided")
 	}
 
+	var score []int
+	if params.score != "" {
+		score, err = s.model.Tokenize(params.score, false, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to process completion: %w", err)
+		} else if len(score) == 0 {
+			return nil, errors.New("no completion provided")
+		}
+
+		// unlike a prompt, a completion being scored can't be truncated
+		if len(inputs)+len(score) > s.cache.numCtx {
+			return nil, fmt.Errorf("prompt and completion of %d tokens exceed the context length of %d", len(inputs)+len(score), s.cache.numCtx)
+		}
+	}
+
 	if params.numKeep < 0 {
 		params.numKeep = len(inputs)
 	}
+	params.numKeep = common.NumKeep(params.numKeep, params.contextOverflow)
 
 	if s.model.AddBOSToken() {
 		params.numKeep += 1
@@ -121,6 +223,10 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 	params.numKeep = min(params.numKeep, s.cache.numCtx-1)
 
 	if len(inputs) > s.cache.numCtx {
+		if !common.ShiftsContext(params.contextOverflow) {
+			return nil, fmt.Errorf("prompt of %d tokens exceeds the context length of %d", len(inputs), s.cache.numCtx)
+		}
+
 		discard := len(inputs) - s.cache.numCtx
 		newInputs := inputs[:params.numKeep]
 		newInputs = append(newInputs, inputs[params.numKeep+discard:]...)
@@ -131,6 +237,13 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 
 	var sc *llama.SamplingContext
 	if params.samplingParams != nil {
+		params.samplingParams.LogitBias, err = common.LogitBias(params.logitBias, s.model.NumVocab(), func(text string) ([]int, error) {
+			return s.model.Tokenize(text, false, true)
+		})
+		if err != nil {
+			return nil, err
+		}
+
 		sc, err = llama.NewSamplingContext(s.model, *params.samplingParams)
 		if err != nil {
 			return nil, err
@@ -142,22 +255,71 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 		}
 	}
 
+	var numImageInputs int
+	for _, input := range inputs {
+		if input.embed != nil {
+			numImageInputs++
+		}
+	}
+
+	var beams *common.BeamSearch
+	if params.numBeams > 1 && score == nil {
+		beams = common.NewBeamSearch(params.numBeams, params.lengthPenalty)
+	}
+
 	return &Sequence{
 		inputs:              inputs,
-		numPromptInputs:     len(inputs),
+		score:               score,
+		numPromptInputs:     len(inputs) + len(score),
+		numImageInputs:      numImageInputs,
 		startProcessingTime: startTime,
 		numPredict:          params.numPredict,
 		pendingResponses:    make([]string, 0),
-		responses:           make(chan string, 100),
+		responses:           make(chan llm.CompletionResponse, 100),
 		quit:                make(chan bool, 1),
 		embedding:           make(chan []float32, 1),
 		samplingCtx:         sc,
 		embeddingOnly:       params.embedding,
 		stop:                params.stop,
+		stopTokenIDs:        params.stopTokenIDs,
+		logprobs:            params.logprobs,
+		topLogprobs:         params.topLogprobs,
+		beams:               beams,
+		adapters:            adapters,
 		numKeep:             params.numKeep,
+		shift:               common.ShiftsContext(params.contextOverflow),
+		slide:               common.SlidesContext(params.contextOverflow),
 	}, nil
 }
 
+// predictsScore reports whether the input at i predicts the next token of
+// the completion being scored, which is the input after it.
+func (seq *Sequence) predictsScore(i int) bool {
+	// the tokens being scored are the last of the inputs left
+	first := len(seq.inputs) - min(len(seq.score)-len(seq.scored)-len(seq.scoreBatch), len(seq.inputs))
+	return i+1 >= first && i+1 < len(seq.inputs)
+}
+
+// canceled reports whether the request of the sequence has gone, such as by
+// its client disconnecting.
+func (seq *Sequence) canceled() bool {
+	select {
+	case <-seq.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// slots returns the number of cache slots the sequence uses.
+func (seq *Sequence) slots() int {
+	if seq.beams != nil {
+		return seq.beams.Width
+	}
+
+	return 1
+}
+
 // inputs processes the prompt and images into a list of inputs
 // by splitting the prompt on [img-<n>] tags, tokenizing text and
 // generating image embeddings for each image
@@ -239,6 +401,10 @@ type Server struct {
 	// TODO (jmorganca): make this n_batch
 	batchSize int
 
+	// maximum number of inputs in a batch across all sequences, or 0 for no
+	// limit beyond batchSize per sequence
+	maxBatch int
+
 	// protects access to everything below this line
 	// this is context state needed for decoding
 	mu sync.Mutex
@@ -259,6 +425,14 @@ type Server struct {
 	// KV cache
 	cache *InputCache
 
+	// draft model for speculative decoding, if any
+	draft *draftContext
+
+	// LoRA adapters of the model, and the scales they are applied to lc
+	// with, or nil for all of them with scale 1
+	loras    []*llama.LoraAdapter
+	adapters []float32
+
 	// next sequence for prompt processing to avoid starvation
 	nextSeq int
 }
@@ -274,7 +448,9 @@ func (s *Server) allNil() bool {
 
 func flushPending(seq *Sequence) bool {
 	joined := strings.Join(seq.pendingResponses, "")
+	logprobs := seq.pendingLogprobs
 	seq.pendingResponses = []string{}
+	seq.pendingLogprobs = nil
 
 	// Check if there are any partial UTF-8 characters remaining.
 	// We already check and queue as we are generating but some may
@@ -291,7 +467,7 @@ func flushPending(seq *Sequence) bool {
 	}
 
 	select {
-	case seq.responses <- joined:
+	case seq.responses <- llm.CompletionResponse{Content: joined, Logprobs: logprobs}:
 		return true
 	case <-seq.quit:
 		return false
@@ -303,11 +479,22 @@ func (s *Server) removeSequence(seqIndex int, reason llm.DoneReason) {
 
 	flushPending(seq)
 	seq.doneReason = reason
+
+	if seq.beams != nil {
+		s.releaseBeams(seq)
+	}
+
+	if seq.session != "" && seq.adapters == nil {
+		if err := s.cache.SaveSession(seq.cache, seq.session); err != nil {
+			slog.Warn("couldn't save session", "error", err)
+		}
+	}
+
 	close(seq.responses)
 	close(seq.embedding)
 	seq.cache.InUse = false
 	s.seqs[seqIndex] = nil
-	s.seqsSem.Release(1)
+	s.seqsSem.Release(int64(seq.slots()))
 }
 
 func (s *Server) run(ctx context.Context) {
@@ -365,25 +552,75 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 
 	var batch *llama.Batch
 
-	seqIdx := s.nextSeq - 1
-	for range s.seqs {
-		seqIdx = (seqIdx + 1) % len(s.seqs)
+	// the adapters apply to the whole batch, so it only has the inputs of
+	// sequences with the same adapters as the first. The first sequence
+	// left out starts the next batch
+	var adapters []float32
+	batched, deferred := false, -1
+
+	for _, seqIdx := range s.batchOrder() {
 		seq := s.seqs[seqIdx]
 
-		if seq == nil {
+		// the request has gone, so its sequence ends now rather than when
+		// its next response can't be sent, which may be many steps away
+		if seq.canceled() {
+			s.removeSequence(seqIdx, llm.DoneReasonConnectionClosed)
 			continue
 		}
 
+		// prompts are only evaluated in the room left by the sequences
+		// that are generating
+		if seq.numDecoded == 0 && s.batchFull(batch) {
+			break
+		}
+
 		// if past the num predict limit
 		if seq.numPredict > 0 && seq.numPredicted >= seq.numPredict {
 			s.removeSequence(seqIdx, llm.DoneReasonLength)
 			continue
 		}
 
+		if !batched {
+			adapters, batched = seq.adapters, true
+		} else if !slices.Equal(seq.adapters, adapters) {
+			if deferred < 0 {
+				deferred = seqIdx
+			}
+			continue
+		}
+
+		if seq.beams != nil && seq.numDecoded > 0 {
+			if batch == nil {
+				batch = tokenBatch
+			}
+
+			if batch.IsEmbedding() || !s.addBeams(seq, batch) {
+				s.nextSeq = seqIdx
+			}
+			continue
+		}
+
+		if s.draft != nil && len(seq.drafts) == 0 {
+			s.propose(seq)
+		}
+
 		for i, input := range seq.inputs {
+			if seq.numDecoded == 0 && s.batchFull(batch) {
+				s.nextSeq = seqIdx
+				break
+			}
+
 			if len(seq.cache.Inputs)+len(seq.pendingInputs)+1 > s.cache.numCtx {
-				if len(seq.pendingInputs) == 0 {
-					err := s.cache.ShiftCacheSlot(seq.cache, seq.numKeep)
+				if len(seq.pendingInputs) == 0 && !seq.shift {
+					s.removeSequence(seqIdx, llm.DoneReasonLength)
+					break
+				} else if len(seq.pendingInputs) == 0 {
+					var err error
+					if seq.slide {
+						err = s.cache.SlideCacheSlot(seq.cache, seq.numKeep, len(seq.inputs)-i)
+					} else {
+						err = s.cache.ShiftCacheSlot(seq.cache, seq.numKeep)
+					}
 					if err != nil {
 						var reprocess *ErrReprocessInputs
 						if errors.As(err, &reprocess) {
@@ -421,18 +658,34 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 				break
 			}
 
-			batch.Add(input.token, input.embed, len(seq.cache.Inputs)+len(seq.pendingInputs), i+1 == len(seq.inputs), seq.cache.Id)
+			// logits are needed for the last input, to check each of the
+			// draft model's proposals, and to score each token of a
+			// completion
+			score := seq.predictsScore(i)
+			logits := i >= len(seq.inputs)-len(seq.drafts)-1 || score
+			batch.Add(input.token, input.embed, len(seq.cache.Inputs)+len(seq.pendingInputs), logits, seq.cache.Id)
 			seq.pendingInputs = append(seq.pendingInputs, input)
 			seq.iBatch = batch.NumTokens() - 1
+			if score {
+				seq.scoreBatch = append(seq.scoreBatch, seq.iBatch)
+			}
 		}
 
 		seq.inputs = seq.inputs[len(seq.pendingInputs):]
 	}
 
+	if deferred >= 0 {
+		s.nextSeq = deferred
+	}
+
 	if batch == nil || batch.NumTokens() == 0 {
 		return nil
 	}
 
+	if err := s.setAdapters(adapters); err != nil {
+		return err
+	}
+
 	err := s.lc.Decode(batch)
 	if err != nil {
 		return fmt.Errorf("failed to decode batch: %w", err)
@@ -449,11 +702,22 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 			seq.pendingInputs = []input{}
 		}
 
+		for _, idx := range seq.scoreBatch {
+			token := seq.score[len(seq.scored)]
+			seq.scored = append(seq.scored, common.Logprobs(s.lc.GetLogitsIth(idx), token, seq.topLogprobs, s.model.TokenToPiece))
+		}
+		seq.scoreBatch = nil
+
 		// don't sample prompt processing
 		if len(seq.inputs) != 0 {
 			continue
 		}
 
+		// or beams that weren't in the batch
+		if seq.beams != nil && seq.numDecoded > 0 && len(seq.beamBatch) == 0 {
+			continue
+		}
+
 		seq.numDecoded += 1
 		if seq.numDecoded == 1 {
 			seq.startGenerationTime = time.Now()
@@ -471,68 +735,204 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 			continue
 		}
 
-		// sample a token
-		token := seq.samplingCtx.Sample(s.lc, seq.iBatch)
-		seq.samplingCtx.Accept(token, true)
-		piece := s.model.TokenToPiece(token)
-
-		seq.numPredicted++
-
-		// if it's an end of sequence token, break
-		if s.model.TokenIsEog(token) {
-			// TODO (jmorganca): we should send this back
-			// as it's important for the /api/generate context
-			// seq.responses <- piece
-
+		// or, once its completion is scored, return the log probabilities
+		// with the final response
+		if seq.score != nil {
 			s.removeSequence(i, llm.DoneReasonStop)
 			continue
 		}
 
-		seq.inputs = []input{{token: token}}
+		if seq.beams != nil {
+			s.stepBeams(i, seq)
+			continue
+		}
 
-		seq.pendingResponses = append(seq.pendingResponses, piece)
-		sequence := strings.Join(seq.pendingResponses, "")
+		// sample a token, and then one for each of the draft model's
+		// proposals for as long as they match
+		drafts := seq.drafts
+		seq.drafts = nil
+
+		var tokens []int
+		var logprobs []*api.Logprob
+		for j := 0; j <= len(drafts); j++ {
+			idx := seq.iBatch - len(drafts) + j
+			token := seq.samplingCtx.Sample(s.lc, idx)
+			seq.samplingCtx.Accept(token, true)
+			tokens = append(tokens, token)
+
+			var logprob *api.Logprob
+			if seq.logprobs {
+				lp := common.Logprobs(s.lc.GetLogitsIth(idx), token, seq.topLogprobs, s.model.TokenToPiece)
+				logprob = &lp
+			}
+			logprobs = append(logprobs, logprob)
 
-		if ok, stop := common.FindStop(sequence, seq.stop); ok {
-			slog.Debug("hit stop token", "pending", seq.pendingResponses, "stop", stop)
+			if j == len(drafts) || token != drafts[j] {
+				break
+			}
+		}
 
-			var tokenTruncated bool
-			origLen := len(seq.pendingResponses)
-			seq.pendingResponses, tokenTruncated = common.TruncateStop(seq.pendingResponses, stop)
-			newLen := len(seq.pendingResponses)
+		// only keep the accepted proposals in the cache. processToken
+		// expects each token not to be in the cache's inputs yet, so they
+		// are added back one at a time
+		numCached := len(seq.cache.Inputs) - len(drafts)
+		if len(drafts) > 0 {
+			s.lc.KvCacheSeqRm(seq.cache.Id, numCached+len(tokens)-1, -1)
+		}
+		seq.cache.Inputs = seq.cache.Inputs[:numCached]
+		seq.numDecoded += len(tokens) - 1
 
-			// Update the cache based on the tokens that will be returned:
-			// - We have 1 token more than is currently in the cache because
-			// the last one generated wasn't submitted to Decode
-			// - Remove any stop sequences that we stripped out
-			// - If truncateStop removed a portion of a token, drop that
-			// - As defense-in-depth, if truncatedToken didn't find a stop token
-			// remove the extra one that we added to the cache len
-			tokenLen := len(seq.cache.Inputs) + 1
-			tokenLen -= origLen - newLen
-			if tokenTruncated || origLen == newLen {
-				tokenLen--
+		for j, token := range tokens {
+			if j > 0 {
+				seq.cache.Inputs = append(seq.cache.Inputs, input{token: tokens[j-1]})
 			}
-			seq.cache.Inputs = seq.cache.Inputs[:tokenLen]
 
-			s.removeSequence(i, llm.DoneReasonStop)
-			continue
+			if !s.processToken(i, seq, token, logprobs[j]) {
+				break
+			}
 		}
+	}
 
-		if common.ContainsStopSuffix(sequence, seq.stop) {
-			continue
+	return nil
+}
+
+// batchOrder returns the indexes of the sequences in the order their inputs
+// are added to the next batch. Sequences that are generating come first, so
+// their next tokens aren't held up by long prompts, and each group starts
+// from s.nextSeq to avoid starvation.
+func (s *Server) batchOrder() []int {
+	var generating, prompts []int
+	for i := range s.seqs {
+		seqIdx := (s.nextSeq + i) % len(s.seqs)
+		switch seq := s.seqs[seqIdx]; {
+		case seq == nil:
+		case seq.numDecoded > 0:
+			generating = append(generating, seqIdx)
+		default:
+			prompts = append(prompts, seqIdx)
 		}
+	}
 
-		if common.IncompleteUnicode(sequence) {
-			continue
+	return append(generating, prompts...)
+}
+
+// batchFull reports whether batch has as many inputs as can be evaluated at
+// once across all sequences.
+func (s *Server) batchFull(batch *llama.Batch) bool {
+	return s.maxBatch > 0 && batch != nil && batch.NumTokens() >= s.maxBatch
+}
+
+// propose adds the draft model's proposals for the tokens after the next
+// input of seq to its inputs, if it is generating.
+func (s *Server) propose(seq *Sequence) {
+	if seq.embeddingOnly || seq.numDecoded == 0 || len(seq.inputs) != 1 {
+		return
+	}
+
+	// the proposals must fit in the batch and context, and leave room for
+	// the token sampled after them within the number to predict
+	n := min(maxDraftTokens, s.batchSize-1, s.cache.numCtx-len(seq.cache.Inputs)-1)
+	if seq.numPredict > 0 {
+		n = min(n, seq.numPredict-seq.numPredicted-1)
+	}
+
+	tokens, err := s.draft.propose(seq.cache.Id, seq.cache.Inputs, seq.inputs[0], n)
+	if err != nil {
+		slog.Warn("couldn't propose tokens with the draft model", "error", err)
+		return
+	}
+
+	for _, token := range tokens {
+		seq.inputs = append(seq.inputs, input{token: token})
+	}
+	seq.drafts = tokens
+}
+
+// processToken adds the token sampled for the sequence at seqIndex to its
+// response, along with its log probability if requested, reporting whether
+// the sequence is still generating.
+func (s *Server) processToken(seqIndex int, seq *Sequence, token int, logprob *api.Logprob) bool {
+	piece := s.model.TokenToPiece(token)
+	seq.numPredicted++
+
+	// if it's an end of sequence token, stop
+	if s.model.TokenIsEog(token) || slices.Contains(seq.stopTokenIDs, token) {
+		// TODO (jmorganca): we should send this back
+		// as it's important for the /api/generate context
+		// seq.responses <- piece
+
+		s.removeSequence(seqIndex, llm.DoneReasonStop)
+		return false
+	}
+
+	seq.inputs = []input{{token: token}}
+
+	seq.pendingResponses = append(seq.pendingResponses, piece)
+	if logprob != nil {
+		seq.pendingLogprobs = append(seq.pendingLogprobs, *logprob)
+	}
+	sequence := strings.Join(seq.pendingResponses, "")
+
+	if ok, stop := common.FindStop(sequence, seq.stop); ok {
+		slog.Debug("hit stop token", "pending", seq.pendingResponses, "stop", stop)
+
+		var tokenTruncated bool
+		origLen := len(seq.pendingResponses)
+		seq.pendingResponses, tokenTruncated = common.TruncateStop(seq.pendingResponses, stop)
+		newLen := len(seq.pendingResponses)
+		seq.pendingLogprobs = seq.pendingLogprobs[:min(len(seq.pendingLogprobs), newLen)]
+
+		// Update the cache based on the tokens that will be returned:
+		// - We have 1 token more than is currently in the cache because
+		// the last one generated wasn't submitted to Decode
+		// - Remove any stop sequences that we stripped out
+		// - If truncateStop removed a portion of a token, drop that
+		// - As defense-in-depth, if truncatedToken didn't find a stop token
+		// remove the extra one that we added to the cache len
+		tokenLen := len(seq.cache.Inputs) + 1
+		tokenLen -= origLen - newLen
+		if tokenTruncated || origLen == newLen {
+			tokenLen--
 		}
+		seq.cache.Inputs = seq.cache.Inputs[:tokenLen]
+
+		s.removeSequence(seqIndex, llm.DoneReasonStop)
+		return false
+	}
+
+	if common.ContainsStopSuffix(sequence, seq.stop) || common.IncompleteUnicode(sequence) {
+		return true
+	}
 
-		if !flushPending(seq) {
-			s.removeSequence(i, llm.DoneReasonConnectionClosed)
+	if !flushPending(seq) {
+		s.removeSequence(seqIndex, llm.DoneReasonConnectionClosed)
+		return false
+	}
+
+	return true
+}
+
+// llamaSamplers returns the names llama.cpp has for the samplers in order,
+// or in sample.DefaultOrder if it's empty, so both engines apply them in the
+// same order. llama.cpp checks the grammar against the sampled token, so
+// it's left out.
+func llamaSamplers(order []string) []string {
+	if len(order) == 0 {
+		order = sample.DefaultOrder
+	}
+
+	names := make([]string, 0, len(order))
+	for _, name := range order {
+		switch name {
+		case "grammar":
+		case "typical_p":
+			names = append(names, "typ_p")
+		default:
+			names = append(names, name)
 		}
 	}
 
-	return nil
+	return names
 }
 
 func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
@@ -570,6 +970,31 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		PenaltyPresent: req.Options.PresencePenalty,
 		Seed:           uint32(req.Options.Seed),
 		Grammar:        req.Grammar,
+		Samplers:       llamaSamplers(req.Options.Samplers),
+
+		DynatempRange:    req.Options.DynatempRange,
+		DynatempExponent: req.Options.DynatempExponent,
+		Mirostat:         req.Options.Mirostat,
+		MirostatTau:      req.Options.MirostatTau,
+		MirostatEta:      req.Options.MirostatEta,
+
+		DryMultiplier:       req.Options.DryMultiplier,
+		DryBase:             req.Options.DryBase,
+		DryAllowedLength:    req.Options.DryAllowedLength,
+		DryPenaltyLastN:     req.Options.DryPenaltyLastN,
+		DrySequenceBreakers: req.Options.DrySequenceBreakers,
+	}
+
+	if req.Options.NumBeams > 1 {
+		if req.Options.NumBeams > s.parallel {
+			http.Error(w, fmt.Sprintf("num_beams can be at most %d, the number of parallel sequences", s.parallel), http.StatusBadRequest)
+			return
+		}
+
+		if req.Grammar != "" {
+			http.Error(w, "num_beams can't be used with a format or grammar", http.StatusBadRequest)
+			return
+		}
 	}
 
 	seq, err := s.NewSequence(req.Prompt, req.Images, NewSequenceParams{
@@ -577,15 +1002,26 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		stop:           req.Options.Stop,
 		numKeep:        req.Options.NumKeep,
 		samplingParams: &samplingParams,
+		logitBias:      req.Options.LogitBias,
+		stopTokenIDs:   req.Options.StopTokenIDs,
+		logprobs:       req.Logprobs,
+		topLogprobs:    req.TopLogprobs,
+		numBeams:       req.Options.NumBeams,
+		lengthPenalty:  req.Options.LengthPenalty,
+		score:          req.Score,
 		embedding:      false,
+
+		contextOverflow: req.Options.ContextOverflow,
+		adapter:         req.Options.Adapter,
 	})
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Ensure there is a place to put the sequence, released when removed from s.seqs
-	if err := s.seqsSem.Acquire(r.Context(), 1); err != nil {
+	// Ensure there is a place to put the sequence, and each of its beams,
+	// released when removed from s.seqs
+	if err := s.seqsSem.Acquire(r.Context(), int64(seq.slots())); err != nil {
 		if errors.Is(err, context.Canceled) {
 			slog.Info("aborting completion request due to client closing the connection")
 		} else {
@@ -598,14 +1034,27 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 	found := false
 	for i, sq := range s.seqs {
 		if sq == nil {
-			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, true)
+			seq.session = req.Session
+			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, seq.adapters, true, req.Session)
 			if err != nil {
 				s.mu.Unlock()
-				s.seqsSem.Release(1)
+				s.seqsSem.Release(int64(seq.slots()))
 				http.Error(w, fmt.Sprintf("Failed to load cache: %v", err), http.StatusInternalServerError)
 				return
 			}
 
+			// the completion is scored after the prompt, whatever of it is
+			// cached, so its tokens are always evaluated
+			for _, token := range seq.score {
+				seq.inputs = append(seq.inputs, input{token: token})
+			}
+
+			seq.numCachedInputs = seq.numPromptInputs - len(seq.inputs)
+
+			if seq.beams != nil {
+				seq.beamSlots = append([]*InputCacheSlot{seq.cache}, s.cache.ReserveSlots(seq.beams.Width-1, seq.adapters)...)
+			}
+
 			s.seqs[i] = seq
 			s.cond.Signal()
 			found = true
@@ -615,21 +1064,38 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 	s.mu.Unlock()
 
 	if !found {
-		s.seqsSem.Release(1)
+		s.seqsSem.Release(int64(seq.slots()))
 		http.Error(w, "could not find an available sequence", http.StatusInternalServerError)
 		return
 	}
 
+	var stats <-chan time.Time
+	if req.StatsInterval > 0 {
+		ticker := time.NewTicker(req.StatsInterval)
+		defer ticker.Stop()
+		stats = ticker.C
+	}
+
 	for {
 		select {
 		case <-r.Context().Done():
 			close(seq.quit)
 			return
-		case content, ok := <-seq.responses:
+		case <-stats:
+			s.mu.Lock()
+			progress := seq.progress()
+			s.mu.Unlock()
+
+			if err := json.NewEncoder(w).Encode(&progress); err != nil {
+				http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+				close(seq.quit)
+				return
+			}
+
+			flusher.Flush()
+		case resp, ok := <-seq.responses:
 			if ok {
-				if err := json.NewEncoder(w).Encode(&llm.CompletionResponse{
-					Content: content,
-				}); err != nil {
+				if err := json.NewEncoder(w).Encode(&resp); err != nil {
 					http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
 					close(seq.quit)
 					return
@@ -641,9 +1107,12 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 					Done:               true,
 					DoneReason:         seq.doneReason,
 					PromptEvalCount:    seq.numPromptInputs,
+					PromptCachedCount:  seq.numCachedInputs,
+					PromptImageCount:   seq.numImageInputs,
 					PromptEvalDuration: seq.startGenerationTime.Sub(seq.startProcessingTime),
 					EvalCount:          seq.numDecoded,
 					EvalDuration:       time.Since(seq.startGenerationTime),
+					Logprobs:           seq.scored,
 				}); err != nil {
 					http.Error(w, fmt.Sprintf("failed to encode final response: %v", err), http.StatusInternalServerError)
 				}
@@ -683,7 +1152,7 @@ func (s *Server) embeddings(w http.ResponseWriter, r *http.Request) {
 	found := false
 	for i, sq := range s.seqs {
 		if sq == nil {
-			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, false)
+			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, seq.adapters, false, "")
 			if err != nil {
 				s.mu.Unlock()
 				s.seqsSem.Release(1)
@@ -744,6 +1213,9 @@ func (s *Server) loadModel(
 	flashAttention bool,
 	threads int,
 	multiUserCache bool,
+	prefixCacheSize int,
+	dpath string,
+	draftParams llama.ModelParams,
 ) {
 	var err error
 	s.model, err = llama.LoadModelFromFile(mpath, params)
@@ -757,13 +1229,16 @@ func (s *Server) loadModel(
 		panic(err)
 	}
 
-	if lpath.String() != "" {
-		for _, path := range lpath {
-			err := s.model.ApplyLoraFromFile(s.lc, path, 1.0, threads)
-			if err != nil {
-				panic(err)
-			}
+	for _, path := range lpath {
+		lora, err := s.model.LoadLoraAdapter(path)
+		if err != nil {
+			panic(err)
 		}
+		s.loras = append(s.loras, lora)
+	}
+
+	if err := s.lc.SetLoraAdapters(s.loras, defaultAdapterScales(len(s.loras))); err != nil {
+		panic(err)
 	}
 
 	if ppath != "" {
@@ -774,11 +1249,18 @@ func (s *Server) loadModel(
 		}
 	}
 
-	s.cache, err = NewInputCache(s.lc, kvSize, s.parallel, multiUserCache)
+	s.cache, err = NewInputCache(s.lc, kvSize, s.parallel, multiUserCache, prefixCacheSize)
 	if err != nil {
 		panic(err)
 	}
 
+	if dpath != "" {
+		s.draft, err = newDraftContext(s.model, dpath, draftParams, ctxParams, s.batchSize, s.parallel)
+		if err != nil {
+			slog.Warn("not using draft model", "model", dpath, "error", err)
+		}
+	}
+
 	s.status = llm.ServerStatusReady
 	s.ready.Done()
 }
@@ -796,10 +1278,15 @@ func Execute(args []string) error {
 	kvCacheType := fs.String("kv-cache-type", "", "quantization type for KV cache (default: f16)")
 	port := fs.Int("port", 8080, "Port to expose the server on")
 	threads := fs.Int("threads", runtime.NumCPU(), "Number of threads to use during generation")
+	numa := fs.String("numa", "", "NUMA strategy: distribute, isolate or numactl (default: disabled)")
 	_ = fs.Bool("verbose", false, "verbose output (default: disabled)")
 	noMmap := fs.Bool("no-mmap", false, "do not memory-map model (slower load but may reduce pageouts if not using mlock)")
 	tensorSplit := fs.String("tensor-split", "", "fraction of the model to offload to each GPU, comma-separated list of proportions")
 	multiUserCache := fs.Bool("multiuser-cache", false, "optimize input cache algorithm for multiple users")
+	prefixCacheSize := fs.Int("prefix-cache-size", 0, "Maximum size in bytes of prompt prefixes kept after they are evicted from the context")
+	maxBatch := fs.Int("max-batch", 0, "Maximum number of inputs to evaluate at once across all sequences (default: no limit beyond the batch size)")
+	draftPath := fs.String("draft", "", "Path to draft model for speculative decoding")
+	draftGpuLayers := fs.Int("draft-n-gpu-layers", 0, "Number of layers of the draft model to offload to GPU")
 
 	var lpaths multiLPath
 	fs.Var(&lpaths, "lora", "Path to lora layer file (can be specified multiple times)")
@@ -815,9 +1302,11 @@ func Execute(args []string) error {
 	slog.Info("starting go runner")
 
 	llama.BackendInit()
+	llama.NumaInit(*numa)
 
 	server := &Server{
 		batchSize: *batchSize,
+		maxBatch:  *maxBatch,
 		parallel:  *parallel,
 		seqs:      make([]*Sequence, *parallel),
 		seqsSem:   semaphore.NewWeighted(int64(*parallel)),
@@ -844,8 +1333,14 @@ func Execute(args []string) error {
 		},
 	}
 
+	draftParams := llama.ModelParams{
+		NumGpuLayers: *draftGpuLayers,
+		MainGpu:      *mainGpu,
+		UseMmap:      !*noMmap,
+	}
+
 	server.ready.Add(1)
-	go server.loadModel(params, *mpath, lpaths, *ppath, *kvSize, *kvCacheType, *flashAttention, *threads, *multiUserCache)
+	go server.loadModel(params, *mpath, lpaths, *ppath, *kvSize, *kvCacheType, *flashAttention, *threads, *multiUserCache, *prefixCacheSize, *draftPath, draftParams)
 
 	server.cond = sync.NewCond(&server.mu)
 
@@ -0,0 +1,69 @@
+package llamarunner
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/goobla/goobla/api"
+)
+
+func TestBatchOrder(t *testing.T) {
+	s := &Server{
+		seqs: []*Sequence{
+			{numDecoded: 0},
+			nil,
+			{numDecoded: 3},
+			{numDecoded: 0},
+			{numDecoded: 1},
+		},
+	}
+
+	cases := []struct {
+		nextSeq int
+		want    []int
+	}{
+		{0, []int{2, 4, 0, 3}},
+		{3, []int{4, 2, 3, 0}},
+		{4, []int{4, 2, 0, 3}},
+	}
+
+	for _, tt := range cases {
+		s.nextSeq = tt.nextSeq
+		if got := s.batchOrder(); !slices.Equal(got, tt.want) {
+			t.Errorf("nextSeq %d: got %v, want %v", tt.nextSeq, got, tt.want)
+		}
+	}
+}
+
+func TestPredictsScore(t *testing.T) {
+	// a prompt of two tokens and a completion of three, evaluated in
+	// batches of two
+	seq := &Sequence{
+		inputs: []input{{token: 1}, {token: 2}, {token: 3}, {token: 4}, {token: 5}},
+		score:  []int{3, 4, 5},
+	}
+
+	var got []bool
+	for len(seq.inputs) > 0 {
+		n := min(2, len(seq.inputs))
+		for i := range n {
+			score := seq.predictsScore(i)
+			got = append(got, score)
+			if score {
+				seq.scoreBatch = append(seq.scoreBatch, i)
+			}
+		}
+
+		seq.inputs = seq.inputs[n:]
+		for range seq.scoreBatch {
+			seq.scored = append(seq.scored, api.Logprob{})
+		}
+		seq.scoreBatch = nil
+	}
+
+	// each input but the last predicts a token of the completion, except
+	// the first token of the prompt
+	if want := []bool{false, true, true, true, false}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,143 @@
+package llamarunner
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// Sessions are files holding the KV cache of a conversation so it can be
+// restored after the model is unloaded. A session file starts with
+// sessionMagic, followed by the number of tokens in the cache and the
+// tokens, then the KV cache returned by llama.Context.StateSeqGetData.
+
+var sessionMagic = [4]byte{'G', 'K', 'V', 1}
+
+var errSessionImages = errors.New("sessions with images can't be saved")
+
+// SaveSession writes the KV cache of slot to the session file path.
+func (c *InputCache) SaveSession(slot *InputCacheSlot, path string) error {
+	tokens := make([]int32, len(slot.Inputs))
+	for i, inp := range slot.Inputs {
+		if inp.embed != nil {
+			return errSessionImages
+		}
+		tokens[i] = int32(inp.token)
+	}
+
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	data := c.lc.StateSeqGetData(slot.Id)
+	if len(data) == 0 {
+		return errors.New("couldn't copy kv cache")
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, v := range []any{sessionMagic, uint64(len(tokens)), tokens, data} {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	slog.Debug("saved session", "id", slot.Id, "inputs", len(tokens), "size", len(data))
+	return os.Rename(f.Name(), path)
+}
+
+// readSessionTokens reads the tokens at the start of a session file from r,
+// leaving it at the KV cache.
+func readSessionTokens(r io.Reader) ([]int32, error) {
+	var magic [4]byte
+	if err := binary.Read(r, binary.LittleEndian, &magic); err != nil {
+		return nil, err
+	}
+
+	if magic != sessionMagic {
+		return nil, errors.New("not a session file")
+	}
+
+	var n uint64
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+
+	tokens := make([]int32, 0, min(n, 1<<20))
+	for range n {
+		var t int32
+		if err := binary.Read(r, binary.LittleEndian, &t); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+
+	return tokens, nil
+}
+
+// loadSession restores the KV cache in the session file path into slot if
+// it has more inputs of prompt than the numPast already there, and returns
+// the number of inputs of prompt in slot.
+func (c *InputCache) loadSession(slot *InputCacheSlot, prompt []input, numPast int, path string) int {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return numPast
+	} else if err != nil {
+		slog.Warn("couldn't read session", "error", err)
+		return numPast
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	tokens, err := readSessionTokens(r)
+	if err != nil {
+		slog.Warn("couldn't read session", "path", path, "error", err)
+		return numPast
+	}
+
+	inputs := make([]input, len(tokens))
+	for i, t := range tokens {
+		inputs[i] = input{token: int(t)}
+	}
+
+	n := countCommonPrefix(inputs, prompt)
+	if n <= numPast {
+		return numPast
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		slog.Warn("couldn't read session", "error", err)
+		return numPast
+	}
+
+	c.lc.KvCacheSeqRm(slot.Id, 0, -1)
+	if !c.lc.StateSeqSetData(slot.Id, data) {
+		slog.Warn("couldn't restore session, evaluating the prompt again", "id", slot.Id, "inputs", len(inputs))
+		c.lc.KvCacheSeqRm(slot.Id, 0, -1)
+		slot.Inputs = []input{}
+		return 0
+	}
+
+	slog.Debug("restored session", "id", slot.Id, "inputs", n, "prompt", len(prompt))
+	slot.Inputs = inputs
+	return n
+}
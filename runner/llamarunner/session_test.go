@@ -0,0 +1,42 @@
+package llamarunner
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+func TestReadSessionTokens(t *testing.T) {
+	var b bytes.Buffer
+	for _, v := range []any{sessionMagic, uint64(3), []int32{5, 6, 7}, []byte("kv")} {
+		if err := binary.Write(&b, binary.LittleEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tokens, err := readSessionTokens(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(tokens, []int32{5, 6, 7}) {
+		t.Errorf("got %v, want [5 6 7]", tokens)
+	}
+
+	if rest := b.String(); rest != "kv" {
+		t.Errorf("got %q after the tokens, want the kv cache", rest)
+	}
+
+	if _, err := readSessionTokens(bytes.NewReader([]byte("GGUF\x00\x00\x00\x00\x00\x00\x00\x00"))); err == nil {
+		t.Error("expected an error for a file that isn't a session")
+	}
+
+	// truncated
+	b.Reset()
+	binary.Write(&b, binary.LittleEndian, sessionMagic)
+	binary.Write(&b, binary.LittleEndian, uint64(1<<40))
+	if _, err := readSessionTokens(&b); err == nil {
+		t.Error("expected an error for a truncated session")
+	}
+}
@@ -0,0 +1,186 @@
+package sample
+
+import (
+	"fmt"
+	"math"
+	"slices"
+)
+
+// DefaultOrder is the order transforms are applied in when a [Config] doesn't
+// set one.
+var DefaultOrder = []string{"penalties", "dry", "top_k", "temperature", "top_p", "min_p", "typical_p"}
+
+// transformNames are the transforms that can be ordered in
+// [Config.Samplers].
+var transformNames = []string{"penalties", "dry", "top_k", "temperature", "top_p", "min_p", "typical_p", "grammar"}
+
+// CheckOrder returns an error if order has a transform that isn't known or
+// is listed more than once.
+func CheckOrder(order []string) error {
+	for i, name := range order {
+		if !slices.Contains(transformNames, name) {
+			return fmt.Errorf("unknown sampler %q, must be one of %v", name, transformNames)
+		}
+
+		if slices.Contains(order[:i], name) {
+			return fmt.Errorf("sampler %q is listed more than once", name)
+		}
+	}
+
+	return nil
+}
+
+// transform is a step of the sampling pipeline which modifies the tokens
+// considered for sampling.
+type transform struct {
+	name string
+
+	// probs is whether the transform works on probabilities instead of
+	// logits, and sorted whether it requires them in descending order
+	probs, sorted bool
+
+	// sorts is whether the tokens are sorted in descending order after the
+	// transform, and keepsOrder whether they stay sorted if they were
+	sorts, keepsOrder bool
+
+	apply func([]token) []token
+}
+
+// pipeline returns the transforms enabled by cfg in the order they're
+// applied.
+func (s *Sampler) pipeline(cfg Config) []transform {
+	if s.mirostat != nil {
+		return []transform{
+			{name: "temperature", keepsOrder: true, apply: func(ts []token) []token {
+				temperature(ts, cfg.Temperature)
+				return ts
+			}},
+			{name: "mirostat", probs: true, sorted: true, sorts: true, apply: s.mirostat.truncate},
+		}
+	}
+
+	order := cfg.Samplers
+	if len(order) == 0 {
+		order = DefaultOrder
+	}
+
+	var transforms []transform
+	for _, name := range order {
+		var t transform
+		switch name {
+		case "penalties":
+			if s.penalties == nil {
+				continue
+			}
+			t = transform{apply: s.penalties.apply}
+		case "dry":
+			if s.dry == nil {
+				continue
+			}
+			t = transform{apply: s.dry.apply}
+		case "top_k":
+			if cfg.TopK <= 0 {
+				continue
+			}
+			t = transform{sorts: true, apply: func(ts []token) []token {
+				return topK(ts, cfg.TopK)
+			}}
+		case "temperature":
+			t = transform{keepsOrder: true, apply: func(ts []token) []token {
+				if cfg.DynatempRange > 0 {
+					dynamicTemperature(ts, cfg.Temperature, cfg.DynatempRange, cfg.DynatempExponent)
+				} else {
+					temperature(ts, cfg.Temperature)
+				}
+				return ts
+			}}
+		case "top_p":
+			if cfg.TopP >= 1.0 {
+				continue
+			}
+			t = transform{probs: true, sorted: true, keepsOrder: true, apply: func(ts []token) []token {
+				return topP(ts, cfg.TopP)
+			}}
+		case "min_p":
+			if cfg.MinP <= 0.0 {
+				continue
+			}
+			t = transform{probs: true, sorted: true, keepsOrder: true, apply: func(ts []token) []token {
+				return minP(ts, cfg.MinP)
+			}}
+		case "typical_p":
+			if cfg.TypicalP >= 1.0 {
+				continue
+			}
+			t = transform{probs: true, apply: func(ts []token) []token {
+				return typicalP(ts, cfg.TypicalP)
+			}}
+		case "grammar":
+			g := s.grammar
+			if g == nil {
+				continue
+			}
+			s.grammarInPipeline = true
+			t = transform{apply: func(ts []token) []token {
+				g.Apply(ts)
+				return ts
+			}}
+		}
+
+		// sampling greedily only needs the transforms that change the
+		// logits of individual tokens
+		if cfg.Temperature == 0 && name != "penalties" && name != "dry" && name != "grammar" {
+			continue
+		}
+
+		t.name = name
+		transforms = append(transforms, t)
+	}
+
+	return transforms
+}
+
+// Pipeline returns the names of the transforms the sampler applies, in
+// order, followed by how the token is picked.
+func (s *Sampler) Pipeline() []string {
+	var names []string
+	for _, t := range s.transforms {
+		names = append(names, t.name)
+	}
+
+	if s.greedy {
+		return append(names, "greedy")
+	}
+
+	return append(names, "dist")
+}
+
+// run applies the transforms of the pipeline to tokens, which hold logits,
+// converting them between logits and probabilities and sorting them as the
+// transforms require. It returns the tokens left and whether they hold
+// probabilities.
+func (s *Sampler) run(tokens []token) ([]token, bool) {
+	var probs, sorted bool
+	for _, t := range s.transforms {
+		switch {
+		case t.probs && !probs:
+			softmax(tokens)
+			probs = true
+		case !t.probs && probs:
+			for i := range tokens {
+				tokens[i].value = float32(math.Log(float64(tokens[i].value)))
+			}
+			probs = false
+		}
+
+		if t.sorted && !sorted {
+			tokens = topK(tokens, 0)
+			sorted = true
+		}
+
+		tokens = t.apply(tokens)
+		sorted = t.sorts || (sorted && t.keepsOrder)
+	}
+
+	return tokens, probs
+}
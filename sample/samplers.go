@@ -1,12 +1,14 @@
 package sample
 
 import (
+	"cmp"
 	"encoding/json"
 	"errors"
 	"math"
 	"math/rand/v2"
 	"slices"
 
+	"github.com/goobla/goobla/api"
 	"github.com/goobla/goobla/llama"
 	"github.com/goobla/goobla/model"
 )
@@ -17,13 +19,21 @@ type token struct {
 	value float32 // The raw logit or probability from the model
 }
 
+// Sampler picks tokens from logits by running them through a pipeline of
+// transforms, such as top_k and temperature, in a configurable order.
 type Sampler struct {
-	rng         *rand.Rand
-	topK        int
-	topP        float32
-	minP        float32
-	temperature float32
-	grammar     *GrammarSampler
+	rng        *rand.Rand
+	greedy     bool
+	transforms []transform
+	mirostat   *mirostat
+	penalties  *penalties
+	dry        *dry
+	logitBias  map[int32]float32
+	grammar    *GrammarSampler
+
+	// grammarInPipeline is whether the grammar is one of the transforms,
+	// rather than checked against the sampled token
+	grammarInPipeline bool
 }
 
 // Config specifies the sampling options used to build a Sampler.  It is
@@ -33,7 +43,50 @@ type Config struct {
 	TopK        int     `json:"top_k,omitempty"`
 	TopP        float32 `json:"top_p,omitempty"`
 	MinP        float32 `json:"min_p,omitempty"`
+	TypicalP    float32 `json:"typical_p,omitempty"`
 	Seed        int     `json:"seed,omitempty"`
+
+	// RepeatLastN is the number of sampled tokens penalized for repetition
+	// by RepeatPenalty, FrequencyPenalty and PresencePenalty, or all of them
+	// if it's negative.
+	RepeatLastN      int     `json:"repeat_last_n,omitempty"`
+	RepeatPenalty    float32 `json:"repeat_penalty,omitempty"`
+	FrequencyPenalty float32 `json:"frequency_penalty,omitempty"`
+	PresencePenalty  float32 `json:"presence_penalty,omitempty"`
+
+	// DryMultiplier enables DRY ("don't repeat yourself") sampling if it's
+	// positive, which penalizes tokens that would extend a sequence repeated
+	// from the last DryPenaltyLastN tokens, or all of them if it's negative.
+	// Repetitions at least DryAllowedLength long are penalized by
+	// DryMultiplier * DryBase^(length - DryAllowedLength). Repetitions can't
+	// span DryBreakers, the IDs of tokens such as newlines.
+	DryMultiplier    float32 `json:"dry_multiplier,omitempty"`
+	DryBase          float32 `json:"dry_base,omitempty"`
+	DryAllowedLength int     `json:"dry_allowed_length,omitempty"`
+	DryPenaltyLastN  int     `json:"dry_penalty_last_n,omitempty"`
+	DryBreakers      []int32 `json:"dry_breakers,omitempty"`
+
+	// Samplers is the order the transforms are applied in, from those in
+	// [DefaultOrder] and "grammar". Transforms that aren't listed aren't
+	// applied. The grammar is checked against the sampled token if it isn't
+	// listed.
+	Samplers []string `json:"samplers,omitempty"`
+
+	// DynatempRange enables dynamic temperature, which samples with a
+	// temperature up to DynatempRange above or below Temperature depending
+	// on the entropy of the logits, scaled by the power DynatempExponent.
+	DynatempRange    float32 `json:"dynatemp_range,omitempty"`
+	DynatempExponent float32 `json:"dynatemp_exponent,omitempty"`
+
+	// Mirostat enables mirostat sampling if it's 2, for mirostat 2.0, which
+	// targets a surprise of MirostatTau learned at the rate MirostatEta.
+	// It replaces the other samplers except temperature.
+	Mirostat    int     `json:"mirostat,omitempty"`
+	MirostatTau float32 `json:"mirostat_tau,omitempty"`
+	MirostatEta float32 `json:"mirostat_eta,omitempty"`
+
+	// LogitBias is added to the logits of the tokens it has before sampling
+	LogitBias map[int32]float32 `json:"logit_bias,omitempty"`
 }
 
 // UnmarshalJSON implements json.Unmarshaler so a Sampler can be constructed
@@ -53,9 +106,13 @@ func (s *Sampler) Sample(logits []float32) (int32, error) {
 	}
 
 	tokens := make([]token, len(logits))
-	for i := range logits {
-		tokens[i].id = int32(i)
-		tokens[i].value = logits[i]
+	s.reset(tokens, logits)
+
+	// mirostat learns from each token sampled, so only the one accepted by
+	// the grammar should count
+	var m mirostat
+	if s.mirostat != nil {
+		m = *s.mirostat
 	}
 
 	t, err := s.sample(tokens)
@@ -63,22 +120,25 @@ func (s *Sampler) Sample(logits []float32) (int32, error) {
 		return -1, err
 	}
 
-	if s.grammar != nil {
+	if s.grammar != nil && s.grammarInPipeline {
+		s.grammar.Accept(t.id)
+	} else if s.grammar != nil {
 		// optimization: first check if the max logit is accepted by the grammar
 		// if the max logit is rejected, apply the grammar to all logits (slower)
 		top := []token{t}
 		s.grammar.Apply(top)
 		if !math.IsInf(float64(top[0].value), -1) {
 			s.grammar.Accept(top[0].id)
+			s.Accept(top[0].id)
 			return top[0].id, nil
 		}
 
 		// since .sample has side effects of modifying the tokens
 		// we need to reset them before applying the grammar and
 		// sampling again
-		for i := range logits {
-			tokens[i].id = int32(i)
-			tokens[i].value = logits[i]
+		s.reset(tokens, logits)
+		if s.mirostat != nil {
+			*s.mirostat = m
 		}
 		s.grammar.Apply(tokens)
 		t, err = s.sample(tokens)
@@ -88,9 +148,39 @@ func (s *Sampler) Sample(logits []float32) (int32, error) {
 		s.grammar.Accept(t.id)
 	}
 
+	s.Accept(t.id)
 	return t.id, nil
 }
 
+// Accept adds tokens to the history that repetition is penalized in. Sampled
+// tokens are added by [Sampler.Sample], so this is for the tokens before
+// them, such as the prompt's.
+func (s *Sampler) Accept(ids ...int32) {
+	for _, id := range ids {
+		if s.penalties != nil {
+			s.penalties.accept(id)
+		}
+
+		if s.dry != nil {
+			s.dry.accept(id)
+		}
+	}
+}
+
+// reset sets tokens to logits with the logit bias added
+func (s *Sampler) reset(tokens []token, logits []float32) {
+	for i := range logits {
+		tokens[i].id = int32(i)
+		tokens[i].value = logits[i]
+	}
+
+	for id, bias := range s.logitBias {
+		if id >= 0 && int(id) < len(tokens) {
+			tokens[id].value += bias
+		}
+	}
+}
+
 // greedy returns the highest probability token from the tokens
 func greedy(tokens []token) token {
 	max := tokens[0]
@@ -103,23 +193,33 @@ func greedy(tokens []token) token {
 	return max
 }
 
-// sample returns the highest probability token from the tokens
-// given sampler parameters. It also has side effects of modifying the tokens
+// sample returns a token from the tokens after running them through the
+// pipeline. It also has side effects of modifying the tokens
 func (s *Sampler) sample(tokens []token) (token, error) {
-	if s.temperature == 0 {
+	tokens, probs := s.run(tokens)
+	if s.greedy {
 		return greedy(tokens), nil
 	}
 
-	// topK also sorts the tokens in descending order of logits
-	tokens = topK(tokens, s.topK)
+	if !probs {
+		softmax(tokens)
+	}
+
+	t, p, err := s.pick(tokens)
+	if err != nil {
+		return token{}, err
+	}
 
-	// scale and normalize the tokens in place
-	temperature(tokens, s.temperature)
-	softmax(tokens)
+	if s.mirostat != nil {
+		s.mirostat.update(p)
+	}
 
-	tokens = topP(tokens, s.topP)
-	tokens = minP(tokens, s.minP)
+	return t, nil
+}
 
+// pick samples a token from tokens, which hold probabilities, returning it
+// along with its probability. It has side effects of modifying the tokens
+func (s *Sampler) pick(tokens []token) (token, float32, error) {
 	var r float32
 	if s.rng != nil {
 		r = s.rng.Float32()
@@ -143,9 +243,15 @@ func (s *Sampler) sample(tokens []token) (token, error) {
 	})
 
 	if math.IsNaN(float64(sum)) {
-		return token{}, errors.New("sample: logits sum to NaN, check model output")
+		return token{}, 0, errors.New("sample: logits sum to NaN, check model output")
 	}
-	return tokens[idx], nil
+
+	p := tokens[idx].value
+	if idx > 0 {
+		p -= tokens[idx-1].value
+	}
+
+	return tokens[idx], p / sum, nil
 }
 
 // NewSampler unmarshals the provided JSON configuration and returns a sampler
@@ -155,12 +261,16 @@ func NewSampler(b []byte, grammar *GrammarSampler) (Sampler, error) {
 	if err := json.Unmarshal(b, &cfg); err != nil {
 		return Sampler{}, err
 	}
-	return NewSamplerFromConfig(cfg, grammar), nil
+	return NewSamplerFromConfig(cfg, grammar)
 }
 
 // NewSamplerFromConfig returns a sampler configured with the provided options.
 // The configuration is typically populated via JSON and passed through [Config].
-func NewSamplerFromConfig(cfg Config, grammar *GrammarSampler) Sampler {
+func NewSamplerFromConfig(cfg Config, grammar *GrammarSampler) (Sampler, error) {
+	if err := CheckOrder(cfg.Samplers); err != nil {
+		return Sampler{}, err
+	}
+
 	var rng *rand.Rand
 	if cfg.Seed != -1 {
 		// PCG requires two parameters: sequence and stream
@@ -187,14 +297,61 @@ func NewSamplerFromConfig(cfg Config, grammar *GrammarSampler) Sampler {
 		cfg.MinP = 1.0
 	}
 
-	return Sampler{
-		rng:         rng,
-		topK:        cfg.TopK,
-		topP:        cfg.TopP,
-		minP:        cfg.MinP,
-		temperature: cfg.Temperature,
-		grammar:     grammar,
+	if cfg.TypicalP <= 0.0 || cfg.TypicalP >= 1.0 {
+		cfg.TypicalP = 1.0
+	}
+
+	if cfg.DynatempRange < 0.0 {
+		cfg.DynatempRange = 0.0
+	}
+	if cfg.DynatempExponent <= 0.0 {
+		cfg.DynatempExponent = 1.0
+	}
+
+	sampler := Sampler{
+		rng:       rng,
+		greedy:    cfg.Temperature == 0,
+		logitBias: cfg.LogitBias,
+		grammar:   grammar,
 	}
+
+	if cfg.Mirostat == 2 && cfg.Temperature > 0 {
+		if cfg.MirostatTau <= 0.0 {
+			cfg.MirostatTau = 5.0
+		}
+		if cfg.MirostatEta <= 0.0 {
+			cfg.MirostatEta = 0.1
+		}
+		sampler.mirostat = newMirostat(cfg.MirostatTau, cfg.MirostatEta)
+	}
+
+	cfg.RepeatPenalty = cmp.Or(cfg.RepeatPenalty, 1.0)
+	if cfg.RepeatLastN != 0 && (cfg.RepeatPenalty != 1.0 || cfg.FrequencyPenalty != 0.0 || cfg.PresencePenalty != 0.0) {
+		sampler.penalties = &penalties{
+			lastN:     cfg.RepeatLastN,
+			repeat:    cfg.RepeatPenalty,
+			frequency: cfg.FrequencyPenalty,
+			presence:  cfg.PresencePenalty,
+		}
+	}
+
+	if cfg.DryMultiplier > 0 && cfg.DryBase >= 1.0 && cfg.DryPenaltyLastN != 0 {
+		breakers := make(map[int32]bool, len(cfg.DryBreakers))
+		for _, id := range cfg.DryBreakers {
+			breakers[id] = true
+		}
+
+		sampler.dry = &dry{
+			multiplier:    cfg.DryMultiplier,
+			base:          cfg.DryBase,
+			allowedLength: cfg.DryAllowedLength,
+			lastN:         cfg.DryPenaltyLastN,
+			breakers:      breakers,
+		}
+	}
+
+	sampler.transforms = sampler.pipeline(cfg)
+	return sampler, nil
 }
 
 type GrammarSampler struct {
@@ -237,3 +394,31 @@ func (g *GrammarSampler) Accept(token int32) {
 func (g *GrammarSampler) Free() {
 	g.grammar.Free()
 }
+
+// ConfigFromOptions returns the sampling options in opts as a Config,
+// except for the logit bias and DRY breakers, which need the model's
+// vocabulary.
+func ConfigFromOptions(opts api.Options) Config {
+	return Config{
+		Temperature:      opts.Temperature,
+		TopK:             opts.TopK,
+		TopP:             opts.TopP,
+		MinP:             opts.MinP,
+		TypicalP:         opts.TypicalP,
+		Seed:             opts.Seed,
+		RepeatLastN:      opts.RepeatLastN,
+		RepeatPenalty:    opts.RepeatPenalty,
+		FrequencyPenalty: opts.FrequencyPenalty,
+		PresencePenalty:  opts.PresencePenalty,
+		DryMultiplier:    opts.DryMultiplier,
+		DryBase:          opts.DryBase,
+		DryAllowedLength: opts.DryAllowedLength,
+		DryPenaltyLastN:  opts.DryPenaltyLastN,
+		Samplers:         opts.Samplers,
+		DynatempRange:    opts.DynatempRange,
+		DynatempExponent: opts.DynatempExponent,
+		Mirostat:         opts.Mirostat,
+		MirostatTau:      opts.MirostatTau,
+		MirostatEta:      opts.MirostatEta,
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"math/rand/v2"
 	"os"
 	"path/filepath"
+	"slices"
 	"testing"
 
 	"github.com/goobla/goobla/model"
@@ -69,6 +70,233 @@ func TestWeighted(t *testing.T) {
 	}
 }
 
+func TestLogitBias(t *testing.T) {
+	logits := []float32{1, 3, 2, 0}
+
+	var sampler Sampler
+	if err := json.Unmarshal([]byte(`{"temperature":0,"logit_bias":{"1":-100,"3":2.5}}`), &sampler); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := sampler.Sample(logits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != 3 {
+		t.Errorf("index mismatch: want 3, got %d", got)
+	}
+
+	// banned tokens are never sampled
+	sampler, _ = NewSamplerFromConfig(Config{Temperature: 1, Seed: 42, LogitBias: map[int32]float32{1: float32(math.Inf(-1))}}, nil)
+	for range 100 {
+		if got, err := sampler.Sample(logits); err != nil || got == 1 {
+			t.Fatalf("got %d, %v; want a token other than 1", got, err)
+		}
+	}
+}
+
+func TestMirostat(t *testing.T) {
+	logits := []float32{4, 3, 2, 1, 0, -1}
+
+	// with a fixed mu, tokens are sampled from those with a surprise of at
+	// most mu, renormalized
+	sampler, _ := NewSamplerFromConfig(Config{Temperature: 1, Seed: 42, Mirostat: 2}, nil)
+	*sampler.mirostat = mirostat{tau: 3, mu: 3}
+
+	probs := make([]float64, len(logits))
+	for i, l := range logits {
+		probs[i] = float64(l)
+	}
+	probs = refSoftmax(probs)
+
+	var sum float64
+	want := make([]float64, len(probs))
+	for i, p := range probs {
+		if i == 0 || -math.Log2(p) <= 3 {
+			want[i] = p
+			sum += p
+		}
+	}
+	for i := range want {
+		want[i] /= sum
+	}
+
+	const n = 100000
+	counts := make([]float64, len(logits))
+	for range n {
+		got, err := sampler.Sample(logits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[got]++
+	}
+
+	for i := range want {
+		if got := counts[i] / n; math.Abs(got-want[i]) > 0.01 {
+			t.Errorf("token %d: want probability %f, got %f", i, want[i], got)
+		}
+	}
+
+	// mu adapts so the average surprise of sampled tokens is close to tau
+	r := rand.New(rand.NewPCG(1, 2))
+	logits = make([]float32, 1000)
+	for i := range logits {
+		logits[i] = float32(r.NormFloat64() * 3)
+	}
+
+	sampler, _ = NewSamplerFromConfig(Config{Temperature: 1, Seed: 42, Mirostat: 2, MirostatTau: 4, MirostatEta: 0.1}, nil)
+	probs = make([]float64, len(logits))
+	for i, l := range logits {
+		probs[i] = float64(l)
+	}
+	probs = refSoftmax(probs)
+
+	var surprise float64
+	for i := range 2000 {
+		got, err := sampler.Sample(logits)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// skip samples while mu converges
+		if i >= 1000 {
+			surprise += -math.Log2(probs[got])
+		}
+	}
+
+	if avg := surprise / 1000; math.Abs(avg-4) > 0.5 {
+		t.Errorf("average surprise %f, want about 4", avg)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  Config
+		want []string
+		err  bool
+	}{
+		{
+			name: "default",
+			cfg:  Config{Temperature: 0.8, TopK: 40, TopP: 0.9, RepeatLastN: 64, RepeatPenalty: 1.1},
+			want: []string{"penalties", "top_k", "temperature", "top_p", "dist"},
+		},
+		{
+			name: "disabled",
+			cfg:  Config{Temperature: 0.8, TopP: 1, MinP: 0.05, TypicalP: 0.9},
+			want: []string{"temperature", "min_p", "typical_p", "dist"},
+		},
+		{
+			name: "order",
+			cfg:  Config{Temperature: 0.8, TopK: 40, TopP: 0.9, MinP: 0.05, Samplers: []string{"min_p", "top_p", "temperature", "top_k"}},
+			want: []string{"min_p", "top_p", "temperature", "top_k", "dist"},
+		},
+		{
+			name: "greedy",
+			cfg:  Config{TopK: 40, RepeatLastN: 64, RepeatPenalty: 1.1},
+			want: []string{"penalties", "greedy"},
+		},
+		{
+			name: "dry",
+			cfg:  Config{TopK: 40, DryMultiplier: 0.8, DryBase: 1.75, DryPenaltyLastN: -1},
+			want: []string{"dry", "greedy"},
+		},
+		{
+			name: "mirostat",
+			cfg:  Config{Temperature: 0.8, TopK: 40, Mirostat: 2},
+			want: []string{"temperature", "mirostat", "dist"},
+		},
+		{
+			name: "unknown",
+			cfg:  Config{Samplers: []string{"top_k", "top_a"}},
+			err:  true,
+		},
+		{
+			name: "duplicate",
+			cfg:  Config{Samplers: []string{"top_k", "top_k"}},
+			err:  true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			sampler, err := NewSamplerFromConfig(tt.cfg, nil)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := sampler.Pipeline(); !slices.Equal(got, tt.want) {
+				t.Errorf("pipeline = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPipelineOrder(t *testing.T) {
+	logits := []float32{3, 2.5, 2, 0, -1}
+
+	// top_p before temperature keeps the tokens that make up p of the
+	// unscaled distribution, so a high temperature can't add more
+	sampler, err := NewSamplerFromConfig(Config{Temperature: 100, TopP: 0.5, Seed: 1, Samplers: []string{"top_p", "temperature"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 100 {
+		got, err := sampler.Sample(logits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got > 1 {
+			t.Fatalf("sampled token %d, want 0 or 1", got)
+		}
+	}
+
+	// the other way around, the flattened distribution keeps more tokens
+	sampler, err = NewSamplerFromConfig(Config{Temperature: 100, TopP: 0.5, Seed: 1, Samplers: []string{"temperature", "top_p"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[int32]bool)
+	for range 100 {
+		got, err := sampler.Sample(logits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[got] = true
+	}
+
+	if !seen[2] {
+		t.Errorf("expected token 2 to be sampled, got %v", seen)
+	}
+
+	// repeated tokens are penalized after they're sampled
+	sampler, err = NewSamplerFromConfig(Config{RepeatLastN: 64, RepeatPenalty: 10}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []int32
+	for range 3 {
+		id, err := sampler.Sample(logits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, id)
+	}
+
+	if want := []int32{0, 1, 2}; !slices.Equal(got, want) {
+		t.Errorf("sampled %v, want %v", got, want)
+	}
+}
+
 func TestNewSamplerJSON(t *testing.T) {
 	logits := []float32{-10, 3, -10, -10}
 	sampler, err := NewSampler([]byte(`{"temperature":0}`), nil)
@@ -175,13 +403,14 @@ func TestGrammar(t *testing.T) {
 }
 
 func BenchmarkSample(b *testing.B) {
-	samplers := map[string]Sampler{}
-	if err := json.Unmarshal([]byte(`{"temperature":0}`), &samplers["Greedy"]); err != nil {
+	var greedy, weighted Sampler
+	if err := json.Unmarshal([]byte(`{"temperature":0}`), &greedy); err != nil {
 		b.Fatal(err)
 	}
-	if err := json.Unmarshal([]byte(`{"temperature":0.5,"top_k":10,"top_p":0.9,"min_p":0.2,"seed":-1}`), &samplers["Weighted"]); err != nil {
+	if err := json.Unmarshal([]byte(`{"temperature":0.5,"top_k":10,"top_p":0.9,"min_p":0.2,"seed":-1}`), &weighted); err != nil {
 		b.Fatal(err)
 	}
+	samplers := map[string]Sampler{"Greedy": greedy, "Weighted": weighted}
 
 	// Generate random logits for benchmarking
 	logits := make([]float32, 1<<16)
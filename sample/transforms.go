@@ -1,6 +1,7 @@
 package sample
 
 import (
+	"cmp"
 	"container/heap"
 	"math"
 	"slices"
@@ -128,3 +129,229 @@ func minP(ts []token, p float32) []token {
 	}
 	return ts
 }
+
+// dynamicTemperature applies scaling to the logits with a temperature between
+// temp-r and temp+r, which is higher the more evenly the probability is spread
+// across the tokens. exp controls how the normalized entropy of the tokens
+// maps to the temperature.
+func dynamicTemperature(ts []token, temp, r, exp float32) {
+	if len(ts) <= 1 {
+		temperature(ts, temp)
+		return
+	}
+
+	probs := make([]token, len(ts))
+	copy(probs, ts)
+	softmax(probs)
+
+	var entropy float64
+	for _, t := range probs {
+		if t.value > 0 {
+			entropy -= float64(t.value) * math.Log(float64(t.value))
+		}
+	}
+
+	normalized := entropy / math.Log(float64(len(ts)))
+
+	minTemp := max(0, temp-r)
+	maxTemp := temp + r
+	temperature(ts, minTemp+(maxTemp-minTemp)*float32(math.Pow(normalized, float64(exp))))
+}
+
+// typicalP limits tokens to those whose information content is closest to
+// the entropy of the distribution, up to a cumulative probability p. It
+// requires ts to hold probabilities and returns them sorted by how typical
+// they are.
+func typicalP(ts []token, p float32) []token {
+	if p >= 1.0 || len(ts) <= 1 {
+		return ts
+	}
+
+	var entropy float64
+	for _, t := range ts {
+		if t.value > 0 {
+			entropy -= float64(t.value) * math.Log(float64(t.value))
+		}
+	}
+
+	shifted := func(t token) float64 {
+		return math.Abs(-math.Log(float64(t.value)) - entropy)
+	}
+
+	slices.SortStableFunc(ts, func(a, b token) int {
+		return cmp.Compare(shifted(a), shifted(b))
+	})
+
+	var sum float32
+	for i, t := range ts {
+		sum += t.value
+		if sum > p {
+			return ts[:i+1]
+		}
+	}
+
+	return ts
+}
+
+// mirostat is the state of mirostat 2.0 sampling, which keeps the surprise
+// of the sampled tokens close to a target tau by learning the maximum
+// surprise mu of the tokens to sample from.
+type mirostat struct {
+	tau, eta, mu float32
+}
+
+func newMirostat(tau, eta float32) *mirostat {
+	return &mirostat{tau: tau, eta: eta, mu: 2 * tau}
+}
+
+// truncate limits tokens to those with a surprise of at most mu and
+// normalizes their probabilities. It requires ts to hold probabilities
+// sorted in descending order.
+func (m *mirostat) truncate(ts []token) []token {
+	n := len(ts)
+	for i, t := range ts {
+		if -math.Log2(float64(t.value)) > float64(m.mu) {
+			n = i
+			break
+		}
+	}
+
+	ts = ts[:max(n, 1)]
+
+	var sum float32
+	for _, t := range ts {
+		sum += t.value
+	}
+
+	for i := range ts {
+		ts[i].value /= sum
+	}
+
+	return ts
+}
+
+// update adjusts mu towards tau given p, the probability of the sampled
+// token.
+func (m *mirostat) update(p float32) {
+	surprise := float32(-math.Log2(float64(p)))
+	m.mu -= m.eta * (surprise - m.tau)
+}
+
+// penalties discourages repetition by penalizing the logits of the recent
+// tokens, as in llama.cpp.
+type penalties struct {
+	lastN                       int
+	repeat, frequency, presence float32
+
+	// history is the tokens of the context, up to the last lastN
+	history []int32
+}
+
+// apply penalizes tokens by how many times they're in the history. Logits
+// are divided by the repeat penalty, or multiplied if they're negative, then
+// the frequency penalty for each time and the presence penalty are taken off.
+func (p *penalties) apply(ts []token) []token {
+	counts := make(map[int32]int)
+	for _, id := range p.history {
+		counts[id]++
+	}
+
+	penalize := func(t *token, count int) {
+		if t.value <= 0 {
+			t.value *= p.repeat
+		} else {
+			t.value /= p.repeat
+		}
+
+		t.value -= float32(count)*p.frequency + p.presence
+	}
+
+	for id, count := range counts {
+		if i := tokenIndex(ts, id); i >= 0 {
+			penalize(&ts[i], count)
+		}
+	}
+
+	return ts
+}
+
+// accept adds a token to the history.
+func (p *penalties) accept(id int32) {
+	p.history = window(append(p.history, id), p.lastN)
+}
+
+// dry discourages repetition by penalizing tokens that would extend a
+// sequence of tokens repeated from earlier in the history, as in DRY ("don't
+// repeat yourself") sampling. A token extending a repetition at least
+// allowedLength long is penalized by multiplier * base^(length -
+// allowedLength). Repetitions can't span breakers, such as newlines.
+type dry struct {
+	multiplier, base float32
+	allowedLength    int
+	lastN            int
+	breakers         map[int32]bool
+
+	// history is the tokens of the context, up to the last lastN
+	history []int32
+}
+
+func (d *dry) apply(ts []token) []token {
+	n := len(d.history)
+	if n == 0 || d.breakers[d.history[n-1]] {
+		return ts
+	}
+
+	// for each earlier position, the tokens ending there that match the
+	// end of the history are a repetition that the token after it would
+	// extend. Keep the longest repetition for each token.
+	lengths := make(map[int32]int)
+	for i := n - 2; i >= 0; i-- {
+		var length int
+		for length <= i && d.history[i-length] == d.history[n-1-length] && !d.breakers[d.history[i-length]] {
+			length++
+		}
+
+		if next := d.history[i+1]; length > lengths[next] {
+			lengths[next] = length
+		}
+	}
+
+	for id, length := range lengths {
+		if length < d.allowedLength {
+			continue
+		}
+
+		if i := tokenIndex(ts, id); i >= 0 {
+			penalty := float64(d.multiplier) * math.Pow(float64(d.base), float64(length-d.allowedLength))
+			ts[i].value -= float32(min(penalty, math.MaxFloat32))
+		}
+	}
+
+	return ts
+}
+
+// accept adds a token to the history.
+func (d *dry) accept(id int32) {
+	d.history = window(append(d.history, id), d.lastN)
+}
+
+// window returns the last n tokens of history, or all of them if n is
+// negative.
+func window(history []int32, n int) []int32 {
+	if n >= 0 && len(history) > n {
+		return history[len(history)-n:]
+	}
+
+	return history
+}
+
+// tokenIndex returns the index of the token with id in ts, or -1 if it isn't
+// there.
+func tokenIndex(ts []token, id int32) int {
+	// tokens are usually still in the order of their IDs
+	if int(id) < len(ts) && ts[id].id == id {
+		return int(id)
+	}
+
+	return slices.IndexFunc(ts, func(t token) bool { return t.id == id })
+}
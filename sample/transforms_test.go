@@ -1,8 +1,10 @@
 package sample
 
 import (
+	"cmp"
 	"math"
 	"math/rand/v2"
+	"slices"
 	"testing"
 )
 
@@ -295,6 +297,208 @@ func TestMinP(t *testing.T) {
 	}
 }
 
+// refSoftmax is a reference softmax in float64
+func refSoftmax(logits []float64) []float64 {
+	m := math.Inf(-1)
+	for _, l := range logits {
+		m = math.Max(m, l)
+	}
+
+	var sum float64
+	probs := make([]float64, len(logits))
+	for i, l := range logits {
+		probs[i] = math.Exp(l - m)
+		sum += probs[i]
+	}
+
+	for i := range probs {
+		probs[i] /= sum
+	}
+
+	return probs
+}
+
+// refEntropy is the entropy of probs in nats
+func refEntropy(probs []float64) float64 {
+	var h float64
+	for _, p := range probs {
+		if p > 0 {
+			h -= p * math.Log(p)
+		}
+	}
+	return h
+}
+
+func TestDynamicTemperature(t *testing.T) {
+	cases := []struct {
+		logits       []float32
+		temp, r, exp float32
+	}{
+		{[]float32{1, 4, -2, 0}, 0.8, 0.5, 1},
+		{[]float32{1, 4, -2, 0}, 0.8, 0.5, 2},
+		{[]float32{0, 0, 0, 0}, 1, 0.5, 1},
+		{[]float32{10, -10, -10}, 0.3, 0.5, 1},
+		{[]float32{2}, 0.7, 0.5, 1},
+	}
+
+	for _, tt := range cases {
+		// reference: scale by a temperature between temp-r and temp+r,
+		// interpolated by the normalized entropy of the logits
+		logits := make([]float64, len(tt.logits))
+		for i, l := range tt.logits {
+			logits[i] = float64(l)
+		}
+
+		temp := float64(tt.temp)
+		if len(logits) > 1 {
+			minTemp := math.Max(0, float64(tt.temp-tt.r))
+			maxTemp := float64(tt.temp + tt.r)
+			normalized := refEntropy(refSoftmax(logits)) / math.Log(float64(len(logits)))
+			temp = minTemp + (maxTemp-minTemp)*math.Pow(normalized, float64(tt.exp))
+		}
+
+		// as in temperature, it's clipped near 0
+		temp = math.Max(temp, 1e-7)
+
+		want := make([]float32, len(logits))
+		for i, l := range logits {
+			want[i] = float32(l / temp)
+		}
+
+		tokens := toTokens(tt.logits)
+		dynamicTemperature(tokens, tt.temp, tt.r, tt.exp)
+		for i := range want {
+			if math.Abs(float64(tokens[i].value-want[i])) > 1e-4 {
+				t.Errorf("%v: index %d: want %f, got %f", tt, i, want[i], tokens[i].value)
+			}
+		}
+	}
+
+	// uniform logits use the highest temperature
+	tokens := toTokens([]float32{1, 1, 1, 1})
+	dynamicTemperature(tokens, 1, 0.5, 1)
+	compareLogits(t, "dynamicTemperature(uniform)", []float32{1 / 1.5, 1 / 1.5, 1 / 1.5, 1 / 1.5}, tokens)
+}
+
+func TestTypicalP(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	logits := make([]float32, 50)
+	for i := range logits {
+		logits[i] = float32(r.NormFloat64() * 2)
+	}
+
+	for _, p := range []float32{0.2, 0.5, 0.9, 0.99, 1.0} {
+		tokens := toTokens(logits)
+		softmax(tokens)
+
+		// reference: sort by the distance of each token's information
+		// content from the entropy, then keep tokens until their
+		// cumulative probability exceeds p
+		probs := make([]float64, len(tokens))
+		for i, tok := range tokens {
+			probs[i] = float64(tok.value)
+		}
+		h := refEntropy(probs)
+
+		ids := make([]int32, len(probs))
+		for i := range ids {
+			ids[i] = int32(i)
+		}
+		slices.SortStableFunc(ids, func(a, b int32) int {
+			return cmp.Compare(math.Abs(-math.Log(probs[a])-h), math.Abs(-math.Log(probs[b])-h))
+		})
+
+		if p < 1 {
+			var sum float64
+			for i, id := range ids {
+				sum += probs[id]
+				if sum > float64(p) {
+					ids = ids[:i+1]
+					break
+				}
+			}
+		}
+
+		got := typicalP(tokens, p)
+		if len(got) != len(ids) {
+			t.Fatalf("typicalP(%v): want %d tokens, got %d", p, len(ids), len(got))
+		}
+
+		if p < 1 {
+			for i := range ids {
+				if got[i].id != ids[i] {
+					t.Errorf("typicalP(%v): index %d: want token %d, got %d", p, i, ids[i], got[i].id)
+				}
+			}
+		}
+	}
+
+	// a single token is always kept
+	tokens := toTokens([]float32{1})
+	softmax(tokens)
+	if got := typicalP(tokens, 0.1); len(got) != 1 {
+		t.Errorf("typicalP(0.1): want 1 token, got %d", len(got))
+	}
+}
+
+func TestPenalties(t *testing.T) {
+	p := &penalties{lastN: 3, repeat: 2, frequency: 0.5, presence: 0.25}
+	for _, id := range []int32{0, 1, 1, 3} {
+		p.accept(id)
+	}
+
+	// only the last 3 tokens are kept
+	if !slices.Equal(p.history, []int32{1, 1, 3}) {
+		t.Fatalf("history = %v, want [1 1 3]", p.history)
+	}
+
+	tokens := p.apply(toTokens([]float32{2, 4, -1, -2}))
+	compareLogits(t, "penalties", []float32{2, 4/2.0 - 2*0.5 - 0.25, -1, -2*2.0 - 0.5 - 0.25}, tokens)
+
+	// tokens out of the order of their IDs are found
+	tokens = toTokens([]float32{2, 4, -1, -2})
+	slices.Reverse(tokens)
+	tokens = p.apply(tokens)
+	compareLogits(t, "penalties(reversed)", []float32{-2*2.0 - 0.5 - 0.25, -1, 4/2.0 - 2*0.5 - 0.25, 2}, tokens)
+}
+
+func TestDry(t *testing.T) {
+	newDry := func(breakers map[int32]bool, history ...int32) *dry {
+		d := &dry{multiplier: 0.8, base: 1.75, allowedLength: 2, lastN: -1, breakers: breakers}
+		for _, id := range history {
+			d.accept(id)
+		}
+		return d
+	}
+
+	// 4 would repeat 1 2 3 4, extending a repetition 3 tokens long
+	d := newDry(nil, 1, 2, 3, 4, 7, 1, 2, 3)
+	tokens := d.apply(toTokens([]float32{1, 1, 1, 1, 1, 1, 1, 1, 1, 1}))
+	compareLogits(t, "dry", []float32{1, 1, 1, 1, 1 - 0.8*1.75, 1, 1, 1, 1, 1}, tokens)
+
+	// repetitions shorter than the allowed length aren't penalized
+	d = newDry(nil, 1, 4, 7, 1)
+	tokens = d.apply(toTokens([]float32{1, 1, 1, 1, 1}))
+	compareLogits(t, "dry(short)", []float32{1, 1, 1, 1, 1}, tokens)
+
+	// repetitions can't span breakers
+	d = newDry(nil, 9, 3, 4, 2, 9, 3)
+	tokens = d.apply(toTokens([]float32{1, 1, 1, 1, 1}))
+	compareLogits(t, "dry(no breakers)", []float32{1, 1, 1, 1, 1 - 0.8}, tokens)
+
+	d = newDry(map[int32]bool{9: true}, 9, 3, 4, 2, 9, 3)
+	tokens = d.apply(toTokens([]float32{1, 1, 1, 1, 1}))
+	compareLogits(t, "dry(breakers)", []float32{1, 1, 1, 1, 1}, tokens)
+
+	// only the last lastN tokens are kept
+	d = newDry(nil, 1, 2, 3, 4, 7, 1, 2, 3)
+	d.lastN = 4
+	d.accept(1)
+	if !slices.Equal(d.history, []int32{1, 2, 3, 1}) {
+		t.Fatalf("history = %v, want [1 2 3 1]", d.history)
+	}
+}
+
 func BenchmarkTransforms(b *testing.B) {
 	// Generate random logits
 	tokens := make([]token, 1<<16)
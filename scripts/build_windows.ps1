@@ -172,6 +172,7 @@ function gatherDependencies() {
     }
 
     cp "${script:SRC_DIR}\app\goobla_welcome.ps1" "${script:SRC_DIR}\dist\"
+    cp "${script:SRC_DIR}\app\goobla_proxy.ps1" "${script:SRC_DIR}\dist\"
 }
 
 function sign() {
@@ -179,7 +180,7 @@ function sign() {
         write-host "Signing Goobla executables, scripts and libraries"
         & "${script:SignTool}" sign /v /fd sha256 /t http://timestamp.digicert.com /f "${script:GOOBLA_CERT}" `
             /csp "Google Cloud KMS Provider" /kc ${env:KEY_CONTAINER} `
-            $(get-childitem -path "${script:SRC_DIR}\dist" -r -include @('goobla_welcome.ps1')) `
+            $(get-childitem -path "${script:SRC_DIR}\dist" -r -include @('goobla_welcome.ps1', 'goobla_proxy.ps1')) `
             $(get-childitem -path "${script:SRC_DIR}\dist\windows-*" -r -include @('*.exe', '*.dll'))
         if ($LASTEXITCODE -ne 0) { exit($LASTEXITCODE)}
     } else {
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/goobla/goobla/envconfig"
+	"github.com/goobla/goobla/types/model"
+)
+
+var (
+	errAliasNotFound = errors.New("alias not found")
+	errAliasIsModel  = errors.New("name is already used by a model")
+	errAliasIsAlias  = errors.New("name is already used by an alias")
+)
+
+// aliasesMu serializes updates to the aliases file. Reads do not take the
+// lock since the file is replaced atomically.
+var aliasesMu sync.Mutex
+
+// aliasesFile is the on-disk format of the aliases file, which maps fully
+// qualified alias names to fully qualified model names.
+type aliasesFile struct {
+	Aliases map[string]string `json:"aliases"`
+}
+
+func aliasesPath() (string, error) {
+	mdir, err := envconfig.Models()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(mdir, "aliases.json"), nil
+}
+
+// aliasCache caches the aliases file until it changes, since aliases are
+// looked up whenever a model name is parsed.
+var aliasCache cachedFile[map[model.Name]model.Name]
+
+// Aliases returns the configured aliases and the models they refer to.
+func Aliases() (map[model.Name]model.Name, error) {
+	aliases, err := loadAliases()
+	if err != nil {
+		return nil, err
+	}
+
+	return maps.Clone(aliases), nil
+}
+
+// loadAliases returns the configured aliases, reading the aliases file only
+// when it has changed since it was last read. The returned map must not be
+// modified.
+func loadAliases() (map[model.Name]model.Name, error) {
+	p, err := aliasesPath()
+	if err != nil {
+		return nil, err
+	}
+
+	aliasCache.Lock()
+	defer aliasCache.Unlock()
+
+	aliases, err := aliasCache.load(p, parseAliases)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[model.Name]model.Name{}, nil
+	}
+	return aliases, err
+}
+
+func parseAliases(p string, b []byte) (map[model.Name]model.Name, error) {
+	var f aliasesFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+
+	aliases := make(map[model.Name]model.Name, len(f.Aliases))
+	for k, v := range f.Aliases {
+		alias, target := model.ParseName(k), model.ParseName(v)
+		if !alias.IsValid() || !target.IsValid() {
+			slog.Warn("ignoring invalid alias", "alias", k, "target", v)
+			continue
+		}
+		aliases[alias] = target
+	}
+
+	return aliases, nil
+}
+
+func writeAliases(aliases map[model.Name]model.Name) error {
+	p, err := aliasesPath()
+	if err != nil {
+		return err
+	}
+
+	f := aliasesFile{Aliases: make(map[string]string, len(aliases))}
+	for alias, target := range aliases {
+		f.Aliases[alias.String()] = target.String()
+	}
+
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(p, b, 0o600); err != nil {
+		return err
+	}
+
+	aliasCache.Lock()
+	aliasCache.reset()
+	aliasCache.Unlock()
+	return nil
+}
+
+// lookupAlias returns the model that n is an alias for. Names are compared
+// case-insensitively.
+func lookupAlias(n model.Name) (model.Name, bool) {
+	aliases, err := loadAliases()
+	if err != nil {
+		slog.Warn("ignoring invalid aliases file", "error", err)
+		return model.Name{}, false
+	}
+
+	for alias, target := range aliases {
+		if strings.EqualFold(alias.String(), n.String()) {
+			return target, true
+		}
+	}
+
+	return model.Name{}, false
+}
+
+// resolveAlias returns the model n is an alias for, or n if it is not an
+// alias.
+func resolveAlias(n model.Name) model.Name {
+	if target, ok := lookupAlias(n); ok {
+		return target
+	}
+
+	return n
+}
+
+// SetAlias creates or updates alias to refer to target, which must be an
+// existing model. Requests using alias see either the old or the new target.
+func SetAlias(alias, target model.Name) error {
+	if !alias.IsValid() || !target.IsValid() {
+		return ErrModelPathInvalid
+	}
+
+	if _, err := ParseNamedManifest(alias); err == nil {
+		return fmt.Errorf("%s: %w", alias.DisplayShortest(), errAliasIsModel)
+	}
+
+	aliasesMu.Lock()
+	defer aliasesMu.Unlock()
+
+	aliases, err := Aliases()
+	if err != nil {
+		return err
+	}
+
+	for a := range aliases {
+		if strings.EqualFold(a.String(), target.String()) {
+			return fmt.Errorf("%s: %w", target.DisplayShortest(), errAliasIsAlias)
+		}
+	}
+
+	if _, err := ParseNamedManifest(target); err != nil {
+		return err
+	}
+
+	for a := range aliases {
+		if strings.EqualFold(a.String(), alias.String()) {
+			delete(aliases, a)
+		}
+	}
+
+	aliases[alias] = target
+	return writeAliases(aliases)
+}
+
+// DeleteAlias removes alias. The model it refers to is not affected.
+func DeleteAlias(alias model.Name) error {
+	aliasesMu.Lock()
+	defer aliasesMu.Unlock()
+
+	aliases, err := Aliases()
+	if err != nil {
+		return err
+	}
+
+	var found bool
+	for a := range aliases {
+		if strings.EqualFold(a.String(), alias.String()) {
+			delete(aliases, a)
+			found = true
+		}
+	}
+
+	if !found {
+		return errAliasNotFound
+	}
+
+	return writeAliases(aliases)
+}
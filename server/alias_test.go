@@ -0,0 +1,193 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/fs/ggml"
+	"github.com/goobla/goobla/types/model"
+)
+
+func TestAliases(t *testing.T) {
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	var s Server
+
+	_, digest := createBinFile(t, ggml.KV{"general.architecture": "test"}, nil)
+	for _, name := range []string{"llama3:70b-instruct-q4", "llama3:8b"} {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model: name,
+			Files: map[string]string{"model.gguf": digest},
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("create %s: expected status code 200, actual %d", name, w.Code)
+		}
+	}
+
+	list := func() []api.AliasResponse {
+		t.Helper()
+		w := createRequest(t, s.ListAliasesHandler, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		var resp api.ListAliasesResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Aliases
+	}
+
+	if got := list(); len(got) != 0 {
+		t.Fatalf("expected no aliases, got %v", got)
+	}
+
+	t.Run("create", func(t *testing.T) {
+		w := createRequest(t, s.CreateAliasHandler, api.AliasRequest{Alias: "prod-llm", Target: "llama3:70b-instruct-q4"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body)
+		}
+
+		want := []api.AliasResponse{{Alias: "prod-llm:latest", Target: "llama3:70b-instruct-q4"}}
+		if diff := cmp.Diff(want, list()); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		if mp := ParseModelPath("prod-llm"); mp.Tag != "70b-instruct-q4" {
+			t.Errorf("ParseModelPath(%q) = %v, want alias target", "prod-llm", mp)
+		}
+
+		m, err := GetModel("prod-llm")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.ShortName != "llama3:70b-instruct-q4" {
+			t.Errorf("expected model llama3:70b-instruct-q4, got %s", m.ShortName)
+		}
+
+		w = createRequest(t, s.ShowHandler, api.ShowRequest{Model: "Prod-LLM"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("show: expected status code 200, actual %d", w.Code)
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		w := createRequest(t, s.CreateAliasHandler, api.AliasRequest{Alias: "prod-llm", Target: "llama3:8b"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body)
+		}
+
+		want := []api.AliasResponse{{Alias: "prod-llm:latest", Target: "llama3:8b"}}
+		if diff := cmp.Diff(want, list()); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		cases := []struct {
+			name string
+			req  api.AliasRequest
+			code int
+		}{
+			{"missing target", api.AliasRequest{Alias: "a", Target: "missing"}, http.StatusNotFound},
+			{"model name", api.AliasRequest{Alias: "llama3:8b", Target: "llama3:70b-instruct-q4"}, http.StatusBadRequest},
+			{"chained", api.AliasRequest{Alias: "b", Target: "prod-llm"}, http.StatusBadRequest},
+			{"invalid alias", api.AliasRequest{Alias: "a:", Target: "llama3:8b"}, http.StatusBadRequest},
+		}
+
+		for _, tt := range cases {
+			t.Run(tt.name, func(t *testing.T) {
+				w := createRequest(t, s.CreateAliasHandler, tt.req)
+				if w.Code != tt.code {
+					t.Errorf("expected status code %d, actual %d", tt.code, w.Code)
+				}
+			})
+		}
+
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model: "prod-llm",
+			Files: map[string]string{"model.gguf": digest},
+		})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("create over alias: expected status code 400, actual %d", w.Code)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		w := createRequest(t, s.DeleteHandler, api.DeleteRequest{Model: "prod-llm"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		if got := list(); len(got) != 0 {
+			t.Errorf("expected no aliases, got %v", got)
+		}
+
+		// the model is left in place
+		if _, err := ParseNamedManifest(model.ParseName("llama3:8b")); err != nil {
+			t.Error(err)
+		}
+
+		w = createRequest(t, s.DeleteAliasHandler, api.AliasRequest{Alias: "prod-llm"})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status code 404, actual %d", w.Code)
+		}
+	})
+}
+
+func TestAliasesCache(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("GOOBLA_MODELS", dir)
+
+	p := filepath.Join(dir, "aliases.json")
+	write := func(target string, mtime time.Time) {
+		t.Helper()
+		b, err := json.Marshal(aliasesFile{Aliases: map[string]string{"registry.goobla.ai/library/prod:latest": target}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	write("registry.goobla.ai/library/a:latest", now)
+
+	alias := model.ParseName("prod")
+	if target, _ := lookupAlias(alias); target.Model != "a" {
+		t.Fatalf("expected alias for a, got %v", target)
+	}
+
+	// the returned aliases are a copy of the cached ones
+	aliases, err := Aliases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clear(aliases)
+	if _, ok := lookupAlias(alias); !ok {
+		t.Fatal("expected alias to be cached")
+	}
+
+	write("registry.goobla.ai/library/b:latest", now.Add(time.Second))
+	if target, _ := lookupAlias(alias); target.Model != "b" {
+		t.Fatalf("expected changed alias for b, got %v", target)
+	}
+
+	if err := DeleteAlias(alias); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := lookupAlias(alias); ok {
+		t.Fatal("expected deleted alias to be gone")
+	}
+}
@@ -0,0 +1,413 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/envconfig"
+)
+
+// Once an API key is created, every request must be made with one, sent as
+// an Authorization bearer token or in the X-Api-Key header, whose scopes
+// allow it:
+//
+//   - read: list and show models and other information about the server
+//   - generate: run models, such as with generate, chat and embed requests
+//   - manage-models: pull, push, create, copy and delete models
+//   - admin: everything, including managing API keys, reading the audit log
+//     and changing the server's configuration
+//
+// Keys are stored hashed in keys.json in the models directory, so the secret
+// of a key is only known when it's created. The first key must have the admin
+// scope so keys can still be managed, and must be created over the unix
+// socket or from a loopback address, since no key is needed to create it.
+
+var (
+	errKeyNotFound    = errors.New("API key not found")
+	errInvalidAPIKey  = errors.New("invalid API key")
+	errMissingAPIKey  = errors.New("an API key is required")
+	errFirstKeyAdmin  = errors.New("the first API key must have the admin scope")
+	errFirstKeyRemote = errors.New("the first API key must be created on the server's machine")
+	errKeyNotAllowed  = errors.New("the API key doesn't have the scope needed for this request")
+	errInvalidKeyName = errors.New("API key name is required")
+)
+
+// apiKeyPrefix starts the secret of every key so they can be recognized.
+const apiKeyPrefix = "goobla_"
+
+// apiKeyFile is the on-disk format of a key.
+type apiKeyFile struct {
+	api.APIKey
+
+	// Hash is the hex encoded SHA-256 of the key's secret.
+	Hash string `json:"hash"`
+}
+
+// apiKeys are the keys in the keys file, cached until it changes. Holding
+// its lock also serializes updates to the file.
+var apiKeys cachedFile[[]apiKeyFile]
+
+func apiKeysPath() (string, error) {
+	dir, err := envconfig.Models()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "keys.json"), nil
+}
+
+// loadAPIKeys returns the keys. It must be called with apiKeys locked.
+func loadAPIKeys() ([]apiKeyFile, error) {
+	p, err := apiKeysPath()
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := apiKeys.load(p, func(p string, b []byte) ([]apiKeyFile, error) {
+		var keys []apiKeyFile
+		if err := json.Unmarshal(b, &keys); err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		return keys, nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return keys, err
+}
+
+// saveAPIKeys replaces the keys. It must be called with apiKeys locked.
+func saveAPIKeys(keys []apiKeyFile) error {
+	p, err := apiKeysPath()
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(p, b, 0o600); err != nil {
+		return err
+	}
+
+	apiKeys.reset()
+	return nil
+}
+
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// createAPIKey creates the key req, returning it with its secret. The first
+// key can only be created by local requests, since no key is needed to
+// create it.
+func createAPIKey(req api.CreateKeyRequest, local bool) (*api.APIKey, error) {
+	name, scopes := req.Name, req.Scopes
+	if strings.TrimSpace(name) == "" {
+		return nil, errInvalidKeyName
+	}
+
+	if len(scopes) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+
+	for _, scope := range scopes {
+		if !slices.Contains(api.APIKeyScopes, scope) {
+			return nil, fmt.Errorf("unknown scope %q, must be one of %s", scope, strings.Join(api.APIKeyScopes, ", "))
+		}
+	}
+
+	apiKeys.Lock()
+	defer apiKeys.Unlock()
+
+	keys, err := loadAPIKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 && !local {
+		return nil, errFirstKeyRemote
+	}
+
+	if len(keys) == 0 && !slices.Contains(scopes, api.ScopeAdmin) {
+		return nil, errFirstKeyAdmin
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	key := apiKeyFile{
+		APIKey: api.APIKey{
+			ID:        hex.EncodeToString(id),
+			Name:      name,
+			Scopes:    slices.Compact(slices.Sorted(slices.Values(scopes))),
+			CreatedAt: time.Now().UTC(),
+
+			RequestsPerMinute: req.RequestsPerMinute,
+			TokensPerMinute:   req.TokensPerMinute,
+		},
+	}
+
+	// the id is part of the secret so a key can be told apart without it
+	s := apiKeyPrefix + key.ID + "_" + hex.EncodeToString(secret)
+	key.Hash = hashAPIKey(s)
+
+	if err := saveAPIKeys(append(slices.Clone(keys), key)); err != nil {
+		return nil, err
+	}
+
+	created := key.APIKey
+	created.Key = s
+	return &created, nil
+}
+
+// listAPIKeys returns the keys, without their secrets.
+func listAPIKeys() ([]api.APIKey, error) {
+	apiKeys.Lock()
+	defer apiKeys.Unlock()
+
+	keys, err := loadAPIKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]api.APIKey, 0, len(keys))
+	for _, k := range keys {
+		list = append(list, k.APIKey)
+	}
+
+	return list, nil
+}
+
+// deleteAPIKey revokes the key id.
+func deleteAPIKey(id string) error {
+	apiKeys.Lock()
+	defer apiKeys.Unlock()
+
+	keys, err := loadAPIKeys()
+	if err != nil {
+		return err
+	}
+
+	i := slices.IndexFunc(keys, func(k apiKeyFile) bool { return k.ID == id })
+	if i < 0 {
+		return errKeyNotFound
+	}
+
+	return saveAPIKeys(slices.Delete(slices.Clone(keys), i, i+1))
+}
+
+// verifyAPIKey returns the key with the secret s, or nil if no keys have been
+// created so none are needed.
+func verifyAPIKey(s string) (*api.APIKey, error) {
+	apiKeys.Lock()
+	defer apiKeys.Unlock()
+
+	keys, err := loadAPIKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	if s == "" {
+		return nil, errMissingAPIKey
+	}
+
+	hash := hashAPIKey(s)
+	for _, k := range keys {
+		if subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hash)) == 1 {
+			return &k.APIKey, nil
+		}
+	}
+
+	return nil, errInvalidAPIKey
+}
+
+// requestAPIKey returns the API key the request c was made with, if any.
+func requestAPIKey(c *gin.Context) string {
+	if key := c.GetHeader("X-Api-Key"); key != "" {
+		return key
+	}
+
+	key, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return key
+}
+
+// isLocalRequest reports whether r was made over a unix socket or from a
+// loopback address.
+func isLocalRequest(r *http.Request) bool {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && addr.Network() == "unix" {
+		return true
+	}
+
+	addr, err := netip.ParseAddrPort(r.RemoteAddr)
+	return err == nil && addr.Addr().Unmap().IsLoopback()
+}
+
+// routeScope returns the scope a key needs for a request to the route with
+// the method, or "" if the route is open to all.
+func routeScope(method, route string) string {
+	switch route {
+	case "/", "/api/version", "/api/health", "/api/health/live", "/api/health/ready":
+		return ""
+	case "/api/keys", "/api/keys/:id", "/api/audit", "/api/config", "/api/admin/drain", "/api/sign":
+		return api.ScopeAdmin
+	case "/api/pull", "/api/push", "/api/create", "/api/delete", "/api/copy", "/api/edit",
+		"/api/blobs/:digest", "/api/blobs/:digest/link", "/api/pin", "/api/preload",
+		"/api/import", "/api/export", "/api/aliases":
+		if method == http.MethodGet || method == http.MethodHead {
+			return api.ScopeRead
+		}
+		return api.ScopeManageModels
+	case "/api/tags", "/api/show", "/api/ps", "/api/status", "/api/updates", "/api/manifests/*name",
+		"/api/health/storage", "/metrics", "/v1/models", "/v1/models/*model":
+		return api.ScopeRead
+	}
+
+	if strings.HasPrefix(route, "/api/") || strings.HasPrefix(route, "/v1/") || strings.HasPrefix(route, "/anthropic/") {
+		return api.ScopeGenerate
+	}
+
+	// unknown routes need the most access
+	return api.ScopeAdmin
+}
+
+// apiKeyMiddleware checks the API key or OIDC token of each request allows
+// it, once keys have been created or OIDC is enabled.
+func apiKeyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scope := routeScope(c.Request.Method, c.FullPath())
+		if scope == "" {
+			c.Next()
+			return
+		}
+
+		s := requestAPIKey(c)
+		if oidcEnabled() && isJWT(s) {
+			claims, err := verifyToken(c.Request.Context(), s)
+			if errors.Is(err, errInvalidToken) {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+				return
+			} else if err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+
+			if !allowsScope(claims.scopes, scope) {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": errKeyNotAllowed.Error()})
+				return
+			}
+
+			if claims.user != "" {
+				c.Set(userKey, claims.user)
+			}
+
+			c.Next()
+			return
+		}
+
+		key, err := verifyAPIKey(s)
+		if key == nil && err == nil && oidcEnabled() {
+			// without any API keys, a token is still needed
+			err = errMissingAPIKey
+		}
+
+		if errors.Is(err, errMissingAPIKey) || errors.Is(err, errInvalidAPIKey) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if key != nil && !allowsScope(key.Scopes, scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": errKeyNotAllowed.Error()})
+			return
+		}
+
+		if key != nil {
+			c.Set(apiKeyContextKey, key)
+		}
+
+		c.Next()
+	}
+}
+
+// allowsScope reports whether scopes allow requests that need scope.
+func allowsScope(scopes []string, scope string) bool {
+	return slices.Contains(scopes, scope) || slices.Contains(scopes, api.ScopeAdmin)
+}
+
+func (s *Server) ListKeysHandler(c *gin.Context) {
+	keys, err := listAPIKeys()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.ListKeysResponse{Keys: keys})
+}
+
+func (s *Server) CreateKeyHandler(c *gin.Context) {
+	var req api.CreateKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	key, err := createAPIKey(req, isLocalRequest(c.Request))
+	if err != nil {
+		status := http.StatusBadRequest
+		switch {
+		case errors.Is(err, errFirstKeyRemote):
+			status = http.StatusForbidden
+		case errors.Is(err, fs.ErrPermission):
+			status = http.StatusInternalServerError
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, key)
+}
+
+func (s *Server) DeleteKeyHandler(c *gin.Context) {
+	if err := deleteAPIKey(c.Param("id")); errors.Is(err, errKeyNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
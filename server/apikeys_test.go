@@ -0,0 +1,329 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/server/internal/cache/blob"
+	"github.com/goobla/goobla/server/internal/client/goobla"
+)
+
+func TestAPIKeys(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	var s Server
+	r := gin.New()
+	r.Use(apiKeyMiddleware())
+	r.GET("/api/version", func(c *gin.Context) {})
+	r.GET("/api/tags", func(c *gin.Context) {})
+	r.POST("/api/generate", func(c *gin.Context) {})
+	r.POST("/api/pull", func(c *gin.Context) {})
+	r.GET("/api/keys", s.ListKeysHandler)
+	r.POST("/api/keys", s.CreateKeyHandler)
+	r.DELETE("/api/keys/:id", s.DeleteKeyHandler)
+
+	remote := "192.0.2.1:1234"
+	do := func(method, path, key string, body any) *httptest.ResponseRecorder {
+		var b bytes.Buffer
+		if body != nil {
+			if err := json.NewEncoder(&b).Encode(body); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		req := httptest.NewRequest(method, path, &b)
+		req.RemoteAddr = remote
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	create := func(key, name string, scopes ...string) api.APIKey {
+		t.Helper()
+		w := do(http.MethodPost, "/api/keys", key, api.CreateKeyRequest{Name: name, Scopes: scopes})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200 creating %s, got %d: %s", name, w.Code, w.Body.String())
+		}
+
+		var k api.APIKey
+		if err := json.Unmarshal(w.Body.Bytes(), &k); err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	// no keys are needed until one is created
+	if w := do(http.MethodPost, "/api/generate", "", nil); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 without keys, got %d", w.Code)
+	}
+
+	// no key is needed to create the first one, so it can't be created
+	// remotely
+	if w := do(http.MethodPost, "/api/keys", "", api.CreateKeyRequest{Name: "admin", Scopes: []string{api.ScopeAdmin}}); w.Code != http.StatusForbidden {
+		t.Errorf("expected status 403 for a remote first key, got %d", w.Code)
+	}
+
+	remote = "127.0.0.1:1234"
+
+	if w := do(http.MethodPost, "/api/keys", "", api.CreateKeyRequest{Name: "app", Scopes: []string{"generate"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a first key without admin, got %d", w.Code)
+	}
+
+	admin := create("", "admin", api.ScopeAdmin)
+	if !strings.HasPrefix(admin.Key, apiKeyPrefix) {
+		t.Errorf("expected the key to start with %q, got %q", apiKeyPrefix, admin.Key)
+	}
+
+	if w := do(http.MethodPost, "/api/keys", admin.Key, api.CreateKeyRequest{Name: "app", Scopes: []string{"everything"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an unknown scope, got %d", w.Code)
+	}
+
+	// later keys are created with a key, from anywhere
+	remote = "192.0.2.1:1234"
+
+	app := create(admin.Key, "app", api.ScopeRead, api.ScopeGenerate)
+
+	cases := []struct {
+		method, path, key string
+		status            int
+	}{
+		{http.MethodGet, "/api/version", "", http.StatusOK},
+		{http.MethodGet, "/api/tags", "", http.StatusUnauthorized},
+		{http.MethodGet, "/api/tags", "goobla_bogus", http.StatusUnauthorized},
+		{http.MethodGet, "/api/tags", app.Key, http.StatusOK},
+		{http.MethodPost, "/api/generate", app.Key, http.StatusOK},
+		{http.MethodPost, "/api/pull", app.Key, http.StatusForbidden},
+		{http.MethodGet, "/api/keys", app.Key, http.StatusForbidden},
+		{http.MethodPost, "/api/pull", admin.Key, http.StatusOK},
+	}
+
+	for _, tt := range cases {
+		if w := do(tt.method, tt.path, tt.key, nil); w.Code != tt.status {
+			t.Errorf("%s %s: expected status %d, got %d", tt.method, tt.path, tt.status, w.Code)
+		}
+	}
+
+	// the key can also be sent in the X-Api-Key header
+	req := httptest.NewRequest(http.MethodGet, "/api/tags", nil)
+	req.Header.Set("X-Api-Key", app.Key)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200 with X-Api-Key, got %d", w.Code)
+	}
+
+	w = do(http.MethodGet, "/api/keys", admin.Key, nil)
+	var list api.ListKeysResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list.Keys) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(list.Keys))
+	}
+
+	for _, k := range list.Keys {
+		if k.Key != "" {
+			t.Errorf("expected the secret of %s not to be listed", k.Name)
+		}
+	}
+
+	if w := do(http.MethodDelete, "/api/keys/"+app.ID, admin.Key, nil); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 revoking, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if w := do(http.MethodGet, "/api/tags", app.Key, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 for a revoked key, got %d", w.Code)
+	}
+
+	if w := do(http.MethodDelete, "/api/keys/"+app.ID, admin.Key, nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 revoking twice, got %d", w.Code)
+	}
+}
+
+func TestRouteScopes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// every route must be listed so new ones don't silently get the
+	// generate scope. Routes for any method are listed with "*".
+	want := map[string]string{
+		"GET /":                                "",
+		"HEAD /":                               "",
+		"GET /api/version":                     "",
+		"HEAD /api/version":                    "",
+		"GET /api/health":                      "",
+		"HEAD /api/health":                     "",
+		"GET /api/health/live":                 "",
+		"HEAD /api/health/live":                "",
+		"GET /api/health/ready":                "",
+		"HEAD /api/health/ready":               "",
+		"GET /api/health/storage":              api.ScopeRead,
+		"GET /api/tags":                        api.ScopeRead,
+		"HEAD /api/tags":                       api.ScopeRead,
+		"POST /api/show":                       api.ScopeRead,
+		"GET /api/ps":                          api.ScopeRead,
+		"GET /api/status":                      api.ScopeRead,
+		"GET /api/updates":                     api.ScopeRead,
+		"GET /api/manifests/*name":             api.ScopeRead,
+		"GET /api/aliases":                     api.ScopeRead,
+		"GET /api/blobs/:digest":               api.ScopeRead,
+		"HEAD /api/blobs/:digest":              api.ScopeRead,
+		"GET /metrics":                         api.ScopeRead,
+		"GET /v1/models":                       api.ScopeRead,
+		"GET /v1/models/*model":                api.ScopeRead,
+		"POST /api/pull":                       api.ScopeManageModels,
+		"POST /api/push":                       api.ScopeManageModels,
+		"POST /api/create":                     api.ScopeManageModels,
+		"POST /api/copy":                       api.ScopeManageModels,
+		"POST /api/edit":                       api.ScopeManageModels,
+		"DELETE /api/delete":                   api.ScopeManageModels,
+		"POST /api/blobs/:digest":              api.ScopeManageModels,
+		"POST /api/blobs/:digest/link":         api.ScopeManageModels,
+		"POST /api/sign":                       api.ScopeAdmin,
+		"POST /api/pin":                        api.ScopeManageModels,
+		"DELETE /api/pin":                      api.ScopeManageModels,
+		"POST /api/preload":                    api.ScopeManageModels,
+		"DELETE /api/preload":                  api.ScopeManageModels,
+		"POST /api/import":                     api.ScopeManageModels,
+		"POST /api/export":                     api.ScopeManageModels,
+		"POST /api/aliases":                    api.ScopeManageModels,
+		"DELETE /api/aliases":                  api.ScopeManageModels,
+		"GET /api/keys":                        api.ScopeAdmin,
+		"POST /api/keys":                       api.ScopeAdmin,
+		"DELETE /api/keys/:id":                 api.ScopeAdmin,
+		"GET /api/audit":                       api.ScopeAdmin,
+		"GET /api/config":                      api.ScopeAdmin,
+		"PATCH /api/config":                    api.ScopeAdmin,
+		"POST /api/admin/drain":                api.ScopeAdmin,
+		"POST /api/generate":                   api.ScopeGenerate,
+		"POST /api/chat":                       api.ScopeGenerate,
+		"DELETE /api/chat/session":             api.ScopeGenerate,
+		"POST /api/embed":                      api.ScopeGenerate,
+		"POST /api/embeddings":                 api.ScopeGenerate,
+		"POST /api/rerank":                     api.ScopeGenerate,
+		"POST /api/tokenize":                   api.ScopeGenerate,
+		"POST /api/detokenize":                 api.ScopeGenerate,
+		"POST /api/template":                   api.ScopeGenerate,
+		"POST /api/score":                      api.ScopeGenerate,
+		"POST /api/compare":                    api.ScopeGenerate,
+		"POST /api/cancel/:id":                 api.ScopeGenerate,
+		"GET /api/conversations":               api.ScopeGenerate,
+		"POST /api/conversations":              api.ScopeGenerate,
+		"GET /api/conversations/:id":           api.ScopeGenerate,
+		"POST /api/conversations/:id/messages": api.ScopeGenerate,
+		"DELETE /api/conversations/:id":        api.ScopeGenerate,
+		"GET /api/sessions":                    api.ScopeGenerate,
+		"POST /api/sessions":                   api.ScopeGenerate,
+		"POST /api/sessions/:id/chat":          api.ScopeGenerate,
+		"DELETE /api/sessions/:id":             api.ScopeGenerate,
+		"GET /api/batch":                       api.ScopeGenerate,
+		"POST /api/batch":                      api.ScopeGenerate,
+		"GET /api/batch/:id":                   api.ScopeGenerate,
+		"POST /api/batch/:id/cancel":           api.ScopeGenerate,
+		"GET /api/batch/:id/results":           api.ScopeGenerate,
+		"DELETE /api/batch/:id":                api.ScopeGenerate,
+		"POST /v1/chat/completions":            api.ScopeGenerate,
+		"POST /v1/responses":                   api.ScopeGenerate,
+		"POST /v1/completions":                 api.ScopeGenerate,
+		"POST /v1/embeddings":                  api.ScopeGenerate,
+		"POST /v1/rerank":                      api.ScopeGenerate,
+		"POST /v1/audio/transcriptions":        api.ScopeGenerate,
+		"* /v1/audio/speech":                   api.ScopeGenerate,
+		"* /v1/audio/translations":             api.ScopeGenerate,
+		"* /v1/images/*path":                   api.ScopeGenerate,
+		"POST /anthropic/v1/messages":          api.ScopeGenerate,
+	}
+
+	var s Server
+	h, err := s.GenerateRoutes(slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, route := range h.(*gin.Engine).Routes() {
+		scope, ok := want[route.Method+" "+route.Path]
+		if !ok {
+			scope, ok = want["* "+route.Path]
+		}
+
+		if !ok {
+			t.Errorf("%s %s: no scope listed", route.Method, route.Path)
+		} else if got := routeScope(route.Method, route.Path); got != scope {
+			t.Errorf("%s %s: expected scope %q, got %q", route.Method, route.Path, scope, got)
+		}
+	}
+}
+
+func TestAPIKeysRegistryClient(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	t.Setenv("GOOBLA_MODELS", dir)
+
+	// use a cache of its own rather than the default one, which is only
+	// opened once
+	c, err := blob.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s Server
+	rc := &goobla.Registry{Cache: c, HTTPClient: panicOnRoundTrip}
+	h, err := s.GenerateRoutes(slog.New(slog.NewTextHandler(io.Discard, nil)), rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, path, key string, body any) *httptest.ResponseRecorder {
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest(method, path, &b)
+		req.RemoteAddr = "127.0.0.1:1234"
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do(http.MethodPost, "/api/keys", "", api.CreateKeyRequest{Name: "admin", Scopes: []string{api.ScopeAdmin}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 creating a key, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var admin api.APIKey
+	if err := json.Unmarshal(w.Body.Bytes(), &admin); err != nil {
+		t.Fatal(err)
+	}
+
+	// pulls and deletes handled by the new registry client still need a key
+	if w := do(http.MethodDelete, "/api/delete", "", api.DeleteRequest{Model: "test"}); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 deleting without a key, got %d", w.Code)
+	}
+
+	if w := do(http.MethodPost, "/api/pull", "", api.PullRequest{Model: "test"}); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 pulling without a key, got %d", w.Code)
+	}
+
+	if w := do(http.MethodDelete, "/api/delete", admin.Key, api.DeleteRequest{Model: "test"}); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 deleting a missing model with a key, got %d: %s", w.Code, w.Body.String())
+	}
+}
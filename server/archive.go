@@ -0,0 +1,236 @@
+package server
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/goobla/goobla/types/model"
+)
+
+// Model archives are zstd compressed tar files laid out like the models
+// directory. The first entry is the model's manifest, stored at
+// "manifests/<host>/<namespace>/<model>/<tag>", followed by each of the blobs
+// it references at "blobs/sha256-<hex>".
+
+var (
+	errArchiveNoManifest   = errors.New("archive does not start with a manifest")
+	errArchiveMissingBlob  = errors.New("archive is missing a blob")
+	errArchiveUnknownEntry = errors.New("archive contains an unexpected file")
+)
+
+// zstdMagic is the magic number at the start of a zstd frame.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// exportModel writes an archive of the model n to w.
+func exportModel(ctx context.Context, n model.Name, w io.Writer) error {
+	m, err := ParseNamedManifest(n)
+	if err != nil {
+		return err
+	}
+
+	// the manifest is copied as is so its digest is unchanged
+	manifest, err := os.ReadFile(m.filepath)
+	if err != nil {
+		return err
+	}
+
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	defer zw.Close()
+
+	tw := tar.NewWriter(zw)
+	defer tw.Close()
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    path.Join("manifests", n.Host, n.Namespace, n.Model, n.Tag),
+		Mode:    0o644,
+		Size:    int64(len(manifest)),
+		ModTime: m.fi.ModTime(),
+	}); err != nil {
+		return err
+	}
+
+	if _, err := tw.Write(manifest); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, layer := range append(m.Layers, m.Config) {
+		if layer.Digest == "" || seen[layer.Digest] {
+			continue
+		}
+		seen[layer.Digest] = true
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := exportBlob(ctx, tw, layer.Digest, m.fi.ModTime()); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// exportBlob writes the blob with digest to tw, with the modification time of
+// the manifest that uses it.
+func exportBlob(ctx context.Context, tw *tar.Writer, digest string, modTime time.Time) error {
+	size, err := localBlobs.Stat(ctx, digest)
+	if err != nil {
+		return err
+	}
+
+	r, err := localBlobs.Open(ctx, digest)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    path.Join("blobs", strings.Replace(digest, ":", "-", 1)),
+		Mode:    0o644,
+		Size:    size,
+		ModTime: modTime,
+	}); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, r)
+	return err
+}
+
+// importModel reads a model archive from r, which may be compressed with zstd
+// or not, and creates the model. The model takes the name stored in the
+// archive unless n is valid. Every blob is verified against its digest and
+// the model is only created once all of its blobs are present.
+func importModel(ctx context.Context, r io.Reader, n model.Name) (model.Name, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(len(zstdMagic)); err == nil && bytes.Equal(magic, zstdMagic) {
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return model.Name{}, err
+		}
+		defer zr.Close()
+
+		r = zr
+	} else {
+		r = br
+	}
+
+	tr := tar.NewReader(r)
+
+	hdr, err := tr.Next()
+	if errors.Is(err, io.EOF) {
+		return model.Name{}, errArchiveNoManifest
+	} else if err != nil {
+		return model.Name{}, err
+	}
+
+	parts := strings.Split(hdr.Name, "/")
+	if len(parts) != 5 || parts[0] != "manifests" {
+		return model.Name{}, errArchiveNoManifest
+	}
+
+	if !n.IsValid() {
+		n = model.ParseName(fmt.Sprintf("%s/%s/%s:%s", parts[1], parts[2], parts[3], parts[4]))
+		if !n.IsValid() {
+			return model.Name{}, fmt.Errorf("%w: invalid model name %q", errArchiveNoManifest, hdr.Name)
+		}
+	}
+
+	manifest, err := io.ReadAll(tr)
+	if err != nil {
+		return model.Name{}, err
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		return model.Name{}, fmt.Errorf("%w: %w", errArchiveNoManifest, err)
+	}
+
+	blobs := make(map[string]bool)
+	for _, layer := range append(m.Layers, m.Config) {
+		if layer.Digest != "" {
+			blobs[strings.Replace(layer.Digest, "-", ":", 1)] = false
+		}
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return model.Name{}, err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return model.Name{}, err
+		}
+
+		name, ok := strings.CutPrefix(hdr.Name, "blobs/")
+		digest := strings.Replace(name, "-", ":", 1)
+		if _, referenced := blobs[digest]; !ok || !referenced {
+			return model.Name{}, fmt.Errorf("%w: %q", errArchiveUnknownEntry, hdr.Name)
+		}
+
+		if _, err := localBlobs.Stat(ctx, digest); err == nil && !isCorrupted(digest) {
+			// already present, the tar reader skips the contents
+			blobs[digest] = true
+			continue
+		}
+
+		if err := localBlobs.Put(ctx, digest, tr, hdr.Size); err != nil {
+			return model.Name{}, err
+		}
+
+		if err := unmarkCorrupted(digest); err != nil {
+			return model.Name{}, err
+		}
+
+		blobs[digest] = true
+	}
+
+	for digest, found := range blobs {
+		if !found {
+			if _, err := localBlobs.Stat(ctx, digest); err != nil {
+				return model.Name{}, fmt.Errorf("%w: %s", errArchiveMissingBlob, digest)
+			}
+		}
+	}
+
+	manifests, err := GetManifestPath()
+	if err != nil {
+		return model.Name{}, err
+	}
+
+	p := filepath.Join(manifests, n.Filepath())
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return model.Name{}, err
+	}
+
+	if err := os.WriteFile(p, manifest, 0o644); err != nil {
+		return model.Name{}, err
+	}
+
+	return n, nil
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/fs/ggml"
+	"github.com/goobla/goobla/types/model"
+)
+
+func TestExportImport(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	var s Server
+	_, digest := createBinFile(t, ggml.KV{"general.architecture": "test"}, nil)
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:  "test",
+		Files:  map[string]string{"model.gguf": digest},
+		System: "You are a test.",
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = createRequest(t, s.ExportHandler, api.ExportRequest{Model: "missing"})
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = createRequest(t, s.ExportHandler, api.ExportRequest{Model: "test"})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/zstd", w.Header().Get("Content-Type"))
+	archive := w.Body.Bytes()
+
+	want, err := ParseNamedManifest(model.ParseName("test"))
+	require.NoError(t, err)
+
+	r := gin.New()
+	r.POST("/api/import", s.ImportHandler)
+
+	importArchive := func(query string, b []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/import"+query, bytes.NewReader(b))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// import into an empty models directory, as on another machine
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	w = importArchive("", archive)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp api.ImportResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, "test:latest", resp.Model)
+
+	got, err := ParseNamedManifest(model.ParseName("test"))
+	require.NoError(t, err)
+	assert.Equal(t, want.digest, got.digest)
+	for _, layer := range append(got.Layers, got.Config) {
+		require.NoError(t, verifyBlob(layer.Digest))
+	}
+
+	w = importArchive("?model=copy:v1", archive)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, "copy:v1", resp.Model)
+
+	_, err = ParseNamedManifest(model.ParseName("copy:v1"))
+	require.NoError(t, err)
+
+	w = importArchive("?model=bad!name", archive)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestImportTampered(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	_, digest := testBlob("model weights")
+	manifest, err := json.Marshal(Manifest{
+		SchemaVersion: 2,
+		Layers:        []Layer{{MediaType: "application/vnd.goobla.image.model", Digest: digest, Size: 13}},
+	})
+	require.NoError(t, err)
+
+	archive := func(files ...string) []byte {
+		var b bytes.Buffer
+		tw := tar.NewWriter(&b)
+		for i := 0; i < len(files); i += 2 {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: files[i], Mode: 0o644, Size: int64(len(files[i+1]))}))
+			_, err := tw.Write([]byte(files[i+1]))
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+		return b.Bytes()
+	}
+
+	name := "manifests/registry.goobla.ai/library/test/latest"
+	blob := "blobs/" + digest[:6] + "-" + digest[7:]
+
+	cases := map[string]struct {
+		archive []byte
+		err     error
+	}{
+		"modified":   {archive(name, string(manifest), blob, "model weighs"), errDigestMismatch},
+		"missing":    {archive(name, string(manifest)), errArchiveMissingBlob},
+		"unknown":    {archive(name, string(manifest), "blobs/../../etc/passwd", "root"), errArchiveUnknownEntry},
+		"blob first": {archive(blob, "model weights", name, string(manifest)), errArchiveNoManifest},
+	}
+
+	for name, tt := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := importModel(t.Context(), bytes.NewReader(tt.archive), model.Name{})
+			require.ErrorIs(t, err, tt.err)
+
+			manifests, err := GetManifestPath()
+			require.NoError(t, err)
+			_, err = os.Stat(filepath.Join(manifests, "registry.goobla.ai", "library", "test", "latest"))
+			require.ErrorIs(t, err, os.ErrNotExist, "the model must not be created")
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/goobla/goobla/api"
+)
+
+// Audio is sent in chat messages like images, as base64 encoded data or as
+// the URL or path of a file, which is loaded from the same hosts and
+// directories as images. Long WAV files are split into chunks the length of
+// the window audio encoders take, so each chunk is a separate input of the
+// message.
+
+// audioChunkDuration is the longest audio that's sent to the runner as one
+// input
+const audioChunkDuration = 30 * time.Second
+
+// prepareAudio replaces the references in audio with the files they refer
+// to, and splits long files into chunks.
+func prepareAudio(ctx context.Context, audio []api.AudioData) ([]api.AudioData, error) {
+	var chunks []api.AudioData
+	for _, data := range audio {
+		if ref := data.Ref(); ref != "" {
+			var err error
+			data, err = loadImage(ctx, ref)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load audio %s: %w", ref, err)
+			}
+		}
+
+		split, err := splitAudio(data, audioChunkDuration)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, chunk := range split {
+			chunks = append(chunks, chunk)
+		}
+	}
+
+	return chunks, nil
+}
+
+// splitAudio splits a WAV file into WAV files of at most d long. Files that
+// aren't WAV files are left as they are, for the model to decode.
+func splitAudio(data []byte, d time.Duration) ([][]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return [][]byte{data}, nil
+	}
+
+	var format, samples []byte
+	for b := data[12:]; len(b) >= 8; {
+		id, size := string(b[:4]), int(binary.LittleEndian.Uint32(b[4:8]))
+		b = b[8:]
+		if size > len(b) {
+			// the data chunk of streamed files may have the largest size
+			size = len(b)
+		}
+
+		switch id {
+		case "fmt ":
+			format = b[:size]
+		case "data":
+			samples = b[:size]
+		}
+
+		// chunks are padded to an even size
+		b = b[min(size+size%2, len(b)):]
+	}
+
+	if len(format) < 16 || samples == nil {
+		return nil, errors.New("invalid WAV file: missing fmt or data chunk")
+	}
+
+	byteRate := int(binary.LittleEndian.Uint32(format[8:12]))
+	blockAlign := int(binary.LittleEndian.Uint16(format[12:14]))
+	if byteRate == 0 || blockAlign == 0 {
+		return nil, errors.New("invalid WAV file: invalid format")
+	}
+
+	n := byteRate * int(d/time.Second)
+	n -= n % blockAlign
+	if n <= 0 || len(samples) <= n {
+		return [][]byte{data}, nil
+	}
+
+	var chunks [][]byte
+	for len(samples) > 0 {
+		chunk := samples[:min(n, len(samples))]
+		samples = samples[len(chunk):]
+
+		var b bytes.Buffer
+		b.WriteString("RIFF")
+		binary.Write(&b, binary.LittleEndian, uint32(4+8+len(format)+len(format)%2+8+len(chunk)))
+		b.WriteString("WAVEfmt ")
+		binary.Write(&b, binary.LittleEndian, uint32(len(format)))
+		b.Write(format)
+		if len(format)%2 == 1 {
+			b.WriteByte(0)
+		}
+		b.WriteString("data")
+		binary.Write(&b, binary.LittleEndian, uint32(len(chunk)))
+		b.Write(chunk)
+		chunks = append(chunks, b.Bytes())
+	}
+
+	return chunks, nil
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// testWAV returns a 16 kHz mono 16-bit WAV file of d long.
+func testWAV(d time.Duration) []byte {
+	samples := make([]byte, 2*16000*int(d/time.Second))
+
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(36+len(samples)))
+	b.WriteString("WAVEfmt ")
+	binary.Write(&b, binary.LittleEndian, uint32(16))
+	binary.Write(&b, binary.LittleEndian, uint16(1))       // PCM
+	binary.Write(&b, binary.LittleEndian, uint16(1))       // channels
+	binary.Write(&b, binary.LittleEndian, uint32(16000))   // sample rate
+	binary.Write(&b, binary.LittleEndian, uint32(2*16000)) // byte rate
+	binary.Write(&b, binary.LittleEndian, uint16(2))       // block align
+	binary.Write(&b, binary.LittleEndian, uint16(16))      // bits per sample
+	b.WriteString("data")
+	binary.Write(&b, binary.LittleEndian, uint32(len(samples)))
+	b.Write(samples)
+	return b.Bytes()
+}
+
+func TestSplitAudio(t *testing.T) {
+	cases := []struct {
+		name   string
+		data   []byte
+		chunks []time.Duration
+	}{
+		{name: "short", data: testWAV(10 * time.Second), chunks: []time.Duration{10 * time.Second}},
+		{name: "exact", data: testWAV(30 * time.Second), chunks: []time.Duration{30 * time.Second}},
+		{name: "long", data: testWAV(70 * time.Second), chunks: []time.Duration{30 * time.Second, 30 * time.Second, 10 * time.Second}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks, err := splitAudio(tt.data, 30*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(chunks) != len(tt.chunks) {
+				t.Fatalf("expected %d chunks, got %d", len(tt.chunks), len(chunks))
+			}
+
+			for i, chunk := range chunks {
+				// every chunk is a WAV file of its own
+				want := testWAV(tt.chunks[i])
+				if !bytes.Equal(chunk, want) {
+					t.Errorf("chunk %d: expected a %s WAV file of %d bytes, got %d bytes", i, tt.chunks[i], len(want), len(chunk))
+				}
+			}
+		})
+	}
+
+	t.Run("not wav", func(t *testing.T) {
+		chunks, err := splitAudio([]byte("audio"), 30*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(chunks) != 1 || string(chunks[0]) != "audio" {
+			t.Errorf("expected the audio to be kept, got %q", chunks)
+		}
+	})
+
+	t.Run("invalid wav", func(t *testing.T) {
+		if _, err := splitAudio([]byte("RIFF\x04\x00\x00\x00WAVE"), 30*time.Second); err == nil {
+			t.Error("expected error")
+		}
+	})
+}
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/envconfig"
+	"github.com/goobla/goobla/format"
+)
+
+// The audit log is a JSON Lines file with an [api.AuditEntry] for each
+// request that changes models or runs inference. It is only ever appended
+// to. When it grows past GOOBLA_AUDIT_LOG_MAX_SIZE it is renamed to
+// <path>.1, shifting older logs up to GOOBLA_AUDIT_LOG_BACKUPS.
+
+const (
+	defaultAuditLogMaxSize = 100 << 20
+
+	// maxAuditBody is the largest request body parsed for the model and
+	// parameters. Larger requests, such as archives, are recorded without
+	// them.
+	maxAuditBody = 16 << 20
+
+	defaultAuditLimit = 100
+)
+
+// auditContentFields are request fields that hold content rather than
+// parameters, or credentials, which are left out of the audit log.
+var auditContentFields = []string{
+	"adapters", "context", "files", "images", "input", "license", "messages",
+	"modelfile", "password", "prompt", "suffix", "system", "template", "tools",
+	"username",
+}
+
+// auditModelFields are the request fields naming the model, in order of
+// preference.
+var auditModelFields = []string{"model", "name", "source", "alias"}
+
+var errAuditDisabled = errors.New("the audit log is disabled, set GOOBLA_AUDIT_LOG to enable it")
+
+// auditMu serializes writes to the audit log
+var auditMu sync.Mutex
+
+func auditLogMaxSize() int64 {
+	s := envconfig.AuditLogMaxSize()
+	if s == "" {
+		return defaultAuditLogMaxSize
+	}
+
+	n, err := format.ParseBytes(s)
+	if err != nil || n <= 0 {
+		slog.Warn("invalid GOOBLA_AUDIT_LOG_MAX_SIZE, using default", "value", s)
+		return defaultAuditLogMaxSize
+	}
+
+	return n
+}
+
+// writeAudit appends e to the audit log at p, rotating it first if it is
+// full.
+func writeAudit(p string, e api.AuditEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+
+	if fi, err := os.Stat(p); err == nil && fi.Size()+int64(len(b)) > auditLogMaxSize() {
+		if err := rotateAuditLog(p, int(envconfig.AuditLogBackups())); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func rotateAuditLog(p string, backups int) error {
+	if backups == 0 {
+		return os.Remove(p)
+	}
+
+	if err := os.Remove(fmt.Sprintf("%s.%d", p, backups)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	for i := backups - 1; i > 0; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", p, i), fmt.Sprintf("%s.%d", p, i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return os.Rename(p, p+".1")
+}
+
+// auditLogFiles returns the audit log at p and its rotated backups, oldest
+// first.
+func auditLogFiles(p string) []string {
+	var files []string
+	for i := int(envconfig.AuditLogBackups()); i > 0; i-- {
+		files = append(files, fmt.Sprintf("%s.%d", p, i))
+	}
+	return append(files, p)
+}
+
+// auditRequest parses the JSON body b for the model and parameters of a
+// request.
+func auditRequest(b []byte) (string, map[string]any) {
+	var fields map[string]any
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return "", nil
+	}
+
+	var model string
+	for _, k := range auditModelFields {
+		if s, ok := fields[k].(string); ok && s != "" {
+			model = s
+			break
+		}
+	}
+
+	for _, k := range auditModelFields {
+		if s, ok := fields[k].(string); ok && s == model {
+			delete(fields, k)
+		}
+	}
+
+	for _, k := range auditContentFields {
+		delete(fields, k)
+	}
+
+	if len(fields) == 0 {
+		return model, nil
+	}
+
+	return model, fields
+}
+
+// auditWriter remembers the last line written to the response, which holds
+// the error of a streamed response that fails.
+type auditWriter struct {
+	gin.ResponseWriter
+	last []byte
+}
+
+func (w *auditWriter) Write(b []byte) (int, error) {
+	if line := bytes.TrimSpace(b); len(line) > 0 {
+		if i := bytes.LastIndexByte(line, '\n'); i >= 0 {
+			line = line[i+1:]
+		}
+		w.last = append(w.last[:0], line...)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *auditWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// auditMiddleware records requests for action in the audit log.
+func auditMiddleware(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p := envconfig.AuditLog()
+		if p == "" {
+			c.Next()
+			return
+		}
+
+		e := api.AuditEntry{
+			Time:       time.Now().UTC(),
+			Action:     action,
+			User:       requestUser(c),
+			RemoteAddr: c.ClientIP(),
+			Model:      c.Query("model"),
+		}
+
+		if c.Request.Body != nil {
+			b, err := io.ReadAll(io.LimitReader(c.Request.Body, maxAuditBody+1))
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.Request.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(b), c.Request.Body), c.Request.Body}
+
+			if len(b) <= maxAuditBody {
+				model, params := auditRequest(b)
+				e.Model = cmp.Or(model, e.Model)
+				e.Parameters = params
+			}
+		}
+
+		w := &auditWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+
+		e.Status = w.Status()
+		var resp struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(w.last, &resp) == nil {
+			e.Error = resp.Error
+		}
+
+		if err := writeAudit(p, e); err != nil {
+			slog.Warn("couldn't write audit log", "error", err)
+		}
+	}
+}
+
+func (s *Server) AuditHandler(c *gin.Context) {
+	p := envconfig.AuditLog()
+	if p == "" {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": errAuditDisabled.Error()})
+		return
+	}
+
+	model, action, user := c.Query("model"), c.Query("action"), c.Query("user")
+
+	// users of a multi-user server only see their own requests
+	if u := requestUser(c); u != "" {
+		user = u
+	}
+
+	var since time.Time
+	if s := c.Query("since"); s != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid since: %v", err)})
+			return
+		}
+	}
+
+	limit := defaultAuditLimit
+	if s := c.Query("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid limit %q", s)})
+			return
+		}
+		limit = n
+	}
+
+	entries := []api.AuditEntry{}
+	for _, fp := range auditLogFiles(p) {
+		f, err := os.Open(fp)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, maxAuditBody)
+		for scanner.Scan() {
+			var e api.AuditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				slog.Warn("skipping invalid audit log entry", "file", fp, "error", err)
+				continue
+			}
+
+			if (model != "" && e.Model != model) ||
+				(action != "" && e.Action != action) ||
+				(user != "" && e.User != user) ||
+				e.Time.Before(since) {
+				continue
+			}
+
+			entries = append(entries, e)
+			if len(entries) > limit {
+				entries = slices.Delete(entries, 0, len(entries)-limit)
+			}
+		}
+
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, api.AuditResponse{Entries: entries})
+}
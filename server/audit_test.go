@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/fs/ggml"
+	"github.com/goobla/goobla/types/model"
+)
+
+func queryAudit(t *testing.T, s *Server, query string) []api.AuditEntry {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/audit?"+query, nil)
+	s.AuditHandler(c)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp api.AuditResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	return resp.Entries
+}
+
+func TestAuditMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+	t.Setenv("GOOBLA_AUDIT_LOG", filepath.Join(t.TempDir(), "audit", "audit.jsonl"))
+
+	var s Server
+	r := gin.New()
+	r.POST("/api/create", auditMiddleware("create"), s.CreateHandler)
+	r.POST("/api/copy", auditMiddleware("copy"), s.CopyHandler)
+	r.DELETE("/api/delete", auditMiddleware("delete"), s.DeleteHandler)
+	r.POST("/api/generate", auditMiddleware("generate"), func(c *gin.Context) {
+		// a streamed response that fails after it starts
+		c.Writer.WriteString(`{"response":"hello"}` + "\n")
+		c.Writer.WriteString(`{"error":"runner crashed"}` + "\n")
+	})
+
+	do := func(method, path string, body any) *httptest.ResponseRecorder {
+		var b bytes.Buffer
+		require.NoError(t, json.NewEncoder(&b).Encode(body))
+
+		w := NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, &b))
+		return w.ResponseRecorder
+	}
+
+	_, digest := createBinFile(t, ggml.KV{"general.architecture": "test"}, nil)
+	w := do(http.MethodPost, "/api/create", api.CreateRequest{
+		Model:  "test",
+		Files:  map[string]string{"model.gguf": digest},
+		System: "you are a secret agent",
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// the handler still reads the whole body
+	_, err := ParseNamedManifest(model.ParseName("test"))
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/api/copy", api.CopyRequest{Source: "test", Destination: "copy"}).Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/api/delete", api.DeleteRequest{Model: "missing"}).Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/api/generate", api.GenerateRequest{Model: "test", Prompt: "hi", Options: map[string]any{"temperature": 0.5}}).Code)
+
+	entries := queryAudit(t, &s, "")
+	require.Len(t, entries, 4)
+
+	create := entries[0]
+	assert.Equal(t, "create", create.Action)
+	assert.Equal(t, "test", create.Model)
+	assert.Equal(t, http.StatusOK, create.Status)
+	assert.NotEmpty(t, create.RemoteAddr)
+	assert.False(t, create.Time.IsZero())
+	assert.NotContains(t, create.Parameters, "files")
+	assert.NotContains(t, create.Parameters, "system")
+
+	cp := entries[1]
+	assert.Equal(t, "copy", cp.Action)
+	assert.Equal(t, "test", cp.Model)
+	assert.Equal(t, map[string]any{"destination": "copy"}, cp.Parameters)
+
+	del := entries[2]
+	assert.Equal(t, "delete", del.Action)
+	assert.Equal(t, http.StatusNotFound, del.Status)
+	assert.Equal(t, "model 'missing' not found", del.Error)
+
+	generate := entries[3]
+	assert.Equal(t, "generate", generate.Action)
+	assert.Equal(t, http.StatusOK, generate.Status)
+	assert.Equal(t, "runner crashed", generate.Error)
+	assert.Equal(t, map[string]any{"temperature": 0.5}, generate.Parameters["options"])
+	assert.NotContains(t, generate.Parameters, "prompt")
+
+	t.Run("filter", func(t *testing.T) {
+		entries := queryAudit(t, &s, "model=test&action=copy")
+		require.Len(t, entries, 1)
+		assert.Equal(t, "copy", entries[0].Action)
+
+		entries = queryAudit(t, &s, "limit=2")
+		require.Len(t, entries, 2)
+		assert.Equal(t, "delete", entries[0].Action)
+		assert.Equal(t, "generate", entries[1].Action)
+
+		entries = queryAudit(t, &s, "since="+generate.Time.Format("2006-01-02T15:04:05.999999999Z07:00"))
+		require.Len(t, entries, 1)
+		assert.Equal(t, "generate", entries[0].Action)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Setenv("GOOBLA_AUDIT_LOG", "")
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/audit", nil)
+		s.AuditHandler(c)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := filepath.Join(t.TempDir(), "audit.jsonl")
+	t.Setenv("GOOBLA_AUDIT_LOG", p)
+	t.Setenv("GOOBLA_AUDIT_LOG_MAX_SIZE", "1KB")
+	t.Setenv("GOOBLA_AUDIT_LOG_BACKUPS", "2")
+
+	for i := range 50 {
+		require.NoError(t, writeAudit(p, api.AuditEntry{Action: "pull", Model: fmt.Sprintf("model-%02d", i), Status: http.StatusOK}))
+	}
+
+	for _, fp := range []string{p, p + ".1", p + ".2"} {
+		fi, err := os.Stat(fp)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, fi.Size(), int64(1000))
+	}
+
+	_, err := os.Stat(p + ".3")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// entries are returned oldest first across the rotated logs
+	var s Server
+	entries := queryAudit(t, &s, "limit=1000")
+	require.NotEmpty(t, entries)
+	assert.Less(t, len(entries), 50)
+	assert.Equal(t, "model-49", entries[len(entries)-1].Model)
+	for i := 1; i < len(entries); i++ {
+		assert.Less(t, entries[i-1].Model, entries[i].Model)
+	}
+}
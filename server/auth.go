@@ -1,6 +1,7 @@
 package server
 
 import (
+	"cmp"
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
@@ -93,3 +94,70 @@ func getAuthorizationToken(ctx context.Context, challenge registryChallenge) (st
 
 	return token.Token, nil
 }
+
+// getRegistryToken exchanges challenge for a bearer token using the
+// authentication flow of the registry described by regOpts.
+func getRegistryToken(ctx context.Context, challenge registryChallenge, regOpts *registryOptions) (string, error) {
+	if regOpts != nil && regOpts.OCI {
+		return getOCIAuthorizationToken(ctx, challenge, regOpts)
+	}
+
+	return getAuthorizationToken(ctx, challenge)
+}
+
+// getOCIAuthorizationToken requests a token from the realm of challenge using
+// the token authentication flow of the OCI distribution spec. Credentials in
+// regOpts, if any, are sent to the realm using basic authentication.
+func getOCIAuthorizationToken(ctx context.Context, challenge registryChallenge, regOpts *registryOptions) (string, error) {
+	if challenge.Realm == "" {
+		// basic auth challenges have no realm to exchange
+		// credentials with
+		return "", errUnauthorized
+	}
+
+	redirectURL, err := url.Parse(challenge.Realm)
+	if err != nil {
+		return "", err
+	}
+
+	values := redirectURL.Query()
+	if challenge.Service != "" {
+		values.Add("service", challenge.Service)
+	}
+	for _, s := range strings.Fields(challenge.Scope) {
+		values.Add("scope", s)
+	}
+	redirectURL.RawQuery = values.Encode()
+
+	response, err := makeRequest(ctx, http.MethodGet, redirectURL, nil, nil, &registryOptions{
+		Username: regOpts.Username,
+		Password: regOpts.Password,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return "", fmt.Errorf("%d: %v", response.StatusCode, err)
+	}
+
+	if response.StatusCode >= http.StatusBadRequest {
+		if len(body) > 0 {
+			return "", fmt.Errorf("%d: %s", response.StatusCode, body)
+		}
+		return "", fmt.Errorf("%d", response.StatusCode)
+	}
+
+	// registries return the token as either "token" or "access_token"
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", err
+	}
+
+	return cmp.Or(token.Token, token.AccessToken), nil
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestGetOCIAuthorizationToken(t *testing.T) {
+	var got url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Query()
+		if user, pass, ok := r.BasicAuth(); ok {
+			if user != "alice" || pass != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"token": "private"}) //nolint:errcheck
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "anonymous"}) //nolint:errcheck
+	}))
+	defer srv.Close()
+
+	challenge := parseRegistryChallenge(`Bearer realm="` + srv.URL + `/token",service="ghcr.io",scope="repository:ns/repo:pull repository:ns/repo:push"`)
+
+	t.Run("anonymous", func(t *testing.T) {
+		token, err := getOCIAuthorizationToken(t.Context(), challenge, &registryOptions{OCI: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "anonymous" {
+			t.Errorf("token = %q, want %q", token, "anonymous")
+		}
+		if s := got.Get("service"); s != "ghcr.io" {
+			t.Errorf("service = %q, want %q", s, "ghcr.io")
+		}
+		if s := got["scope"]; len(s) != 2 {
+			t.Errorf("scope = %v, want 2 scopes", s)
+		}
+	})
+
+	t.Run("credentials", func(t *testing.T) {
+		token, err := getOCIAuthorizationToken(t.Context(), challenge, &registryOptions{OCI: true, Username: "alice", Password: "secret"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "private" {
+			t.Errorf("token = %q, want %q", token, "private")
+		}
+	})
+
+	t.Run("bad credentials", func(t *testing.T) {
+		if _, err := getOCIAuthorizationToken(t.Context(), challenge, &registryOptions{OCI: true, Username: "alice", Password: "wrong"}); err == nil {
+			t.Error("expected error")
+		}
+	})
+
+	t.Run("basic challenge", func(t *testing.T) {
+		if _, err := getOCIAuthorizationToken(t.Context(), parseRegistryChallenge(`Basic realm=""`), &registryOptions{OCI: true}); err == nil {
+			t.Error("expected error")
+		}
+	})
+}
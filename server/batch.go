@@ -0,0 +1,745 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/envconfig"
+)
+
+// Batches are requests processed one at a time in the background with low
+// priority, so they only use models when interactive requests don't. Each is
+// stored in the batches directory of the models directory: the batch in
+// <id>.json, its requests in <id>.input.jsonl and the results of the
+// requests processed so far in <id>.jsonl. Batches being processed when the
+// server stops are resumed when it starts again.
+
+const maxBatchRequests = 50_000
+
+const (
+	batchQueued     = "queued"
+	batchInProgress = "in_progress"
+	batchCompleted  = "completed"
+	batchFailed     = "failed"
+	batchCancelling = "cancelling"
+	batchCancelled  = "cancelled"
+)
+
+var batchEndpoints = []string{"/api/chat", "/api/generate"}
+
+var (
+	errBatchNotFound = errors.New("batch not found")
+	errInvalidBatch  = errors.New("invalid batch")
+)
+
+var (
+	// batchesMu serializes updates to batches and guards batchRunning.
+	// Reads do not take the lock since files are replaced atomically.
+	batchesMu sync.Mutex
+
+	// batchRunning is the batch being processed and cancels it
+	batchRunning struct {
+		id     string
+		cancel context.CancelFunc
+	}
+
+	// batchWake wakes the batch worker when a batch is queued
+	batchWake = make(chan struct{}, 1)
+)
+
+// batchFile is the on-disk format of a batch.
+type batchFile struct {
+	User string `json:"user,omitempty"`
+	api.Batch
+}
+
+// batchPath returns the path of the file of the batch id with the suffix,
+// ".json", ".input.jsonl" or ".jsonl". The id must be one created by
+// newBatch.
+func batchPath(id, suffix string) (string, error) {
+	if b, err := hex.DecodeString(id); err != nil || len(b) != 16 || strings.ToLower(id) != id {
+		return "", errBatchNotFound
+	}
+
+	dir, err := envconfig.Models()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "batches", id+suffix), nil
+}
+
+func readBatch(p string) (*batchFile, error) {
+	b, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errBatchNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var f batchFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+
+	return &f, nil
+}
+
+func writeBatch(p string, f *batchFile) error {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(p, b, 0o600)
+}
+
+// batchItems returns the requests of req, checked and with their bodies set
+// not to stream and to have low priority.
+func batchItems(req api.BatchRequest) ([]api.BatchItem, error) {
+	var items []api.BatchItem
+	switch {
+	case len(req.Requests) > 0 && req.File != "":
+		return nil, fmt.Errorf("%w: requests and file can't both be set", errInvalidBatch)
+	case req.File != "":
+		f, err := localBlobs.Open(context.TODO(), req.File)
+		if errors.Is(err, ErrInvalidDigestFormat) {
+			return nil, fmt.Errorf("%w: %w", errInvalidBatch, err)
+		} else if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("%w: file %s not found", errInvalidBatch, req.File)
+		} else if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		d := json.NewDecoder(f)
+		for {
+			var item api.BatchItem
+			if err := d.Decode(&item); errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("%w: file line %d: %w", errInvalidBatch, len(items)+1, err)
+			}
+
+			if len(items) == maxBatchRequests {
+				return nil, fmt.Errorf("%w: at most %d requests are allowed", errInvalidBatch, maxBatchRequests)
+			}
+
+			items = append(items, item)
+		}
+	default:
+		items = req.Requests
+	}
+
+	if len(items) == 0 {
+		return nil, fmt.Errorf("%w: requests or file is required", errInvalidBatch)
+	}
+
+	if len(items) > maxBatchRequests {
+		return nil, fmt.Errorf("%w: at most %d requests are allowed", errInvalidBatch, maxBatchRequests)
+	}
+
+	endpoint := cmp.Or(req.Endpoint, "/api/chat")
+	if !slices.Contains(batchEndpoints, endpoint) {
+		return nil, fmt.Errorf("%w: endpoint %q isn't supported, must be one of %s", errInvalidBatch, endpoint, strings.Join(batchEndpoints, ", "))
+	}
+
+	ids := make(map[string]bool)
+	for i, item := range items {
+		if item.CustomID == "" {
+			return nil, fmt.Errorf("%w: request %d: custom_id is required", errInvalidBatch, i)
+		}
+
+		if ids[item.CustomID] {
+			return nil, fmt.Errorf("%w: request %d: duplicate custom_id %q", errInvalidBatch, i, item.CustomID)
+		}
+		ids[item.CustomID] = true
+
+		if item.Method != "" && item.Method != http.MethodPost {
+			return nil, fmt.Errorf("%w: request %q: method must be POST", errInvalidBatch, item.CustomID)
+		}
+
+		item.Method = http.MethodPost
+		item.URL = cmp.Or(item.URL, endpoint)
+
+		var body any
+		stream := false
+		switch item.URL {
+		case "/api/chat":
+			var r api.ChatRequest
+			if err := json.Unmarshal(item.Body, &r); err != nil {
+				return nil, fmt.Errorf("%w: request %q: %w", errInvalidBatch, item.CustomID, err)
+			}
+
+			r.Stream, r.Priority = &stream, priorityLow.String()
+			body = r
+		case "/api/generate":
+			var r api.GenerateRequest
+			if err := json.Unmarshal(item.Body, &r); err != nil {
+				return nil, fmt.Errorf("%w: request %q: %w", errInvalidBatch, item.CustomID, err)
+			}
+
+			r.Stream, r.Priority = &stream, priorityLow.String()
+			body = r
+		default:
+			return nil, fmt.Errorf("%w: request %q: url %q isn't supported, must be one of %s", errInvalidBatch, item.CustomID, item.URL, strings.Join(batchEndpoints, ", "))
+		}
+
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+
+		item.Body = b
+		items[i] = item
+	}
+
+	return items, nil
+}
+
+// newBatch queues the requests of req for user.
+func newBatch(user string, req api.BatchRequest) (*api.Batch, error) {
+	items, err := batchItems(req)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	p, err := batchPath(hex.EncodeToString(id), ".json")
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	e := json.NewEncoder(&b)
+	for _, item := range items {
+		if err := e.Encode(item); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return nil, err
+	}
+
+	// the requests are written first so a batch is never seen without them
+	input := strings.TrimSuffix(p, ".json") + ".input.jsonl"
+	if err := os.WriteFile(input, b.Bytes(), 0o644); err != nil {
+		return nil, err
+	}
+
+	f := batchFile{
+		User: user,
+		Batch: api.Batch{
+			ID:            hex.EncodeToString(id),
+			Status:        batchQueued,
+			Endpoint:      cmp.Or(req.Endpoint, "/api/chat"),
+			RequestCounts: api.BatchRequestCounts{Total: len(items)},
+			Metadata:      req.Metadata,
+			CreatedAt:     time.Now().UTC(),
+		},
+	}
+
+	if err := writeBatch(p, &f); err != nil {
+		os.Remove(input)
+		return nil, err
+	}
+
+	select {
+	case batchWake <- struct{}{}:
+	default:
+	}
+
+	return &f.Batch, nil
+}
+
+// getBatch returns the batch id of user. Other users' batches are reported
+// as not found.
+func getBatch(user, id string) (*api.Batch, error) {
+	p, err := batchPath(id, ".json")
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := readBatch(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.User != user {
+		return nil, errBatchNotFound
+	}
+
+	return &f.Batch, nil
+}
+
+// allBatches returns the batches of all users, most recently created first.
+func allBatches() ([]batchFile, error) {
+	dir, err := envconfig.Models()
+	if err != nil {
+		return nil, err
+	}
+
+	matches, err := filepath.Glob(filepath.Join(dir, "batches", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var batches []batchFile
+	for _, p := range matches {
+		f, err := readBatch(p)
+		if errors.Is(err, errBatchNotFound) {
+			// deleted since it was listed
+			continue
+		} else if err != nil {
+			slog.Warn("ignoring invalid batch", "error", err)
+			continue
+		}
+
+		if f.ID == "" {
+			continue
+		}
+
+		batches = append(batches, *f)
+	}
+
+	slices.SortFunc(batches, func(a, b batchFile) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+
+	return batches, nil
+}
+
+// listBatches returns the batches of user, most recently created first.
+func listBatches(user string) ([]api.Batch, error) {
+	all, err := allBatches()
+	if err != nil {
+		return nil, err
+	}
+
+	batches := []api.Batch{}
+	for _, f := range all {
+		if f.User == user {
+			batches = append(batches, f.Batch)
+		}
+	}
+
+	return batches, nil
+}
+
+// updateBatch calls fn with the batch id to update it. It doesn't check the
+// user of the batch, which fn may do.
+func updateBatch(id string, fn func(*batchFile) error) (*api.Batch, error) {
+	batchesMu.Lock()
+	defer batchesMu.Unlock()
+
+	p, err := batchPath(id, ".json")
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := readBatch(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fn(f); err != nil {
+		return nil, err
+	}
+
+	if err := writeBatch(p, f); err != nil {
+		return nil, err
+	}
+
+	return &f.Batch, nil
+}
+
+// cancelBatch cancels the batch id of user. Batches that are already done
+// are left as they are.
+func cancelBatch(user, id string) (*api.Batch, error) {
+	return updateBatch(id, func(f *batchFile) error {
+		if f.User != user {
+			return errBatchNotFound
+		}
+
+		now := time.Now().UTC()
+		switch f.Status {
+		case batchQueued:
+			f.Status, f.CancelledAt = batchCancelled, &now
+		case batchInProgress:
+			f.Status = batchCancelling
+			if batchRunning.id == id {
+				batchRunning.cancel()
+			}
+		}
+
+		return nil
+	})
+}
+
+// deleteBatch deletes the batch id of user and its results, cancelling it if
+// it's being processed.
+func deleteBatch(user, id string) error {
+	batchesMu.Lock()
+	defer batchesMu.Unlock()
+
+	p, err := batchPath(id, ".json")
+	if err != nil {
+		return err
+	}
+
+	f, err := readBatch(p)
+	if err != nil {
+		return err
+	}
+
+	if f.User != user {
+		return errBatchNotFound
+	}
+
+	if batchRunning.id == id {
+		batchRunning.cancel()
+	}
+
+	if err := os.Remove(p); err != nil {
+		return err
+	}
+
+	base := strings.TrimSuffix(p, ".json")
+	for _, p := range []string{base + ".input.jsonl", base + ".jsonl"} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runBatches processes queued batches, oldest first, until ctx is done.
+func (s *Server) runBatches(ctx context.Context) {
+	h := s.internalHandler()
+	for {
+		f, err := nextBatch()
+		if err != nil {
+			slog.Warn("failed to find the next batch", "error", err)
+		}
+
+		if f == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-batchWake:
+			}
+			continue
+		}
+
+		processBatch(ctx, h, f)
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// nextBatch returns the oldest batch that isn't done, or nil if there isn't
+// one.
+func nextBatch() (*batchFile, error) {
+	all, err := allBatches()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range slices.Backward(all) {
+		switch f.Status {
+		case batchQueued, batchInProgress, batchCancelling:
+			return &f, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// processBatch makes the requests of the batch f which haven't been made yet
+// with h, appending their results to its results. Processing stops when ctx
+// is done, leaving the batch to be resumed.
+func processBatch(ctx context.Context, h http.Handler, f *batchFile) {
+	id := f.ID
+
+	bctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	batchesMu.Lock()
+	batchRunning.id, batchRunning.cancel = id, cancel
+	batchesMu.Unlock()
+
+	defer func() {
+		batchesMu.Lock()
+		batchRunning.id, batchRunning.cancel = "", nil
+		batchesMu.Unlock()
+	}()
+
+	fail := func(err error) {
+		slog.Warn("batch failed", "id", id, "error", err)
+		if _, err := updateBatch(id, func(f *batchFile) error {
+			now := time.Now().UTC()
+			f.Status, f.Error, f.CompletedAt = batchFailed, err.Error(), &now
+			return nil
+		}); err != nil && !errors.Is(err, errBatchNotFound) {
+			slog.Warn("failed to update batch", "id", id, "error", err)
+		}
+	}
+
+	input, err := batchPath(id, ".input.jsonl")
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	items, err := readBatchItems(input)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	output := strings.TrimSuffix(input, ".input.jsonl") + ".jsonl"
+	counts, err := countBatchResults(output)
+	if err != nil {
+		fail(err)
+		return
+	}
+	counts.Total = len(items)
+
+	if _, err := updateBatch(id, func(f *batchFile) error {
+		if f.Status == batchCancelling {
+			cancel()
+			return nil
+		}
+
+		f.Status, f.RequestCounts = batchInProgress, counts
+		if f.StartedAt == nil {
+			now := time.Now().UTC()
+			f.StartedAt = &now
+		}
+		return nil
+	}); errors.Is(err, errBatchNotFound) {
+		return
+	} else if err != nil {
+		fail(err)
+		return
+	}
+
+	results, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer results.Close()
+
+	bctx = context.WithValue(bctx, batchUserKey{}, f.User)
+	for i := counts.Completed + counts.Failed; i < len(items) && bctx.Err() == nil; i++ {
+		r := runBatchItem(bctx, h, items[i])
+		if bctx.Err() != nil {
+			// the request was interrupted, so it's made again if the batch
+			// is resumed
+			break
+		}
+
+		r.ID = fmt.Sprintf("%s-%d", id, i)
+		b, err := json.Marshal(r)
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		if _, err := results.Write(append(b, '\n')); err != nil {
+			fail(err)
+			return
+		}
+
+		if r.Response.StatusCode < http.StatusBadRequest {
+			counts.Completed++
+		} else {
+			counts.Failed++
+		}
+
+		if _, err := updateBatch(id, func(f *batchFile) error {
+			f.RequestCounts = counts
+			return nil
+		}); errors.Is(err, errBatchNotFound) {
+			return
+		} else if err != nil {
+			slog.Warn("failed to update batch", "id", id, "error", err)
+		}
+	}
+
+	if ctx.Err() != nil {
+		// the server is stopping
+		return
+	}
+
+	if _, err := updateBatch(id, func(f *batchFile) error {
+		now := time.Now().UTC()
+		if f.Status == batchCancelling {
+			f.Status, f.CancelledAt = batchCancelled, &now
+		} else {
+			f.Status, f.CompletedAt = batchCompleted, &now
+		}
+		return nil
+	}); err != nil && !errors.Is(err, errBatchNotFound) {
+		slog.Warn("failed to update batch", "id", id, "error", err)
+	}
+}
+
+func readBatchItems(p string) ([]api.BatchItem, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var items []api.BatchItem
+	d := json.NewDecoder(f)
+	for {
+		var item api.BatchItem
+		if err := d.Decode(&item); errors.Is(err, io.EOF) {
+			return items, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+
+		items = append(items, item)
+	}
+}
+
+// countBatchResults counts the results in the results file p, which may not
+// exist yet.
+func countBatchResults(p string) (api.BatchRequestCounts, error) {
+	var counts api.BatchRequestCounts
+
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return counts, nil
+	} else if err != nil {
+		return counts, err
+	}
+	defer f.Close()
+
+	d := json.NewDecoder(f)
+	for {
+		var r api.BatchResult
+		if err := d.Decode(&r); errors.Is(err, io.EOF) {
+			return counts, nil
+		} else if err != nil {
+			return counts, fmt.Errorf("%s: %w", p, err)
+		}
+
+		if r.Response.StatusCode < http.StatusBadRequest {
+			counts.Completed++
+		} else {
+			counts.Failed++
+		}
+	}
+}
+
+// batchUserKey is the context key of the user of the batch, or other
+// request, an internal request is made for.
+type batchUserKey struct{}
+
+// internalHandler returns the handler of the requests the server makes to
+// itself, such as for batches and comparisons, which is built once.
+func (s *Server) internalHandler() http.Handler {
+	s.internalOnce.Do(func() {
+		s.internal = s.batchHandler()
+	})
+
+	return s.internal
+}
+
+// batchHandler returns a handler of the requests of batches.
+func (s *Server) batchHandler() http.Handler {
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		if user, _ := c.Request.Context().Value(batchUserKey{}).(string); user != "" {
+			c.Set(userKey, user)
+		}
+		c.Next()
+	})
+	r.POST("/api/chat", s.ChatHandler)
+	r.POST("/api/generate", s.GenerateHandler)
+	return r
+}
+
+// batchResponseWriter records the response to a request of a batch.
+type batchResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *batchResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *batchResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *batchResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+func (w *batchResponseWriter) Flush() {}
+
+// runBatchItem makes the request item with h, returning its result.
+func runBatchItem(ctx context.Context, h http.Handler, item api.BatchItem) api.BatchResult {
+	result := api.BatchResult{CustomID: item.CustomID}
+
+	req, err := http.NewRequestWithContext(ctx, item.Method, item.URL, bytes.NewReader(item.Body))
+	if err != nil {
+		result.Response = batchErrorResponse(http.StatusInternalServerError, err)
+		return result
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	w := batchResponseWriter{header: make(http.Header)}
+	h.ServeHTTP(&w, req)
+
+	body := bytes.TrimSpace(w.body.Bytes())
+	if !json.Valid(body) {
+		result.Response = batchErrorResponse(cmp.Or(w.status, http.StatusInternalServerError), errors.New(string(body)))
+		return result
+	}
+
+	result.Response = api.BatchResultResponse{StatusCode: w.status, Body: body}
+	return result
+}
+
+func batchErrorResponse(status int, err error) api.BatchResultResponse {
+	b, _ := json.Marshal(gin.H{"error": err.Error()})
+	return api.BatchResultResponse{StatusCode: status, Body: b}
+}
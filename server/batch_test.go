@@ -0,0 +1,263 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/goobla/goobla/api"
+)
+
+func TestBatchItems(t *testing.T) {
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	items, err := batchItems(api.BatchRequest{
+		Endpoint: "/api/generate",
+		Requests: []api.BatchItem{
+			{CustomID: "a", Body: json.RawMessage(`{"model": "test", "prompt": "Hello!", "stream": true, "priority": "high"}`)},
+			{CustomID: "b", URL: "/api/chat", Body: json.RawMessage(`{"model": "test", "messages": [{"role": "user", "content": "Hello!"}]}`)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if items[0].Method != http.MethodPost || items[0].URL != "/api/generate" || items[1].URL != "/api/chat" {
+		t.Errorf("unexpected items %+v", items)
+	}
+
+	var r api.GenerateRequest
+	if err := json.Unmarshal(items[0].Body, &r); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Stream == nil || *r.Stream || r.Priority != "low" || r.Prompt != "Hello!" {
+		t.Errorf("unexpected body %s", items[0].Body)
+	}
+
+	cases := map[string]api.BatchRequest{
+		"empty":        {},
+		"no custom id": {Requests: []api.BatchItem{{Body: json.RawMessage(`{}`)}}},
+		"duplicate":    {Requests: []api.BatchItem{{CustomID: "a", Body: json.RawMessage(`{}`)}, {CustomID: "a", Body: json.RawMessage(`{}`)}}},
+		"method":       {Requests: []api.BatchItem{{CustomID: "a", Method: http.MethodGet, Body: json.RawMessage(`{}`)}}},
+		"url":          {Requests: []api.BatchItem{{CustomID: "a", URL: "/api/pull", Body: json.RawMessage(`{}`)}}},
+		"endpoint":     {Endpoint: "/api/embed", Requests: []api.BatchItem{{CustomID: "a", Body: json.RawMessage(`{}`)}}},
+		"body":         {Requests: []api.BatchItem{{CustomID: "a", Body: json.RawMessage(`[]`)}}},
+		"missing file": {File: "sha256:" + strings.Repeat("0", 64)},
+	}
+
+	for name, req := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := batchItems(req); !errors.Is(err, errInvalidBatch) {
+				t.Errorf("expected an invalid batch, got %v", err)
+			}
+		})
+	}
+}
+
+func TestBatchFile(t *testing.T) {
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	digest := "sha256:" + strings.Repeat("a", 64)
+	p, err := GetBlobsPath(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(p, []byte(`{"custom_id": "a", "body": {"model": "test"}}
+{"custom_id": "b", "body": {"model": "test"}}
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := batchItems(api.BatchRequest{File: digest})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != 2 || items[0].CustomID != "a" || items[1].CustomID != "b" {
+		t.Errorf("unexpected items %+v", items)
+	}
+}
+
+func TestBatches(t *testing.T) {
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	req := api.BatchRequest{
+		Requests: []api.BatchItem{
+			{CustomID: "a", Body: json.RawMessage(`{"model": "missing", "messages": [{"role": "user", "content": "Hello!"}]}`)},
+			{CustomID: "b", URL: "/api/generate", Body: json.RawMessage(`{"model": "missing", "prompt": "Hello!"}`)},
+		},
+		Metadata: map[string]string{"dataset": "test"},
+	}
+
+	b, err := newBatch("alice", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Status != batchQueued || b.RequestCounts.Total != 2 || b.Metadata["dataset"] != "test" {
+		t.Errorf("unexpected batch %+v", b)
+	}
+
+	if _, err := getBatch("bob", b.ID); !errors.Is(err, errBatchNotFound) {
+		t.Errorf("expected another user's batch not to be found, got %v", err)
+	}
+
+	if batches, err := listBatches("alice"); err != nil || len(batches) != 1 || batches[0].ID != b.ID {
+		t.Errorf("unexpected batches %+v, %v", batches, err)
+	}
+
+	f, err := nextBatch()
+	if err != nil || f == nil || f.ID != b.ID {
+		t.Fatalf("unexpected next batch %+v, %v", f, err)
+	}
+
+	var s Server
+	processBatch(t.Context(), s.batchHandler(), f)
+
+	b, err = getBatch("alice", b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Status != batchCompleted || b.StartedAt == nil || b.CompletedAt == nil || b.RequestCounts != (api.BatchRequestCounts{Total: 2, Failed: 2}) {
+		t.Errorf("unexpected batch %+v", b)
+	}
+
+	p, err := batchPath(b.ID, ".jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(results)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 results, got %q", results)
+	}
+
+	for i, line := range lines {
+		var r api.BatchResult
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatal(err)
+		}
+
+		if r.CustomID != req.Requests[i].CustomID || r.Response.StatusCode != http.StatusNotFound || !strings.Contains(string(r.Response.Body), "not found") {
+			t.Errorf("unexpected result %+v", r)
+		}
+	}
+
+	if f, err := nextBatch(); err != nil || f != nil {
+		t.Errorf("expected no next batch, got %+v, %v", f, err)
+	}
+
+	queued, err := newBatch("alice", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := cancelBatch("bob", queued.ID); !errors.Is(err, errBatchNotFound) {
+		t.Errorf("expected another user's batch not to be cancelled, got %v", err)
+	}
+
+	cancelled, err := cancelBatch("alice", queued.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cancelled.Status != batchCancelled || cancelled.CancelledAt == nil {
+		t.Errorf("unexpected batch %+v", cancelled)
+	}
+
+	if f, err := nextBatch(); err != nil || f != nil {
+		t.Errorf("expected no next batch, got %+v, %v", f, err)
+	}
+
+	if err := deleteBatch("alice", b.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(p); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the results to be deleted, got %v", err)
+	}
+
+	if batches, err := listBatches("alice"); err != nil || len(batches) != 1 || batches[0].ID != queued.ID {
+		t.Errorf("unexpected batches %+v, %v", batches, err)
+	}
+}
+
+func TestBatchResume(t *testing.T) {
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	b, err := newBatch("", api.BatchRequest{
+		Requests: []api.BatchItem{
+			{CustomID: "a", Body: json.RawMessage(`{"model": "missing"}`)},
+			{CustomID: "b", Body: json.RawMessage(`{"model": "missing"}`)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server stopped after the first request of the batch
+	p, err := batchPath(b.ID, ".jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(p, []byte(`{"id":"x","custom_id":"a","response":{"status_code":200,"body":{}}}`+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := updateBatch(b.ID, func(f *batchFile) error {
+		f.Status = batchInProgress
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := nextBatch()
+	if err != nil || f == nil {
+		t.Fatalf("unexpected next batch %+v, %v", f, err)
+	}
+
+	var s Server
+	processBatch(t.Context(), s.batchHandler(), f)
+
+	b, err = getBatch("", b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Status != batchCompleted || b.RequestCounts != (api.BatchRequestCounts{Total: 2, Completed: 1, Failed: 1}) {
+		t.Errorf("unexpected batch %+v", b)
+	}
+
+	// a stopping server leaves the batch to be resumed
+	stopped, err := newBatch("", api.BatchRequest{Requests: []api.BatchItem{{CustomID: "a", Body: json.RawMessage(`{"model": "missing"}`)}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	f, err = nextBatch()
+	if err != nil || f == nil || f.ID != stopped.ID {
+		t.Fatalf("unexpected next batch %+v, %v", f, err)
+	}
+
+	processBatch(ctx, s.batchHandler(), f)
+
+	if b, err := getBatch("", stopped.ID); err != nil || b.Status != batchInProgress || b.RequestCounts.Completed+b.RequestCounts.Failed != 0 {
+		t.Errorf("unexpected batch %+v, %v", b, err)
+	}
+}
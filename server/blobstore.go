@@ -0,0 +1,317 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/envconfig"
+	"github.com/goobla/goobla/format"
+)
+
+// BlobStore stores model blobs addressed by their sha256 digest, in either
+// the "sha256:<hex>" or "sha256-<hex>" form. Implementations return an error
+// wrapping [fs.ErrNotExist] for blobs they do not have.
+//
+// Blobs in the models directory are read, written and removed through
+// localBlobs. Their paths are only used where a file is needed: by runners,
+// which map models into memory, by downloads and uploads, which resume at
+// offsets of the file, and by peers, which serve ranges of it.
+type BlobStore interface {
+	// Stat returns the size of the blob.
+	Stat(ctx context.Context, digest string) (int64, error)
+
+	// Open returns a reader for the contents of the blob.
+	Open(ctx context.Context, digest string) (io.ReadCloser, error)
+
+	// Put stores size bytes read from r as the blob, or all of r if size
+	// is -1 and the store supports it. Implementations must not expose a
+	// partially written blob.
+	Put(ctx context.Context, digest string, r io.Reader, size int64) error
+
+	// Delete removes the blob.
+	Delete(ctx context.Context, digest string) error
+}
+
+var digestRe = regexp.MustCompile("^sha256[:-][0-9a-fA-F]{64}$")
+
+// blobName returns digest in the "sha256-<hex>" form used for blob file and
+// object names.
+func blobName(digest string) (string, error) {
+	if !digestRe.MatchString(digest) {
+		return "", ErrInvalidDigestFormat
+	}
+
+	return strings.Replace(digest, ":", "-", 1), nil
+}
+
+// NewBlobStore returns the blob store described by rawURL. Supported schemes
+// are file, for a directory laid out like the local blobs directory, and s3,
+// for an S3 compatible object store.
+func NewBlobStore(rawURL string) (BlobStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("blob store %q: missing path", rawURL)
+		}
+		return fileBlobStore{dir: filepath.FromSlash(u.Path)}, nil
+	case "s3":
+		return newS3BlobStore(u)
+	default:
+		return nil, fmt.Errorf("blob store %q: unsupported scheme %q", rawURL, u.Scheme)
+	}
+}
+
+// localBlobs is the blob store backed by the local blobs directory.
+var localBlobs BlobStore = fileBlobStore{}
+
+// sharedBlobStore returns the blob store configured with GOOBLA_BLOB_STORE,
+// or nil if none is configured.
+func sharedBlobStore() (BlobStore, error) {
+	s := envconfig.BlobStore()
+	if s == "" {
+		return nil, nil
+	}
+
+	return NewBlobStore(s)
+}
+
+// fileBlobStore stores blobs in a directory on the filesystem using the same
+// layout as the blobs directory. The zero value uses the blobs directory of
+// the models path.
+type fileBlobStore struct {
+	dir string
+}
+
+// path returns the path of the blob with digest. It has no side effects, so
+// reading blobs doesn't create directories.
+func (s fileBlobStore) path(digest string) (string, error) {
+	if s.dir == "" {
+		return lookupBlobPath(digest)
+	}
+
+	name, err := blobName(digest)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(s.dir, "blobs", name[7:9], name), nil
+}
+
+// writePath returns the path blobs with digest are written to, creating its
+// directory. Blobs of the local blobs directory are always written to the
+// writable models directory.
+func (s fileBlobStore) writePath(digest string) (string, error) {
+	p, err := s.path(digest)
+	if err != nil {
+		return "", err
+	}
+
+	if s.dir == "" && inReadOnlyModelsDir(p) {
+		name, err := blobName(digest)
+		if err != nil {
+			return "", err
+		}
+
+		blobs, err := lookupBlobPath("")
+		if err != nil {
+			return "", err
+		}
+
+		p = filepath.Join(blobs, name[7:9], name)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return "", err
+	}
+
+	return p, nil
+}
+
+func (s fileBlobStore) Stat(_ context.Context, digest string) (int64, error) {
+	p, err := s.path(digest)
+	if err != nil {
+		return 0, err
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return 0, err
+	}
+
+	return fi.Size(), nil
+}
+
+func (s fileBlobStore) Open(_ context.Context, digest string) (io.ReadCloser, error) {
+	p, err := s.path(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(p)
+}
+
+// Put writes r to a temporary file which is renamed into place once its
+// digest has been verified.
+func (s fileBlobStore) Put(_ context.Context, digest string, r io.Reader, size int64) error {
+	p, err := s.writePath(digest)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(p), filepath.Base(p)+"-partial-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if size >= 0 && n != size {
+		return fmt.Errorf("%s: wrote %d bytes, expected %d", digest, n, size)
+	}
+
+	if fmt.Sprintf("sha256-%x", h.Sum(nil)) != strings.Replace(digest, ":", "-", 1) {
+		return fmt.Errorf("%s: %w", digest, errDigestMismatch)
+	}
+
+	if err := os.Chmod(f.Name(), 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), p)
+}
+
+// Delete removes the blob. Blobs of the local blobs directory that are in a
+// read-only models directory are left in place.
+func (s fileBlobStore) Delete(_ context.Context, digest string) error {
+	p, err := s.path(digest)
+	if err != nil {
+		return err
+	}
+
+	if s.dir == "" && inReadOnlyModelsDir(p) {
+		return nil
+	}
+
+	return os.Remove(p)
+}
+
+// copyBlob copies the blob with digest from src to dst, reporting progress to
+// fn if it is not nil.
+func copyBlob(ctx context.Context, dst, src BlobStore, digest string, fn func(api.ProgressResponse)) error {
+	size, err := src.Stat(ctx, digest)
+	if err != nil {
+		return err
+	}
+
+	r, err := src.Open(ctx, digest)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if fn != nil {
+		r = &progressReader{ReadCloser: r, fn: func(n int64) {
+			fn(api.ProgressResponse{
+				Status:    fmt.Sprintf("pulling %s", digest[7:19]),
+				Digest:    digest,
+				Total:     size,
+				Completed: n,
+			})
+		}}
+	}
+
+	return dst.Put(ctx, digest, r, size)
+}
+
+// progressReader calls fn with the number of bytes read so far, at most
+// every 100ms and once more when the reader is exhausted.
+type progressReader struct {
+	io.ReadCloser
+	n    int64
+	last time.Time
+	fn   func(int64)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	if err != nil || time.Since(r.last) > 100*time.Millisecond {
+		r.fn(r.n)
+		r.last = time.Now()
+	}
+	return n, err
+}
+
+// fetchSharedBlob copies the blob with digest from the shared blob store, if
+// one is configured, into the local blobs directory. It returns an error
+// wrapping [fs.ErrNotExist] if the shared store does not have the blob.
+func fetchSharedBlob(ctx context.Context, digest string, fn func(api.ProgressResponse)) error {
+	shared, err := sharedBlobStore()
+	if err != nil {
+		return err
+	} else if shared == nil {
+		return fs.ErrNotExist
+	}
+
+	if err := copyBlob(ctx, localBlobs, shared, digest, fn); err != nil {
+		return err
+	}
+
+	slog.Info("copied blob from shared store", "digest", digest)
+	return nil
+}
+
+// storeSharedBlobs copies the local blobs with the given digests to the shared
+// blob store, if one is configured, skipping blobs it already has. Failures
+// are logged rather than returned since the blobs are available locally.
+func storeSharedBlobs(ctx context.Context, digests []string) {
+	shared, err := sharedBlobStore()
+	if err != nil {
+		slog.Warn("invalid shared blob store", "error", err)
+		return
+	} else if shared == nil {
+		return
+	}
+
+	for _, digest := range digests {
+		if _, err := shared.Stat(ctx, digest); err == nil {
+			continue
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("couldn't check shared blob store", "digest", digest, "error", err)
+			continue
+		}
+
+		size, _ := localBlobs.Stat(ctx, digest)
+		slog.Info("copying blob to shared store", "digest", digest, "size", format.HumanBytes2(uint64(size)))
+		if err := copyBlob(ctx, shared, localBlobs, digest, nil); err != nil {
+			slog.Warn("couldn't copy blob to shared store", "digest", digest, "error", err)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goobla/goobla/envconfig"
+)
+
+// s3PartSize is the size of each part of a multipart upload. Objects no
+// larger than one part are uploaded with a single request.
+const s3PartSize = 64 << 20
+
+// s3BlobStore stores blobs as objects in an S3 compatible bucket, under
+// "<prefix>/blobs/sha256-<hex>". Requests use path style addressing and are
+// signed with AWS signature version 4.
+//
+// It is configured with a URL of the form
+//
+//	s3://bucket/prefix?region=us-east-1&endpoint=https://minio.example.com
+//
+// and the standard AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN environment variables. The region defaults to AWS_REGION
+// and the endpoint to the AWS endpoint for the region.
+type s3BlobStore struct {
+	endpoint *url.URL
+	bucket   string
+	prefix   string
+	region   string
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+
+	partSize int64
+	client   *http.Client
+}
+
+func newS3BlobStore(u *url.URL) (*s3BlobStore, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("blob store %q: missing bucket", u)
+	}
+
+	q := u.Query()
+	s := &s3BlobStore{
+		bucket:       u.Host,
+		prefix:       strings.Trim(u.Path, "/"),
+		region:       cmp.Or(q.Get("region"), os.Getenv("AWS_REGION"), "us-east-1"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		partSize:     s3PartSize,
+		client:       http.DefaultClient,
+	}
+
+	endpoint := cmp.Or(q.Get("endpoint"), "https://s3."+s.region+".amazonaws.com")
+	var err error
+	if s.endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("blob store %q: %w", u, err)
+	}
+
+	return s, nil
+}
+
+func (s *s3BlobStore) objectURL(digest string) (*url.URL, error) {
+	name, err := blobName(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.endpoint.JoinPath(s.bucket, path.Join(s.prefix, "blobs", name)), nil
+}
+
+// do signs and sends a request for u. Responses with a status of 300 or more
+// are closed and returned as errors, with 404 wrapping [fs.ErrNotExist].
+func (s *s3BlobStore) do(ctx context.Context, method string, u *url.URL, body []byte) (*http.Response, error) {
+	if envconfig.Offline() {
+		return nil, errOffline
+	}
+
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), r)
+	if err != nil {
+		return nil, err
+	}
+
+	payloadHash := "UNSIGNED-PAYLOAD"
+	if body != nil {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+
+	s.sign(req, payloadHash, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+		var e struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		if xml.Unmarshal(b, &e) == nil && e.Code != "" {
+			err = fmt.Errorf("s3: %s %s: %s: %s", method, u.Path, e.Code, e.Message)
+		} else {
+			err = fmt.Errorf("s3: %s %s: %s", method, u.Path, resp.Status)
+		}
+
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%w: %w", fs.ErrNotExist, err)
+		}
+
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (s *s3BlobStore) Stat(ctx context.Context, digest string) (int64, error) {
+	u, err := s.objectURL(digest)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := s.do(ctx, http.MethodHead, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	return resp.ContentLength, nil
+}
+
+func (s *s3BlobStore) Open(ctx context.Context, digest string) (io.ReadCloser, error) {
+	u, err := s.objectURL(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// Put uploads r with a single request if it fits in one part, otherwise with
+// a multipart upload, which S3 only makes visible once it is completed.
+func (s *s3BlobStore) Put(ctx context.Context, digest string, r io.Reader, size int64) error {
+	if size < 0 {
+		return fmt.Errorf("%s: blobs of unknown size can't be stored in s3", digest)
+	}
+
+	u, err := s.objectURL(digest)
+	if err != nil {
+		return err
+	}
+
+	if size <= s.partSize {
+		b := make([]byte, size)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return err
+		}
+
+		return s.put(ctx, u, b)
+	}
+
+	return s.putMultipart(ctx, u, r, size)
+}
+
+func (s *s3BlobStore) put(ctx context.Context, u *url.URL, b []byte) error {
+	resp, err := s.do(ctx, http.MethodPut, u, b)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (s *s3BlobStore) putMultipart(ctx context.Context, u *url.URL, r io.Reader, size int64) error {
+	create := *u
+	create.RawQuery = "uploads="
+	resp, err := s.do(ctx, http.MethodPost, &create, []byte{})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var upload struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&upload); err != nil {
+		return err
+	}
+
+	abort := func() {
+		q := *u
+		q.RawQuery = url.Values{"uploadId": {upload.UploadID}}.Encode()
+		//nolint:contextcheck // abort even if ctx is canceled
+		if resp, err := s.do(context.Background(), http.MethodDelete, &q, nil); err == nil {
+			resp.Body.Close()
+		}
+	}
+
+	var parts []s3CompletedPart
+	b := make([]byte, s.partSize)
+	for offset := int64(0); offset < size; offset += s.partSize {
+		n := min(s.partSize, size-offset)
+		if _, err := io.ReadFull(r, b[:n]); err != nil {
+			abort()
+			return err
+		}
+
+		part := s3CompletedPart{PartNumber: len(parts) + 1}
+		q := *u
+		q.RawQuery = url.Values{
+			"partNumber": {strconv.Itoa(part.PartNumber)},
+			"uploadId":   {upload.UploadID},
+		}.Encode()
+
+		resp, err := s.do(ctx, http.MethodPut, &q, b[:n])
+		if err != nil {
+			abort()
+			return err
+		}
+		resp.Body.Close()
+
+		part.ETag = resp.Header.Get("ETag")
+		parts = append(parts, part)
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		abort()
+		return err
+	}
+
+	complete := *u
+	complete.RawQuery = url.Values{"uploadId": {upload.UploadID}}.Encode()
+	resp, err = s.do(ctx, http.MethodPost, &complete, body)
+	if err != nil {
+		abort()
+		return err
+	}
+	defer resp.Body.Close()
+
+	// S3 may report an error in the body of a successful response
+	var result struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err == nil && result.XMLName.Local == "Error" {
+		abort()
+		return fmt.Errorf("s3: complete upload: %s: %s", result.Code, result.Message)
+	}
+
+	return nil
+}
+
+func (s *s3BlobStore) Delete(ctx context.Context, digest string) error {
+	u, err := s.objectURL(digest)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(ctx, http.MethodDelete, u, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// sign adds AWS signature version 4 authentication to req. The host, range,
+// content type and x-amz-* headers are signed.
+func (s *s3BlobStore) sign(req *http.Request, payloadHash string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") || k == "range" || k == "content-type" || k == "content-md5" {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// query parameters are sorted and encoded with %20 for spaces
+	canonicalQuery := strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, v := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, v)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestIDHeader is the header of the id of a generate or chat request,
+// which is set by the client or otherwise generated, and can be passed to
+// /api/cancel/{id} to cancel it.
+const requestIDHeader = "X-Request-Id"
+
+// activeRequest is a generate or chat request in progress.
+type activeRequest struct {
+	user   string
+	cancel context.CancelFunc
+}
+
+// activeRequests are the generate and chat requests in progress by id, so
+// they can be canceled.
+type activeRequests struct {
+	mu       sync.Mutex
+	requests map[string]activeRequest
+}
+
+// add adds the request id of user, reporting false if there's already a
+// request with the id in progress.
+func (a *activeRequests) add(id, user string, cancel context.CancelFunc) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.requests[id]; ok {
+		return false
+	}
+
+	if a.requests == nil {
+		a.requests = make(map[string]activeRequest)
+	}
+
+	a.requests[id] = activeRequest{user: user, cancel: cancel}
+	return true
+}
+
+func (a *activeRequests) remove(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.requests, id)
+}
+
+// cancel cancels the request id of user, reporting false if they have no
+// such request in progress.
+func (a *activeRequests) cancel(id, user string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	r, ok := a.requests[id]
+	if !ok || (user != "" && r.user != user) {
+		return false
+	}
+
+	r.cancel()
+	return true
+}
+
+// cancelableMiddleware gives the request an id, returned in its
+// X-Request-Id header, it can be canceled by. Canceling it cancels the
+// context of the request, which stops its model runner generating.
+func (s *Server) cancelableMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if id == "" {
+			b := make([]byte, 16)
+			if _, err := rand.Read(b); err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			id = hex.EncodeToString(b)
+		}
+
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+
+		if !s.active.add(id, requestUser(c), cancel) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "a request with this id is already in progress"})
+			return
+		}
+		defer s.active.remove(id)
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+func (s *Server) CancelHandler(c *gin.Context) {
+	if !s.active.cancel(c.Param("id"), requestUser(c)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "request not found"})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
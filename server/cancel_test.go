@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCancel(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var s Server
+	started := make(chan struct{})
+	canceled := make(chan error, 1)
+
+	r := gin.New()
+	r.POST("/api/generate", s.cancelableMiddleware(), func(c *gin.Context) {
+		close(started)
+		<-c.Request.Context().Done()
+		canceled <- c.Request.Context().Err()
+	})
+	r.POST("/api/chat", s.cancelableMiddleware(), func(c *gin.Context) {})
+	r.POST("/api/cancel/:id", s.CancelHandler)
+
+	post := func(path, id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		if id != "" {
+			req.Header.Set(requestIDHeader, id)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	go post("/api/generate", "abc")
+	<-started
+
+	if w := post("/api/chat", "abc"); w.Code != http.StatusConflict {
+		t.Errorf("expected status 409 for a duplicate id, got %d", w.Code)
+	}
+
+	if w := post("/api/cancel/abc", ""); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	select {
+	case err := <-canceled:
+		if err != context.Canceled {
+			t.Errorf("expected the request to be canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request wasn't canceled")
+	}
+
+	// the id is free once the request is done
+	if w := post("/api/chat", "abc"); w.Code != http.StatusOK || w.Header().Get(requestIDHeader) != "abc" {
+		t.Errorf("unexpected response %d with id %q", w.Code, w.Header().Get(requestIDHeader))
+	}
+
+	if w := post("/api/cancel/abc", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", w.Code)
+	}
+
+	if w := post("/api/chat", ""); len(w.Header().Get(requestIDHeader)) != 32 {
+		t.Errorf("expected a generated id, got %q", w.Header().Get(requestIDHeader))
+	}
+
+	t.Run("other user", func(t *testing.T) {
+		var a activeRequests
+		ctx, cancel := context.WithCancel(t.Context())
+		a.add("abc", "alice", cancel)
+
+		if a.cancel("abc", "bob") {
+			t.Error("expected another user not to cancel the request")
+		}
+
+		if !a.cancel("abc", "alice") || ctx.Err() == nil {
+			t.Error("expected the request to be canceled")
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"unicode/utf8"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/llm"
+)
+
+// defaultChunkSize is the number of tokens in each chunk of the documents of
+// embed requests that don't set chunk_size
+const defaultChunkSize = 512
+
+// chunkDocuments splits docs into chunks of size tokens, each starting overlap
+// tokens before the end of the previous one. Documents are tokenized by the
+// model of r, so chunks are counted as the model will count them.
+func chunkDocuments(ctx context.Context, r llm.LlamaServer, docs []api.EmbedDocument, size, overlap int) ([]api.EmbedChunk, error) {
+	chunks := []api.EmbedChunk{}
+	for i, doc := range docs {
+		tokens, err := r.Tokenize(ctx, doc.Text)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(tokens) == 0 {
+			continue
+		}
+
+		all, err := r.Detokenize(ctx, tokens)
+		if err != nil {
+			return nil, err
+		}
+
+		// tokenizers may add a space to the start of the text, which
+		// shifts every offset by the same amount
+		shift := max(len(all)-len(doc.Text), 0)
+
+		for start := 0; ; start += size - overlap {
+			end := min(start+size, len(tokens))
+
+			from, err := tokenOffset(ctx, r, doc.Text, tokens, start, shift)
+			if err != nil {
+				return nil, err
+			}
+
+			to, err := tokenOffset(ctx, r, doc.Text, tokens, end, shift)
+			if err != nil {
+				return nil, err
+			}
+
+			to = max(to, from)
+			startChars := utf8.RuneCountInString(doc.Text[:from])
+			chunks = append(chunks, api.EmbedChunk{
+				Document: i,
+				ID:       doc.ID,
+				Text:     doc.Text[from:to],
+				Start:    startChars,
+				End:      startChars + utf8.RuneCountInString(doc.Text[from:to]),
+				Tokens:   end - start,
+			})
+
+			if end == len(tokens) {
+				break
+			}
+		}
+	}
+
+	return chunks, nil
+}
+
+// tokenOffset returns the byte offset in text where its i-th token starts.
+// It's found by detokenizing the tokens before it, since tokens don't always
+// map to whole characters.
+func tokenOffset(ctx context.Context, r llm.LlamaServer, text string, tokens []int, i, shift int) (int, error) {
+	switch i {
+	case 0:
+		return 0, nil
+	case len(tokens):
+		return len(text), nil
+	}
+
+	s, err := r.Detokenize(ctx, tokens[:i])
+	if err != nil {
+		return 0, err
+	}
+
+	n := min(max(len(s)-shift, 0), len(text))
+	for n > 0 && n < len(text) && !utf8.RuneStart(text[n]) {
+		n--
+	}
+
+	return n, nil
+}
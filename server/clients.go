@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/envconfig"
+)
+
+// Each client, identified by its user on a multi-user server, its verified
+// API key or otherwise its address, can have at most GOOBLA_MAX_CLIENT_REQUESTS
+// generate, chat and embedding requests in progress. Its other requests wait
+// for one to finish, and once GOOBLA_MAX_CLIENT_QUEUE are waiting, further
+// requests are refused.
+//
+// With GOOBLA_FAIR_SHARE, the slots of the loaded models are also shared
+// equally between the clients with requests in progress or waiting, so a
+// client sending many requests at once can't take every slot from others.
+
+var errClientBusy = errors.New("too many requests from this client, please try again")
+
+type clientState struct {
+	active  int
+	waiting int
+}
+
+type clientLimiter struct {
+	mu      sync.Mutex
+	clients map[string]*clientState
+
+	// changed is closed and replaced when a request finishes or stops
+	// waiting so waiting requests can check whether they can start.
+	changed chan struct{}
+
+	// slots returns the number of requests the loaded models can handle at
+	// once, which is shared between clients with GOOBLA_FAIR_SHARE.
+	slots func() int
+}
+
+func newClientLimiter(slots func() int) *clientLimiter {
+	return &clientLimiter{
+		clients: make(map[string]*clientState),
+		changed: make(chan struct{}),
+		slots:   slots,
+	}
+}
+
+// clientID identifies the client that made the request c: its user, or the
+// API key apiKeyMiddleware verified, or otherwise its address. Unverified
+// credentials aren't used since a client could change them with every
+// request to escape its limits.
+func clientID(c *gin.Context) string {
+	if user := requestUser(c); user != "" {
+		return "user:" + user
+	}
+
+	if key, ok := c.Get(apiKeyContextKey); ok {
+		return "key:" + key.(*api.APIKey).ID
+	}
+
+	return "addr:" + c.ClientIP()
+}
+
+// limit returns how many requests a client can have in progress, or 0 if
+// there's no limit. It must be called with l.mu held.
+func (l *clientLimiter) limit() int {
+	n := int(envconfig.MaxClientRequests())
+	if envconfig.FairShare() {
+		if slots := l.slots(); slots > 0 {
+			share := max(1, slots/len(l.clients))
+			if n == 0 || share < n {
+				n = share
+			}
+		}
+	}
+
+	return n
+}
+
+// acquire waits until the client id can start another request. The function
+// it returns must be called when the request finishes.
+func (l *clientLimiter) acquire(ctx context.Context, id string) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	client, ok := l.clients[id]
+	if !ok {
+		client = &clientState{}
+		l.clients[id] = client
+	}
+
+	if n := l.limit(); n > 0 && client.active >= n {
+		if q := int(envconfig.MaxClientQueue()); q > 0 && client.waiting >= q {
+			l.remove(id, client)
+			return nil, errClientBusy
+		}
+
+		client.waiting++
+		for n > 0 && client.active >= n {
+			changed := l.changed
+			l.mu.Unlock()
+			select {
+			case <-ctx.Done():
+				l.mu.Lock()
+				client.waiting--
+				l.remove(id, client)
+				l.notify()
+				return nil, ctx.Err()
+			case <-changed:
+			}
+			l.mu.Lock()
+			n = l.limit()
+		}
+		client.waiting--
+	}
+
+	client.active++
+	return sync.OnceFunc(func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		client.active--
+		l.remove(id, client)
+		l.notify()
+	}), nil
+}
+
+// notify wakes the waiting requests. It must be called with l.mu held.
+func (l *clientLimiter) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// remove forgets the client id if it has no requests in progress or waiting.
+// It must be called with l.mu held.
+func (l *clientLimiter) remove(id string, client *clientState) {
+	if client.active == 0 && client.waiting == 0 {
+		delete(l.clients, id)
+	}
+}
+
+// middleware limits the requests each client can have in progress.
+func (l *clientLimiter) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		release, err := l.acquire(c.Request.Context(), clientID(c))
+		if errors.Is(err, errClientBusy) {
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.Abort()
+			return
+		}
+		defer release()
+
+		c.Next()
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goobla/goobla/api"
+)
+
+func TestClientLimiter(t *testing.T) {
+	t.Setenv("GOOBLA_MAX_CLIENT_REQUESTS", "1")
+	t.Setenv("GOOBLA_MAX_CLIENT_QUEUE", "1")
+
+	l := newClientLimiter(func() int { return 0 })
+
+	release, err := l.acquire(t.Context(), "a")
+	require.NoError(t, err)
+
+	// other clients have their own limit
+	releaseB, err := l.acquire(t.Context(), "b")
+	require.NoError(t, err)
+	releaseB()
+
+	acquired := make(chan func())
+	go func() {
+		release, err := l.acquire(t.Context(), "a")
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- release
+	}()
+
+	require.Eventually(t, func() bool {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.clients["a"].waiting == 1
+	}, time.Second, time.Millisecond)
+
+	_, err = l.acquire(t.Context(), "a")
+	assert.ErrorIs(t, err, errClientBusy)
+
+	select {
+	case <-acquired:
+		t.Fatal("request started over the client's limit")
+	default:
+	}
+
+	release()
+	release = <-acquired
+
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+	defer cancel()
+	_, err = l.acquire(ctx, "a")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	release()
+	assert.Empty(t, l.clients)
+}
+
+func TestClientLimiterFairShare(t *testing.T) {
+	t.Setenv("GOOBLA_FAIR_SHARE", "1")
+
+	l := newClientLimiter(func() int { return 4 })
+
+	// a client on its own can use every slot
+	var releases []func()
+	for range 4 {
+		release, err := l.acquire(t.Context(), "a")
+		require.NoError(t, err)
+		releases = append(releases, release)
+	}
+
+	// another client gets its share while the first waits for its requests
+	// to fall under theirs
+	releaseB, err := l.acquire(t.Context(), "b")
+	require.NoError(t, err)
+	defer releaseB()
+
+	acquired := make(chan func())
+	go func() {
+		release, err := l.acquire(t.Context(), "a")
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- release
+	}()
+
+	for _, release := range releases[:3] {
+		select {
+		case <-acquired:
+			t.Fatal("request started over the client's share")
+		case <-time.After(10 * time.Millisecond):
+		}
+		release()
+	}
+
+	select {
+	case release := <-acquired:
+		release()
+	case <-time.After(time.Second):
+		t.Fatal("request didn't start within the client's share")
+	}
+
+	for _, release := range releases[3:] {
+		release()
+	}
+}
+
+func TestClientID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	newContext := func(auth string) *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/chat", nil)
+		c.Request.RemoteAddr = "192.0.2.1:1234"
+		if auth != "" {
+			c.Request.Header.Set("Authorization", auth)
+		}
+		return c
+	}
+
+	assert.Equal(t, "addr:192.0.2.1", clientID(newContext("")))
+
+	// keys that haven't been verified don't identify the client, so it
+	// can't get a new identity by changing them
+	assert.Equal(t, "addr:192.0.2.1", clientID(newContext("Bearer sk-test")))
+	c := newContext("")
+	c.Request.Header.Set("X-Api-Key", "sk-other")
+	assert.Equal(t, "addr:192.0.2.1", clientID(c))
+
+	c = newContext("Bearer sk-test")
+	c.Set(apiKeyContextKey, &api.APIKey{ID: "k1"})
+	assert.Equal(t, "key:k1", clientID(c))
+
+	c.Set(userKey, "alice")
+	assert.Equal(t, "user:alice", clientID(c))
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/goobla/goobla/api"
+)
+
+// compareChatRequest returns the chat request of req given to each of its
+// models.
+func compareChatRequest(req api.CompareRequest) api.ChatRequest {
+	msgs := req.Messages
+	if len(msgs) == 0 {
+		if req.System != "" {
+			msgs = append(msgs, api.Message{Role: "system", Content: req.System})
+		}
+		msgs = append(msgs, api.Message{Role: "user", Content: req.Prompt})
+	}
+
+	return api.ChatRequest{
+		Messages:  msgs,
+		Tools:     req.Tools,
+		Format:    req.Format,
+		Stream:    req.Stream,
+		Think:     req.Think,
+		KeepAlive: req.KeepAlive,
+		Options:   req.Options,
+		Priority:  req.Priority,
+	}
+}
+
+// compareResponseWriter passes each response of a chat made with
+// internalHandler to send as it's written.
+type compareResponseWriter struct {
+	header http.Header
+	status int
+	buf    bytes.Buffer
+	send   func(api.CompareResponse) bool
+}
+
+func (w *compareResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *compareResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *compareResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	w.buf.Write(b)
+	for {
+		line, err := w.buf.ReadBytes('\n')
+		if err != nil {
+			// keep the incomplete line until the rest of it is written
+			w.buf.Reset()
+			w.buf.Write(line)
+			return len(b), nil
+		}
+
+		if err := w.writeLine(line); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (w *compareResponseWriter) writeLine(line []byte) error {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return nil
+	}
+
+	var resp struct {
+		api.ChatResponse
+		Error string        `json:"error"`
+		Code  api.ErrorCode `json:"code"`
+	}
+	if err := json.Unmarshal(line, &resp); err != nil {
+		resp.Error = string(line)
+	}
+
+	if w.status >= http.StatusBadRequest && resp.Error == "" {
+		resp.Error = http.StatusText(w.status)
+	}
+
+	if !w.send(api.CompareResponse{ChatResponse: resp.ChatResponse, ModelError: resp.Error, ModelErrorCode: resp.Code}) {
+		return context.Canceled
+	}
+
+	return nil
+}
+
+func (w *compareResponseWriter) Flush() {}
+
+// CloseNotify is needed to stream responses with gin. The end of the
+// comparison is noticed through the context of its requests instead.
+func (w *compareResponseWriter) CloseNotify() <-chan bool {
+	return nil
+}
+
+// compare chats with each of models with h, sending their tagged responses
+// to ch as they're generated, and closes ch once they're all done.
+func compare(ctx context.Context, h http.Handler, models []string, req api.ChatRequest, ch chan any) {
+	var wg sync.WaitGroup
+	for i, name := range models {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			send := func(resp api.CompareResponse) bool {
+				resp.Index = i
+				resp.Model = cmp.Or(resp.Model, name)
+				select {
+				case ch <- resp:
+					return true
+				case <-ctx.Done():
+					return false
+				}
+			}
+
+			req := req
+			req.Model = name
+			b, err := json.Marshal(req)
+			if err != nil {
+				send(api.CompareResponse{ModelError: err.Error()})
+				return
+			}
+
+			r, err := http.NewRequestWithContext(ctx, http.MethodPost, "/api/chat", bytes.NewReader(b))
+			if err != nil {
+				send(api.CompareResponse{ModelError: err.Error()})
+				return
+			}
+			r.Header.Set("Content-Type", "application/json")
+
+			w := compareResponseWriter{header: make(http.Header), send: send}
+			h.ServeHTTP(&w, r)
+			if err := w.writeLine(w.buf.Bytes()); err != nil {
+				return
+			}
+
+			if w.status == 0 && ctx.Err() == nil {
+				send(api.CompareResponse{ModelError: fmt.Sprintf("no response from %s", name)})
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(ch)
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/discover"
+	"github.com/goobla/goobla/fs/ggml"
+	"github.com/goobla/goobla/llm"
+)
+
+func TestCompare(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mock := mockRunner{
+		CompletionFn: func(_ context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			// echo the prompt a word at a time
+			for _, word := range strings.Fields(r.Prompt) {
+				fn(llm.CompletionResponse{Content: word})
+			}
+
+			fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop})
+			return nil
+		},
+	}
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 2),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			getGpuFn:      discover.GetGPUInfo,
+			getCpuFn:      discover.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, _ *ggml.GGML, _ discover.GpuInfoList, _ int) {
+				// add small delay to simulate loading
+				time.Sleep(time.Millisecond)
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(t.Context())
+
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture":          "llama",
+		"llama.block_count":             uint32(1),
+		"llama.context_length":          uint32(8192),
+		"llama.embedding_length":        uint32(4096),
+		"llama.attention.head_count":    uint32(32),
+		"llama.attention.head_count_kv": uint32(8),
+		"tokenizer.ggml.tokens":         []string{""},
+		"tokenizer.ggml.scores":         []float32{0},
+		"tokenizer.ggml.token_type":     []int32{0},
+	}, []*ggml.Tensor{
+		{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+	})
+
+	for _, name := range []string{"alpha", "beta"} {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:    name,
+			Files:    map[string]string{"file.gguf": digest},
+			Template: name + `{{ range .Messages }} {{ .Role }}: {{ .Content }}{{ end }}`,
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	compare := func(t *testing.T, req api.CompareRequest) (map[int]string, map[int]string) {
+		t.Helper()
+
+		w := createRequest(t, s.CompareHandler, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		contents, errs := make(map[int]string), make(map[int]string)
+		scanner := bufio.NewScanner(w.Body)
+		for scanner.Scan() {
+			var resp api.CompareResponse
+			if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Model != req.Models[resp.Index] {
+				t.Errorf("expected model %q for index %d, got %q", req.Models[resp.Index], resp.Index, resp.Model)
+			}
+
+			contents[resp.Index] += resp.Message.Content
+			if resp.ModelError != "" {
+				errs[resp.Index] = resp.ModelError
+			}
+		}
+
+		return contents, errs
+	}
+
+	t.Run("streaming", func(t *testing.T) {
+		contents, errs := compare(t, api.CompareRequest{
+			Models: []string{"alpha", "beta", "missing"},
+			Prompt: "Hi",
+			System: "Be brief.",
+		})
+
+		if contents[0] != "alphasystem:Bebrief.user:Hi" || contents[1] != "betasystem:Bebrief.user:Hi" {
+			t.Errorf("unexpected contents %v", contents)
+		}
+
+		if len(errs) != 1 || !strings.Contains(errs[2], "not found") {
+			t.Errorf("unexpected errors %v", errs)
+		}
+	})
+
+	t.Run("not streaming", func(t *testing.T) {
+		stream := false
+		contents, errs := compare(t, api.CompareRequest{
+			Models:   []string{"beta", "alpha"},
+			Messages: []api.Message{{Role: "user", Content: "Hi"}},
+			Stream:   &stream,
+		})
+
+		if contents[0] != "betauser:Hi" || contents[1] != "alphauser:Hi" || len(errs) != 0 {
+			t.Errorf("unexpected responses %v %v", contents, errs)
+		}
+	})
+
+	cases := map[string]api.CompareRequest{
+		"no models":            {Prompt: "Hi"},
+		"no prompt":            {Models: []string{"alpha"}},
+		"prompt and messages":  {Models: []string{"alpha"}, Prompt: "Hi", Messages: []api.Message{{Role: "user", Content: "Hi"}}},
+		"system with messages": {Models: []string{"alpha"}, System: "Be brief.", Messages: []api.Message{{Role: "user", Content: "Hi"}}},
+		"invalid priority":     {Models: []string{"alpha"}, Prompt: "Hi", Priority: "urgent"},
+	}
+
+	for name, req := range cases {
+		t.Run(name, func(t *testing.T) {
+			w := createRequest(t, s.CompareHandler, req)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
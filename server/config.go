@@ -0,0 +1,133 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/envconfig"
+	"github.com/goobla/goobla/logutil"
+)
+
+// The runtime configuration is kept in the environment variables it's read
+// from, so a change takes effect the next time the server reads them without
+// restarting it or unloading models.
+
+// logLevel is the level of the server's logger, which changes with the
+// configuration.
+var logLevel = new(slog.LevelVar)
+
+// configMu serializes configuration changes.
+var configMu sync.Mutex
+
+var logLevels = map[string]slog.Level{
+	"error": slog.LevelError,
+	"warn":  slog.LevelWarn,
+	"info":  slog.LevelInfo,
+	"debug": slog.LevelDebug,
+	"trace": logutil.LevelTrace,
+}
+
+func logLevelName(level slog.Level) string {
+	for name, l := range logLevels {
+		if l == level {
+			return name
+		}
+	}
+
+	return strings.ToLower(level.String())
+}
+
+func serverConfig() api.ServerConfig {
+	keepAlive := envconfig.KeepAlive()
+	if keepAlive == math.MaxInt64 {
+		keepAlive = -1
+	}
+
+	maxLoaded, numParallel, maxClient := envconfig.MaxRunners(), envconfig.NumParallel(), envconfig.MaxClientRequests()
+	return api.ServerConfig{
+		KeepAlive:         &api.Duration{Duration: keepAlive},
+		MaxLoadedModels:   &maxLoaded,
+		NumParallel:       &numParallel,
+		MaxClientRequests: &maxClient,
+		LogLevel:          logLevelName(envconfig.LogLevel()),
+	}
+}
+
+// updateServerConfig sets the fields of cfg that are set, after checking
+// all of them so an invalid change leaves the configuration as it was.
+func updateServerConfig(cfg api.ServerConfig) error {
+	env := make(map[string]string)
+	if cfg.KeepAlive != nil {
+		// an infinite keep alive is unmarshaled as the longest duration
+		if cfg.KeepAlive.Duration == math.MaxInt64 {
+			env["GOOBLA_KEEP_ALIVE"] = "-1"
+		} else {
+			env["GOOBLA_KEEP_ALIVE"] = cfg.KeepAlive.Duration.String()
+		}
+	}
+
+	if cfg.MaxLoadedModels != nil {
+		env["GOOBLA_MAX_LOADED_MODELS"] = strconv.FormatUint(uint64(*cfg.MaxLoadedModels), 10)
+	}
+
+	if cfg.NumParallel != nil {
+		env["GOOBLA_NUM_PARALLEL"] = strconv.FormatUint(uint64(*cfg.NumParallel), 10)
+	}
+
+	if cfg.MaxClientRequests != nil {
+		env["GOOBLA_MAX_CLIENT_REQUESTS"] = strconv.FormatUint(uint64(*cfg.MaxClientRequests), 10)
+	}
+
+	level, setLevel := logLevels[strings.ToLower(cfg.LogLevel)]
+	if cfg.LogLevel != "" {
+		if !setLevel {
+			return fmt.Errorf("invalid log level %q", cfg.LogLevel)
+		}
+
+		// GOOBLA_DEBUG counts levels below info in steps of 4
+		env["GOOBLA_DEBUG"] = strconv.Itoa(int(-level / 4))
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+	for k, v := range env {
+		if err := os.Setenv(k, v); err != nil {
+			return err
+		}
+	}
+
+	if setLevel {
+		logLevel.Set(level)
+	}
+
+	slog.Info("server config updated", "env", env)
+	return nil
+}
+
+func (s *Server) ConfigHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, serverConfig())
+}
+
+func (s *Server) UpdateConfigHandler(c *gin.Context) {
+	var req api.ServerConfig
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := updateServerConfig(req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, serverConfig())
+}
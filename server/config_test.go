@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/envconfig"
+)
+
+func TestServerConfig(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// restore the environment the handler changes
+	for _, k := range []string{"GOOBLA_KEEP_ALIVE", "GOOBLA_MAX_LOADED_MODELS", "GOOBLA_NUM_PARALLEL", "GOOBLA_MAX_CLIENT_REQUESTS", "GOOBLA_DEBUG"} {
+		t.Setenv(k, "")
+	}
+	t.Cleanup(func() { logLevel.Set(slog.LevelInfo) })
+
+	var s Server
+	r := gin.New()
+	r.GET("/api/config", s.ConfigHandler)
+	r.PATCH("/api/config", s.UpdateConfigHandler)
+
+	do := func(method, body string) (*httptest.ResponseRecorder, api.ServerConfig) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, "/api/config", bytes.NewBufferString(body)))
+
+		var cfg api.ServerConfig
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &cfg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w, cfg
+	}
+
+	w, cfg := do(http.MethodGet, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	if cfg.KeepAlive.Duration != 5*time.Minute || *cfg.MaxLoadedModels != 0 || cfg.LogLevel != "info" {
+		t.Errorf("expected the default config, got %+v", cfg)
+	}
+
+	w, cfg = do(http.MethodPatch, `{"keep_alive": "1h", "max_loaded_models": 2, "log_level": "debug"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+
+	if cfg.KeepAlive.Duration != time.Hour || *cfg.MaxLoadedModels != 2 || *cfg.NumParallel != 0 || cfg.LogLevel != "debug" {
+		t.Errorf("expected the config to be updated, got %+v", cfg)
+	}
+
+	if envconfig.KeepAlive() != time.Hour || envconfig.MaxRunners() != 2 || envconfig.LogLevel() != slog.LevelDebug {
+		t.Error("expected the environment to be updated")
+	}
+
+	if logLevel.Level() != slog.LevelDebug {
+		t.Errorf("expected the logger's level to be debug, got %s", logLevel.Level())
+	}
+
+	_, cfg = do(http.MethodPatch, `{"keep_alive": -1, "log_level": "warn"}`)
+	// -1 is unmarshaled as the longest duration
+	if cfg.KeepAlive.Duration != math.MaxInt64 || cfg.LogLevel != "warn" || *cfg.MaxLoadedModels != 2 {
+		t.Errorf("expected an infinite keep alive, got %+v", cfg)
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, body := range []string{`{"log_level": "verbose", "num_parallel": 4}`, `{"num_parallel": -1}`} {
+			if w, _ := do(http.MethodPatch, body); w.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400 for %s, got %d", body, w.Code)
+			}
+		}
+
+		if envconfig.NumParallel() != 0 {
+			t.Error("expected an invalid change to leave the config as it was")
+		}
+	})
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/envconfig"
+)
+
+// Conversations are chat histories kept on the server, so chat requests
+// only need to send their new messages. Each is stored as a JSON file in
+// the conversations directory of the models directory, along with the
+// user it belongs to.
+
+var errConversationNotFound = errors.New("conversation not found")
+
+// conversationsMu serializes updates to conversations. Reads do not take
+// the lock since files are replaced atomically.
+var conversationsMu sync.Mutex
+
+// conversationFile is the on-disk format of a conversation.
+type conversationFile struct {
+	User string `json:"user,omitempty"`
+	api.Conversation
+}
+
+// conversationPath returns the path of the file of the conversation id,
+// which must be one created by newConversation.
+func conversationPath(id string) (string, error) {
+	if b, err := hex.DecodeString(id); err != nil || len(b) != 16 || strings.ToLower(id) != id {
+		return "", errConversationNotFound
+	}
+
+	dir, err := envconfig.Models()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "conversations", id+".json"), nil
+}
+
+func readConversation(p string) (*conversationFile, error) {
+	b, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errConversationNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var f conversationFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+
+	return &f, nil
+}
+
+func writeConversation(p string, f *conversationFile) error {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(p, b, 0o600)
+}
+
+// newConversation creates a conversation for user with the messages.
+func newConversation(user, model string, msgs []api.Message) (*api.Conversation, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	p, err := conversationPath(hex.EncodeToString(id))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	f := conversationFile{
+		User: user,
+		Conversation: api.Conversation{
+			ID:        hex.EncodeToString(id),
+			Model:     model,
+			Messages:  msgs,
+			CreatedAt: now,
+			UpdatedAt: now,
+		},
+	}
+
+	if err := writeConversation(p, &f); err != nil {
+		return nil, err
+	}
+
+	return &f.Conversation, nil
+}
+
+// getConversation returns the conversation id of user. Other users'
+// conversations are reported as not found.
+func getConversation(user, id string) (*api.Conversation, error) {
+	p, err := conversationPath(id)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := readConversation(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.User != user {
+		return nil, errConversationNotFound
+	}
+
+	return &f.Conversation, nil
+}
+
+// listConversations returns the conversations of user without their
+// messages, most recently updated first.
+func listConversations(user string) ([]api.Conversation, error) {
+	dir, err := envconfig.Models()
+	if err != nil {
+		return nil, err
+	}
+
+	matches, err := filepath.Glob(filepath.Join(dir, "conversations", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	convs := []api.Conversation{}
+	for _, p := range matches {
+		f, err := readConversation(p)
+		if errors.Is(err, errConversationNotFound) {
+			// deleted since it was listed
+			continue
+		} else if err != nil {
+			slog.Warn("ignoring invalid conversation", "error", err)
+			continue
+		}
+
+		if f.User != user || f.ID == "" {
+			continue
+		}
+
+		f.Messages = nil
+		convs = append(convs, f.Conversation)
+	}
+
+	slices.SortFunc(convs, func(a, b api.Conversation) int {
+		return cmp.Compare(b.UpdatedAt.UnixNano(), a.UpdatedAt.UnixNano())
+	})
+
+	return convs, nil
+}
+
+// appendConversation adds the messages to the end of the conversation id of
+// user.
+func appendConversation(user, id string, msgs []api.Message) (*api.Conversation, error) {
+	conversationsMu.Lock()
+	defer conversationsMu.Unlock()
+
+	p, err := conversationPath(id)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := readConversation(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.User != user {
+		return nil, errConversationNotFound
+	}
+
+	f.Messages = append(f.Messages, msgs...)
+	f.UpdatedAt = time.Now().UTC()
+	if err := writeConversation(p, f); err != nil {
+		return nil, err
+	}
+
+	return &f.Conversation, nil
+}
+
+// deleteConversation deletes the conversation id of user.
+func deleteConversation(user, id string) error {
+	conversationsMu.Lock()
+	defer conversationsMu.Unlock()
+
+	p, err := conversationPath(id)
+	if err != nil {
+		return err
+	}
+
+	f, err := readConversation(p)
+	if err != nil {
+		return err
+	}
+
+	if f.User != user {
+		return errConversationNotFound
+	}
+
+	if err := os.Remove(p); err != nil {
+		return err
+	}
+
+	return removeSessionCaches(user, "conversation:"+id)
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/goobla/goobla/api"
+)
+
+func TestConversations(t *testing.T) {
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	conv, err := newConversation("alice", "test", []api.Message{{Role: "system", Content: "Be brief."}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newConversation("bob", "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := getConversation("alice", conv.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(conv, got); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := getConversation("bob", conv.ID); !errors.Is(err, errConversationNotFound) {
+		t.Errorf("expected another user's conversation not to be found, got %v", err)
+	}
+
+	for _, id := range []string{"", "../aliases", conv.ID[:8], "0123456789ABCDEF0123456789ABCDEF"} {
+		if _, err := getConversation("alice", id); !errors.Is(err, errConversationNotFound) {
+			t.Errorf("%q: expected not found, got %v", id, err)
+		}
+	}
+
+	updated, err := appendConversation("alice", conv.ID, []api.Message{{Role: "user", Content: "Hello!"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []api.Message{{Role: "system", Content: "Be brief."}, {Role: "user", Content: "Hello!"}}
+	if diff := cmp.Diff(want, updated.Messages); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	if updated.UpdatedAt.Before(conv.UpdatedAt) {
+		t.Errorf("expected updated_at to advance, got %v before %v", updated.UpdatedAt, conv.UpdatedAt)
+	}
+
+	list, err := listConversations("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list) != 1 || list[0].ID != conv.ID || list[0].Messages != nil {
+		t.Errorf("unexpected conversations %+v", list)
+	}
+
+	if err := deleteConversation("bob", conv.ID); !errors.Is(err, errConversationNotFound) {
+		t.Errorf("expected another user's conversation not to be deleted, got %v", err)
+	}
+
+	cache, err := sessionPath("alice", &Model{ModelPath: "/blobs/sha256-a"}, "conversation:"+conv.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(cache, []byte("kv cache"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := deleteConversation("alice", conv.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(cache); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the conversation's cache to be deleted, got %v", err)
+	}
+
+	if list, err := listConversations("alice"); err != nil || len(list) != 0 {
+		t.Errorf("expected no conversations, got %+v, %v", list, err)
+	}
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/envconfig"
+)
+
+// corsHeaders are the request headers browsers may send by default.
+var corsHeaders = []string{
+	"Authorization",
+	"Content-Type",
+	"User-Agent",
+	"Accept",
+	"X-Requested-With",
+	"X-Request-Id",
+	"X-Api-Key",
+
+	// OpenAI compatibility headers
+	"OpenAI-Beta",
+	"x-stainless-arch",
+	"x-stainless-async",
+	"x-stainless-custom-poll-interval",
+	"x-stainless-helper-method",
+	"x-stainless-lang",
+	"x-stainless-os",
+	"x-stainless-package-version",
+	"x-stainless-poll-helper",
+	"x-stainless-retry-count",
+	"x-stainless-runtime",
+	"x-stainless-runtime-version",
+	"x-stainless-timeout",
+
+	// Anthropic compatibility headers
+	"anthropic-beta",
+	"anthropic-version",
+	"x-api-key",
+}
+
+// managementPaths returns the paths of the routes that change the server,
+// such as its models and API keys, rather than running models: those an API
+// key needs the manage-models or admin scope for. Routes with parameters
+// match by prefix.
+func managementPaths(routes gin.RoutesInfo) []string {
+	var paths []string
+	for _, r := range routes {
+		if scope := routeScope(r.Method, r.Path); scope != api.ScopeManageModels && scope != api.ScopeAdmin {
+			continue
+		}
+
+		p := r.Path
+		if i := strings.IndexAny(p, ":*"); i >= 0 {
+			p = p[:i] + "*"
+		}
+
+		if !slices.Contains(paths, p) {
+			paths = append(paths, p)
+		}
+	}
+
+	return paths
+}
+
+// corsRule is the policy of browser requests to paths, which either match
+// exactly or, ending with "*", by prefix. Origins may contain a "*"
+// wildcard, such as "https://*.example.com", and browser requests from other
+// origins are refused. With no origins, browsers can't make requests to the
+// paths at all.
+type corsRule struct {
+	Paths   []string `json:"paths"`
+	Origins []string `json:"origins"`
+
+	// Methods and Headers are the methods and request headers browsers may
+	// use, or the defaults if they're empty.
+	Methods []string `json:"methods,omitempty"`
+	Headers []string `json:"headers,omitempty"`
+}
+
+// corsFile configures the policy of browser requests. The first rule whose
+// paths match a request applies, and others use the origins allowed by
+// GOOBLA_ORIGINS:
+//
+//	{
+//	  "disable_management": true,
+//	  "rules": [
+//	    {"paths": ["/api/chat", "/v1/*"], "origins": ["https://*.example.com"]}
+//	  ]
+//	}
+//
+// With DisableManagement set, browsers can't make requests to the routes
+// that change the server, such as pulling and deleting models, whatever the
+// rules.
+type corsFile struct {
+	DisableManagement bool       `json:"disable_management"`
+	Rules             []corsRule `json:"rules"`
+}
+
+func loadCORS() (corsFile, error) {
+	var f corsFile
+
+	p := envconfig.CORSConfig()
+	b, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return f, nil
+	} else if err != nil {
+		return f, err
+	}
+
+	if err := json.Unmarshal(b, &f); err != nil {
+		return f, fmt.Errorf("%s: %w", p, err)
+	}
+
+	return f, nil
+}
+
+func matchPath(pattern, path string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(path, prefix)
+	}
+	return pattern == path
+}
+
+func corsConfig(origins, methods, headers []string) (gin.HandlerFunc, error) {
+	cfg := cors.DefaultConfig()
+	cfg.AllowWildcard = true
+	cfg.AllowBrowserExtensions = true
+	cfg.AllowHeaders = corsHeaders
+	if len(headers) > 0 {
+		cfg.AllowHeaders = headers
+	}
+	if len(methods) > 0 {
+		cfg.AllowMethods = methods
+	}
+
+	if len(origins) > 0 {
+		cfg.AllowOrigins = origins
+	} else {
+		// refuse every cross-origin request
+		cfg.AllowOriginFunc = func(string) bool { return false }
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cors.New(cfg), nil
+}
+
+// corsMiddleware applies the policy of the CORS config file, or allows the
+// origins set by GOOBLA_ORIGINS if it doesn't exist. The file is read when
+// the server starts, and routes are only listed once the first request is
+// handled, after they've all been registered.
+func corsMiddleware(routes func() gin.RoutesInfo) (gin.HandlerFunc, error) {
+	f, err := loadCORS()
+	if err != nil {
+		return nil, err
+	}
+
+	def, err := corsConfig(envconfig.AllowedOrigins(), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	type rule struct {
+		paths   func() []string
+		handler gin.HandlerFunc
+	}
+
+	var rules []rule
+	if f.DisableManagement {
+		h, err := corsConfig(nil, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule{sync.OnceValue(func() []string { return managementPaths(routes()) }), h})
+	}
+
+	for i, r := range f.Rules {
+		h, err := corsConfig(r.Origins, r.Methods, r.Headers)
+		if err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %w", envconfig.CORSConfig(), i, err)
+		}
+		rules = append(rules, rule{func() []string { return r.Paths }, h})
+	}
+
+	return func(c *gin.Context) {
+		// preflight requests aren't routed, so rules match the request's path
+		for _, r := range rules {
+			for _, p := range r.paths() {
+				if matchPath(p, c.Request.URL.Path) {
+					r.handler(c)
+					return
+				}
+			}
+		}
+
+		def(c)
+	}, nil
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCORS(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := filepath.Join(t.TempDir(), "cors.json")
+	if err := os.WriteFile(p, []byte(`{
+		"disable_management": true,
+		"rules": [
+			{"paths": ["/api/chat", "/v1/*"], "origins": ["https://*.example.com"], "methods": ["POST"], "headers": ["Content-Type"]},
+			{"paths": ["/api/tags"], "origins": []}
+		]
+	}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOOBLA_CORS_CONFIG", p)
+	t.Setenv("GOOBLA_ORIGINS", "https://ui.example.org")
+
+	r := gin.New()
+	h, err := corsMiddleware(r.Routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Use(h)
+	for _, path := range []string{"/api/chat", "/v1/chat/completions", "/api/generate", "/api/pull", "/api/edit"} {
+		r.POST(path, func(c *gin.Context) {})
+	}
+	r.GET("/api/tags", func(c *gin.Context) {})
+	r.DELETE("/api/keys/:id", func(c *gin.Context) {})
+
+	cases := []struct {
+		name, method, path, origin string
+		status                     int
+		allowMethods               string
+	}{
+		{"no origin", http.MethodPost, "/api/pull", "", http.StatusOK, ""},
+		{"rule origin", http.MethodPost, "/api/chat", "https://app.example.com", http.StatusOK, ""},
+		{"rule prefix", http.MethodPost, "/v1/chat/completions", "https://app.example.com", http.StatusOK, ""},
+		{"rule refused", http.MethodPost, "/api/chat", "https://ui.example.org", http.StatusForbidden, ""},
+		{"rule preflight", http.MethodOptions, "/api/chat", "https://app.example.com", http.StatusNoContent, "POST"},
+		{"default origin", http.MethodPost, "/api/generate", "https://ui.example.org", http.StatusOK, ""},
+		{"default localhost", http.MethodPost, "/api/generate", "http://localhost:3000", http.StatusOK, ""},
+		{"default refused", http.MethodPost, "/api/generate", "https://app.example.com", http.StatusForbidden, ""},
+		{"management", http.MethodPost, "/api/pull", "http://localhost:3000", http.StatusForbidden, ""},
+		{"management edit", http.MethodPost, "/api/edit", "http://localhost:3000", http.StatusForbidden, ""},
+		{"management parameter", http.MethodDelete, "/api/keys/k1", "http://localhost:3000", http.StatusForbidden, ""},
+		{"no origins", http.MethodGet, "/api/tags", "http://localhost:3000", http.StatusForbidden, ""},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.method == http.MethodOptions {
+				req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, w.Code)
+			}
+
+			if got := w.Header().Get("Access-Control-Allow-Methods"); got != tt.allowMethods {
+				t.Errorf("expected allowed methods %q, got %q", tt.allowMethods, got)
+			}
+		})
+	}
+
+	t.Run("invalid origin", func(t *testing.T) {
+		if err := os.WriteFile(p, []byte(`{"rules": [{"paths": ["/api/chat"], "origins": ["example.com"]}]}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := corsMiddleware(r.Routes); err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/envconfig"
+	"github.com/goobla/goobla/llm"
+)
+
+// When a runner crashes during a generate or chat request, a crash report is
+// written to the crashes directory of the logs directory with what the runner
+// wrote to stderr, its exit code, the memory of the GPUs and the parameters of
+// the request, and the request's error refers to the report by its id. If the
+// runner crashed before responding, the request is run again once with half
+// its layers offloaded to the GPUs, since most crashes are of a GPU running
+// out of memory.
+
+// crashReport is the report of a runner crash.
+type crashReport struct {
+	ID       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	Model    string    `json:"model"`
+	ExitCode int       `json:"exit_code"`
+	Stderr   string    `json:"stderr"`
+
+	Engine    string `json:"engine"`
+	Library   string `json:"library"`
+	GPULayers int    `json:"gpu_layers"`
+
+	// EstimatedVRAM and EstimatedTotal are the memory the runner was
+	// estimated to need, and GPUs the memory of the GPUs after the crash
+	EstimatedVRAM  uint64     `json:"estimated_vram"`
+	EstimatedTotal uint64     `json:"estimated_total"`
+	GPUs           []crashGPU `json:"gpus"`
+
+	Request crashRequest `json:"request"`
+}
+
+type crashGPU struct {
+	Library     string `json:"library"`
+	ID          string `json:"id"`
+	Name        string `json:"name,omitempty"`
+	TotalMemory uint64 `json:"total_memory"`
+	FreeMemory  uint64 `json:"free_memory"`
+}
+
+// crashRequest is the parameters of the request a runner crashed during. Its
+// prompt and images aren't included, only their sizes.
+type crashRequest struct {
+	Options      *api.Options `json:"options,omitempty"`
+	PromptLength int          `json:"prompt_length"`
+	Images       int          `json:"images,omitempty"`
+	Format       bool         `json:"format,omitempty"`
+	Grammar      bool         `json:"grammar,omitempty"`
+	Logprobs     bool         `json:"logprobs,omitempty"`
+}
+
+// reportCrash writes the report of crash, the error of req to the runner r of
+// the model m, setting its id.
+func (s *Server) reportCrash(r llm.LlamaServer, m *Model, req llm.CompletionRequest, crash *llm.CrashError) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		slog.Warn("failed to report crash", "error", err)
+		return
+	}
+
+	backend := r.Backend()
+	report := crashReport{
+		ID:             hex.EncodeToString(id),
+		Time:           time.Now().UTC(),
+		Model:          m.ShortName,
+		ExitCode:       crash.ExitCode,
+		Stderr:         crash.Stderr,
+		Engine:         backend.Engine,
+		Library:        backend.Library,
+		GPULayers:      backend.GPULayers,
+		EstimatedVRAM:  r.EstimatedVRAM(),
+		EstimatedTotal: r.EstimatedTotal(),
+		GPUs:           []crashGPU{},
+		Request: crashRequest{
+			Options:      req.Options,
+			PromptLength: len(req.Prompt),
+			Images:       len(req.Images),
+			Format:       len(req.Format) > 0,
+			Grammar:      req.Grammar != "",
+			Logprobs:     req.Logprobs,
+		},
+	}
+
+	if backend.Library != "cpu" && s.sched != nil {
+		for _, g := range s.sched.getGpuFn() {
+			report.GPUs = append(report.GPUs, crashGPU{
+				Library:     g.Library,
+				ID:          g.ID,
+				Name:        g.Name,
+				TotalMemory: g.TotalMemory,
+				FreeMemory:  g.FreeMemory,
+			})
+		}
+	}
+
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		slog.Warn("failed to report crash", "error", err)
+		return
+	}
+
+	dir := filepath.Join(envconfig.Logs(), "crashes")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		slog.Warn("failed to report crash", "error", err)
+		return
+	}
+
+	p := filepath.Join(dir, report.ID+".json")
+	if err := os.WriteFile(p, b, 0o600); err != nil {
+		slog.Warn("failed to report crash", "error", err)
+		return
+	}
+
+	crash.ID = report.ID
+	slog.Error("model runner crashed", "model", m.ShortName, "exit_code", crash.ExitCode, "report", p)
+}
+
+// completion runs req on the runner *r of the model m. If the runner crashes,
+// the crash is reported and, unless the runner responded first, req is run
+// again once on a runner from retry with half as many layers on the GPUs,
+// which replaces *r.
+func (s *Server) completion(ctx context.Context, r *llm.LlamaServer, m *Model, req llm.CompletionRequest, fn func(llm.CompletionResponse), retry func(numGPU int) (llm.LlamaServer, error)) error {
+	for retried := false; ; retried = true {
+		var responded bool
+		err := (*r).Completion(ctx, req, func(cr llm.CompletionResponse) {
+			responded = responded || !cr.Progress
+			fn(cr)
+		})
+
+		var crash *llm.CrashError
+		if !errors.As(err, &crash) {
+			return err
+		}
+
+		s.reportCrash(*r, m, req, crash)
+
+		layers := (*r).Backend().GPULayers
+		if retried || responded || layers == 0 || retry == nil || ctx.Err() != nil {
+			return err
+		}
+
+		slog.Warn("retrying the request of a crashed runner with fewer layers on the GPUs", "model", m.ShortName, "gpu_layers", layers/2)
+		next, rerr := retry(layers / 2)
+		if rerr != nil {
+			slog.Warn("failed to retry the request of a crashed runner", "model", m.ShortName, "error", rerr)
+			return err
+		}
+
+		*r = next
+	}
+}
+
+// withNumGPU returns a copy of the request options opts with num_gpu set to
+// numGPU.
+func withNumGPU(opts map[string]any, numGPU int) map[string]any {
+	opts = maps.Clone(opts)
+	if opts == nil {
+		opts = make(map[string]any)
+	}
+	opts["num_gpu"] = numGPU
+	return opts
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/discover"
+	"github.com/goobla/goobla/llm"
+)
+
+type crashingRunner struct {
+	llm.LlamaServer
+
+	layers int
+	// responds is whether the runner responds before crashing
+	responds bool
+	crashes  bool
+}
+
+func (r *crashingRunner) Backend() llm.Backend {
+	return llm.Backend{Engine: "goobla", Library: "cuda_v12", GPULayers: r.layers}
+}
+
+func (r *crashingRunner) EstimatedVRAM() uint64  { return 4 << 30 }
+func (r *crashingRunner) EstimatedTotal() uint64 { return 5 << 30 }
+
+func (r *crashingRunner) Completion(_ context.Context, _ llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+	if r.responds {
+		fn(llm.CompletionResponse{Content: "Hi"})
+	}
+
+	if r.crashes {
+		return &llm.CrashError{
+			Err:      fmt.Errorf("%w while running the model: CUDA error: out of memory", llm.ErrRunnerStopped),
+			ExitCode: 2,
+			Stderr:   "CUDA error: out of memory",
+		}
+	}
+
+	fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop})
+	return nil
+}
+
+func TestCompletionCrash(t *testing.T) {
+	logs := t.TempDir()
+	t.Setenv("GOOBLA_LOGS", logs)
+
+	s := &Server{sched: &Scheduler{getGpuFn: func() discover.GpuInfoList {
+		g := discover.GpuInfo{Library: "cuda", ID: "0", Name: "test"}
+		g.TotalMemory = 8 << 30
+		g.FreeMemory = 1 << 30
+		return discover.GpuInfoList{g}
+	}}}
+	m := &Model{ShortName: "test"}
+	req := llm.CompletionRequest{Prompt: "Hello!", Options: &api.Options{}}
+
+	t.Run("retry", func(t *testing.T) {
+		var r llm.LlamaServer = &crashingRunner{layers: 32, crashes: true}
+		var numGPU int
+		retry := func(n int) (llm.LlamaServer, error) {
+			numGPU = n
+			return &crashingRunner{layers: n}, nil
+		}
+
+		var done bool
+		if err := s.completion(t.Context(), &r, m, req, func(cr llm.CompletionResponse) { done = done || cr.Done }, retry); err != nil {
+			t.Fatal(err)
+		}
+
+		if numGPU != 16 || !done || r.Backend().GPULayers != 16 {
+			t.Errorf("expected the request to be retried with 16 layers, got %d, done %v", numGPU, done)
+		}
+
+		reports, err := filepath.Glob(filepath.Join(logs, "crashes", "*.json"))
+		if err != nil || len(reports) != 1 {
+			t.Fatalf("expected a crash report, got %v, %v", reports, err)
+		}
+
+		b, err := os.ReadFile(reports[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var report crashReport
+		if err := json.Unmarshal(b, &report); err != nil {
+			t.Fatal(err)
+		}
+
+		if report.ExitCode != 2 || report.Stderr == "" || report.GPULayers != 32 || len(report.GPUs) != 1 || report.GPUs[0].FreeMemory != 1<<30 || report.Request.PromptLength != 6 {
+			t.Errorf("unexpected report %+v", report)
+		}
+	})
+
+	t.Run("retry crashes", func(t *testing.T) {
+		var r llm.LlamaServer = &crashingRunner{layers: 32, crashes: true}
+		var retries int
+		retry := func(n int) (llm.LlamaServer, error) {
+			retries++
+			return &crashingRunner{layers: n, crashes: true}, nil
+		}
+
+		err := s.completion(t.Context(), &r, m, req, func(llm.CompletionResponse) {}, retry)
+
+		var crash *llm.CrashError
+		if !errors.As(err, &crash) || !errors.Is(err, llm.ErrRunnerStopped) {
+			t.Fatalf("expected a crash, got %v", err)
+		}
+
+		if retries != 1 {
+			t.Errorf("expected 1 retry, got %d", retries)
+		}
+
+		if _, err := os.Stat(filepath.Join(logs, "crashes", crash.ID+".json")); err != nil {
+			t.Errorf("expected the crash to be reported, got %v", err)
+		}
+
+		if se := streamError(err, api.Usage{}); se.CrashID != crash.ID || se.Code != api.ErrorCodeOutOfMemory {
+			t.Errorf("unexpected error %+v", se)
+		}
+	})
+
+	t.Run("responded", func(t *testing.T) {
+		var r llm.LlamaServer = &crashingRunner{layers: 32, responds: true, crashes: true}
+		retry := func(n int) (llm.LlamaServer, error) {
+			t.Error("expected no retry after the runner responded")
+			return nil, errors.New("unexpected retry")
+		}
+
+		if err := s.completion(t.Context(), &r, m, req, func(llm.CompletionResponse) {}, retry); !errors.Is(err, llm.ErrRunnerStopped) {
+			t.Errorf("expected the runner to have stopped, got %v", err)
+		}
+	})
+}
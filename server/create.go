@@ -10,6 +10,7 @@ import (
 	"io"
 	"io/fs"
 	"log/slog"
+	"maps"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -30,12 +31,12 @@ import (
 )
 
 var (
-	errNoFilesProvided         = errors.New("no files provided to convert")
-	errOnlyOneAdapterSupported = errors.New("only one adapter is currently supported")
-	errOnlyGGUFSupported       = errors.New("supplied file was not in GGUF format")
-	errUnknownType             = errors.New("unknown type")
-	errNeitherFromOrFiles      = errors.New("neither 'from' or 'files' was specified")
-	errFilePath                = errors.New("file path must be relative")
+	errNoFilesProvided    = errors.New("no files provided to convert")
+	errOnlyGGUFSupported  = errors.New("supplied file was not in GGUF format")
+	errUnknownType        = errors.New("unknown type")
+	errNeitherFromOrFiles = errors.New("neither 'from' or 'files' was specified")
+	errFilePath           = errors.New("file path must be relative")
+	errImatrixNoQuantize  = errors.New("an importance matrix can only be used when quantizing")
 )
 
 func (s *Server) CreateHandler(c *gin.Context) {
@@ -61,12 +62,43 @@ func (s *Server) CreateHandler(c *gin.Context) {
 		return
 	}
 
+	// a name pinned to a digest, or with a tag that looks like one, would
+	// be indistinguishable from a digest reference
+	if name.Digest() != "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errDigestTag.Error()})
+		return
+	}
+
+	if _, ok := lookupAlias(name); ok {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s: %v", name.DisplayShortest(), errAliasIsAlias)})
+		return
+	}
+
 	name, err := getExistingName(name)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	if !checkWrite(c, name) {
+		return
+	}
+
+	if from := model.ParseName(r.From); from.IsValid() {
+		if from, err := getExistingName(from); err == nil && !checkRead(c, from) {
+			return
+		}
+	}
+
+	if r.Draft != "" && !checkDraft(c, r.Draft) {
+		return
+	}
+
+	if r.ImportanceMatrix != "" && cmp.Or(r.Quantize, r.Quantization) == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errImatrixNoQuantize.Error()})
+		return
+	}
+
 	ch := make(chan any)
 	go func() {
 		defer close(ch)
@@ -88,14 +120,29 @@ func (s *Server) CreateHandler(c *gin.Context) {
 			ctx, cancel := context.WithCancel(c.Request.Context())
 			defer cancel()
 
-			baseLayers, err = parseFromModel(ctx, fromName, fn)
+			// Hugging Face repositories are converted unless they've been pulled
+			err = errNoSafetensors
+			if repo, ok := huggingFaceRepo(r.From); ok {
+				if _, merr := ParseNamedManifest(fromName); errors.Is(merr, os.ErrNotExist) {
+					baseLayers, err = createFromHuggingFace(ctx, repo, fn)
+				}
+			}
+			if errors.Is(err, errNoSafetensors) {
+				baseLayers, err = parseFromModel(ctx, fromName, fn)
+			}
 			if err != nil {
 				ch <- gin.H{"error": err.Error()}
+				return
+			}
+
+			// models created from locked models are locked too
+			if m, err := GetModel(fromName.String()); err == nil && m.Config.Locked {
+				r.Locked = true
 			}
 		} else if r.Files != nil {
 			baseLayers, err = convertModelFromFiles(r.Files, baseLayers, false, fn)
 			if err != nil {
-				for _, badReq := range []error{errNoFilesProvided, errOnlyGGUFSupported, errUnknownType} {
+				for _, badReq := range []error{errNoFilesProvided, errOnlyGGUFSupported, errUnknownType, convert.ErrUnsupportedArchitecture} {
 					if errors.Is(err, badReq) {
 						ch <- gin.H{"error": err.Error(), "status": http.StatusBadRequest}
 						return
@@ -113,7 +160,7 @@ func (s *Server) CreateHandler(c *gin.Context) {
 		if r.Adapters != nil {
 			adapterLayers, err = convertModelFromFiles(r.Adapters, baseLayers, true, fn)
 			if err != nil {
-				for _, badReq := range []error{errNoFilesProvided, errOnlyOneAdapterSupported, errOnlyGGUFSupported, errUnknownType, errFilePath} {
+				for _, badReq := range []error{errNoFilesProvided, errOnlyGGUFSupported, errUnknownType, errFilePath} {
 					if errors.Is(err, badReq) {
 						ch <- gin.H{"error": err.Error(), "status": http.StatusBadRequest}
 						return
@@ -143,6 +190,8 @@ func (s *Server) CreateHandler(c *gin.Context) {
 			}
 		}
 
+		notify(webhookEvent{Event: eventModelCreated, Model: name.DisplayShortest()})
+
 		ch <- api.ProgressResponse{Status: "success"}
 	}()
 
@@ -166,18 +215,24 @@ func convertModelFromFiles(files map[string]string, baseLayers []*layerGGML, isA
 	case "gguf":
 		if len(files) == 0 {
 			return nil, errNoFilesProvided
-		} else if len(files) > 1 && isAdapter {
-			return nil, errOnlyOneAdapterSupported
 		}
 
-		var digest string
+		// each file of adapters is an adapter, named after the file and
+		// numbered in the order of their names
 		var allLayers []*layerGGML
-		for _, v := range files {
-			digest = v
-			layers, err := ggufLayers(digest, fn)
+		for _, name := range slices.Sorted(maps.Keys(files)) {
+			layers, err := ggufLayers(files[name], fn)
 			if err != nil {
 				return nil, err
 			}
+
+			if isAdapter {
+				for _, layer := range layers {
+					if layer.MediaType == "application/vnd.goobla.image.adapter" {
+						layer.Name = strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+					}
+				}
+			}
 			allLayers = append(allLayers, layers...)
 		}
 		return allLayers, nil
@@ -259,7 +314,13 @@ func convertFromSafetensors(files map[string]string, baseLayers []*layerGGML, is
 		}
 	}
 
-	t, err := os.CreateTemp(tmpDir, "fp16")
+	return convertSafetensorsDir(tmpDir, baseLayers, isAdapter, fn)
+}
+
+// convertSafetensorsDir converts the safetensors model or adapter in dir to a
+// GGUF layer.
+func convertSafetensorsDir(dir string, baseLayers []*layerGGML, isAdapter bool, fn func(resp api.ProgressResponse)) ([]*layerGGML, error) {
+	t, err := os.CreateTemp(dir, "fp16")
 	if err != nil {
 		return nil, err
 	}
@@ -269,7 +330,7 @@ func convertFromSafetensors(files map[string]string, baseLayers []*layerGGML, is
 	if !isAdapter {
 		fn(api.ProgressResponse{Status: "converting model"})
 		mediaType = "application/vnd.goobla.image.model"
-		if err := convert.ConvertModel(os.DirFS(tmpDir), t); err != nil {
+		if err := convert.ConvertModel(os.DirFS(dir), t); err != nil {
 			return nil, err
 		}
 	} else {
@@ -279,7 +340,7 @@ func convertFromSafetensors(files map[string]string, baseLayers []*layerGGML, is
 		}
 		fn(api.ProgressResponse{Status: "converting adapter"})
 		mediaType = "application/vnd.goobla.image.adapter"
-		if err := convert.ConvertAdapter(os.DirFS(tmpDir), t, kv); err != nil {
+		if err := convert.ConvertAdapter(os.DirFS(dir), t, kv); err != nil {
 			return nil, err
 		}
 	}
@@ -343,7 +404,15 @@ func createModel(r api.CreateRequest, name model.Name, baseLayers []*layerGGML,
 				if !slices.Contains([]string{"F16", "F32"}, ft.String()) {
 					return errors.New("quantization is only supported for F16 and F32 models")
 				} else if ft != want {
-					layer, err = quantizeLayer(layer, quantType, fn)
+					var imatrix *importanceMatrix
+					if r.ImportanceMatrix != "" {
+						fn(api.ProgressResponse{Status: "reading importance matrix"})
+						if imatrix, err = importanceMatrixFromBlob(r.ImportanceMatrix); err != nil {
+							return err
+						}
+					}
+
+					layer, err = quantizeLayer(layer, quantType, imatrix, fn)
 					if err != nil {
 						return err
 					}
@@ -353,11 +422,24 @@ func createModel(r api.CreateRequest, name model.Name, baseLayers []*layerGGML,
 			config.ModelFamily = cmp.Or(config.ModelFamily, layer.GGML.KV().Architecture())
 			config.ModelType = cmp.Or(config.ModelType, format.HumanNumber(layer.GGML.KV().ParameterCount()))
 			config.FileType = cmp.Or(config.FileType, layer.GGML.KV().FileType().String())
+			config.License = cmp.Or(config.License, layer.GGML.KV().String("general.license"))
+			config.ParameterCount = cmp.Or(config.ParameterCount, layer.GGML.KV().ParameterCount())
+			config.ContextLength = cmp.Or(config.ContextLength, layer.GGML.KV().ContextLength())
+			config.Source = cmp.Or(config.Source, layer.GGML.KV().String("general.source.url"))
 			config.ModelFamilies = append(config.ModelFamilies, layer.GGML.KV().Architecture())
 		}
 		layers = append(layers, layer.Layer)
 	}
 
+	config.Locked = r.Locked
+
+	if m := r.Metadata; m != nil {
+		config.License = cmp.Or(m.License, config.License)
+		config.ParameterCount = cmp.Or(m.ParameterCount, config.ParameterCount)
+		config.ContextLength = cmp.Or(m.ContextLength, config.ContextLength)
+		config.Source = cmp.Or(m.Source, config.Source)
+	}
+
 	if r.Template != "" {
 		layers, err = setTemplate(layers, r.Template)
 		if err != nil {
@@ -372,6 +454,13 @@ func createModel(r api.CreateRequest, name model.Name, baseLayers []*layerGGML,
 		}
 	}
 
+	if r.Draft != "" {
+		layers, err = setDraft(layers, r.Draft)
+		if err != nil {
+			return err
+		}
+	}
+
 	if r.License != nil {
 		switch l := r.License.(type) {
 		case string:
@@ -408,6 +497,12 @@ func createModel(r api.CreateRequest, name model.Name, baseLayers []*layerGGML,
 		return err
 	}
 
+	if r.Check {
+		if err := checkTemplate(layers, fn); err != nil {
+			return err
+		}
+	}
+
 	configLayer, err := createConfigLayer(layers, config)
 	if err != nil {
 		return err
@@ -419,6 +514,12 @@ func createModel(r api.CreateRequest, name model.Name, baseLayers []*layerGGML,
 		}
 	}
 
+	// the layers are already written, but are pruned at startup if the
+	// model doesn't fit
+	if err := reserveDisk(name, append(layers, *configLayer), fn); err != nil {
+		return err
+	}
+
 	fn(api.ProgressResponse{Status: "writing manifest"})
 	if err := WriteManifest(name, *configLayer, layers); err != nil {
 		return err
@@ -427,7 +528,7 @@ func createModel(r api.CreateRequest, name model.Name, baseLayers []*layerGGML,
 	return nil
 }
 
-func quantizeLayer(layer *layerGGML, quantizeType string, fn func(resp api.ProgressResponse)) (*layerGGML, error) {
+func quantizeLayer(layer *layerGGML, quantizeType string, imatrix *importanceMatrix, fn func(resp api.ProgressResponse)) (*layerGGML, error) {
 	ft := layer.GGML.KV().FileType()
 	var doneBytes atomic.Uint64
 	totalBytes := uint64(layer.Size) - layer.GGML.Tensors().Offset
@@ -458,7 +559,7 @@ func quantizeLayer(layer *layerGGML, quantizeType string, fn func(resp api.Progr
 	defer temp.Close()
 	defer os.Remove(temp.Name())
 
-	if err := quantize(fp, temp, layer.GGML, ftype, fnWrap); err != nil {
+	if err := quantize(fp, temp, layer.GGML, ftype, imatrix, fnWrap); err != nil {
 		return nil, err
 	}
 	temp.Seek(0, io.SeekStart)
@@ -560,6 +661,49 @@ func setTemplate(layers []Layer, t string) ([]Layer, error) {
 	return layers, nil
 }
 
+// checkTemplate renders the template of the layers, or the default template
+// if there isn't one, with sample conversations and reports the problems it
+// finds. Problems other than warnings fail the check.
+func checkTemplate(layers []Layer, fn func(resp api.ProgressResponse)) error {
+	fn(api.ProgressResponse{Status: "checking template"})
+
+	tmpl := template.DefaultTemplate
+	for _, layer := range layers {
+		if layer.MediaType != "application/vnd.goobla.image.template" {
+			continue
+		}
+
+		p, err := GetBlobsPath(layer.Digest)
+		if err != nil {
+			return err
+		}
+
+		bts, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		if tmpl, err = template.Parse(string(bts)); err != nil {
+			return fmt.Errorf("%w: %s", errBadTemplate, err)
+		}
+	}
+
+	var errs []string
+	for _, p := range tmpl.Check() {
+		if p.Warning {
+			fn(api.ProgressResponse{Status: "warning: " + p.String()})
+		} else {
+			fn(api.ProgressResponse{Status: "error: " + p.String()})
+			errs = append(errs, p.String())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %s", errBadTemplate, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
 func setSystem(layers []Layer, s string) ([]Layer, error) {
 	layers = removeLayer(layers, "application/vnd.goobla.image.system")
 	if s != "" {
@@ -573,6 +717,15 @@ func setSystem(layers []Layer, s string) ([]Layer, error) {
 	return layers, nil
 }
 
+func setDraft(layers []Layer, draft string) ([]Layer, error) {
+	layers = removeLayer(layers, "application/vnd.goobla.image.draft")
+	layer, err := NewLayer(strings.NewReader(draft), "application/vnd.goobla.image.draft")
+	if err != nil {
+		return nil, err
+	}
+	return append(layers, layer), nil
+}
+
 func setLicense(layers []Layer, l string) ([]Layer, error) {
 	blob := strings.NewReader(l)
 	layer, err := NewLayer(blob, "application/vnd.goobla.image.license")
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/goobla/goobla/api"
+)
+
+// maxDeltaWindow is how much of a base layer a patch can refer to. Patches
+// are decoded with the end of the base layer as the zstd dictionary, which
+// the decoder limits to 2 GiB, so patches of larger layers can only refer to
+// their last 2 GiB. Patches that refer further back fail to decode or don't
+// match the layer's digest, and the whole layer is pulled instead.
+const maxDeltaWindow = 2 << 30
+
+// Delta is a patch made with "zstd --patch-from" that reconstructs a layer
+// from an older layer, advertised by registries in the layer's descriptor.
+type Delta struct {
+	// Base is the digest of the layer the patch applies to.
+	Base string `json:"base"`
+
+	// Digest and Size describe the patch blob.
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// localDelta returns the smallest of layer's deltas whose base layer is
+// present locally, if the layer itself isn't.
+func localDelta(layer Layer) (Delta, bool) {
+	if p, err := GetBlobsPath(layer.Digest); err != nil {
+		return Delta{}, false
+	} else if _, err := os.Stat(p); err == nil {
+		return Delta{}, false
+	}
+
+	var best Delta
+	for _, d := range layer.Deltas {
+		p, err := GetBlobsPath(d.Base)
+		if err != nil {
+			continue
+		}
+
+		if _, err := os.Stat(p); err != nil || isCorrupted(d.Base) {
+			continue
+		}
+
+		if best.Digest == "" || d.Size < best.Size {
+			best = d
+		}
+	}
+
+	return best, best.Digest != ""
+}
+
+// pullLayer downloads layer. If the registry offers a patch from a layer that
+// is already present, such as one from an older version of the model, only
+// the patch is downloaded and applied. The whole layer is downloaded if that
+// fails.
+func pullLayer(ctx context.Context, mp ModelPath, layer Layer, regOpts *registryOptions, fn func(api.ProgressResponse)) (cacheHit bool, _ error) {
+	if d, ok := localDelta(layer); ok {
+		err := pullDelta(ctx, mp, layer, d, regOpts, fn)
+		if err == nil {
+			return false, nil
+		} else if errors.Is(err, context.Canceled) {
+			return false, err
+		}
+
+		slog.Warn("couldn't apply delta, pulling the whole layer", "digest", layer.Digest, "base", d.Base, "error", err)
+	}
+
+	return downloadBlob(ctx, downloadOpts{
+		mp:      mp,
+		digest:  layer.Digest,
+		regOpts: regOpts,
+		fn:      fn,
+	})
+}
+
+func pullDelta(ctx context.Context, mp ModelPath, layer Layer, d Delta, regOpts *registryOptions, fn func(api.ProgressResponse)) error {
+	slog.Info("pulling delta", "digest", layer.Digest, "base", d.Base, "size", d.Size, "layer_size", layer.Size)
+
+	patch, err := GetBlobsPath(d.Digest)
+	if err != nil {
+		return err
+	}
+
+	cacheHit, err := downloadBlob(ctx, downloadOpts{
+		mp:      mp,
+		digest:  d.Digest,
+		regOpts: regOpts,
+		fn:      fn,
+	})
+	if err != nil {
+		return err
+	}
+
+	// the patch isn't referenced by any manifest so it is removed once
+	// it has been applied, or if it can't be, unless it was already here
+	if !cacheHit {
+		defer os.Remove(patch)
+	}
+
+	if err := verifyBlob(d.Digest); err != nil {
+		return err
+	}
+
+	base, err := GetBlobsPath(d.Base)
+	if err != nil {
+		return err
+	}
+
+	dst, err := GetBlobsPath(layer.Digest)
+	if err != nil {
+		return err
+	}
+
+	fn(api.ProgressResponse{
+		Status: fmt.Sprintf("applying delta %s", layer.Digest[7:19]),
+		Digest: layer.Digest,
+		Total:  layer.Size,
+	})
+
+	if err := applyDelta(base, patch, dst, layer.Digest); err != nil {
+		return err
+	}
+
+	fn(api.ProgressResponse{
+		Status:    fmt.Sprintf("applying delta %s", layer.Digest[7:19]),
+		Digest:    layer.Digest,
+		Total:     layer.Size,
+		Completed: layer.Size,
+	})
+
+	return nil
+}
+
+// applyDelta writes the result of applying the patch at patch to the file at
+// base to dst, which is only created if the result matches digest. The base
+// is mapped into memory rather than read, since layers can be larger than
+// the memory available.
+func applyDelta(base, patch, dst, digest string) error {
+	bf, err := os.Open(base)
+	if err != nil {
+		return err
+	}
+	defer bf.Close()
+
+	fi, err := bf.Stat()
+	if err != nil {
+		return err
+	}
+
+	n := min(fi.Size(), maxDeltaWindow)
+	dict, unmap, err := mapFile(bf, fi.Size()-n, n)
+	if err != nil {
+		return err
+	}
+	defer unmap() //nolint:errcheck
+
+	pf, err := os.Open(patch)
+	if err != nil {
+		return err
+	}
+	defer pf.Close()
+
+	// patches made with --patch-from have no dictionary ID, which the
+	// decoder matches to a dictionary with ID 0
+	dec, err := zstd.NewReader(pf,
+		zstd.WithDecoderDictRaw(0, dict),
+		zstd.WithDecoderMaxWindow(1<<31),
+		zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+
+	f, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+"-delta-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), dec); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if got := fmt.Sprintf("sha256:%x", h.Sum(nil)); got != digest {
+		return fmt.Errorf("%w: expected %q, got %q", errDigestMismatch, digest, got)
+	}
+
+	return os.Rename(f.Name(), dst)
+}
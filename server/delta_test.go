@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goobla/goobla/api"
+)
+
+// makeDelta returns a patch of target from base like "zstd --patch-from".
+func makeDelta(t *testing.T, base, target []byte) []byte {
+	t.Helper()
+
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderDictRaw(0, base), zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+	require.NoError(t, err)
+	defer enc.Close()
+
+	return enc.EncodeAll(target, nil)
+}
+
+func TestPullModelDelta(t *testing.T) {
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	base := make([]byte, 1<<20)
+	_, err := rand.Read(base)
+	require.NoError(t, err)
+
+	// the new version differs from the old in a few bytes
+	target := bytes.Clone(base)
+	copy(target[len(target)/2:], "nightly")
+
+	patch := makeDelta(t, base, target)
+	require.Less(t, len(patch), len(target)/100)
+
+	_, baseDigest := testBlob(string(base))
+	_, targetDigest := testBlob(string(target))
+	_, patchDigest := testBlob(string(patch))
+
+	require.NoError(t, localBlobs.Put(t.Context(), baseDigest, bytes.NewReader(base), int64(len(base))))
+
+	layer := func(digest string, size int, deltas ...Delta) Layer {
+		return Layer{MediaType: "application/vnd.goobla.image.model", Digest: digest, Size: int64(size), Deltas: deltas}
+	}
+
+	manifests := map[string]Manifest{
+		// the patch is broken so the whole layer is pulled
+		"broken": {SchemaVersion: 2, Layers: []Layer{layer(targetDigest, len(target), Delta{Base: baseDigest, Digest: baseDigest, Size: int64(len(base))})}},
+		"delta":  {SchemaVersion: 2, Layers: []Layer{layer(targetDigest, len(target), Delta{Base: baseDigest, Digest: patchDigest, Size: int64(len(patch))})}},
+	}
+
+	var mu sync.Mutex
+	var pulled []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blobs := map[string][]byte{
+			"/v2/ns/repo/blobs/" + targetDigest: target,
+			"/v2/ns/repo/blobs/" + patchDigest:  patch,
+			"/v2/ns/repo/blobs/" + baseDigest:   []byte("not a patch"),
+		}
+
+		if b, ok := blobs[r.URL.Path]; ok {
+			mu.Lock()
+			pulled = append(pulled, r.URL.Path)
+			mu.Unlock()
+
+			w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+			if r.Method == http.MethodHead {
+				return
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+			return
+		}
+
+		for tag, m := range manifests {
+			if r.URL.Path == "/v2/ns/repo/manifests/"+tag {
+				json.NewEncoder(w).Encode(m) //nolint:errcheck
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	pull := func(tag string) {
+		t.Helper()
+		mu.Lock()
+		pulled = nil
+		mu.Unlock()
+
+		require.NoError(t, PullModel(t.Context(), "http://"+srv.Listener.Addr().String()+"/ns/repo:"+tag, &registryOptions{Insecure: true}, func(api.ProgressResponse) {}))
+
+		p, err := GetBlobsPath(targetDigest)
+		require.NoError(t, err)
+		got, err := os.ReadFile(p)
+		require.NoError(t, err)
+		assert.Equal(t, target, got)
+	}
+
+	t.Run("delta", func(t *testing.T) {
+		pull("delta")
+		for _, p := range pulled {
+			assert.NotContains(t, p, targetDigest, "the whole layer must not be pulled")
+		}
+
+		// the patch is removed once applied
+		p, err := GetBlobsPath(patchDigest)
+		require.NoError(t, err)
+		_, err = os.Stat(p)
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("broken", func(t *testing.T) {
+		p, err := GetBlobsPath(targetDigest)
+		require.NoError(t, err)
+		require.NoError(t, os.Remove(p))
+
+		pull("broken")
+		assert.Contains(t, pulled, "/v2/ns/repo/blobs/"+targetDigest)
+
+		// a patch that is also a local blob is left in place
+		p, err = GetBlobsPath(baseDigest)
+		require.NoError(t, err)
+		_, err = os.Stat(p)
+		require.NoError(t, err)
+	})
+}
+
+func TestApplyDeltaLargeBase(t *testing.T) {
+	dir := t.TempDir()
+
+	// the base is sparse, with data only in the part patches can refer to
+	tail := make([]byte, 1<<20)
+	_, err := rand.Read(tail)
+	require.NoError(t, err)
+
+	base := filepath.Join(dir, "base")
+	f, err := os.Create(base)
+	require.NoError(t, err)
+	setSparse(f)
+	require.NoError(t, f.Truncate(maxDeltaWindow+(1<<20)+int64(len(tail))))
+	_, err = f.WriteAt(tail, maxDeltaWindow+(1<<20))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	target := bytes.Clone(tail)
+	copy(target[len(target)/2:], "nightly")
+
+	patch := filepath.Join(dir, "patch")
+	require.NoError(t, os.WriteFile(patch, makeDelta(t, tail, target), 0o644))
+
+	_, digest := testBlob(string(target))
+	dst := filepath.Join(dir, "target")
+	require.NoError(t, applyDelta(base, patch, dst, digest))
+
+	got, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	assert.Equal(t, target, got)
+
+	// a patch of a different base fails, and nothing is written
+	require.NoError(t, os.WriteFile(patch, makeDelta(t, target, target), 0o644))
+	require.Error(t, applyDelta(base, patch, filepath.Join(dir, "other"), digest))
+	_, err = os.Stat(filepath.Join(dir, "other"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
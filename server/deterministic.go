@@ -0,0 +1,30 @@
+package server
+
+import (
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/llm"
+	"github.com/goobla/goobla/version"
+)
+
+// deterministicSeed is the seed deterministic requests are sampled with when
+// they don't set one.
+const deterministicSeed = 0
+
+// reproducibility returns what the response to a request with opts is
+// generated with, or nil if the request isn't deterministic.
+func reproducibility(r llm.LlamaServer, m *Model, opts *api.Options) *api.Reproducibility {
+	if !opts.Deterministic {
+		return nil
+	}
+
+	b := r.Backend()
+	return &api.Reproducibility{
+		Seed:         opts.Seed,
+		Digest:       m.Digest,
+		Quantization: m.Config.FileType,
+		Engine:       b.Engine,
+		Backend:      b.Library,
+		GPULayers:    b.GPULayers,
+		Version:      version.Version,
+	}
+}
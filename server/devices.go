@@ -0,0 +1,146 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/discover"
+	"github.com/goobla/goobla/format"
+)
+
+// gpuDiscoveryInterval is how often the scheduler looks for GPUs that were
+// added, removed or recovered from a driver reset.
+var gpuDiscoveryInterval = time.Minute
+
+const (
+	deviceAvailable = "available"
+	deviceMissing   = "missing"
+)
+
+// watchGPUs discovers the GPUs every gpuDiscoveryInterval until ctx is done.
+func (s *Scheduler) watchGPUs(ctx context.Context) {
+	s.checkGPUs()
+
+	ticker := time.NewTicker(gpuDiscoveryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.rediscoverFn()
+			s.checkGPUs()
+		}
+	}
+}
+
+// checkGPUs records the GPUs that are currently discovered, and unloads the
+// models loaded on GPUs that disappeared since the last check so they're
+// loaded again on the GPUs that remain. It returns the GPUs that are
+// missing, by deviceKey.
+func (s *Scheduler) checkGPUs() map[string]bool {
+	s.devicesMu.Lock()
+	defer s.devicesMu.Unlock()
+
+	found := make(map[string]discover.GpuInfo)
+	for _, g := range s.getGpuFn() {
+		if g.Library != "cpu" {
+			found[deviceKey(g)] = g
+		}
+	}
+
+	missing := make(map[string]bool)
+	lost := make(map[string]bool)
+	for key, d := range s.devices {
+		_, ok := found[key]
+		switch {
+		case ok && d.Status == deviceMissing:
+			slog.Info("GPU recovered", "library", d.Library, "id", d.ID, "name", d.Name)
+			d.Status = deviceAvailable
+		case !ok && d.Status == deviceAvailable:
+			slog.Warn("GPU is no longer available", "library", d.Library, "id", d.ID, "name", d.Name)
+			d.Status = deviceMissing
+			lost[key] = true
+		}
+
+		if d.Status == deviceMissing {
+			missing[key] = true
+		}
+	}
+
+	for key, g := range found {
+		if _, ok := s.devices[key]; !ok {
+			if len(s.devices) > 0 {
+				slog.Info("new GPU discovered", "library", g.Library, "id", g.ID, "name", g.Name, "total", format.HumanBytes2(g.TotalMemory))
+			}
+
+			s.devices[key] = &api.DeviceStatus{
+				Library:   g.Library,
+				ID:        g.ID,
+				Name:      g.Name,
+				Status:    deviceAvailable,
+				TotalVRAM: int64(g.TotalMemory),
+			}
+		}
+	}
+
+	if len(lost) > 0 {
+		s.loadedMu.Lock()
+		var runners []*runnerRef
+		for _, r := range s.loaded {
+			if slices.ContainsFunc(r.gpus, func(g discover.GpuInfo) bool { return lost[deviceKey(g)] }) {
+				runners = append(runners, r)
+			}
+		}
+		s.loadedMu.Unlock()
+
+		for _, r := range runners {
+			slog.Warn("unloading model from a missing GPU", "model", r.modelPath)
+			s.expiredCh <- r
+		}
+	}
+
+	return missing
+}
+
+// retryOnMissingGPU discovers the GPUs again after req failed to load on
+// gpus, and schedules req again if any of them disappeared, such as after a
+// driver reset. It reports whether req was scheduled again.
+func (s *Scheduler) retryOnMissingGPU(req *LlmRequest, gpus discover.GpuInfoList) bool {
+	if req.retriedGPUs || req.ctx.Err() != nil || len(gpus) == 0 || gpus[0].Library == "cpu" {
+		return false
+	}
+
+	s.rediscoverFn()
+	missing := s.checkGPUs()
+	if !slices.ContainsFunc(gpus, func(g discover.GpuInfo) bool { return missing[deviceKey(g)] }) {
+		return false
+	}
+
+	slog.Warn("GPU disappeared while loading model, retrying", "model", req.model.ModelPath)
+	req.retriedGPUs = true
+	go func() {
+		s.pendingReqCh <- req
+	}()
+	return true
+}
+
+// deviceStatus returns the health of the GPUs that have been discovered.
+func (s *Scheduler) deviceStatus() []api.DeviceStatus {
+	s.devicesMu.Lock()
+	defer s.devicesMu.Unlock()
+
+	devices := make([]api.DeviceStatus, 0, len(s.devices))
+	for _, d := range s.devices {
+		devices = append(devices, *d)
+	}
+
+	slices.SortFunc(devices, func(a, b api.DeviceStatus) int {
+		return cmp.Or(cmp.Compare(a.Library, b.Library), cmp.Compare(a.ID, b.ID))
+	})
+	return devices
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/discover"
+)
+
+func TestCheckGPUs(t *testing.T) {
+	gpus := discover.GpuInfoList{
+		{Library: "cuda", ID: "GPU-a", Name: "a"},
+		{Library: "cuda", ID: "GPU-b", Name: "b"},
+	}
+
+	s := InitScheduler(t.Context())
+	found := gpus
+	s.getGpuFn = func() discover.GpuInfoList { return found }
+
+	if missing := s.checkGPUs(); len(missing) != 0 {
+		t.Fatalf("expected no missing GPUs, got %v", missing)
+	}
+
+	r := &runnerRef{modelPath: "b", gpus: discover.GpuInfoList{gpus[1]}}
+	s.loadedMu.Lock()
+	s.loaded["a"] = &runnerRef{modelPath: "a", gpus: discover.GpuInfoList{gpus[0]}}
+	s.loaded["b"] = r
+	s.loadedMu.Unlock()
+
+	// the second GPU disappears
+	found = gpus[:1]
+	if missing := s.checkGPUs(); len(missing) != 1 || !missing["cuda:GPU-b"] {
+		t.Fatalf("expected the second GPU to be missing, got %v", missing)
+	}
+
+	select {
+	case expired := <-s.expiredCh:
+		if expired != r {
+			t.Errorf("expected the model on the missing GPU to be unloaded, got %s", expired.modelPath)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the model on the missing GPU to be unloaded")
+	}
+
+	// models are only unloaded when the GPU disappears
+	s.checkGPUs()
+	if len(s.expiredCh) != 0 {
+		t.Errorf("expected no more models to be unloaded, got %d", len(s.expiredCh))
+	}
+
+	want := []api.DeviceStatus{
+		{Library: "cuda", ID: "GPU-a", Name: "a", Status: deviceAvailable},
+		{Library: "cuda", ID: "GPU-b", Name: "b", Status: deviceMissing},
+	}
+	if got := s.deviceStatus(); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	// the second GPU recovers
+	found = gpus
+	if missing := s.checkGPUs(); len(missing) != 0 {
+		t.Fatalf("expected no missing GPUs, got %v", missing)
+	}
+
+	if got := s.deviceStatus(); got[1].Status != deviceAvailable {
+		t.Errorf("expected the second GPU to be available, got %q", got[1].Status)
+	}
+}
+
+func TestRetryOnMissingGPU(t *testing.T) {
+	gpus := discover.GpuInfoList{
+		{Library: "cuda", ID: "GPU-a"},
+		{Library: "cuda", ID: "GPU-b"},
+	}
+
+	s := InitScheduler(t.Context())
+	found := gpus
+	s.getGpuFn = func() discover.GpuInfoList { return found }
+	var rediscovered int
+	s.rediscoverFn = func() { rediscovered++ }
+	s.checkGPUs()
+
+	req := &LlmRequest{ctx: t.Context(), model: &Model{ModelPath: "a"}}
+	if s.retryOnMissingGPU(req, gpus) {
+		t.Fatal("expected no retry while all GPUs are available")
+	}
+
+	if rediscovered != 1 {
+		t.Errorf("expected the GPUs to be discovered again, got %d times", rediscovered)
+	}
+
+	found = gpus[1:]
+	if !s.retryOnMissingGPU(req, gpus) {
+		t.Fatal("expected a retry after a GPU disappeared")
+	}
+
+	select {
+	case pending := <-s.pendingReqCh:
+		if pending != req {
+			t.Error("expected the request to be scheduled again")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the request to be scheduled again")
+	}
+
+	// requests are only retried once
+	if s.retryOnMissingGPU(req, gpus[1:]) {
+		t.Error("expected no second retry")
+	}
+
+	if s.retryOnMissingGPU(&LlmRequest{ctx: t.Context()}, discover.GpuInfoList{{Library: "cpu"}}) {
+		t.Error("expected no retry for models loaded on the CPU")
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"golang.org/x/sync/errgroup"
 
 	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/envconfig"
 	"github.com/goobla/goobla/format"
 )
 
@@ -45,6 +46,8 @@ type blobDownload struct {
 
 	Parts []*blobDownloadPart
 
+	limiter *rateLimiter
+
 	context.CancelFunc
 
 	done       chan struct{}
@@ -61,6 +64,9 @@ type blobDownloadPart struct {
 	lastUpdatedMu sync.Mutex
 	lastUpdated   time.Time
 
+	// writeMu serializes writes of the part's state file
+	writeMu sync.Mutex
+
 	*blobDownload `json:"-"`
 }
 
@@ -100,6 +106,16 @@ const (
 	maxDownloadPartSize int64 = 1000 * format.MegaByte
 )
 
+// downloadConcurrency returns the number of parts of a blob downloaded at
+// once, which is also the number of parts large blobs are split into.
+func downloadConcurrency() int {
+	if n := envconfig.PullConcurrency(); n > 0 {
+		return int(n)
+	}
+
+	return numDownloadParts
+}
+
 func (p *blobDownloadPart) Name() string {
 	return strings.Join([]string{
 		p.blobDownload.Name, "partial", strconv.Itoa(p.N),
@@ -114,8 +130,10 @@ func (p *blobDownloadPart) StopsAt() int64 {
 	return p.Offset + p.Size
 }
 
+// Write records that b has been written to the part.
 func (p *blobDownloadPart) Write(b []byte) (n int, err error) {
 	n = len(b)
+	p.Completed.Add(int64(n))
 	p.blobDownload.Completed.Add(int64(n))
 	p.lastUpdatedMu.Lock()
 	p.lastUpdated = time.Now()
@@ -151,7 +169,7 @@ func (b *blobDownload) Prepare(ctx context.Context, requestURL *url.URL, opts *r
 
 		b.Total, _ = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
 
-		size := b.Total / numDownloadParts
+		size := b.Total / int64(downloadConcurrency())
 		switch {
 		case size < minDownloadPartSize:
 			size = minDownloadPartSize
@@ -214,6 +232,7 @@ func newBackoff(maxBackoff time.Duration) func(ctx context.Context) error {
 func (b *blobDownload) run(ctx context.Context, requestURL *url.URL, opts *registryOptions) error {
 	defer blobDownloadManager.Delete(b.Digest)
 	ctx, b.CancelFunc = context.WithCancel(ctx)
+	b.limiter = opts.limiter
 
 	file, err := os.OpenFile(b.Name+"-partial", os.O_CREATE|os.O_RDWR, 0o644)
 	if err != nil {
@@ -224,6 +243,9 @@ func (b *blobDownload) run(ctx context.Context, requestURL *url.URL, opts *regis
 
 	_ = file.Truncate(b.Total)
 
+	// chunkOpts are the registry options used to fetch chunks, nil if the
+	// chunks are fetched from a presigned URL outside the registry
+	var chunkOpts *registryOptions
 	directURL, err := func() (*url.URL, error) {
 		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 		defer cancel()
@@ -260,10 +282,19 @@ func (b *blobDownload) run(ctx context.Context, requestURL *url.URL, opts *regis
 				continue
 			}
 			defer resp.Body.Close()
-			if resp.StatusCode != http.StatusTemporaryRedirect && resp.StatusCode != http.StatusOK {
+			switch resp.StatusCode {
+			case http.StatusTemporaryRedirect:
+				return resp.Location()
+			case http.StatusOK:
+				// some registries, including most OCI
+				// registries, serve blobs directly and
+				// require the same credentials for each chunk
+				chunkOpts = newOpts
+				chunkOpts.CheckRedirect = nil
+				return resp.Request.URL, nil
+			default:
 				return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
 			}
-			return resp.Location()
 		}
 	}()
 	if err != nil {
@@ -271,7 +302,7 @@ func (b *blobDownload) run(ctx context.Context, requestURL *url.URL, opts *regis
 	}
 
 	g, inner := errgroup.WithContext(ctx)
-	g.SetLimit(numDownloadParts)
+	g.SetLimit(downloadConcurrency())
 	for i := range b.Parts {
 		part := b.Parts[i]
 		if part.Completed.Load() == part.Size {
@@ -281,8 +312,8 @@ func (b *blobDownload) run(ctx context.Context, requestURL *url.URL, opts *regis
 		g.Go(func() error {
 			var err error
 			for try := 0; try < maxRetries; try++ {
-				w := io.NewOffsetWriter(file, part.StartsAt())
-				err = b.downloadChunk(inner, directURL, w, part)
+				w := rateLimitWriter(inner, io.NewOffsetWriter(file, part.StartsAt()), b.limiter)
+				err = b.downloadChunk(inner, directURL, w, part, chunkOpts)
 				switch {
 				case errors.Is(err, context.Canceled), errors.Is(err, syscall.ENOSPC):
 					// return immediately if the context is canceled or the device is out of space
@@ -326,33 +357,44 @@ func (b *blobDownload) run(ctx context.Context, requestURL *url.URL, opts *regis
 	return nil
 }
 
-func (b *blobDownload) downloadChunk(ctx context.Context, requestURL *url.URL, w io.Writer, part *blobDownloadPart) error {
+func (b *blobDownload) downloadChunk(ctx context.Context, requestURL *url.URL, w io.Writer, part *blobDownloadPart, opts *registryOptions) error {
 	g, ctx := errgroup.WithContext(ctx)
 	g.Go(func() error {
-		req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL.String(), nil)
-		if err != nil {
-			return err
-		}
-		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", part.StartsAt(), part.StopsAt()-1))
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return err
+		var resp *http.Response
+		if opts != nil {
+			headers := make(http.Header)
+			headers.Set("Range", fmt.Sprintf("bytes=%d-%d", part.StartsAt(), part.StopsAt()-1))
+
+			// parts are downloaded concurrently so copy anything
+			// the request may modify
+			u, o := *requestURL, *opts
+			var err error
+			resp, err = makeRequestWithRetry(ctx, http.MethodGet, &u, headers, nil, &o)
+			if err != nil {
+				return err
+			}
+		} else {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL.String(), nil)
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", part.StartsAt(), part.StopsAt()-1))
+			resp, err = http.DefaultClient.Do(req)
+			if err != nil {
+				return err
+			}
 		}
 		defer resp.Body.Close()
 
-		n, err := io.CopyN(w, io.TeeReader(resp.Body, part), part.Size-part.Completed.Load())
-		if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, io.ErrUnexpectedEOF) {
-			// rollback progress
-			b.Completed.Add(-n)
-			return err
-		}
-
-		part.Completed.Add(n)
+		// progress is only counted once it has been written to the file
+		// so the part can be resumed from where it stopped
+		_, err := io.CopyN(io.MultiWriter(w, part), resp.Body, part.Size-part.Completed.Load())
 		if err := b.writePart(part.Name(), part); err != nil {
 			return err
 		}
 
-		// return nil or context.Canceled or UnexpectedEOF (resumable)
+		// return nil, the error to retry, or context.Canceled or
+		// UnexpectedEOF (resumable)
 		return err
 	})
 
@@ -365,6 +407,12 @@ func (b *blobDownload) downloadChunk(ctx context.Context, requestURL *url.URL, w
 					return nil
 				}
 
+				// save progress regularly so a pull that is killed
+				// resumes close to where it stopped
+				if err := b.writePart(part.Name(), part); err != nil {
+					return err
+				}
+
 				part.lastUpdatedMu.Lock()
 				lastUpdated := part.lastUpdated
 				part.lastUpdatedMu.Unlock()
@@ -414,6 +462,9 @@ func (b *blobDownload) readPart(partName string) (*blobDownloadPart, error) {
 }
 
 func (b *blobDownload) writePart(partName string, part *blobDownloadPart) error {
+	part.writeMu.Lock()
+	defer part.writeMu.Unlock()
+
 	partFile, err := os.OpenFile(partName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0o644)
 	if err != nil {
 		return err
@@ -443,11 +494,21 @@ func (b *blobDownload) Wait(ctx context.Context, fn func(api.ProgressResponse))
 		case <-b.done:
 			return b.err
 		case <-ticker.C:
+			chunks := make([]api.ChunkProgress, len(b.Parts))
+			for i, part := range b.Parts {
+				chunks[i] = api.ChunkProgress{
+					Offset:    part.Offset,
+					Total:     part.Size,
+					Completed: part.Completed.Load(),
+				}
+			}
+
 			fn(api.ProgressResponse{
 				Status:    fmt.Sprintf("pulling %s", b.Digest[7:19]),
 				Digest:    b.Digest,
 				Total:     b.Total,
 				Completed: b.Completed.Load(),
+				Chunks:    chunks,
 			})
 		case <-ctx.Done():
 			return ctx.Err()
@@ -478,6 +539,15 @@ func downloadBlob(ctx context.Context, opts downloadOpts) (cacheHit bool, _ erro
 	case errors.Is(err, os.ErrNotExist):
 	case err != nil:
 		return false, err
+	case isCorrupted(opts.digest):
+		slog.Info("replacing corrupted blob", "digest", opts.digest)
+		if err := os.Remove(fp); err != nil {
+			return false, err
+		}
+
+		if err := unmarkCorrupted(opts.digest); err != nil {
+			return false, err
+		}
 	default:
 		opts.fn(api.ProgressResponse{
 			Status:    fmt.Sprintf("pulling %s", opts.digest[7:19]),
@@ -489,11 +559,17 @@ func downloadBlob(ctx context.Context, opts downloadOpts) (cacheHit bool, _ erro
 		return true, nil
 	}
 
+	// blobs copied from the shared store are verified as they are written
+	if err := fetchSharedBlob(ctx, opts.digest, opts.fn); err == nil {
+		return true, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("couldn't copy blob from shared store, pulling from registry", "digest", opts.digest, "error", err)
+	}
+
 	data, ok := blobDownloadManager.LoadOrStore(opts.digest, &blobDownload{Name: fp, Digest: opts.digest})
 	download := data.(*blobDownload)
 	if !ok {
-		requestURL := opts.mp.BaseURL()
-		requestURL = requestURL.JoinPath("v2", opts.mp.GetNamespaceRepository(), "blobs", opts.digest)
+		requestURL := blobURL(opts.mp, opts.digest, opts.regOpts)
 		if err := download.Prepare(ctx, requestURL, opts.regOpts); err != nil {
 			blobDownloadManager.Delete(opts.digest)
 			return false, err
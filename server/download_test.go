@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goobla/goobla/api"
+)
+
+func TestDownloadConcurrency(t *testing.T) {
+	cases := map[string]int{
+		"":   numDownloadParts,
+		"0":  numDownloadParts,
+		"4":  4,
+		"32": 32,
+	}
+
+	for v, expect := range cases {
+		t.Run(v, func(t *testing.T) {
+			t.Setenv("GOOBLA_PULL_CONCURRENCY", v)
+			assert.Equal(t, expect, downloadConcurrency())
+		})
+	}
+}
+
+func TestDownloadBlobResume(t *testing.T) {
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	blob := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	_, digest := testBlob(string(blob))
+
+	var mu sync.Mutex
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/ns/repo/blobs/"+digest {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if rng := r.Header.Get("Range"); rng != "" {
+			mu.Lock()
+			ranges = append(ranges, rng)
+			mu.Unlock()
+		}
+
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+	}))
+	defer srv.Close()
+
+	// leave behind the state of a pull that was killed part way through
+	// the first part
+	fp, err := GetBlobsPath(digest)
+	require.NoError(t, err)
+
+	const completed = 1000
+	require.NoError(t, os.WriteFile(fp+"-partial", blob[:completed], 0o644))
+
+	b, err := json.Marshal(jsonBlobDownloadPart{N: 0, Offset: 0, Size: int64(len(blob)), Completed: completed})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(fp+"-partial-0", b, 0o644))
+
+	var last api.ProgressResponse
+	cacheHit, err := downloadBlob(t.Context(), downloadOpts{
+		mp:      ParseModelPath("http://" + srv.Listener.Addr().String() + "/ns/repo:tag"),
+		digest:  digest,
+		regOpts: &registryOptions{Insecure: true},
+		fn:      func(p api.ProgressResponse) { last = p },
+	})
+	require.NoError(t, err)
+	assert.False(t, cacheHit)
+
+	assert.Equal(t, []string{"bytes=1000-65535"}, ranges)
+
+	got, err := os.ReadFile(fp)
+	require.NoError(t, err)
+	assert.Equal(t, blob, got)
+
+	_, err = os.Stat(fp + "-partial-0")
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	if last.Chunks != nil {
+		assert.Len(t, last.Chunks, 1)
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/types/model"
+)
+
+// A model can name a smaller draft model, with DRAFT in its Modelfile or
+// the draft field of a request, which proposes the next few tokens for the
+// model to check all at once with speculative decoding. The draft model must
+// share the model's vocabulary, and it is loaded in the same runner.
+
+// checkDraft aborts the request if the draft model named draft doesn't exist
+// or its user may not use it, reporting whether it may continue.
+func checkDraft(c *gin.Context, draft string) bool {
+	n := model.ParseName(draft)
+	if !n.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid draft model name %q", draft)})
+		return false
+	}
+
+	n, err := getExistingName(n)
+	if err == nil {
+		_, err = GetModel(n.String())
+	}
+
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && !canRead(requestUser(c), n)) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("draft model '%s' not found", draft)})
+		return false
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+
+	return true
+}
+
+// draftPath returns the path to the weights of the draft model named draft,
+// or "" if it can't be used, in which case the model is run without it.
+func draftPath(draft string) string {
+	if draft == "" {
+		return ""
+	}
+
+	m, err := GetModel(draft)
+	if err != nil {
+		slog.Warn("not using draft model", "draft", draft, "error", err)
+		return ""
+	}
+
+	return m.ModelPath
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/envconfig"
+	"github.com/goobla/goobla/types/model"
+)
+
+// Draining stops the server without failing requests, on one of the signals
+// of GOOBLA_DRAIN_ON or with /api/admin/drain. New inference requests are
+// refused and /api/health reports the server isn't ready, so load balancers
+// send requests elsewhere. Once the requests in progress have finished, or
+// GOOBLA_DRAIN_TIMEOUT has passed, the loaded models are recorded so the
+// next server loads them again, and the server stops.
+
+var errDraining = errors.New("server is shutting down, please try again")
+
+// drainer tracks the inference requests in progress so the server can wait
+// for them when it's drained.
+type drainer struct {
+	mu       sync.Mutex
+	draining bool
+	inflight int
+	// idle is closed once the server is draining and no requests are in
+	// progress
+	idle chan struct{}
+}
+
+// acquire starts a request, reporting false if the server is draining.
+func (d *drainer) acquire() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return false
+	}
+
+	d.inflight++
+	return true
+}
+
+func (d *drainer) release() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.inflight--
+	if d.draining && d.inflight == 0 {
+		close(d.idle)
+	}
+}
+
+// drain refuses new requests, returning a channel that's closed once no
+// requests are in progress.
+func (d *drainer) drain() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.draining {
+		d.draining = true
+		d.idle = make(chan struct{})
+		if d.inflight == 0 {
+			close(d.idle)
+		}
+	}
+
+	return d.idle
+}
+
+func (d *drainer) state() (draining bool, inflight int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.draining, d.inflight
+}
+
+// drainMiddleware refuses inference requests while the server is draining.
+// It comes after the middleware of the OpenAI and Anthropic compatible
+// endpoints so its errors are in their formats.
+func (s *Server) drainMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.drainer.acquire() {
+			c.Header("Connection", "close")
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": errDraining.Error()})
+			return
+		}
+		defer s.drainer.release()
+
+		c.Next()
+	}
+}
+
+func (s *Server) DrainHandler(c *gin.Context) {
+	s.drainer.drain()
+
+	// Serve stops the server once it's drained
+	select {
+	case s.drainRequests <- struct{}{}:
+	default:
+	}
+
+	c.Status(http.StatusAccepted)
+}
+
+// drain waits for the requests in progress, up to GOOBLA_DRAIN_TIMEOUT,
+// records the loaded models and shuts srvr down.
+func (s *Server) drain(srvr *http.Server) {
+	timeout := envconfig.DrainTimeout()
+	slog.Info("draining", "timeout", timeout)
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	select {
+	case <-s.drainer.drain():
+	case <-ctx.Done():
+		_, inflight := s.drainer.state()
+		slog.Warn("stopping with requests in progress", "requests", inflight)
+	}
+
+	if err := saveLoadedModels(s.sched); err != nil {
+		slog.Warn("couldn't record the loaded models", "error", err)
+	}
+
+	// other requests, such as pulls, have until the timeout
+	if err := srvr.Shutdown(ctx); err != nil {
+		slog.Warn("stopping with connections open", "error", err)
+	}
+}
+
+// drainSignals parses the signal names of GOOBLA_DRAIN_ON, such as SIGTERM.
+func drainSignals() ([]os.Signal, error) {
+	var signals []os.Signal
+	for _, name := range envconfig.DrainOn() {
+		switch strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "SIG") {
+		case "INT":
+			signals = append(signals, syscall.SIGINT)
+		case "TERM":
+			signals = append(signals, syscall.SIGTERM)
+		case "HUP":
+			signals = append(signals, syscall.SIGHUP)
+		case "QUIT":
+			signals = append(signals, syscall.SIGQUIT)
+		default:
+			return nil, fmt.Errorf("unsupported drain signal %q", name)
+		}
+	}
+
+	return signals, nil
+}
+
+// loadedModel is a model that was loaded when the server was drained.
+type loadedModel struct {
+	Model     string        `json:"model"`
+	KeepAlive *api.Duration `json:"keep_alive,omitempty"`
+	Preloaded bool          `json:"preloaded,omitempty"`
+}
+
+type loadedModelsFile struct {
+	Models []loadedModel `json:"models"`
+}
+
+func loadedModelsPath() (string, error) {
+	dir, err := envconfig.Models()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "loaded.json"), nil
+}
+
+// saveLoadedModels records the models loaded by sched.
+func saveLoadedModels(sched *Scheduler) error {
+	var f loadedModelsFile
+	sched.loadedMu.Lock()
+	for _, runner := range sched.loaded {
+		runner.refMu.Lock()
+		if runner.model != nil {
+			m := loadedModel{Model: runner.model.ShortName, Preloaded: runner.preloaded}
+			if !runner.preloaded {
+				m.KeepAlive = &api.Duration{Duration: runner.sessionDuration}
+			}
+			f.Models = append(f.Models, m)
+		}
+		runner.refMu.Unlock()
+	}
+	sched.loadedMu.Unlock()
+
+	if len(f.Models) == 0 {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	p, err := loadedModelsPath()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(p, b, 0o600)
+}
+
+// takeLoadedModels returns the models recorded when the server was last
+// drained, removing the record so they're only loaded again once.
+func takeLoadedModels() ([]loadedModel, error) {
+	p, err := loadedModelsPath()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := os.Remove(p); err != nil {
+		return nil, err
+	}
+
+	var f loadedModelsFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+
+	return f.Models, nil
+}
+
+// restoreModels loads the models that weren't preloaded when the server was
+// last drained, with their keep alive.
+func (s *Server) restoreModels(models []loadedModel) {
+	for _, m := range models {
+		if m.Preloaded {
+			continue
+		}
+
+		n := model.ParseName(m.Model)
+		if !n.IsValid() {
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if _, _, _, err := s.scheduleRunner(ctx, n.String(), nil, nil, m.KeepAlive, priorityNormal, ""); err != nil {
+			slog.Warn("couldn't load model loaded before restarting", "model", m.Model, "error", err)
+		}
+		cancel()
+	}
+}
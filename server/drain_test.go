@@ -0,0 +1,135 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestDrain(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := Server{drainRequests: make(chan struct{}, 1)}
+	started, finish := make(chan struct{}), make(chan struct{})
+
+	r := gin.New()
+	r.POST("/api/generate", s.drainMiddleware(), func(c *gin.Context) {
+		close(started)
+		<-finish
+	})
+	r.POST("/api/admin/drain", s.DrainHandler)
+
+	post := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, nil))
+		return w
+	}
+
+	done := make(chan int)
+	go func() { done <- post("/api/generate").Code }()
+	<-started
+
+	if w := post("/api/admin/drain"); w.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d", w.Code)
+	}
+
+	select {
+	case <-s.drainRequests:
+	default:
+		t.Fatal("expected the server to be asked to drain")
+	}
+
+	if w := post("/api/generate"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected a new request to be refused, got %d", w.Code)
+	}
+
+	idle := s.drainer.drain()
+	select {
+	case <-idle:
+		t.Fatal("expected the drain to wait for the request in progress")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(finish)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("expected the request in progress to finish, got %d", code)
+	}
+
+	select {
+	case <-idle:
+	case <-time.After(time.Second):
+		t.Fatal("expected the drain to finish")
+	}
+}
+
+func TestDrainSignals(t *testing.T) {
+	t.Setenv("GOOBLA_DRAIN_ON", "SIGTERM,hup")
+	signals, err := drainSignals()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(signals) != 2 || signals[0] != syscall.SIGTERM || signals[1] != syscall.SIGHUP {
+		t.Errorf("expected SIGTERM and SIGHUP, got %v", signals)
+	}
+
+	t.Setenv("GOOBLA_DRAIN_ON", "SIGKILL")
+	if _, err := drainSignals(); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestLoadedModels(t *testing.T) {
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	sched := InitScheduler(t.Context())
+	sched.loaded["a"] = &runnerRef{model: &Model{ShortName: "a:latest"}, sessionDuration: time.Hour}
+	sched.loaded["b"] = &runnerRef{model: &Model{ShortName: "b:latest"}, preloaded: true}
+
+	if err := saveLoadedModels(sched); err != nil {
+		t.Fatal(err)
+	}
+
+	models, err := takeLoadedModels()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(models) != 2 {
+		t.Fatalf("expected 2 models, got %d", len(models))
+	}
+
+	for _, m := range models {
+		switch m.Model {
+		case "a:latest":
+			if m.Preloaded || m.KeepAlive == nil || m.KeepAlive.Duration != time.Hour {
+				t.Errorf("expected a to be kept loaded for an hour, got %+v", m)
+			}
+		case "b:latest":
+			if !m.Preloaded || m.KeepAlive != nil {
+				t.Errorf("expected b to be preloaded, got %+v", m)
+			}
+		default:
+			t.Errorf("unexpected model %q", m.Model)
+		}
+	}
+
+	// the models are only loaded again once
+	if models, err := takeLoadedModels(); err != nil || models != nil {
+		t.Errorf("expected no models, got %v, %v", models, err)
+	}
+
+	p, err := loadedModelsPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Errorf("expected the file to be removed, got %v", err)
+	}
+}
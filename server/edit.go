@@ -0,0 +1,389 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/envconfig"
+	"github.com/goobla/goobla/fs/ggml"
+	"github.com/goobla/goobla/template"
+	"github.com/goobla/goobla/types/errtypes"
+	"github.com/goobla/goobla/types/model"
+)
+
+// Editing a model rewrites the GGUF metadata of its weights into a new layer
+// with the same tensors, to fix metadata such as a broken chat template or
+// special tokens without converting the model again. Only the metadata that
+// can be fixed without changing the tensors can be edited.
+
+var errBadMetadata = errors.New("invalid metadata")
+
+// editableMetadata are the types of the GGUF metadata that can be edited, by
+// key without the architecture prefix.
+var editableMetadata = map[string]string{
+	"tokenizer.chat_template": "string",
+
+	"context_length":                       "uint32",
+	"rope.freq_base":                       "float32",
+	"rope.freq_scale":                      "float32",
+	"rope.scaling.type":                    "string",
+	"rope.scaling.factor":                  "float32",
+	"rope.scaling.original_context_length": "uint32",
+
+	"tokenizer.ggml.bos_token_id":     "token",
+	"tokenizer.ggml.eos_token_id":     "token",
+	"tokenizer.ggml.eos_token_ids":    "tokens",
+	"tokenizer.ggml.unk_token_id":     "token",
+	"tokenizer.ggml.sep_token_id":     "token",
+	"tokenizer.ggml.pad_token_id":     "token",
+	"tokenizer.ggml.cls_token_id":     "token",
+	"tokenizer.ggml.mask_token_id":    "token",
+	"tokenizer.ggml.eot_token_id":     "token",
+	"tokenizer.ggml.eom_token_id":     "token",
+	"tokenizer.ggml.add_bos_token":    "bool",
+	"tokenizer.ggml.add_eos_token":    "bool",
+	"tokenizer.ggml.add_space_prefix": "bool",
+}
+
+// editMetadata applies the edits to kv, returning the keys that were edited.
+func editMetadata(kv ggml.KV, edits map[string]any) ([]string, error) {
+	arch := kv.Architecture()
+	vocabSize := len(kv.Strings("tokenizer.ggml.tokens"))
+
+	var keys []string
+	for _, name := range slices.Sorted(maps.Keys(edits)) {
+		v := edits[name]
+
+		// keys are accepted with or without the architecture prefix
+		name = strings.TrimPrefix(name, arch+".")
+		key := name
+		if !strings.HasPrefix(name, "general.") && !strings.HasPrefix(name, "tokenizer.") {
+			key = arch + "." + name
+		}
+
+		kind, ok := editableMetadata[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s can't be edited", errBadMetadata, key)
+		}
+
+		keys = append(keys, key)
+		if v == nil {
+			delete(kv, key)
+			continue
+		}
+
+		value, err := metadataValue(kind, v, vocabSize)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", errBadMetadata, key, err)
+		}
+		kv[key] = value
+	}
+
+	return keys, nil
+}
+
+// metadataValue converts the JSON value v to the GGUF type of kind.
+func metadataValue(kind string, v any, vocabSize int) (any, error) {
+	integer := func(v any, limit float64) (float64, error) {
+		n, ok := v.(float64)
+		if !ok || n != math.Trunc(n) || n < 0 || n > limit {
+			return 0, fmt.Errorf("expected an integer from 0 to %v, got %v", limit, v)
+		}
+		return n, nil
+	}
+
+	switch kind {
+	case "string":
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+	case "bool":
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	case "float32":
+		if n, ok := v.(float64); ok {
+			return float32(n), nil
+		}
+	case "uint32":
+		n, err := integer(v, math.MaxUint32)
+		return uint32(n), err
+	case "token":
+		n, err := integer(v, float64(vocabSize-1))
+		return uint32(n), err
+	case "tokens":
+		values, ok := v.([]any)
+		if !ok {
+			break
+		}
+
+		ids := make([]int32, len(values))
+		for i, v := range values {
+			n, err := integer(v, float64(vocabSize-1))
+			if err != nil {
+				return nil, err
+			}
+			ids[i] = int32(n)
+		}
+		return ids, nil
+	}
+
+	return nil, fmt.Errorf("expected a %s, got %v", kind, v)
+}
+
+// tensorCopy writes a tensor of the original file as it is.
+type tensorCopy struct {
+	*io.SectionReader
+	written *atomic.Int64
+	fn      func(written int64)
+}
+
+func (t tensorCopy) WriteTo(w io.Writer) (int64, error) {
+	n, err := io.Copy(w, t.SectionReader)
+	t.fn(t.written.Add(n))
+	return n, err
+}
+
+// editLayer returns a layer of the model in layer with the metadata edits.
+func editLayer(layer Layer, edits map[string]any, fn func(api.ProgressResponse)) (Layer, ggml.KV, []string, error) {
+	blob, err := GetBlobsPath(layer.Digest)
+	if err != nil {
+		return Layer{}, nil, nil, err
+	}
+
+	r, err := os.Open(blob)
+	if err != nil {
+		return Layer{}, nil, nil, err
+	}
+	defer r.Close()
+
+	f, err := ggml.Decode(r, -1)
+	if err != nil {
+		return Layer{}, nil, nil, err
+	}
+
+	kv := maps.Clone(f.KV())
+	keys, err := editMetadata(kv, edits)
+	if err != nil {
+		return Layer{}, nil, nil, err
+	}
+
+	var written atomic.Int64
+	progress := func(n int64) {
+		fn(api.ProgressResponse{Status: "rewriting metadata", Digest: layer.Digest, Total: layer.Size, Completed: n})
+	}
+
+	var ts []*ggml.Tensor
+	for _, t := range f.Tensors().Items() {
+		ts = append(ts, &ggml.Tensor{
+			Name:  t.Name,
+			Kind:  t.Kind,
+			Shape: t.Shape,
+			WriterTo: tensorCopy{
+				SectionReader: io.NewSectionReader(r, int64(f.Tensors().Offset+t.Offset), int64(t.Size())),
+				written:       &written,
+				fn:            progress,
+			},
+		})
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(blob), "edit")
+	if err != nil {
+		return Layer{}, nil, nil, err
+	}
+	defer temp.Close()
+	defer os.Remove(temp.Name())
+
+	progress(0)
+	if err := ggml.WriteGGUF(temp, kv, ts); err != nil {
+		return Layer{}, nil, nil, err
+	}
+	progress(layer.Size)
+
+	if _, err := temp.Seek(0, io.SeekStart); err != nil {
+		return Layer{}, nil, nil, err
+	}
+
+	edited, err := NewLayer(temp, layer.MediaType)
+	if err != nil {
+		return Layer{}, nil, nil, err
+	}
+	return edited, kv, keys, nil
+}
+
+// editModel writes the model of manifest m with the metadata edits as name.
+func editModel(m *Manifest, name model.Name, edits map[string]any, fn func(api.ProgressResponse)) error {
+	i := slices.IndexFunc(m.Layers, func(l Layer) bool { return l.MediaType == "application/vnd.goobla.image.model" })
+	if i < 0 {
+		return fmt.Errorf("%w: the model has no weights", errBadMetadata)
+	}
+
+	var config ConfigV2
+	if m.Config.Digest != "" {
+		p, err := GetBlobsPath(m.Config.Digest)
+		if err != nil {
+			return err
+		}
+
+		bts, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		if err := json.Unmarshal(bts, &config); err != nil {
+			return err
+		}
+	}
+
+	layer, kv, keys, err := editLayer(m.Layers[i], edits, fn)
+	if err != nil {
+		return err
+	}
+
+	layers := slices.Clone(m.Layers)
+	layers[i] = layer
+
+	for _, key := range keys {
+		switch key {
+		case kv.Architecture() + ".context_length":
+			config.ContextLength = kv.ContextLength()
+		case "tokenizer.chat_template":
+			// the template is detected from the chat template as it is when
+			// the model is created
+			if t, err := template.Named(kv.ChatTemplate()); err != nil {
+				slog.Debug("template detection", "error", err)
+				if _, err := template.Parse(kv.ChatTemplate()); err != nil {
+					slog.Debug("template detection", "error", err)
+					continue
+				}
+
+				if layers, err = setTemplate(layers, kv.ChatTemplate()); err != nil {
+					return err
+				}
+				fn(api.ProgressResponse{Status: "using the model's chat template"})
+			} else {
+				if layers, err = setTemplate(layers, string(t.Bytes)); err != nil {
+					return err
+				}
+				fn(api.ProgressResponse{Status: fmt.Sprintf("using autodetected template %s", t.Name)})
+			}
+		}
+	}
+
+	configLayer, err := createConfigLayer(layers, config)
+	if err != nil {
+		return err
+	}
+
+	fn(api.ProgressResponse{Status: "writing manifest"})
+	return WriteManifest(name, *configLayer, layers)
+}
+
+func (s *Server) EditHandler(c *gin.Context) {
+	var r api.EditRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(r.Metadata) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "metadata is required"})
+		return
+	}
+
+	name := model.ParseName(r.Model)
+	if !name.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errtypes.InvalidModelNameErrMsg})
+		return
+	}
+
+	name, err := getExistingName(name)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !checkRead(c, name) {
+		return
+	}
+
+	dst := name
+	if r.Destination != "" {
+		dst = model.ParseName(r.Destination)
+		if !dst.IsValid() {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("destination %q is invalid", r.Destination)})
+			return
+		}
+		if _, ok := lookupAlias(dst); ok {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("destination %q: %v", r.Destination, errAliasIsAlias)})
+			return
+		}
+		if dst, err = getExistingName(dst); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if !checkWrite(c, dst) {
+		return
+	}
+
+	m, err := ParseNamedManifest(name)
+	if errors.Is(err, os.ErrNotExist) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found", r.Model)})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	oldManifest, _ := ParseNamedManifest(dst)
+
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
+		fn := func(resp api.ProgressResponse) {
+			ch <- resp
+		}
+
+		if err := editModel(m, dst, r.Metadata, fn); errors.Is(err, errBadMetadata) {
+			ch <- gin.H{"error": err.Error(), "status": http.StatusBadRequest}
+			return
+		} else if err != nil {
+			ch <- gin.H{"error": err.Error()}
+			return
+		}
+
+		if !envconfig.NoPrune() && oldManifest != nil {
+			if err := oldManifest.RemoveLayers(); err != nil {
+				ch <- gin.H{"error": err.Error()}
+			}
+		}
+
+		ch <- api.ProgressResponse{Status: "success"}
+	}()
+
+	if r.Stream != nil && !*r.Stream {
+		waitForStream(c, ch)
+		return
+	}
+
+	streamResponse(c, ch)
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/fs/ggml"
+)
+
+func TestEdit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	var s Server
+
+	data := bytes.Repeat([]byte{1, 2, 3, 4}, 64)
+	_, digest := createBinFile(t, map[string]any{
+		"general.architecture":        "llama",
+		"llama.context_length":        uint32(2048),
+		"tokenizer.ggml.tokens":       []string{"<s>", "</s>", "a", "b"},
+		"tokenizer.ggml.eos_token_id": uint32(2),
+	}, []*ggml.Tensor{
+		{Name: "token_embd.weight", Kind: uint32(ggml.TensorTypeF32), Shape: []uint64{64}, WriterTo: bytes.NewReader(data)},
+	})
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:  "test",
+		Files:  map[string]string{"test.gguf": digest},
+		Stream: &stream,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body)
+	}
+
+	w = createRequest(t, s.EditHandler, api.EditRequest{
+		Model:       "test",
+		Destination: "edited",
+		Metadata: map[string]any{
+			"context_length":              8192,
+			"tokenizer.ggml.eos_token_id": 1,
+			"tokenizer.chat_template":     "{% for message in messages %}<|im_start|>{{ message['role'] }}\n{{ message['content'] }}<|im_end|>\n{% endfor %}<|im_start|>assistant\n",
+		},
+		Stream: &stream,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body)
+	}
+
+	m, err := GetModel("edited")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(m.ModelPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	g, err := ggml.Decode(f, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := g.KV().ContextLength(); n != 8192 {
+		t.Errorf("expected context length 8192, got %d", n)
+	}
+	if id := g.KV().Uint("tokenizer.ggml.eos_token_id"); id != 1 {
+		t.Errorf("expected eos token 1, got %d", id)
+	}
+	if tokens := g.KV().Strings("tokenizer.ggml.tokens"); len(tokens) != 4 {
+		t.Errorf("expected the tokens to be kept, got %v", tokens)
+	}
+
+	ts := g.Tensors()
+	if items := ts.Items(); len(items) != 1 || items[0].Name != "token_embd.weight" {
+		t.Fatalf("unexpected tensors %v", items)
+	}
+
+	b := make([]byte, len(data))
+	if _, err := f.ReadAt(b, int64(ts.Offset+ts.Items()[0].Offset)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Error("expected the tensor data to be unchanged")
+	}
+
+	if m.Template.String() == "{{ .Prompt }}" {
+		t.Error("expected the template to be detected from the chat template")
+	}
+
+	// the context length is also recorded in the model's config
+	if m.Config.ContextLength != 8192 {
+		t.Errorf("expected config context length 8192, got %d", m.Config.ContextLength)
+	}
+
+	// the original model is unchanged
+	orig, err := GetModel("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orig.ModelPath == m.ModelPath {
+		t.Error("expected the original model to be unchanged")
+	}
+
+	cases := []map[string]any{
+		{"tokenizer.ggml.tokens": []string{"a"}},
+		{"tokenizer.ggml.eos_token_id": 4},
+		{"context_length": -1},
+		{"context_length": "long"},
+		{"rope.freq_base": "high"},
+	}
+	for _, metadata := range cases {
+		w = createRequest(t, s.EditHandler, api.EditRequest{Model: "test", Metadata: metadata, Stream: &stream})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected status code 400, actual %d", metadata, w.Code)
+		}
+	}
+
+	// null removes metadata
+	w = createRequest(t, s.EditHandler, api.EditRequest{Model: "edited", Metadata: map[string]any{"llama.context_length": nil}, Stream: &stream})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body)
+	}
+
+	m, err = GetModel("edited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, err := os.Open(m.ModelPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+
+	g, err = ggml.Decode(f2, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.KV()["llama.context_length"]; ok {
+		t.Error("expected the context length to be removed")
+	}
+}
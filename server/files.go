@@ -0,0 +1,91 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// writeFileAtomic writes b to name, creating its directory if needed. It
+// writes to a temporary file in the same directory and renames it into
+// place, so readers never see a partially written file.
+func writeFileAtomic(name string, b []byte, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := f.Chmod(mode); err != nil {
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), name)
+}
+
+// cachedFile holds the parsed contents of a file until the file changes, for
+// config files that are read on every request. Its mutex must be held to use
+// it, and can also be held to serialize updates to the file.
+type cachedFile[T any] struct {
+	sync.Mutex
+	path    string
+	modTime time.Time
+	size    int64
+	value   T
+}
+
+// load returns the contents of the file p, reading and parsing them again
+// only if the file has changed since it was last read. Errors from os.Stat,
+// such as for a missing file, are returned as is.
+func (f *cachedFile[T]) load(p string, parse func(p string, b []byte) (T, error)) (T, error) {
+	var zero T
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		f.reset()
+		return zero, err
+	}
+
+	if p == f.path && fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return f.value, nil
+	}
+
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return zero, err
+	}
+
+	v, err := parse(p, b)
+	if err != nil {
+		return zero, err
+	}
+
+	f.path, f.modTime, f.size, f.value = p, fi.ModTime(), fi.Size(), v
+	return v, nil
+}
+
+// reset forgets the contents, so they're read again by the next load. The
+// file may be rewritten within the resolution of its modification time, so
+// it should be reset whenever it is written.
+func (f *cachedFile[T]) reset() {
+	var zero T
+	f.path, f.value = "", zero
+}
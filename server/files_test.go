@@ -0,0 +1,91 @@
+package server
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "dir", "file.json")
+	for _, s := range []string{"first", "second"} {
+		if err := writeFileAtomic(p, []byte(s), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != s {
+			t.Errorf("expected %q, got %q", s, b)
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 {
+		t.Errorf("expected no temporary files to be left, got %v", entries)
+	}
+}
+
+func TestCachedFile(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "file")
+
+	var reads int
+	parse := func(p string, b []byte) (string, error) {
+		reads++
+		return string(b), nil
+	}
+
+	var f cachedFile[string]
+	if _, err := f.load(p, parse); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected a missing file to be reported, got %v", err)
+	}
+
+	mtime := time.Now().Add(-time.Hour)
+	write := func(s string) {
+		t.Helper()
+		if err := os.WriteFile(p, []byte(s), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		// keep the modification time so only other changes are noticed
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	load := func(want string, wantReads int) {
+		t.Helper()
+		got, err := f.load(p, parse)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != want || reads != wantReads {
+			t.Errorf("expected %q after %d reads, got %q after %d", want, wantReads, got, reads)
+		}
+	}
+
+	write("a")
+	load("a", 1)
+	load("a", 1)
+
+	// a change in size is noticed
+	write("bb")
+	load("bb", 2)
+
+	// but not one that keeps both, until the cache is reset
+	write("cc")
+	load("bb", 2)
+	f.reset()
+	load("cc", 3)
+}
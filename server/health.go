@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/envconfig"
+)
+
+// /api/health/live and /api/health/ready are probes for orchestrators such as
+// Kubernetes. The server is live as long as it answers, so a failing liveness
+// probe means it should be restarted. It's ready when /api/health is and the
+// model store can be written to, the runners of the loaded models respond and
+// none of the GPUs it discovered has gone missing, so a failing readiness probe
+// means requests should go to other servers for now.
+
+const (
+	healthOK    = "ok"
+	healthError = "error"
+
+	// runnerPingTimeout is how long a loaded runner has to respond to the
+	// readiness check.
+	runnerPingTimeout = 5 * time.Second
+)
+
+func (s *Server) LiveHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, api.HealthResponse{Status: "alive"})
+}
+
+func (s *Server) ReadyHandler(c *gin.Context) {
+	resp := s.health()
+	resp.Checks = []api.HealthCheck{
+		healthCheck("models", checkModelStore()),
+		healthCheck("runners", s.checkRunners(c.Request.Context())),
+		healthCheck("gpus", s.checkGPUs()),
+	}
+
+	for _, check := range resp.Checks {
+		if check.Status != healthOK && resp.Status == preloadReady {
+			resp.Status = preloadError
+		}
+	}
+
+	status := http.StatusOK
+	if resp.Status != preloadReady {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, resp)
+}
+
+func healthCheck(name string, err error) api.HealthCheck {
+	if err != nil {
+		return api.HealthCheck{Name: name, Status: healthError, Error: err.Error()}
+	}
+
+	return api.HealthCheck{Name: name, Status: healthOK}
+}
+
+// checkModelStore checks that models can be written to the models directory.
+func checkModelStore() error {
+	dir, err := envconfig.Models()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, ".health-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkRunners checks that the runners of the loaded models respond. Runners
+// that are still loading aren't checked.
+func (s *Server) checkRunners(ctx context.Context) error {
+	s.sched.loadedMu.Lock()
+	runners := make([]*runnerRef, 0, len(s.sched.loaded))
+	for _, r := range s.sched.loaded {
+		if !r.loading {
+			runners = append(runners, r)
+		}
+	}
+	s.sched.loadedMu.Unlock()
+
+	var errs []error
+	for _, r := range runners {
+		ctx, cancel := context.WithTimeout(ctx, runnerPingTimeout)
+		if err := r.llama.Ping(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.model.ShortName, err))
+		}
+		cancel()
+	}
+
+	return errors.Join(errs...)
+}
+
+// checkGPUs checks that none of the GPUs the scheduler discovered is missing.
+func (s *Server) checkGPUs() error {
+	var errs []error
+	for _, d := range s.sched.deviceStatus() {
+		if d.Status != deviceAvailable {
+			errs = append(errs, fmt.Errorf("%s GPU %s is %s", d.Library, d.ID, d.Status))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+)
+
+func TestHealthProbes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	s := Server{sched: InitScheduler(t.Context())}
+	probe := func(fn gin.HandlerFunc, path string) (int, api.HealthResponse) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, path, nil)
+		fn(c)
+
+		var resp api.HealthResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, resp
+	}
+
+	failed := func(resp api.HealthResponse) []string {
+		var names []string
+		for _, check := range resp.Checks {
+			if check.Status != healthOK {
+				names = append(names, check.Name)
+			}
+		}
+		return names
+	}
+
+	if code, resp := probe(s.LiveHandler, "/api/health/live"); code != http.StatusOK || resp.Status != "alive" {
+		t.Errorf("expected the server to be live, got %d %+v", code, resp)
+	}
+
+	if code, resp := probe(s.ReadyHandler, "/api/health/ready"); code != http.StatusOK || resp.Status != preloadReady || len(resp.Checks) != 3 || failed(resp) != nil {
+		t.Errorf("expected the server to be ready, got %d %+v", code, resp)
+	}
+
+	runner := &runnerRef{model: &Model{ShortName: "test"}, llama: &mockLlm{pingResp: errors.New("connection refused")}}
+	s.sched.loaded["test"] = runner
+	s.sched.devices["cuda-0"] = &api.DeviceStatus{Library: "cuda", ID: "0", Status: deviceMissing}
+
+	code, resp := probe(s.ReadyHandler, "/api/health/ready")
+	if code != http.StatusServiceUnavailable || resp.Status != preloadError {
+		t.Errorf("expected the server not to be ready, got %d %+v", code, resp)
+	}
+
+	if names := failed(resp); len(names) != 2 || names[0] != "runners" || names[1] != "gpus" {
+		t.Errorf("expected the runners and gpus checks to fail, got %+v", resp.Checks)
+	}
+
+	// a runner that's loading isn't checked
+	runner.loading = true
+	delete(s.sched.devices, "cuda-0")
+	if code, resp := probe(s.ReadyHandler, "/api/health/ready"); code != http.StatusOK {
+		t.Errorf("expected the server to be ready, got %d %+v", code, resp)
+	}
+
+	// the server stays live while it isn't ready
+	s.drainer.draining = true
+	if code, resp := probe(s.ReadyHandler, "/api/health/ready"); code != http.StatusServiceUnavailable || resp.Status != "draining" {
+		t.Errorf("expected a draining server not to be ready, got %d %+v", code, resp)
+	}
+
+	if code, _ := probe(s.LiveHandler, "/api/health/live"); code != http.StatusOK {
+		t.Errorf("expected a draining server to be live, got %d", code)
+	}
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/envconfig"
+)
+
+// Models can be created from the safetensors weights of a Hugging Face
+// repository, named hf.co/org/repo or huggingface.co/org/repo without a tag.
+// The weights, config and tokenizer are downloaded, with HF_TOKEN if it's set
+// for gated and private repositories, and converted like safetensors files
+// sent with the request. Repositories without safetensors weights, such as
+// those of GGUF files, are pulled from the registry like other models.
+
+// huggingFaceURL is the URL of the Hugging Face Hub.
+var huggingFaceURL = "https://huggingface.co"
+
+var errNoSafetensors = errors.New("no safetensors weights")
+
+// huggingFaceRepo returns the repository, such as org/repo, of a model name
+// for a Hugging Face repository.
+func huggingFaceRepo(name string) (string, bool) {
+	host, repo, ok := strings.Cut(name, "/")
+	if !ok || !(strings.EqualFold(host, "hf.co") || strings.EqualFold(host, "huggingface.co")) {
+		return "", false
+	}
+
+	// a tag selects a GGUF file of the repository, which is pulled instead
+	org, name, ok := strings.Cut(repo, "/")
+	if !ok || org == "" || name == "" || strings.ContainsAny(name, "/:") {
+		return "", false
+	}
+	return repo, true
+}
+
+type huggingFaceFile struct {
+	Name string `json:"rfilename"`
+	LFS  *struct {
+		SHA256 string `json:"sha256"`
+		Size   int64  `json:"size"`
+	} `json:"lfs"`
+}
+
+// huggingFaceRequest makes a GET request for the path of the Hugging Face Hub.
+func huggingFaceRequest(ctx context.Context, repo, p string) (*http.Response, error) {
+	if envconfig.Offline() {
+		return nil, errOffline
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, huggingFaceURL+p, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := envconfig.HFToken(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		resp.Body.Close()
+		return nil, fmt.Errorf("access to hf.co/%s denied: set HF_TOKEN to a token with access to it", repo)
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, fmt.Errorf("hf.co/%s: %w", repo, os.ErrNotExist)
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("hf.co/%s: unexpected status %s", repo, resp.Status)
+	}
+}
+
+// huggingFaceFiles returns the files of the repository needed to convert its
+// model, or errNoSafetensors if it has no safetensors weights.
+func huggingFaceFiles(ctx context.Context, repo string) ([]huggingFaceFile, error) {
+	resp, err := huggingFaceRequest(ctx, repo, "/api/models/"+repo+"?blobs=true")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var info struct {
+		Siblings []huggingFaceFile `json:"siblings"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+
+	// the same files are converted as when creating a model from a directory
+	var files []huggingFaceFile
+	var tokenizer bool
+	for _, f := range info.Siblings {
+		if !fs.ValidPath(f.Name) {
+			continue
+		}
+
+		dir, name := path.Split(f.Name)
+		switch {
+		case dir == "" && path.Ext(name) == ".safetensors":
+		case strings.Count(f.Name, "/") <= 1 && path.Ext(name) == ".json":
+			tokenizer = tokenizer || name == "tokenizer.json"
+		default:
+			continue
+		}
+		files = append(files, f)
+	}
+
+	if !slices.ContainsFunc(files, func(f huggingFaceFile) bool { return path.Ext(f.Name) == ".safetensors" }) {
+		return nil, errNoSafetensors
+	}
+
+	// tokenizer.model is only needed without tokenizer.json
+	if !tokenizer {
+		for _, f := range info.Siblings {
+			if fs.ValidPath(f.Name) && strings.Count(f.Name, "/") <= 1 && path.Base(f.Name) == "tokenizer.model" {
+				files = append(files, f)
+			}
+		}
+	}
+
+	return files, nil
+}
+
+// downloadHuggingFaceFile downloads the file f of the repository into dir,
+// verifying its digest if it's stored with LFS.
+func downloadHuggingFaceFile(ctx context.Context, repo string, f huggingFaceFile, dir string, fn func(api.ProgressResponse)) error {
+	p := "/" + repo + "/resolve/main/"
+	for i, segment := range strings.Split(f.Name, "/") {
+		if i > 0 {
+			p += "/"
+		}
+		p += url.PathEscape(segment)
+	}
+
+	resp, err := huggingFaceRequest(ctx, repo, p)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	name := filepath.Join(dir, filepath.FromSlash(f.Name))
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+
+	w, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	status := fmt.Sprintf("downloading %s", f.Name)
+	if f.LFS == nil {
+		fn(api.ProgressResponse{Status: status})
+		_, err := io.Copy(w, resp.Body)
+		return err
+	}
+
+	// the progress of weights is reported like the layers of a pull
+	pw := &downloadProgress{
+		resp: api.ProgressResponse{Status: status, Digest: "sha256:" + f.LFS.SHA256, Total: f.LFS.Size},
+		fn:   fn,
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, h, pw), resp.Body); err != nil {
+		return err
+	}
+	pw.report()
+
+	if digest := hex.EncodeToString(h.Sum(nil)); digest != f.LFS.SHA256 {
+		return fmt.Errorf("%s: digest mismatch, expected %q, got %q", f.Name, f.LFS.SHA256, digest)
+	}
+	return nil
+}
+
+// downloadProgress reports the bytes written to it, at most every 100ms.
+type downloadProgress struct {
+	resp     api.ProgressResponse
+	fn       func(api.ProgressResponse)
+	reported time.Time
+}
+
+func (w *downloadProgress) Write(b []byte) (int, error) {
+	w.resp.Completed += int64(len(b))
+	if time.Since(w.reported) >= 100*time.Millisecond {
+		w.report()
+	}
+	return len(b), nil
+}
+
+func (w *downloadProgress) report() {
+	w.reported = time.Now()
+	w.fn(w.resp)
+}
+
+// createFromHuggingFace downloads and converts the model of the Hugging Face
+// repository, returning errNoSafetensors if it has no safetensors weights.
+func createFromHuggingFace(ctx context.Context, repo string, fn func(api.ProgressResponse)) ([]*layerGGML, error) {
+	fn(api.ProgressResponse{Status: fmt.Sprintf("fetching hf.co/%s", repo)})
+	files, err := huggingFaceFiles(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	modelsDir, err := envconfig.Models()
+	if err != nil {
+		return nil, err
+	}
+	tmpDir, err := os.MkdirTemp(modelsDir, "goobla-huggingface")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, f := range files {
+		if err := downloadHuggingFaceFile(ctx, repo, f, tmpDir, fn); err != nil {
+			return nil, err
+		}
+	}
+
+	layers, err := convertSafetensorsDir(tmpDir, nil, false, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, layer := range layers {
+		if layer.MediaType == "application/vnd.goobla.image.model" {
+			layer.From = "hf.co/" + repo
+		}
+	}
+	return layers, nil
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/goobla/goobla/api"
+)
+
+func TestHuggingFaceRepo(t *testing.T) {
+	cases := map[string]string{
+		"hf.co/org/repo":          "org/repo",
+		"huggingface.co/org/repo": "org/repo",
+		"HF.co/Org/Repo":          "Org/Repo",
+		"hf.co/org/repo:Q4_K_M":   "",
+		"hf.co/org":               "",
+		"hf.co/org/repo/file":     "",
+		"example.com/org/repo":    "",
+		"org/repo":                "",
+	}
+
+	for name, want := range cases {
+		repo, ok := huggingFaceRepo(name)
+		if repo != want || ok != (want != "") {
+			t.Errorf("%s: expected %q, got %q", name, want, repo)
+		}
+	}
+}
+
+func TestHuggingFaceFiles(t *testing.T) {
+	weights := []byte("weights")
+	sum := sha256.Sum256(weights)
+	digest := hex.EncodeToString(sum[:])
+
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		switch r.URL.Path {
+		case "/api/models/org/repo":
+			json.NewEncoder(w).Encode(map[string]any{
+				"siblings": []map[string]any{
+					{"rfilename": "README.md"},
+					{"rfilename": "config.json"},
+					{"rfilename": "model.safetensors", "lfs": map[string]any{"sha256": digest, "size": len(weights)}},
+					{"rfilename": "original/params.json"},
+					{"rfilename": "original/consolidated.safetensors"},
+					{"rfilename": "original/tokenizer.model"},
+					{"rfilename": "a/b/c.json"},
+					{"rfilename": "../escape.json"},
+				},
+			})
+		case "/api/models/org/gguf":
+			json.NewEncoder(w).Encode(map[string]any{
+				"siblings": []map[string]any{{"rfilename": "model-Q4_K_M.gguf"}},
+			})
+		case "/org/repo/resolve/main/model.safetensors":
+			w.Write(weights)
+		case "/org/repo/resolve/main/bad.safetensors":
+			w.Write([]byte("tampered"))
+		case "/api/models/org/gated":
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	t.Setenv("HF_TOKEN", "secret")
+	t.Setenv("GOOBLA_OFFLINE", "")
+	defer func(u string) { huggingFaceURL = u }(huggingFaceURL)
+	huggingFaceURL = srv.URL
+
+	files, err := huggingFaceFiles(t.Context(), "org/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	// tokenizer.model is included since there's no tokenizer.json
+	if want := []string{"config.json", "model.safetensors", "original/params.json", "original/tokenizer.model"}; !slices.Equal(names, want) {
+		t.Errorf("expected files %v, got %v", want, names)
+	}
+	if auth != "Bearer secret" {
+		t.Errorf("expected the token to be sent, got %q", auth)
+	}
+
+	// repositories without safetensors are pulled instead
+	if _, err := huggingFaceFiles(t.Context(), "org/gguf"); !errors.Is(err, errNoSafetensors) {
+		t.Errorf("expected errNoSafetensors, got %v", err)
+	}
+	if _, err := huggingFaceFiles(t.Context(), "org/missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected a missing repository to not exist, got %v", err)
+	}
+	if _, err := huggingFaceFiles(t.Context(), "org/gated"); err == nil {
+		t.Error("expected a gated repository to be denied")
+	}
+
+	dir := t.TempDir()
+	var progress []api.ProgressResponse
+	fn := func(resp api.ProgressResponse) { progress = append(progress, resp) }
+	if err := downloadHuggingFaceFile(t.Context(), "org/repo", files[1], dir, fn); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := os.ReadFile(filepath.Join(dir, "model.safetensors")); err != nil || string(b) != "weights" {
+		t.Errorf("expected the weights to be downloaded, got %q, %v", b, err)
+	}
+	if last := progress[len(progress)-1]; last.Digest != "sha256:"+digest || last.Completed != last.Total {
+		t.Errorf("expected the download to complete, got %+v", last)
+	}
+
+	bad := files[1]
+	bad.Name = "bad.safetensors"
+	if err := downloadHuggingFaceFile(t.Context(), "org/repo", bad, dir, fn); err == nil {
+		t.Error("expected a digest mismatch")
+	}
+
+	t.Setenv("GOOBLA_OFFLINE", "1")
+	if _, err := huggingFaceFiles(t.Context(), "org/repo"); !errors.Is(err, errOffline) {
+		t.Errorf("expected the request to fail offline, got %v", err)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"io"
 	"log"
 	"log/slog"
+	"maps"
 	"net"
 	"net/http"
 	"net/url"
@@ -38,8 +39,13 @@ var (
 	errCapabilityInsert     = errors.New("insert")
 	errCapabilityVision     = errors.New("vision")
 	errCapabilityEmbedding  = errors.New("embedding")
+	errCapabilityRerank     = errors.New("rerank")
 	errCapabilityThinking   = errors.New("thinking")
+	errCapabilityAudio      = errors.New("audio")
 	errInsecureProtocol     = errors.New("insecure protocol http")
+	errInvalidOptions       = errors.New("invalid options")
+	errContextOverflow      = errors.New("prompt exceeds the context length")
+	errDigestTag            = errors.New("tags of the form sha256-<hex> are reserved for digest references")
 )
 
 type registryOptions struct {
@@ -48,7 +54,19 @@ type registryOptions struct {
 	Password string
 	Token    string
 
+	// OCI selects the OCI distribution protocol, which uses standard
+	// token authentication and OCI manifest media types.
+	OCI bool
+
 	CheckRedirect func(req *http.Request, via []*http.Request) error
+
+	// limiter limits the bandwidth of blob transfers, in addition to
+	// the server wide limit
+	limiter *rateLimiter
+
+	// peer is the goobla server models are pulled from instead of their
+	// registry, if any
+	peer *url.URL
 }
 
 type Model struct {
@@ -58,7 +76,10 @@ type Model struct {
 	ModelPath      string
 	ParentModel    string
 	AdapterPaths   []string
+	AdapterNames   []string // names of the adapters, "" for those without one
 	ProjectorPaths []string
+	Draft          string // name of the draft model for speculative decoding
+	DraftPath      string
 	System         string
 	License        []string
 	Digest         string
@@ -68,6 +89,12 @@ type Model struct {
 	Template *template.Template
 }
 
+// Locked reports whether requests can't override the template and system
+// prompt of the model, because it's locked or all templates are locked.
+func (m *Model) Locked() bool {
+	return m.Config.Locked || envconfig.LockTemplates()
+}
+
 // Capabilities returns the capabilities that the model supports
 func (m *Model) Capabilities() []model.Capability {
 	capabilities := []model.Capability{}
@@ -77,8 +104,14 @@ func (m *Model) Capabilities() []model.Capability {
 	if err == nil {
 		defer f.Close()
 
-		if f.KeyValue("pooling_type").Valid() {
-			capabilities = append(capabilities, model.CapabilityEmbedding)
+		if pooling := f.KeyValue("pooling_type"); pooling.Valid() {
+			// rank pooling scores the relevance of a document to a
+			// query with a classification head instead of embedding it
+			if pooling.Uint() == poolingTypeRank {
+				capabilities = append(capabilities, model.CapabilityRerank)
+			} else {
+				capabilities = append(capabilities, model.CapabilityEmbedding)
+			}
 		} else {
 			// If no embedding is specified, we assume the model supports completion
 			capabilities = append(capabilities, model.CapabilityCompletion)
@@ -86,6 +119,9 @@ func (m *Model) Capabilities() []model.Capability {
 		if f.KeyValue("vision.block_count").Valid() {
 			capabilities = append(capabilities, model.CapabilityVision)
 		}
+		if f.KeyValue("audio.block_count").Valid() {
+			capabilities = append(capabilities, model.CapabilityAudio)
+		}
 	} else {
 		slog.Error("couldn't open model file", "error", err)
 	}
@@ -132,6 +168,8 @@ func (m *Model) CheckCapabilities(want ...model.Capability) error {
 		model.CapabilityVision:     errCapabilityVision,
 		model.CapabilityEmbedding:  errCapabilityEmbedding,
 		model.CapabilityThinking:   errCapabilityThinking,
+		model.CapabilityRerank:     errCapabilityRerank,
+		model.CapabilityAudio:      errCapabilityAudio,
 	}
 
 	for _, cap := range want {
@@ -197,6 +235,20 @@ func (m *Model) String() string {
 		})
 	}
 
+	if m.Draft != "" {
+		modelfile.Commands = append(modelfile.Commands, parser.Command{
+			Name: "draft",
+			Args: m.Draft,
+		})
+	}
+
+	if m.Config.Locked {
+		modelfile.Commands = append(modelfile.Commands, parser.Command{
+			Name: "locked",
+			Args: "true",
+		})
+	}
+
 	for k, v := range m.Options {
 		switch v := v.(type) {
 		case []any:
@@ -206,6 +258,13 @@ func (m *Model) String() string {
 					Args: fmt.Sprintf("%v", s),
 				})
 			}
+		case map[string]any:
+			for _, key := range slices.Sorted(maps.Keys(v)) {
+				modelfile.Commands = append(modelfile.Commands, parser.Command{
+					Name: k,
+					Args: fmt.Sprintf("%s:%v", key, v[key]),
+				})
+			}
 		default:
 			modelfile.Commands = append(modelfile.Commands, parser.Command{
 				Name: k,
@@ -238,19 +297,43 @@ type ConfigV2 struct {
 	ModelType     string   `json:"model_type"`
 	FileType      string   `json:"file_type"`
 
+	License        string `json:"license,omitempty"`
+	ParameterCount uint64 `json:"parameter_count,omitempty"`
+	ContextLength  uint64 `json:"context_length,omitempty"`
+	Source         string `json:"source,omitempty"`
+
+	// Locked is whether requests can't override the template and system
+	// prompt of the model
+	Locked bool `json:"locked,omitempty"`
+
 	// required by spec
 	Architecture string `json:"architecture"`
 	OS           string `json:"os"`
 	RootFS       RootFS `json:"rootfs"`
 }
 
+// Metadata returns the structured metadata of the model with config c.
+func (c ConfigV2) Metadata() api.ModelMetadata {
+	return api.ModelMetadata{
+		License:        c.License,
+		ParameterCount: c.ParameterCount,
+		ContextLength:  c.ContextLength,
+		Source:         c.Source,
+		Quantization:   c.FileType,
+	}
+}
+
 type RootFS struct {
 	Type    string   `json:"type"`
 	DiffIDs []string `json:"diff_ids"`
 }
 
 func GetManifest(mp ModelPath) (*Manifest, string, error) {
-	fp, err := mp.GetManifestPath()
+	if !mp.name().IsValid() {
+		return nil, "", os.ErrNotExist
+	}
+
+	fp, err := manifestFile(mp.name())
 	if err != nil {
 		return nil, "", err
 	}
@@ -316,6 +399,7 @@ func GetModel(name string) (*Model, error) {
 		// Deprecated in versions > 0.1.2. Embedding layers in Modelfiles are no longer supported and will be ignored.
 		case "application/vnd.goobla.image.adapter":
 			model.AdapterPaths = append(model.AdapterPaths, filename)
+			model.AdapterNames = append(model.AdapterNames, layer.Name)
 		case "application/vnd.goobla.image.projector":
 			model.ProjectorPaths = append(model.ProjectorPaths, filename)
 		case "application/vnd.goobla.image.prompt",
@@ -336,6 +420,13 @@ func GetModel(name string) (*Model, error) {
 			}
 
 			model.System = string(bts)
+		case "application/vnd.goobla.image.draft":
+			bts, err := os.ReadFile(filename)
+			if err != nil {
+				return nil, err
+			}
+
+			model.Draft = string(bts)
 		case "application/vnd.goobla.image.params":
 			params, err := os.Open(filename)
 			if err != nil {
@@ -391,7 +482,10 @@ func CopyModel(src, dst model.Name) error {
 		return err
 	}
 
-	srcpath := filepath.Join(manifests, src.Filepath())
+	srcpath, err := manifestFile(src)
+	if err != nil {
+		return err
+	}
 	srcfile, err := os.Open(srcpath)
 	if err != nil {
 		return err
@@ -425,13 +519,8 @@ func deleteUnusedLayers(deleteMap map[string]struct{}) error {
 
 	// only delete the files which are still in the deleteMap
 	for k := range deleteMap {
-		fp, err := GetBlobsPath(k)
-		if err != nil {
-			slog.Info(fmt.Sprintf("couldn't get file path for '%s': %v", k, err))
-			continue
-		}
-		if err := os.Remove(fp); err != nil {
-			slog.Info(fmt.Sprintf("couldn't remove file '%s': %v", fp, err))
+		if err := localBlobs.Delete(context.TODO(), k); err != nil {
+			slog.Info(fmt.Sprintf("couldn't remove blob '%s': %v", k, err))
 			continue
 		}
 	}
@@ -524,12 +613,32 @@ func PushModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 		return errInsecureProtocol
 	}
 
+	if mp.Digest() != "" {
+		return errors.New("cannot push a digest-pinned model, copy it to a tag first")
+	}
+
 	manifest, _, err := GetManifest(mp)
 	if err != nil {
 		fn(api.ProgressResponse{Status: "couldn't retrieve manifest"})
 		return err
 	}
 
+	if c, ok := lookupRegistryConfig(mp.Registry); ok {
+		c.apply(regOpts)
+	}
+
+	contentType := mediaTypeDockerManifest
+	if mp.IsOCI() {
+		regOpts.OCI = true
+		contentType = mediaTypeOCIManifest
+		manifest.MediaType = mediaTypeOCIManifest
+	}
+
+	// deltas refer to patches on the registry the model was pulled from
+	for i := range manifest.Layers {
+		manifest.Layers[i].Deltas = nil
+	}
+
 	var layers []Layer
 	layers = append(layers, manifest.Layers...)
 	if manifest.Config.Digest != "" {
@@ -545,7 +654,7 @@ func PushModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 
 	fn(api.ProgressResponse{Status: "pushing manifest"})
 	requestURL := mp.BaseURL()
-	requestURL = requestURL.JoinPath("v2", mp.GetNamespaceRepository(), "manifests", mp.Tag)
+	requestURL = requestURL.JoinPath("v2", mp.GetNamespaceRepository(), "manifests", mp.Reference())
 
 	manifestJSON, err := json.Marshal(manifest)
 	if err != nil {
@@ -553,13 +662,18 @@ func PushModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 	}
 
 	headers := make(http.Header)
-	headers.Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+	headers.Set("Content-Type", contentType)
 	resp, err := makeRequestWithRetry(ctx, http.MethodPut, requestURL, headers, bytes.NewReader(manifestJSON), regOpts)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(manifestJSON))
+	if err := pushSignatures(ctx, mp, manifest, digest, contentType, regOpts, fn); err != nil {
+		return err
+	}
+
 	fn(api.ProgressResponse{Status: "success"})
 
 	return nil
@@ -590,9 +704,17 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 
 	fn(api.ProgressResponse{Status: "pulling manifest"})
 
-	manifest, err = pullModelManifest(ctx, mp, regOpts)
+	// blobs are fetched from wherever the manifest was found but the
+	// manifest is always written under the requested name
+	src, manifest, regOpts, err := pullMirroredManifest(ctx, mp, regOpts)
 	if err != nil {
-		return fmt.Errorf("pull model manifest: %s", err)
+		return fmt.Errorf("pull model manifest: %w", err)
+	}
+
+	fn(api.ProgressResponse{Status: "verifying signatures"})
+	sigs, err := pullSignatures(ctx, src, manifest, regOpts)
+	if err != nil {
+		return err
 	}
 
 	var layers []Layer
@@ -601,14 +723,13 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 		layers = append(layers, manifest.Config)
 	}
 
+	if err := reserveDisk(mp.name(), layers, fn); err != nil {
+		return err
+	}
+
 	skipVerify := make(map[string]bool)
 	for _, layer := range layers {
-		cacheHit, err := downloadBlob(ctx, downloadOpts{
-			mp:      mp,
-			digest:  layer.Digest,
-			regOpts: regOpts,
-			fn:      fn,
-		})
+		cacheHit, err := pullLayer(ctx, src, layer, regOpts, fn)
 		if err != nil {
 			return err
 		}
@@ -638,11 +759,22 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 		}
 	}
 
+	var pulled []string
+	for _, layer := range layers {
+		if !skipVerify[layer.Digest] {
+			pulled = append(pulled, layer.Digest)
+		}
+	}
+	storeSharedBlobs(ctx, pulled)
+
 	fn(api.ProgressResponse{Status: "writing manifest"})
 
-	manifestJSON, err := json.Marshal(manifest)
-	if err != nil {
-		return err
+	manifestJSON := manifest.raw
+	if manifestJSON == nil {
+		manifestJSON, err = json.Marshal(manifest)
+		if err != nil {
+			return err
+		}
 	}
 
 	fp, err := mp.GetManifestPath()
@@ -659,6 +791,12 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 		return err
 	}
 
+	if len(sigs) > 0 {
+		if err := writeSignatures(manifest, sigs); err != nil {
+			return err
+		}
+	}
+
 	if !envconfig.NoPrune() && len(deleteMap) > 0 {
 		fn(api.ProgressResponse{Status: "removing unused layers"})
 		if err := deleteUnusedLayers(deleteMap); err != nil {
@@ -666,27 +804,95 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 		}
 	}
 
+	notify(webhookEvent{Event: eventModelPulled, Model: mp.name().DisplayShortest(), Digest: fmt.Sprintf("%x", sha256.Sum256(manifestJSON))})
+
 	fn(api.ProgressResponse{Status: "success"})
 
 	return nil
 }
 
+// pullMirroredManifest pulls the manifest for mp from each of its mirrors in
+// turn, returning the manifest along with the model path and registry options
+// that should be used to pull its layers. The error from the last candidate,
+// the default registry, is returned if no candidate has the manifest.
+func pullMirroredManifest(ctx context.Context, mp ModelPath, regOpts *registryOptions) (ModelPath, *Manifest, *registryOptions, error) {
+	if regOpts.peer != nil {
+		// mirrors and registry credentials don't apply to peers
+		m, err := pullModelManifest(ctx, mp, regOpts)
+		if err == nil {
+			slog.Info("pulling from peer", "model", mp.GetShortTagname(), "peer", regOpts.peer.Redacted())
+		}
+		return mp, m, regOpts, err
+	}
+
+	var err error
+	for _, src := range mp.Mirrors() {
+		// copy the options so credentials obtained from one registry
+		// are not sent to another
+		opts := new(registryOptions)
+		*opts = *regOpts
+		opts.OCI = src.IsOCI()
+		if c, ok := lookupRegistryConfig(src.Registry); ok {
+			c.apply(opts)
+		}
+
+		var m *Manifest
+		m, err = pullModelManifest(ctx, src, opts)
+		if err == nil {
+			if src.Registry != mp.Registry {
+				slog.Info("pulling from registry mirror", "model", mp.GetShortTagname(), "mirror", src.Registry)
+			}
+			return src, m, opts, nil
+		} else if ctx.Err() != nil {
+			return mp, nil, nil, err
+		}
+
+		if src.Registry != mp.Registry {
+			slog.Warn("registry mirror unavailable, trying next", "mirror", src.Registry, "error", err)
+		}
+	}
+
+	return mp, nil, nil, err
+}
+
 func pullModelManifest(ctx context.Context, mp ModelPath, regOpts *registryOptions) (*Manifest, error) {
-	requestURL := mp.BaseURL().JoinPath("v2", mp.GetNamespaceRepository(), "manifests", mp.Tag)
+	requestURL := manifestURL(mp, regOpts)
 
 	headers := make(http.Header)
-	headers.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
+	if regOpts.OCI {
+		headers.Set("Accept", strings.Join([]string{mediaTypeOCIManifest, mediaTypeDockerManifest}, ", "))
+	} else {
+		headers.Set("Accept", mediaTypeDockerManifest)
+	}
 	resp, err := makeRequestWithRetry(ctx, http.MethodGet, requestURL, headers, nil, regOpts)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
 	var m Manifest
-	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+	if err := json.Unmarshal(b, &m); err != nil {
 		return nil, err
 	}
 
+	m.digest = fmt.Sprintf("%x", sha256.Sum256(b))
+	if d := mp.Digest(); d != "" {
+		if d != "sha256:"+m.digest {
+			return nil, fmt.Errorf("%w: manifest for %s has digest sha256:%s", errDigestMismatch, d, m.digest)
+		}
+		// keep the registry's bytes so the local manifest has the pinned digest
+		m.raw = b
+	}
+
+	if m.MediaType == mediaTypeOCIIndex {
+		return nil, fmt.Errorf("%w: image indexes are not supported, pull a specific manifest instead", errUnsupportedManifest)
+	}
+
 	return &m, err
 }
 
@@ -701,7 +907,10 @@ func GetSHA256Digest(r io.Reader) (string, int64) {
 	return fmt.Sprintf("sha256:%x", h.Sum(nil)), n
 }
 
-var errUnauthorized = errors.New("unauthorized: access denied")
+var (
+	errUnauthorized        = errors.New("unauthorized: access denied")
+	errUnsupportedManifest = errors.New("unsupported manifest")
+)
 
 func makeRequestWithRetry(ctx context.Context, method string, requestURL *url.URL, headers http.Header, body io.ReadSeeker, regOpts *registryOptions) (*http.Response, error) {
 	for range 2 {
@@ -720,7 +929,7 @@ func makeRequestWithRetry(ctx context.Context, method string, requestURL *url.UR
 
 			// Handle authentication error with one retry
 			challenge := parseRegistryChallenge(resp.Header.Get("www-authenticate"))
-			token, err := getAuthorizationToken(ctx, challenge)
+			token, err := getRegistryToken(ctx, challenge, regOpts)
 			if err != nil {
 				return nil, err
 			}
@@ -765,6 +974,10 @@ func makeRequestWithRetry(ctx context.Context, method string, requestURL *url.UR
 var testMakeRequestDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
 
 func makeRequest(ctx context.Context, method string, requestURL *url.URL, headers http.Header, body io.Reader, regOpts *registryOptions) (*http.Response, error) {
+	if envconfig.Offline() {
+		return nil, errOffline
+	}
+
 	if requestURL.Scheme != "http" && regOpts != nil && regOpts.Insecure {
 		requestURL.Scheme = "http"
 	}
@@ -797,13 +1010,14 @@ func makeRequest(ctx context.Context, method string, requestURL *url.URL, header
 		req.ContentLength = contentLength
 	}
 
+	tr, err := registryTransport(requestURL.Host)
+	if err != nil {
+		return nil, err
+	}
+
 	c := &http.Client{
 		CheckRedirect: regOpts.CheckRedirect,
-	}
-	if testMakeRequestDialContext != nil {
-		tr := http.DefaultTransport.(*http.Transport).Clone()
-		tr.DialContext = testMakeRequestDialContext
-		c.Transport = tr
+		Transport:     tr,
 	}
 	return c.Do(req)
 }
@@ -844,12 +1058,7 @@ func parseRegistryChallenge(authStr string) registryChallenge {
 var errDigestMismatch = errors.New("digest mismatch, file must be downloaded again")
 
 func verifyBlob(digest string) error {
-	fp, err := GetBlobsPath(digest)
-	if err != nil {
-		return err
-	}
-
-	f, err := os.Open(fp)
+	f, err := localBlobs.Open(context.TODO(), digest)
 	if err != nil {
 		return err
 	}
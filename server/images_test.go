@@ -1,8 +1,21 @@
 package server
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/goobla/goobla/api"
 
 	"github.com/goobla/goobla/fs/ggml"
 	"github.com/goobla/goobla/template"
@@ -27,6 +40,12 @@ func TestModelCapabilities(t *testing.T) {
 		"bert.pooling_type":    uint32(1),
 	}, []*ggml.Tensor{})
 
+	// Create rerank model (bert architecture with rank pooling)
+	rerankModelPath, _ := createBinFile(t, ggml.KV{
+		"general.architecture": "bert",
+		"bert.pooling_type":    uint32(poolingTypeRank),
+	}, []*ggml.Tensor{})
+
 	toolsInsertTemplate, err := template.Parse("{{ .prompt }}{{ if .tools }}{{ .tools }}{{ end }}{{ if .suffix }}{{ .suffix }}{{ end }}")
 	if err != nil {
 		t.Fatalf("Failed to parse template: %v", err)
@@ -96,6 +115,14 @@ func TestModelCapabilities(t *testing.T) {
 			},
 			expectedCaps: []model.Capability{model.CapabilityEmbedding},
 		},
+		{
+			name: "model with rerank capability",
+			model: Model{
+				ModelPath: rerankModelPath,
+				Template:  chatTemplate,
+			},
+			expectedCaps: []model.Capability{model.CapabilityRerank},
+		},
 	}
 
 	// compare two slices of model.Capability regardless of order
@@ -253,3 +280,120 @@ func TestModelCheckCapabilities(t *testing.T) {
 		})
 	}
 }
+
+func TestPullModelOCI(t *testing.T) {
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	blob := []byte("model weights")
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(blob))
+	manifest, err := json.Marshal(Manifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeOCIManifest,
+		Layers:        []Layer{{MediaType: "application/vnd.goobla.image.model", Digest: digest, Size: int64(len(blob))}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			io.WriteString(w, `{"token":"secret"}`) //nolint:errcheck
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+srv.URL+`/token",service="test",scope="repository:ns/repo:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/v2/ns/repo/manifests/tag":
+			if !strings.Contains(r.Header.Get("Accept"), mediaTypeOCIManifest) {
+				t.Errorf("Accept = %q, want %q", r.Header.Get("Accept"), mediaTypeOCIManifest)
+			}
+			w.Header().Set("Content-Type", mediaTypeOCIManifest)
+			w.Write(manifest) //nolint:errcheck
+		case "/v2/ns/repo/blobs/" + digest:
+			// serve the blob directly rather than redirecting
+			w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+			if r.Method == http.MethodHead {
+				return
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	name := "oci://" + srv.Listener.Addr().String() + "/ns/repo:tag"
+	if err := PullModel(t.Context(), name, &registryOptions{Insecure: true}, func(api.ProgressResponse) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := GetBlobsPath(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != string(blob) {
+		t.Errorf("blob = %q, want %q", got, blob)
+	}
+
+	if _, _, err := GetManifest(ParseModelPath(name)); err != nil {
+		t.Errorf("manifest not written: %v", err)
+	}
+}
+
+func TestPullModelDigest(t *testing.T) {
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	blob := []byte("model weights")
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(blob))
+	// registries may serve manifests that do not round trip through Manifest
+	manifest := []byte(fmt.Sprintf(`{"schemaVersion":2, "layers":[{"mediaType":"application/vnd.goobla.image.model","digest":%q,"size":%d}]}`, digest, len(blob)))
+	manifestDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(manifest))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/ns/repo/manifests/" + manifestDigest, "/v2/ns/repo/manifests/" + digest:
+			w.Write(manifest) //nolint:errcheck
+		case "/v2/ns/repo/blobs/" + digest:
+			w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+			if r.Method == http.MethodHead {
+				return
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	name := "http://" + srv.Listener.Addr().String() + "/ns/repo@" + manifestDigest
+	if err := PullModel(t.Context(), name, &registryOptions{Insecure: true}, func(api.ProgressResponse) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := ParseNamedManifest(model.ParseName(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := "sha256:" + m.digest; got != manifestDigest {
+		t.Errorf("manifest digest = %q, want %q", got, manifestDigest)
+	}
+
+	// the registry serves the same manifest for a different digest
+	name = "http://" + srv.Listener.Addr().String() + "/ns/repo@" + digest
+	if err := PullModel(t.Context(), name, &registryOptions{Insecure: true}, func(api.ProgressResponse) {}); !errors.Is(err, errDigestMismatch) {
+		t.Errorf("err = %v, want %v", err, errDigestMismatch)
+	}
+}
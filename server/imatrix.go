@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// importanceMatrix is the importance of each column of the tensors of a
+// model, keyed by tensor name, as computed by llama-imatrix from calibration
+// data. Quantizing with it keeps the columns that matter most for the data
+// more accurate.
+type importanceMatrix struct {
+	Tensors map[string][]float32
+	// Chunks is the number of chunks of calibration data it was computed
+	// from, and Dataset the name of the data, if they're known.
+	Chunks  int32
+	Dataset string
+}
+
+var errBadImportanceMatrix = errors.New("invalid importance matrix")
+
+// readImportanceMatrix reads an importance matrix in the format written by
+// llama-imatrix: the number of entries, each a name, the number of times it
+// was accumulated and its values, optionally followed by the number of
+// chunks and the name of the dataset.
+func readImportanceMatrix(r io.Reader) (*importanceMatrix, error) {
+	read := func(v any) error {
+		if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+			return fmt.Errorf("%w: %w", errBadImportanceMatrix, err)
+		}
+		return nil
+	}
+
+	readString := func() (string, error) {
+		var n int32
+		if err := read(&n); err != nil {
+			return "", err
+		}
+		if n < 0 || n > 1<<16 {
+			return "", fmt.Errorf("%w: name length %d", errBadImportanceMatrix, n)
+		}
+
+		b := make([]byte, n)
+		if err := read(b); err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+
+	var n int32
+	if err := read(&n); err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return nil, fmt.Errorf("%w: %d entries", errBadImportanceMatrix, n)
+	}
+
+	m := importanceMatrix{Tensors: make(map[string][]float32, n)}
+	for range n {
+		name, err := readString()
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			return nil, fmt.Errorf("%w: unnamed entry", errBadImportanceMatrix)
+		}
+
+		var calls, size int32
+		if err := read(&calls); err != nil {
+			return nil, err
+		}
+		if err := read(&size); err != nil {
+			return nil, err
+		}
+		if size <= 0 || size > 1<<26 {
+			return nil, fmt.Errorf("%w: %s has %d values", errBadImportanceMatrix, name, size)
+		}
+
+		values := make([]float32, size)
+		if err := read(values); err != nil {
+			return nil, err
+		}
+
+		// the values are sums over the calls
+		if calls > 0 {
+			for i := range values {
+				values[i] /= float32(calls)
+			}
+		}
+		m.Tensors[name] = values
+	}
+
+	// the chunks and dataset are only written by newer versions
+	if err := binary.Read(r, binary.LittleEndian, &m.Chunks); errors.Is(err, io.EOF) {
+		return &m, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: %w", errBadImportanceMatrix, err)
+	}
+
+	dataset, err := readString()
+	if err != nil {
+		return nil, err
+	}
+	m.Dataset = dataset
+	return &m, nil
+}
+
+// importanceMatrixFromBlob reads the importance matrix in the blob digest.
+func importanceMatrixFromBlob(digest string) (*importanceMatrix, error) {
+	f, err := localBlobs.Open(context.TODO(), digest)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return readImportanceMatrix(f)
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"maps"
+	"os"
+	"slices"
+	"testing"
+
+	fsggml "github.com/goobla/goobla/fs/ggml"
+)
+
+// writeImportanceMatrix writes tensors in the format of llama-imatrix, as
+// accumulated over calls, followed by the number of chunks and the dataset
+// if dataset isn't empty.
+func writeImportanceMatrix(t *testing.T, tensors map[string][]float32, calls int32, dataset string) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	write := func(v any) {
+		if err := binary.Write(&b, binary.LittleEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(int32(len(tensors)))
+	for _, name := range slices.Sorted(maps.Keys(tensors)) {
+		write(int32(len(name)))
+		write([]byte(name))
+		write(calls)
+		write(int32(len(tensors[name])))
+		values := slices.Clone(tensors[name])
+		for i := range values {
+			values[i] *= float32(calls)
+		}
+		write(values)
+	}
+
+	if dataset != "" {
+		write(int32(10))
+		write(int32(len(dataset)))
+		write([]byte(dataset))
+	}
+	return b.Bytes()
+}
+
+func TestReadImportanceMatrix(t *testing.T) {
+	tensors := map[string][]float32{
+		"blk.0.attn_q.weight": {1, 2, 3, 4},
+		"output.weight":       {0.5, 0.25},
+	}
+
+	m, err := readImportanceMatrix(bytes.NewReader(writeImportanceMatrix(t, tensors, 4, "wiki.train.raw")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range tensors {
+		if !slices.Equal(m.Tensors[name], values) {
+			t.Errorf("%s: expected %v, got %v", name, values, m.Tensors[name])
+		}
+	}
+	if m.Chunks != 10 || m.Dataset != "wiki.train.raw" {
+		t.Errorf("unexpected chunks %d and dataset %q", m.Chunks, m.Dataset)
+	}
+
+	// older versions don't write the chunks and dataset
+	m, err = readImportanceMatrix(bytes.NewReader(writeImportanceMatrix(t, tensors, 1, "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Tensors) != 2 || m.Chunks != 0 || m.Dataset != "" {
+		t.Errorf("unexpected importance matrix %+v", m)
+	}
+
+	b := writeImportanceMatrix(t, tensors, 1, "")
+	for _, bad := range [][]byte{nil, {0, 0, 0, 0}, b[:len(b)-1]} {
+		if _, err := readImportanceMatrix(bytes.NewReader(bad)); !errors.Is(err, errBadImportanceMatrix) {
+			t.Errorf("expected errBadImportanceMatrix, got %v", err)
+		}
+	}
+}
+
+func TestQuantizeImportanceMatrix(t *testing.T) {
+	data := bytes.Repeat(quantBytes[fsggml.TensorTypeF16], 4)
+	p, _ := createBinFile(t, map[string]any{"general.architecture": "foo"}, []*fsggml.Tensor{
+		{Name: "blk.0.attn_q.weight", Kind: uint32(fsggml.TensorTypeF16), Shape: []uint64{256, 4}, WriterTo: bytes.NewReader(data)},
+	})
+
+	quantizeWith := func(imatrix *importanceMatrix) (*fsggml.GGML, error) {
+		in, err := os.Open(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer in.Close()
+
+		orig, err := fsggml.Decode(in, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out, err := os.CreateTemp(t.TempDir(), "quantized")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer out.Close()
+
+		if err := quantize(in, out, orig, fsggml.FileTypeQ4_K_M, imatrix, func(uint64) {}); err != nil {
+			return nil, err
+		}
+
+		if _, err := out.Seek(0, 0); err != nil {
+			t.Fatal(err)
+		}
+		return fsggml.Decode(out, -1)
+	}
+
+	importance := make([]float32, 256)
+	for i := range importance {
+		importance[i] = float32(i + 1)
+	}
+
+	f, err := quantizeWith(&importanceMatrix{
+		Tensors: map[string][]float32{"blk.0.attn_q.weight": importance},
+		Chunks:  10,
+		Dataset: "wiki.train.raw",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind := fsggml.TensorType(f.Tensors().Items()[0].Kind); kind != fsggml.TensorTypeQ4_K {
+		t.Errorf("expected Q4_K, got %s", kind)
+	}
+	if n := f.KV()["quantize.imatrix.entries_count"]; n != uint32(1) {
+		t.Errorf("expected 1 importance matrix entry, got %v", n)
+	}
+	if dataset := f.KV()["quantize.imatrix.dataset"]; dataset != "wiki.train.raw" {
+		t.Errorf("expected the dataset to be recorded, got %v", dataset)
+	}
+
+	// an importance matrix for a different model can't be used
+	if _, err := quantizeWith(&importanceMatrix{
+		Tensors: map[string][]float32{"blk.0.attn_q.weight": importance[:128]},
+	}); !errors.Is(err, errBadImportanceMatrix) {
+		t.Errorf("expected errBadImportanceMatrix, got %v", err)
+	}
+}
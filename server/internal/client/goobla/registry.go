@@ -11,7 +11,6 @@ import (
 	"crypto"
 	"crypto/ed25519"
 	"crypto/sha256"
-	"crypto/tls"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
@@ -74,7 +73,12 @@ const (
 )
 
 var defaultCache = sync.OnceValues(func() (*blob.DiskCache, error) {
-	dir := os.Getenv("GOOBLA_MODELS")
+	// models are only written to the last of a list of directories
+	dirs := filepath.SplitList(os.Getenv("GOOBLA_MODELS"))
+	dir := ""
+	if len(dirs) > 0 {
+		dir = dirs[len(dirs)-1]
+	}
 	if dir == "" {
 		home, _ := os.UserHomeDir()
 		home = cmp.Or(home, ".")
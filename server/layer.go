@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"crypto/sha256"
 	"errors"
 	"fmt"
@@ -9,10 +10,12 @@ import (
 )
 
 type Layer struct {
-	MediaType string `json:"mediaType"`
-	Digest    string `json:"digest"`
-	Size      int64  `json:"size"`
-	From      string `json:"from,omitempty"`
+	MediaType string  `json:"mediaType"`
+	Digest    string  `json:"digest"`
+	Size      int64   `json:"size"`
+	From      string  `json:"from,omitempty"`
+	Name      string  `json:"name,omitempty"` // name of an adapter, which requests select it by
+	Deltas    []Delta `json:"deltas,omitempty"`
 	status    string
 }
 
@@ -69,12 +72,7 @@ func NewLayerFromLayer(digest, mediatype, from string) (Layer, error) {
 		return Layer{}, errors.New("creating new layer from layer with empty digest")
 	}
 
-	blob, err := GetBlobsPath(digest)
-	if err != nil {
-		return Layer{}, err
-	}
-
-	fi, err := os.Stat(blob)
+	size, err := localBlobs.Stat(context.TODO(), digest)
 	if err != nil {
 		return Layer{}, err
 	}
@@ -82,7 +80,7 @@ func NewLayerFromLayer(digest, mediatype, from string) (Layer, error) {
 	return Layer{
 		MediaType: mediatype,
 		Digest:    digest,
-		Size:      fi.Size(),
+		Size:      size,
 		From:      from,
 		status:    fmt.Sprintf("using existing layer %s", digest),
 	}, nil
@@ -121,10 +119,5 @@ func (l *Layer) Remove() error {
 		}
 	}
 
-	blob, err := GetBlobsPath(l.Digest)
-	if err != nil {
-		return err
-	}
-
-	return os.Remove(blob)
+	return localBlobs.Delete(context.TODO(), l.Digest)
 }
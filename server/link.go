@@ -0,0 +1,81 @@
+package server
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// linkBlob makes the file at src available as the blob with digest without
+// copying its contents where possible. It tries a reflink, which shares
+// storage copy-on-write on filesystems that support it, and falls back to a
+// copy. It returns the method that was used. Files aren't hardlinked, since
+// changes to the file would then change the blob.
+//
+// The linked file is verified against digest before it is moved into place
+// so a partially linked or modified blob is never visible.
+func linkBlob(src, digest string) (string, error) {
+	dst, err := GetBlobsPath(digest)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(src); err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+"-partial-*")
+	if err != nil {
+		return "", err
+	}
+	tmp := f.Name()
+	f.Close()
+	defer os.Remove(tmp)
+
+	method := "reflink"
+	if err := reflink(src, tmp); err != nil {
+		if !errors.Is(err, errors.ErrUnsupported) {
+			slog.Debug("reflink failed", "src", src, "error", err)
+		}
+
+		method = "copy"
+		if err := copyFile(src, tmp); err != nil {
+			return "", err
+		}
+	}
+
+	if err := verifyFile(tmp, digest); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(tmp, dst); err != nil {
+		return "", err
+	}
+
+	return method, nil
+}
+
+// verifyFile checks that the sha256 digest of the file at p matches digest.
+func verifyFile(p, digest string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	if got := fmt.Sprintf("sha256:%x", h.Sum(nil)); got != strings.Replace(digest, "-", ":", 1) {
+		return fmt.Errorf("%w: expected %q, got %q", errDigestMismatch, digest, got)
+	}
+
+	return nil
+}
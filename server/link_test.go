@@ -0,0 +1,174 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/fs/ggml"
+)
+
+func TestLinkBlob(t *testing.T) {
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	blob, digest := testBlob("model weights")
+	src := filepath.Join(t.TempDir(), "model.gguf")
+	require.NoError(t, os.WriteFile(src, blob, 0o644))
+
+	_, otherDigest := testBlob("other weights")
+	_, err := linkBlob(src, otherDigest)
+	require.ErrorIs(t, err, errDigestMismatch)
+
+	p, err := GetBlobsPath(otherDigest)
+	require.NoError(t, err)
+	_, err = os.Stat(p)
+	require.ErrorIs(t, err, os.ErrNotExist, "mismatched blob must not be visible")
+
+	method, err := linkBlob(src, digest)
+	require.NoError(t, err)
+	assert.Contains(t, []string{"reflink", "copy"}, method)
+
+	p, err = GetBlobsPath(digest)
+	require.NoError(t, err)
+	got, err := os.ReadFile(p)
+	require.NoError(t, err)
+	assert.Equal(t, blob, got)
+
+	entries, err := os.ReadDir(filepath.Dir(p))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "temporary files must be removed")
+
+	// the blob doesn't change with the file it was made from
+	f, err := os.OpenFile(src, os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("M"), 0)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	got, err = os.ReadFile(p)
+	require.NoError(t, err)
+	assert.Equal(t, blob, got)
+	require.NoError(t, verifyFile(p, digest))
+}
+
+func TestLinkBlobConcurrent(t *testing.T) {
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	blob, digest := testBlob("model weights")
+	src := filepath.Join(t.TempDir(), "model.gguf")
+	require.NoError(t, os.WriteFile(src, blob, 0o644))
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = linkBlob(src, digest)
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	p, err := GetBlobsPath(digest)
+	require.NoError(t, err)
+	require.NoError(t, verifyFile(p, digest))
+
+	entries, err := os.ReadDir(filepath.Dir(p))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "temporary files must be removed")
+}
+
+func TestLinkBlobHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	blob, digest := testBlob("model weights")
+	src := filepath.Join(t.TempDir(), "model.gguf")
+	require.NoError(t, os.WriteFile(src, blob, 0o644))
+
+	var s Server
+	r := gin.New()
+	r.POST("/api/blobs/:digest/link", s.LinkBlobHandler)
+
+	link := func(remoteAddr, path string) *httptest.ResponseRecorder {
+		b, err := json.Marshal(api.LinkBlobRequest{Path: path})
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodPost, "/api/blobs/"+digest+"/link", bytes.NewReader(b))
+		req.RemoteAddr = remoteAddr
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := link("192.0.2.1:1234", src)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = link("127.0.0.1:1234", "model.gguf")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = link("127.0.0.1:1234", filepath.Join(t.TempDir(), "missing.gguf"))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = link("[::1]:1234", src)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var resp api.LinkBlobResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.NotEqual(t, "existing", resp.Method)
+
+	w = link("127.0.0.1:1234", src)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, "existing", resp.Method)
+}
+
+func TestListSharedLayers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	var s Server
+	_, digest := createBinFile(t, ggml.KV{"general.architecture": "test"}, nil)
+	for _, name := range []string{"a", "b"} {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model: name,
+			Files: map[string]string{"model.gguf": digest},
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	w := createRequest(t, s.CopyHandler, api.CopyRequest{Source: "a", Destination: "c"})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = createRequest(t, s.ListHandler, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp api.ListResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	require.Len(t, resp.Models, 3)
+	require.NotNil(t, resp.Storage)
+
+	var size int64
+	for _, m := range resp.Models {
+		assert.Positive(t, m.SharedSize, m.Name)
+		size += m.Size
+	}
+
+	assert.Equal(t, size, resp.Storage.Size)
+	assert.Less(t, resp.Storage.UniqueSize, resp.Storage.Size)
+}
@@ -0,0 +1,24 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+)
+
+// maxTopLogprobs is the most alternatives that can be returned for each
+// token, as in the OpenAI API.
+const maxTopLogprobs = 20
+
+// checkLogprobs returns an error if top isn't a number of alternatives that
+// can be returned, or is set without logprobs.
+func checkLogprobs(logprobs bool, top int) error {
+	if top < 0 || top > maxTopLogprobs {
+		return fmt.Errorf("top_logprobs must be between 0 and %d", maxTopLogprobs)
+	}
+
+	if top > 0 && !logprobs {
+		return errors.New("top_logprobs requires logprobs")
+	}
+
+	return nil
+}
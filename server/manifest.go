@@ -16,6 +16,18 @@ import (
 	"github.com/goobla/goobla/types/model"
 )
 
+// Manifest media types understood by the registry clients. The OCI types are
+// only used with registries that speak the OCI distribution protocol.
+const (
+	mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex       = "application/vnd.oci.image.index.v1+json"
+)
+
+// errReadOnlyModel is returned when removing a model from a read-only models
+// directory.
+var errReadOnlyModel = errors.New("model is in a read-only models directory")
+
 type Manifest struct {
 	SchemaVersion int     `json:"schemaVersion"`
 	MediaType     string  `json:"mediaType"`
@@ -25,6 +37,10 @@ type Manifest struct {
 	filepath string
 	fi       os.FileInfo
 	digest   string
+
+	// raw holds the manifest as served by the registry for digest-pinned
+	// pulls, which must be stored byte for byte
+	raw []byte
 }
 
 func (m *Manifest) Size() (size int64) {
@@ -36,6 +52,10 @@ func (m *Manifest) Size() (size int64) {
 }
 
 func (m *Manifest) Remove() error {
+	if inReadOnlyModelsDir(m.filepath) {
+		return errReadOnlyModel
+	}
+
 	if err := os.Remove(m.filepath); err != nil {
 		return err
 	}
@@ -67,13 +87,11 @@ func ParseNamedManifest(n model.Name) (*Manifest, error) {
 		return nil, model.Unqualified(n)
 	}
 
-	manifests, err := GetManifestPath()
+	p, err := manifestFile(n)
 	if err != nil {
 		return nil, err
 	}
 
-	p := filepath.Join(manifests, n.Filepath())
-
 	var m Manifest
 	f, err := os.Open(p)
 	if err != nil {
@@ -117,7 +135,7 @@ func WriteManifest(name model.Name, config Layer, layers []Layer) error {
 
 	m := Manifest{
 		SchemaVersion: 2,
-		MediaType:     "application/vnd.docker.distribution.manifest.v2+json",
+		MediaType:     mediaTypeDockerManifest,
 		Config:        config,
 		Layers:        layers,
 	}
@@ -133,7 +151,6 @@ func Manifests(continueOnError bool) (map[model.Name]*Manifest, error) {
 
 	ms := make(map[model.Name]*Manifest)
 
-	fsys := os.DirFS(manifests)
 	walkFn := func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			if continueOnError {
@@ -163,6 +180,11 @@ func Manifests(continueOnError bool) (map[model.Name]*Manifest, error) {
 			return fmt.Errorf("%s %w", path, err)
 		}
 
+		if _, ok := ms[n]; ok {
+			// shadowed by a model in a directory searched earlier
+			return nil
+		}
+
 		m, err := ParseNamedManifest(n)
 		if err != nil {
 			if continueOnError {
@@ -176,9 +198,18 @@ func Manifests(continueOnError bool) (map[model.Name]*Manifest, error) {
 		return nil
 	}
 
-	if err := fs.WalkDir(fsys, ".", walkFn); err != nil {
+	if err := fs.WalkDir(os.DirFS(manifests), ".", walkFn); err != nil {
 		return nil, err
 	}
 
+	for _, dir := range readOnlyModelsDirs() {
+		err := fs.WalkDir(os.DirFS(filepath.Join(dir, "manifests")), ".", walkFn)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
 	return ms, nil
 }
@@ -2,6 +2,7 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"os"
 	"path/filepath"
 	"slices"
@@ -154,3 +155,70 @@ func TestManifests(t *testing.T) {
 		})
 	}
 }
+
+func TestReadOnlyModelsDirs(t *testing.T) {
+	ro, rw := t.TempDir(), t.TempDir()
+	t.Setenv("GOOBLA_MODELS", ro+string(filepath.ListSeparator)+rw)
+
+	blob, digest := testBlob("bundled weights")
+	roBlob := filepath.Join(ro, "blobs", digest[7:9], "sha256-"+digest[7:])
+	if err := os.MkdirAll(filepath.Dir(roBlob), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(roBlob, blob, 0o444); err != nil {
+		t.Fatal(err)
+	}
+
+	name := model.ParseName("bundled")
+	p := filepath.Join(ro, "manifests", name.Filepath())
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(Manifest{SchemaVersion: 2, Layers: []Layer{{Digest: digest, Size: int64(len(blob))}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, b, 0o444); err != nil {
+		t.Fatal(err)
+	}
+
+	ms, err := Manifests(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, ok := ms[name]
+	if !ok {
+		t.Fatalf("expected %s in %v", name, ms)
+	}
+
+	if got, err := GetBlobsPath(digest); err != nil {
+		t.Fatal(err)
+	} else if got != roBlob {
+		t.Errorf("expected blob in the read-only directory %q, got %q", roBlob, got)
+	}
+
+	if err := m.Remove(); !errors.Is(err, errReadOnlyModel) {
+		t.Errorf("expected %v, got %v", errReadOnlyModel, err)
+	}
+
+	// an unreferenced blob in a read-only directory is left alone
+	if err := os.Remove(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RemoveLayers(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(roBlob); err != nil {
+		t.Fatal(err)
+	}
+
+	// new models are written to the writable directory
+	if err := WriteManifest(name, Layer{}, m.Layers); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(rw, "manifests", name.Filepath())); err != nil {
+		t.Fatal(err)
+	}
+}
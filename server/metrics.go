@@ -0,0 +1,374 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/envconfig"
+	"github.com/goobla/goobla/llm"
+	"github.com/goobla/goobla/types/model"
+)
+
+// Metrics are served at /metrics in the Prometheus text format when
+// GOOBLA_METRICS is set. Counters and histograms are updated as requests are
+// handled; gauges are read from the scheduler and the blob store on each
+// scrape.
+
+var errMetricsDisabled = errors.New("metrics are disabled, set GOOBLA_METRICS=1 to enable them")
+
+var (
+	durationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+	rateBuckets     = []float64{1, 2.5, 5, 10, 20, 30, 50, 75, 100, 150, 200, 500}
+)
+
+var (
+	requestsTotal = newCounter("goobla_requests_total",
+		"Number of HTTP requests handled.", "method", "path", "status")
+	requestDuration = newHistogram("goobla_request_duration_seconds",
+		"Time taken to handle HTTP requests, including streaming the response.", durationBuckets, "method", "path")
+	timeToFirstToken = newHistogram("goobla_time_to_first_token_seconds",
+		"Time from receiving a generate or chat request to its first token, including loading the model.", durationBuckets, "model")
+	tokensPerSecond = newHistogram("goobla_eval_tokens_per_second",
+		"Rate tokens were generated at by each completed generate or chat request.", rateBuckets, "model")
+	promptTokensTotal = newCounter("goobla_prompt_tokens_total",
+		"Number of prompt tokens evaluated.", "model")
+	generatedTokensTotal = newCounter("goobla_generated_tokens_total",
+		"Number of tokens generated.", "model")
+	cachedPromptTokensTotal = newCounter("goobla_prompt_cached_tokens_total",
+		"Number of prompt tokens found in the cache rather than evaluated.", "model")
+	rateLimitedTotal = newCounter("goobla_rate_limited_requests_total",
+		"Number of requests refused for being over a rate limit.", "limit")
+)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeSample writes a sample of metric name with the given labels, which
+// alternate between names and values.
+func writeSample(w io.Writer, name string, value float64, labels ...string) {
+	var b strings.Builder
+	b.WriteString(name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i == 0 {
+			b.WriteByte('{')
+		} else {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+	}
+	if len(labels) > 1 {
+		b.WriteByte('}')
+	}
+
+	fmt.Fprintf(w, "%s %s\n", b.String(), formatMetricValue(value))
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// pairLabels interleaves label names with their values.
+func pairLabels(names, values []string) []string {
+	labels := make([]string, 0, 2*len(names))
+	for i, name := range names {
+		labels = append(labels, name, values[i])
+	}
+	return labels
+}
+
+// seriesKey identifies the series with the given label values.
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+type counterSeries struct {
+	values []string
+	value  float64
+}
+
+// counter is a Prometheus counter with a series for each set of label values.
+type counter struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+	return &counter{name: name, help: help, labels: labels, series: make(map[string]*counterSeries)}
+}
+
+func (c *counter) add(v float64, values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := seriesKey(values)
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{values: values}
+		c.series[key] = s
+	}
+	s.value += v
+}
+
+func (c *counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeHeader(w, c.name, "counter", c.help)
+	for _, key := range slices.Sorted(maps.Keys(c.series)) {
+		s := c.series[key]
+		writeSample(w, c.name, s.value, pairLabels(c.labels, s.values)...)
+	}
+}
+
+type histogramSeries struct {
+	values []string
+	// counts holds the number of observations in each bucket, with the last
+	// for those above the largest bound
+	counts []uint64
+	sum    float64
+}
+
+// histogram is a Prometheus histogram with a series for each set of label
+// values.
+type histogram struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogram {
+	return &histogram{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+func (h *histogram) observe(v float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := seriesKey(values)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{values: values, counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+
+	i, _ := slices.BinarySearch(h.buckets, v)
+	s.counts[i]++
+	s.sum += v
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.name, "histogram", h.help)
+	for _, key := range slices.Sorted(maps.Keys(h.series)) {
+		s := h.series[key]
+		labels := pairLabels(h.labels, s.values)
+
+		var count uint64
+		for i, n := range s.counts {
+			count += n
+
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			writeSample(w, h.name+"_bucket", float64(count), append(slices.Clone(labels), "le", formatMetricValue(le))...)
+		}
+
+		writeSample(w, h.name+"_sum", s.sum, labels...)
+		writeSample(w, h.name+"_count", float64(count), labels...)
+	}
+}
+
+// metricsMiddleware counts requests and how long they took by route.
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !envconfig.Metrics() {
+			c.Next()
+			return
+		}
+
+		start := time.Now()
+		c.Next()
+
+		// label by route rather than URL so unmatched paths don't create
+		// a series each
+		path := c.FullPath()
+		if path == "" {
+			path = "unmatched"
+		}
+
+		requestsTotal.add(1, c.Request.Method, path, strconv.Itoa(c.Writer.Status()))
+		requestDuration.observe(time.Since(start).Seconds(), c.Request.Method, path)
+	}
+}
+
+// metricsModel returns the label for the model named n. Models in a user's
+// namespace share one label so their names aren't exposed to scrapers.
+func metricsModel(n model.Name) string {
+	if envconfig.MultiUser() && isUser(n.Namespace) {
+		return "private"
+	}
+
+	return n.DisplayShortest()
+}
+
+// completionMetrics records the metrics of a generate or chat request.
+type completionMetrics struct {
+	model string
+	start time.Time
+	first bool
+}
+
+func newCompletionMetrics(m *Model, start time.Time) *completionMetrics {
+	return &completionMetrics{model: metricsModel(model.ParseName(m.Name)), start: start}
+}
+
+// observe records the response cr of the completion.
+func (m *completionMetrics) observe(cr llm.CompletionResponse) {
+	if !envconfig.Metrics() {
+		return
+	}
+
+	if !m.first && (cr.Content != "" || cr.Done) {
+		m.first = true
+		timeToFirstToken.observe(time.Since(m.start).Seconds(), m.model)
+	}
+
+	if cr.Done {
+		promptTokensTotal.add(float64(cr.PromptEvalCount), m.model)
+		cachedPromptTokensTotal.add(float64(cr.PromptCachedCount), m.model)
+		generatedTokensTotal.add(float64(cr.EvalCount), m.model)
+		if cr.EvalDuration > 0 {
+			tokensPerSecond.observe(float64(cr.EvalCount)/cr.EvalDuration.Seconds(), m.model)
+		}
+	}
+}
+
+// writeSchedulerMetrics writes the queue depth, loaded models and VRAM used
+// by each GPU.
+func (s *Server) writeSchedulerMetrics(w io.Writer) {
+	var queued, loaded int
+	type gpuKey struct{ id, library string }
+	vram := make(map[gpuKey]uint64)
+
+	if s.sched != nil {
+		queued = s.sched.queued()
+
+		s.sched.loadedMu.Lock()
+		loaded = len(s.sched.loaded)
+		for _, r := range s.sched.loaded {
+			if r.llama == nil {
+				continue
+			}
+
+			for _, g := range r.gpus {
+				if g.Library == "cpu" {
+					continue
+				}
+				vram[gpuKey{g.ID, g.Library}] += r.llama.EstimatedVRAMByGPU(g.ID)
+			}
+		}
+		s.sched.loadedMu.Unlock()
+	}
+
+	writeHeader(w, "goobla_queued_requests", "gauge", "Number of requests waiting for a model to be scheduled.")
+	writeSample(w, "goobla_queued_requests", float64(queued))
+
+	writeHeader(w, "goobla_loaded_models", "gauge", "Number of models loaded.")
+	writeSample(w, "goobla_loaded_models", float64(loaded))
+
+	writeHeader(w, "goobla_gpu_vram_used_bytes", "gauge", "VRAM used by loaded models on each GPU.")
+	keys := slices.SortedFunc(maps.Keys(vram), func(a, b gpuKey) int {
+		return strings.Compare(a.library+a.id, b.library+b.id)
+	})
+	for _, k := range keys {
+		writeSample(w, "goobla_gpu_vram_used_bytes", float64(vram[k]), "gpu", k.id, "library", k.library)
+	}
+}
+
+// writeBlobMetrics writes the size of the blob store.
+func writeBlobMetrics(w io.Writer) error {
+	p, err := GetBlobsPath("")
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	if err := filepath.WalkDir(p, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.Type().IsRegular() {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += fi.Size()
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	writeHeader(w, "goobla_blob_store_bytes", "gauge", "Size of the blobs in the model store.")
+	writeSample(w, "goobla_blob_store_bytes", float64(size))
+	return nil
+}
+
+func (s *Server) MetricsHandler(c *gin.Context) {
+	if !envconfig.Metrics() {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": errMetricsDisabled.Error()})
+		return
+	}
+
+	var b bytes.Buffer
+	for _, m := range []interface{ write(io.Writer) }{
+		requestsTotal, requestDuration, timeToFirstToken, tokensPerSecond, promptTokensTotal, generatedTokensTotal,
+		cachedPromptTokensTotal, rateLimitedTotal,
+	} {
+		m.write(&b)
+	}
+
+	s.writeSchedulerMetrics(&b)
+
+	if err := writeBlobMetrics(&b); err != nil {
+		slog.Warn("couldn't measure blob store", "error", err)
+	}
+
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", b.Bytes())
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goobla/goobla/llm"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram("test_seconds", "A test histogram.", []float64{1, 5}, "model")
+	h.observe(0.5, "a")
+	h.observe(1, "a")
+	h.observe(3, "a")
+	h.observe(10, "a")
+	h.observe(2, `b"\`)
+
+	var b strings.Builder
+	h.write(&b)
+	assert.Equal(t, `# HELP test_seconds A test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{model="a",le="1"} 2
+test_seconds_bucket{model="a",le="5"} 3
+test_seconds_bucket{model="a",le="+Inf"} 4
+test_seconds_sum{model="a"} 14.5
+test_seconds_count{model="a"} 4
+test_seconds_bucket{model="b\"\\",le="1"} 0
+test_seconds_bucket{model="b\"\\",le="5"} 1
+test_seconds_bucket{model="b\"\\",le="+Inf"} 1
+test_seconds_sum{model="b\"\\"} 2
+test_seconds_count{model="b\"\\"} 1
+`, b.String())
+}
+
+func TestMetricsHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+	t.Setenv("GOOBLA_METRICS", "1")
+
+	scrape := func(r *gin.Engine) string {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+		return w.Body.String()
+	}
+
+	var s Server
+	r := gin.New()
+	r.Use(metricsMiddleware())
+	r.GET("/metrics", s.MetricsHandler)
+	r.GET("/api/tags", s.ListHandler)
+
+	for range 2 {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/tags", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/missing/abc123", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	blob, digest := testBlob("0123456789")
+	p, err := GetBlobsPath(digest)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(p, blob, 0o644))
+
+	metrics := newCompletionMetrics(&Model{Name: "registry.goobla.ai/library/metrics-test:latest"}, time.Now().Add(-2*time.Second))
+	metrics.observe(llm.CompletionResponse{Content: "hello"})
+	metrics.observe(llm.CompletionResponse{Content: " world"})
+	metrics.observe(llm.CompletionResponse{Done: true, PromptEvalCount: 7, PromptCachedCount: 5, EvalCount: 40, EvalDuration: 2 * time.Second})
+
+	body := scrape(r)
+	assert.Contains(t, body, `goobla_requests_total{method="GET",path="/api/tags",status="200"} 2`+"\n")
+	assert.Contains(t, body, `goobla_requests_total{method="GET",path="unmatched",status="404"} 1`+"\n")
+	assert.Contains(t, body, `goobla_request_duration_seconds_count{method="GET",path="/api/tags"} 2`+"\n")
+	assert.Contains(t, body, `goobla_time_to_first_token_seconds_bucket{model="metrics-test:latest",le="1"} 0`+"\n")
+	assert.Contains(t, body, `goobla_time_to_first_token_seconds_count{model="metrics-test:latest"} 1`+"\n")
+	assert.Contains(t, body, `goobla_eval_tokens_per_second_bucket{model="metrics-test:latest",le="20"} 1`+"\n")
+	assert.Contains(t, body, `goobla_eval_tokens_per_second_sum{model="metrics-test:latest"} 20`+"\n")
+	assert.Contains(t, body, `goobla_prompt_tokens_total{model="metrics-test:latest"} 7`+"\n")
+	assert.Contains(t, body, `goobla_generated_tokens_total{model="metrics-test:latest"} 40`+"\n")
+	assert.Contains(t, body, `goobla_prompt_cached_tokens_total{model="metrics-test:latest"} 5`+"\n")
+	assert.Contains(t, body, "goobla_queued_requests 0\n")
+	assert.Contains(t, body, "goobla_loaded_models 0\n")
+	assert.Contains(t, body, "# TYPE goobla_gpu_vram_used_bytes gauge\n")
+	assert.Contains(t, body, "goobla_blob_store_bytes 10\n")
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Setenv("GOOBLA_METRICS", "")
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps n bytes of f from off into memory read-only, so they can be
+// read as a slice without reading them into memory up front.
+func mapFile(f *os.File, off, n int64) ([]byte, func() error, error) {
+	if n == 0 {
+		return nil, func() error { return nil }, nil
+	}
+
+	// the offset of a mapping must be a multiple of the page size
+	start := off &^ int64(os.Getpagesize()-1)
+	b, err := syscall.Mmap(int(f.Fd()), start, int(off-start+n), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, &os.PathError{Op: "mmap", Path: f.Name(), Err: err}
+	}
+
+	return b[off-start:], func() error { return syscall.Munmap(b) }, nil
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// mapFile maps n bytes of f from off into memory read-only, so they can be
+// read as a slice without reading them into memory up front.
+func mapFile(f *os.File, off, n int64) ([]byte, func() error, error) {
+	if n == 0 {
+		return nil, func() error { return nil }, nil
+	}
+
+	end := off + n
+	h, err := windows.CreateFileMapping(windows.Handle(f.Fd()), nil, windows.PAGE_READONLY, uint32(end>>32), uint32(end), nil)
+	if err != nil {
+		return nil, nil, &os.PathError{Op: "CreateFileMapping", Path: f.Name(), Err: err}
+	}
+	defer windows.CloseHandle(h) //nolint:errcheck
+
+	// the offset of a view must be a multiple of the allocation granularity
+	start := off &^ (1<<16 - 1)
+	addr, err := windows.MapViewOfFile(h, windows.FILE_MAP_READ, uint32(start>>32), uint32(start), uintptr(end-start))
+	if err != nil {
+		return nil, nil, &os.PathError{Op: "MapViewOfFile", Path: f.Name(), Err: err}
+	}
+
+	b := unsafe.Slice((*byte)(*(*unsafe.Pointer)(unsafe.Pointer(&addr))), end-start)
+	return b[off-start:], func() error { return windows.UnmapViewOfFile(addr) }, nil
+}
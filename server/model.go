@@ -10,6 +10,7 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/goobla/goobla/api"
 	"github.com/goobla/goobla/fs/ggml"
@@ -41,10 +42,12 @@ func parseFromModel(ctx context.Context, name model.Name, fn func(api.ProgressRe
 	}
 
 	for _, layer := range m.Layers {
+		adapter := layer.Name
 		layer, err := NewLayerFromLayer(layer.Digest, layer.MediaType, name.DisplayShortest())
 		if err != nil {
 			return nil, err
 		}
+		layer.Name = adapter
 
 		switch layer.MediaType {
 		case "application/vnd.goobla.image.model",
@@ -80,6 +83,21 @@ func detectChatTemplate(layers []*layerGGML) ([]*layerGGML, error) {
 		if s := layer.GGML.KV().ChatTemplate(); s != "" {
 			if t, err := template.Named(s); err != nil {
 				slog.Debug("template detection", "error", err, "template", s)
+
+				// chat templates without a named equivalent are rendered
+				// as they are
+				if _, err := template.Parse(s); err != nil {
+					slog.Debug("template detection", "error", err)
+					continue
+				}
+
+				layer, err := NewLayer(strings.NewReader(s), "application/vnd.goobla.image.template")
+				if err != nil {
+					return nil, err
+				}
+
+				layer.status = "using the model's chat template"
+				layers = append(layers, &layerGGML{layer, nil})
 			} else {
 				layer, err := NewLayer(t.Reader(), "application/vnd.goobla.image.template")
 				if err != nil {
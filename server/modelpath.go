@@ -1,6 +1,7 @@
 package server
 
 import (
+	"cmp"
 	"errors"
 	"fmt"
 	"io/fs"
@@ -8,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
 
 	"github.com/goobla/goobla/envconfig"
@@ -27,6 +29,10 @@ const (
 	DefaultNamespace      = "library"
 	DefaultTag            = "latest"
 	DefaultProtocolScheme = "https"
+
+	// OCIProtocolScheme selects the OCI distribution protocol for a
+	// registry. Requests are made over https.
+	OCIProtocolScheme = "oci"
 )
 
 var (
@@ -52,6 +58,8 @@ func ParseModelPath(name string) ModelPath {
 		name = after
 	}
 
+	name, digest, pinned := strings.Cut(name, "@")
+
 	name = strings.ReplaceAll(name, string(os.PathSeparator), "/")
 	parts := strings.Split(name, "/")
 	switch len(parts) {
@@ -71,9 +79,44 @@ func ParseModelPath(name string) ModelPath {
 		mp.Tag = tag
 	}
 
+	// digest-pinned paths are stored under a tag derived from the digest,
+	// see [model.ParseName]
+	if pinned {
+		mp.Tag = strings.Replace(digest, ":", "-", 1)
+	}
+
+	// aliases are replaced with the model they refer to
+	if target, ok := lookupAlias(mp.name()); ok {
+		mp.Registry = target.Host
+		mp.Namespace = target.Namespace
+		mp.Repository = target.Model
+		mp.Tag = target.Tag
+	}
+
 	return mp
 }
 
+func (mp ModelPath) name() model.Name {
+	return model.Name{
+		Host:      mp.Registry,
+		Namespace: mp.Namespace,
+		Model:     mp.Repository,
+		Tag:       mp.Tag,
+	}
+}
+
+// Digest returns the manifest digest mp is pinned to, in the form
+// "sha256:<hex>", or the empty string if mp refers to a tag.
+func (mp ModelPath) Digest() string {
+	return model.Name{Tag: mp.Tag}.Digest()
+}
+
+// Reference returns the reference used to address the manifest for mp in a
+// registry: the digest for digest-pinned paths, otherwise the tag.
+func (mp ModelPath) Reference() string {
+	return cmp.Or(mp.Digest(), mp.Tag)
+}
+
 func (mp ModelPath) GetNamespaceRepository() string {
 	return fmt.Sprintf("%s/%s", mp.Namespace, mp.Repository)
 }
@@ -94,12 +137,7 @@ func (mp ModelPath) GetShortTagname() string {
 
 // GetManifestPath returns the path to the manifest file for the given model path, it is up to the caller to create the directory if it does not exist.
 func (mp ModelPath) GetManifestPath() (string, error) {
-	name := model.Name{
-		Host:      mp.Registry,
-		Namespace: mp.Namespace,
-		Model:     mp.Repository,
-		Tag:       mp.Tag,
-	}
+	name := mp.name()
 	if !name.IsValid() {
 		return "", fs.ErrNotExist
 	}
@@ -111,12 +149,119 @@ func (mp ModelPath) GetManifestPath() (string, error) {
 }
 
 func (mp ModelPath) BaseURL() *url.URL {
+	scheme := mp.ProtocolScheme
+	if scheme == DefaultProtocolScheme {
+		if c, ok := lookupRegistryConfig(mp.Registry); ok && c.Scheme != "" {
+			scheme = c.Scheme
+		}
+	}
+
+	if scheme == OCIProtocolScheme {
+		scheme = "https"
+	}
+
 	return &url.URL{
-		Scheme: mp.ProtocolScheme,
+		Scheme: scheme,
 		Host:   mp.Registry,
 	}
 }
 
+// IsOCI reports whether the registry for mp uses the OCI distribution
+// protocol, either because it was requested with the oci:// scheme or because
+// the registry is listed in GOOBLA_OCI_REGISTRIES or configured with the oci
+// scheme in the registries config file.
+func (mp ModelPath) IsOCI() bool {
+	if mp.ProtocolScheme == OCIProtocolScheme || slices.Contains(envconfig.OCIRegistries(), mp.Registry) {
+		return true
+	}
+
+	c, ok := lookupRegistryConfig(mp.Registry)
+	return ok && c.Scheme == OCIProtocolScheme
+}
+
+// schemeName returns the short name of n, prefixed with the oci:// scheme if
+// raw, the name as given by the user, requested the OCI distribution protocol.
+// Other schemes are dropped in favor of the insecure flag.
+func schemeName(raw string, n model.Name) string {
+	if strings.HasPrefix(raw, OCIProtocolScheme+"://") {
+		return OCIProtocolScheme + "://" + n.DisplayShortest()
+	}
+
+	return n.DisplayShortest()
+}
+
+// Mirrors returns the model path rewritten for each registry mirror configured
+// via GOOBLA_REGISTRY_MIRRORS in priority order, followed by mp itself. Mirrors
+// only apply to models from the default registry.
+func (mp ModelPath) Mirrors() []ModelPath {
+	if mp.Registry != DefaultRegistry {
+		return []ModelPath{mp}
+	}
+
+	var mps []ModelPath
+	for _, m := range envconfig.RegistryMirrors() {
+		mirror := mp
+		if scheme, host, found := strings.Cut(m, "://"); found {
+			mirror.ProtocolScheme = scheme
+			m = host
+		}
+		mirror.Registry = strings.TrimSuffix(m, "/")
+		mps = append(mps, mirror)
+	}
+
+	return append(mps, mp)
+}
+
+// readOnlyModelsDirs returns the models directories other than the writable
+// one, in the order they are searched for models missing from it.
+func readOnlyModelsDirs() []string {
+	dirs, _ := envconfig.ModelsDirs()
+	return dirs[:len(dirs)-1]
+}
+
+// inReadOnlyModelsDir reports whether p is in one of the read-only models
+// directories rather than the writable one.
+func inReadOnlyModelsDir(p string) bool {
+	if len(readOnlyModelsDirs()) == 0 {
+		return false
+	}
+
+	mdir, err := envconfig.Models()
+	if err != nil {
+		return false
+	}
+
+	rel, err := filepath.Rel(mdir, p)
+	return err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// manifestFile returns the path to the manifest for n. It is in the writable
+// models directory unless the model only exists in a read-only one.
+func manifestFile(n model.Name) (string, error) {
+	manifests, err := GetManifestPath()
+	if err != nil {
+		return "", err
+	}
+
+	p := filepath.Join(manifests, n.Filepath())
+	if _, err := os.Stat(p); err == nil {
+		return p, nil
+	}
+
+	for _, dir := range readOnlyModelsDirs() {
+		if ro := filepath.Join(dir, "manifests", n.Filepath()); fileExists(ro) {
+			return ro, nil
+		}
+	}
+
+	return p, nil
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
 func GetManifestPath() (string, error) {
 	mdir, err := envconfig.Models()
 	if err != nil {
@@ -131,6 +276,27 @@ func GetManifestPath() (string, error) {
 }
 
 func GetBlobsPath(digest string) (string, error) {
+	path, err := lookupBlobPath(digest)
+	if err != nil {
+		return "", err
+	}
+
+	dir := path
+	if digest != "" {
+		dir = filepath.Dir(path)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("%w: ensure path elements are traversable", err)
+	}
+
+	return path, nil
+}
+
+// lookupBlobPath returns the path of the blob with digest, or of the blobs
+// directory if digest is empty, like GetBlobsPath but without creating any
+// directories.
+func lookupBlobPath(digest string) (string, error) {
 	// only accept actual sha256 digests
 	pattern := "^sha256[:-][0-9a-fA-F]{64}$"
 	re := regexp.MustCompile(pattern)
@@ -145,23 +311,26 @@ func GetBlobsPath(digest string) (string, error) {
 		return "", err
 	}
 	if digest == "" {
-		path := filepath.Join(mdir, "blobs")
-		if err := os.MkdirAll(path, 0o755); err != nil {
-			return "", fmt.Errorf("%w: ensure path elements are traversable", err)
-		}
-		return path, nil
+		return filepath.Join(mdir, "blobs"), nil
 	}
 
 	hex := strings.TrimPrefix(digest, "sha256-")
 	path := filepath.Join(mdir, "blobs", hex[:2], digest)
-	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
-		return "", fmt.Errorf("%w: ensure path elements are traversable", err)
-	}
 
 	old := filepath.Join(mdir, "blobs", digest)
 	if _, err := os.Stat(old); err == nil {
 		return old, nil
 	}
 
+	if !fileExists(path) {
+		for _, dir := range readOnlyModelsDirs() {
+			for _, ro := range []string{filepath.Join(dir, "blobs", hex[:2], digest), filepath.Join(dir, "blobs", digest)} {
+				if fileExists(ro) {
+					return ro, nil
+				}
+			}
+		}
+	}
+
 	return path, nil
 }
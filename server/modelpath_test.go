@@ -1,11 +1,19 @@
 package server
 
 import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/goobla/goobla/types/model"
 )
 
 func TestGetBlobsPath(t *testing.T) {
@@ -95,6 +103,17 @@ func TestParseModelPath(t *testing.T) {
 				Tag:            "tag",
 			},
 		},
+		{
+			"oci protocol",
+			"oci://ghcr.io/ns/repo:tag",
+			ModelPath{
+				ProtocolScheme: "oci",
+				Registry:       "ghcr.io",
+				Namespace:      "ns",
+				Repository:     "repo",
+				Tag:            "tag",
+			},
+		},
 		{
 			"no protocol",
 			"example.com/ns/repo:tag",
@@ -128,6 +147,17 @@ func TestParseModelPath(t *testing.T) {
 				Tag:            "tag",
 			},
 		},
+		{
+			"digest",
+			"ns/repo@sha256:456402914e838a953e0cf80caa6adbe75383d9e63584a964f504a7bbb8f7aad9",
+			ModelPath{
+				ProtocolScheme: "https",
+				Registry:       DefaultRegistry,
+				Namespace:      "ns",
+				Repository:     "repo",
+				Tag:            "sha256-456402914e838a953e0cf80caa6adbe75383d9e63584a964f504a7bbb8f7aad9",
+			},
+		},
 		{
 			"no tag",
 			"repo",
@@ -151,3 +181,110 @@ func TestParseModelPath(t *testing.T) {
 		})
 	}
 }
+
+func TestModelPathMirrors(t *testing.T) {
+	t.Setenv("GOOBLA_REGISTRY_MIRRORS", "mirror.example.com, http://10.0.0.2:5000/")
+
+	got := ParseModelPath("library/repo:tag").Mirrors()
+	want := []ModelPath{
+		{ProtocolScheme: "https", Registry: "mirror.example.com", Namespace: "library", Repository: "repo", Tag: "tag"},
+		{ProtocolScheme: "http", Registry: "10.0.0.2:5000", Namespace: "library", Repository: "repo", Tag: "tag"},
+		{ProtocolScheme: "https", Registry: DefaultRegistry, Namespace: "library", Repository: "repo", Tag: "tag"},
+	}
+	assert.Equal(t, want, got)
+
+	// mirrors do not apply to other registries
+	got = ParseModelPath("example.com/ns/repo:tag").Mirrors()
+	assert.Equal(t, []ModelPath{{ProtocolScheme: "https", Registry: "example.com", Namespace: "ns", Repository: "repo", Tag: "tag"}}, got)
+}
+
+func TestPullMirroredManifest(t *testing.T) {
+	const manifest = `{"schemaVersion":2,"layers":[{"digest":"sha256:aaaa"}]}`
+
+	serve := func(ok bool) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !ok || !strings.HasSuffix(r.URL.Path, "/manifests/tag") {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			io.WriteString(w, manifest) //nolint:errcheck
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+
+	upstream := serve(true)
+	testMakeRequestDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if strings.HasPrefix(addr, DefaultRegistry+":") {
+			addr = upstream.Listener.Addr().String()
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+	t.Cleanup(func() { testMakeRequestDialContext = nil })
+
+	cases := []struct {
+		name string
+		ok   []bool
+		want int // index of the expected source, len(ok) for the default registry
+	}{
+		{"no mirrors", nil, 0},
+		{"first mirror", []bool{true, true}, 0},
+		{"second mirror", []bool{false, true}, 1},
+		{"fallback", []bool{false, false}, 2},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var mirrors []string
+			for _, ok := range tt.ok {
+				mirrors = append(mirrors, "http://"+serve(ok).Listener.Addr().String())
+			}
+			t.Setenv("GOOBLA_REGISTRY_MIRRORS", strings.Join(mirrors, ","))
+
+			mp := ParseModelPath("library/repo:tag")
+			src, m, _, err := pullMirroredManifest(t.Context(), mp, &registryOptions{Insecure: true})
+			require.NoError(t, err)
+			require.Len(t, m.Layers, 1)
+			assert.Equal(t, mp.Mirrors()[tt.want], src)
+		})
+	}
+}
+
+func TestModelPathOCI(t *testing.T) {
+	t.Setenv("GOOBLA_OCI_REGISTRIES", "harbor.example.com")
+
+	cases := []struct {
+		name    string
+		oci     bool
+		baseURL string
+	}{
+		{"oci://ghcr.io/ns/repo:tag", true, "https://ghcr.io"},
+		{"harbor.example.com/ns/repo:tag", true, "https://harbor.example.com"},
+		{"example.com/ns/repo:tag", false, "https://example.com"},
+		{"repo:tag", false, "https://" + DefaultRegistry},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			mp := ParseModelPath(tt.name)
+			assert.Equal(t, tt.oci, mp.IsOCI())
+			assert.Equal(t, tt.baseURL, mp.BaseURL().String())
+		})
+	}
+}
+
+func TestSchemeName(t *testing.T) {
+	cases := map[string]string{
+		"oci://ghcr.io/ns/repo:tag": "oci://ghcr.io/ns/repo:tag",
+		"https://ghcr.io/ns/repo":   "ghcr.io/ns/repo:latest",
+		"ghcr.io/ns/repo:tag":       "ghcr.io/ns/repo:tag",
+		"repo":                      "repo:latest",
+	}
+
+	for raw, want := range cases {
+		t.Run(raw, func(t *testing.T) {
+			assert.Equal(t, want, schemeName(raw, model.ParseName(raw)))
+		})
+	}
+}
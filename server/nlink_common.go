@@ -0,0 +1,17 @@
+//go:build !windows
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+// linkCount returns the number of hardlinks to the file described by fi.
+func linkCount(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink) //nolint:unconvert // Nlink is not uint64 on all platforms
+	}
+
+	return 1
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/envconfig"
+)
+
+// When GOOBLA_OFFLINE is set, the server doesn't connect to the network at
+// all: registries aren't used to pull, push or check models for updates,
+// the http_fetch tool doesn't fetch URLs, webhooks aren't sent, traces
+// aren't exported, OIDC signing keys aren't fetched and S3 blob stores
+// can't be reached. GOOBLA_ROUTE_TO can't be used, as router mode only
+// forwards requests to other servers.
+
+var errOffline = errors.New("goobla is offline: unset GOOBLA_OFFLINE to connect to the network")
+
+// checkOnline aborts the request with errOffline if the server is offline,
+// reporting whether it can go on.
+func checkOnline(c *gin.Context) bool {
+	if envconfig.Offline() {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": errOffline.Error()})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+
+	"github.com/goobla/goobla/api"
+)
+
+func TestOffline(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+	t.Setenv("GOOBLA_OFFLINE", "1")
+
+	var s Server
+	for _, tt := range []struct {
+		handler gin.HandlerFunc
+		method  string
+		path    string
+		body    string
+	}{
+		{s.PullHandler, http.MethodPost, "/api/pull", `{"model":"test"}`},
+		{s.PushHandler, http.MethodPost, "/api/push", `{"model":"test"}`},
+		{s.UpdatesHandler, http.MethodGet, "/api/updates", ""},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			tt.handler(c)
+
+			var resp struct {
+				Error string `json:"error"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if w.Code != http.StatusServiceUnavailable || resp.Error != errOffline.Error() {
+				t.Errorf("expected the request to fail offline, got %d %q", w.Code, resp.Error)
+			}
+		})
+	}
+
+	// the registry isn't connected to for other requests, such as creating a
+	// model from a registry model
+	var requested bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := makeRequest(t.Context(), http.MethodGet, u, nil, nil, &registryOptions{}); !errors.Is(err, errOffline) {
+		t.Errorf("expected the request to fail offline, got %v", err)
+	}
+
+	if _, err := runHTTPFetch(t.Context(), api.ToolCallFunctionArguments{"url": srv.URL}); !errors.Is(err, errOffline) {
+		t.Errorf("expected the fetch to fail offline, got %v", err)
+	}
+
+	if err := getJSON(t.Context(), srv.URL, &struct{}{}); !errors.Is(err, errOffline) {
+		t.Errorf("expected fetching OIDC keys to fail offline, got %v", err)
+	}
+
+	bs, err := NewBlobStore("s3://bucket/models?endpoint=" + url.QueryEscape(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := bs.Stat(t.Context(), "sha256:"+strings.Repeat("0", 64)); !errors.Is(err, errOffline) {
+		t.Errorf("expected the S3 blob store to fail offline, got %v", err)
+	}
+
+	t.Setenv("GOOBLA_OTEL_ENDPOINT", srv.URL)
+	provider := otel.GetTracerProvider()
+	stop, err := setupTracing(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop()
+
+	if otel.GetTracerProvider() != provider {
+		t.Error("expected traces not to be exported offline")
+	}
+
+	if _, err := newRouter([]string{srv.URL}); !errors.Is(err, errOffline) {
+		t.Errorf("expected router mode to be refused offline, got %v", err)
+	}
+
+	if requested {
+		t.Error("expected no requests to be made offline")
+	}
+}
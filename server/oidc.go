@@ -0,0 +1,450 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/envconfig"
+)
+
+// With GOOBLA_OIDC_ISSUER set, requests can be made with a JWT issued by that
+// OpenID Connect provider for GOOBLA_OIDC_AUDIENCE, sent like an API key. The
+// provider's signing keys are found through its discovery document and
+// refreshed periodically, or sooner when a token is signed by a key that
+// isn't known yet.
+//
+// The token's scopes, from its GOOBLA_OIDC_SCOPES_CLAIM claim, are those of
+// API keys and limit the requests it can make the same way. Its user, from
+// its GOOBLA_OIDC_USER_CLAIM claim, owns the namespace with their name as in
+// multi-user mode, unless the token has the admin scope.
+
+var errInvalidToken = errors.New("invalid token")
+
+const (
+	// oidcKeysRefresh is how often the provider's signing keys are refreshed.
+	oidcKeysRefresh = time.Hour
+
+	// oidcKeysMinRefresh is how often the provider's signing keys may be
+	// refreshed for tokens signed by unknown keys.
+	oidcKeysMinRefresh = time.Minute
+
+	// oidcLeeway is how far the times of a token may be from the server's
+	// clock.
+	oidcLeeway = time.Minute
+)
+
+// oidcKeys are the signing keys of the provider, by key id, cached until
+// they're refreshed or the issuer changes.
+var oidcKeys struct {
+	mu      sync.Mutex
+	issuer  string
+	fetched time.Time
+	keys    map[string]crypto.PublicKey
+}
+
+// oidcClaims are the claims of a token.
+type oidcClaims struct {
+	user   string
+	scopes []string
+}
+
+// isJWT reports whether token looks like a JWT rather than an API key.
+func isJWT(token string) bool {
+	return !strings.HasPrefix(token, apiKeyPrefix) && strings.Count(token, ".") == 2
+}
+
+// oidcEnabled reports whether requests can be made with OIDC tokens.
+func oidcEnabled() bool {
+	return envconfig.OIDCIssuer() != ""
+}
+
+// jwk is a JSON web key of the provider's key set.
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+
+	// RSA keys
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// EC and OKP keys
+	X string `json:"x"`
+	Y string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		if !e.IsInt64() {
+			return nil, errors.New("invalid RSA exponent")
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid EC key")
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func getJSON(ctx context.Context, url string, v any) error {
+	if envconfig.Offline() {
+		return errOffline
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// fetchOIDCKeys fetches the signing keys of the provider issuer.
+func fetchOIDCKeys(ctx context.Context, issuer string) (map[string]crypto.PublicKey, error) {
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := getJSON(ctx, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+
+	if discovery.Issuer != issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q", discovery.Issuer)
+	}
+
+	if discovery.JWKSURI == "" {
+		return nil, errors.New("discovery document has no jwks_uri")
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := getJSON(ctx, discovery.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		pub, err := k.publicKey()
+		if err != nil {
+			// skip keys of types that aren't supported rather than
+			// rejecting every token
+			continue
+		}
+
+		keys[k.Kid] = pub
+	}
+
+	return keys, nil
+}
+
+// oidcKey returns the signing key kid of the provider issuer, refreshing the
+// keys if they're stale or kid isn't known.
+func oidcKey(ctx context.Context, issuer, kid string) (crypto.PublicKey, error) {
+	oidcKeys.mu.Lock()
+	defer oidcKeys.mu.Unlock()
+
+	if oidcKeys.issuer != issuer {
+		oidcKeys.issuer = issuer
+		oidcKeys.fetched = time.Time{}
+		oidcKeys.keys = nil
+	}
+
+	key, ok := oidcKeys.keys[kid]
+	age := time.Since(oidcKeys.fetched)
+	if age > oidcKeysRefresh || (!ok && age > oidcKeysMinRefresh) {
+		keys, err := fetchOIDCKeys(ctx, issuer)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't fetch the signing keys of %s: %w", issuer, err)
+		}
+
+		oidcKeys.fetched = time.Now()
+		oidcKeys.keys = keys
+		key, ok = keys[kid]
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown signing key %q", errInvalidToken, kid)
+	}
+
+	return key, nil
+}
+
+// verifySignature verifies the signature sig of the signed part of a token
+// with key and the algorithm alg.
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+		k, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(k, signed, sig) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(k, hash, digest, sig)
+		case "PS":
+			return rsa.VerifyPSS(k, hash, digest, sig, nil)
+		}
+	case *ecdsa.PublicKey:
+		if alg[:2] != "ES" {
+			break
+		}
+
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid signature")
+		}
+
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("algorithm %q doesn't match the signing key", alg)
+}
+
+// audience is the aud claim of a token, which is a string or a list of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+// claimStrings returns the claim v as a list, splitting strings on spaces as
+// they are in the scope claim.
+func claimStrings(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		var s []string
+		for _, e := range v {
+			if e, ok := e.(string); ok {
+				s = append(s, e)
+			}
+		}
+		return s
+	}
+
+	return nil
+}
+
+// verifyToken verifies token was issued by the OIDC provider for the
+// server's audience, returning its claims.
+func verifyToken(ctx context.Context, token string) (*oidcClaims, error) {
+	issuer := envconfig.OIDCIssuer()
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", errInvalidToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidToken, err)
+	}
+
+	key, err := oidcKey(ctx, issuer, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidToken, err)
+	}
+
+	var claims struct {
+		Issuer    string   `json:"iss"`
+		Audience  audience `json:"aud"`
+		ExpiresAt *int64   `json:"exp"`
+		NotBefore *int64   `json:"nbf"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	switch {
+	case claims.Issuer != issuer:
+		return nil, fmt.Errorf("%w: wrong issuer", errInvalidToken)
+	case !slices.Contains(claims.Audience, envconfig.OIDCAudience()):
+		return nil, fmt.Errorf("%w: wrong audience", errInvalidToken)
+	case claims.ExpiresAt == nil || now.After(time.Unix(*claims.ExpiresAt, 0).Add(oidcLeeway)):
+		return nil, fmt.Errorf("%w: token expired", errInvalidToken)
+	case claims.NotBefore != nil && now.Before(time.Unix(*claims.NotBefore, 0).Add(-oidcLeeway)):
+		return nil, fmt.Errorf("%w: token not valid yet", errInvalidToken)
+	}
+
+	var all map[string]any
+	if err := decodeSegment(parts[1], &all); err != nil {
+		return nil, err
+	}
+
+	var c oidcClaims
+	for _, scope := range claimStrings(all[cmp.Or(envconfig.OIDCScopesClaim(), "scope")]) {
+		if slices.Contains(api.APIKeyScopes, scope) {
+			c.scopes = append(c.scopes, scope)
+		}
+	}
+
+	// tokens with the admin scope act for the whole server rather than a
+	// user's namespace
+	if !slices.Contains(c.scopes, api.ScopeAdmin) {
+		userClaim := cmp.Or(envconfig.OIDCUserClaim(), "sub")
+		user, _ := all[userClaim].(string)
+		if !isValidUser(user) {
+			return nil, fmt.Errorf("%w: claim %q isn't a valid user name", errInvalidToken, userClaim)
+		}
+
+		if err := registerOIDCUser(user); err != nil {
+			return nil, err
+		}
+		c.user = user
+	}
+
+	return &c, nil
+}
+
+func decodeSegment(s string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidToken, err)
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidToken, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/fs/ggml"
+	"github.com/goobla/goobla/types/model"
+)
+
+func signToken(t *testing.T, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest[:])
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDC(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fetches atomic.Int32
+	var issuer string
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": issuer, "jwks_uri": issuer + "/keys"})
+		case "/keys":
+			fetches.Add(1)
+			b64 := base64.RawURLEncoding.EncodeToString
+			json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+				{
+					"kid": "rsa", "kty": "RSA", "use": "sig",
+					"n": b64(rsaKey.N.Bytes()),
+					"e": b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+				},
+				{
+					"kid": "ec", "kty": "EC", "crv": "P-256",
+					"x": b64(ecKey.X.FillBytes(make([]byte, 32))),
+					"y": b64(ecKey.Y.FillBytes(make([]byte, 32))),
+				},
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer provider.Close()
+	issuer = provider.URL
+
+	t.Setenv("GOOBLA_OIDC_ISSUER", issuer)
+	t.Setenv("GOOBLA_OIDC_AUDIENCE", "goobla")
+	t.Setenv("GOOBLA_OIDC_SCOPES_CLAIM", "roles")
+
+	var user string
+	r := gin.New()
+	r.Use(apiKeyMiddleware())
+	r.GET("/api/version", func(c *gin.Context) {})
+	r.POST("/api/generate", func(c *gin.Context) { user = requestUser(c) })
+	r.POST("/api/pull", func(c *gin.Context) { user = requestUser(c) })
+
+	claims := func(mod func(map[string]any)) map[string]any {
+		c := map[string]any{
+			"iss":   issuer,
+			"aud":   []string{"other", "goobla"},
+			"sub":   "alice",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"roles": []string{"generate"},
+		}
+		if mod != nil {
+			mod(c)
+		}
+		return c
+	}
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name, path, token string
+		status            int
+		user              string
+	}{
+		{"no token", "/api/generate", "", http.StatusUnauthorized, ""},
+		{"version", "/api/version", "", http.StatusOK, ""},
+		{"rsa", "/api/generate", signToken(t, "rsa", rsaKey, claims(nil)), http.StatusOK, "alice"},
+		{"ec", "/api/generate", signToken(t, "ec", ecKey, claims(nil)), http.StatusOK, "alice"},
+		{"audience string", "/api/generate", signToken(t, "rsa", rsaKey, claims(func(c map[string]any) { c["aud"] = "goobla" })), http.StatusOK, "alice"},
+		{"scope not allowed", "/api/pull", signToken(t, "rsa", rsaKey, claims(nil)), http.StatusForbidden, ""},
+		{"admin", "/api/pull", signToken(t, "rsa", rsaKey, claims(func(c map[string]any) { c["roles"] = []string{"admin"} })), http.StatusOK, ""},
+		{"wrong audience", "/api/generate", signToken(t, "rsa", rsaKey, claims(func(c map[string]any) { c["aud"] = "other" })), http.StatusUnauthorized, ""},
+		{"wrong issuer", "/api/generate", signToken(t, "rsa", rsaKey, claims(func(c map[string]any) { c["iss"] = "https://example.com" })), http.StatusUnauthorized, ""},
+		{"expired", "/api/generate", signToken(t, "rsa", rsaKey, claims(func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() })), http.StatusUnauthorized, ""},
+		{"no expiry", "/api/generate", signToken(t, "rsa", rsaKey, claims(func(c map[string]any) { delete(c, "exp") })), http.StatusUnauthorized, ""},
+		{"not yet valid", "/api/generate", signToken(t, "rsa", rsaKey, claims(func(c map[string]any) { c["nbf"] = time.Now().Add(time.Hour).Unix() })), http.StatusUnauthorized, ""},
+		{"invalid user", "/api/generate", signToken(t, "rsa", rsaKey, claims(func(c map[string]any) { c["sub"] = "not a user" })), http.StatusUnauthorized, ""},
+		{"wrong key", "/api/generate", signToken(t, "rsa", otherKey, claims(nil)), http.StatusUnauthorized, ""},
+		{"unknown key", "/api/generate", signToken(t, "other", otherKey, claims(nil)), http.StatusUnauthorized, ""},
+		{"api key", "/api/generate", "goobla_bogus", http.StatusUnauthorized, ""},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			user = ""
+			req := httptest.NewRequest(http.MethodPost, tt.path, nil)
+			if tt.path == "/api/version" {
+				req.Method = http.MethodGet
+			}
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+
+			if user != tt.user {
+				t.Errorf("expected user %q, got %q", tt.user, user)
+			}
+		})
+	}
+
+	// the keys are cached, and unknown keys don't refetch them more than
+	// once a minute
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("expected the keys to be fetched once, got %d", n)
+	}
+
+	t.Run("namespaces", func(t *testing.T) {
+		var s Server
+		_, digest := createBinFile(t, ggml.KV{"general.architecture": "test"}, nil)
+		if w := createRequest(t, s.CreateHandler, api.CreateRequest{Model: "shared/model", Files: map[string]string{"model.gguf": digest}}); w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		generate := func(sub string) int {
+			req := httptest.NewRequest(http.MethodPost, "/api/generate", nil)
+			req.Header.Set("Authorization", "Bearer "+signToken(t, "rsa", rsaKey, claims(func(c map[string]any) { c["sub"] = sub })))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		for _, sub := range []string{"library", "Library", "shared"} {
+			if code := generate(sub); code != http.StatusUnauthorized {
+				t.Errorf("%s: expected status 401, got %d", sub, code)
+			}
+		}
+
+		if code := generate("bob"); code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		// users are remembered after the cache is reloaded
+		oidcUsers.Lock()
+		oidcUsers.reset()
+		oidcUsers.Unlock()
+
+		alice := model.ParseName("alice/model")
+		bob := model.ParseName("bob/model")
+		shared := model.ParseName("shared/model")
+		if !canRead("alice", alice) || canRead("bob", alice) || canRead("alice", bob) {
+			t.Error("expected users' namespaces to be private")
+		}
+
+		if !canRead("alice", shared) || !canRead("bob", shared) {
+			t.Error("expected shared namespaces to be readable")
+		}
+
+		if canWrite("alice", bob) || canWrite("alice", shared) {
+			t.Error("expected users to only write to their namespace")
+		}
+	})
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/envconfig"
+	"github.com/goobla/goobla/types/model"
+)
+
+// Goobla servers can pull models from each other rather than from a
+// registry. A server with GOOBLA_SERVE_PEERS set serves the manifests of its
+// models at /api/manifests/<host>/<namespace>/<model>/<tag> and their blobs
+// at /api/blobs/<digest>, which are pulled with the same download and
+// verification as blobs from a registry. It's off by default since anyone
+// who can reach the server could download its models.
+
+var errInvalidPeer = errors.New("peer must be an http or https URL")
+
+// parsePeer parses the URL of a goobla server to pull from.
+func parsePeer(s string) (*url.URL, error) {
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidPeer, err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("%w: %q", errInvalidPeer, s)
+	}
+
+	return u, nil
+}
+
+// manifestURL returns the URL of mp's manifest at its registry, or at the
+// peer in regOpts.
+func manifestURL(mp ModelPath, regOpts *registryOptions) *url.URL {
+	if regOpts.peer != nil {
+		return regOpts.peer.JoinPath("api", "manifests", mp.Registry, mp.Namespace, mp.Repository, mp.Tag)
+	}
+
+	return mp.BaseURL().JoinPath("v2", mp.GetNamespaceRepository(), "manifests", mp.Reference())
+}
+
+// blobURL returns the URL of the blob digest at mp's registry, or at the peer
+// in regOpts.
+func blobURL(mp ModelPath, digest string, regOpts *registryOptions) *url.URL {
+	if regOpts.peer != nil {
+		return regOpts.peer.JoinPath("api", "blobs", digest)
+	}
+
+	return mp.BaseURL().JoinPath("v2", mp.GetNamespaceRepository(), "blobs", digest)
+}
+
+// findManifest returns the manifest for n. Names tagged with a digest, as
+// written by pinned pulls, also match a manifest with that digest under any
+// other name.
+func findManifest(n model.Name) (*Manifest, error) {
+	m, err := ParseNamedManifest(n)
+	if !errors.Is(err, os.ErrNotExist) || n.Digest() == "" {
+		return m, err
+	}
+
+	ms, err := Manifests(true)
+	if err != nil {
+		return nil, err
+	}
+
+	want := strings.TrimPrefix(n.Digest(), "sha256:")
+	for _, m := range ms {
+		if m.digest == want {
+			return m, nil
+		}
+	}
+
+	return nil, os.ErrNotExist
+}
+
+// checkServePeers aborts the request if the server doesn't serve models to
+// other servers, reporting whether it may continue.
+func checkServePeers(c *gin.Context) bool {
+	if !envconfig.ServePeers() {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "this server doesn't serve models to other servers, set GOOBLA_SERVE_PEERS=1 to allow it"})
+		return false
+	}
+	return true
+}
+
+func (s *Server) GetManifestHandler(c *gin.Context) {
+	if !checkServePeers(c) {
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(c.Param("name"), "/"), "/")
+	if len(parts) != 4 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("name %q is invalid", c.Param("name"))})
+		return
+	}
+
+	n := model.ParseName(fmt.Sprintf("%s/%s/%s:%s", parts[0], parts[1], parts[2], parts[3]))
+	if !n.IsFullyQualified() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("name %q is invalid", c.Param("name"))})
+		return
+	}
+
+	if !checkRead(c, n) {
+		return
+	}
+
+	m, err := findManifest(n)
+	if errors.Is(err, os.ErrNotExist) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found", n.DisplayShortest())})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// the manifest is served as is so its digest is unchanged
+	b, err := os.ReadFile(m.filepath)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Docker-Content-Digest", "sha256:"+m.digest)
+	c.Data(http.StatusOK, mediaTypeDockerManifest, b)
+}
+
+func (s *Server) GetBlobHandler(c *gin.Context) {
+	if !checkServePeers(c) {
+		return
+	}
+
+	digest := c.Param("digest")
+	p, err := GetBlobsPath(digest)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// corrupted blobs are not served so they don't spread to other servers
+	if isCorrupted(digest) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("blob %q is corrupted", digest)})
+		return
+	}
+
+	if user := requestUser(c); user != "" && !canReadBlob(user, digest) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("blob %q not found", digest)})
+		return
+	}
+
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("blob %q not found", digest)})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Docker-Content-Digest", strings.Replace(digest, "-", ":", 1))
+	http.ServeContent(c.Writer, c.Request, "", fi.ModTime(), f)
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/fs/ggml"
+	"github.com/goobla/goobla/types/model"
+)
+
+func TestPeerHandlers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	var s Server
+	_, digest := createBinFile(t, ggml.KV{"general.architecture": "test"}, nil)
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Files: map[string]string{"model.gguf": digest},
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	m, err := ParseNamedManifest(model.ParseName("test"))
+	require.NoError(t, err)
+
+	r := gin.New()
+	r.GET("/api/manifests/*name", s.GetManifestHandler)
+	r.GET("/api/blobs/:digest", s.GetBlobHandler)
+	r.HEAD("/api/blobs/:digest", s.HeadBlobHandler)
+
+	get := func(method, path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// models are only served to other servers when it's enabled
+	w = get(http.MethodGet, "/api/manifests/registry.goobla.ai/library/test/latest", nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = get(http.MethodGet, "/api/blobs/"+m.Layers[0].Digest, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	t.Setenv("GOOBLA_SERVE_PEERS", "1")
+
+	w = get(http.MethodGet, "/api/manifests/registry.goobla.ai/library/test/latest", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "sha256:"+m.digest, w.Header().Get("Docker-Content-Digest"))
+
+	var got Manifest
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	assert.Equal(t, m.Layers, got.Layers)
+
+	// a pinned name matches the manifest by digest
+	w = get(http.MethodGet, "/api/manifests/registry.goobla.ai/library/test/sha256-"+m.digest, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = get(http.MethodGet, "/api/manifests/registry.goobla.ai/library/missing/latest", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = get(http.MethodGet, "/api/manifests/test", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = get(http.MethodHead, "/api/blobs/"+digest, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	size, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64)
+	require.NoError(t, err)
+
+	w = get(http.MethodGet, "/api/blobs/"+digest, http.Header{"Range": {"bytes=4-"}})
+	require.Equal(t, http.StatusPartialContent, w.Code)
+	assert.EqualValues(t, size-4, w.Body.Len())
+
+	_, missing := testBlob("missing")
+	w = get(http.MethodGet, "/api/blobs/"+missing, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestPullModelFromPeer(t *testing.T) {
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	layer, layerDigest := testBlob("model weights")
+	config, configDigest := testBlob(`{"model_format":"gguf"}`)
+	manifest, err := json.Marshal(Manifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeDockerManifest,
+		Config:        Layer{MediaType: "application/vnd.docker.container.image.v1+json", Digest: configDigest, Size: int64(len(config))},
+		Layers:        []Layer{{MediaType: "application/vnd.goobla.image.model", Digest: layerDigest, Size: int64(len(layer))}},
+	})
+	require.NoError(t, err)
+
+	tampered := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blobs := map[string][]byte{
+			"/api/blobs/" + layerDigest:  layer,
+			"/api/blobs/" + configDigest: config,
+		}
+
+		if b, ok := blobs[r.URL.Path]; ok {
+			if tampered && r.URL.Path == "/api/blobs/"+layerDigest {
+				b = []byte("model weighs!")
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+			return
+		}
+
+		if r.URL.Path == "/api/manifests/registry.goobla.ai/library/test/latest" {
+			w.Write(manifest) //nolint:errcheck
+			return
+		}
+
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	peer, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	require.NoError(t, PullModel(t.Context(), "test", &registryOptions{peer: peer}, func(api.ProgressResponse) {}))
+
+	m, err := ParseNamedManifest(model.ParseName("test"))
+	require.NoError(t, err)
+	require.Len(t, m.Layers, 1)
+
+	f, err := localBlobs.Open(t.Context(), layerDigest)
+	require.NoError(t, err)
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, layer, b)
+
+	t.Run("tampered", func(t *testing.T) {
+		t.Setenv("GOOBLA_MODELS", t.TempDir())
+		tampered = true
+
+		err := PullModel(t.Context(), "test", &registryOptions{peer: peer}, func(api.ProgressResponse) {})
+		require.ErrorIs(t, err, errDigestMismatch)
+	})
+}
+
+func TestParsePeer(t *testing.T) {
+	cases := map[string]string{
+		"http://other-host:11434":  "http://other-host:11434",
+		"https://goobla.internal/": "https://goobla.internal/",
+		"other-host:11434":         "http://other-host:11434",
+	}
+
+	for in, want := range cases {
+		u, err := parsePeer(in)
+		require.NoError(t, err)
+		assert.Equal(t, want, u.String())
+	}
+
+	for _, in := range []string{"ftp://other-host", "http://", "http://%zz"} {
+		_, err := parsePeer(in)
+		assert.ErrorIs(t, err, errInvalidPeer, in)
+	}
+}
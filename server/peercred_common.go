@@ -0,0 +1,14 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// peerCredentials isn't supported on this platform, so no connections are
+// accepted from the socket's peers when its users are limited.
+func peerCredentials(*net.UnixConn) (uid, gid uint32, err error) {
+	return 0, 0, errors.New("peer credentials aren't supported on this platform")
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerCredentials returns the user and group ids of the process at the other
+// end of conn.
+func peerCredentials(conn *net.UnixConn) (uid, gid uint32, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var cred *unix.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return 0, 0, err
+	}
+
+	if credErr != nil {
+		return 0, 0, credErr
+	}
+
+	return cred.Uid, cred.Gid, nil
+}
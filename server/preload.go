@@ -0,0 +1,238 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/envconfig"
+	"github.com/goobla/goobla/types/model"
+)
+
+// Preloaded models are loaded when the server starts, from GOOBLA_PRELOAD,
+// or with /api/preload, and kept loaded regardless of keep alive so requests
+// don't wait for them to load. /api/health reports the server ready once
+// they've all been loaded.
+
+const (
+	preloadLoading = "loading"
+	preloadReady   = "ready"
+	preloadError   = "error"
+)
+
+type preload struct {
+	api.PreloadStatus
+	// path is the model's path in the scheduler, once it's known
+	path string
+}
+
+// preloads are the preloaded models by name.
+type preloads struct {
+	mu     sync.Mutex
+	models map[string]preload
+}
+
+func (p *preloads) set(name, path, status string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.models == nil {
+		p.models = make(map[string]preload)
+	}
+
+	m := preload{PreloadStatus: api.PreloadStatus{Model: name, Status: status}, path: path}
+	if err != nil {
+		m.Error = err.Error()
+	}
+	p.models[name] = m
+}
+
+// remove removes the model name, returning its path and whether it was
+// preloaded.
+func (p *preloads) remove(name string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m, ok := p.models[name]
+	delete(p.models, name)
+	return m.path, ok
+}
+
+func (p *preloads) statuses() []api.PreloadStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	statuses := make([]api.PreloadStatus, 0, len(p.models))
+	for _, m := range p.models {
+		statuses = append(statuses, m.PreloadStatus)
+	}
+
+	slices.SortFunc(statuses, func(a, b api.PreloadStatus) int {
+		return strings.Compare(a.Model, b.Model)
+	})
+	return statuses
+}
+
+// preload loads the model n and keeps it loaded.
+func (s *Server) preload(n model.Name) error {
+	name := n.DisplayShortest()
+	s.preloads.set(name, "", preloadLoading, nil)
+
+	m, err := GetModel(n.String())
+	if err != nil {
+		s.preloads.set(name, "", preloadError, err)
+		return err
+	}
+
+	s.preloads.set(name, m.ModelPath, preloadLoading, nil)
+	s.sched.setPreloaded(m.ModelPath, true)
+
+	// the runner is released once it's loaded, leaving it idle
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, _, _, err := s.scheduleRunner(ctx, n.String(), nil, nil, nil, priorityHigh, ""); err != nil {
+		s.sched.setPreloaded(m.ModelPath, false)
+		s.preloads.set(name, m.ModelPath, preloadError, err)
+		return err
+	}
+
+	s.preloads.set(name, m.ModelPath, preloadReady, nil)
+	slog.Info("preloaded model", "model", name)
+	return nil
+}
+
+// preloadModels loads the models of GOOBLA_PRELOAD, and the models that were
+// loaded when the server was last drained, one at a time.
+func (s *Server) preloadModels() {
+	loaded, err := takeLoadedModels()
+	if err != nil {
+		slog.Warn("couldn't read the models loaded before restarting", "error", err)
+	}
+
+	models := envconfig.Preload()
+	for _, m := range loaded {
+		if m.Preloaded && !slices.Contains(models, m.Model) {
+			models = append(models, m.Model)
+		}
+	}
+	names := make([]model.Name, len(models))
+
+	// every model is loading until it's been tried, so the server isn't
+	// ready in the meantime
+	for i, v := range models {
+		n := model.ParseName(strings.TrimSpace(v))
+		names[i] = n
+		if !n.IsValid() {
+			s.preloads.set(v, "", preloadError, errors.New("invalid model name"))
+			continue
+		}
+
+		if existing, err := getExistingName(n); err == nil {
+			names[i] = existing
+		}
+		s.preloads.set(names[i].DisplayShortest(), "", preloadLoading, nil)
+	}
+
+	for _, n := range names {
+		if !n.IsValid() {
+			continue
+		}
+
+		if err := s.preload(n); err != nil {
+			slog.Error("couldn't preload model", "model", n.DisplayShortest(), "error", err)
+		}
+	}
+
+	s.restoreModels(loaded)
+}
+
+func (s *Server) PreloadHandler(c *gin.Context) {
+	var r api.PreloadRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	n := model.ParseName(r.Model)
+	if !n.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("name %q is invalid", r.Model)})
+		return
+	}
+
+	n, err := getExistingName(n)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !checkRead(c, n) {
+		return
+	}
+
+	if c.Request.Method == http.MethodDelete {
+		path, ok := s.preloads.remove(n.DisplayShortest())
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q isn't preloaded", r.Model)})
+			return
+		}
+
+		if path != "" {
+			s.sched.setPreloaded(path, false)
+		}
+		c.Status(http.StatusOK)
+		return
+	}
+
+	if err := s.preload(n); errors.Is(err, os.ErrNotExist) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found", r.Model)})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func (s *Server) HealthHandler(c *gin.Context) {
+	resp := s.health()
+
+	status := http.StatusOK
+	if resp.Status != preloadReady {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, resp)
+}
+
+// health returns the readiness of the server from its preloaded models and
+// whether it's draining.
+func (s *Server) health() api.HealthResponse {
+	resp := api.HealthResponse{Status: preloadReady, Models: s.preloads.statuses()}
+	for _, m := range resp.Models {
+		switch {
+		case m.Status == preloadError:
+			resp.Status = preloadError
+		case m.Status == preloadLoading && resp.Status == preloadReady:
+			resp.Status = preloadLoading
+		}
+	}
+
+	if draining, _ := s.drainer.state(); draining {
+		resp.Status = "draining"
+	}
+
+	return resp
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/discover"
+	"github.com/goobla/goobla/fs/ggml"
+	"github.com/goobla/goobla/llm"
+)
+
+func TestPreload(t *testing.T) {
+	t.Run("scheduler", func(t *testing.T) {
+		ctx, done := context.WithTimeout(t.Context(), 20*time.Millisecond)
+		defer done()
+		s := InitScheduler(ctx)
+		s.setPreloaded("foo", true)
+
+		req := &LlmRequest{
+			ctx:             ctx,
+			model:           &Model{ModelPath: "foo"},
+			opts:            api.DefaultOptions(),
+			successCh:       make(chan *runnerRef, 1),
+			errCh:           make(chan error, 1),
+			sessionDuration: &api.Duration{Duration: 0},
+		}
+
+		server := &mockLlm{estimatedVRAMByGPU: map[string]uint64{}}
+		s.newServerFn = func(discover.GpuInfoList, string, *ggml.GGML, []string, []string, string, api.Options, int) (llm.LlamaServer, error) {
+			return server, nil
+		}
+		s.load(req, nil, discover.GpuInfoList{}, 0)
+
+		var runner *runnerRef
+		select {
+		case err := <-req.errCh:
+			t.Fatal(err)
+		case runner = <-req.successCh:
+		}
+
+		if !runner.preloaded || runner.sessionDuration != math.MaxInt64 {
+			t.Fatalf("expected the runner to be kept loaded, got %s", runner.sessionDuration)
+		}
+
+		// neither the request's keep alive nor unloading the model expire it
+		s.expireRunner(&Model{ModelPath: "foo"})
+		s.finishedReqCh <- req
+		s.processCompleted(ctx)
+
+		s.loadedMu.Lock()
+		loaded := len(s.loaded)
+		s.loadedMu.Unlock()
+		if loaded != 1 {
+			t.Fatal("expected the model to still be loaded")
+		}
+
+		s.setPreloaded("foo", false)
+		runner.refMu.Lock()
+		defer runner.refMu.Unlock()
+		if runner.preloaded || runner.sessionDuration != 5*time.Minute || runner.expireTimer == nil {
+			t.Errorf("expected the runner to expire after the default keep alive, got %s", runner.sessionDuration)
+		}
+		runner.expireTimer.Stop()
+	})
+
+	t.Run("health", func(t *testing.T) {
+		gin.SetMode(gin.TestMode)
+
+		var s Server
+		health := func() (int, api.HealthResponse) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/api/health", nil)
+			s.HealthHandler(c)
+
+			var resp api.HealthResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			return w.Code, resp
+		}
+
+		if code, resp := health(); code != http.StatusOK || resp.Status != preloadReady {
+			t.Errorf("expected a server without preloaded models to be ready, got %d %q", code, resp.Status)
+		}
+
+		s.preloads.set("a", "", preloadLoading, nil)
+		s.preloads.set("b", "", preloadReady, nil)
+		if code, resp := health(); code != http.StatusServiceUnavailable || resp.Status != preloadLoading || len(resp.Models) != 2 {
+			t.Errorf("expected the server to be loading, got %d %+v", code, resp)
+		}
+
+		s.preloads.set("a", "", preloadError, errors.New("out of memory"))
+		if code, resp := health(); code != http.StatusServiceUnavailable || resp.Status != preloadError || resp.Models[0].Error != "out of memory" {
+			t.Errorf("expected an error, got %d %+v", code, resp)
+		}
+
+		if _, ok := s.preloads.remove("a"); !ok {
+			t.Fatal("expected a to be removed")
+		}
+
+		if code, resp := health(); code != http.StatusOK || resp.Status != preloadReady {
+			t.Errorf("expected the server to be ready, got %d %+v", code, resp)
+		}
+	})
+}
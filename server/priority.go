@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/envconfig"
+)
+
+// requestPriority is the class of a request to the scheduler. Queued
+// requests with a higher priority are scheduled first, and models last used
+// by lower priority requests are unloaded first to make room.
+type requestPriority int
+
+const (
+	priorityLow requestPriority = iota - 1
+	priorityNormal
+	priorityHigh
+)
+
+func (p requestPriority) String() string {
+	switch p {
+	case priorityLow:
+		return "low"
+	case priorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+func parsePriority(s string) (requestPriority, error) {
+	switch strings.ToLower(s) {
+	case "low":
+		return priorityLow, nil
+	case "", "normal":
+		return priorityNormal, nil
+	case "high":
+		return priorityHigh, nil
+	default:
+		return priorityNormal, fmt.Errorf("invalid priority %q, must be low, normal or high", s)
+	}
+}
+
+// prioritiesFile sets the priority of API keys, sent as bearer tokens, and
+// of the users of a multi-user server:
+//
+//	{
+//	  "keys": {"sk-batch-jobs": "low"},
+//	  "users": {"alice": "high"}
+//	}
+type prioritiesFile struct {
+	Keys  map[string]string `json:"keys"`
+	Users map[string]string `json:"users"`
+}
+
+// loadPriorities reads the priorities config file. The file is read on each
+// call so changes take effect without restarting the server.
+func loadPriorities() (prioritiesFile, error) {
+	var f prioritiesFile
+
+	p := envconfig.PrioritiesConfig()
+	b, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return f, nil
+	} else if err != nil {
+		return f, err
+	}
+
+	if err := json.Unmarshal(b, &f); err != nil {
+		return f, fmt.Errorf("%s: %w", p, err)
+	}
+
+	return f, nil
+}
+
+// resolvePriority returns the priority of the request c, which asked for
+// priority s. Requests from an API key or user in the priorities config have
+// its priority unless they ask for a lower one.
+func resolvePriority(c *gin.Context, s string) (requestPriority, error) {
+	p, err := parsePriority(s)
+	if err != nil {
+		return p, err
+	}
+
+	f, err := loadPriorities()
+	if err != nil {
+		slog.Warn("ignoring invalid priorities config", "error", err)
+		return p, nil
+	}
+
+	var limit string
+	if key, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok && f.Keys[key] != "" {
+		limit = f.Keys[key]
+	} else if user := requestUser(c); user != "" && f.Users[user] != "" {
+		limit = f.Users[user]
+	} else {
+		return p, nil
+	}
+
+	highest, err := parsePriority(limit)
+	if err != nil {
+		slog.Warn("ignoring invalid priorities config", "file", envconfig.PrioritiesConfig(), "error", err)
+		return p, nil
+	}
+
+	if s == "" || p > highest {
+		return highest, nil
+	}
+
+	return p, nil
+}
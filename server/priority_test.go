@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolvePriority(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := filepath.Join(t.TempDir(), "priorities.json")
+	require.NoError(t, os.WriteFile(p, []byte(`{"keys": {"batch-key": "low", "chat-key": "high"}, "users": {"alice": "low"}}`), 0o644))
+	t.Setenv("GOOBLA_PRIORITIES_CONFIG", p)
+
+	cases := []struct {
+		name     string
+		key      string
+		user     string
+		priority string
+		want     requestPriority
+		err      bool
+	}{
+		{name: "default", want: priorityNormal},
+		{name: "requested", priority: "HIGH", want: priorityHigh},
+		{name: "invalid", priority: "urgent", err: true},
+		{name: "key default", key: "batch-key", want: priorityLow},
+		{name: "key limit", key: "batch-key", priority: "high", want: priorityLow},
+		{name: "key lower", key: "chat-key", priority: "normal", want: priorityNormal},
+		{name: "key high", key: "chat-key", want: priorityHigh},
+		{name: "unknown key", key: "other-key", priority: "high", want: priorityHigh},
+		{name: "user limit", user: "alice", priority: "normal", want: priorityLow},
+		{name: "other user", user: "bob", want: priorityNormal},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodPost, "/api/chat", nil)
+			if tt.key != "" {
+				c.Request.Header.Set("Authorization", "Bearer "+tt.key)
+			}
+			if tt.user != "" {
+				c.Set(userKey, tt.user)
+			}
+
+			got, err := resolvePriority(c, tt.priority)
+			if tt.err {
+				assert.ErrorContains(t, err, "invalid priority")
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
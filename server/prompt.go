@@ -10,7 +10,6 @@ import (
 	"strings"
 
 	"github.com/goobla/goobla/api"
-	"github.com/goobla/goobla/fs/ggml"
 	"github.com/goobla/goobla/llm"
 	"github.com/goobla/goobla/template"
 )
@@ -19,20 +18,23 @@ type tokenizeFunc func(context.Context, string) ([]int, error)
 
 // chatPrompt accepts a list of messages and returns the prompt and images that should be used for the next chat turn.
 // chatPrompt truncates any messages that exceed the context window of the model, making sure to always include 1) the
-// latest message and 2) system messages
+// latest message and 2) system messages. Messages are only truncated with the default context_overflow policy: with
+// "error" a prompt that exceeds the context window is an error, and with "shift_with_attention_sink" the runner
+// shifts the prompt instead.
 func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.Options, msgs []api.Message, tools []api.Tool, think *bool) (prompt string, images []llm.ImageData, _ error) {
 	var system []api.Message
+	truncate := opts.ContextOverflow == "" || opts.ContextOverflow == api.ContextOverflowTruncateOldest
 
-	imageNumTokens := 768
-	if len(m.ProjectorPaths) > 0 {
-		if tokens := projectorImageTokens(m.ProjectorPaths[0]); tokens > 0 {
-			imageNumTokens = tokens
-		}
-	}
+	imageNumTokens := numImageTokens(m)
 
 	n := len(msgs) - 1
+	if !truncate {
+		// keep all of the messages
+		n = 0
+	}
+
 	// in reverse, find all messages that fit into context window
-	for i := n; i >= 0; i-- {
+	for i := n; truncate && i >= 0; i-- {
 		// always include the last message
 		if i == n {
 			continue
@@ -99,6 +101,23 @@ func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.
 
 			images = append(images, imgData)
 		}
+
+		// audio is sent to the runner as multimodal inputs like images
+		for _, a := range msg.Audio {
+			audioData := llm.ImageData{
+				ID:   len(images),
+				Data: a,
+			}
+
+			audioTag := fmt.Sprintf("[img-%d]", audioData.ID)
+			if !strings.Contains(prompt, "[audio]") {
+				prefix += audioTag
+			} else {
+				prompt = strings.Replace(prompt, "[audio]", audioTag, 1)
+			}
+
+			images = append(images, audioData)
+		}
 		msgs[currMsgIdx+cnt].Content = prefix + prompt
 	}
 
@@ -112,9 +131,50 @@ func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.
 		return "", nil, err
 	}
 
+	if err := checkContextLength(ctx, m, tokenize, opts, b.String(), len(images)); err != nil {
+		return "", nil, err
+	}
+
 	return b.String(), images, nil
 }
 
+// checkContextLength returns an error wrapping errContextOverflow if prompt
+// and its images don't fit in the context window of a request with the
+// "error" context_overflow policy, so it fails before it reaches the runner.
+func checkContextLength(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.Options, prompt string, numImages int) error {
+	if opts.ContextOverflow != api.ContextOverflowError {
+		return nil
+	}
+
+	s, err := tokenize(ctx, prompt)
+	if err != nil {
+		return err
+	}
+
+	ctxLen := len(s)
+	if m.ProjectorPaths != nil {
+		ctxLen += numImageTokens(m) * numImages
+	}
+
+	if ctxLen > opts.NumCtx {
+		return fmt.Errorf("%w: %d tokens exceed the context length of %d", errContextOverflow, ctxLen, opts.NumCtx)
+	}
+
+	return nil
+}
+
+// numImageTokens returns the number of tokens each image of a prompt for m
+// is estimated to take.
+func numImageTokens(m *Model) int {
+	if len(m.ProjectorPaths) > 0 {
+		if tokens := projectorImageTokens(m.ProjectorPaths[0]); tokens > 0 {
+			return tokens
+		}
+	}
+
+	return 768
+}
+
 func projectorImageTokens(path string) int {
 	const defaultTokens = 768
 	ggmlData, err := llm.LoadModel(path, 0)
@@ -2,6 +2,8 @@ package server
 
 import (
 	"bytes"
+	"errors"
+	"slices"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -260,3 +262,51 @@ func TestChatPrompt(t *testing.T) {
 		})
 	}
 }
+
+func TestChatPromptContextOverflow(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- if .System }}{{ .System }} {{ end }}
+{{- if .Prompt }}{{ .Prompt }} {{ end }}
+{{- if .Response }}{{ .Response }} {{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "user", Content: "You're a test, Harry!"},
+		{Role: "assistant", Content: "I-I'm a what?"},
+		{Role: "user", Content: "A test. And a thumping good one at that, I'd wager."},
+	}
+
+	all := "You're a test, Harry! I-I'm a what? A test. And a thumping good one at that, I'd wager. "
+	last := "A test. And a thumping good one at that, I'd wager. "
+
+	cases := []struct {
+		policy string
+		limit  int
+		want   string
+		err    error
+	}{
+		{"", 64, all, nil},
+		{"", 12, last, nil},
+		{api.ContextOverflowTruncateOldest, 12, last, nil},
+		{api.ContextOverflowError, 64, all, nil},
+		{api.ContextOverflowError, 12, "", errContextOverflow},
+		{api.ContextOverflowShift, 12, all, nil},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.policy, func(t *testing.T) {
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: tt.limit}, ContextOverflow: tt.policy}
+			prompt, _, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, slices.Clone(msgs), nil, nil)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+
+			if diff := cmp.Diff(prompt, tt.want); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
@@ -18,6 +18,7 @@ type quantizer struct {
 	*os.File
 	offset     uint64
 	from, to   *fsggml.Tensor
+	imatrix    []float32
 	progressFn func(n uint64)
 }
 
@@ -41,7 +42,7 @@ func (q quantizer) WriteTo(w io.Writer) (int64, error) {
 	} else {
 		f32s = ggml.ConvertToF32(data, q.from.Kind, q.from.Elements())
 	}
-	data = ggml.Quantize(newType, f32s, q.from.Shape)
+	data = ggml.Quantize(newType, f32s, q.from.Shape, q.imatrix)
 	n, err := w.Write(data)
 	q.progressFn(q.from.Size())
 	return int64(n), err
@@ -150,9 +151,18 @@ func getTensorNewType(kv fsggml.KV, qs *quantizeState, newType fsggml.TensorType
 	return newType
 }
 
-func quantize(in, out *os.File, orig *fsggml.GGML, newFileType fsggml.FileType, progressFn func(n uint64)) error {
+func quantize(in, out *os.File, orig *fsggml.GGML, newFileType fsggml.FileType, imatrix *importanceMatrix, progressFn func(n uint64)) error {
 	kv := maps.Clone(orig.KV())
 	kv["general.file_type"] = newFileType
+	if imatrix != nil {
+		kv["quantize.imatrix.entries_count"] = uint32(len(imatrix.Tensors))
+		if imatrix.Chunks > 0 {
+			kv["quantize.imatrix.chunks_count"] = uint32(imatrix.Chunks)
+		}
+		if imatrix.Dataset != "" {
+			kv["quantize.imatrix.dataset"] = imatrix.Dataset
+		}
+	}
 	// kv["general.quantization_version"] = ggml.QuantizationVersion()
 	qs := &quantizeState{is70B: format.HumanNumber(kv.ParameterCount()) == "70B"}
 	// Build up the quantize state so newType can adjust types
@@ -183,12 +193,27 @@ func quantize(in, out *os.File, orig *fsggml.GGML, newFileType fsggml.FileType,
 			Shape: tensor.Shape,
 			Kind:  uint32(newType),
 		}
+		var importance []float32
+		if imatrix != nil && newType != fsggml.TensorType(tensor.Kind) && newType.IsQuantized() {
+			if importance = imatrix.Tensors[tensor.Name]; importance != nil {
+				// there's a value for each column of every expert
+				columns := tensor.Shape[0]
+				if len(tensor.Shape) > 2 {
+					columns *= tensor.Shape[2]
+				}
+				if uint64(len(importance)) != columns {
+					return fmt.Errorf("%w: %s has %d values for %d columns", errBadImportanceMatrix, tensor.Name, len(importance), columns)
+				}
+			}
+		}
+
 		outputTensors[i] = newTensor
 		outputTensors[i].WriterTo = quantizer{
 			File:       in,
 			offset:     orig.Tensors().Offset + tensor.Offset,
 			from:       tensor,
 			to:         newTensor,
+			imatrix:    importance,
 			progressFn: progressFn,
 		}
 	}
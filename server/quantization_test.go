@@ -296,7 +296,7 @@ func TestQuantizeModel(t *testing.T) {
 				t.Fatal(err.Error())
 			}
 
-			err = quantize(fp, tmp, meta, ftype, progress)
+			err = quantize(fp, tmp, meta, ftype, nil, progress)
 			if err != nil {
 				t.Fatalf("error during quantize: %s", err)
 			}
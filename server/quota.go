@@ -0,0 +1,380 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/envconfig"
+	"github.com/goobla/goobla/format"
+	"github.com/goobla/goobla/types/model"
+)
+
+var errDiskQuota = errors.New("not enough space within the disk quota")
+
+// touchInterval is how often the last use of a model is recorded, so that
+// every request doesn't rewrite usage.json.
+const touchInterval = time.Minute
+
+// usageState records when models were last used and which are pinned. It is
+// stored in usage.json in the models directory, keyed by the lowercased fully
+// qualified model name.
+type usageState struct {
+	Models map[string]*modelUsage `json:"models,omitempty"`
+}
+
+type modelUsage struct {
+	LastUsed time.Time `json:"last_used,omitzero"`
+	Pinned   bool      `json:"pinned,omitempty"`
+}
+
+// usageMu serializes updates to usage.json
+var usageMu sync.Mutex
+
+// quotaMu serializes making room for models so concurrent pulls don't both
+// claim the same free space.
+var quotaMu sync.Mutex
+
+func usageKey(n model.Name) string {
+	return strings.ToLower(n.String())
+}
+
+func usageStatePath() (string, error) {
+	dir, err := envconfig.Models()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "usage.json"), nil
+}
+
+func readUsageState() (usageState, error) {
+	var s usageState
+
+	p, err := usageStatePath()
+	if err != nil {
+		return s, err
+	}
+
+	b, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+
+	if err := json.Unmarshal(b, &s); err != nil {
+		return s, fmt.Errorf("%s: %w", p, err)
+	}
+
+	return s, nil
+}
+
+// updateUsageState applies fn to the usage state, writing it back if fn
+// reports that it changed.
+func updateUsageState(fn func(*usageState) bool) error {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+
+	s, err := readUsageState()
+	if err != nil {
+		return err
+	}
+
+	if s.Models == nil {
+		s.Models = make(map[string]*modelUsage)
+	}
+
+	if !fn(&s) {
+		return nil
+	}
+
+	p, err := usageStatePath()
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(p, b, 0o600)
+}
+
+// touchModel records that the model n was used.
+func touchModel(n model.Name) error {
+	return updateUsageState(func(s *usageState) bool {
+		u, ok := s.Models[usageKey(n)]
+		if !ok {
+			u = &modelUsage{}
+			s.Models[usageKey(n)] = u
+		}
+
+		if time.Since(u.LastUsed) < touchInterval {
+			return false
+		}
+
+		u.LastUsed = time.Now()
+		return true
+	})
+}
+
+// setPinned pins or unpins the model n. Pinned models are never evicted.
+func setPinned(n model.Name, pinned bool) error {
+	return updateUsageState(func(s *usageState) bool {
+		u, ok := s.Models[usageKey(n)]
+		if !ok {
+			u = &modelUsage{}
+			s.Models[usageKey(n)] = u
+		}
+
+		if u.Pinned == pinned {
+			return false
+		}
+
+		u.Pinned = pinned
+		return true
+	})
+}
+
+// forgetModel removes the usage of the deleted model n.
+func forgetModel(n model.Name) error {
+	return updateUsageState(func(s *usageState) bool {
+		if _, ok := s.Models[usageKey(n)]; !ok {
+			return false
+		}
+
+		delete(s.Models, usageKey(n))
+		return true
+	})
+}
+
+// pinned reports whether the model n is pinned.
+func (s usageState) pinned(n model.Name) bool {
+	u, ok := s.Models[usageKey(n)]
+	return ok && u.Pinned
+}
+
+// maxDisk returns the size the model store is limited to by
+// GOOBLA_MAX_DISK, or 0 if it is unlimited.
+func maxDisk() int64 {
+	s := envconfig.MaxDisk()
+	if s == "" {
+		return 0
+	}
+
+	n, err := format.ParseBytes(s)
+	if err != nil {
+		slog.Warn("invalid GOOBLA_MAX_DISK, ignoring", "error", err)
+		return 0
+	}
+
+	return n
+}
+
+// storeSize returns the size of the blobs used by ms and layers in the
+// writable models directory. Blobs in read-only directories don't count
+// against the quota.
+func storeSize(ms map[model.Name]*Manifest, layers []Layer) int64 {
+	sizes := make(map[string]int64)
+	add := func(l Layer) {
+		if l.Digest == "" {
+			return
+		}
+
+		if p, err := GetBlobsPath(l.Digest); err == nil && !inReadOnlyModelsDir(p) {
+			sizes[l.Digest] = l.Size
+		}
+	}
+
+	for _, m := range ms {
+		for _, l := range append(m.Layers, m.Config) {
+			add(l)
+		}
+	}
+
+	for _, l := range layers {
+		add(l)
+	}
+
+	var size int64
+	for _, s := range sizes {
+		size += s
+	}
+	return size
+}
+
+// reserveDisk checks that the model n fits within the disk quota with
+// layers, some of which may already be in the store. Saved chat session
+// caches count against the quota and are removed first if it doesn't, as
+// they can be rebuilt. If it still doesn't and GOOBLA_EVICT_MODELS is set,
+// the least recently used models that aren't pinned are deleted until it
+// does.
+func reserveDisk(n model.Name, layers []Layer, fn func(api.ProgressResponse)) error {
+	limit := maxDisk()
+	if limit == 0 {
+		return nil
+	}
+
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+
+	ms, err := Manifests(true)
+	if err != nil {
+		return err
+	}
+
+	sessions := sessionsSize()
+	used := storeSize(ms, nil) + sessions
+	projected := storeSize(ms, layers) + sessions
+	if projected <= limit {
+		return nil
+	}
+
+	if sessions > 0 {
+		if err := pruneSessions(max(0, limit-storeSize(ms, layers))); err != nil {
+			return err
+		}
+
+		sessions = sessionsSize()
+		used = storeSize(ms, nil) + sessions
+		projected = storeSize(ms, layers) + sessions
+		if projected <= limit {
+			return nil
+		}
+	}
+
+	if !envconfig.EvictModels() {
+		return fmt.Errorf("%w: %s needs %s but %s of %s is in use", errDiskQuota, n.DisplayShortest(), format.HumanBytes2(uint64(projected-used)), format.HumanBytes2(uint64(used)), format.HumanBytes2(uint64(limit)))
+	}
+
+	keep := make(map[string]bool)
+	for _, l := range layers {
+		keep[l.Digest] = true
+	}
+
+	usage, err := readUsageState()
+	if err != nil {
+		return err
+	}
+
+	lastUsed := func(name model.Name) time.Time {
+		if u, ok := usage.Models[usageKey(name)]; ok && !u.LastUsed.IsZero() {
+			return u.LastUsed
+		}
+		return ms[name].fi.ModTime()
+	}
+
+	var candidates []model.Name
+	for name, m := range ms {
+		// a model being replaced can't be evicted to make room for itself
+		if strings.EqualFold(name.String(), n.String()) || usage.pinned(name) {
+			continue
+		}
+
+		if inReadOnlyModelsDir(m.filepath) {
+			continue
+		}
+
+		candidates = append(candidates, name)
+	}
+
+	slices.SortFunc(candidates, func(a, b model.Name) int {
+		return cmp.Or(lastUsed(a).Compare(lastUsed(b)), cmp.Compare(a.String(), b.String()))
+	})
+
+	for _, name := range candidates {
+		if projected <= limit {
+			break
+		}
+
+		fn(api.ProgressResponse{Status: fmt.Sprintf("evicting %s", name.DisplayShortest())})
+		slog.Info("evicting model to stay within disk quota", "model", name.DisplayShortest(), "last_used", lastUsed(name))
+
+		m := ms[name]
+		if err := m.Remove(); err != nil {
+			return err
+		}
+		delete(ms, name)
+
+		// layers of the new model are kept even if nothing else uses them
+		for _, l := range append(m.Layers, m.Config) {
+			if keep[l.Digest] {
+				continue
+			}
+
+			if err := l.Remove(); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+
+		if err := forgetModel(name); err != nil {
+			slog.Warn("couldn't forget evicted model", "model", name.DisplayShortest(), "error", err)
+		}
+		notify(webhookEvent{Event: eventModelDeleted, Model: name.DisplayShortest()})
+
+		projected = storeSize(ms, layers) + sessions
+	}
+
+	if projected > limit {
+		return fmt.Errorf("%w: %s would use %s of %s even after evicting all unpinned models", errDiskQuota, n.DisplayShortest(), format.HumanBytes2(uint64(projected)), format.HumanBytes2(uint64(limit)))
+	}
+
+	return nil
+}
+
+func (s *Server) PinHandler(c *gin.Context) {
+	var r api.PinRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	n := model.ParseName(r.Model)
+	if !n.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("name %q is invalid", r.Model)})
+		return
+	}
+
+	n, err := getExistingName(n)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !checkRead(c, n) {
+		return
+	}
+
+	if _, err := ParseNamedManifest(n); errors.Is(err, os.ErrNotExist) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found", r.Model)})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := setPinned(n, c.Request.Method != http.MethodDelete); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
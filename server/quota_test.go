@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/fs/ggml"
+	"github.com/goobla/goobla/types/model"
+)
+
+func TestReserveDisk(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	var s Server
+	for _, name := range []string{"a", "b", "c"} {
+		_, digest := createBinFile(t, ggml.KV{"general.architecture": "test", "general.name": name}, nil)
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model: name,
+			Files: map[string]string{"model.gguf": digest},
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	ms, err := Manifests(true)
+	require.NoError(t, err)
+	used := storeSize(ms, nil)
+
+	// a pinned and b used recently, so c is the least recently used model
+	// that can be evicted
+	require.NoError(t, setPinned(model.ParseName("a"), true))
+	require.NoError(t, touchModel(model.ParseName("b")))
+
+	_, digest := testBlob("new model")
+	layers := []Layer{{MediaType: "application/vnd.goobla.image.model", Digest: digest, Size: 1}}
+	noop := func(api.ProgressResponse) {}
+
+	t.Setenv("GOOBLA_MAX_DISK", strconv.FormatInt(used, 10))
+
+	t.Run("refuse", func(t *testing.T) {
+		err := reserveDisk(model.ParseName("new"), layers, noop)
+		assert.ErrorIs(t, err, errDiskQuota)
+	})
+
+	t.Run("sessions", func(t *testing.T) {
+		t.Setenv("GOOBLA_MAX_DISK", strconv.FormatInt(used+1, 10))
+
+		cache, err := sessionPath("", &Model{ModelPath: "/blobs/sha256-a"}, "chat")
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(cache, []byte("kv cache"), 0o644))
+
+		// the session cache is removed rather than a model
+		require.NoError(t, reserveDisk(model.ParseName("new"), layers, noop))
+		assert.NoFileExists(t, cache)
+
+		ms, err := Manifests(true)
+		require.NoError(t, err)
+		assert.Len(t, ms, 3)
+	})
+
+	t.Run("evict", func(t *testing.T) {
+		t.Setenv("GOOBLA_EVICT_MODELS", "1")
+
+		var statuses []string
+		require.NoError(t, reserveDisk(model.ParseName("new"), layers, func(r api.ProgressResponse) {
+			statuses = append(statuses, r.Status)
+		}))
+		assert.Equal(t, []string{"evicting c:latest"}, statuses)
+
+		for name, exists := range map[string]bool{"a": true, "b": true, "c": false} {
+			_, err := ParseNamedManifest(model.ParseName(name))
+			assert.Equal(t, exists, err == nil, name)
+		}
+
+		// nothing left to evict but the pinned model
+		layers := []Layer{{MediaType: "application/vnd.goobla.image.model", Digest: digest, Size: used}}
+		err := reserveDisk(model.ParseName("new"), layers, noop)
+		assert.ErrorIs(t, err, errDiskQuota)
+
+		_, err = ParseNamedManifest(model.ParseName("a"))
+		assert.NoError(t, err)
+		_, err = ParseNamedManifest(model.ParseName("b"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+func TestPinHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	var s Server
+	_, digest := createBinFile(t, ggml.KV{"general.architecture": "test"}, nil)
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Files: map[string]string{"model.gguf": digest},
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	pinned := func() bool {
+		w := createRequest(t, s.ListHandler, nil)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp api.ListResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		require.Len(t, resp.Models, 1)
+		return resp.Models[0].Pinned
+	}
+
+	pin := func(method, name string) int {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(method, "/api/pin", strings.NewReader(`{"model":"`+name+`"}`))
+		s.PinHandler(c)
+		return w.Code
+	}
+
+	assert.False(t, pinned())
+
+	assert.Equal(t, http.StatusOK, pin(http.MethodPost, "test"))
+	assert.True(t, pinned())
+
+	assert.Equal(t, http.StatusOK, pin(http.MethodDelete, "test"))
+	assert.False(t, pinned())
+
+	assert.Equal(t, http.StatusNotFound, pin(http.MethodPost, "missing"))
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/goobla/goobla/envconfig"
+	"github.com/goobla/goobla/format"
+)
+
+// maxRateLimitChunk is the most data passed through a rate limiter at once,
+// which keeps transfers smooth rather than bursty.
+const maxRateLimitChunk = 32 * format.KibiByte
+
+// rateLimiter is a token bucket limiting the combined throughput of the
+// transfers sharing it to rate bytes per second. A nil rateLimiter does not
+// limit anything.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a rate limiter for rate bytes per second, or nil if
+// rate is not positive.
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	burst := max(float64(rate)/10, maxRateLimitChunk)
+	return &rateLimiter{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait blocks until n bytes may be transferred. Waiters take tokens ahead of
+// time, going into debt, so concurrent transfers are served in turn.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	d := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+var serverLimiter struct {
+	mu      sync.Mutex
+	setting string
+	*rateLimiter
+}
+
+// serverRateLimiter returns the rate limiter shared by all transfers, as set
+// by GOOBLA_MAX_BANDWIDTH, or nil if there is no limit.
+func serverRateLimiter() *rateLimiter {
+	serverLimiter.mu.Lock()
+	defer serverLimiter.mu.Unlock()
+
+	if s := envconfig.MaxBandwidth(); s != serverLimiter.setting {
+		serverLimiter.setting = s
+		serverLimiter.rateLimiter = nil
+		if s != "" {
+			rate, err := format.ParseBytes(s)
+			if err != nil {
+				slog.Warn("invalid GOOBLA_MAX_BANDWIDTH, ignoring", "error", err)
+			}
+			serverLimiter.rateLimiter = newRateLimiter(rate)
+		}
+	}
+
+	return serverLimiter.rateLimiter
+}
+
+// rateLimitReader limits reads from r by the server rate limiter and
+// limiter, which may be nil.
+func rateLimitReader(ctx context.Context, r io.Reader, limiter *rateLimiter) io.Reader {
+	limiters := limitersOf(limiter)
+	if len(limiters) == 0 {
+		return r
+	}
+
+	return &rateLimitedReader{ctx: ctx, r: r, limiters: limiters}
+}
+
+// rateLimitWriter limits writes to w by the server rate limiter and
+// limiter, which may be nil.
+func rateLimitWriter(ctx context.Context, w io.Writer, limiter *rateLimiter) io.Writer {
+	limiters := limitersOf(limiter)
+	if len(limiters) == 0 {
+		return w
+	}
+
+	return &rateLimitedWriter{ctx: ctx, w: w, limiters: limiters}
+}
+
+func limitersOf(limiter *rateLimiter) []*rateLimiter {
+	var limiters []*rateLimiter
+	for _, l := range []*rateLimiter{serverRateLimiter(), limiter} {
+		if l != nil {
+			limiters = append(limiters, l)
+		}
+	}
+	return limiters
+}
+
+func waitAll(ctx context.Context, limiters []*rateLimiter, n int) error {
+	for _, l := range limiters {
+		if err := l.wait(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type rateLimitedReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*rateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > maxRateLimitChunk {
+		p = p[:maxRateLimitChunk]
+	}
+
+	n, err := r.r.Read(p)
+	if err := waitAll(r.ctx, r.limiters, n); err != nil {
+		return n, err
+	}
+
+	return n, err
+}
+
+type rateLimitedWriter struct {
+	ctx      context.Context
+	w        io.Writer
+	limiters []*rateLimiter
+}
+
+func (w *rateLimitedWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxRateLimitChunk)]
+		if err := waitAll(w.ctx, w.limiters, len(chunk)); err != nil {
+			return written, err
+		}
+
+		n, err := w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		p = p[n:]
+	}
+
+	return written, nil
+}
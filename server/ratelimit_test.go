@@ -0,0 +1,67 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	assert.Nil(t, newRateLimiter(0))
+	assert.Nil(t, newRateLimiter(-1))
+
+	t.Setenv("GOOBLA_MAX_BANDWIDTH", "")
+	assert.Nil(t, serverRateLimiter())
+
+	r := bytes.NewReader(nil)
+	assert.Same(t, r, rateLimitReader(t.Context(), r, nil), "unlimited readers are not wrapped")
+
+	// the first 100KB are the burst, the rest take 200ms at 1MB/s
+	const rate = 1_000_000
+	data := bytes.Repeat([]byte{'a'}, 300_000)
+
+	t.Run("reader", func(t *testing.T) {
+		start := time.Now()
+		b, err := io.ReadAll(rateLimitReader(t.Context(), bytes.NewReader(data), newRateLimiter(rate)))
+		require.NoError(t, err)
+		assert.Equal(t, data, b)
+		assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+	})
+
+	t.Run("writer", func(t *testing.T) {
+		var buf bytes.Buffer
+		start := time.Now()
+		n, err := rateLimitWriter(t.Context(), &buf, newRateLimiter(rate)).Write(data)
+		require.NoError(t, err)
+		assert.Equal(t, len(data), n)
+		assert.Equal(t, data, buf.Bytes())
+		assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+	})
+
+	t.Run("server", func(t *testing.T) {
+		t.Setenv("GOOBLA_MAX_BANDWIDTH", "1MB")
+		l := serverRateLimiter()
+		require.NotNil(t, l)
+		assert.InDelta(t, rate, l.rate, 0)
+		assert.Same(t, l, serverRateLimiter(), "the server limiter is shared")
+
+		start := time.Now()
+		b, err := io.ReadAll(rateLimitReader(t.Context(), bytes.NewReader(data), nil))
+		require.NoError(t, err)
+		assert.Equal(t, data, b)
+		assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		l := newRateLimiter(1)
+		ctx, cancel := context.WithCancel(t.Context())
+		cancel()
+		_, err := io.ReadAll(rateLimitReader(ctx, bytes.NewReader(data), l))
+		require.ErrorIs(t, err, context.Canceled)
+	})
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package server
+
+import "errors"
+
+func reflink(string, string) error {
+	return errors.ErrUnsupported
+}
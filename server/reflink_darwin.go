@@ -0,0 +1,17 @@
+package server
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// reflink makes the existing file at dst share the contents of src.
+func reflink(src, dst string) error {
+	// clonefile creates dst, which must not exist
+	if err := os.Remove(dst); err != nil {
+		return err
+	}
+
+	return unix.Clonefile(src, dst, unix.CLONE_NOFOLLOW)
+}
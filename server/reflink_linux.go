@@ -0,0 +1,24 @@
+package server
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// reflink makes the existing file at dst share the contents of src.
+func reflink(src, dst string) error {
+	s, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	d, err := os.OpenFile(dst, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return unix.IoctlFileClone(int(d.Fd()), int(s.Fd()))
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/goobla/goobla/envconfig"
+)
+
+// registryConfig holds the connection settings for a single registry host,
+// as read from the registries config file:
+//
+//	{
+//	  "registries": {
+//	    "registry.example.com": {
+//	      "scheme": "oci",
+//	      "ca_cert": "certs/ca.pem",
+//	      "token": "..."
+//	    }
+//	  }
+//	}
+//
+// Relative certificate paths are resolved against the directory containing
+// the config file.
+type registryConfig struct {
+	// Scheme is the protocol used for the registry when a model name does
+	// not specify one: "https", "http" or "oci".
+	Scheme string `json:"scheme,omitempty"`
+
+	// Insecure skips verification of the registry's TLS certificate.
+	Insecure bool `json:"insecure,omitempty"`
+
+	// CACert is a PEM bundle of certificate authorities trusted in
+	// addition to the system pool.
+	CACert string `json:"ca_cert,omitempty"`
+
+	// ClientCert and ClientKey are a PEM encoded certificate and key
+	// presented to the registry for mutual TLS.
+	ClientCert string `json:"client_cert,omitempty"`
+	ClientKey  string `json:"client_key,omitempty"`
+
+	// Token is sent as a bearer token. Username and Password are sent
+	// using basic authentication or exchanged for a token with OCI
+	// registries. Credentials given with a request take precedence.
+	Token    string `json:"token,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+type registriesFile struct {
+	Registries map[string]registryConfig `json:"registries"`
+}
+
+// registries caches the registries config file, and the transports of the
+// registries it configures, until the file changes.
+var registries struct {
+	cachedFile[map[string]registryConfig]
+	transports map[string]*http.Transport
+}
+
+// loadRegistryConfigs reads the registries config file, returning the
+// settings keyed by lowercase registry host. A missing file is not an error.
+// The file is only read again when it changes, so changes take effect
+// without restarting the server.
+func loadRegistryConfigs() (map[string]registryConfig, error) {
+	registries.Lock()
+	defer registries.Unlock()
+
+	return loadRegistryConfigsLocked()
+}
+
+func loadRegistryConfigsLocked() (map[string]registryConfig, error) {
+	configs, err := registries.load(envconfig.RegistriesConfig(), func(p string, b []byte) (map[string]registryConfig, error) {
+		configs, err := parseRegistryConfigs(p, b)
+		if err == nil {
+			resetRegistryTransports()
+		}
+		return configs, err
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		resetRegistryTransports()
+		return nil, nil
+	}
+	return configs, err
+}
+
+func parseRegistryConfigs(p string, b []byte) (map[string]registryConfig, error) {
+	var f registriesFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+
+	resolve := func(s string) string {
+		if s == "" || filepath.IsAbs(s) {
+			return s
+		}
+		return filepath.Join(filepath.Dir(p), s)
+	}
+
+	configs := make(map[string]registryConfig, len(f.Registries))
+	for host, c := range f.Registries {
+		switch c.Scheme {
+		case "", "http", "https", OCIProtocolScheme:
+		default:
+			return nil, fmt.Errorf("%s: registry %q: %w %q", p, host, ErrInvalidProtocol, c.Scheme)
+		}
+
+		if (c.ClientCert == "") != (c.ClientKey == "") {
+			return nil, fmt.Errorf("%s: registry %q: client_cert and client_key must be set together", p, host)
+		}
+
+		c.CACert = resolve(c.CACert)
+		c.ClientCert = resolve(c.ClientCert)
+		c.ClientKey = resolve(c.ClientKey)
+		configs[strings.ToLower(host)] = c
+	}
+
+	return configs, nil
+}
+
+// resetRegistryTransports forgets the transports made for the previous
+// registries config, closing their idle connections.
+func resetRegistryTransports() {
+	for _, tr := range registries.transports {
+		tr.CloseIdleConnections()
+	}
+
+	registries.transports = nil
+}
+
+// lookupRegistryConfig returns the settings for host from the registries
+// config file.
+func lookupRegistryConfig(host string) (registryConfig, bool) {
+	configs, err := loadRegistryConfigs()
+	if err != nil {
+		slog.Warn("ignoring invalid registries config", "error", err)
+		return registryConfig{}, false
+	}
+
+	c, ok := configs[strings.ToLower(host)]
+	return c, ok
+}
+
+// apply fills in credentials and protocol options from c that are not
+// already set in opts.
+func (c registryConfig) apply(opts *registryOptions) {
+	if opts.Token == "" && opts.Username == "" {
+		opts.Token = c.Token
+		opts.Username = c.Username
+		opts.Password = c.Password
+	}
+
+	if c.Scheme == OCIProtocolScheme {
+		opts.OCI = true
+	}
+}
+
+// tlsConfig returns the TLS configuration described by c, or nil if c uses
+// the defaults.
+func (c registryConfig) tlsConfig() (*tls.Config, error) {
+	if !c.Insecure && c.CACert == "" && c.ClientCert == "" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		InsecureSkipVerify: c.Insecure, //nolint:gosec // explicitly requested in the registries config
+	}
+
+	if c.CACert != "" {
+		pem, err := os.ReadFile(c.CACert)
+		if err != nil {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", c.CACert)
+		}
+
+		cfg.RootCAs = pool
+	}
+
+	if c.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// registryTransport returns the transport to use for requests to host, or
+// nil to use the default transport. Transports are made once per host, so
+// connections to registries are reused, until the registries config changes.
+func registryTransport(host string) (http.RoundTripper, error) {
+	if testMakeRequestDialContext != nil {
+		c, _ := lookupRegistryConfig(host)
+		tr, err := newRegistryTransport(host, c)
+		if err != nil {
+			return nil, err
+		}
+
+		if tr == nil {
+			tr = http.DefaultTransport.(*http.Transport).Clone()
+		}
+
+		tr.DialContext = testMakeRequestDialContext
+		return tr, nil
+	}
+
+	registries.Lock()
+	defer registries.Unlock()
+
+	configs, err := loadRegistryConfigsLocked()
+	if err != nil {
+		slog.Warn("ignoring invalid registries config", "error", err)
+		return nil, nil
+	}
+
+	host = strings.ToLower(host)
+	c, ok := configs[host]
+	if !ok {
+		return nil, nil
+	}
+
+	if tr, ok := registries.transports[host]; ok {
+		return tr, nil
+	}
+
+	tr, err := newRegistryTransport(host, c)
+	if err != nil {
+		return nil, err
+	} else if tr == nil {
+		return nil, nil
+	}
+
+	if registries.transports == nil {
+		registries.transports = make(map[string]*http.Transport)
+	}
+
+	registries.transports[host] = tr
+	return tr, nil
+}
+
+// newRegistryTransport returns a transport with the TLS settings of c, or nil
+// if c uses the defaults.
+func newRegistryTransport(host string, c registryConfig) (*http.Transport, error) {
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, fmt.Errorf("registry %s: %w", host, err)
+	} else if tlsConfig == nil {
+		return nil, nil
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = tlsConfig
+	return tr, nil
+}
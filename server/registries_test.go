@@ -0,0 +1,181 @@
+package server
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeRegistriesConfig(t *testing.T, s string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	p := filepath.Join(dir, "registries.json")
+	require.NoError(t, os.WriteFile(p, []byte(s), 0o644))
+	t.Setenv("GOOBLA_REGISTRIES_CONFIG", p)
+	return dir
+}
+
+func TestLoadRegistryConfigs(t *testing.T) {
+	t.Run("missing", func(t *testing.T) {
+		t.Setenv("GOOBLA_REGISTRIES_CONFIG", filepath.Join(t.TempDir(), "registries.json"))
+
+		configs, err := loadRegistryConfigs()
+		require.NoError(t, err)
+		assert.Empty(t, configs)
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		dir := writeRegistriesConfig(t, `{"registries": {"Registry.Example.com": {"scheme": "oci", "ca_cert": "ca.pem", "client_cert": "/certs/client.pem", "client_key": "/certs/client.key", "token": "secret"}}}`)
+
+		c, ok := lookupRegistryConfig("registry.example.com")
+		require.True(t, ok)
+		assert.Equal(t, registryConfig{
+			Scheme:     "oci",
+			CACert:     filepath.Join(dir, "ca.pem"),
+			ClientCert: "/certs/client.pem",
+			ClientKey:  "/certs/client.key",
+			Token:      "secret",
+		}, c)
+
+		_, ok = lookupRegistryConfig("other.example.com")
+		assert.False(t, ok)
+	})
+
+	t.Run("invalid scheme", func(t *testing.T) {
+		writeRegistriesConfig(t, `{"registries": {"example.com": {"scheme": "ftp"}}}`)
+
+		_, err := loadRegistryConfigs()
+		require.ErrorIs(t, err, ErrInvalidProtocol)
+	})
+
+	t.Run("client cert without key", func(t *testing.T) {
+		writeRegistriesConfig(t, `{"registries": {"example.com": {"client_cert": "client.pem"}}}`)
+
+		_, err := loadRegistryConfigs()
+		require.Error(t, err)
+	})
+}
+
+func TestRegistryConfigModelPath(t *testing.T) {
+	writeRegistriesConfig(t, `{"registries": {"plain.example.com": {"scheme": "http"}, "oci.example.com": {"scheme": "oci"}}}`)
+
+	cases := []struct {
+		name    string
+		baseURL string
+		oci     bool
+	}{
+		{"plain.example.com/ns/repo", "http://plain.example.com", false},
+		{"https://plain.example.com/ns/repo", "http://plain.example.com", false},
+		{"oci.example.com/ns/repo", "https://oci.example.com", true},
+		{"other.example.com/ns/repo", "https://other.example.com", false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			mp := ParseModelPath(tt.name)
+			assert.Equal(t, tt.baseURL, mp.BaseURL().String())
+			assert.Equal(t, tt.oci, mp.IsOCI())
+		})
+	}
+}
+
+func TestRegistryConfigApply(t *testing.T) {
+	c := registryConfig{Scheme: "oci", Username: "user", Password: "pass"}
+
+	var opts registryOptions
+	c.apply(&opts)
+	assert.Equal(t, registryOptions{Username: "user", Password: "pass", OCI: true}, opts)
+
+	// credentials from the request take precedence
+	opts = registryOptions{Token: "token"}
+	c.apply(&opts)
+	assert.Equal(t, registryOptions{Token: "token", OCI: true}, opts)
+}
+
+func TestRegistryConfigCACert(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	get := func() (*http.Response, error) {
+		return makeRequest(t.Context(), http.MethodGet, u.JoinPath("v2"), nil, nil, &registryOptions{})
+	}
+
+	// the test server's certificate is not trusted by default
+	_, err = get()
+	require.Error(t, err)
+
+	dir := writeRegistriesConfig(t, `{"registries": {"`+u.Host+`": {"ca_cert": "ca.pem"}}}`)
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ca.pem"), ca, 0o644))
+
+	resp, err := get()
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	var opts registryOptions
+	c, _ := lookupRegistryConfig(u.Host)
+	c.Token = "secret"
+	c.apply(&opts)
+
+	resp, err = makeRequest(t.Context(), http.MethodGet, u.JoinPath("v2"), nil, nil, &opts)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	writeRegistriesConfig(t, `{"registries": {"`+u.Host+`": {"insecure": true}}}`)
+	resp, err = get()
+	require.NoError(t, err)
+	resp.Body.Close()
+}
+
+func TestRegistryTransportCache(t *testing.T) {
+	dir := writeRegistriesConfig(t, `{"registries": {"insecure.example.com": {"insecure": true}, "plain.example.com": {"token": "secret"}}}`)
+	p := filepath.Join(dir, "registries.json")
+
+	tr, err := registryTransport("insecure.example.com")
+	require.NoError(t, err)
+	require.NotNil(t, tr)
+
+	// the same transport is used until the config changes, so connections
+	// are reused
+	again, err := registryTransport("Insecure.Example.com")
+	require.NoError(t, err)
+	assert.Same(t, tr, again)
+
+	tr, err = registryTransport("plain.example.com")
+	require.NoError(t, err)
+	assert.Nil(t, tr, "registries without TLS settings use the default transport")
+
+	// changes to the config take effect
+	require.NoError(t, os.WriteFile(p, []byte(`{"registries": {"insecure.example.com": {"insecure":false}}}`), 0o644))
+	mtime := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(p, mtime, mtime))
+	tr, err = registryTransport("insecure.example.com")
+	require.NoError(t, err)
+	assert.Nil(t, tr)
+
+	// but the config isn't read again until its modification time or size
+	// changes
+	require.NoError(t, os.WriteFile(p, []byte(`{"registries": {"insecure.example.com": {"insecure": true}}}`), 0o644))
+	require.NoError(t, os.Chtimes(p, mtime, mtime))
+	tr, err = registryTransport("insecure.example.com")
+	require.NoError(t, err)
+	assert.Nil(t, tr)
+}
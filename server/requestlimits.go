@@ -0,0 +1,205 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/anthropic"
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/envconfig"
+	"github.com/goobla/goobla/openai"
+)
+
+// Each client, identified as for the client limiter, can make at most
+// GOOBLA_RATE_LIMIT_RPM inference requests a minute, and have at most
+// GOOBLA_RATE_LIMIT_TPM prompt and generated tokens a minute evaluated for
+// its generate and chat requests. API keys can have their own
+// limits. Requests over a limit are refused with a 429 and a Retry-After
+// header of when the client can try again.
+//
+// Both limits are token buckets holding a minute of the limit, so a client
+// can use a whole minute's quota at once. The tokens of a request are only
+// known once it's done, so a client over its token limit can't start new
+// requests until the tokens it owes are refilled.
+
+const (
+	rateLimitRequests = "requests"
+	rateLimitTokens   = "tokens"
+
+	// apiKeyContextKey is the API key the request was made with.
+	apiKeyContextKey = "apiKey"
+
+	// rateChargeContextKey is the function the tokens evaluated for the
+	// request are charged to its client with.
+	rateChargeContextKey = "rateCharge"
+)
+
+// rateBucket is the quota left of a client for one of its limits.
+type rateBucket struct {
+	quota float64
+	limit uint
+	last  time.Time
+}
+
+// full reports whether the bucket would be refilled to a minute of its limit
+// by now, so forgetting it doesn't forgive quota the client owes.
+func (b *rateBucket) full(now time.Time) bool {
+	return b.quota+now.Sub(b.last).Minutes()*float64(b.limit) >= float64(b.limit)
+}
+
+// refill adds the quota earned since the bucket was last used, up to a
+// minute of limit.
+func (b *rateBucket) refill(limit uint, now time.Time) {
+	b.quota = min(float64(limit), b.quota+now.Sub(b.last).Minutes()*float64(limit))
+	b.last = now
+}
+
+// wait returns how long until the bucket has a whole unit of quota.
+func (b *rateBucket) wait(limit uint) time.Duration {
+	if b.quota >= 1 {
+		return 0
+	}
+
+	return time.Duration((1 - b.quota) / float64(limit) * float64(time.Minute))
+}
+
+type requestLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+	swept   time.Time
+}
+
+func newRequestLimiter() *requestLimiter {
+	return &requestLimiter{buckets: make(map[string]*rateBucket)}
+}
+
+// bucket returns the refilled bucket of the limit of client id. It must be
+// called with l.mu held.
+func (l *requestLimiter) bucket(id, kind string, limit uint, now time.Time) *rateBucket {
+	// full buckets are forgotten so clients that have stopped making
+	// requests aren't kept forever
+	if now.Sub(l.swept) > time.Minute {
+		for k, b := range l.buckets {
+			if b.full(now) {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+
+	k := kind + ":" + id
+	b, ok := l.buckets[k]
+	if !ok {
+		b = &rateBucket{quota: float64(limit), last: now}
+		l.buckets[k] = b
+	}
+
+	b.limit = limit
+	b.refill(limit, now)
+	return b
+}
+
+// allow takes a request from the quota of client id, returning how long
+// until it can make one and which limit it's over if it can't.
+func (l *requestLimiter) allow(id string, rpm, tpm uint, now time.Time) (time.Duration, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if tpm > 0 {
+		if d := l.bucket(id, rateLimitTokens, tpm, now).wait(tpm); d > 0 {
+			return d, rateLimitTokens
+		}
+	}
+
+	if rpm > 0 {
+		b := l.bucket(id, rateLimitRequests, rpm, now)
+		if d := b.wait(rpm); d > 0 {
+			return d, rateLimitRequests
+		}
+		b.quota--
+	}
+
+	return 0, ""
+}
+
+// charge takes n tokens from the quota of client id, which may leave it
+// owing tokens.
+func (l *requestLimiter) charge(id string, tpm uint, n int, now time.Time) {
+	if tpm == 0 || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bucket(id, rateLimitTokens, tpm, now).quota -= float64(n)
+}
+
+// rateLimits returns the client of the request c and its limits.
+func rateLimits(c *gin.Context) (id string, rpm, tpm uint) {
+	id, rpm, tpm = clientID(c), envconfig.RateLimitRPM(), envconfig.RateLimitTPM()
+	if key, ok := c.Get(apiKeyContextKey); ok {
+		key := key.(*api.APIKey)
+		if key.RequestsPerMinute > 0 {
+			rpm = key.RequestsPerMinute
+		}
+		if key.TokensPerMinute > 0 {
+			tpm = key.TokensPerMinute
+		}
+	}
+
+	return id, rpm, tpm
+}
+
+// rateLimitError returns the body of the error for a request to path over
+// its limit, in the format of the API it was made to.
+func rateLimitError(path, kind string) any {
+	msg := fmt.Sprintf("rate limit reached for %s per minute, please try again later", kind)
+	switch {
+	case strings.HasPrefix(path, "/v1/"):
+		code := "rate_limit_exceeded"
+		return openai.ErrorResponse{Error: openai.Error{Type: kind, Message: msg, Code: &code}}
+	case strings.HasPrefix(path, "/anthropic/"):
+		return anthropic.NewError(http.StatusTooManyRequests, msg)
+	default:
+		return gin.H{"error": msg}
+	}
+}
+
+// middleware refuses the requests of clients over their limits, and lets
+// the handler charge the tokens evaluated for the request with chargeTokens.
+// It must come before the middleware of the OpenAI and Anthropic
+// compatible endpoints so its errors aren't rewritten.
+func (l *requestLimiter) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, rpm, tpm := rateLimits(c)
+		if rpm == 0 && tpm == 0 {
+			c.Next()
+			return
+		}
+
+		if d, kind := l.allow(id, rpm, tpm, time.Now()); d > 0 {
+			rateLimitedTotal.add(1, kind)
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, rateLimitError(c.Request.URL.Path, kind))
+			return
+		}
+
+		c.Set(rateChargeContextKey, func(n int) { l.charge(id, tpm, n, time.Now()) })
+		c.Next()
+	}
+}
+
+// chargeTokens charges the n tokens evaluated for the request c to its
+// client's rate limit.
+func chargeTokens(c *gin.Context, n int) {
+	if charge, ok := c.Get(rateChargeContextKey); ok {
+		charge.(func(int))(n)
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/openai"
+)
+
+func TestRequestLimiter(t *testing.T) {
+	l := newRequestLimiter()
+	now := time.Now()
+
+	t.Run("requests", func(t *testing.T) {
+		for i := range 2 {
+			if d, _ := l.allow("a", 2, 0, now); d != 0 {
+				t.Fatalf("expected request %d to be allowed, got a wait of %s", i, d)
+			}
+		}
+
+		d, kind := l.allow("a", 2, 0, now)
+		if kind != rateLimitRequests || d != 30*time.Second {
+			t.Fatalf("expected a wait of 30s for requests, got %s for %q", d, kind)
+		}
+
+		if d, _ := l.allow("b", 2, 0, now); d != 0 {
+			t.Errorf("expected another client to be allowed, got a wait of %s", d)
+		}
+
+		if d, _ := l.allow("a", 2, 0, now.Add(30*time.Second)); d != 0 {
+			t.Errorf("expected the request to be allowed once refilled, got a wait of %s", d)
+		}
+	})
+
+	t.Run("tokens", func(t *testing.T) {
+		if d, _ := l.allow("c", 0, 60, now); d != 0 {
+			t.Fatalf("expected the request to be allowed, got a wait of %s", d)
+		}
+
+		// the request used more tokens than a minute's quota
+		l.charge("c", 60, 90, now)
+
+		d, kind := l.allow("c", 0, 60, now)
+		if kind != rateLimitTokens || d != 31*time.Second {
+			t.Fatalf("expected a wait of 31s for tokens, got %s for %q", d, kind)
+		}
+
+		if d, _ := l.allow("c", 0, 60, now.Add(31*time.Second)); d != 0 {
+			t.Errorf("expected the request to be allowed once refilled, got a wait of %s", d)
+		}
+	})
+
+	t.Run("debt", func(t *testing.T) {
+		l := newRequestLimiter()
+		if d, _ := l.allow("d", 0, 60, now); d != 0 {
+			t.Fatalf("expected the request to be allowed, got a wait of %s", d)
+		}
+
+		// the request used ten minutes of quota, which the client still
+		// owes after the idle buckets are swept
+		l.charge("d", 60, 600, now)
+
+		d, kind := l.allow("d", 0, 60, now.Add(2*time.Minute))
+		if kind != rateLimitTokens || d != 7*time.Minute+time.Second {
+			t.Fatalf("expected a wait of 7m1s for tokens, got %s for %q", d, kind)
+		}
+
+		// once refilled, the bucket is forgotten
+		l.allow("e", 0, 60, now.Add(20*time.Minute))
+		if _, ok := l.buckets[rateLimitTokens+":d"]; ok {
+			t.Error("expected the refilled bucket to be forgotten")
+		}
+	})
+}
+
+func TestRequestLimiterMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("GOOBLA_RATE_LIMIT_RPM", "1")
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		if id := c.GetHeader("X-Test-Key"); id != "" {
+			c.Set(apiKeyContextKey, &api.APIKey{ID: id, RequestsPerMinute: 2})
+		}
+	})
+	rates := newRequestLimiter().middleware()
+	r.POST("/api/generate", rates, func(c *gin.Context) {})
+	r.POST("/v1/chat/completions", rates, func(c *gin.Context) {})
+
+	post := func(path, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		if key != "" {
+			req.Header.Set("X-Test-Key", key)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post("/api/generate", ""); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	w := post("/api/generate", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d", w.Code)
+	}
+
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("expected Retry-After 60, got %q", got)
+	}
+
+	w = post("/v1/chat/completions", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d", w.Code)
+	}
+
+	var resp openai.ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Error.Type != rateLimitRequests || resp.Error.Code == nil || *resp.Error.Code != "rate_limit_exceeded" {
+		t.Errorf("expected an OpenAI rate limit error, got %+v", resp.Error)
+	}
+
+	// the key has its own, higher limit
+	for i := range 2 {
+		if w := post("/api/generate", "k"); w.Code != http.StatusOK {
+			t.Fatalf("expected request %d with the key to be allowed, got %d", i, w.Code)
+		}
+	}
+
+	if w := post("/api/generate", "k"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status 429 over the key's limit, got %d", w.Code)
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"math"
+	"slices"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/fs/ggml"
+	"github.com/goobla/goobla/llm"
+)
+
+// poolingTypeRank is the pooling type of reranking models. Instead of
+// embedding their input they score it with a classification head, giving a
+// single value for the relevance of a document to a query.
+const poolingTypeRank = 4
+
+// rerankTemplate returns the text joining a query and a document in the
+// input of the reranking model with kv, and the text ending it: the end of
+// sequence and separator tokens the model was trained with, like
+// "<s>query</s></s>document</s>".
+func rerankTemplate(ctx context.Context, r llm.LlamaServer, kv ggml.KV) (sep, end string, err error) {
+	eos := int(kv.Uint("tokenizer.ggml.eos_token_id"))
+
+	tokens := []int{eos}
+	if _, ok := kv["tokenizer.ggml.seperator_token_id"]; ok {
+		tokens = append(tokens, int(kv.Uint("tokenizer.ggml.seperator_token_id")))
+	}
+
+	sep, err = r.Detokenize(ctx, tokens)
+	if err != nil {
+		return "", "", err
+	}
+
+	// the tokenizer adds the end of sequence token if the model expects it
+	if !kv.Bool("tokenizer.ggml.add_eos_token") {
+		end, err = r.Detokenize(ctx, []int{eos})
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	return sep, end, nil
+}
+
+// rerankResults returns the results for the documents with the scores,
+// which are logits, most relevant first and limited to the topN most
+// relevant when topN is more than zero.
+func rerankResults(documents []string, scores []float32, topN int, returnDocuments bool) []api.RerankResult {
+	results := make([]api.RerankResult, len(documents))
+	for i, score := range scores {
+		results[i] = api.RerankResult{
+			Index:          i,
+			RelevanceScore: 1 / (1 + math.Exp(-float64(score))),
+		}
+
+		if returnDocuments {
+			results[i].Document = documents[i]
+		}
+	}
+
+	slices.SortStableFunc(results, func(a, b api.RerankResult) int {
+		return cmp.Compare(b.RelevanceScore, a.RelevanceScore)
+	})
+
+	if topN > 0 && topN < len(results) {
+		results = results[:topN]
+	}
+
+	return results
+}
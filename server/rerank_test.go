@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/discover"
+	"github.com/goobla/goobla/fs/ggml"
+)
+
+// mockReranker scores documents by whether they mention the query, which is
+// the text before the separator.
+type mockReranker struct {
+	mockRunner
+
+	mu     sync.Mutex
+	inputs []string
+}
+
+func (m *mockReranker) Embedding(_ context.Context, s string) ([]float32, error) {
+	m.mu.Lock()
+	m.inputs = append(m.inputs, s)
+	m.mu.Unlock()
+
+	query, doc, _ := strings.Cut(s, "</s></s>")
+	if strings.Contains(doc, query) {
+		return []float32{2}, nil
+	}
+
+	return []float32{-2}, nil
+}
+
+func (*mockReranker) Detokenize(_ context.Context, tokens []int) (string, error) {
+	var sb strings.Builder
+	for range tokens {
+		sb.WriteString("</s>")
+	}
+
+	return sb.String(), nil
+}
+
+func TestRerank(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var mock mockReranker
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			getGpuFn:      discover.GetGPUInfo,
+			getCpuFn:      discover.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, _ *ggml.GGML, _ discover.GpuInfoList, _ int) {
+				// add small delay to simulate loading
+				time.Sleep(time.Millisecond)
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(t.Context())
+
+	createModel := func(name string, pooling uint32) {
+		_, digest := createBinFile(t, ggml.KV{
+			"general.architecture":              "bert",
+			"bert.block_count":                  uint32(1),
+			"bert.context_length":               uint32(512),
+			"bert.embedding_length":             uint32(4),
+			"bert.attention.head_count":         uint32(1),
+			"bert.pooling_type":                 pooling,
+			"tokenizer.ggml.tokens":             []string{"<s>", "<pad>", "</s>"},
+			"tokenizer.ggml.scores":             []float32{0, 0, 0},
+			"tokenizer.ggml.token_type":         []int32{3, 3, 3},
+			"tokenizer.ggml.eos_token_id":       uint32(2),
+			"tokenizer.ggml.seperator_token_id": uint32(2),
+			"tokenizer.ggml.add_eos_token":      true,
+		}, []*ggml.Tensor{
+			{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		})
+
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:  name,
+			Files:  map[string]string{"file.gguf": digest},
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	createModel("reranker", poolingTypeRank)
+	createModel("embedder", 1)
+
+	t.Run("rerank", func(t *testing.T) {
+		mock.inputs = nil
+
+		w := createRequest(t, s.RerankHandler, api.RerankRequest{
+			Model:           "reranker",
+			Query:           "goobla",
+			Documents:       []string{"a llama", "goobla runs models", "the goobla server"},
+			TopN:            2,
+			ReturnDocuments: true,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.RerankResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []api.RerankResult{
+			{Index: 1, Document: "goobla runs models", RelevanceScore: 0.8807970779778823},
+			{Index: 2, Document: "the goobla server", RelevanceScore: 0.8807970779778823},
+		}
+		if diff := cmp.Diff(want, resp.Results); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		if len(mock.inputs) != 3 || !strings.Contains(strings.Join(mock.inputs, "\n"), "goobla</s></s>a llama") {
+			t.Errorf("unexpected inputs %q", mock.inputs)
+		}
+	})
+
+	t.Run("missing query", func(t *testing.T) {
+		w := createRequest(t, s.RerankHandler, api.RerankRequest{Model: "reranker", Documents: []string{"a"}})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("missing model", func(t *testing.T) {
+		w := createRequest(t, s.RerankHandler, api.RerankRequest{Model: "missing", Query: "goobla"})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("not a reranker", func(t *testing.T) {
+		w := createRequest(t, s.RerankHandler, api.RerankRequest{Model: "embedder", Query: "goobla", Documents: []string{"a"}})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if !strings.Contains(w.Body.String(), "does not support rerank") {
+			t.Errorf("unexpected error %s", w.Body.String())
+		}
+	})
+}
+
+func TestRerankResults(t *testing.T) {
+	documents := []string{"a", "b", "c"}
+	scores := []float32{0, 1, -1}
+
+	got := rerankResults(documents, scores, 0, false)
+	if len(got) != 3 || got[0].Index != 1 || got[1].Index != 0 || got[2].Index != 2 || got[1].RelevanceScore != 0.5 || got[0].Document != "" {
+		t.Errorf("unexpected results %+v", got)
+	}
+
+	got = rerankResults(documents, scores, 5, true)
+	if len(got) != 3 || got[0].Document != "b" {
+		t.Errorf("unexpected results %+v", got)
+	}
+
+	got = rerankResults(documents, scores, 1, false)
+	if len(got) != 1 || got[0].Index != 1 {
+		t.Errorf("unexpected results %+v", got)
+	}
+}
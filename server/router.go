@@ -0,0 +1,248 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/envconfig"
+	"github.com/goobla/goobla/types/model"
+)
+
+// In router mode, set with GOOBLA_ROUTE_TO, the server proxies inference
+// requests to a pool of other servers rather than running models itself.
+// Each request goes to a server that already has its model loaded, or else
+// the one with the fewest requests in progress, so a small cluster can be
+// used through a single endpoint.
+
+// routerPollInterval is how often the models loaded by each backend are
+// checked.
+var routerPollInterval = 5 * time.Second
+
+var errNoBackends = errors.New("no backends available")
+
+type backend struct {
+	url   *url.URL
+	proxy *httputil.ReverseProxy
+
+	// inflight is the number of requests proxied to the backend that are
+	// in progress
+	inflight atomic.Int64
+
+	mu      sync.Mutex
+	healthy bool
+	// loaded are the names of the models the backend has loaded
+	loaded map[string]bool
+}
+
+func (b *backend) has(name string) (healthy, loaded bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.healthy, b.loaded[name]
+}
+
+// poll updates the models loaded by the backend.
+func (b *backend) poll(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, routerPollInterval)
+	defer cancel()
+
+	resp, err := api.NewClient(b.url, http.DefaultClient).ListRunning(ctx)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		if b.healthy {
+			slog.Warn("backend unavailable", "backend", b.url, "error", err)
+		}
+		b.healthy = false
+		return
+	}
+
+	b.healthy = true
+	b.loaded = make(map[string]bool, len(resp.Models))
+	for _, m := range resp.Models {
+		b.loaded[model.ParseName(m.Name).DisplayShortest()] = true
+	}
+}
+
+// router picks the backend of each request in router mode.
+type router struct {
+	backends []*backend
+}
+
+// newRouter returns the router of hosts, or nil if there are none. Hosts
+// default to the scheme http and port 11434.
+func newRouter(hosts []string) (*router, error) {
+	var r router
+	for _, host := range hosts {
+		host = strings.TrimSpace(host)
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+
+		u, err := url.Parse(host)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid backend %q", host)
+		}
+
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "11434")
+		}
+
+		b := &backend{url: u, healthy: true}
+		b.proxy = &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.SetURL(u)
+				pr.SetXForwarded()
+			},
+			// responses are streamed
+			FlushInterval: -1,
+			ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+				if errors.Is(err, context.Canceled) {
+					return
+				}
+
+				slog.Warn("backend request failed", "backend", u, "error", err)
+				b.mu.Lock()
+				b.healthy = false
+				b.mu.Unlock()
+
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadGateway)
+				json.NewEncoder(w).Encode(gin.H{"error": fmt.Sprintf("backend %s: %v", u.Host, err)})
+			},
+		}
+		r.backends = append(r.backends, b)
+	}
+
+	if len(r.backends) == 0 {
+		return nil, nil
+	}
+
+	if envconfig.Offline() {
+		return nil, fmt.Errorf("GOOBLA_ROUTE_TO: %w", errOffline)
+	}
+
+	return &r, nil
+}
+
+// run polls the backends until ctx is done.
+func (r *router) run(ctx context.Context) {
+	ticker := time.NewTicker(routerPollInterval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, b := range r.backends {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				b.poll(ctx)
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pick returns the healthy backend for the model name that has it loaded,
+// preferring the one with the fewest requests in progress.
+func (r *router) pick(name string) *backend {
+	var best *backend
+	var bestLoaded bool
+	for _, b := range r.backends {
+		healthy, loaded := b.has(name)
+		if !healthy {
+			continue
+		}
+
+		switch {
+		case best == nil,
+			loaded && !bestLoaded,
+			loaded == bestLoaded && b.inflight.Load() < best.inflight.Load():
+			best, bestLoaded = b, loaded
+		}
+	}
+
+	return best
+}
+
+// middleware proxies requests to a backend in router mode. It comes before
+// the middleware of the OpenAI and Anthropic compatible endpoints so the
+// backend receives the original request.
+func (r *router) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if r == nil {
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var req struct {
+			Model string `json:"model"`
+		}
+		// requests that aren't valid are refused by the backend
+		_ = json.Unmarshal(body, &req)
+		name := model.ParseName(req.Model).DisplayShortest()
+
+		b := r.pick(name)
+		if b == nil {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": errNoBackends.Error()})
+			return
+		}
+
+		// the backend loads the model for the request, so the next requests
+		// for it go to the same backend
+		b.mu.Lock()
+		if b.loaded == nil {
+			b.loaded = make(map[string]bool)
+		}
+		b.loaded[name] = true
+		b.mu.Unlock()
+
+		b.inflight.Add(1)
+		defer b.inflight.Add(-1)
+
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		c.Request.ContentLength = int64(len(body))
+		b.proxy.ServeHTTP(proxyWriter{c.Writer}, c.Request)
+		c.Abort()
+	}
+}
+
+// proxyWriter hides the CloseNotify method of gin's writer from the proxy,
+// as it panics if the writer it wraps doesn't implement it.
+type proxyWriter struct {
+	http.ResponseWriter
+}
+
+func (w proxyWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+)
+
+func TestRouter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	backend := func(name string, loaded ...string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/api/ps":
+				var resp api.ProcessResponse
+				for _, m := range loaded {
+					resp.Models = append(resp.Models, api.ProcessModelResponse{Name: m})
+				}
+				json.NewEncoder(w).Encode(resp)
+			default:
+				body, _ := io.ReadAll(r.Body)
+				json.NewEncoder(w).Encode(map[string]string{"backend": name, "path": r.URL.Path, "body": string(body)})
+			}
+		}))
+	}
+
+	a, b := backend("a"), backend("b", "llama3.2:latest")
+	defer a.Close()
+
+	rt, err := newRouter([]string{a.URL, b.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	poll := func() {
+		for _, b := range rt.backends {
+			b.poll(t.Context())
+		}
+	}
+	poll()
+
+	r := gin.New()
+	r.POST("/api/chat", rt.middleware(), func(c *gin.Context) {
+		t.Error("expected the request to be proxied")
+	})
+
+	chat := func(model string) (int, map[string]string) {
+		body := `{"model": "` + model + `"}`
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/chat", bytes.NewBufferString(body)))
+
+		var resp map[string]string
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code == http.StatusOK && resp["body"] != body {
+			t.Errorf("expected the body to be forwarded, got %q", resp["body"])
+		}
+		return w.Code, resp
+	}
+
+	if _, resp := chat("llama3.2"); resp["backend"] != "b" {
+		t.Errorf("expected the backend with the model loaded, got %q", resp["backend"])
+	}
+
+	// b has a request in progress
+	rt.backends[1].inflight.Add(1)
+	if _, resp := chat("mistral"); resp["backend"] != "a" {
+		t.Errorf("expected the backend with fewer requests, got %q", resp["backend"])
+	}
+
+	// a now has mistral loaded
+	rt.backends[1].inflight.Add(-1)
+	rt.backends[0].inflight.Add(1)
+	if _, resp := chat("mistral"); resp["backend"] != "a" {
+		t.Errorf("expected the backend that loaded the model, got %q", resp["backend"])
+	}
+	rt.backends[0].inflight.Add(-1)
+
+	b.Close()
+	poll()
+	if _, resp := chat("llama3.2"); resp["backend"] != "a" {
+		t.Errorf("expected the healthy backend, got %q", resp["backend"])
+	}
+
+	a.Close()
+	poll()
+	if code, _ := chat("llama3.2"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 with no backends, got %d", code)
+	}
+
+	t.Run("hosts", func(t *testing.T) {
+		rt, err := newRouter([]string{"10.0.0.2", "https://example.com:8443"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := rt.backends[0].url.String(); got != "http://10.0.0.2:11434" {
+			t.Errorf("expected the default scheme and port, got %s", got)
+		}
+
+		if got := rt.backends[1].url.String(); got != "https://example.com:8443" {
+			t.Errorf("expected the host as given, got %s", got)
+		}
+
+		if rt, err := newRouter(nil); rt != nil || err != nil {
+			t.Errorf("expected no router, got %v, %v", rt, err)
+		}
+	})
+}
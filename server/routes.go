@@ -1,9 +1,11 @@
 package server
 
 import (
+	"archive/tar"
 	"bytes"
 	"cmp"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,6 +13,7 @@ import (
 	"io"
 	"io/fs"
 	"log/slog"
+	"maps"
 	"math"
 	"net"
 	"net/http"
@@ -18,16 +21,22 @@ import (
 	"net/netip"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/image/webp"
 	"golang.org/x/sync/errgroup"
 
+	"github.com/goobla/goobla/anthropic"
 	"github.com/goobla/goobla/api"
 	"github.com/goobla/goobla/discover"
 	"github.com/goobla/goobla/envconfig"
@@ -35,9 +44,11 @@ import (
 	"github.com/goobla/goobla/llm"
 	"github.com/goobla/goobla/logutil"
 	openaimid "github.com/goobla/goobla/openai/middleware"
+	"github.com/goobla/goobla/sample"
 	"github.com/goobla/goobla/server/internal/client/goobla"
 	"github.com/goobla/goobla/server/internal/registry"
 	"github.com/goobla/goobla/template"
+	"github.com/goobla/goobla/template/jinja"
 	"github.com/goobla/goobla/thinking"
 	"github.com/goobla/goobla/tools"
 	"github.com/goobla/goobla/types/errtypes"
@@ -56,6 +67,33 @@ var mode string = gin.DebugMode
 type Server struct {
 	addr  net.Addr
 	sched *Scheduler
+
+	// internal handles the requests the server makes to itself, built once
+	// by internalHandler
+	internalOnce sync.Once
+	internal     http.Handler
+
+	// active are the generate and chat requests in progress, which can be
+	// canceled
+	active activeRequests
+
+	// preloads are the models kept loaded regardless of keep alive
+	preloads preloads
+
+	// sessions are the live sessions of /api/sessions
+	sessions sessions
+
+	// drainer tracks the inference requests in progress, and
+	// drainRequests receives requests to drain the server
+	drainer       drainer
+	drainRequests chan struct{}
+
+	// pulls is the number of models being pulled
+	pulls atomic.Int32
+
+	// router proxies inference requests to other servers in router mode,
+	// and is nil otherwise
+	router *router
 }
 
 func init() {
@@ -73,8 +111,13 @@ func init() {
 var (
 	errRequired    = errors.New("is required")
 	errBadTemplate = errors.New("template error")
+	errLocked      = errors.New("the template and system prompt of the model are locked")
 )
 
+// maxBeams is the most beams beam search can keep, each of which needs a
+// sequence of its own in the runner.
+const maxBeams = 8
+
 func modelOptions(model *Model, requestOpts map[string]any) (api.Options, error) {
 	opts := api.DefaultOptions()
 	if err := opts.FromMap(model.Options); err != nil {
@@ -85,12 +128,72 @@ func modelOptions(model *Model, requestOpts map[string]any) (api.Options, error)
 		return api.Options{}, err
 	}
 
+	if err := sample.CheckOrder(opts.Samplers); err != nil {
+		return api.Options{}, fmt.Errorf("%w: %w", errInvalidOptions, err)
+	}
+
+	if opts.NumBeams < 0 || opts.NumBeams > maxBeams {
+		return api.Options{}, fmt.Errorf("%w: num_beams must be between 0 and %d", errInvalidOptions, maxBeams)
+	}
+
+	switch opts.ContextOverflow {
+	case "", api.ContextOverflowTruncateOldest, api.ContextOverflowError, api.ContextOverflowShift:
+	default:
+		return api.Options{}, fmt.Errorf("%w: context_overflow must be %s, %s or %s", errInvalidOptions, api.ContextOverflowTruncateOldest, api.ContextOverflowError, api.ContextOverflowShift)
+	}
+
+	if opts.Deterministic && opts.Seed == -1 {
+		opts.Seed = deterministicSeed
+	}
+
+	adapter, err := adapterOption(model, opts.Adapter)
+	if err != nil {
+		return api.Options{}, fmt.Errorf("%w: %w", errInvalidOptions, err)
+	}
+	opts.Adapter = adapter
+
 	return opts, nil
 }
 
+// adapterOption returns the adapter option of a request for model with the
+// adapters given by their index, as the runner loaded them, and those that
+// aren't listed set to scale 0. It's nil if every adapter is applied with
+// scale 1, as they are by default.
+func adapterOption(model *Model, adapter map[string]float32) (map[string]float32, error) {
+	if adapter == nil {
+		return nil, nil
+	}
+
+	scales := make([]float32, len(model.AdapterPaths))
+	for name, scale := range adapter {
+		i := -1
+		if name != "" {
+			i = slices.Index(model.AdapterNames, name)
+		}
+		if n, err := strconv.Atoi(name); i < 0 && err == nil && n >= 0 && n < len(scales) {
+			i = n
+		}
+
+		if i < 0 {
+			return nil, fmt.Errorf("model has no adapter %q", name)
+		}
+		scales[i] = scale
+	}
+
+	if !slices.ContainsFunc(scales, func(s float32) bool { return s != 1 }) {
+		return nil, nil
+	}
+
+	indexed := make(map[string]float32, len(scales))
+	for i, scale := range scales {
+		indexed[strconv.Itoa(i)] = scale
+	}
+	return indexed, nil
+}
+
 // scheduleRunner schedules a runner after validating inputs such as capabilities and model options.
 // It returns the allocated runner, model instance, and consolidated options if successful and error otherwise.
-func (s *Server) scheduleRunner(ctx context.Context, name string, caps []model.Capability, requestOpts map[string]any, keepAlive *api.Duration) (llm.LlamaServer, *Model, *api.Options, error) {
+func (s *Server) scheduleRunner(ctx context.Context, name string, caps []model.Capability, requestOpts map[string]any, keepAlive *api.Duration, priority requestPriority, draft string) (llm.LlamaServer, *Model, *api.Options, error) {
 	if name == "" {
 		return nil, nil, nil, fmt.Errorf("model %w", errRequired)
 	}
@@ -100,6 +203,10 @@ func (s *Server) scheduleRunner(ctx context.Context, name string, caps []model.C
 		return nil, nil, nil, err
 	}
 
+	if err := touchModel(ParseModelPath(name).name()); err != nil {
+		slog.Warn("couldn't record model use", "model", name, "error", err)
+	}
+
 	if slices.Contains(model.Config.ModelFamilies, "mllama") && len(model.ProjectorPaths) > 0 {
 		return nil, nil, nil, fmt.Errorf("'llama3.2-vision' is no longer compatible with your version of Goobla and has been replaced by a newer version. To re-download, run 'goobla pull llama3.2-vision'")
 	}
@@ -113,13 +220,22 @@ func (s *Server) scheduleRunner(ctx context.Context, name string, caps []model.C
 		return nil, nil, nil, err
 	}
 
-	runnerCh, errCh := s.sched.GetRunner(ctx, model, opts, keepAlive)
+	model.DraftPath = draftPath(cmp.Or(draft, model.Draft))
+
+	ctx, span := tracer.Start(ctx, "schedule", trace.WithAttributes(attribute.String("goobla.model", model.ShortName)))
+	runnerCh, errCh := s.sched.GetRunner(ctx, model, opts, keepAlive, priority)
 	var runner *runnerRef
 	select {
 	case runner = <-runnerCh:
 	case err = <-errCh:
+		endSpan(span, err)
 		return nil, nil, nil, err
 	}
+	span.End()
+
+	if opts.NumCtx == api.NumCtxAuto {
+		opts.NumCtx = runner.Options.NumCtx / runner.numParallel
+	}
 
 	return runner.llama, model, &opts, nil
 }
@@ -151,6 +267,10 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		return
 	}
 
+	if !checkRead(c, name) {
+		return
+	}
+
 	m, err := GetModel(name.String())
 	if err != nil {
 		switch {
@@ -183,6 +303,11 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		return
 	}
 
+	if m.Locked() && (req.Raw || req.Template != "" || req.System != "") {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("%s: %v", req.Model, errLocked)})
+		return
+	}
+
 	caps := []model.Capability{model.CapabilityCompletion}
 	if req.Suffix != "" {
 		caps = append(caps, model.CapabilityInsert)
@@ -195,7 +320,31 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		// updated template supporting thinking
 	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), caps, req.Options, req.KeepAlive)
+	priority, err := resolvePriority(c, req.Priority)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := llm.CompletionGrammar(req.Format, req.Grammar); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := checkLogprobs(req.Logprobs, req.TopLogprobs); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Draft != "" && !checkDraft(c, req.Draft) {
+		return
+	}
+
+	// the runner is scheduled with a context of its own, which is canceled
+	// to release it if it crashes and the request is retried
+	schedCtx, release := context.WithCancel(c.Request.Context())
+	defer func() { release() }()
+	r, m, opts, err := s.scheduleRunner(schedCtx, name.String(), caps, req.Options, req.KeepAlive, priority, req.Draft)
 	if errors.Is(err, errCapabilityCompletion) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support generate", req.Model)})
 		return
@@ -204,6 +353,13 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		return
 	}
 
+	retry := func(numGPU int) (llm.LlamaServer, error) {
+		release()
+		schedCtx, release = context.WithCancel(c.Request.Context())
+		r, _, _, err := s.scheduleRunner(schedCtx, name.String(), caps, withNumGPU(req.Options, numGPU), req.KeepAlive, priority, req.Draft)
+		return r, err
+	}
+
 	if req.Think != nil && !*req.Think && !slices.Contains(m.Capabilities(), model.CapabilityThinking) {
 		slog.Warn("model does not support thinking output", "model", req.Model)
 	}
@@ -226,6 +382,11 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		return
 	}
 
+	if err := prepareImages(c.Request.Context(), m, req.Images); err != nil {
+		c.JSON(imageErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
 	images := make([]llm.ImageData, len(req.Images))
 	for i := range req.Images {
 		images[i] = llm.ImageData{ID: i, Data: req.Images[i]}
@@ -288,6 +449,14 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		prompt = b.String()
 	}
 
+	if err := checkContextLength(c.Request.Context(), m, r.Tokenize, opts, prompt, len(images)); errors.Is(err, errContextOverflow) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
 	var thinkingState *thinking.Parser
 	openingTag, closingTag := thinking.InferTags(m.Template.Template)
 	if req.Think != nil && *req.Think && openingTag != "" && closingTag != "" {
@@ -301,25 +470,45 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 	var sbThinking strings.Builder
 	var sbContent strings.Builder
 
+	metrics := newCompletionMetrics(m, checkpointStart)
+	var usage usageTracker
+	ctx, cancel := withGenerationTimeout(c.Request.Context(), req.Timeout)
 	ch := make(chan any)
 	go func() {
 		defer close(ch)
-		if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
-			Prompt:  prompt,
-			Images:  images,
-			Format:  req.Format,
-			Options: opts,
+		defer cancel()
+		if err := s.completion(ctx, &r, m, llm.CompletionRequest{
+			Prompt:        prompt,
+			Images:        images,
+			Format:        req.Format,
+			Grammar:       req.Grammar,
+			Options:       opts,
+			StatsInterval: statsInterval(req.Stream, req.StatsInterval),
+			Logprobs:      req.Logprobs,
+			TopLogprobs:   req.TopLogprobs,
 		}, func(cr llm.CompletionResponse) {
+			metrics.observe(cr)
+			usage.observe(cr)
+			if cr.Done {
+				chargeTokens(c, cr.PromptEvalCount+cr.EvalCount)
+			}
+			if cr.Progress {
+				ch <- api.GenerateResponse{Model: req.Model, CreatedAt: time.Now().UTC(), Usage: usage.usage(cr)}
+				return
+			}
+
 			res := api.GenerateResponse{
 				Model:     req.Model,
 				CreatedAt: time.Now().UTC(),
 				Response:  cr.Content,
+				Logprobs:  cr.Logprobs,
 				Done:      cr.Done,
 				Metrics: api.Metrics{
 					PromptEvalCount:    cr.PromptEvalCount,
 					PromptEvalDuration: cr.PromptEvalDuration,
 					EvalCount:          cr.EvalCount,
 					EvalDuration:       cr.EvalDuration,
+					PromptImageCount:   cr.PromptImageCount,
 				},
 			}
 
@@ -334,18 +523,20 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 			}
 
 			if _, err := sbRaw.WriteString(cr.Content); err != nil {
-				ch <- gin.H{"error": err.Error()}
+				ch <- streamError(err, usage.partial)
 			}
 
 			if cr.Done {
 				res.DoneReason = cr.DoneReason.String()
 				res.TotalDuration = time.Since(checkpointStart)
 				res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+				res.NumCtx = opts.NumCtx
+				res.Reproducibility = reproducibility(r, m, opts)
 
 				if !req.Raw {
 					tokens, err := r.Tokenize(c.Request.Context(), prompt+sbRaw.String())
 					if err != nil {
-						ch <- gin.H{"error": err.Error()}
+						ch <- streamError(err, usage.partial)
 						return
 					}
 					res.Context = tokens
@@ -353,24 +544,30 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 			}
 
 			ch <- res
-		}); err != nil {
-			ch <- gin.H{"error": err.Error()}
+		}, retry); errors.Is(context.Cause(ctx), errGenerationTimeout) {
+			ch <- api.GenerateResponse{
+				Model:           req.Model,
+				CreatedAt:       time.Now().UTC(),
+				Done:            true,
+				DoneReason:      llm.DoneReasonTimeout.String(),
+				Metrics:         timeoutMetrics(usage.partial, checkpointStart, checkpointLoaded),
+				Reproducibility: reproducibility(r, m, opts),
+			}
+		} else if err != nil {
+			ch <- streamError(err, usage.partial)
 		}
 	}()
 
 	if req.Stream != nil && !*req.Stream {
 		var r api.GenerateResponse
+		var logprobs []api.Logprob
 		for rr := range ch {
 			switch t := rr.(type) {
 			case api.GenerateResponse:
+				logprobs = append(logprobs, t.Logprobs...)
 				r = t
-			case gin.H:
-				msg, ok := t["error"].(string)
-				if !ok {
-					msg = "unexpected error format in response"
-				}
-
-				c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+			case api.StreamError:
+				c.JSON(http.StatusInternalServerError, t)
 				return
 			default:
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected response"})
@@ -380,6 +577,7 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 
 		r.Thinking = sbThinking.String()
 		r.Response = sbContent.String()
+		r.Logprobs = logprobs
 
 		c.JSON(http.StatusOK, r)
 		return
@@ -407,6 +605,11 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 		truncate = false
 	}
 
+	if req.Dimensions < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "dimensions must be positive"})
+		return
+	}
+
 	var input []string
 
 	switch i := req.Input.(type) {
@@ -429,13 +632,38 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 		}
 	}
 
+	if len(input) > 0 && len(req.Documents) > 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "input and documents can't be used together"})
+		return
+	}
+
+	if req.ChunkSize < 0 || req.ChunkOverlap < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "chunk_size and chunk_overlap must not be negative"})
+		return
+	}
+
+	if req.ChunkSize > 0 && req.ChunkOverlap >= req.ChunkSize {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "chunk_overlap must be less than chunk_size"})
+		return
+	}
+
 	name, err := getExistingName(model.ParseName(req.Model))
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
 		return
 	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), []model.Capability{}, req.Options, req.KeepAlive)
+	if !checkRead(c, name) {
+		return
+	}
+
+	priority, err := resolvePriority(c, req.Priority)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), []model.Capability{}, req.Options, req.KeepAlive, priority, "")
 	if err != nil {
 		handleScheduleError(c, req.Model, err)
 		return
@@ -443,7 +671,7 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 
 	checkpointLoaded := time.Now()
 
-	if len(input) == 0 {
+	if len(input) == 0 && len(req.Documents) == 0 {
 		c.JSON(http.StatusOK, api.EmbedResponse{Model: req.Model, Embeddings: [][]float32{}})
 		return
 	}
@@ -454,6 +682,32 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 		return
 	}
 
+	ctxLen := min(opts.NumCtx, int(kvData.ContextLength()))
+
+	var chunks []api.EmbedChunk
+	if len(req.Documents) > 0 {
+		size := cmp.Or(req.ChunkSize, min(defaultChunkSize, ctxLen))
+		if size > ctxLen {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("chunk_size %d is more than the context length %d", size, ctxLen)})
+			return
+		}
+
+		if req.ChunkOverlap >= size {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "chunk_overlap must be less than chunk_size"})
+			return
+		}
+
+		chunks, err = chunkDocuments(c.Request.Context(), r, req.Documents, size, req.ChunkOverlap)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		for _, chunk := range chunks {
+			input = append(input, chunk.Text)
+		}
+	}
+
 	var count int
 	for i, s := range input {
 		tokens, err := r.Tokenize(c.Request.Context(), s)
@@ -462,7 +716,6 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 			return
 		}
 
-		ctxLen := min(opts.NumCtx, int(kvData.ContextLength()))
 		if len(tokens) > ctxLen {
 			if !truncate {
 				c.JSON(http.StatusBadRequest, gin.H{"error": "input length exceeds maximum context length"})
@@ -490,7 +743,7 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 			if err != nil {
 				return err
 			}
-			embeddings[i] = normalize(embedding)
+			embeddings[i] = embedding
 			return nil
 		})
 	}
@@ -500,9 +753,34 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 		return
 	}
 
+	for i, e := range embeddings {
+		if req.Dimensions > 0 {
+			if req.Dimensions > len(e) {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("dimensions %d is more than the %d of the model's embeddings", req.Dimensions, len(e))})
+				return
+			}
+			e = e[:req.Dimensions]
+		}
+
+		if req.Normalize == nil || *req.Normalize {
+			e = normalize(e)
+		}
+
+		embeddings[i] = e
+	}
+
+	if chunks != nil {
+		for i := range chunks {
+			chunks[i].Embedding = embeddings[i]
+		}
+
+		embeddings = [][]float32{}
+	}
+
 	resp := api.EmbedResponse{
 		Model:           req.Model,
 		Embeddings:      embeddings,
+		Chunks:          chunks,
 		TotalDuration:   time.Since(checkpointStart),
 		LoadDuration:    checkpointLoaded.Sub(checkpointStart),
 		PromptEvalCount: count,
@@ -510,25 +788,9 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, resp)
 }
 
-func normalize(vec []float32) []float32 {
-	var sum float32
-	for _, v := range vec {
-		sum += v * v
-	}
-
-	norm := float32(0.0)
-	if sum > 0 {
-		norm = float32(1.0 / math.Sqrt(float64(sum)))
-	}
-
-	for i := range vec {
-		vec[i] *= norm
-	}
-	return vec
-}
-
-func (s *Server) EmbeddingsHandler(c *gin.Context) {
-	var req api.EmbeddingRequest
+func (s *Server) RerankHandler(c *gin.Context) {
+	checkpointStart := time.Now()
+	var req api.RerankRequest
 	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
 		return
@@ -537,178 +799,194 @@ func (s *Server) EmbeddingsHandler(c *gin.Context) {
 		return
 	}
 
-	name := model.ParseName(req.Model)
-	if !name.IsValid() {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+	if req.Query == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "query is required"})
 		return
 	}
 
-	r, _, _, err := s.scheduleRunner(c.Request.Context(), name.String(), []model.Capability{}, req.Options, req.KeepAlive)
-	if err != nil {
-		handleScheduleError(c, req.Model, err)
+	if req.TopN < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "top_n must not be negative"})
 		return
 	}
 
-	// an empty request loads the model
-	if req.Prompt == "" {
-		c.JSON(http.StatusOK, api.EmbeddingResponse{Embedding: []float64{}})
-		return
+	truncate := true
+	if req.Truncate != nil && !*req.Truncate {
+		truncate = false
 	}
 
-	embedding, err := r.Embedding(c.Request.Context(), req.Prompt)
+	name, err := getExistingName(model.ParseName(req.Model))
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": strings.TrimSpace(err.Error())})
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
 		return
 	}
 
-	var e []float64
-	for _, v := range embedding {
-		e = append(e, float64(v))
+	if !checkRead(c, name) {
+		return
 	}
 
-	resp := api.EmbeddingResponse{
-		Embedding: e,
+	priority, err := resolvePriority(c, req.Priority)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-	c.JSON(http.StatusOK, resp)
-}
 
-func (s *Server) PullHandler(c *gin.Context) {
-	var req api.PullRequest
-	err := c.ShouldBindJSON(&req)
-	switch {
-	case errors.Is(err, io.EOF):
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), []model.Capability{model.CapabilityRerank}, req.Options, req.KeepAlive, priority, "")
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
 		return
-	case err != nil:
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+
+	checkpointLoaded := time.Now()
+
+	if len(req.Documents) == 0 {
+		c.JSON(http.StatusOK, api.RerankResponse{Model: req.Model, Results: []api.RerankResult{}})
 		return
 	}
 
-	name := model.ParseName(cmp.Or(req.Model, req.Name))
-	if !name.IsValid() {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errtypes.InvalidModelNameErrMsg})
+	kvData, _, err := getModelData(m.ModelPath, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	name, err = getExistingName(name)
+	sep, end, err := rerankTemplate(c.Request.Context(), r, kvData)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	ch := make(chan any)
-	go func() {
-		defer close(ch)
-		fn := func(r api.ProgressResponse) {
-			ch <- r
+	var count int
+	input := make([]string, len(req.Documents))
+	for i, doc := range req.Documents {
+		s := req.Query + sep + doc + end
+		tokens, err := r.Tokenize(c.Request.Context(), s)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
 		}
 
-		regOpts := &registryOptions{
-			Insecure: req.Insecure,
+		ctxLen := min(opts.NumCtx, int(kvData.ContextLength()))
+		if len(tokens) > ctxLen {
+			if !truncate {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "input length exceeds maximum context length"})
+				return
+			}
+
+			tokens = tokens[:ctxLen]
+			s, err = r.Detokenize(c.Request.Context(), tokens)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
 		}
 
-		ctx, cancel := context.WithCancel(c.Request.Context())
-		defer cancel()
+		count += len(tokens)
 
-		if err := PullModel(ctx, name.DisplayShortest(), regOpts, fn); err != nil {
-			ch <- gin.H{"error": err.Error()}
-		}
-	}()
+		input[i] = s
+	}
 
-	if req.Stream != nil && !*req.Stream {
-		waitForStream(c, ch)
-		return
+	var g errgroup.Group
+	scores := make([]float32, len(input))
+	for i, text := range input {
+		g.Go(func() error {
+			score, err := r.Embedding(c.Request.Context(), text)
+			if err != nil {
+				return err
+			}
+
+			if len(score) != 1 {
+				return fmt.Errorf("model '%s' did not return a relevance score", req.Model)
+			}
+
+			scores[i] = score[0]
+			return nil
+		})
 	}
 
-	streamResponse(c, ch)
-}
+	if err := g.Wait(); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": strings.TrimSpace(err.Error())})
+		return
+	}
 
-func (s *Server) PushHandler(c *gin.Context) {
-	var req api.PushRequest
-	err := c.ShouldBindJSON(&req)
-	switch {
-	case errors.Is(err, io.EOF):
+	resp := api.RerankResponse{
+		Model:           req.Model,
+		Results:         rerankResults(req.Documents, scores, req.TopN, req.ReturnDocuments),
+		TotalDuration:   time.Since(checkpointStart),
+		LoadDuration:    checkpointLoaded.Sub(checkpointStart),
+		PromptEvalCount: count,
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) TokenizeHandler(c *gin.Context) {
+	var req api.TokenizeRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
 		return
-	case err != nil:
+	} else if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	var mname string
-	if req.Model != "" {
-		mname = req.Model
-	} else if req.Name != "" {
-		mname = req.Name
-	} else {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+	if len(req.Messages) > 0 && (req.Prompt != "" || req.System != "" || req.Raw) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "messages can't be combined with prompt, system or raw"})
 		return
 	}
 
-	ch := make(chan any)
-	go func() {
-		defer close(ch)
-		fn := func(r api.ProgressResponse) {
-			ch <- r
-		}
-
-		regOpts := &registryOptions{
-			Insecure: req.Insecure,
-		}
+	if req.Raw && req.System != "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "raw mode does not support system"})
+		return
+	}
 
-		ctx, cancel := context.WithCancel(c.Request.Context())
-		defer cancel()
+	name, err := getExistingName(model.ParseName(req.Model))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
 
-		name, err := getExistingName(model.ParseName(mname))
-		if err != nil {
-			ch <- gin.H{"error": err.Error()}
-			return
-		}
+	if !checkRead(c, name) {
+		return
+	}
 
-		if err := PushModel(ctx, name.DisplayShortest(), regOpts, fn); err != nil {
-			ch <- gin.H{"error": err.Error()}
-		}
-	}()
+	priority, err := resolvePriority(c, req.Priority)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	if req.Stream != nil && !*req.Stream {
-		waitForStream(c, ch)
+	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), nil, req.Options, req.KeepAlive, priority, "")
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
 		return
 	}
 
-	streamResponse(c, ch)
-}
+	prompt, err := tokenizePrompt(m, req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
-// getExistingName searches the models directory for the longest prefix match of
-// the input name and returns the input name with all existing parts replaced
-// with each part found. If no parts are found, the input name is returned as
-// is.
-func getExistingName(n model.Name) (model.Name, error) {
-	var zero model.Name
-	existing, err := Manifests(true)
+	tokens, err := r.Tokenize(c.Request.Context(), prompt)
 	if err != nil {
-		return zero, err
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
-	var set model.Name // tracks parts already canonicalized
-	for e := range existing {
-		if set.Host == "" && strings.EqualFold(e.Host, n.Host) {
-			n.Host = e.Host
-		}
-		if set.Namespace == "" && strings.EqualFold(e.Namespace, n.Namespace) {
-			n.Namespace = e.Namespace
-		}
-		if set.Model == "" && strings.EqualFold(e.Model, n.Model) {
-			n.Model = e.Model
-		}
-		if set.Tag == "" && strings.EqualFold(e.Tag, n.Tag) {
-			n.Tag = e.Tag
-		}
+
+	if tokens == nil {
+		tokens = []int{}
 	}
-	return n, nil
+
+	c.JSON(http.StatusOK, api.TokenizeResponse{
+		Model:         req.Model,
+		Tokens:        tokens,
+		Count:         len(tokens),
+		ContextLength: opts.NumCtx,
+	})
 }
 
-func (s *Server) DeleteHandler(c *gin.Context) {
-	var r api.DeleteRequest
-	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+func (s *Server) DetokenizeHandler(c *gin.Context) {
+	var req api.DetokenizeRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
 		return
 	} else if err != nil {
@@ -716,249 +994,1148 @@ func (s *Server) DeleteHandler(c *gin.Context) {
 		return
 	}
 
-	n := model.ParseName(cmp.Or(r.Model, r.Name))
-	if !n.IsValid() {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("name %q is invalid", cmp.Or(r.Model, r.Name))})
+	name, err := getExistingName(model.ParseName(req.Model))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
 		return
 	}
 
-	n, err := getExistingName(n)
+	if !checkRead(c, name) {
+		return
+	}
+
+	priority, err := resolvePriority(c, req.Priority)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", cmp.Or(r.Model, r.Name))})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	m, err := ParseNamedManifest(n)
+	r, m, _, err := s.scheduleRunner(c.Request.Context(), name.String(), nil, req.Options, req.KeepAlive, priority, "")
 	if err != nil {
-		switch {
-		case os.IsNotExist(err):
-			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", cmp.Or(r.Model, r.Name))})
-		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		}
+		handleScheduleError(c, req.Model, err)
 		return
 	}
 
-	if err := m.Remove(); err != nil {
+	kvData, _, err := getModelData(m.ModelPath, false)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	if err := m.RemoveLayers(); err != nil {
+	// tokenizers don't check the tokens they're given
+	for _, t := range req.Tokens {
+		if t < 0 || uint64(t) >= kvData.VocabSize() {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("token %d is not in the model's vocabulary", t)})
+			return
+		}
+	}
+
+	content, err := r.Detokenize(c.Request.Context(), req.Tokens)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+
+	c.JSON(http.StatusOK, api.DetokenizeResponse{Model: req.Model, Content: content})
 }
 
-func (s *Server) ShowHandler(c *gin.Context) {
-	var req api.ShowRequest
-	err := c.ShouldBindJSON(&req)
-	switch {
-	case errors.Is(err, io.EOF):
+func (s *Server) TemplateHandler(c *gin.Context) {
+	var req api.TemplateRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
 		return
-	case err != nil:
+	} else if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	if req.Model != "" {
-		// noop
-	} else if req.Name != "" {
-		req.Model = req.Name
-	} else {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+	if len(req.Messages) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "messages are required"})
 		return
 	}
 
-	resp, err := GetModelInfo(req)
-	if err != nil {
-		switch {
-		case os.IsNotExist(err):
-			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
-		case err.Error() == errtypes.InvalidModelNameErrMsg:
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	var tmpl *template.Template
+	if req.Template != "" {
+		var err error
+		tmpl, err = template.Parse(req.Template)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
-		return
 	}
 
-	c.JSON(http.StatusOK, resp)
-}
-
-func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
-	name := model.ParseName(req.Model)
-	if !name.IsValid() {
-		return nil, ErrModelPathInvalid
-	}
-	name, err := getExistingName(name)
+	name, err := getExistingName(model.ParseName(req.Model))
 	if err != nil {
-		return nil, err
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
 	}
 
-	m, err := GetModel(name.String())
+	if !checkRead(c, name) {
+		return
+	}
+
+	priority, err := resolvePriority(c, req.Priority)
 	if err != nil {
-		return nil, err
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	modelDetails := api.ModelDetails{
-		ParentModel:       m.ParentModel,
-		Format:            m.Config.ModelFormat,
-		Family:            m.Config.ModelFamily,
-		Families:          m.Config.ModelFamilies,
-		ParameterSize:     m.Config.ModelType,
-		QuantizationLevel: m.Config.FileType,
+	r, m, _, err := s.scheduleRunner(c.Request.Context(), name.String(), nil, req.Options, req.KeepAlive, priority, "")
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
 	}
 
-	if req.System != "" {
-		m.System = req.System
+	if tmpl != nil {
+		// don't change the model the scheduler shares
+		m = &Model{Template: tmpl, System: m.System, Messages: m.Messages}
 	}
 
-	msgs := make([]api.Message, len(m.Messages))
-	for i, msg := range m.Messages {
-		msgs[i] = api.Message{Role: msg.Role, Content: msg.Content}
+	prompt, err := tokenizePrompt(m, api.TokenizeRequest{Messages: req.Messages, Tools: req.Tools, Think: req.Think})
+	if err != nil && tmpl != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
-	manifest, err := ParseNamedManifest(name)
+	tokens, err := r.Tokenize(c.Request.Context(), prompt)
 	if err != nil {
-		return nil, err
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
-	resp := &api.ShowResponse{
-		License:      strings.Join(m.License, "\n"),
-		System:       m.System,
-		Template:     m.Template.String(),
-		Details:      modelDetails,
-		Messages:     msgs,
-		Capabilities: m.Capabilities(),
-		ModifiedAt:   manifest.fi.ModTime(),
+	c.JSON(http.StatusOK, api.TemplateResponse{Model: req.Model, Prompt: prompt, Count: len(tokens)})
+}
+
+func (s *Server) ScoreHandler(c *gin.Context) {
+	checkpointStart := time.Now()
+	var req api.ScoreRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	var params []string
-	cs := 30
-	for k, v := range m.Options {
-		switch val := v.(type) {
-		case []any:
-			for _, nv := range val {
-				params = append(params, fmt.Sprintf("%-*s %#v", cs, k, nv))
-			}
-		default:
-			params = append(params, fmt.Sprintf("%-*s %#v", cs, k, v))
-		}
+	if req.Completion == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "completion is required"})
+		return
 	}
-	resp.Parameters = strings.Join(params, "\n")
 
-	for k, v := range req.Options {
-		if _, ok := req.Options[k]; ok {
-			m.Options[k] = v
-		}
+	if req.Raw && req.System != "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "raw mode does not support system"})
+		return
 	}
 
-	var sb strings.Builder
-	fmt.Fprintln(&sb, "# Modelfile generated by \"goobla show\"")
-	fmt.Fprintln(&sb, "# To build a new Modelfile based on this, replace FROM with:")
-	fmt.Fprintf(&sb, "# FROM %s\n\n", m.ShortName)
-	fmt.Fprint(&sb, m.String())
-	resp.Modelfile = sb.String()
+	if err := checkLogprobs(true, req.TopLogprobs); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	kvData, tensors, err := getModelData(m.ModelPath, req.Verbose)
+	name, err := getExistingName(model.ParseName(req.Model))
 	if err != nil {
-		return nil, err
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
 	}
 
-	delete(kvData, "general.name")
-	delete(kvData, "tokenizer.chat_template")
-	resp.ModelInfo = kvData
-
-	tensorData := make([]api.Tensor, len(tensors.Items()))
-	for cnt, t := range tensors.Items() {
-		tensorData[cnt] = api.Tensor{Name: t.Name, Type: t.Type(), Shape: t.Shape}
+	if !checkRead(c, name) {
+		return
 	}
-	resp.Tensors = tensorData
 
-	if len(m.ProjectorPaths) > 0 {
-		projectorData, _, err := getModelData(m.ProjectorPaths[0], req.Verbose)
+	priority, err := resolvePriority(c, req.Priority)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), []model.Capability{model.CapabilityCompletion}, req.Options, req.KeepAlive, priority, "")
+	if errors.Is(err, errCapabilityCompletion) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support score", req.Model)})
+		return
+	} else if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	checkpointLoaded := time.Now()
+
+	prompt, err := tokenizePrompt(m, api.TokenizeRequest{Prompt: req.Prompt, System: req.System, Raw: req.Raw})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// unlike a prompt, the completion can't be truncated to fit
+	var count int
+	for _, text := range []string{prompt, req.Completion} {
+		tokens, err := r.Tokenize(c.Request.Context(), text)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		count += len(tokens)
+	}
+
+	if count > opts.NumCtx {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "input length exceeds maximum context length"})
+		return
+	}
+
+	var final llm.CompletionResponse
+	if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
+		Prompt:      prompt,
+		Options:     opts,
+		Score:       req.Completion,
+		TopLogprobs: req.TopLogprobs,
+	}, func(cr llm.CompletionResponse) {
+		if cr.Done {
+			final = cr
+		}
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(final.Logprobs) == 0 {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("model '%s' did not score the completion", req.Model)})
+		return
+	}
+
+	var logprob float64
+	for _, lp := range final.Logprobs {
+		logprob += lp.Logprob
+	}
+
+	c.JSON(http.StatusOK, api.ScoreResponse{
+		Model:              req.Model,
+		Logprob:            logprob,
+		Perplexity:         math.Exp(-logprob / float64(len(final.Logprobs))),
+		Logprobs:           final.Logprobs,
+		TotalDuration:      time.Since(checkpointStart),
+		LoadDuration:       checkpointLoaded.Sub(checkpointStart),
+		PromptEvalCount:    final.PromptEvalCount,
+		PromptEvalDuration: final.PromptEvalDuration,
+	})
+}
+
+// CompareHandler chats with several models at once, streaming their responses
+// interleaved and tagged with the index of their model.
+func (s *Server) CompareHandler(c *gin.Context) {
+	var req api.CompareRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(req.Models) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "models are required"})
+		return
+	}
+
+	if (req.Prompt == "") == (len(req.Messages) == 0) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "prompt or messages are required, but not both"})
+		return
+	}
+
+	if len(req.Messages) > 0 && req.System != "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "system is not supported with messages"})
+		return
+	}
+
+	// the priority is checked against the limits of the request here, as the
+	// requests of the models are made without its credentials
+	priority, err := resolvePriority(c, req.Priority)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	chatReq := compareChatRequest(req)
+	chatReq.Priority = priority.String()
+
+	ctx, cancel := context.WithCancel(context.WithValue(c.Request.Context(), batchUserKey{}, requestUser(c)))
+	defer cancel()
+
+	ch := make(chan any)
+	go compare(ctx, s.internalHandler(), req.Models, chatReq, ch)
+	streamResponse(c, ch)
+}
+
+func normalize(vec []float32) []float32 {
+	var sum float32
+	for _, v := range vec {
+		sum += v * v
+	}
+
+	norm := float32(0.0)
+	if sum > 0 {
+		norm = float32(1.0 / math.Sqrt(float64(sum)))
+	}
+
+	for i := range vec {
+		vec[i] *= norm
+	}
+	return vec
+}
+
+func (s *Server) EmbeddingsHandler(c *gin.Context) {
+	var req api.EmbeddingRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name := model.ParseName(req.Model)
+	if !name.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+
+	if !checkRead(c, name) {
+		return
+	}
+
+	priority, err := resolvePriority(c, req.Priority)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	r, _, _, err := s.scheduleRunner(c.Request.Context(), name.String(), []model.Capability{}, req.Options, req.KeepAlive, priority, "")
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	// an empty request loads the model
+	if req.Prompt == "" {
+		c.JSON(http.StatusOK, api.EmbeddingResponse{Embedding: []float64{}})
+		return
+	}
+
+	embedding, err := r.Embedding(c.Request.Context(), req.Prompt)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": strings.TrimSpace(err.Error())})
+		return
+	}
+
+	var e []float64
+	for _, v := range embedding {
+		e = append(e, float64(v))
+	}
+
+	resp := api.EmbeddingResponse{
+		Embedding: e,
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) PullHandler(c *gin.Context) {
+	var req api.PullRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name := model.ParseName(cmp.Or(req.Model, req.Name))
+	if !name.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errtypes.InvalidModelNameErrMsg})
+		return
+	}
+
+	if !checkOnline(c) {
+		return
+	}
+
+	name, err = getExistingName(name)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// pulling into another user's namespace would replace their model
+	if !checkRead(c, name) {
+		return
+	}
+
+	regOpts := &registryOptions{
+		Insecure: req.Insecure,
+		limiter:  newRateLimiter(req.RateLimit),
+	}
+
+	if req.From != "" {
+		regOpts.peer, err = parsePeer(req.From)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
+		fn := func(r api.ProgressResponse) {
+			ch <- r
+		}
+
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+
+		s.pulls.Add(1)
+		defer s.pulls.Add(-1)
+
+		if err := PullModel(ctx, schemeName(cmp.Or(req.Model, req.Name), name), regOpts, fn); err != nil {
+			ch <- gin.H{"error": err.Error()}
+		}
+	}()
+
+	if req.Stream != nil && !*req.Stream {
+		waitForStream(c, ch)
+		return
+	}
+
+	streamResponse(c, ch)
+}
+
+func (s *Server) PushHandler(c *gin.Context) {
+	var req api.PushRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var mname string
+	if req.Model != "" {
+		mname = req.Model
+	} else if req.Name != "" {
+		mname = req.Name
+	} else {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+
+	if !checkOnline(c) {
+		return
+	}
+
+	if n, err := getExistingName(model.ParseName(mname)); err == nil && !checkRead(c, n) {
+		return
+	}
+
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
+		fn := func(r api.ProgressResponse) {
+			ch <- r
+		}
+
+		regOpts := &registryOptions{
+			Insecure: req.Insecure,
+			Username: req.Username,
+			Password: req.Password,
+			limiter:  newRateLimiter(req.RateLimit),
+		}
+
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+
+		name, err := getExistingName(model.ParseName(mname))
+		if err != nil {
+			ch <- gin.H{"error": err.Error()}
+			return
+		}
+
+		if err := PushModel(ctx, schemeName(mname, name), regOpts, fn); err != nil {
+			ch <- gin.H{"error": err.Error()}
+		}
+	}()
+
+	if req.Stream != nil && !*req.Stream {
+		waitForStream(c, ch)
+		return
+	}
+
+	streamResponse(c, ch)
+}
+
+// getExistingName searches the models directory for the longest prefix match of
+// the input name and returns the input name with all existing parts replaced
+// with each part found. If no parts are found, the input name is returned as
+// is. Aliases are replaced with the model they refer to.
+func getExistingName(n model.Name) (model.Name, error) {
+	n = resolveAlias(n)
+
+	var zero model.Name
+	existing, err := Manifests(true)
+	if err != nil {
+		return zero, err
+	}
+	var set model.Name // tracks parts already canonicalized
+	for e := range existing {
+		if set.Host == "" && strings.EqualFold(e.Host, n.Host) {
+			n.Host = e.Host
+		}
+		if set.Namespace == "" && strings.EqualFold(e.Namespace, n.Namespace) {
+			n.Namespace = e.Namespace
+		}
+		if set.Model == "" && strings.EqualFold(e.Model, n.Model) {
+			n.Model = e.Model
+		}
+		if set.Tag == "" && strings.EqualFold(e.Tag, n.Tag) {
+			n.Tag = e.Tag
+		}
+	}
+	return n, nil
+}
+
+func (s *Server) DeleteHandler(c *gin.Context) {
+	var r api.DeleteRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	n := model.ParseName(cmp.Or(r.Model, r.Name))
+	if !n.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("name %q is invalid", cmp.Or(r.Model, r.Name))})
+		return
+	}
+
+	if !checkWrite(c, n) {
+		return
+	}
+
+	// deleting an alias leaves the model it refers to in place
+	if _, ok := lookupAlias(n); ok {
+		if err := DeleteAlias(n); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	n, err := getExistingName(n)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", cmp.Or(r.Model, r.Name))})
+		return
+	}
+
+	m, err := ParseNamedManifest(n)
+	if err != nil {
+		switch {
+		case os.IsNotExist(err):
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", cmp.Or(r.Model, r.Name))})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	if err := m.Remove(); errors.Is(err, errReadOnlyModel) {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("model '%s' can't be deleted: %v", cmp.Or(r.Model, r.Name), err)})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := m.RemoveLayers(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := forgetModel(n); err != nil {
+		slog.Warn("couldn't forget deleted model", "model", n.DisplayShortest(), "error", err)
+	}
+
+	notify(webhookEvent{Event: eventModelDeleted, Model: n.DisplayShortest()})
+}
+
+func (s *Server) ShowHandler(c *gin.Context) {
+	var req api.ShowRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Model != "" {
+		// noop
+	} else if req.Name != "" {
+		req.Model = req.Name
+	} else {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+
+	if n := model.ParseName(req.Model); n.IsValid() {
+		if n, err := getExistingName(n); err == nil && !checkRead(c, n) {
+			return
+		}
+	}
+
+	resp, err := GetModelInfo(req)
+	if err != nil {
+		switch {
+		case os.IsNotExist(err):
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		case err.Error() == errtypes.InvalidModelNameErrMsg:
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
+	name := model.ParseName(req.Model)
+	if !name.IsValid() {
+		return nil, ErrModelPathInvalid
+	}
+	name, err := getExistingName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := GetModel(name.String())
+	if err != nil {
+		return nil, err
+	}
+
+	modelDetails := api.ModelDetails{
+		ParentModel:       m.ParentModel,
+		Format:            m.Config.ModelFormat,
+		Family:            m.Config.ModelFamily,
+		Families:          m.Config.ModelFamilies,
+		ParameterSize:     m.Config.ModelType,
+		QuantizationLevel: m.Config.FileType,
+	}
+
+	if req.System != "" {
+		m.System = req.System
+	}
+
+	msgs := make([]api.Message, len(m.Messages))
+	for i, msg := range m.Messages {
+		msgs[i] = api.Message{Role: msg.Role, Content: msg.Content}
+	}
+
+	manifest, err := ParseNamedManifest(name)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &api.ShowResponse{
+		License:      strings.Join(m.License, "\n"),
+		System:       m.System,
+		Template:     m.Template.String(),
+		Details:      modelDetails,
+		Messages:     msgs,
+		Capabilities: m.Capabilities(),
+		ModifiedAt:   manifest.fi.ModTime(),
+		Metadata:     m.Config.Metadata(),
+	}
+
+	var params []string
+	cs := 30
+	for k, v := range m.Options {
+		switch val := v.(type) {
+		case []any:
+			for _, nv := range val {
+				params = append(params, fmt.Sprintf("%-*s %#v", cs, k, nv))
+			}
+		case map[string]any:
+			for _, key := range slices.Sorted(maps.Keys(val)) {
+				params = append(params, fmt.Sprintf("%-*s %#v", cs, k, fmt.Sprintf("%s:%v", key, val[key])))
+			}
+		default:
+			params = append(params, fmt.Sprintf("%-*s %#v", cs, k, v))
+		}
+	}
+	resp.Parameters = strings.Join(params, "\n")
+
+	for k, v := range req.Options {
+		if _, ok := req.Options[k]; ok {
+			m.Options[k] = v
+		}
+	}
+
+	var sb strings.Builder
+	fmt.Fprintln(&sb, "# Modelfile generated by \"goobla show\"")
+	fmt.Fprintln(&sb, "# To build a new Modelfile based on this, replace FROM with:")
+	fmt.Fprintf(&sb, "# FROM %s\n\n", m.ShortName)
+	fmt.Fprint(&sb, m.String())
+	resp.Modelfile = sb.String()
+
+	kvData, tensors, err := getModelData(m.ModelPath, req.Verbose)
+	if err != nil {
+		return nil, err
+	}
+
+	delete(kvData, "general.name")
+	delete(kvData, "tokenizer.chat_template")
+	resp.ModelInfo = kvData
+
+	// models created before metadata was recorded in their config
+	resp.Metadata.License = cmp.Or(resp.Metadata.License, kvData.String("general.license"))
+	resp.Metadata.ParameterCount = cmp.Or(resp.Metadata.ParameterCount, kvData.ParameterCount())
+	resp.Metadata.ContextLength = cmp.Or(resp.Metadata.ContextLength, kvData.ContextLength())
+	resp.Metadata.Source = cmp.Or(resp.Metadata.Source, kvData.String("general.source.url"))
+
+	tensorData := make([]api.Tensor, len(tensors.Items()))
+	for cnt, t := range tensors.Items() {
+		tensorData[cnt] = api.Tensor{Name: t.Name, Type: t.Type(), Shape: t.Shape}
+	}
+	resp.Tensors = tensorData
+
+	if len(m.ProjectorPaths) > 0 {
+		projectorData, _, err := getModelData(m.ProjectorPaths[0], req.Verbose)
+		if err != nil {
+			return nil, err
+		}
+		resp.ProjectorInfo = projectorData
+	}
+
+	if req.Verbose {
+		opts, err := modelOptions(m, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		sampler, err := sample.NewSamplerFromConfig(sample.ConfigFromOptions(opts), nil)
 		if err != nil {
 			return nil, err
 		}
-		resp.ProjectorInfo = projectorData
+		resp.Samplers = sampler.Pipeline()
+	}
+
+	return resp, nil
+}
+
+func getModelData(digest string, verbose bool) (ggml.KV, ggml.Tensors, error) {
+	maxArraySize := 0
+	if verbose {
+		maxArraySize = -1
+	}
+	data, err := llm.LoadModel(digest, maxArraySize)
+	if err != nil {
+		return nil, ggml.Tensors{}, err
+	}
+
+	kv := data.KV()
+
+	if !verbose {
+		for k := range kv {
+			if t, ok := kv[k].([]any); len(t) > 5 && ok {
+				kv[k] = []any{}
+			}
+		}
+	}
+
+	return kv, data.Tensors(), nil
+}
+
+func (s *Server) ListHandler(c *gin.Context) {
+	ms, err := Manifests(true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	user := requestUser(c)
+	maps.DeleteFunc(ms, func(n model.Name, _ *Manifest) bool {
+		return !canRead(user, n)
+	})
+
+	usage, err := readUsageState()
+	if err != nil {
+		slog.Warn("ignoring invalid usage file", "error", err)
+	}
+
+	// count the models using each layer to find those that are shared
+	users := make(map[string]int)
+	layers := make(map[string]int64)
+	for _, m := range ms {
+		for _, l := range append(m.Layers, m.Config) {
+			if l.Digest != "" {
+				users[l.Digest]++
+				layers[l.Digest] = l.Size
+			}
+		}
+	}
+
+	storage := api.StorageStats{}
+	for digest, size := range layers {
+		storage.UniqueSize += size
+		if p, err := GetBlobsPath(digest); err == nil {
+			if fi, err := os.Stat(p); err == nil && linkCount(fi) > 1 {
+				storage.LinkedSize += size
+			}
+		}
+	}
+
+	models := []api.ListModelResponse{}
+	for n, m := range ms {
+		var cf ConfigV2
+
+		var shared int64
+		for _, l := range append(m.Layers, m.Config) {
+			if users[l.Digest] > 1 {
+				shared += l.Size
+			}
+		}
+		storage.Size += m.Size()
+
+		if m.Config.Digest != "" {
+			f, err := m.Config.Open()
+			if err != nil {
+				slog.Warn("bad manifest filepath", "name", n, "error", err)
+				continue
+			}
+			defer f.Close()
+
+			if err := json.NewDecoder(f).Decode(&cf); err != nil {
+				slog.Warn("bad manifest config", "name", n, "error", err)
+				continue
+			}
+		}
+
+		// tag should never be masked
+		models = append(models, api.ListModelResponse{
+			Model:      n.DisplayShortest(),
+			Name:       n.DisplayShortest(),
+			Size:       m.Size(),
+			Digest:     m.digest,
+			ModifiedAt: m.fi.ModTime(),
+			Details: api.ModelDetails{
+				Format:            cf.ModelFormat,
+				Family:            cf.ModelFamily,
+				Families:          cf.ModelFamilies,
+				ParameterSize:     cf.ModelType,
+				QuantizationLevel: cf.FileType,
+			},
+			Metadata:   cf.Metadata(),
+			Pinned:     usage.pinned(n),
+			SharedSize: shared,
+		})
+	}
+
+	slices.SortStableFunc(models, func(i, j api.ListModelResponse) int {
+		// most recently modified first
+		return cmp.Compare(j.ModifiedAt.Unix(), i.ModifiedAt.Unix())
+	})
+
+	c.JSON(http.StatusOK, api.ListResponse{Models: models, Storage: &storage})
+}
+
+func (s *Server) ListAliasesHandler(c *gin.Context) {
+	aliases, err := Aliases()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	user := requestUser(c)
+	resp := api.ListAliasesResponse{Aliases: []api.AliasResponse{}}
+	for alias, target := range aliases {
+		if !canRead(user, alias) || !canRead(user, target) {
+			continue
+		}
+
+		resp.Aliases = append(resp.Aliases, api.AliasResponse{
+			Alias:  alias.DisplayShortest(),
+			Target: target.DisplayShortest(),
+		})
+	}
+
+	slices.SortFunc(resp.Aliases, func(a, b api.AliasResponse) int {
+		return cmp.Compare(a.Alias, b.Alias)
+	})
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) CreateAliasHandler(c *gin.Context) {
+	var r api.AliasRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	alias := model.ParseName(r.Alias)
+	if !alias.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("alias %q is invalid", r.Alias)})
+		return
+	}
+
+	target := model.ParseName(r.Target)
+	if !target.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("target %q is invalid", r.Target)})
+		return
+	}
+
+	if !checkWrite(c, alias) || !checkRead(c, target) {
+		return
+	}
+
+	// resolve the target's case but not aliases, which cannot be chained
+	if _, ok := lookupAlias(target); !ok {
+		var err error
+		if target, err = getExistingName(target); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if err := SetAlias(alias, target); errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", r.Target)})
+	} else if errors.Is(err, errAliasIsModel) || errors.Is(err, errAliasIsAlias) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func (s *Server) DeleteAliasHandler(c *gin.Context) {
+	var r api.AliasRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	alias := model.ParseName(r.Alias)
+	if !alias.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("alias %q is invalid", r.Alias)})
+		return
+	}
+
+	if !checkWrite(c, alias) {
+		return
+	}
+
+	if err := DeleteAlias(alias); errors.Is(err, errAliasNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("alias '%s' not found", r.Alias)})
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func (s *Server) CreateConversationHandler(c *gin.Context) {
+	var r api.ConversationRequest
+	if err := c.ShouldBindJSON(&r); err != nil && !errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if r.Model != "" {
+		name := model.ParseName(r.Model)
+		if !name.IsValid() {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("model %q is invalid", r.Model)})
+			return
+		}
+
+		if !checkRead(c, name) {
+			return
+		}
 	}
 
-	return resp, nil
+	conv, err := newConversation(requestUser(c), r.Model, r.Messages)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, conv)
 }
 
-func getModelData(digest string, verbose bool) (ggml.KV, ggml.Tensors, error) {
-	maxArraySize := 0
-	if verbose {
-		maxArraySize = -1
+func (s *Server) ListConversationsHandler(c *gin.Context) {
+	convs, err := listConversations(requestUser(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
-	data, err := llm.LoadModel(digest, maxArraySize)
+
+	c.JSON(http.StatusOK, api.ListConversationsResponse{Conversations: convs})
+}
+
+func (s *Server) GetConversationHandler(c *gin.Context) {
+	conv, err := getConversation(requestUser(c), c.Param("id"))
 	if err != nil {
-		return nil, ggml.Tensors{}, err
+		handleConversationError(c, err)
+		return
 	}
 
-	kv := data.KV()
+	c.JSON(http.StatusOK, conv)
+}
 
-	if !verbose {
-		for k := range kv {
-			if t, ok := kv[k].([]any); len(t) > 5 && ok {
-				kv[k] = []any{}
-			}
-		}
+func (s *Server) AddMessagesHandler(c *gin.Context) {
+	var r api.ConversationRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	return kv, data.Tensors(), nil
+	conv, err := appendConversation(requestUser(c), c.Param("id"), r.Messages)
+	if err != nil {
+		handleConversationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, conv)
 }
 
-func (s *Server) ListHandler(c *gin.Context) {
-	ms, err := Manifests(true)
+func (s *Server) DeleteConversationHandler(c *gin.Context) {
+	if err := deleteConversation(requestUser(c), c.Param("id")); err != nil {
+		handleConversationError(c, err)
+	}
+}
+
+func handleConversationError(c *gin.Context, err error) {
+	if errors.Is(err, errConversationNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("conversation '%s' not found", c.Param("id"))})
+		return
+	}
+
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+func (s *Server) CreateBatchHandler(c *gin.Context) {
+	var r api.BatchRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	b, err := newBatch(requestUser(c), r)
+	if errors.Is(err, errInvalidBatch) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, b)
+}
+
+func (s *Server) ListBatchesHandler(c *gin.Context) {
+	batches, err := listBatches(requestUser(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	models := []api.ListModelResponse{}
-	for n, m := range ms {
-		var cf ConfigV2
+	c.JSON(http.StatusOK, api.ListBatchesResponse{Batches: batches})
+}
 
-		if m.Config.Digest != "" {
-			f, err := m.Config.Open()
-			if err != nil {
-				slog.Warn("bad manifest filepath", "name", n, "error", err)
-				continue
-			}
-			defer f.Close()
+func (s *Server) GetBatchHandler(c *gin.Context) {
+	b, err := getBatch(requestUser(c), c.Param("id"))
+	if err != nil {
+		handleBatchError(c, err)
+		return
+	}
 
-			if err := json.NewDecoder(f).Decode(&cf); err != nil {
-				slog.Warn("bad manifest config", "name", n, "error", err)
-				continue
-			}
-		}
+	c.JSON(http.StatusOK, b)
+}
 
-		// tag should never be masked
-		models = append(models, api.ListModelResponse{
-			Model:      n.DisplayShortest(),
-			Name:       n.DisplayShortest(),
-			Size:       m.Size(),
-			Digest:     m.digest,
-			ModifiedAt: m.fi.ModTime(),
-			Details: api.ModelDetails{
-				Format:            cf.ModelFormat,
-				Family:            cf.ModelFamily,
-				Families:          cf.ModelFamilies,
-				ParameterSize:     cf.ModelType,
-				QuantizationLevel: cf.FileType,
-			},
-		})
+func (s *Server) CancelBatchHandler(c *gin.Context) {
+	b, err := cancelBatch(requestUser(c), c.Param("id"))
+	if err != nil {
+		handleBatchError(c, err)
+		return
 	}
 
-	slices.SortStableFunc(models, func(i, j api.ListModelResponse) int {
-		// most recently modified first
-		return cmp.Compare(j.ModifiedAt.Unix(), i.ModifiedAt.Unix())
-	})
+	c.JSON(http.StatusOK, b)
+}
+
+func (s *Server) DeleteBatchHandler(c *gin.Context) {
+	if err := deleteBatch(requestUser(c), c.Param("id")); err != nil {
+		handleBatchError(c, err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func (s *Server) BatchResultsHandler(c *gin.Context) {
+	if _, err := getBatch(requestUser(c), c.Param("id")); err != nil {
+		handleBatchError(c, err)
+		return
+	}
+
+	p, err := batchPath(c.Param("id"), ".jsonl")
+	if err != nil {
+		handleBatchError(c, err)
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", c.Param("id")+".jsonl"))
+
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		// no requests have been processed yet
+		c.Status(http.StatusOK)
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+
+	c.Status(http.StatusOK)
+	if _, err := io.Copy(c.Writer, f); err != nil {
+		slog.Warn("failed to write batch results", "id", c.Param("id"), "error", err)
+	}
+}
+
+func handleBatchError(c *gin.Context, err error) {
+	if errors.Is(err, errBatchNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("batch '%s' not found", c.Param("id"))})
+		return
+	}
 
-	c.JSON(http.StatusOK, api.ListResponse{Models: models})
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 }
 
 func (s *Server) CopyHandler(c *gin.Context) {
@@ -982,37 +2159,188 @@ func (s *Server) CopyHandler(c *gin.Context) {
 		return
 	}
 
+	if !checkRead(c, src) {
+		return
+	}
+
 	dst := model.ParseName(r.Destination)
 	if !dst.IsValid() {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("destination %q is invalid", r.Destination)})
 		return
 	}
+	if dst.Digest() != "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("destination %q: %v", r.Destination, errDigestTag)})
+		return
+	}
+	if _, ok := lookupAlias(dst); ok {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("destination %q: %v", r.Destination, errAliasIsAlias)})
+		return
+	}
 	dst, err = getExistingName(dst)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	if err := CopyModel(src, dst); errors.Is(err, os.ErrNotExist) {
-		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found", r.Source)})
-	} else if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-	}
-}
+	if !checkWrite(c, dst) {
+		return
+	}
+
+	if err := CopyModel(src, dst); errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found", r.Source)})
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func (s *Server) ExportHandler(c *gin.Context) {
+	var r api.ExportRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	n := model.ParseName(r.Model)
+	if !n.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("name %q is invalid", r.Model)})
+		return
+	}
+
+	n, err := getExistingName(n)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !checkRead(c, n) {
+		return
+	}
+
+	// check the model exists before the response is started so the error
+	// can still be reported as JSON
+	if _, err := ParseNamedManifest(n); errors.Is(err, os.ErrNotExist) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found", r.Model)})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "application/zstd")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", n.Model+"-"+n.Tag+".tar.zst"))
+	c.Status(http.StatusOK)
+
+	if err := exportModel(c.Request.Context(), n, c.Writer); err != nil {
+		// the client sees a truncated archive
+		slog.Error("export failed", "model", n.DisplayShortest(), "error", err)
+		c.Abort()
+	}
+}
+
+func (s *Server) ImportHandler(c *gin.Context) {
+	var n model.Name
+	if name := c.Query("model"); name != "" {
+		n = model.ParseName(name)
+		if !n.IsValid() {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("name %q is invalid", name)})
+			return
+		}
+	}
+
+	// the name in the archive can't be checked before it is written
+	if requestUser(c) != "" && !n.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+
+	if !checkWrite(c, n) {
+		return
+	}
+
+	n, err := importModel(c.Request.Context(), c.Request.Body, n)
+	switch {
+	case errors.Is(err, errDigestMismatch),
+		errors.Is(err, errArchiveNoManifest),
+		errors.Is(err, errArchiveMissingBlob),
+		errors.Is(err, errArchiveUnknownEntry),
+		errors.Is(err, tar.ErrHeader),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, api.ImportResponse{Model: n.DisplayShortest()})
+	}
+}
+
+func (s *Server) HeadBlobHandler(c *gin.Context) {
+	size, err := localBlobs.Stat(c.Request.Context(), c.Param("digest"))
+	if errors.Is(err, ErrInvalidDigestFormat) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("blob %q not found", c.Param("digest"))})
+		return
+	}
+
+	c.Header("Content-Length", strconv.FormatInt(size, 10))
+	c.Status(http.StatusOK)
+}
+
+func (s *Server) StorageHealthHandler(c *gin.Context) {
+	st, err := readScrubState()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp := api.StorageHealthResponse{Status: "ok", Scrubbing: scrubbing.Load()}
+	if !st.LastScrub.IsZero() {
+		resp.LastScrub = &st.LastScrub
+	}
+
+	if len(st.Corrupted) > 0 {
+		ms, err := Manifests(true)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		for digest, b := range st.Corrupted {
+			// blobs removed since the scrub are no longer a problem
+			if p, err := GetBlobsPath(digest); err != nil {
+				continue
+			} else if _, err := os.Stat(p); err != nil {
+				continue
+			}
+
+			cb := api.CorruptedBlob{Digest: digest, Actual: b.Actual, DetectedAt: b.DetectedAt}
+			for n, m := range ms {
+				if !canRead(requestUser(c), n) {
+					continue
+				}
+
+				if slices.ContainsFunc(append(m.Layers, m.Config), func(l Layer) bool { return l.Digest == digest }) {
+					cb.Models = append(cb.Models, n.DisplayShortest())
+				}
+			}
+			slices.Sort(cb.Models)
 
-func (s *Server) HeadBlobHandler(c *gin.Context) {
-	path, err := GetBlobsPath(c.Param("digest"))
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+			resp.Corrupted = append(resp.Corrupted, cb)
+		}
 	}
 
-	if _, err := os.Stat(path); err != nil {
-		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("blob %q not found", c.Param("digest"))})
-		return
+	if len(resp.Corrupted) > 0 {
+		resp.Status = "corrupted"
+		slices.SortFunc(resp.Corrupted, func(a, b api.CorruptedBlob) int {
+			return cmp.Compare(a.Digest, b.Digest)
+		})
 	}
 
-	c.Status(http.StatusOK)
+	c.JSON(http.StatusOK, resp)
 }
 
 func (s *Server) CreateBlobHandler(c *gin.Context) {
@@ -1035,14 +2363,11 @@ func (s *Server) CreateBlobHandler(c *gin.Context) {
 		}
 	}
 
-	path, err := GetBlobsPath(c.Param("digest"))
-	if err != nil {
+	_, err := localBlobs.Stat(c.Request.Context(), c.Param("digest"))
+	switch {
+	case errors.Is(err, ErrInvalidDigestFormat):
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
-	}
-
-	_, err = os.Stat(path)
-	switch {
 	case errors.Is(err, os.ErrNotExist):
 		// noop
 	case err != nil:
@@ -1053,18 +2378,63 @@ func (s *Server) CreateBlobHandler(c *gin.Context) {
 		return
 	}
 
-	layer, err := NewLayer(c.Request.Body, "")
-	if err != nil {
+	err = localBlobs.Put(c.Request.Context(), c.Param("digest"), c.Request.Body, c.Request.ContentLength)
+	if errors.Is(err, errDigestMismatch) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("digest mismatch, expected %q", c.Param("digest"))})
+		return
+	} else if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	if layer.Digest != c.Param("digest") {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("digest mismatch, expected %q, got %q", c.Param("digest"), layer.Digest)})
+	c.Status(http.StatusCreated)
+}
+
+func (s *Server) LinkBlobHandler(c *gin.Context) {
+	// the path refers to the server's filesystem so only local clients,
+	// which share it, may use it
+	if addr, err := netip.ParseAddrPort(c.Request.RemoteAddr); err != nil || !addr.Addr().IsLoopback() {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "linking blobs is only allowed from the local machine"})
 		return
 	}
 
-	c.Status(http.StatusCreated)
+	var r api.LinkBlobRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !filepath.IsAbs(r.Path) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("path %q is not absolute", r.Path)})
+		return
+	}
+
+	p, err := GetBlobsPath(c.Param("digest"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := os.Stat(p); err == nil {
+		c.JSON(http.StatusOK, api.LinkBlobResponse{Method: "existing"})
+		return
+	}
+
+	method, err := linkBlob(r.Path, c.Param("digest"))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, errDigestMismatch):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		slog.Debug("linked blob", "digest", c.Param("digest"), "path", r.Path, "method", method)
+		c.JSON(http.StatusCreated, api.LinkBlobResponse{Method: method})
+	}
 }
 
 func isLocalIP(ip netip.Addr) bool {
@@ -1117,7 +2487,9 @@ func allowedHost(host string) bool {
 
 func allowedHostsMiddleware(addr net.Addr) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if addr == nil {
+		// browsers can't connect to unix sockets, so their requests can't be
+		// rebound to them
+		if addr == nil || addr.Network() == "unix" {
 			c.Next()
 			return
 		}
@@ -1154,91 +2526,159 @@ func allowedHostsMiddleware(addr net.Addr) gin.HandlerFunc {
 }
 
 func (s *Server) GenerateRoutes(logger *slog.Logger, rc *goobla.Registry) (http.Handler, error) {
-	corsConfig := cors.DefaultConfig()
-	corsConfig.AllowWildcard = true
-	corsConfig.AllowBrowserExtensions = true
-	corsConfig.AllowHeaders = []string{
-		"Authorization",
-		"Content-Type",
-		"User-Agent",
-		"Accept",
-		"X-Requested-With",
-
-		// OpenAI compatibility headers
-		"OpenAI-Beta",
-		"x-stainless-arch",
-		"x-stainless-async",
-		"x-stainless-custom-poll-interval",
-		"x-stainless-helper-method",
-		"x-stainless-lang",
-		"x-stainless-os",
-		"x-stainless-package-version",
-		"x-stainless-poll-helper",
-		"x-stainless-retry-count",
-		"x-stainless-runtime",
-		"x-stainless-runtime-version",
-		"x-stainless-timeout",
-	}
-	corsConfig.AllowOrigins = envconfig.AllowedOrigins()
-
 	r := gin.Default()
 	r.HandleMethodNotAllowed = true
+
+	corsHandler, err := corsMiddleware(r.Routes)
+	if err != nil {
+		return nil, err
+	}
+
 	r.Use(
-		cors.New(corsConfig),
+		corsHandler,
 		allowedHostsMiddleware(s.addr),
+		tracingMiddleware(),
+		metricsMiddleware(),
+		multiUserMiddleware(),
+		apiKeyMiddleware(),
 	)
 
+	clients := newClientLimiter(func() int { return s.sched.slots() })
+	limit := clients.middleware()
+	rates := newRequestLimiter().middleware()
+	cancelable := s.cancelableMiddleware()
+	drain := s.drainMiddleware()
+	proxy := s.router.middleware()
+
 	// General
 	r.HEAD("/", func(c *gin.Context) { c.String(http.StatusOK, "Goobla is running") })
 	r.GET("/", func(c *gin.Context) { c.String(http.StatusOK, "Goobla is running") })
 	r.HEAD("/api/version", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"version": version.Version}) })
-	r.GET("/api/version", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"version": version.Version}) })
+	r.GET("/api/version", s.VersionHandler)
+
+	// Local model cache management
+	pull, del := s.PullHandler, s.DeleteHandler
+	if useRegistryClient(rc) {
+		// the new implementation handles pulls and deletes behind the
+		// same middleware as the other routes, so they are still
+		// authenticated, rate limited and audited
+		rs := &registry.Local{
+			Client: rc,
+			Logger: logger,
+			Prune:  PruneLayers,
+		}
+		pull, del = gin.WrapH(rs), gin.WrapH(rs)
+	}
 
-	// Local model cache management (new implementation is at end of function)
-	r.POST("/api/pull", s.PullHandler)
-	r.POST("/api/push", s.PushHandler)
+	r.POST("/api/pull", auditMiddleware("pull"), pull)
+	r.POST("/api/push", auditMiddleware("push"), s.PushHandler)
 	r.HEAD("/api/tags", s.ListHandler)
 	r.GET("/api/tags", s.ListHandler)
 	r.POST("/api/show", s.ShowHandler)
-	r.DELETE("/api/delete", s.DeleteHandler)
+	r.DELETE("/api/delete", auditMiddleware("delete"), del)
 
 	// Create
-	r.POST("/api/create", s.CreateHandler)
+	r.POST("/api/create", auditMiddleware("create"), s.CreateHandler)
 	r.POST("/api/blobs/:digest", s.CreateBlobHandler)
 	r.HEAD("/api/blobs/:digest", s.HeadBlobHandler)
-	r.POST("/api/copy", s.CopyHandler)
+	r.GET("/api/blobs/:digest", s.GetBlobHandler)
+	r.POST("/api/blobs/:digest/link", s.LinkBlobHandler)
+	r.GET("/api/manifests/*name", s.GetManifestHandler)
+	r.POST("/api/admin/drain", auditMiddleware("drain"), s.DrainHandler)
+	r.GET("/api/health", s.HealthHandler)
+	r.HEAD("/api/health", s.HealthHandler)
+	r.GET("/api/health/live", s.LiveHandler)
+	r.HEAD("/api/health/live", s.LiveHandler)
+	r.GET("/api/health/ready", s.ReadyHandler)
+	r.HEAD("/api/health/ready", s.ReadyHandler)
+	r.GET("/api/health/storage", s.StorageHealthHandler)
+	r.POST("/api/copy", auditMiddleware("copy"), s.CopyHandler)
+	r.POST("/api/edit", auditMiddleware("edit"), s.EditHandler)
+	r.POST("/api/export", s.ExportHandler)
+	r.POST("/api/sign", auditMiddleware("sign"), s.SignHandler)
+	r.POST("/api/pin", auditMiddleware("pin"), s.PinHandler)
+	r.DELETE("/api/pin", auditMiddleware("unpin"), s.PinHandler)
+	r.POST("/api/preload", auditMiddleware("preload"), s.PreloadHandler)
+	r.DELETE("/api/preload", auditMiddleware("delete_preload"), s.PreloadHandler)
+	r.GET("/api/updates", s.UpdatesHandler)
+	r.POST("/api/import", auditMiddleware("import"), s.ImportHandler)
+	r.GET("/api/aliases", s.ListAliasesHandler)
+	r.POST("/api/aliases", auditMiddleware("create_alias"), s.CreateAliasHandler)
+	r.DELETE("/api/aliases", auditMiddleware("delete_alias"), s.DeleteAliasHandler)
+	r.GET("/api/audit", s.AuditHandler)
+	r.GET("/api/keys", s.ListKeysHandler)
+	r.POST("/api/keys", auditMiddleware("create_key"), s.CreateKeyHandler)
+	r.DELETE("/api/keys/:id", auditMiddleware("delete_key"), s.DeleteKeyHandler)
+	r.GET("/api/config", s.ConfigHandler)
+	r.PATCH("/api/config", auditMiddleware("update_config"), s.UpdateConfigHandler)
+	r.GET("/api/conversations", s.ListConversationsHandler)
+	r.POST("/api/conversations", s.CreateConversationHandler)
+	r.GET("/api/conversations/:id", s.GetConversationHandler)
+	r.POST("/api/conversations/:id/messages", s.AddMessagesHandler)
+	r.DELETE("/api/conversations/:id", s.DeleteConversationHandler)
+	r.GET("/api/sessions", s.ListSessionsHandler)
+	r.POST("/api/sessions", auditMiddleware("create_session"), s.CreateSessionHandler)
+	r.DELETE("/api/sessions/:id", s.CloseSessionHandler)
+	r.GET("/api/batch", s.ListBatchesHandler)
+	r.POST("/api/batch", auditMiddleware("create_batch"), s.CreateBatchHandler)
+	r.GET("/api/batch/:id", s.GetBatchHandler)
+	r.POST("/api/batch/:id/cancel", auditMiddleware("cancel_batch"), s.CancelBatchHandler)
+	r.GET("/api/batch/:id/results", s.BatchResultsHandler)
+	r.DELETE("/api/batch/:id", auditMiddleware("delete_batch"), s.DeleteBatchHandler)
+	r.GET("/metrics", s.MetricsHandler)
 
 	// Inference
 	r.GET("/api/ps", s.PsHandler)
-	r.POST("/api/generate", s.GenerateHandler)
-	r.POST("/api/chat", s.ChatHandler)
-	r.POST("/api/embed", s.EmbedHandler)
-	r.POST("/api/embeddings", s.EmbeddingsHandler)
+	r.GET("/api/status", s.StatusHandler)
+	r.POST("/api/generate", auditMiddleware("generate"), cancelable, rates, proxy, drain, limit, s.GenerateHandler)
+	r.POST("/api/chat", auditMiddleware("chat"), cancelable, rates, proxy, drain, limit, s.ChatHandler)
+	r.DELETE("/api/chat/session", s.DeleteChatSessionHandler)
+	r.POST("/api/sessions/:id/chat", auditMiddleware("chat"), cancelable, rates, drain, limit, s.SessionChatHandler)
+	r.POST("/api/cancel/:id", s.CancelHandler)
+	r.POST("/api/embed", rates, proxy, drain, limit, s.EmbedHandler)
+	r.POST("/api/rerank", rates, drain, limit, s.RerankHandler)
+	r.POST("/api/tokenize", rates, drain, limit, s.TokenizeHandler)
+	r.POST("/api/detokenize", rates, drain, limit, s.DetokenizeHandler)
+	r.POST("/api/template", rates, drain, limit, s.TemplateHandler)
+	r.POST("/api/score", rates, drain, limit, s.ScoreHandler)
+	r.POST("/api/compare", auditMiddleware("chat"), cancelable, rates, drain, limit, s.CompareHandler)
+	r.POST("/api/embeddings", rates, proxy, drain, limit, s.EmbeddingsHandler)
 
 	// Inference (OpenAI compatibility)
-	r.POST("/v1/chat/completions", openaimid.ChatMiddleware(), s.ChatHandler)
-	r.POST("/v1/completions", openaimid.CompletionsMiddleware(), s.GenerateHandler)
-	r.POST("/v1/embeddings", openaimid.EmbeddingsMiddleware(), s.EmbedHandler)
+	r.POST("/v1/chat/completions", auditMiddleware("chat"), cancelable, rates, proxy, openaimid.ChatMiddleware(), drain, limit, s.ChatHandler)
+	r.POST("/v1/responses", auditMiddleware("chat"), cancelable, rates, proxy, openaimid.ResponsesMiddleware(), drain, limit, s.ChatHandler)
+	r.POST("/v1/completions", auditMiddleware("generate"), cancelable, rates, proxy, openaimid.CompletionsMiddleware(), drain, limit, s.GenerateHandler)
+	r.POST("/v1/embeddings", rates, proxy, openaimid.EmbeddingsMiddleware(), drain, limit, s.EmbedHandler)
+	r.POST("/v1/rerank", rates, openaimid.RerankMiddleware(), drain, limit, s.RerankHandler)
 	r.GET("/v1/models", openaimid.ListMiddleware(), s.ListHandler)
-	r.GET("/v1/models/:model", openaimid.RetrieveMiddleware(), s.ShowHandler)
-
-	if rc != nil {
-		// wrap old with new
-		rs := &registry.Local{
-			Client:   rc,
-			Logger:   logger,
-			Fallback: r,
-
-			Prune: PruneLayers,
+	r.GET("/v1/models/*model", openaimid.RetrieveMiddleware(), s.ShowHandler)
+	r.Any("/v1/images/*path", openaimid.UnsupportedMiddleware())
+	r.POST("/v1/audio/transcriptions", auditMiddleware("chat"), cancelable, rates, proxy, openaimid.TranscriptionsMiddleware(), drain, limit, s.ChatHandler)
+	r.Any("/v1/audio/speech", openaimid.UnsupportedMiddleware())
+	r.Any("/v1/audio/translations", openaimid.UnsupportedMiddleware())
+
+	// Inference (Anthropic compatibility)
+	r.POST("/anthropic/v1/messages", auditMiddleware("chat"), cancelable, rates, proxy, anthropic.MessagesMiddleware(), drain, limit, s.ChatHandler)
+
+	r.NoRoute(func(c *gin.Context) {
+		if strings.HasPrefix(c.Request.URL.Path, "/v1/") {
+			openaimid.UnsupportedMiddleware()(c)
 		}
-		return rs, nil
-	}
+	})
 
 	return r, nil
 }
 
+// useRegistryClient reports whether pulls and deletes are handled by the new
+// registry client rc. It doesn't know about users so it can't be used in
+// multi-user mode, nor is it offline, nor does it verify signatures.
+func useRegistryClient(rc *goobla.Registry) bool {
+	return rc != nil && !envconfig.MultiUser() && !envconfig.Offline() && !envconfig.RequireSignedModels()
+}
+
 func Serve(ln net.Listener) error {
-	slog.SetDefault(logutil.NewLogger(os.Stderr, envconfig.LogLevel()))
+	logLevel.Set(envconfig.LogLevel())
+	slog.SetDefault(logutil.NewLogger(os.Stderr, logLevel))
 	slog.Info("server config", "env", envconfig.Values())
 
 	blobsDir, err := GetBlobsPath("")
@@ -1269,7 +2709,18 @@ func Serve(ln net.Listener) error {
 		}
 	}
 
-	s := &Server{addr: ln.Addr()}
+	stopTracing, err := setupTracing(context.Background())
+	if err != nil {
+		return err
+	}
+	defer stopTracing()
+
+	s := &Server{addr: ln.Addr(), drainRequests: make(chan struct{}, 1)}
+
+	s.router, err = newRouter(envconfig.RouteTo())
+	if err != nil {
+		return err
+	}
 
 	var rc *goobla.Registry
 	if useClient2 {
@@ -1312,20 +2763,88 @@ func Serve(ln net.Listener) error {
 	sched := InitScheduler(schedCtx)
 	s.sched = sched
 
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		schedDone()
+		done()
+		return fmt.Errorf("tls: %w", err)
+	}
+
+	drainOn, err := drainSignals()
+	if err != nil {
+		schedDone()
+		done()
+		return err
+	}
+
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+		slog.Info("serving TLS", "client_auth", tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert)
+	}
+
 	slog.Info(fmt.Sprintf("Listening on %s (version %s)", ln.Addr(), version.Version))
 
-	// listen for a ctrl+c and stop any loaded llm
+	if p := envconfig.UnixSocket(); p != "" {
+		sock, err := ListenUnix(p)
+		if err != nil {
+			schedDone()
+			done()
+			return err
+		}
+
+		slog.Info("listening on unix socket", "path", p)
+		go func() {
+			if err := srvr.Serve(sock); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("unix socket server error", "error", err)
+			}
+		}()
+	}
+
+	var stopOnce sync.Once
+	stop := func() {
+		stopOnce.Do(func() {
+			srvr.Close()
+			schedDone()
+			sched.unloadAllRunners()
+			s.sessions.closeAll()
+			done()
+		})
+	}
+
+	// listen for a ctrl+c and stop any loaded llm, draining the server
+	// first for the signals of GOOBLA_DRAIN_ON
 	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signals, append([]os.Signal{syscall.SIGINT, syscall.SIGTERM}, drainOn...)...)
 	go func() {
-		<-signals
-		srvr.Close()
-		schedDone()
-		sched.unloadAllRunners()
-		done()
+		select {
+		case sig := <-signals:
+			if !slices.Contains(drainOn, sig) {
+				stop()
+				return
+			}
+		case <-s.drainRequests:
+		}
+
+		// another signal stops the server without waiting
+		go func() {
+			<-signals
+			stop()
+		}()
+
+		s.drain(srvr)
+		stop()
 	}()
 
 	s.sched.Run(schedCtx)
+	go runScrubber(ctx)
+	go runUpdater(ctx)
+	go s.runBatches(ctx)
+	go s.preloadModels()
+	go s.sessions.run(ctx)
+	if s.router != nil {
+		slog.Info("routing requests", "backends", envconfig.RouteTo())
+		go s.router.run(ctx)
+	}
 
 	// register the experimental webp decoder
 	// so webp images can be used in multimodal inputs
@@ -1336,6 +2855,8 @@ func Serve(ln net.Listener) error {
 	gpus := discover.GetGPUInfo()
 	gpus.LogDetails()
 
+	notify(webhookEvent{Event: eventServerStarted})
+
 	err = srvr.Serve(ln)
 	// If server is closed from the signal handler, wait for the ctx to be done
 	// otherwise error out quickly
@@ -1373,6 +2894,68 @@ func waitForStream(c *gin.Context, ch chan any) {
 	c.JSON(http.StatusOK, latest)
 }
 
+// errGenerationTimeout is the cause of the cancellation of a generate or chat
+// request that took longer than its timeout.
+var errGenerationTimeout = errors.New("generation timed out")
+
+// withGenerationTimeout returns a copy of ctx that is canceled once a request
+// with the timeout has generated for as long as it or GOOBLA_MAX_GENERATION_TIME
+// allows, whichever is shorter.
+func withGenerationTimeout(ctx context.Context, timeout *api.Duration) (context.Context, context.CancelFunc) {
+	d := envconfig.MaxGenerationTime()
+	if timeout != nil && timeout.Duration > 0 && (d == 0 || timeout.Duration < d) {
+		d = timeout.Duration
+	}
+
+	if d == 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeoutCause(ctx, d, errGenerationTimeout)
+}
+
+// timeoutMetrics returns the metrics of a response that timed out with the
+// usage so far.
+func timeoutMetrics(usage api.Usage, start, loaded time.Time) api.Metrics {
+	return api.Metrics{
+		TotalDuration:   time.Since(start),
+		LoadDuration:    loaded.Sub(start),
+		PromptEvalCount: usage.PromptEvalCount,
+		EvalCount:       usage.EvalCount,
+	}
+}
+
+// streamError returns the final response of a generate or chat request that
+// failed with err after it started, with the usage of its response so far.
+func streamError(err error, usage api.Usage) api.StreamError {
+	se := api.StreamError{ErrorMessage: err.Error(), Code: errorCode(err), Usage: &usage}
+
+	var crash *llm.CrashError
+	if errors.As(err, &crash) {
+		se.CrashID = crash.ID
+	}
+	return se
+}
+
+// errorCode returns the [api.ErrorCode] of err.
+func errorCode(err error) api.ErrorCode {
+	msg := strings.ToLower(err.Error())
+	switch {
+	case errors.Is(err, context.Canceled):
+		return api.ErrorCodeCanceled
+	case errors.Is(err, context.DeadlineExceeded), strings.Contains(msg, "timed out"):
+		return api.ErrorCodeTimeout
+	case strings.Contains(msg, "out of memory"), strings.Contains(msg, "cudamalloc failed"), strings.Contains(msg, "failed to allocate"):
+		// the runner stops if it runs out of memory, but only its
+		// message tells
+		return api.ErrorCodeOutOfMemory
+	case errors.Is(err, llm.ErrRunnerStopped):
+		return api.ErrorCodeRunnerStopped
+	default:
+		return api.ErrorCodeInternal
+	}
+}
+
 func streamResponse(c *gin.Context, ch chan any) {
 	c.Header("Content-Type", "application/x-ndjson")
 	c.Stream(func(w io.Writer) bool {
@@ -1398,10 +2981,34 @@ func streamResponse(c *gin.Context, ch chan any) {
 	})
 }
 
+// VersionHandler reports the server's version, and the build of the CPU
+// backend the runners load for the server's CPU.
+func (s *Server) VersionHandler(c *gin.Context) {
+	features := discover.CPUFeatures()
+	variant, forced := discover.CPUVariant(features)
+	if features == nil {
+		features = []string{}
+	}
+
+	c.JSON(http.StatusOK, api.VersionResponse{
+		Version: version.Version,
+		CPU: &api.CPUDiagnostics{
+			Features: features,
+			Variant:  variant,
+			Forced:   forced,
+		},
+	})
+}
+
 func (s *Server) PsHandler(c *gin.Context) {
 	models := []api.ProcessModelResponse{}
 
+	user := requestUser(c)
 	for _, v := range s.sched.loaded {
+		if !canRead(user, model.ParseName(v.model.Name)) {
+			continue
+		}
+
 		model := v.model
 		modelDetails := api.ModelDetails{
 			Format:            model.Config.ModelFormat,
@@ -1419,6 +3026,10 @@ func (s *Server) PsHandler(c *gin.Context) {
 			Digest:    model.Digest,
 			Details:   modelDetails,
 			ExpiresAt: v.expiresAt,
+
+			KVCacheType: v.kvCacheType,
+			KVCacheSize: int64(v.kvCacheSize),
+			Sessions:    s.sessions.count(model.ModelPath),
 		}
 		// The scheduler waits to set expiresAt, so if a model is loading it's
 		// possible that it will be set to the unix epoch. For those cases, just
@@ -1436,7 +3047,7 @@ func (s *Server) PsHandler(c *gin.Context) {
 		return cmp.Compare(j.ExpiresAt.Unix(), i.ExpiresAt.Unix())
 	})
 
-	c.JSON(http.StatusOK, api.ProcessResponse{Models: models})
+	c.JSON(http.StatusOK, api.ProcessResponse{Models: models, Devices: s.sched.deviceStatus()})
 }
 
 func (s *Server) ChatHandler(c *gin.Context) {
@@ -1451,6 +3062,22 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		return
 	}
 
+	// a request of a live session has only its new messages, and is made
+	// with the session's model and options
+	var live *liveSession
+	if v, ok := c.Get(sessionContextKey); ok {
+		live = v.(*liveSession)
+		if req.ConversationID != "" || req.SessionID != "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "conversation_id and session_id can't be used in a session"})
+			return
+		}
+
+		opts := make(map[string]any, len(live.options)+len(req.Options))
+		maps.Copy(opts, live.options)
+		maps.Copy(opts, req.Options)
+		req.Model, req.Options = live.model, opts
+	}
+
 	// expire the runner
 	if len(req.Messages) == 0 && req.KeepAlive != nil && int(req.KeepAlive.Seconds()) == 0 {
 		model, err := GetModel(req.Model)
@@ -1477,10 +3104,39 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		return
 	}
 
+	var conv *api.Conversation
+	if req.ConversationID != "" {
+		var err error
+		conv, err = getConversation(requestUser(c), req.ConversationID)
+		if errors.Is(err, errConversationNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("conversation '%s' not found", req.ConversationID)})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if req.Model == "" {
+			req.Model = conv.Model
+		}
+	}
+
+	if len(req.ServerTools) > 0 {
+		defs, err := serverTools(req.ServerTools, req.Tools)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		req.Tools = append(req.Tools, defs...)
+	}
+
 	caps := []model.Capability{model.CapabilityCompletion}
 	if len(req.Tools) > 0 {
 		caps = append(caps, model.CapabilityTools)
 	}
+	if slices.ContainsFunc(req.Messages, func(msg api.Message) bool { return len(msg.Audio) > 0 }) {
+		caps = append(caps, model.CapabilityAudio)
+	}
 	if req.Think != nil && *req.Think {
 		caps = append(caps, model.CapabilityThinking)
 	}
@@ -1496,7 +3152,35 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		return
 	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), caps, req.Options, req.KeepAlive)
+	if !checkRead(c, name) {
+		return
+	}
+
+	priority, err := resolvePriority(c, req.Priority)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := llm.CompletionGrammar(req.Format, req.Grammar); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := checkLogprobs(req.Logprobs, req.TopLogprobs); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Draft != "" && !checkDraft(c, req.Draft) {
+		return
+	}
+
+	// the runner is scheduled with a context of its own, which is canceled
+	// to release it if it crashes and the request is retried
+	schedCtx, release := context.WithCancel(c.Request.Context())
+	defer func() { release() }()
+	r, m, opts, err := s.scheduleRunner(schedCtx, name.String(), caps, req.Options, req.KeepAlive, priority, req.Draft)
 	if errors.Is(err, errCapabilityCompletion) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support chat", req.Model)})
 		return
@@ -1505,6 +3189,13 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		return
 	}
 
+	retry := func(numGPU int) (llm.LlamaServer, error) {
+		release()
+		schedCtx, release = context.WithCancel(c.Request.Context())
+		r, _, _, err := s.scheduleRunner(schedCtx, name.String(), caps, withNumGPU(req.Options, numGPU), req.KeepAlive, priority, req.Draft)
+		return r, err
+	}
+
 	checkpointLoaded := time.Now()
 
 	if len(req.Messages) == 0 {
@@ -1518,14 +3209,42 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		return
 	}
 
-	msgs := append(m.Messages, req.Messages...)
-	if req.Messages[0].Role != "system" && m.System != "" {
+	var msgImages [][]api.ImageData
+	for i, msg := range req.Messages {
+		msgImages = append(msgImages, msg.Images)
+
+		req.Messages[i].Audio, err = prepareAudio(c.Request.Context(), msg.Audio)
+		if err != nil {
+			c.JSON(imageErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := prepareImages(c.Request.Context(), m, msgImages...); err != nil {
+		c.JSON(imageErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	chat := req.Messages
+	if conv != nil {
+		chat = append(slices.Clone(conv.Messages), req.Messages...)
+	} else if live != nil {
+		chat = append(s.sessions.history(live), req.Messages...)
+	}
+
+	msgs := append(m.Messages, chat...)
+	// the system prompts of locked models are kept before the system
+	// messages of the request instead of being replaced by them
+	if (chat[0].Role != "system" || m.Locked()) && m.System != "" {
 		msgs = append([]api.Message{{Role: "system", Content: m.System}}, msgs...)
 	}
 	msgs = filterThinkTags(msgs, m)
 
 	prompt, images, err := chatPrompt(c.Request.Context(), m, r.Tokenize, opts, msgs, req.Tools, req.Think)
-	if err != nil {
+	var exception *jinja.Exception
+	if errors.Is(err, errContextOverflow) || errors.As(err, &exception) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
 		slog.Error("chat prompt error", "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -1545,66 +3264,230 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		toolParser = tools.NewParser(m.Template.Template, req.Tools)
 	}
 
+	// the caches of conversations and live sessions are kept like a
+	// session's, so their history doesn't need to be evaluated again
+	sessionID := req.SessionID
+	switch {
+	case sessionID != "":
+	case conv != nil:
+		sessionID = "conversation:" + conv.ID
+	case live != nil:
+		sessionID = "session:" + live.id
+	}
+
+	var session string
+	if sessionID != "" {
+		session, err = sessionPath(requestUser(c), m, sessionID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	metrics := newCompletionMetrics(m, checkpointStart)
+	var usage usageTracker
+	repro := reproducibility(r, m, opts)
+	ctx, cancel := withGenerationTimeout(c.Request.Context(), req.Timeout)
 	ch := make(chan any)
 	go func() {
 		defer close(ch)
+		defer cancel()
 
-		if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
-			Prompt:  prompt,
-			Images:  images,
-			Format:  req.Format,
-			Options: opts,
-		}, func(r llm.CompletionResponse) {
-			res := api.ChatResponse{
-				Model:     req.Model,
-				CreatedAt: time.Now().UTC(),
-				Message:   api.Message{Role: "assistant", Content: r.Content},
-				Done:      r.Done,
-				Metrics: api.Metrics{
-					PromptEvalCount:    r.PromptEvalCount,
-					PromptEvalDuration: r.PromptEvalDuration,
-					EvalCount:          r.EvalCount,
-					EvalDuration:       r.EvalDuration,
-				},
+		// the messages to add to the conversation once the response is done
+		added := slices.Clone(req.Messages)
+
+		for round := 0; ; round++ {
+			// the calls to server tools in this round, which are run once
+			// it's done instead of being returned, and the message they're
+			// part of
+			var serverCalls []api.ToolCall
+			var clientCalls bool
+			var answer, thought strings.Builder
+			var calls []api.ToolCall
+			var done bool
+			serverIndices := make(map[int]bool)
+			send := func(res api.ChatResponse) {
+				clientCalls = clientCalls || len(res.Message.ToolCalls) > 0
+				if res.Done && len(serverCalls) > 0 {
+					if clientCalls {
+						// the client runs the calls to its own tools, so
+						// it's given the others too
+						res.Message.ToolCalls = append(res.Message.ToolCalls, serverCalls...)
+						serverCalls = nil
+					} else {
+						// the model answers once it has the results
+						res.Done = false
+						res.DoneReason = ""
+						res.Metrics = api.Metrics{}
+						res.Reproducibility = nil
+					}
+				}
+
+				answer.WriteString(res.Message.Content)
+				thought.WriteString(res.Message.Thinking)
+				calls = append(calls, res.Message.ToolCalls...)
+				done = res.Done
+				ch <- res
 			}
 
-			if thinkingState != nil {
-				thinkingContent, remainingContent := thinkingState.AddContent(res.Message.Content)
-				if thinkingContent == "" && remainingContent == "" && !r.Done {
-					// need to accumulate more to decide what to send
+			// log probabilities of content that hasn't been sent yet, such as
+			// while tool calls are being parsed
+			var logprobs []api.Logprob
+			err := s.completion(ctx, &r, m, llm.CompletionRequest{
+				Prompt:        prompt,
+				Images:        images,
+				Format:        req.Format,
+				Grammar:       req.Grammar,
+				Options:       opts,
+				StatsInterval: statsInterval(req.Stream, req.StatsInterval),
+				Session:       session,
+				Logprobs:      req.Logprobs,
+				TopLogprobs:   req.TopLogprobs,
+			}, func(r llm.CompletionResponse) {
+				metrics.observe(r)
+				usage.observe(r)
+				if r.Done {
+					chargeTokens(c, r.PromptEvalCount+r.EvalCount)
+				}
+				if r.Progress {
+					ch <- api.ChatResponse{Model: req.Model, CreatedAt: time.Now().UTC(), Message: api.Message{Role: "assistant"}, Usage: usage.usage(r)}
 					return
 				}
-				res.Message.Content = remainingContent
-				res.Message.Thinking = thinkingContent
-			}
 
-			if r.Done {
-				res.DoneReason = r.DoneReason.String()
-				res.TotalDuration = time.Since(checkpointStart)
-				res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+				res := api.ChatResponse{
+					Model:     req.Model,
+					CreatedAt: time.Now().UTC(),
+					Message:   api.Message{Role: "assistant", Content: r.Content},
+					Done:      r.Done,
+					Metrics: api.Metrics{
+						PromptEvalCount:    r.PromptEvalCount,
+						PromptEvalDuration: r.PromptEvalDuration,
+						EvalCount:          r.EvalCount,
+						EvalDuration:       r.EvalDuration,
+						PromptImageCount:   r.PromptImageCount,
+					},
+				}
+				logprobs = append(logprobs, r.Logprobs...)
+
+				if thinkingState != nil {
+					thinkingContent, remainingContent := thinkingState.AddContent(res.Message.Content)
+					if thinkingContent == "" && remainingContent == "" && !r.Done {
+						// need to accumulate more to decide what to send
+						return
+					}
+					res.Message.Content = remainingContent
+					res.Message.Thinking = thinkingContent
+				}
+
+				if r.Done {
+					res.DoneReason = r.DoneReason.String()
+					res.TotalDuration = time.Since(checkpointStart)
+					res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+					res.NumCtx = opts.NumCtx
+					res.Reproducibility = repro
+				}
+
+				if len(req.Tools) > 0 {
+					toolCalls, content := toolParser.Add(res.Message.Content)
+					deltas := toolParser.Deltas()
+					if req.ParallelToolCalls != nil && !*req.ParallelToolCalls {
+						toolCalls = slices.DeleteFunc(toolCalls, func(tc api.ToolCall) bool { return tc.Function.Index > 0 })
+						deltas = slices.DeleteFunc(deltas, func(d api.ToolCallDelta) bool { return d.Index > 0 })
+					}
+
+					if round < maxToolRounds && len(req.ServerTools) > 0 {
+						for _, d := range deltas {
+							if slices.Contains(req.ServerTools, d.Name) {
+								serverIndices[d.Index] = true
+							}
+						}
+
+						deltas = slices.DeleteFunc(deltas, func(d api.ToolCallDelta) bool { return serverIndices[d.Index] })
+						toolCalls = slices.DeleteFunc(toolCalls, func(tc api.ToolCall) bool {
+							if slices.Contains(req.ServerTools, tc.Function.Name) {
+								serverCalls = append(serverCalls, tc)
+								return true
+							}
+							return false
+						})
+					}
+
+					res.Message.ToolCallDeltas = deltas
+					if len(content) > 0 {
+						res.Message.Content = content
+					} else if len(toolCalls) > 0 {
+						res.Message.ToolCalls = toolCalls
+						res.Message.Content = ""
+					} else if len(deltas) > 0 {
+						res.Message.Content = ""
+					} else if res.Message.Thinking != "" {
+						// don't return
+					} else {
+						if r.Done {
+							res.Message.Content = toolParser.Content()
+							res.Logprobs, logprobs = logprobs, nil
+							send(res)
+						}
+						return
+					}
+				}
+
+				res.Logprobs, logprobs = logprobs, nil
+				send(res)
+			}, retry)
+			if errors.Is(context.Cause(ctx), errGenerationTimeout) {
+				// the response so far is the answer, so the calls to
+				// server tools aren't run
+				serverCalls = nil
+				send(api.ChatResponse{
+					Model:           req.Model,
+					CreatedAt:       time.Now().UTC(),
+					Message:         api.Message{Role: "assistant"},
+					Done:            true,
+					DoneReason:      llm.DoneReasonTimeout.String(),
+					Metrics:         timeoutMetrics(usage.partial, checkpointStart, checkpointLoaded),
+					Reproducibility: repro,
+				})
+			} else if err != nil {
+				ch <- streamError(err, usage.partial)
+				return
 			}
 
-			if len(req.Tools) > 0 {
-				toolCalls, content := toolParser.Add(res.Message.Content)
-				if len(content) > 0 {
-					res.Message.Content = content
-				} else if len(toolCalls) > 0 {
-					res.Message.ToolCalls = toolCalls
-					res.Message.Content = ""
-				} else if res.Message.Thinking != "" {
-					// don't return
-				} else {
-					if r.Done {
-						res.Message.Content = toolParser.Content()
-						ch <- res
+			if len(serverCalls) == 0 {
+				if (conv != nil || live != nil) && done {
+					added = append(added, api.Message{Role: "assistant", Content: answer.String(), Thinking: thought.String(), ToolCalls: calls})
+					if conv != nil {
+						if _, err := appendConversation(requestUser(c), conv.ID, added); err != nil {
+							slog.Warn("failed to save conversation", "conversation", conv.ID, "error", err)
+						}
+					} else {
+						s.sessions.add(live, added)
 					}
-					return
 				}
+				return
 			}
 
-			ch <- res
-		}); err != nil {
-			ch <- gin.H{"error": err.Error()}
+			executions := runTools(ctx, serverCalls)
+			ch <- api.ChatResponse{Model: req.Model, CreatedAt: time.Now().UTC(), Message: api.Message{Role: "assistant"}, ToolExecutions: executions}
+
+			reply := api.Message{Role: "assistant", Content: answer.String(), ToolCalls: serverCalls}
+			msgs = append(msgs, reply)
+			added = append(added, reply)
+			for _, e := range executions {
+				msgs = append(msgs, toolMessage(e))
+				added = append(added, toolMessage(e))
+			}
+
+			prompt, images, err = chatPrompt(c.Request.Context(), m, r.Tokenize, opts, msgs, req.Tools, req.Think)
+			if err != nil {
+				ch <- streamError(err, usage.partial)
+				return
+			}
+
+			toolParser = tools.NewParser(m.Template.Template, req.Tools)
+			if thinkingState != nil {
+				thinkingState = &thinking.Parser{OpeningTag: openingTag, ClosingTag: closingTag}
+			}
 		}
 	}()
 
@@ -1613,22 +3496,21 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		var toolCalls []api.ToolCall
 		var sbThinking strings.Builder
 		var sbContent strings.Builder
+		var logprobs []api.Logprob
+		var executions []api.ToolExecution
 		for rr := range ch {
 			switch t := rr.(type) {
 			case api.ChatResponse:
 				sbThinking.WriteString(t.Message.Thinking)
 				sbContent.WriteString(t.Message.Content)
+				logprobs = append(logprobs, t.Logprobs...)
+				executions = append(executions, t.ToolExecutions...)
 				resp = t
 				if len(req.Tools) > 0 {
 					toolCalls = append(toolCalls, t.Message.ToolCalls...)
 				}
-			case gin.H:
-				msg, ok := t["error"].(string)
-				if !ok {
-					msg = "unexpected error format in response"
-				}
-
-				c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+			case api.StreamError:
+				c.JSON(http.StatusInternalServerError, t)
 				return
 			default:
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected response"})
@@ -1638,6 +3520,9 @@ func (s *Server) ChatHandler(c *gin.Context) {
 
 		resp.Message.Content = sbContent.String()
 		resp.Message.Thinking = sbThinking.String()
+		resp.Message.ToolCallDeltas = nil
+		resp.Logprobs = logprobs
+		resp.ToolExecutions = executions
 
 		if len(toolCalls) > 0 {
 			resp.Message.ToolCalls = toolCalls
@@ -1652,7 +3537,7 @@ func (s *Server) ChatHandler(c *gin.Context) {
 
 func handleScheduleError(c *gin.Context, name string, err error) {
 	switch {
-	case errors.Is(err, errCapabilities), errors.Is(err, errRequired):
+	case errors.Is(err, errCapabilities), errors.Is(err, errRequired), errors.Is(err, errInvalidOptions):
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 	case errors.Is(err, context.Canceled):
 		c.JSON(499, gin.H{"error": "request canceled"})
@@ -5,8 +5,10 @@ import (
 	"cmp"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -20,6 +22,7 @@ import (
 	"github.com/goobla/goobla/api"
 	"github.com/goobla/goobla/envconfig"
 	"github.com/goobla/goobla/fs/ggml"
+	"github.com/goobla/goobla/types/model"
 )
 
 var stream bool = false
@@ -186,6 +189,48 @@ func TestCreateFromModel(t *testing.T) {
 	})
 }
 
+func TestCreateDigestTag(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("GOOBLA_MODELS", p)
+	var s Server
+
+	_, digest := createBinFile(t, nil, nil)
+	tag := "sha256-" + strings.Repeat("0a", 32)
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:   "test:" + tag,
+		Files:  map[string]string{"test.gguf": digest},
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status code 400, actual %d", w.Code)
+	}
+
+	w = createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:   "test",
+		Files:  map[string]string{"test.gguf": digest},
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	for _, dst := range []string{"test2:" + tag, "test2@sha256:" + strings.Repeat("0a", 32)} {
+		w = createRequest(t, s.CopyHandler, api.CopyRequest{Source: "test", Destination: dst})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("copy to %s: expected status code 400, actual %d", dst, w.Code)
+		}
+	}
+
+	checkFileExists(t, filepath.Join(p, "manifests", "*", "*", "*", "*"), []string{
+		filepath.Join(p, "manifests", "registry.goobla.ai", "library", "test", "latest"),
+	})
+}
+
 func TestCreateRemovesLayers(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
@@ -621,6 +666,53 @@ func TestCreateTemplateSystem(t *testing.T) {
 	})
 }
 
+func TestCreateCheckTemplate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("GOOBLA_MODELS", p)
+	var s Server
+
+	t.Run("broken", func(t *testing.T) {
+		_, digest := createBinFile(t, nil, nil)
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:     "broken",
+			Files:    map[string]string{"test.gguf": digest},
+			Template: `{{ range .Messages }}{{ if eq .Role "user" }}{{ .Content }}{{ end }}{{ end }}{{ .Sytem }}`,
+			Check:    true,
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status code 400, actual %d", w.Code)
+		}
+
+		for _, s := range []string{`undefined variable \"Sytem\"`, "the assistant message is missing from the prompt"} {
+			if !strings.Contains(w.Body.String(), s) {
+				t.Errorf("expected %q in %s", s, w.Body.String())
+			}
+		}
+
+		if _, err := ParseNamedManifest(model.ParseName("broken")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected no manifest, actual %v", err)
+		}
+	})
+
+	t.Run("warnings", func(t *testing.T) {
+		_, digest := createBinFile(t, nil, nil)
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:   "default",
+			Files:  map[string]string{"test.gguf": digest},
+			Check:  true,
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
+
 func TestCreateLicenses(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
@@ -670,6 +762,216 @@ func TestCreateLicenses(t *testing.T) {
 	}
 }
 
+func TestCreateMetadata(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+	var s Server
+
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture": "test",
+		"general.license":      "apache-2.0",
+		"general.file_type":    uint32(1),
+		"test.context_length":  uint32(4096),
+	}, nil)
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:     "test",
+		Files:    map[string]string{"test.gguf": digest},
+		Metadata: &api.ModelMetadata{Source: "https://example.com/test"},
+		Stream:   &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	want := api.ModelMetadata{
+		License:       "apache-2.0",
+		ContextLength: 4096,
+		Source:        "https://example.com/test",
+		Quantization:  "F16",
+	}
+
+	w = createRequest(t, s.ShowHandler, api.ShowRequest{Model: "test"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	var show api.ShowResponse
+	if err := json.NewDecoder(w.Body).Decode(&show); err != nil {
+		t.Fatal(err)
+	}
+
+	if show.Metadata != want {
+		t.Errorf("expected show metadata %+v, actual %+v", want, show.Metadata)
+	}
+
+	w = createRequest(t, s.ListHandler, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	var list api.ListResponse
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list.Models) != 1 {
+		t.Fatalf("expected 1 model, actual %d", len(list.Models))
+	}
+
+	if list.Models[0].Metadata != want {
+		t.Errorf("expected list metadata %+v, actual %+v", want, list.Models[0].Metadata)
+	}
+}
+
+func TestCreateDraft(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+	var s Server
+
+	_, digest := createBinFile(t, nil, nil)
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:   "draft",
+		Files:  map[string]string{"draft.gguf": digest},
+		Stream: &stream,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	w = createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:   "test",
+		Files:  map[string]string{"test.gguf": digest},
+		Draft:  "missing",
+		Stream: &stream,
+	})
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected status code 404, actual %d", w.Code)
+	}
+
+	w = createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:   "test",
+		Files:  map[string]string{"test.gguf": digest},
+		Draft:  "draft",
+		Stream: &stream,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	// models created from the model keep its draft
+	w = createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:   "child",
+		From:   "test",
+		Stream: &stream,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	m, err := GetModel("child")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Draft != "draft" {
+		t.Errorf("expected draft %q, actual %q", "draft", m.Draft)
+	}
+
+	draft, err := GetModel("draft")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p := draftPath(m.Draft); p != draft.ModelPath {
+		t.Errorf("expected draft path %q, actual %q", draft.ModelPath, p)
+	}
+
+	w = createRequest(t, s.ShowHandler, api.ShowRequest{Model: "child"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	var show api.ShowResponse
+	if err := json.NewDecoder(w.Body).Decode(&show); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(show.Modelfile, "\nDRAFT draft\n") {
+		t.Errorf("expected modelfile to contain DRAFT, actual %s", show.Modelfile)
+	}
+}
+
+func TestCreateAdapters(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+	var s Server
+
+	_, digest := createBinFile(t, nil, nil)
+	_, support := createBinFile(t, map[string]any{"general.type": "adapter", "general.name": "support"}, nil)
+	_, legal := createBinFile(t, map[string]any{"general.type": "adapter", "general.name": "legal"}, nil)
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:     "test",
+		Files:    map[string]string{"test.gguf": digest},
+		Adapters: map[string]string{"adapters/support.gguf": support, "adapters/legal.gguf": legal},
+		Stream:   &stream,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body)
+	}
+
+	// models created from the model keep the names of its adapters
+	w = createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:   "child",
+		From:   "test",
+		Stream: &stream,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	m, err := GetModel("child")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(m.AdapterNames, []string{"legal", "support"}) || len(m.AdapterPaths) != 2 {
+		t.Fatalf("expected adapters legal and support, actual %v", m.AdapterNames)
+	}
+
+	cases := []struct {
+		adapter any
+		want    map[string]float32
+	}{
+		{nil, nil},
+		{"support", map[string]float32{"0": 0, "1": 1}},
+		{map[string]any{"legal": 0.5, "1": 1.0}, map[string]float32{"0": 0.5, "1": 1}},
+		{map[string]any{"legal": 1.0, "support": 1.0}, nil},
+		{api.AdapterNone, map[string]float32{"0": 0, "1": 0}},
+	}
+
+	for _, tt := range cases {
+		opts, err := modelOptions(m, map[string]any{"adapter": tt.adapter})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !maps.Equal(opts.Adapter, tt.want) || (opts.Adapter == nil) != (tt.want == nil) {
+			t.Errorf("adapter %v: expected %v, actual %v", tt.adapter, tt.want, opts.Adapter)
+		}
+	}
+
+	for _, adapter := range []string{"medical", "2"} {
+		if _, err := modelOptions(m, map[string]any{"adapter": adapter}); !errors.Is(err, errInvalidOptions) {
+			t.Errorf("adapter %s: expected an invalid options error, actual %v", adapter, err)
+		}
+	}
+}
+
 func TestCreateDetectTemplate(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
@@ -716,6 +1018,38 @@ func TestCreateDetectTemplate(t *testing.T) {
 			blobPath(filepath.Join(p, "blobs"), "sha256-ca239d7bd8ea90e4a5d2e6bf88f8d74a47b14336e73eb4e18bed4dd325018116"),
 		})
 	})
+
+	t.Run("jinja", func(t *testing.T) {
+		chatTemplate := "{% set ns = namespace(turns=0) %}{% for message in messages %}{% if message.role == 'user' %}{% set ns.turns = ns.turns + 1 %}{% endif %}<start_of_turn_{{ ns.turns }}_{{ message.role | upper }}>{{ message.content | trim }}<end_of_turn>\n{% endfor %}{% if add_generation_prompt %}<start_of_turn_{{ ns.turns }}_ASSISTANT>{% endif %}"
+		_, digest := createBinFile(t, ggml.KV{"tokenizer.chat_template": chatTemplate}, nil)
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:   "jinja",
+			Files:  map[string]string{"test.gguf": digest},
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		m, err := GetModel("jinja")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if m.Template.String() != chatTemplate {
+			t.Errorf("expected the model's chat template, actual %q", m.Template.String())
+		}
+
+		prompt, _, err := chatPrompt(t.Context(), m, mockRunner{}.Tokenize, &api.Options{Runner: api.Runner{NumCtx: 2048}}, []api.Message{{Role: "user", Content: " Hello "}}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if prompt != "<start_of_turn_1_USER>Hello<end_of_turn>\n<start_of_turn_1_ASSISTANT>" {
+			t.Errorf("unexpected prompt %q", prompt)
+		}
+	})
 }
 
 func TestDetectModelTypeFromFiles(t *testing.T) {
@@ -0,0 +1,335 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/discover"
+	"github.com/goobla/goobla/fs/ggml"
+)
+
+// mockEmbedder returns a fixed embedding for each input.
+type mockEmbedder struct {
+	mockRunner
+	embeddings map[string][]float32
+}
+
+func (m *mockEmbedder) Embedding(_ context.Context, s string) ([]float32, error) {
+	// return a copy since the handler modifies embeddings in place
+	return append([]float32(nil), m.embeddings[s]...), nil
+}
+
+func cosine(a, b []float32) float64 {
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+
+	return dot / math.Sqrt(na*nb)
+}
+
+func TestEmbed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mock := mockEmbedder{
+		embeddings: map[string][]float32{
+			"a": {3, 4, 0, 12},
+			"b": {4, 3, 12, 0},
+		},
+	}
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			getGpuFn:      discover.GetGPUInfo,
+			getCpuFn:      discover.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, _ *ggml.GGML, _ discover.GpuInfoList, _ int) {
+				// add small delay to simulate loading
+				time.Sleep(time.Millisecond)
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(t.Context())
+
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture":      "bert",
+		"bert.block_count":          uint32(1),
+		"bert.context_length":       uint32(512),
+		"bert.embedding_length":     uint32(4),
+		"bert.attention.head_count": uint32(1),
+		"bert.pooling_type":         uint32(1),
+		"tokenizer.ggml.tokens":     []string{""},
+		"tokenizer.ggml.scores":     []float32{0},
+		"tokenizer.ggml.token_type": []int32{0},
+	}, []*ggml.Tensor{
+		{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+	})
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:  "test",
+		Files:  map[string]string{"file.gguf": digest},
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	embed := func(t *testing.T, req api.EmbedRequest) [][]float32 {
+		t.Helper()
+
+		w := createRequest(t, s.EmbedHandler, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.EmbedResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.Embeddings
+	}
+
+	approx := cmpopts.EquateApprox(0, 1e-6)
+	normalize := false
+
+	t.Run("normalized", func(t *testing.T) {
+		got := embed(t, api.EmbedRequest{Model: "test", Input: "a"})
+		if diff := cmp.Diff([][]float32{{3. / 13, 4. / 13, 0, 12. / 13}}, got, approx); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("not normalized", func(t *testing.T) {
+		got := embed(t, api.EmbedRequest{Model: "test", Input: "a", Normalize: &normalize})
+		if diff := cmp.Diff([][]float32{{3, 4, 0, 12}}, got); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("dimensions", func(t *testing.T) {
+		got := embed(t, api.EmbedRequest{Model: "test", Input: []string{"a", "b"}, Dimensions: 2})
+		if diff := cmp.Diff([][]float32{{0.6, 0.8}, {0.8, 0.6}}, got, approx); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		raw := embed(t, api.EmbedRequest{Model: "test", Input: []string{"a", "b"}, Dimensions: 2, Normalize: &normalize})
+		if diff := cmp.Diff([][]float32{{3, 4}, {4, 3}}, raw); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		// normalizing doesn't change the cosine similarity of embeddings,
+		// which is the dot product of normalized ones
+		var dot float64
+		for i := range got[0] {
+			dot += float64(got[0][i]) * float64(got[1][i])
+		}
+
+		if want := cosine(raw[0], raw[1]); math.Abs(dot-want) > 1e-6 || math.Abs(cosine(got[0], got[1])-want) > 1e-6 {
+			t.Errorf("expected cosine similarity %f, got %f", want, dot)
+		}
+	})
+
+	t.Run("too many dimensions", func(t *testing.T) {
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{Model: "test", Input: "a", Dimensions: 5})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("negative dimensions", func(t *testing.T) {
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{Model: "test", Input: "a", Dimensions: -1})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+}
+
+// mockChunker tokenizes words, which it detokenizes with a leading space like
+// SentencePiece tokenizers, and embeds text as its length.
+type mockChunker struct {
+	mockRunner
+	words []string
+}
+
+func (m *mockChunker) Tokenize(_ context.Context, s string) ([]int, error) {
+	var tokens []int
+	for _, word := range strings.Fields(s) {
+		tokens = append(tokens, len(m.words))
+		m.words = append(m.words, word)
+	}
+
+	return tokens, nil
+}
+
+func (m *mockChunker) Detokenize(_ context.Context, tokens []int) (string, error) {
+	var sb strings.Builder
+	for _, token := range tokens {
+		sb.WriteString(" " + m.words[token])
+	}
+
+	return sb.String(), nil
+}
+
+func (m *mockChunker) Embedding(_ context.Context, s string) ([]float32, error) {
+	return []float32{float32(len(s))}, nil
+}
+
+func TestEmbedDocuments(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var mock mockChunker
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			getGpuFn:      discover.GetGPUInfo,
+			getCpuFn:      discover.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, _ *ggml.GGML, _ discover.GpuInfoList, _ int) {
+				time.Sleep(time.Millisecond)
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(t.Context())
+
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture":      "bert",
+		"bert.block_count":          uint32(1),
+		"bert.context_length":       uint32(8),
+		"bert.embedding_length":     uint32(1),
+		"bert.attention.head_count": uint32(1),
+		"bert.pooling_type":         uint32(1),
+		"tokenizer.ggml.tokens":     []string{""},
+		"tokenizer.ggml.scores":     []float32{0},
+		"tokenizer.ggml.token_type": []int32{0},
+	}, []*ggml.Tensor{
+		{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+	})
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:  "test",
+		Files:  map[string]string{"file.gguf": digest},
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	normalize := false
+
+	t.Run("chunks", func(t *testing.T) {
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{
+			Model: "test",
+			Documents: []api.EmbedDocument{
+				{ID: "a", Text: "one two three four five"},
+				{Text: "héllo wörld"},
+			},
+			ChunkSize:    3,
+			ChunkOverlap: 1,
+			Normalize:    &normalize,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.EmbedResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []api.EmbedChunk{
+			{Document: 0, ID: "a", Text: "one two three", Start: 0, End: 13, Tokens: 3, Embedding: []float32{13}},
+			{Document: 0, ID: "a", Text: " three four five", Start: 7, End: 23, Tokens: 3, Embedding: []float32{16}},
+			{Document: 1, Text: "héllo wörld", Start: 0, End: 11, Tokens: 2, Embedding: []float32{13}},
+		}
+
+		if diff := cmp.Diff(want, resp.Chunks); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		if len(resp.Embeddings) != 0 {
+			t.Errorf("expected no embeddings, got %d", len(resp.Embeddings))
+		}
+
+		if resp.PromptEvalCount != 8 {
+			t.Errorf("expected prompt eval count 8, got %d", resp.PromptEvalCount)
+		}
+	})
+
+	t.Run("default chunk size", func(t *testing.T) {
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{
+			Model:     "test",
+			Documents: []api.EmbedDocument{{Text: strings.Repeat("word ", 20)}},
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.EmbedResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		// chunks are the context length if it's less than the default
+		var tokens []int
+		for _, chunk := range resp.Chunks {
+			tokens = append(tokens, chunk.Tokens)
+		}
+
+		if diff := cmp.Diff([]int{8, 8, 4}, tokens); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	for _, tt := range []struct {
+		name string
+		req  api.EmbedRequest
+	}{
+		{"input and documents", api.EmbedRequest{Model: "test", Input: "a", Documents: []api.EmbedDocument{{Text: "a"}}}},
+		{"negative chunk size", api.EmbedRequest{Model: "test", Documents: []api.EmbedDocument{{Text: "a"}}, ChunkSize: -1}},
+		{"overlap too large", api.EmbedRequest{Model: "test", Documents: []api.EmbedDocument{{Text: "a"}}, ChunkSize: 2, ChunkOverlap: 2}},
+		{"overlap larger than default", api.EmbedRequest{Model: "test", Documents: []api.EmbedDocument{{Text: "a"}}, ChunkOverlap: 8}},
+		{"chunk size too large", api.EmbedRequest{Model: "test", Documents: []api.EmbedDocument{{Text: "a"}}, ChunkSize: 9}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := createRequest(t, s.EmbedHandler, tt.req)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
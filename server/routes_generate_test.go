@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strings"
@@ -13,11 +15,13 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 
 	"github.com/goobla/goobla/api"
 	"github.com/goobla/goobla/discover"
 	"github.com/goobla/goobla/fs/ggml"
 	"github.com/goobla/goobla/llm"
+	"github.com/goobla/goobla/version"
 )
 
 type mockRunner struct {
@@ -29,6 +33,10 @@ type mockRunner struct {
 	CompletionFn func(context.Context, llm.CompletionRequest, func(llm.CompletionResponse)) error
 }
 
+func (m *mockRunner) Backend() llm.Backend {
+	return llm.Backend{Engine: "goobla", Library: "cpu"}
+}
+
 func (m *mockRunner) Completion(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
 	m.CompletionRequest = r
 	if m.CompletionFn != nil {
@@ -46,8 +54,8 @@ func (mockRunner) Tokenize(_ context.Context, s string) (tokens []int, err error
 	return
 }
 
-func newMockServer(mock *mockRunner) func(discover.GpuInfoList, string, *ggml.GGML, []string, []string, api.Options, int) (llm.LlamaServer, error) {
-	return func(_ discover.GpuInfoList, _ string, _ *ggml.GGML, _, _ []string, _ api.Options, _ int) (llm.LlamaServer, error) {
+func newMockServer(mock *mockRunner) func(discover.GpuInfoList, string, *ggml.GGML, []string, []string, string, api.Options, int) (llm.LlamaServer, error) {
+	return func(_ discover.GpuInfoList, _ string, _ *ggml.GGML, _, _ []string, _ string, _ api.Options, _ int) (llm.LlamaServer, error) {
 		return mock, nil
 	}
 }
@@ -162,6 +170,23 @@ func TestGenerateChat(t *testing.T) {
 		}
 	})
 
+	t.Run("missing audio capability", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "What is said?", Audio: []api.AudioData{[]byte("audio")}},
+			},
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"error":"registry.goobla.ai/library/test:latest does not support audio"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
 	t.Run("missing model", func(t *testing.T) {
 		w := createRequest(t, s.ChatHandler, api.ChatRequest{})
 		if w.Code != http.StatusBadRequest {
@@ -376,6 +401,39 @@ func TestGenerateChat(t *testing.T) {
 		checkChatResponse(t, w.Body, "test-system", "Abra kadabra!")
 	})
 
+	t.Run("messages with system and locked model", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:  "test-locked",
+			From:   "test-system",
+			Locked: true,
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		w = createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test-locked",
+			Messages: []api.Message{
+				{Role: "system", Content: "You can perform magic tricks."},
+				{Role: "user", Content: "Hello!"},
+			},
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		// the model's system prompt is kept
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "system: You are a helpful assistant.\n\nYou can perform magic tricks.\nuser: Hello!\n"); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		checkChatResponse(t, w.Body, "test-locked", "Abra kadabra!")
+	})
+
 	t.Run("messages with tools (non-streaming)", func(t *testing.T) {
 		if w.Code != http.StatusOK {
 			t.Fatalf("failed to create test-system model: %d", w.Code)
@@ -613,6 +671,336 @@ func TestGenerateChat(t *testing.T) {
 			t.Errorf("final tool call mismatch (-got +want):\n%s", diff)
 		}
 	})
+
+	w = createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test-tools",
+		From:  "test",
+		Template: `{{- if .Tools }}{{ .Tools }}
+{{ end }}
+{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{- if .ToolCalls }}<tool_call>
+{{- range .ToolCalls }}{"name": "{{ .Function.Name }}", "arguments": {{ .Function.Arguments }}}
+{{- end }}</tool_call>
+{{- end }}
+{{ end }}`,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	t.Run("messages with tools (deltas)", func(t *testing.T) {
+		var tool api.Tool
+		if err := json.Unmarshal([]byte(`{"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object", "properties": {"location": {"type": "string"}}}}}`), &tool); err != nil {
+			t.Fatal(err)
+		}
+
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			for _, content := range []string{
+				`<tool_call>{"name": "get_weather", "arguments": {"location": "Sea`,
+				`ttle"}}</tool_call><tool_call>{"name": "get_weather", "arguments": {"location": "Paris"}}</tool_call>`,
+			} {
+				fn(llm.CompletionResponse{Content: content})
+			}
+			fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop})
+			return nil
+		}
+
+		chat := func(parallel bool) ([]api.ToolCallDelta, []api.ToolCall) {
+			streaming := true
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model:             "test-tools",
+				Messages:          []api.Message{{Role: "user", Content: "What's the weather in Seattle and Paris?"}},
+				Tools:             []api.Tool{tool},
+				ParallelToolCalls: &parallel,
+				Stream:            &streaming,
+			})
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", w.Code)
+			}
+
+			var deltas []api.ToolCallDelta
+			var calls []api.ToolCall
+			decoder := json.NewDecoder(w.Body)
+			for {
+				var resp api.ChatResponse
+				if err := decoder.Decode(&resp); err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+
+				deltas = append(deltas, resp.Message.ToolCallDeltas...)
+				calls = append(calls, resp.Message.ToolCalls...)
+			}
+
+			return deltas, calls
+		}
+
+		deltas, calls := chat(true)
+		if diff := cmp.Diff(deltas, []api.ToolCallDelta{
+			{Index: 0, Name: "get_weather"},
+			{Index: 0, Arguments: `{"location": "Sea`},
+			{Index: 0, Arguments: `ttle"}`},
+			{Index: 1, Name: "get_weather"},
+			{Index: 1, Arguments: `{"location": "Paris"}`},
+		}); diff != "" {
+			t.Errorf("deltas mismatch (-got +want):\n%s", diff)
+		}
+
+		if len(calls) != 2 || calls[1].Function.Index != 1 {
+			t.Errorf("expected 2 tool calls, got %v", calls)
+		}
+
+		deltas, calls = chat(false)
+		if len(deltas) != 3 || len(calls) != 1 || calls[0].Function.Arguments["location"] != "Seattle" {
+			t.Errorf("expected only the first tool call, got %v and %v", deltas, calls)
+		}
+	})
+
+	t.Run("messages with server tools", func(t *testing.T) {
+		t.Setenv("GOOBLA_TOOLS", "calculator")
+
+		var prompts []string
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			prompts = append(prompts, r.Prompt)
+			if len(prompts) == 1 {
+				fn(llm.CompletionResponse{Content: `<tool_call>{"name": "calculator", "arguments": {"expression": "6 * 7"}}</tool_call>`})
+			} else {
+				fn(llm.CompletionResponse{Content: "It's 42."})
+			}
+			fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop})
+			return nil
+		}
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:       "test-tools",
+			Messages:    []api.Message{{Role: "user", Content: "What's 6 times 7?"}},
+			ServerTools: []string{"calculator"},
+			Stream:      &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(prompts) != 2 || !strings.Contains(prompts[1], "tool: 42") {
+			t.Errorf("expected the result to be given to the model, got prompts %q", prompts)
+		}
+
+		if resp.Message.Content != "It's 42." || len(resp.Message.ToolCalls) != 0 || !resp.Done {
+			t.Errorf("unexpected response %+v", resp)
+		}
+
+		if len(resp.ToolExecutions) != 1 || resp.ToolExecutions[0].Call.Function.Name != "calculator" || resp.ToolExecutions[0].Result != "42" {
+			t.Errorf("unexpected tool executions %+v", resp.ToolExecutions)
+		}
+
+		t.Setenv("GOOBLA_TOOLS", "")
+		w = createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:       "test-tools",
+			Messages:    []api.Message{{Role: "user", Content: "What's 6 times 7?"}},
+			ServerTools: []string{"calculator"},
+			Stream:      &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400 for a tool that isn't enabled, got %d", w.Code)
+		}
+	})
+
+	t.Run("conversation", func(t *testing.T) {
+		conv, err := newConversation("", "test-system", []api.Message{{Role: "user", Content: "Hello!"}, {Role: "assistant", Content: "Hi!"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: "I'm fine."})
+			fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			ConversationID: conv.ID,
+			Messages:       []api.Message{{Role: "user", Content: "How are you?"}},
+			Stream:         &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "system: You are a helpful assistant.\nuser: Hello!\nassistant: Hi!\nuser: How are you?\n"); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if mock.CompletionRequest.Session == "" {
+			t.Error("expected the conversation's cache to be saved")
+		}
+
+		got, err := getConversation("", conv.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := append(conv.Messages, api.Message{Role: "user", Content: "How are you?"}, api.Message{Role: "assistant", Content: "I'm fine."})
+		if diff := cmp.Diff(want, got.Messages); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		w = createRequest(t, s.ChatHandler, api.ChatRequest{
+			ConversationID: "0123456789abcdef0123456789abcdef",
+			Messages:       []api.Message{{Role: "user", Content: "How are you?"}},
+			Stream:         &stream,
+		})
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404 for a missing conversation, got %d", w.Code)
+		}
+	})
+
+	t.Run("session", func(t *testing.T) {
+		m, err := GetModel("test-system")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ls, err := s.sessions.create("", "test-system", m, api.SessionRequest{System: "Be brief.", Options: map[string]any{"temperature": 0.5}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: "Fine."})
+			fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		chat := func(id string, content string) int {
+			w := createRequest(t, func(c *gin.Context) {
+				c.Params = gin.Params{{Key: "id", Value: id}}
+				s.SessionChatHandler(c)
+			}, api.ChatRequest{
+				Messages: []api.Message{{Role: "user", Content: content}},
+				Stream:   &stream,
+			})
+			return w.Code
+		}
+
+		for _, content := range []string{"Hello!", "How are you?"} {
+			if code := chat(ls.id, content); code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", code)
+			}
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "system: Be brief.\nuser: Hello!\nassistant: Fine.\nuser: How are you?\n"); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if mock.CompletionRequest.Session != ls.cache {
+			t.Errorf("expected the session's cache %q, got %q", ls.cache, mock.CompletionRequest.Session)
+		}
+
+		if mock.CompletionRequest.Options.Temperature != 0.5 {
+			t.Errorf("expected the session's options, got temperature %v", mock.CompletionRequest.Options.Temperature)
+		}
+
+		if list := s.sessions.list(""); len(list) != 1 || list[0].Messages != 5 {
+			t.Errorf("expected the session to have 5 messages, got %+v", list)
+		}
+
+		if err := s.sessions.close("", ls.id); err != nil {
+			t.Fatal(err)
+		}
+
+		if code := chat(ls.id, "Hello?"); code != http.StatusNotFound {
+			t.Errorf("expected status 404 for a closed session, got %d", code)
+		}
+	})
+
+	t.Run("logprobs", func(t *testing.T) {
+		logprobs := []api.Logprob{
+			{TokenLogprob: api.TokenLogprob{Token: "Hi", Logprob: -0.25}},
+			{TokenLogprob: api.TokenLogprob{Token: "!", Logprob: -0.5}},
+		}
+
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: "Hi", Logprobs: logprobs[:1]})
+			fn(llm.CompletionResponse{Content: "!", Logprobs: logprobs[1:]})
+			fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		streamed := true
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test-system",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			Logprobs: true,
+			Stream:   &streamed,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if !mock.CompletionRequest.Logprobs {
+			t.Error("expected logprobs to be requested")
+		}
+
+		var got []api.Logprob
+		decoder := json.NewDecoder(w.Body)
+		for {
+			var resp api.ChatResponse
+			if err := decoder.Decode(&resp); errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			got = append(got, resp.Logprobs...)
+		}
+
+		if diff := cmp.Diff(got, logprobs); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: "Once upon"})
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Tell me a story."}},
+			Timeout:  &api.Duration{Duration: 10 * time.Millisecond},
+			Stream:   &stream,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Message.Content != "Once upon" || !resp.Done || resp.DoneReason != "timeout" {
+			t.Errorf("unexpected response %+v", resp)
+		}
+	})
 }
 
 func TestGenerate(t *testing.T) {
@@ -927,6 +1315,72 @@ func TestGenerate(t *testing.T) {
 		checkGenerateResponse(t, w.Body, "test-system", "Abra kadabra!")
 	})
 
+	t.Run("locked", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:  "test-locked",
+			From:   "test-system",
+			Locked: true,
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		// models created from locked models are locked too
+		w = createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:  "test-locked-child",
+			From:   "test-locked",
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		for _, req := range []api.GenerateRequest{
+			{Model: "test-locked", Prompt: "Hello!", System: "You can perform magic tricks."},
+			{Model: "test-locked", Prompt: "Hello!", Template: "{{ .Prompt }}"},
+			{Model: "test-locked", Prompt: "Hello!", Raw: true},
+			{Model: "test-locked-child", Prompt: "Hello!", System: "You can perform magic tricks."},
+		} {
+			req.Stream = &stream
+			w := createRequest(t, s.GenerateHandler, req)
+			if w.Code != http.StatusForbidden {
+				t.Errorf("%+v: expected status 403, got %d", req, w.Code)
+			}
+		}
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test-locked",
+			Prompt: "Hello!",
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "System: You are a helpful assistant. User: Hello! "); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("locked templates", func(t *testing.T) {
+		t.Setenv("GOOBLA_LOCK_TEMPLATES", "1")
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test-system",
+			Prompt: "Hello!",
+			System: "You can perform magic tricks.",
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("expected status 403, got %d", w.Code)
+		}
+	})
+
 	w = createRequest(t, s.CreateHandler, api.CreateRequest{
 		Model: "test-suffix",
 		Template: `{{- if .Suffix }}<PRE> {{ .Prompt }} <SUF>{{ .Suffix }} <MID>
@@ -970,6 +1424,235 @@ func TestGenerate(t *testing.T) {
 		}
 	})
 
+	t.Run("missing draft", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+			Draft:  "missing",
+		})
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"error":"draft model 'missing' not found"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("invalid format", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+			Format: json.RawMessage(`"yaml"`),
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if !strings.Contains(w.Body.String(), "invalid format") {
+			t.Errorf("expected an invalid format error, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("grammar", func(t *testing.T) {
+		grammar := `root ::= "yes" | "no"`
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Grammar: grammar,
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if mock.CompletionRequest.Grammar != grammar {
+			t.Errorf("expected grammar %q, got %q", grammar, mock.CompletionRequest.Grammar)
+		}
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Grammar: `answer ::= "yes"`,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("deterministic", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Options: map[string]any{"deterministic": true},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if seed := mock.CompletionRequest.Options.Seed; seed != deterministicSeed {
+			t.Errorf("expected seed %d, got %d", deterministicSeed, seed)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(&api.Reproducibility{
+			Seed:    deterministicSeed,
+			Engine:  "goobla",
+			Backend: "cpu",
+			Version: version.Version,
+		}, resp.Reproducibility, cmpopts.IgnoreFields(api.Reproducibility{}, "Digest", "Quantization")); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		if resp.Reproducibility.Digest == "" {
+			t.Error("expected a model digest")
+		}
+
+		// an explicit seed is kept
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Options: map[string]any{"deterministic": true, "seed": 7},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if seed := mock.CompletionRequest.Options.Seed; seed != 7 {
+			t.Errorf("expected seed 7, got %d", seed)
+		}
+	})
+
+	t.Run("invalid num_beams", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Options: map[string]any{"num_beams": 100},
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("invalid samplers", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Options: map[string]any{"samplers": []string{"top_k", "top_a"}},
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if !strings.Contains(w.Body.String(), `unknown sampler \"top_a\"`) {
+			t.Errorf("expected an unknown sampler error, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("invalid context overflow", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Options: map[string]any{"context_overflow": "wrap"},
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("context overflow error", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  strings.Repeat("Hello ", 16),
+			Raw:     true,
+			Options: map[string]any{"context_overflow": "error", "num_ctx": 8},
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if !strings.Contains(w.Body.String(), "exceed the context length") {
+			t.Errorf("expected a context length error, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("logprobs", func(t *testing.T) {
+		hello := api.Logprob{TokenLogprob: api.TokenLogprob{Token: "Hello", Logprob: -0.5}}
+		world := api.Logprob{
+			TokenLogprob: api.TokenLogprob{Token: " world", Logprob: -1},
+			TopLogprobs:  []api.TokenLogprob{{Token: " world", Logprob: -1}, {Token: " there", Logprob: -2}},
+		}
+
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: "Hello", Logprobs: []api.Logprob{hello}})
+			fn(llm.CompletionResponse{Content: " world", Logprobs: []api.Logprob{world}})
+			fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:       "test",
+			Prompt:      "Hello!",
+			Logprobs:    true,
+			TopLogprobs: 2,
+			Stream:      &stream,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if !mock.CompletionRequest.Logprobs || mock.CompletionRequest.TopLogprobs != 2 {
+			t.Errorf("expected logprobs with 2 alternatives, got %v %d", mock.CompletionRequest.Logprobs, mock.CompletionRequest.TopLogprobs)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(resp.Logprobs, []api.Logprob{hello, world}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		for _, top := range []int{-1, 21} {
+			w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+				Model:       "test",
+				Prompt:      "Hello!",
+				Logprobs:    true,
+				TopLogprobs: top,
+			})
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("top_logprobs %d: expected status 400, got %d", top, w.Code)
+			}
+		}
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:       "test",
+			Prompt:      "Hello!",
+			TopLogprobs: 2,
+		})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400 without logprobs, got %d", w.Code)
+		}
+	})
+
 	t.Run("raw", func(t *testing.T) {
 		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
 			Model:  "test-system",
@@ -986,4 +1669,171 @@ func TestGenerate(t *testing.T) {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 	})
+	t.Run("stats interval", func(t *testing.T) {
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Progress: true, PromptTokens: 100, PromptEvalCount: 40, PromptEvalDuration: time.Second})
+			fn(llm.CompletionResponse{Progress: true, PromptTokens: 100, PromptEvalCount: 100, EvalCount: 10, EvalDuration: time.Second})
+			fn(llm.CompletionResponse{Content: "Hello"})
+			fn(llm.CompletionResponse{Progress: true, PromptTokens: 100, PromptEvalCount: 100, EvalCount: 40, EvalDuration: 2 * time.Second})
+			fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop, PromptEvalCount: 100, EvalCount: 41})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:         "test",
+			Prompt:        "Hello!",
+			StatsInterval: &api.Duration{Duration: time.Second},
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if mock.CompletionRequest.StatsInterval != time.Second {
+			t.Errorf("expected stats interval 1s, got %s", mock.CompletionRequest.StatsInterval)
+		}
+
+		var usages []api.Usage
+		var response string
+		decoder := json.NewDecoder(w.Body)
+		for {
+			var resp api.GenerateResponse
+			if err := decoder.Decode(&resp); errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Usage != nil {
+				usages = append(usages, *resp.Usage)
+			}
+			response += resp.Response
+		}
+
+		if diff := cmp.Diff(usages, []api.Usage{
+			{PromptEvalCount: 40, PromptTokens: 100},
+			{PromptEvalCount: 100, PromptTokens: 100, EvalCount: 10, TokensPerSecond: 10},
+			{PromptEvalCount: 100, PromptTokens: 100, EvalCount: 40, TokensPerSecond: 30},
+		}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if response != "Hello" {
+			t.Errorf("expected response %q, got %q", "Hello", response)
+		}
+
+		// usage isn't streamed without streaming
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:         "test",
+			Prompt:        "Hello!",
+			Stream:        &stream,
+			StatsInterval: &api.Duration{Duration: time.Second},
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if mock.CompletionRequest.StatsInterval != 0 {
+			t.Errorf("expected no stats interval, got %s", mock.CompletionRequest.StatsInterval)
+		}
+	})
+
+	t.Run("stream error", func(t *testing.T) {
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Progress: true, PromptTokens: 10, PromptEvalCount: 10, EvalCount: 1})
+			fn(llm.CompletionResponse{Content: "Hello"})
+			fn(llm.CompletionResponse{Content: " there"})
+			return fmt.Errorf("%w while running the model: CUDA error: out of memory", llm.ErrRunnerStopped)
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{Model: "test", Prompt: "Hello!"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+		var resp api.StreamError
+		if err := json.Unmarshal([]byte(lines[len(lines)-1]), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		want := api.StreamError{
+			ErrorMessage: "model runner has unexpectedly stopped while running the model: CUDA error: out of memory",
+			Code:         api.ErrorCodeOutOfMemory,
+			Usage:        &api.Usage{PromptEvalCount: 10, PromptTokens: 10, EvalCount: 3},
+		}
+		if diff := cmp.Diff(want, resp); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		// the error is returned whole without streaming
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{Model: "test", Prompt: "Hello!", Stream: &stream})
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("expected status 500, got %d", w.Code)
+		}
+
+		resp = api.StreamError{}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Code != api.ErrorCodeOutOfMemory {
+			t.Errorf("expected code %q, got %q", api.ErrorCodeOutOfMemory, resp.Code)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: "Once"})
+			fn(llm.CompletionResponse{Content: " upon"})
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		for name, timeout := range map[string]string{"request": "", "server": "10ms"} {
+			t.Run(name, func(t *testing.T) {
+				t.Setenv("GOOBLA_MAX_GENERATION_TIME", timeout)
+
+				req := api.GenerateRequest{Model: "test", Prompt: "Tell me a story.", Stream: &stream}
+				if timeout == "" {
+					req.Timeout = &api.Duration{Duration: 10 * time.Millisecond}
+				}
+
+				w := createRequest(t, s.GenerateHandler, req)
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+				}
+
+				var resp api.GenerateResponse
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+
+				if resp.Response != "Once upon" || !resp.Done || resp.DoneReason != "timeout" || resp.EvalCount != 2 {
+					t.Errorf("unexpected response %+v", resp)
+				}
+			})
+		}
+	})
+}
+
+func TestErrorCode(t *testing.T) {
+	cases := []struct {
+		err  error
+		want api.ErrorCode
+	}{
+		{context.Canceled, api.ErrorCodeCanceled},
+		{fmt.Errorf("waiting for the runner: %w", context.DeadlineExceeded), api.ErrorCodeTimeout},
+		{fmt.Errorf("%w while running the model: GGML_ASSERT failed", llm.ErrRunnerStopped), api.ErrorCodeRunnerStopped},
+		{fmt.Errorf("%w while running the model: cudaMalloc failed: out of memory", llm.ErrRunnerStopped), api.ErrorCodeOutOfMemory},
+		{errors.New("invalid grammar"), api.ErrorCodeInternal},
+	}
+
+	for _, tt := range cases {
+		if got := errorCode(tt.err); got != tt.want {
+			t.Errorf("%v: got %q, want %q", tt.err, got, tt.want)
+		}
+	}
 }
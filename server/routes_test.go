@@ -24,6 +24,7 @@ import (
 	"log/slog"
 
 	"github.com/gin-gonic/gin"
+	"github.com/goobla/goobla/anthropic"
 	"github.com/goobla/goobla/api"
 	"github.com/goobla/goobla/fs/ggml"
 	"github.com/goobla/goobla/openai"
@@ -85,12 +86,6 @@ func createTestFile(t *testing.T, name string) (string, string) {
 	return f.Name(), digest
 }
 
-func blobPath(dir, digest string) string {
-	digest = strings.ReplaceAll(digest, "sha256:", "sha256-")
-	hex := strings.TrimPrefix(digest, "sha256-")
-	return filepath.Join(dir, hex[:2], digest)
-}
-
 // equalStringSlices checks if two slices of strings are equal.
 func equalStringSlices(a, b []string) bool {
 	if len(a) != len(b) {
@@ -168,9 +163,15 @@ func TestRoutes(t *testing.T) {
 				if err != nil {
 					t.Fatalf("failed to read response body: %v", err)
 				}
-				expectedBody := fmt.Sprintf(`{"version":"%s"}`, version.Version)
-				if string(body) != expectedBody {
-					t.Errorf("expected body %s, got %s", expectedBody, string(body))
+				var v api.VersionResponse
+				if err := json.Unmarshal(body, &v); err != nil {
+					t.Fatalf("failed to unmarshal response body: %v", err)
+				}
+				if v.Version != version.Version {
+					t.Errorf("expected version %s, got %s", version.Version, v.Version)
+				}
+				if v.CPU == nil || v.CPU.Features == nil {
+					t.Errorf("expected CPU diagnostics, got %s", string(body))
 				}
 			},
 		},
@@ -496,6 +497,141 @@ func TestRoutes(t *testing.T) {
 				}
 			},
 		},
+		{
+			Name: "openai retrieve model with a namespace",
+			Setup: func(t *testing.T, req *http.Request) {
+				createTestModel(t, "someone/show-model")
+			},
+			Method: http.MethodGet,
+			Path:   "/v1/models/someone/show-model",
+			Expected: func(t *testing.T, resp *http.Response) {
+				var m openai.Model
+				if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+					t.Fatal(err)
+				}
+
+				if m.Id != "someone/show-model" || m.OwnedBy != "someone" {
+					t.Errorf("expected model 'someone/show-model' owned by 'someone', got %v", m)
+				}
+			},
+		},
+		{
+			Name:   "openai retrieve missing model",
+			Method: http.MethodGet,
+			Path:   "/v1/models/missing-model",
+			Expected: func(t *testing.T, resp *http.Response) {
+				if resp.StatusCode != http.StatusNotFound {
+					t.Errorf("expected status code 404, got %d", resp.StatusCode)
+				}
+
+				var e openai.ErrorResponse
+				if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+					t.Fatal(err)
+				}
+
+				if e.Error.Message == "" {
+					t.Errorf("expected an error, got %+v", e)
+				}
+			},
+		},
+		{
+			Name:   "openai unsupported model",
+			Method: http.MethodPost,
+			Path:   "/v1/audio/speech",
+			Setup: func(t *testing.T, req *http.Request) {
+				req.Header.Set("Content-Type", "application/json")
+				req.Body = io.NopCloser(strings.NewReader(`{"model": "tts-1", "input": "Hello!"}`))
+			},
+			Expected: func(t *testing.T, resp *http.Response) {
+				if resp.StatusCode != http.StatusNotFound {
+					t.Errorf("expected status code 404, got %d", resp.StatusCode)
+				}
+
+				var e openai.ErrorResponse
+				if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+					t.Fatal(err)
+				}
+
+				if e.Error.Code == nil || *e.Error.Code != "model_not_found" {
+					t.Errorf("expected a model_not_found error, got %+v", e.Error)
+				}
+			},
+		},
+		{
+			Name:   "openai unsupported endpoint",
+			Method: http.MethodPost,
+			Path:   "/v1/images/generations",
+			Expected: func(t *testing.T, resp *http.Response) {
+				if resp.StatusCode != http.StatusNotFound {
+					t.Errorf("expected status code 404, got %d", resp.StatusCode)
+				}
+
+				var e openai.ErrorResponse
+				if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+					t.Fatal(err)
+				}
+
+				if e.Error.Code == nil || *e.Error.Code != "unsupported" || e.Error.Type != "invalid_request_error" {
+					t.Errorf("expected an unsupported error, got %+v", e.Error)
+				}
+			},
+		},
+		{
+			Name:   "openai unknown endpoint",
+			Method: http.MethodGet,
+			Path:   "/v1/fine_tuning/jobs",
+			Expected: func(t *testing.T, resp *http.Response) {
+				if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+					t.Errorf("expected a JSON error, got content type %s", ct)
+				}
+			},
+		},
+		{
+			Name:   "anthropic messages missing model",
+			Method: http.MethodPost,
+			Path:   "/anthropic/v1/messages",
+			Setup: func(t *testing.T, req *http.Request) {
+				req.Header.Set("Content-Type", "application/json")
+				req.Body = io.NopCloser(strings.NewReader(`{"model": "missing-model", "max_tokens": 16, "messages": [{"role": "user", "content": "Hello!"}]}`))
+			},
+			Expected: func(t *testing.T, resp *http.Response) {
+				if resp.StatusCode != http.StatusNotFound {
+					t.Errorf("expected status code 404, got %d", resp.StatusCode)
+				}
+
+				var e anthropic.ErrorResponse
+				if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+					t.Fatal(err)
+				}
+
+				if e.Type != "error" || e.Error.Type != "not_found_error" || e.Error.Message == "" {
+					t.Errorf("expected a not_found_error, got %+v", e)
+				}
+			},
+		},
+		{
+			Name:   "anthropic messages invalid request",
+			Method: http.MethodPost,
+			Path:   "/anthropic/v1/messages",
+			Setup: func(t *testing.T, req *http.Request) {
+				req.Header.Set("Content-Type", "application/json")
+				req.Body = io.NopCloser(strings.NewReader(`{"model": "test", "max_tokens": 16, "messages": []}`))
+			},
+			Expected: func(t *testing.T, resp *http.Response) {
+				if resp.StatusCode != http.StatusBadRequest {
+					t.Errorf("expected status code 400, got %d", resp.StatusCode)
+				}
+
+				var e anthropic.ErrorResponse
+				if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+					t.Fatal(err)
+				}
+
+				if e.Error.Type != "invalid_request_error" {
+					t.Errorf("expected an invalid_request_error, got %+v", e)
+				}
+			},
+		},
 		{
 			Name:   "Method Not Allowed",
 			Method: http.MethodGet,
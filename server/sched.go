@@ -1,10 +1,12 @@
 package server
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
 	"log/slog"
+	"math"
 	"os"
 	"reflect"
 	"runtime"
@@ -13,8 +15,12 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/goobla/goobla/api"
 	"github.com/goobla/goobla/discover"
 	"github.com/goobla/goobla/envconfig"
@@ -33,6 +39,21 @@ type LlmRequest struct {
 	successCh       chan *runnerRef
 	errCh           chan error
 	schedAttempts   uint
+	priority        requestPriority
+	retriedGPUs     bool // scheduled again after a GPU disappeared while loading
+	autoNumCtx      bool // num_ctx auto, fit to the available memory
+
+	// discovered is the GPUs found when the request was scheduled, in the
+	// order tensor_split refers to them
+	discovered discover.GpuInfoList
+}
+
+// optsFor returns the options of req to load its model on gpus, with
+// tensor_split rewritten to refer to gpus rather than all the GPUs.
+func (req *LlmRequest) optsFor(gpus discover.GpuInfoList) api.Options {
+	opts := req.opts
+	opts.TensorSplit = llm.TensorSplitFor(opts.TensorSplit, req.discovered, gpus)
+	return opts
 }
 
 type Scheduler struct {
@@ -44,11 +65,25 @@ type Scheduler struct {
 	loaded   map[string]*runnerRef
 	loadedMu sync.Mutex
 
+	// waiting holds the requests taken from pendingReqCh that are yet to be
+	// scheduled. It is only used by processPending.
+	waiting    []*LlmRequest
+	numWaiting atomic.Int64
+
 	loadFn       func(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoList, numParallel int)
-	newServerFn  func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error)
+	newServerFn  func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error)
 	getGpuFn     func() discover.GpuInfoList
 	getCpuFn     func() discover.GpuInfoList
 	reschedDelay time.Duration
+
+	// preloaded are the paths of the models kept loaded regardless of keep
+	// alive, guarded by loadedMu
+	preloaded map[string]bool
+
+	// devices are the GPUs that have been discovered, by deviceKey
+	devices      map[string]*api.DeviceStatus
+	devicesMu    sync.Mutex
+	rediscoverFn func()
 }
 
 // Default automatic value for number of models we allow per GPU
@@ -71,17 +106,21 @@ func InitScheduler(ctx context.Context) *Scheduler {
 		expiredCh:     make(chan *runnerRef, maxQueue),
 		unloadedCh:    make(chan any, maxQueue),
 		loaded:        make(map[string]*runnerRef),
+		preloaded:     make(map[string]bool),
 		newServerFn:   llm.NewLlamaServer,
 		getGpuFn:      discover.GetGPUInfo,
 		getCpuFn:      discover.GetCPUInfo,
 		reschedDelay:  250 * time.Millisecond,
+		devices:       make(map[string]*api.DeviceStatus),
+		rediscoverFn:  discover.Rediscover,
 	}
 	sched.loadFn = sched.load
 	return sched
 }
 
 // context must be canceled to decrement ref count and release the runner
-func (s *Scheduler) GetRunner(c context.Context, model *Model, opts api.Options, sessionDuration *api.Duration) (chan *runnerRef, chan error) {
+func (s *Scheduler) GetRunner(c context.Context, model *Model, opts api.Options, sessionDuration *api.Duration, priority requestPriority) (chan *runnerRef, chan error) {
+	autoNumCtx := opts.NumCtx == api.NumCtxAuto
 	if opts.NumCtx < 4 {
 		opts.NumCtx = 4
 	}
@@ -93,6 +132,13 @@ func (s *Scheduler) GetRunner(c context.Context, model *Model, opts api.Options,
 		sessionDuration: sessionDuration,
 		successCh:       make(chan *runnerRef),
 		errCh:           make(chan error, 1),
+		priority:        priority,
+		autoNumCtx:      autoNumCtx,
+	}
+
+	if s.queued() >= cap(s.pendingReqCh) {
+		req.errCh <- ErrMaxQueue
+		return req.successCh, req.errCh
 	}
 
 	select {
@@ -113,205 +159,311 @@ func (s *Scheduler) Run(ctx context.Context) {
 	go func() {
 		s.processCompleted(ctx)
 	}()
+
+	go s.watchGPUs(ctx)
 }
 
 func (s *Scheduler) processPending(ctx context.Context) {
 	for {
-		select {
-		case <-ctx.Done():
+		pending := s.nextPending(ctx)
+		if pending == nil {
 			slog.Debug("shutting down scheduler pending loop")
 			return
-		case pending := <-s.pendingReqCh:
-			// Block other requests until we get this pending request running
-			pending.schedAttempts++
-			if pending.origNumCtx == 0 {
-				pending.origNumCtx = pending.opts.NumCtx
-			}
+		}
 
-			if pending.ctx.Err() != nil {
-				slog.Debug("pending request cancelled or timed out, skipping scheduling")
-				continue
-			}
-			numParallel := int(envconfig.NumParallel())
-			// `mllama` is a snowflake and uses an encoder cache which cannot be used with num_parallel > 1
-			// ref: https://github.com/goobla/goobla/issues/4165
-			if slices.Contains(pending.model.Config.ModelFamilies, "mllama") && numParallel != 1 {
-				numParallel = 1
-				slog.Warn("mllama does not currently support parallel requests")
-			}
+		// Block other requests until we get this pending request running
+		pending.schedAttempts++
+		if pending.origNumCtx == 0 {
+			pending.origNumCtx = pending.opts.NumCtx
+		}
 
-			for {
-				var runnerToExpire *runnerRef
-				s.loadedMu.Lock()
-				runner := s.loaded[pending.model.ModelPath]
-				loadedCount := len(s.loaded)
-				s.loadedMu.Unlock()
-				if runner != nil {
-					if runner.needsReload(ctx, pending) {
-						slog.Debug("reloading", "runner", runner)
-						runnerToExpire = runner
-					} else {
-						// Runner is usable, return it
-						pending.useLoadedRunner(runner, s.finishedReqCh)
-						break
-					}
-				} else if envconfig.MaxRunners() > 0 && loadedCount >= int(envconfig.MaxRunners()) {
-					slog.Debug("max runners achieved, unloading one to make room", "runner_count", loadedCount)
-					runnerToExpire = s.findRunnerToUnload()
+		if pending.ctx.Err() != nil {
+			slog.Debug("pending request cancelled or timed out, skipping scheduling")
+			continue
+		}
+		span := trace.SpanFromContext(pending.ctx)
+		span.AddEvent("dequeued", trace.WithAttributes(attribute.Int("goobla.attempt", int(pending.schedAttempts))))
+		numParallel := int(envconfig.NumParallel())
+		// `mllama` is a snowflake and uses an encoder cache which cannot be used with num_parallel > 1
+		// ref: https://github.com/goobla/goobla/issues/4165
+		if slices.Contains(pending.model.Config.ModelFamilies, "mllama") && numParallel != 1 {
+			numParallel = 1
+			slog.Warn("mllama does not currently support parallel requests")
+		}
+
+		for {
+			var runnerToExpire *runnerRef
+			s.loadedMu.Lock()
+			runner := s.loaded[pending.model.ModelPath]
+			loadedCount := len(s.loaded)
+			s.loadedMu.Unlock()
+			if runner != nil {
+				if runner.needsReload(ctx, pending) {
+					slog.Debug("reloading", "runner", runner)
+					runnerToExpire = runner
 				} else {
-					// Either no models are loaded or below envconfig.MaxRunners
-					// Get a refreshed GPU list
-					var gpus discover.GpuInfoList
-					if pending.opts.NumGPU == 0 {
-						gpus = s.getCpuFn()
-					} else {
-						gpus = s.getGpuFn()
+					// Runner is usable, return it
+					span.AddEvent("using loaded runner")
+					pending.useLoadedRunner(runner, s.finishedReqCh)
+					break
+				}
+			} else if envconfig.MaxRunners() > 0 && loadedCount >= int(envconfig.MaxRunners()) {
+				slog.Debug("max runners achieved, unloading one to make room", "runner_count", loadedCount)
+				runnerToExpire = s.findRunnerToUnload()
+			} else {
+				// Either no models are loaded or below envconfig.MaxRunners
+				// Get a refreshed GPU list
+				var gpus discover.GpuInfoList
+				if pending.opts.NumGPU == 0 || pending.opts.Device == "cpu" {
+					gpus = s.getCpuFn()
+				} else {
+					gpus = s.getGpuFn()
+				}
+
+				if pending.opts.TensorSplit != "" {
+					proportions, err := llm.ParseTensorSplit(pending.opts.TensorSplit)
+					if err != nil {
+						pending.errCh <- err
+						break
 					}
 
-					if envconfig.MaxRunners() <= 0 {
-						// No user specified MaxRunners, so figure out what automatic setting to use
-						// If all GPUs have reliable free memory reporting, defaultModelsPerGPU * the number of GPUs
-						// if any GPU has unreliable free memory reporting, 1x the number of GPUs
-						allReliable := true
-						for _, gpu := range gpus {
-							if gpu.UnreliableFreeMemory {
-								allReliable = false
-								break
-							}
-						}
-						if allReliable {
-							// HACK
-							os.Setenv("GOOBLA_MAX_LOADED_MODELS", strconv.Itoa(defaultModelsPerGPU*len(gpus)))
-							slog.Debug("updating default concurrency", "GOOBLA_MAX_LOADED_MODELS", envconfig.MaxRunners(), "gpu_count", len(gpus))
-						} else {
-							// HACK
-							os.Setenv("GOOBLA_MAX_LOADED_MODELS", strconv.Itoa(len(gpus)))
-							slog.Info("one or more GPUs detected that are unable to accurately report free memory - disabling default concurrency")
-						}
+					if len(proportions) != len(gpus) && gpus[0].Library != "cpu" {
+						slog.Warn("tensor_split doesn't match the GPUs found, using the automatic split", "tensor_split", pending.opts.TensorSplit, "gpu_count", len(gpus))
 					}
+				}
+				pending.discovered = gpus
 
-					// Load model for fitting
-					ggml, err := llm.LoadModel(pending.model.ModelPath, 0)
+				if pending.opts.Device != "" && pending.opts.Device != "cpu" {
+					var err error
+					gpus, err = selectDevice(gpus, pending.opts.Device)
 					if err != nil {
 						pending.errCh <- err
 						break
 					}
+				}
 
-					// Embedding models should always be loaded with parallel=1
-					if pending.model.CheckCapabilities(model.CapabilityCompletion) != nil {
-						numParallel = 1
+				if envconfig.MaxRunners() <= 0 {
+					// No user specified MaxRunners, so figure out what automatic setting to use
+					// If all GPUs have reliable free memory reporting, defaultModelsPerGPU * the number of GPUs
+					// if any GPU has unreliable free memory reporting, 1x the number of GPUs
+					allReliable := true
+					for _, gpu := range gpus {
+						if gpu.UnreliableFreeMemory {
+							allReliable = false
+							break
+						}
 					}
+					if allReliable {
+						// HACK
+						os.Setenv("GOOBLA_MAX_LOADED_MODELS", strconv.Itoa(defaultModelsPerGPU*len(gpus)))
+						slog.Debug("updating default concurrency", "GOOBLA_MAX_LOADED_MODELS", envconfig.MaxRunners(), "gpu_count", len(gpus))
+					} else {
+						// HACK
+						os.Setenv("GOOBLA_MAX_LOADED_MODELS", strconv.Itoa(len(gpus)))
+						slog.Info("one or more GPUs detected that are unable to accurately report free memory - disabling default concurrency")
+					}
+				}
 
-					// Evaluate if the model will fit in the available system memory, or if we should unload a model first
-					if len(gpus) == 1 && gpus[0].Library == "cpu" {
-						// simplifying assumption of defaultParallel when in CPU mode
-						if numParallel <= 0 {
-							numParallel = defaultParallel
-						}
+				// Load model for fitting
+				ggml, err := llm.LoadModel(pending.model.ModelPath, 0)
+				if err != nil {
+					pending.errCh <- err
+					break
+				}
 
-						pending.opts.NumCtx = pending.origNumCtx * numParallel
+				// Embedding models should always be loaded with parallel=1
+				if pending.model.CheckCapabilities(model.CapabilityCompletion) != nil {
+					numParallel = 1
+				}
 
-						if loadedCount == 0 {
-							slog.Debug("cpu mode with first model, loading")
-							s.loadFn(pending, ggml, gpus, numParallel)
-							break
-						}
-						runnerToExpire = s.maybeFindCPURunnerToUnload(pending, ggml, gpus)
-						if runnerToExpire == nil {
-							slog.Debug("cpu mode with available system memory or first model, loading")
-							s.loadFn(pending, ggml, gpus, numParallel)
-							break
-						}
-						// else we need to expire a runner
-					} else if loadedCount == 0 {
-						// No models loaded. Load the model but prefer the best fit.
-						slog.Debug("loading first model", "model", pending.model.ModelPath)
-						g := s.pickBestFullFitByLibrary(pending, ggml, gpus, &numParallel)
-						if g != nil {
-							gpus = g
-						} else {
-							// Only allow partial loads when this is the first model
-							gpus = pickBestPartialFitByLibrary(pending, ggml, gpus, &numParallel)
-						}
+				// Deterministic requests are loaded with parallel=1 so that the
+				// results can't depend on other sequences in the same batch
+				if pending.opts.Deterministic {
+					numParallel = 1
+				}
+
+				// Beam search needs a sequence for each of its beams
+				if pending.opts.NumBeams > 1 {
+					numParallel = max(numParallel, pending.opts.NumBeams)
+				}
+
+				if pending.autoNumCtx {
+					s.fitNumCtx(pending, ggml, gpus, &numParallel)
+				}
+
+				// Evaluate if the model will fit in the available system memory, or if we should unload a model first
+				if len(gpus) == 1 && gpus[0].Library == "cpu" {
+					// simplifying assumption of defaultParallel when in CPU mode
+					if numParallel <= 0 {
+						numParallel = defaultParallel
+					}
+
+					pending.opts.NumCtx = pending.origNumCtx * numParallel
+
+					if loadedCount == 0 {
+						slog.Debug("cpu mode with first model, loading")
 						s.loadFn(pending, ggml, gpus, numParallel)
 						break
 					}
-
+					runnerToExpire = s.maybeFindCPURunnerToUnload(pending, ggml, gpus)
 					if runnerToExpire == nil {
-						// More than one loaded model, so we have to see if the
-						// new one fits
-						//
-						// We want to avoid loading on any GPUs that have other
-						// models still loading on them to avoid potential races
-						// with VRAM consumption ramping up during load
-						availGpus := s.filterGPUsWithoutLoadingModels(gpus)
-
-						// Update free memory from currently loaded models
-						s.updateFreeSpace(availGpus)
-						fitGpus := s.pickBestFullFitByLibrary(pending, ggml, availGpus, &numParallel)
-						if fitGpus != nil {
-							slog.Debug("new model fits with existing models, loading")
-							s.loadFn(pending, ggml, fitGpus, numParallel)
-							break
-						}
-
-						// We couldn't find a set of GPUs to fully load the new
-						// model. If no other models are loading (both GPU lists
-						// are the same) then we need to unload another model to
-						// make room
-						if len(availGpus) < len(gpus) {
-							// There are other requests pending, and this one
-							// needs more time, so put it on the back of the
-							// queue so that we might satisfy other pending
-							// requests that aren't blocked
-							go func() {
-								// Process in a go routine to avoid deadlocking
-								// the scheduler if our queue is full
-								slog.Debug("delaying scheduling while other models finish loading", "attempts", pending.schedAttempts, "model", pending.model.ModelPath)
-								time.Sleep(s.reschedDelay)
-								s.pendingReqCh <- pending
-							}()
-							break
-						}
-						runnerToExpire = s.findRunnerToUnload()
+						slog.Debug("cpu mode with available system memory or first model, loading")
+						s.loadFn(pending, ggml, gpus, numParallel)
+						break
 					}
+					// else we need to expire a runner
+				} else if loadedCount == 0 {
+					// No models loaded. Load the model but prefer the best fit.
+					slog.Debug("loading first model", "model", pending.model.ModelPath)
+					g := s.pickBestFullFitByLibrary(pending, ggml, gpus, &numParallel)
+					if g != nil {
+						gpus = g
+					} else {
+						// Only allow partial loads when this is the first model
+						gpus = pickBestPartialFitByLibrary(pending, ggml, gpus, &numParallel)
+					}
+					s.loadFn(pending, ggml, gpus, numParallel)
+					break
 				}
 
 				if runnerToExpire == nil {
-					// Shouildn't happen
-					slog.Error("runner to expire was nil!")
-					continue
-				}
-				// Trigger an expiration to unload once it's done
-				runnerToExpire.refMu.Lock()
-				slog.Debug("resetting model to expire immediately to make room", "runner", runnerToExpire, "refCount", runnerToExpire.refCount)
-				if runnerToExpire.expireTimer != nil {
-					runnerToExpire.expireTimer.Stop()
-					runnerToExpire.expireTimer = nil
-				}
-				runnerToExpire.sessionDuration = 0
-				if runnerToExpire.refCount <= 0 {
-					s.expiredCh <- runnerToExpire
-				}
-				runnerToExpire.refMu.Unlock()
-				// Wait for the unload to happen
-				// Note: at this point we're queueing up all incoming requests, even if they were for
-				// a different model that's loaded and not scheduled to be removed.
-				slog.Debug("waiting for pending requests to complete and unload to occur", "runner", runnerToExpire)
-				select {
-				case <-ctx.Done():
-					slog.Debug("shutting down scheduler pending loop")
-					return
-				case <-s.unloadedCh:
-					slog.Debug("unload completed", "runner", runnerToExpire)
-					continue
+					// More than one loaded model, so we have to see if the
+					// new one fits
+					//
+					// We want to avoid loading on any GPUs that have other
+					// models still loading on them to avoid potential races
+					// with VRAM consumption ramping up during load
+					availGpus := s.filterGPUsWithoutLoadingModels(gpus)
+
+					// Update free memory from currently loaded models
+					s.updateFreeSpace(availGpus)
+					fitGpus := s.pickBestFullFitByLibrary(pending, ggml, availGpus, &numParallel)
+					if fitGpus != nil {
+						slog.Debug("new model fits with existing models, loading")
+						s.loadFn(pending, ggml, fitGpus, numParallel)
+						break
+					}
+
+					// We couldn't find a set of GPUs to fully load the new
+					// model. If no other models are loading (both GPU lists
+					// are the same) then we need to unload another model to
+					// make room
+					if len(availGpus) < len(gpus) {
+						// There are other requests pending, and this one
+						// needs more time, so put it on the back of the
+						// queue so that we might satisfy other pending
+						// requests that aren't blocked
+						go func() {
+							// Process in a go routine to avoid deadlocking
+							// the scheduler if our queue is full
+							slog.Debug("delaying scheduling while other models finish loading", "attempts", pending.schedAttempts, "model", pending.model.ModelPath)
+							span.AddEvent("delayed while other models finish loading")
+							time.Sleep(s.reschedDelay)
+							s.pendingReqCh <- pending
+						}()
+						break
+					}
+
+					if pending.opts.Device != "" {
+						// Only unloading a model from the pinned device
+						// makes room for this one
+						runnerToExpire = s.findRunnerToUnloadOn(gpus)
+					} else {
+						runnerToExpire = s.findRunnerToUnload()
+					}
 				}
 			}
+
+			if runnerToExpire == nil {
+				// Shouildn't happen
+				slog.Error("runner to expire was nil!")
+				continue
+			}
+			// Trigger an expiration to unload once it's done
+			runnerToExpire.refMu.Lock()
+			slog.Debug("resetting model to expire immediately to make room", "runner", runnerToExpire, "refCount", runnerToExpire.refCount)
+			if runnerToExpire.expireTimer != nil {
+				runnerToExpire.expireTimer.Stop()
+				runnerToExpire.expireTimer = nil
+			}
+			runnerToExpire.sessionDuration = 0
+			if runnerToExpire.refCount <= 0 {
+				s.expiredCh <- runnerToExpire
+			}
+			runnerToExpire.refMu.Unlock()
+			// Wait for the unload to happen
+			// Note: at this point we're queueing up all incoming requests, even if they were for
+			// a different model that's loaded and not scheduled to be removed.
+			slog.Debug("waiting for pending requests to complete and unload to occur", "runner", runnerToExpire)
+			span.AddEvent("waiting for unload", trace.WithAttributes(attribute.String("goobla.unloading", runnerToExpire.modelPath)))
+			select {
+			case <-ctx.Done():
+				slog.Debug("shutting down scheduler pending loop")
+				return
+			case <-s.unloadedCh:
+				slog.Debug("unload completed", "runner", runnerToExpire)
+				continue
+			}
+		}
+	}
+}
+
+// nextPending returns the queued request with the highest priority, the
+// earliest queued first, waiting for one if there are none. It returns nil
+// once ctx is done.
+func (s *Scheduler) nextPending(ctx context.Context) *LlmRequest {
+	for len(s.waiting) == 0 {
+		select {
+		case <-ctx.Done():
+			return nil
+		case pending := <-s.pendingReqCh:
+			s.waiting = append(s.waiting, pending)
 		case <-s.unloadedCh:
 			// An unload request when there are no pending request can be ignored
 			slog.Debug("ignoring unload event with no pending requests")
 		}
 	}
+
+	// take the other queued requests so they can be ordered by priority
+drain:
+	for {
+		select {
+		case pending := <-s.pendingReqCh:
+			s.waiting = append(s.waiting, pending)
+		default:
+			break drain
+		}
+	}
+
+	i := 0
+	for j, req := range s.waiting {
+		if req.priority > s.waiting[i].priority {
+			i = j
+		}
+	}
+
+	pending := s.waiting[i]
+	s.waiting = slices.Delete(s.waiting, i, i+1)
+	s.numWaiting.Store(int64(len(s.waiting)))
+	return pending
+}
+
+// slots returns the number of requests the loaded runners can handle at once.
+func (s *Scheduler) slots() int {
+	s.loadedMu.Lock()
+	defer s.loadedMu.Unlock()
+
+	var n int
+	for _, runner := range s.loaded {
+		n += runner.numParallel
+	}
+
+	return n
+}
+
+// queued returns the number of requests waiting to be scheduled.
+func (s *Scheduler) queued() int {
+	return len(s.pendingReqCh) + int(s.numWaiting.Load())
 }
 
 func (s *Scheduler) processCompleted(ctx context.Context) {
@@ -332,31 +484,7 @@ func (s *Scheduler) processCompleted(ctx context.Context) {
 			runner.refMu.Lock()
 			runner.refCount--
 			if runner.refCount <= 0 {
-				if runner.sessionDuration <= 0 {
-					slog.Debug("runner with zero duration has gone idle, expiring to unload", "runner", runner)
-					if runner.expireTimer != nil {
-						runner.expireTimer.Stop()
-						runner.expireTimer = nil
-					}
-					s.expiredCh <- runner
-				} else if runner.expireTimer == nil {
-					slog.Debug("runner with non-zero duration has gone idle, adding timer", "runner", runner, "duration", runner.sessionDuration)
-					runner.expireTimer = time.AfterFunc(runner.sessionDuration, func() {
-						slog.Debug("timer expired, expiring to unload", "runner", runner)
-						runner.refMu.Lock()
-						defer runner.refMu.Unlock()
-						if runner.expireTimer != nil {
-							runner.expireTimer.Stop()
-							runner.expireTimer = nil
-						}
-						s.expiredCh <- runner
-					})
-					runner.expiresAt = time.Now().Add(runner.sessionDuration)
-				} else {
-					slog.Debug("runner with non-zero duration has gone idle, resetting timer", "runner", runner, "duration", runner.sessionDuration)
-					runner.expireTimer.Reset(runner.sessionDuration)
-					runner.expiresAt = time.Now().Add(runner.sessionDuration)
-				}
+				s.idle(runner)
 			}
 			slog.Debug("after processing request finished event", "runner", runner, "refCount", runner.refCount)
 			runner.refMu.Unlock()
@@ -414,6 +542,79 @@ func (s *Scheduler) processCompleted(ctx context.Context) {
 	}
 }
 
+// idle expires runner, which has no requests in progress, once its session
+// duration has passed. The runner's refMu must be held.
+func (s *Scheduler) idle(runner *runnerRef) {
+	if runner.sessionDuration <= 0 {
+		slog.Debug("runner with zero duration has gone idle, expiring to unload", "runner", runner)
+		if runner.expireTimer != nil {
+			runner.expireTimer.Stop()
+			runner.expireTimer = nil
+		}
+		s.expiredCh <- runner
+	} else if runner.expireTimer == nil {
+		slog.Debug("runner with non-zero duration has gone idle, adding timer", "runner", runner, "duration", runner.sessionDuration)
+		runner.expireTimer = time.AfterFunc(runner.sessionDuration, func() {
+			slog.Debug("timer expired, expiring to unload", "runner", runner)
+			runner.refMu.Lock()
+			defer runner.refMu.Unlock()
+			if runner.expireTimer != nil {
+				runner.expireTimer.Stop()
+				runner.expireTimer = nil
+			}
+			s.expiredCh <- runner
+		})
+		runner.expiresAt = time.Now().Add(runner.sessionDuration)
+	} else {
+		slog.Debug("runner with non-zero duration has gone idle, resetting timer", "runner", runner, "duration", runner.sessionDuration)
+		runner.expireTimer.Reset(runner.sessionDuration)
+		runner.expiresAt = time.Now().Add(runner.sessionDuration)
+	}
+}
+
+// setPreloaded sets whether the model at path is kept loaded regardless of
+// keep alive. A model that's no longer preloaded expires after the default
+// keep alive once it's idle.
+func (s *Scheduler) setPreloaded(path string, preloaded bool) {
+	s.loadedMu.Lock()
+	if s.preloaded == nil {
+		s.preloaded = make(map[string]bool)
+	}
+	if preloaded {
+		s.preloaded[path] = true
+	} else {
+		delete(s.preloaded, path)
+	}
+	runner := s.loaded[path]
+	s.loadedMu.Unlock()
+
+	if runner == nil {
+		return
+	}
+
+	runner.refMu.Lock()
+	defer runner.refMu.Unlock()
+	if runner.preloaded == preloaded {
+		return
+	}
+
+	runner.preloaded = preloaded
+	if preloaded {
+		runner.sessionDuration = time.Duration(math.MaxInt64)
+		if runner.expireTimer != nil {
+			runner.expireTimer.Stop()
+			runner.expireTimer = nil
+		}
+		return
+	}
+
+	runner.sessionDuration = envconfig.KeepAlive()
+	// a runner that's loading is idled when its request finishes
+	if runner.refCount <= 0 && !runner.loading {
+		s.idle(runner)
+	}
+}
+
 // Complete the pending request and send the runner back to the requester
 // Wires up a finished event after the request context is completed
 // Updates session duration, and resets expiration timer
@@ -421,11 +622,12 @@ func (pending *LlmRequest) useLoadedRunner(runner *runnerRef, finished chan *Llm
 	runner.refMu.Lock()
 	defer runner.refMu.Unlock()
 	runner.refCount++
+	runner.priority = pending.priority
 	if runner.expireTimer != nil {
 		runner.expireTimer.Stop()
 		runner.expireTimer = nil
 	}
-	if pending.sessionDuration != nil {
+	if pending.sessionDuration != nil && !runner.preloaded {
 		runner.sessionDuration = pending.sessionDuration.Duration
 	}
 	pending.successCh <- runner
@@ -444,7 +646,12 @@ func (s *Scheduler) load(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoLis
 	if req.sessionDuration != nil {
 		sessionDuration = req.sessionDuration.Duration
 	}
-	llama, err := s.newServerFn(gpus, req.model.ModelPath, f, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts, numParallel)
+	_, span := tracer.Start(req.ctx, "load", trace.WithAttributes(
+		attribute.String("goobla.model", req.model.ShortName),
+		attribute.Int("goobla.gpus", len(gpus)),
+		attribute.Int("goobla.num_parallel", numParallel),
+	))
+	llama, err := s.newServerFn(gpus, req.model.ModelPath, f, req.model.AdapterPaths, req.model.ProjectorPaths, req.model.DraftPath, req.optsFor(gpus), numParallel)
 	if err != nil {
 		// some older models are not compatible with newer versions of llama.cpp
 		// show a generalized compatibility error until there is a better way to
@@ -453,6 +660,12 @@ func (s *Scheduler) load(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoLis
 			err = fmt.Errorf("%v: this model may be incompatible with your version of Goobla. If you previously pulled this model, try updating it by running `goobla pull %s`", err, req.model.ShortName)
 		}
 		slog.Info("NewLlamaServer failed", "model", req.model.ModelPath, "error", err)
+		if s.retryOnMissingGPU(req, gpus) {
+			endSpan(span, err)
+			return
+		}
+		notify(webhookEvent{Event: eventModelLoadFailed, Model: req.model.ShortName, Error: err.Error()})
+		endSpan(span, err)
 		req.errCh <- err
 		return
 	}
@@ -465,13 +678,20 @@ func (s *Scheduler) load(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoLis
 		gpus:            gpus,
 		estimatedVRAM:   llama.EstimatedVRAM(),
 		estimatedTotal:  llama.EstimatedTotal(),
+		kvCacheType:     llama.Backend().KVCacheType,
+		kvCacheSize:     llama.EstimatedKVCache(),
 		loading:         true,
 		pid:             llama.Pid(),
+		priority:        req.priority,
 	}
 	runner.numParallel = numParallel
 	runner.refMu.Lock() // hold lock until running or aborted
 
 	s.loadedMu.Lock()
+	if s.preloaded[req.model.ModelPath] {
+		runner.preloaded = true
+		runner.sessionDuration = time.Duration(math.MaxInt64)
+	}
 	if oldRunner, ok := s.loaded[req.model.ModelPath]; ok {
 		// Shouldn't happen, but safeguard against leaking a runner
 		slog.Warn("model was still loaded", "old_runner", oldRunner, "new_runner", runner)
@@ -485,8 +705,17 @@ func (s *Scheduler) load(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoLis
 
 	go func() {
 		defer runner.refMu.Unlock()
-		if err = llama.WaitUntilRunning(req.ctx); err != nil {
+		err = llama.WaitUntilRunning(req.ctx)
+		endSpan(span, err)
+		if err != nil {
 			slog.Error("error loading llama server", "error", err)
+			if s.retryOnMissingGPU(req, gpus) {
+				s.expiredCh <- runner
+				return
+			}
+			if !errors.Is(err, context.Canceled) {
+				notify(webhookEvent{Event: eventModelLoadFailed, Model: req.model.ShortName, Error: err.Error()})
+			}
 			req.errCh <- err
 			slog.Debug("triggering expiration for failed load", "runner", runner)
 			s.expiredCh <- runner
@@ -562,7 +791,7 @@ func (s *Scheduler) filterGPUsWithoutLoadingModels(allGpus discover.GpuInfoList)
 			slog.Debug("overlapping loads detected", "gpus", runner.gpus, "model", runner.modelPath)
 			for _, busyGPU := range runner.gpus {
 				for i := range ret {
-					if ret[i].ID == busyGPU.ID {
+					if ret[i].Library == busyGPU.Library && ret[i].ID == busyGPU.ID {
 						ret = append(ret[:i], ret[i+1:]...)
 						break
 					}
@@ -573,19 +802,60 @@ func (s *Scheduler) filterGPUsWithoutLoadingModels(allGpus discover.GpuInfoList)
 	return ret
 }
 
-// gpuLoadCounts returns the number of models currently loaded per GPU ID.
+// deviceKey identifies a GPU across libraries, whose IDs can overlap.
+func deviceKey(g discover.GpuInfo) string {
+	return g.Library + ":" + g.ID
+}
+
+// gpuLoadCounts returns the number of models currently loaded per GPU.
 func (s *Scheduler) gpuLoadCounts() map[string]int {
 	counts := map[string]int{}
 	s.loadedMu.Lock()
 	defer s.loadedMu.Unlock()
 	for _, r := range s.loaded {
 		for _, g := range r.gpus {
-			counts[g.ID]++
+			counts[deviceKey(g)]++
 		}
 	}
 	return counts
 }
 
+// selectDevice returns the GPUs a model pinned to device can be loaded on.
+// The device is a library, such as cuda, optionally followed by the ID or
+// index of one of its GPUs, such as cuda:1.
+func selectDevice(gpus discover.GpuInfoList, device string) (discover.GpuInfoList, error) {
+	library, id, pinned := strings.Cut(device, ":")
+
+	var selected discover.GpuInfoList
+	for _, g := range gpus {
+		if g.Library == library && (!pinned || g.ID == id) {
+			selected = append(selected, g)
+		}
+	}
+
+	if pinned && len(selected) == 0 {
+		// fall back to the index of the GPU within its library
+		var n int
+		for _, g := range gpus {
+			if g.Library != library {
+				continue
+			}
+
+			if strconv.Itoa(n) == id {
+				selected = append(selected, g)
+				break
+			}
+			n++
+		}
+	}
+
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("device %q is not available", device)
+	}
+
+	return selected, nil
+}
+
 type runnerRef struct {
 	refMu    sync.Mutex
 	refCount uint // prevent unloading if > 0
@@ -596,14 +866,20 @@ type runnerRef struct {
 	gpus           discover.GpuInfoList // Recorded at time of provisioning
 	estimatedVRAM  uint64
 	estimatedTotal uint64
+	kvCacheType    string
+	kvCacheSize    uint64
 
 	sessionDuration time.Duration
 	expireTimer     *time.Timer
 	expiresAt       time.Time
+	// preloaded runners stay loaded regardless of keep alive
+	preloaded bool
 
 	model       *Model
 	modelPath   string
 	numParallel int
+	// priority is the priority of the last request to use the runner
+	priority requestPriority
 	*api.Options
 }
 
@@ -647,11 +923,19 @@ func (runner *runnerRef) needsReload(ctx context.Context, req *LlmRequest) bool
 	// Normalize the NumCtx for parallelism
 	optsExisting.NumCtx = optsExisting.NumCtx / runner.numParallel
 
+	// Any context length is usable with num_ctx auto
+	if req.autoNumCtx {
+		optsNew.NumCtx = optsExisting.NumCtx
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 	if !reflect.DeepEqual(runner.model.AdapterPaths, req.model.AdapterPaths) || // have the adapters changed?
 		!reflect.DeepEqual(runner.model.ProjectorPaths, req.model.ProjectorPaths) || // have the projectors changed?
+		runner.model.DraftPath != req.model.DraftPath || // has the draft model changed?
 		!reflect.DeepEqual(optsExisting, optsNew) || // have the runner options changed?
+		(req.opts.Deterministic && runner.numParallel != 1) || // can other sequences share the batch?
+		req.opts.NumBeams > runner.numParallel || // are there enough sequences for the beams?
 		runner.llama.Ping(ctx) != nil {
 		return true
 	}
@@ -789,31 +1073,47 @@ func (s *Scheduler) pickBestFullFitByLibrary(req *LlmRequest, f *ggml.GGML, gpus
 		if mr := int(envconfig.MaxRunners()); mr > 0 {
 			filtered := sgl[:0]
 			for _, g := range sgl {
-				if loads[g.ID] < mr {
+				if loads[deviceKey(g)] < mr {
 					filtered = append(filtered, g)
 				}
 			}
 			sgl = filtered
 		}
-		// Sort by number of models already loaded (ascending), then performance
-		sort.SliceStable(sgl, func(i, j int) bool {
-			if loads[sgl[i].ID] != loads[sgl[j].ID] {
-				return loads[sgl[i].ID] < loads[sgl[j].ID]
-			}
-			p1 := discover.PerformanceScore(sgl[i])
-			p2 := discover.PerformanceScore(sgl[j])
-			if p1 != p2 {
-				return p1 > p2
+
+		// A tensor split is given for the GPUs in the order they were
+		// discovered, so keep that order and load onto all the GPUs it
+		// places part of the model on
+		proportions, err := llm.ParseTensorSplit(llm.TensorSplitFor(req.opts.TensorSplit, req.discovered, sgl))
+		split := err == nil
+		if split {
+			filtered := sgl[:0]
+			for i, g := range sgl {
+				if proportions[i] > 0 {
+					filtered = append(filtered, g)
+				}
 			}
-			return sgl[i].FreeMemory > sgl[j].FreeMemory
-		})
+			sgl = filtered
+		} else {
+			// Sort by number of models already loaded (ascending), then performance
+			sort.SliceStable(sgl, func(i, j int) bool {
+				if loads[deviceKey(sgl[i])] != loads[deviceKey(sgl[j])] {
+					return loads[deviceKey(sgl[i])] < loads[deviceKey(sgl[j])]
+				}
+				p1 := discover.PerformanceScore(sgl[i])
+				p2 := discover.PerformanceScore(sgl[j])
+				if p1 != p2 {
+					return p1 > p2
+				}
+				return sgl[i].FreeMemory > sgl[j].FreeMemory
+			})
+		}
 
 		// First attempt to fit the model into a single GPU
 		for _, p := range numParallelToTry {
 			req.opts.NumCtx = req.origNumCtx * p
-			if !envconfig.SchedSpread() {
+			if !envconfig.SchedSpread() && !split {
 				for _, g := range sgl {
-					if ok, estimatedVRAM = llm.PredictServerFit([]discover.GpuInfo{g}, f, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts, p); ok {
+					if ok, estimatedVRAM = llm.PredictServerFit([]discover.GpuInfo{g}, f, req.model.AdapterPaths, llm.WeightPaths(req.model.ProjectorPaths, req.model.DraftPath), req.optsFor([]discover.GpuInfo{g}), p); ok {
 						slog.Info("new model will fit in available VRAM in single GPU, loading", "model", req.model.ModelPath, "gpu", g.ID, "parallel", p, "available", g.FreeMemory, "required", format.HumanBytes2(estimatedVRAM))
 						*numParallel = p
 						return []discover.GpuInfo{g}
@@ -829,7 +1129,7 @@ func (s *Scheduler) pickBestFullFitByLibrary(req *LlmRequest, f *ggml.GGML, gpus
 		// Now try all the GPUs
 		for _, p := range numParallelToTry {
 			req.opts.NumCtx = req.origNumCtx * p
-			if ok, estimatedVRAM = llm.PredictServerFit(sgl, f, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts, p); ok {
+			if ok, estimatedVRAM = llm.PredictServerFit(sgl, f, req.model.AdapterPaths, llm.WeightPaths(req.model.ProjectorPaths, req.model.DraftPath), req.optsFor(sgl), p); ok {
 				slog.Info("new model will fit in available VRAM, loading", "model", req.model.ModelPath, "library", sgl[0].Library, "parallel", p, "required", format.HumanBytes2(estimatedVRAM))
 				*numParallel = p
 				return sgl
@@ -839,6 +1139,25 @@ func (s *Scheduler) pickBestFullFitByLibrary(req *LlmRequest, f *ggml.GGML, gpus
 	return nil
 }
 
+// fitNumCtx sets the context length of a request with num_ctx auto to the
+// largest that fits its model in the free memory of gpus. The whole context
+// goes to one sequence unless the number of parallel requests is set.
+func (s *Scheduler) fitNumCtx(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoList, numParallel *int) {
+	if *numParallel <= 0 {
+		*numParallel = 1
+	}
+
+	var systemFree uint64
+	if cpus := s.getCpuFn(); len(cpus) > 0 {
+		systemFree = cpus[0].FreeMemory
+	}
+
+	numCtx := llm.FitContextLength(gpus, f, llm.WeightPaths(req.model.ProjectorPaths, req.model.DraftPath), req.optsFor(gpus), *numParallel, systemFree)
+	slog.Info("fit context length to available memory", "model", req.model.ModelPath, "num_ctx", numCtx, "parallel", *numParallel)
+	req.origNumCtx = numCtx
+	req.opts.NumCtx = numCtx * *numParallel
+}
+
 // If multiple Libraries are detected, pick the Library which loads the most layers for the model
 func pickBestPartialFitByLibrary(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoList, numParallel *int) discover.GpuInfoList {
 	if *numParallel <= 0 {
@@ -852,7 +1171,7 @@ func pickBestPartialFitByLibrary(req *LlmRequest, f *ggml.GGML, gpus discover.Gp
 	var bestEstimate uint64
 	var bestFit int
 	for i, gl := range byLibrary {
-		_, estimatedVRAM := llm.PredictServerFit(gl, f, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts, *numParallel)
+		_, estimatedVRAM := llm.PredictServerFit(gl, f, req.model.AdapterPaths, llm.WeightPaths(req.model.ProjectorPaths, req.model.DraftPath), req.optsFor(gl), *numParallel)
 		if estimatedVRAM > bestEstimate {
 			bestEstimate = estimatedVRAM
 			bestFit = i
@@ -863,12 +1182,28 @@ func pickBestPartialFitByLibrary(req *LlmRequest, f *ggml.GGML, gpus discover.Gp
 
 // findRunnerToUnload finds a runner to unload to make room for a new model
 func (s *Scheduler) findRunnerToUnload() *runnerRef {
+	return s.findRunnerToUnloadOn(nil)
+}
+
+// findRunnerToUnloadOn finds a runner to unload to make room for a new
+// model on gpus, preferring runners loaded on them. If gpus is nil, any
+// runner may be unloaded.
+func (s *Scheduler) findRunnerToUnloadOn(gpus discover.GpuInfoList) *runnerRef {
 	s.loadedMu.Lock()
 	runnerList := make([]*runnerRef, 0, len(s.loaded))
+	var onGPUs []*runnerRef
 	for _, r := range s.loaded {
 		runnerList = append(runnerList, r)
+		if slices.ContainsFunc(r.gpus, func(g discover.GpuInfo) bool {
+			return slices.ContainsFunc(gpus, func(o discover.GpuInfo) bool { return deviceKey(g) == deviceKey(o) })
+		}) {
+			onGPUs = append(onGPUs, r)
+		}
 	}
 	s.loadedMu.Unlock()
+	if len(onGPUs) > 0 {
+		runnerList = onGPUs
+	}
 	if len(runnerList) == 0 {
 		slog.Debug("no loaded runner to unload")
 		return nil
@@ -878,6 +1213,26 @@ func (s *Scheduler) findRunnerToUnload() *runnerRef {
 	// e.g., if we have multiple options, will one make room for the request?
 	sort.Sort(ByDurationAndName(runnerList))
 
+	// Unload runners last used by lower priority requests first, and
+	// preloaded runners last
+	priorities := make(map[*runnerRef]requestPriority, len(runnerList))
+	preloaded := make(map[*runnerRef]bool, len(runnerList))
+	for _, runner := range runnerList {
+		runner.refMu.Lock()
+		priorities[runner] = runner.priority
+		preloaded[runner] = runner.preloaded
+		runner.refMu.Unlock()
+	}
+	slices.SortStableFunc(runnerList, func(a, b *runnerRef) int {
+		if preloaded[a] != preloaded[b] {
+			if preloaded[a] {
+				return 1
+			}
+			return -1
+		}
+		return cmp.Compare(priorities[a], priorities[b])
+	})
+
 	// First try to find a runner that's already idle
 	for _, runner := range runnerList {
 		runner.refMu.Lock()
@@ -910,6 +1265,11 @@ func (s *Scheduler) expireRunner(model *Model) {
 	s.loadedMu.Unlock()
 	if ok {
 		runner.refMu.Lock()
+		if runner.preloaded {
+			slog.Debug("not expiring preloaded runner", "runner", runner)
+			runner.refMu.Unlock()
+			return
+		}
 		runner.expiresAt = time.Now()
 		if runner.expireTimer != nil {
 			runner.expireTimer.Stop()
@@ -927,14 +1287,14 @@ func (s *Scheduler) expireRunner(model *Model) {
 // If not, pick a runner to unload, else return nil and the request can be loaded
 func (s *Scheduler) maybeFindCPURunnerToUnload(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoList) *runnerRef {
 	slog.Debug("evaluating if CPU model load will fit in available system memory")
-	estimate := llm.EstimateGPULayers(gpus, f, req.model.ProjectorPaths, req.opts, req.opts.NumCtx/req.origNumCtx)
+	estimate := llm.EstimateGPULayers(gpus, f, llm.WeightPaths(req.model.ProjectorPaths, req.model.DraftPath), req.opts, req.opts.NumCtx/req.origNumCtx)
 	if estimate.TotalSize <= gpus[0].FreeMemory {
 		slog.Debug("cpu inference mode, model fits in available system memory", "model", format.HumanBytes2(estimate.TotalSize), "available", format.HumanBytes2(gpus[0].FreeMemory))
 		return nil
 	}
 
-	// Optimization idea: try to unload CPU-only runners first or partial offloads with enough
-	// system memory to make room
+	// Optimization idea: try partial offloads with enough system memory to
+	// make room after CPU-only runners
 
-	return s.findRunnerToUnload()
+	return s.findRunnerToUnloadOn(gpus)
 }
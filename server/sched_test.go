@@ -48,7 +48,7 @@ func TestLoad(t *testing.T) {
 		sessionDuration: &api.Duration{Duration: 2 * time.Second},
 	}
 	// Fail to load model first
-	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 		return nil, errors.New("something failed to load model blah")
 	}
 	gpus := discover.GpuInfoList{}
@@ -62,7 +62,7 @@ func TestLoad(t *testing.T) {
 	require.Contains(t, err.Error(), "this model may be incompatible")
 
 	server := &mockLlm{estimatedVRAM: 10, estimatedVRAMByGPU: map[string]uint64{}}
-	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 		return server, nil
 	}
 	s.load(req, f, gpus, 0)
@@ -103,7 +103,7 @@ type reqBundle struct {
 	f       *ggml.GGML
 }
 
-func (scenario *reqBundle) newServer(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+func (scenario *reqBundle) newServer(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 	return scenario.srv, nil
 }
 
@@ -363,10 +363,10 @@ func TestGetRunner(t *testing.T) {
 	s.getCpuFn = getCpuFn
 	s.newServerFn = a.newServer
 	slog.Info("a")
-	successCh1a, errCh1a := s.GetRunner(a.ctx, a.req.model, a.req.opts, a.req.sessionDuration)
+	successCh1a, errCh1a := s.GetRunner(a.ctx, a.req.model, a.req.opts, a.req.sessionDuration, a.req.priority)
 	require.Len(t, s.pendingReqCh, 1)
 	slog.Info("b")
-	successCh1b, errCh1b := s.GetRunner(b.ctx, b.req.model, b.req.opts, b.req.sessionDuration)
+	successCh1b, errCh1b := s.GetRunner(b.ctx, b.req.model, b.req.opts, b.req.sessionDuration, b.req.priority)
 	require.Len(t, s.pendingReqCh, 1)
 	require.Empty(t, successCh1b)
 	require.Len(t, errCh1b, 1)
@@ -390,7 +390,7 @@ func TestGetRunner(t *testing.T) {
 
 	c.req.model.ModelPath = "bad path"
 	slog.Info("c")
-	successCh1c, errCh1c := s.GetRunner(c.ctx, c.req.model, c.req.opts, c.req.sessionDuration)
+	successCh1c, errCh1c := s.GetRunner(c.ctx, c.req.model, c.req.opts, c.req.sessionDuration, c.req.priority)
 	// Starts in pending channel, then should be quickly processed to return an error
 	time.Sleep(50 * time.Millisecond) // Long enough for the "a" model to expire and unload
 	require.Empty(t, successCh1c)
@@ -419,7 +419,7 @@ func TestExpireRunner(t *testing.T) {
 	var f *ggml.GGML
 	gpus := discover.GpuInfoList{}
 	server := &mockLlm{estimatedVRAM: 10, estimatedVRAMByGPU: map[string]uint64{}}
-	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 		return server, nil
 	}
 	s.load(req, f, gpus, 0)
@@ -463,8 +463,8 @@ func TestBogusFinishedEvent(t *testing.T) {
 	s.getCpuFn = getCpuFn
 	s.newServerFn = scenario1.newServer
 
-	successCh1, errCh1 := s.GetRunner(scenario1.ctx, scenario1.req.model, scenario1.req.opts, scenario1.req.sessionDuration)
-	successCh2, errCh2 := s.GetRunner(scenario2.ctx, scenario2.req.model, scenario2.req.opts, scenario2.req.sessionDuration)
+	successCh1, errCh1 := s.GetRunner(scenario1.ctx, scenario1.req.model, scenario1.req.opts, scenario1.req.sessionDuration, scenario1.req.priority)
+	successCh2, errCh2 := s.GetRunner(scenario2.ctx, scenario2.req.model, scenario2.req.opts, scenario2.req.sessionDuration, scenario2.req.priority)
 	require.Len(t, s.pendingReqCh, 2)
 
 	s.Run(ctx)
@@ -526,7 +526,7 @@ func TestPrematureExpired(t *testing.T) {
 		return []discover.GpuInfo{g}
 	}
 	s.newServerFn = scenario1a.newServer
-	successCh1a, errCh1a := s.GetRunner(scenario1a.ctx, scenario1a.req.model, scenario1a.req.opts, scenario1a.req.sessionDuration)
+	successCh1a, errCh1a := s.GetRunner(scenario1a.ctx, scenario1a.req.model, scenario1a.req.opts, scenario1a.req.sessionDuration, scenario1a.req.priority)
 	require.Len(t, s.pendingReqCh, 1)
 	s.Run(ctx)
 	select {
@@ -673,6 +673,156 @@ func TestFindRunnerToUnload(t *testing.T) {
 	require.Equal(t, r1, resp)
 }
 
+func TestFindRunnerToUnloadPriority(t *testing.T) {
+	ctx, done := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer done()
+
+	r1 := &runnerRef{sessionDuration: 1, numParallel: 1, priority: priorityHigh}
+	r2 := &runnerRef{sessionDuration: 2, numParallel: 1, priority: priorityLow}
+
+	s := InitScheduler(ctx)
+	s.loadedMu.Lock()
+	s.loaded["a"] = r1
+	s.loaded["b"] = r2
+	s.loadedMu.Unlock()
+
+	// the runner last used by a low priority request is unloaded first
+	require.Equal(t, r2, s.findRunnerToUnload())
+
+	r2.refCount = 1
+	require.Equal(t, r1, s.findRunnerToUnload())
+
+	r1.refCount = 1
+	require.Equal(t, r2, s.findRunnerToUnload())
+}
+
+func TestFindRunnerToUnloadOn(t *testing.T) {
+	ctx, done := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer done()
+
+	gpus := discover.GpuInfoList{
+		{Library: "cuda", ID: "0"},
+		{Library: "cuda", ID: "1"},
+	}
+	r1 := &runnerRef{sessionDuration: 1, numParallel: 1, gpus: discover.GpuInfoList{gpus[0]}}
+	r2 := &runnerRef{sessionDuration: 2, numParallel: 1, gpus: discover.GpuInfoList{gpus[1]}}
+
+	s := InitScheduler(ctx)
+	s.loadedMu.Lock()
+	s.loaded["a"] = r1
+	s.loaded["b"] = r2
+	s.loadedMu.Unlock()
+
+	require.Equal(t, r1, s.findRunnerToUnload())
+	require.Equal(t, r2, s.findRunnerToUnloadOn(gpus[1:]))
+
+	// runners on other devices are unloaded if none are on the GPUs
+	require.Equal(t, r1, s.findRunnerToUnloadOn(discover.GpuInfoList{{Library: "rocm", ID: "1"}}))
+}
+
+func TestSelectDevice(t *testing.T) {
+	gpus := discover.GpuInfoList{
+		{Library: "cuda", ID: "GPU-a"},
+		{Library: "cuda", ID: "GPU-b"},
+		{Library: "rocm", ID: "0"},
+	}
+
+	cases := []struct {
+		device string
+		want   []string
+	}{
+		{"cuda", []string{"GPU-a", "GPU-b"}},
+		{"cuda:1", []string{"GPU-b"}},
+		{"cuda:GPU-a", []string{"GPU-a"}},
+		{"rocm:0", []string{"0"}},
+		{"cuda:2", nil},
+		{"metal", nil},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.device, func(t *testing.T) {
+			selected, err := selectDevice(gpus, tt.device)
+			if tt.want == nil {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			var ids []string
+			for _, g := range selected {
+				ids = append(ids, g.ID)
+			}
+			require.Equal(t, tt.want, ids)
+		})
+	}
+}
+
+func TestRequestsDevice(t *testing.T) {
+	ctx, done := context.WithTimeout(t.Context(), 500*time.Millisecond)
+	defer done()
+	s := InitScheduler(ctx)
+	s.getGpuFn = getGpuFn
+	s.getCpuFn = getCpuFn
+
+	a := newScenarioRequest(t, ctx, "goobla-model-1", 10, nil)
+	a.req.opts.Device = "cpu"
+	var loadedOn discover.GpuInfoList
+	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+		loadedOn = gpus
+		return a.srv, nil
+	}
+
+	s.Run(ctx)
+	s.pendingReqCh <- a.req
+	select {
+	case <-a.req.successCh:
+		require.Len(t, loadedOn, 1)
+		require.Equal(t, "cpu", loadedOn[0].Library)
+	case err := <-a.req.errCh:
+		t.Fatal(err.Error())
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	b := newScenarioRequest(t, ctx, "goobla-model-2", 10, nil)
+	b.req.opts.Device = "cuda"
+	s.pendingReqCh <- b.req
+	select {
+	case <-b.req.successCh:
+		t.Fatal("expected the model to fail to load on a missing device")
+	case err := <-b.req.errCh:
+		require.ErrorContains(t, err, `device "cuda" is not available`)
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+}
+
+func TestNextPending(t *testing.T) {
+	ctx, done := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer done()
+
+	s := InitScheduler(ctx)
+
+	low := &LlmRequest{priority: priorityLow}
+	normal1 := &LlmRequest{priority: priorityNormal}
+	high := &LlmRequest{priority: priorityHigh}
+	normal2 := &LlmRequest{priority: priorityNormal}
+	for _, req := range []*LlmRequest{low, normal1, high, normal2} {
+		s.pendingReqCh <- req
+	}
+	require.Equal(t, 4, s.queued())
+
+	require.Equal(t, high, s.nextPending(ctx))
+	require.Equal(t, 3, s.queued())
+	require.Equal(t, normal1, s.nextPending(ctx))
+	require.Equal(t, normal2, s.nextPending(ctx))
+	require.Equal(t, low, s.nextPending(ctx))
+	require.Equal(t, 0, s.queued())
+
+	done()
+	require.Nil(t, s.nextPending(ctx))
+}
+
 func TestNeedsReload(t *testing.T) {
 	ctx, done := context.WithTimeout(t.Context(), 100*time.Millisecond)
 	defer done()
@@ -701,6 +851,10 @@ func TestNeedsReload(t *testing.T) {
 	resp = runner.needsReload(ctx, req)
 	require.True(t, resp)
 	req.model.ProjectorPaths = runner.model.ProjectorPaths
+	req.model.DraftPath = "draft1"
+	resp = runner.needsReload(ctx, req)
+	require.True(t, resp)
+	req.model.DraftPath = runner.model.DraftPath
 	runner.loading = true
 	req.opts.NumBatch = 1234
 	resp = runner.needsReload(ctx, req)
@@ -718,6 +872,28 @@ func TestNeedsReload(t *testing.T) {
 	req.opts.NumGPU = -1
 	resp = runner.needsReload(ctx, req)
 	require.False(t, resp)
+	req.opts.Deterministic = true
+	resp = runner.needsReload(ctx, req)
+	require.False(t, resp)
+	runner.numParallel = 2
+	runner.Options.NumCtx = req.opts.NumCtx * 2
+	resp = runner.needsReload(ctx, req)
+	require.True(t, resp)
+	req.opts.Deterministic = false
+	resp = runner.needsReload(ctx, req)
+	require.False(t, resp)
+	req.opts.NumBeams = 4
+	resp = runner.needsReload(ctx, req)
+	require.True(t, resp)
+	req.opts.NumBeams = 2
+	resp = runner.needsReload(ctx, req)
+	require.False(t, resp)
+	req.opts.NumCtx = 4
+	resp = runner.needsReload(ctx, req)
+	require.True(t, resp)
+	req.autoNumCtx = true
+	resp = runner.needsReload(ctx, req)
+	require.False(t, resp)
 }
 
 func TestUnloadAllRunners(t *testing.T) {
@@ -788,9 +964,9 @@ func TestHomogeneousGPUs(t *testing.T) {
 	}
 	s.getCpuFn = getCpuFn
 	a := newScenarioRequest(t, ctx, "goobla-model-1", 10, &api.Duration{Duration: 5 * time.Millisecond})
-	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 		require.Len(t, gpus, 1)
-		return a.newServer(gpus, model, f, adapters, projectors, opts, numParallel)
+		return a.newServer(gpus, model, f, adapters, projectors, draft, opts, numParallel)
 	}
 	slog.Info("a")
 	s.pendingReqCh <- a.req
@@ -808,6 +984,60 @@ func TestHomogeneousGPUs(t *testing.T) {
 	}
 }
 
+func TestRequestsTensorSplit(t *testing.T) {
+	ctx, done := context.WithTimeout(t.Context(), 500*time.Millisecond)
+	defer done()
+	s := InitScheduler(ctx)
+
+	s.getGpuFn = func() discover.GpuInfoList {
+		gpus := []discover.GpuInfo{
+			{Library: "cuda", ID: "0"},
+			{Library: "cuda", ID: "1"},
+			{Library: "cuda", ID: "2"},
+		}
+		for i := range gpus {
+			gpus[i].TotalMemory = 4 * format.GibiByte
+			gpus[i].FreeMemory = 4 * format.GibiByte
+		}
+		return gpus
+	}
+	s.getCpuFn = getCpuFn
+
+	// the split refers to the GPUs in the order they were discovered, so it
+	// is rewritten for the GPUs the model is loaded on
+	a := newScenarioRequest(t, ctx, "goobla-model-1", 10, &api.Duration{Duration: 5 * time.Millisecond})
+	a.req.opts.TensorSplit = "0,1,3"
+	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+		require.Equal(t, []string{"1", "2"}, []string{gpus[0].ID, gpus[1].ID})
+		require.Equal(t, "1,3", opts.TensorSplit)
+		return a.newServer(gpus, model, f, adapters, projectors, draft, opts, numParallel)
+	}
+
+	s.pendingReqCh <- a.req
+	s.Run(ctx)
+	select {
+	case resp := <-a.req.successCh:
+		require.Equal(t, resp.llama, a.srv)
+		require.Equal(t, "0,1,3", resp.Options.TensorSplit)
+	case err := <-a.req.errCh:
+		t.Fatal(err.Error())
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	b := newScenarioRequest(t, ctx, "goobla-model-2", 10, &api.Duration{Duration: 5 * time.Millisecond})
+	b.req.opts.TensorSplit = "1,-1,1"
+	s.pendingReqCh <- b.req
+	select {
+	case <-b.req.successCh:
+		t.Fatal("expected an invalid tensor_split to fail")
+	case err := <-b.req.errCh:
+		require.ErrorContains(t, err, "invalid tensor_split")
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+}
+
 type mockLlm struct {
 	pingResp           error
 	waitResp           error
@@ -850,4 +1080,6 @@ func (s *mockLlm) Close() error {
 func (s *mockLlm) EstimatedVRAM() uint64                  { return s.estimatedVRAM }
 func (s *mockLlm) EstimatedTotal() uint64                 { return s.estimatedTotal }
 func (s *mockLlm) EstimatedVRAMByGPU(gpuid string) uint64 { return s.estimatedVRAMByGPU[gpuid] }
+func (s *mockLlm) EstimatedKVCache() uint64               { return 0 }
+func (s *mockLlm) Backend() llm.Backend                   { return llm.Backend{Library: "cpu"} }
 func (s *mockLlm) Pid() int                               { return -1 }
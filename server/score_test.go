@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/discover"
+	"github.com/goobla/goobla/fs/ggml"
+	"github.com/goobla/goobla/llm"
+)
+
+func TestScore(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mock := mockRunner{
+		CompletionFn: func(_ context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			// each token of the completion is half as likely as the last
+			var logprobs []api.Logprob
+			for i := range len(r.Score) {
+				logprobs = append(logprobs, api.Logprob{TokenLogprob: api.TokenLogprob{
+					Token:   r.Score[i : i+1],
+					Logprob: -float64(i+1) * math.Ln2,
+				}})
+			}
+
+			fn(llm.CompletionResponse{Done: true, PromptEvalCount: 4, Logprobs: logprobs})
+			return nil
+		},
+	}
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			getGpuFn:      discover.GetGPUInfo,
+			getCpuFn:      discover.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, _ *ggml.GGML, _ discover.GpuInfoList, _ int) {
+				// add small delay to simulate loading
+				time.Sleep(time.Millisecond)
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(t.Context())
+
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture":          "llama",
+		"llama.block_count":             uint32(1),
+		"llama.context_length":          uint32(8192),
+		"llama.embedding_length":        uint32(4096),
+		"llama.attention.head_count":    uint32(32),
+		"llama.attention.head_count_kv": uint32(8),
+		"tokenizer.ggml.tokens":         []string{""},
+		"tokenizer.ggml.scores":         []float32{0},
+		"tokenizer.ggml.token_type":     []int32{0},
+	}, []*ggml.Tensor{
+		{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "blk.0.attn_norm.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "blk.0.ffn_down.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "blk.0.ffn_gate.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "blk.0.ffn_up.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "blk.0.ffn_norm.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "blk.0.attn_k.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "blk.0.attn_output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "blk.0.attn_q.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "blk.0.attn_v.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+	})
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:    "test",
+		Files:    map[string]string{"file.gguf": digest},
+		Template: `{{ range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}assistant:`,
+		Stream:   &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	t.Run("score", func(t *testing.T) {
+		w := createRequest(t, s.ScoreHandler, api.ScoreRequest{
+			Model:       "test",
+			Prompt:      "Is the sky blue?",
+			Completion:  "yes",
+			TopLogprobs: 2,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if mock.CompletionRequest.Prompt != "user: Is the sky blue? assistant:" || mock.CompletionRequest.Score != "yes" || mock.CompletionRequest.TopLogprobs != 2 {
+			t.Errorf("unexpected completion request %+v", mock.CompletionRequest)
+		}
+
+		var resp api.ScoreResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		// the completion is 1/2 * 1/4 * 1/8 likely, and each token is 1/4
+		// likely on average
+		if len(resp.Logprobs) != 3 || math.Abs(resp.Logprob-math.Log(1./64)) > 1e-9 || math.Abs(resp.Perplexity-4) > 1e-9 || resp.PromptEvalCount != 4 {
+			t.Errorf("unexpected response %+v", resp)
+		}
+	})
+
+	t.Run("raw", func(t *testing.T) {
+		w := createRequest(t, s.ScoreHandler, api.ScoreRequest{Model: "test", Prompt: "The sky is", Completion: " blue", Raw: true})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if mock.CompletionRequest.Prompt != "The sky is" {
+			t.Errorf("unexpected prompt %q", mock.CompletionRequest.Prompt)
+		}
+	})
+
+	cases := map[string]api.ScoreRequest{
+		"no completion":   {Model: "test", Prompt: "Is the sky blue?"},
+		"top logprobs":    {Model: "test", Prompt: "Is the sky blue?", Completion: "yes", TopLogprobs: 21},
+		"raw with system": {Model: "test", Prompt: "Is the sky blue?", Completion: "yes", Raw: true, System: "You are a llama."},
+		"context length":  {Model: "test", Prompt: "Is the sky blue?", Completion: "yes", Options: map[string]any{"num_ctx": 4}},
+	}
+
+	for name, req := range cases {
+		t.Run(name, func(t *testing.T) {
+			w := createRequest(t, s.ScoreHandler, req)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goobla/goobla/envconfig"
+)
+
+var errScrubRunning = errors.New("blobs are already being scrubbed")
+
+// scrubState is the result of scrubbing blobs. It is stored in scrub.json in
+// the models directory so the scrub interval is kept across restarts and
+// corrupted blobs stay marked until they are replaced.
+type scrubState struct {
+	LastScrub time.Time                `json:"last_scrub"`
+	Corrupted map[string]corruptedBlob `json:"corrupted,omitempty"`
+}
+
+type corruptedBlob struct {
+	Actual     string    `json:"actual"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+var (
+	// scrubMu serializes updates to scrub.json
+	scrubMu sync.Mutex
+
+	// scrubbing is set while blobs are being scrubbed
+	scrubbing atomic.Bool
+)
+
+func scrubStatePath() (string, error) {
+	dir, err := envconfig.Models()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "scrub.json"), nil
+}
+
+func readScrubState() (scrubState, error) {
+	var s scrubState
+
+	p, err := scrubStatePath()
+	if err != nil {
+		return s, err
+	}
+
+	b, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+
+	if err := json.Unmarshal(b, &s); err != nil {
+		return s, fmt.Errorf("%s: %w", p, err)
+	}
+
+	return s, nil
+}
+
+// updateScrubState applies fn to the scrub state, writing it back if fn
+// reports that it changed.
+func updateScrubState(fn func(*scrubState) bool) error {
+	scrubMu.Lock()
+	defer scrubMu.Unlock()
+
+	s, err := readScrubState()
+	if err != nil {
+		return err
+	}
+
+	if s.Corrupted == nil {
+		s.Corrupted = make(map[string]corruptedBlob)
+	}
+
+	if !fn(&s) {
+		return nil
+	}
+
+	p, err := scrubStatePath()
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(p, b, 0o600)
+}
+
+// unmarkCorrupted forgets that the blob with digest was corrupted, once it
+// has been replaced.
+func unmarkCorrupted(digest string) error {
+	return updateScrubState(func(s *scrubState) bool {
+		digest = strings.Replace(digest, "-", ":", 1)
+		if _, ok := s.Corrupted[digest]; !ok {
+			return false
+		}
+
+		delete(s.Corrupted, digest)
+		return true
+	})
+}
+
+// isCorrupted reports whether the blob with digest has been marked as
+// corrupted by a scrub.
+func isCorrupted(digest string) bool {
+	s, err := readScrubState()
+	if err != nil {
+		return false
+	}
+
+	_, ok := s.Corrupted[strings.Replace(digest, "-", ":", 1)]
+	return ok
+}
+
+// scrubDelay is how long after the server starts scrubbing may begin, so an
+// overdue scrub doesn't compete with the models loaded as it starts.
+var scrubDelay = 10 * time.Minute
+
+// runScrubber scrubs blobs every GOOBLA_SCRUB_INTERVAL, if it is set, until
+// ctx is done.
+func runScrubber(ctx context.Context) {
+	interval := envconfig.ScrubInterval()
+	if interval == 0 {
+		return
+	}
+
+	earliest := time.Now().Add(scrubDelay)
+	for {
+		s, err := readScrubState()
+		if err != nil {
+			slog.Warn("couldn't read scrub state", "error", err)
+		}
+
+		next := s.LastScrub.Add(interval)
+		if next.Before(earliest) {
+			next = earliest
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+
+		if err := scrubBlobs(ctx, envconfig.ScrubRate()); errors.Is(err, context.Canceled) {
+			return
+		} else if err != nil {
+			slog.Warn("couldn't scrub blobs", "error", err)
+		}
+	}
+}
+
+// scrubBlobs re-hashes every blob, reading at most rate bytes per second if
+// rate is not zero, and marks those that don't match their digest as
+// corrupted. Blobs that were marked but now match, such as after being pulled
+// again, are unmarked.
+func scrubBlobs(ctx context.Context, rate uint64) error {
+	if !scrubbing.CompareAndSwap(false, true) {
+		return errScrubRunning
+	}
+	defer scrubbing.Store(false)
+
+	dir, err := GetBlobsPath("")
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	slog.Info("scrubbing blobs", "path", dir)
+
+	var checked, corrupted int
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// skip partial downloads and anything else that isn't a blob
+		if d.IsDir() || !digestRe.MatchString(d.Name()) {
+			return nil
+		}
+
+		digest := strings.Replace(d.Name(), "-", ":", 1)
+		actual, err := hashFile(ctx, p, rate)
+		if errors.Is(err, fs.ErrNotExist) {
+			// removed while scrubbing
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		checked++
+		if actual != digest {
+			corrupted++
+			slog.Error("corrupted blob", "digest", digest, "actual", actual, "path", p)
+		}
+
+		return updateScrubState(func(s *scrubState) bool {
+			_, marked := s.Corrupted[digest]
+			switch {
+			case actual != digest && !marked:
+				s.Corrupted[digest] = corruptedBlob{Actual: actual, DetectedAt: time.Now()}
+				return true
+			case actual == digest && marked:
+				delete(s.Corrupted, digest)
+				return true
+			}
+			return false
+		})
+	})
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+
+	// record the scrub even if it failed so it isn't retried immediately
+	if err := updateScrubState(func(s *scrubState) bool {
+		s.LastScrub = start
+		return true
+	}); err != nil {
+		return err
+	}
+
+	if err != nil {
+		return err
+	}
+
+	slog.Info("scrubbed blobs", "checked", checked, "corrupted", corrupted, "duration", time.Since(start))
+	return nil
+}
+
+// hashFile returns the digest of the file at p, reading at most rate bytes
+// per second if rate is not zero.
+func hashFile(ctx context.Context, p string, rate uint64) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	b := make([]byte, 1<<20)
+	start := time.Now()
+
+	var n int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+
+		m, err := f.Read(b)
+		h.Write(b[:m])
+		n += int64(m)
+
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return "", err
+		}
+
+		if rate > 0 {
+			if d := time.Duration(float64(n)/float64(rate)*float64(time.Second)) - time.Since(start); d > 0 {
+				select {
+				case <-ctx.Done():
+					return "", ctx.Err()
+				case <-time.After(d):
+				}
+			}
+		}
+	}
+
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/fs/ggml"
+)
+
+func TestScrubBlobs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	var s Server
+	_, digest := createBinFile(t, ggml.KV{"general.architecture": "test"}, nil)
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Files: map[string]string{"model.gguf": digest},
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	health := func() api.StorageHealthResponse {
+		t.Helper()
+		w := createRequest(t, s.StorageHealthHandler, nil)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp api.StorageHealthResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		return resp
+	}
+
+	resp := health()
+	assert.Equal(t, "ok", resp.Status)
+	assert.Nil(t, resp.LastScrub)
+
+	require.NoError(t, scrubBlobs(t.Context(), 0))
+
+	resp = health()
+	assert.Equal(t, "ok", resp.Status)
+	assert.NotNil(t, resp.LastScrub)
+	assert.Empty(t, resp.Corrupted)
+
+	p, err := GetBlobsPath(digest)
+	require.NoError(t, err)
+	blob, err := os.ReadFile(p)
+	require.NoError(t, err)
+
+	corrupted := append([]byte(nil), blob...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	require.NoError(t, os.WriteFile(p, corrupted, 0o644))
+
+	require.NoError(t, scrubBlobs(t.Context(), 0))
+	assert.True(t, isCorrupted(digest))
+
+	resp = health()
+	assert.Equal(t, "corrupted", resp.Status)
+	require.Len(t, resp.Corrupted, 1)
+	assert.Equal(t, digest, resp.Corrupted[0].Digest)
+	assert.NotEqual(t, digest, resp.Corrupted[0].Actual)
+	assert.Equal(t, []string{"test:latest"}, resp.Corrupted[0].Models)
+
+	// a blob that matches again, e.g. after being replaced, is unmarked
+	require.NoError(t, os.WriteFile(p, blob, 0o644))
+	require.NoError(t, scrubBlobs(t.Context(), 0))
+	assert.False(t, isCorrupted(digest))
+	assert.Equal(t, "ok", health().Status)
+}
+
+func TestScrubBlobsRunning(t *testing.T) {
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	scrubbing.Store(true)
+	defer scrubbing.Store(false)
+
+	require.ErrorIs(t, scrubBlobs(t.Context(), 0), errScrubRunning)
+}
+
+func TestRunScrubber(t *testing.T) {
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	done := make(chan struct{})
+	go func() {
+		runScrubber(t.Context())
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected scrubbing to be disabled by default")
+	}
+
+	t.Setenv("GOOBLA_SCRUB_INTERVAL", "1h")
+	defer func(d time.Duration) { scrubDelay = d }(scrubDelay)
+	scrubDelay = 200 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(t.Context())
+	stopped := make(chan struct{})
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	start := time.Now()
+	go func() {
+		runScrubber(ctx)
+		close(stopped)
+	}()
+
+	var s scrubState
+	require.Eventually(t, func() bool {
+		var err error
+		s, err = readScrubState()
+		return err == nil && !s.LastScrub.IsZero()
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.GreaterOrEqual(t, s.LastScrub.Sub(start), scrubDelay, "expected the first scrub to be delayed")
+}
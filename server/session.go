@@ -0,0 +1,257 @@
+package server
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/envconfig"
+	"github.com/goobla/goobla/format"
+)
+
+// A chat request with a session_id has the runner save the KV cache of the
+// conversation to a file when it is done, and restore it for the next
+// request of the session, so its history isn't evaluated again after the
+// model is unloaded or the server restarts.
+//
+// Caches that haven't been used for GOOBLA_SESSION_TTL are removed, as are
+// the least recently used ones once they take more than
+// GOOBLA_SESSION_MAX_SIZE. They also count against GOOBLA_MAX_DISK, and are
+// removed before any model to stay within it since they can be rebuilt.
+
+// defaultSessionMaxSize is the size session caches are limited to when
+// GOOBLA_SESSION_MAX_SIZE isn't set.
+const defaultSessionMaxSize = 10 * format.GigaByte
+
+// sessionsMu serializes pruning the session caches.
+var sessionsMu sync.Mutex
+
+func sessionsDir() (string, error) {
+	dir, err := envconfig.Models()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "sessions"), nil
+}
+
+// sessionPrefix returns the prefix of the names of the cache files of the
+// session id of user, which has one for each model it was used with.
+func sessionPrefix(user, id string) string {
+	sum := sha256.Sum256([]byte(user + "\x00" + id))
+	return hex.EncodeToString(sum[:16]) + "-"
+}
+
+// sessionPath returns the path of the file holding the KV cache of the
+// session id of user with the model m, creating its directory. Sessions
+// are kept apart for each user and for each model and its adapters, as a
+// cache from one can't be used with another.
+func sessionPath(user string, m *Model, id string) (string, error) {
+	dir, err := sessionsDir()
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	for _, s := range append([]string{m.ModelPath}, m.AdapterPaths...) {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+
+	p := filepath.Join(dir, sessionPrefix(user, id)+hex.EncodeToString(h.Sum(nil)[:16]))
+
+	// the cache is only written when it changes, so record its use to
+	// keep it from expiring while the session is still active
+	now := time.Now()
+	if err := os.Chtimes(p, now, now); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
+	if err := pruneSessions(maxSessionsSize()); err != nil {
+		slog.Warn("couldn't prune session caches", "error", err)
+	}
+
+	return p, nil
+}
+
+// removeSessionCaches removes the caches of the session id of user for every
+// model.
+func removeSessionCaches(user, id string) error {
+	dir, err := sessionsDir()
+	if err != nil {
+		return err
+	}
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	matches, err := filepath.Glob(filepath.Join(dir, sessionPrefix(user, id)+"*"))
+	if err != nil {
+		return err
+	}
+
+	for _, p := range matches {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// maxSessionsSize returns the size session caches are limited to by
+// GOOBLA_SESSION_MAX_SIZE.
+func maxSessionsSize() int64 {
+	s := envconfig.SessionMaxSize()
+	if s == "" {
+		return defaultSessionMaxSize
+	}
+
+	n, err := format.ParseBytes(s)
+	if err != nil {
+		slog.Warn("invalid GOOBLA_SESSION_MAX_SIZE, using the default", "error", err)
+		return defaultSessionMaxSize
+	}
+
+	return n
+}
+
+type sessionCache struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// sessionCaches returns the session cache files, including those being
+// written.
+func sessionCaches() ([]sessionCache, error) {
+	dir, err := sessionsDir()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var caches []sessionCache
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+
+		fi, err := e.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		caches = append(caches, sessionCache{path: filepath.Join(dir, e.Name()), size: fi.Size(), modTime: fi.ModTime()})
+	}
+
+	return caches, nil
+}
+
+// sessionsSize returns the size of the session caches.
+func sessionsSize() int64 {
+	caches, err := sessionCaches()
+	if err != nil {
+		slog.Warn("couldn't list session caches", "error", err)
+	}
+
+	var size int64
+	for _, c := range caches {
+		size += c.size
+	}
+	return size
+}
+
+// pruneSessions removes the session caches that have expired, and then the
+// least recently used ones until they take at most maxSize.
+func pruneSessions(maxSize int64) error {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	caches, err := sessionCaches()
+	if err != nil {
+		return err
+	}
+
+	slices.SortFunc(caches, func(a, b sessionCache) int {
+		return cmp.Or(a.modTime.Compare(b.modTime), strings.Compare(a.path, b.path))
+	})
+
+	var size int64
+	for _, c := range caches {
+		size += c.size
+	}
+
+	ttl := envconfig.SessionTTL()
+	for _, c := range caches {
+		expired := ttl > 0 && time.Since(c.modTime) > ttl
+		if !expired && size <= maxSize {
+			break
+		}
+
+		// caches still being written are left to the runner
+		if !expired && strings.HasSuffix(c.path, ".tmp") {
+			continue
+		}
+
+		if err := os.Remove(c.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+
+		slog.Debug("removed session cache", "path", c.path, "expired", expired)
+		size -= c.size
+	}
+
+	return nil
+}
+
+// DeleteChatSessionHandler removes the saved caches of a chat session, for
+// every model it was used with.
+func (s *Server) DeleteChatSessionHandler(c *gin.Context) {
+	var r api.DeleteChatSessionRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if r.SessionID == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "session_id is required"})
+		return
+	}
+
+	if err := removeSessionCaches(requestUser(c), r.SessionID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+)
+
+func TestSessionPath(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("GOOBLA_MODELS", dir)
+
+	m := &Model{ModelPath: "/blobs/sha256-a"}
+	p, err := sessionPath("", m, "chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filepath.Dir(p) != filepath.Join(dir, "sessions") {
+		t.Errorf("got %s, want a file in %s", p, filepath.Join(dir, "sessions"))
+	}
+
+	if again, _ := sessionPath("", m, "chat"); again != p {
+		t.Errorf("same session: got %s, want %s", again, p)
+	}
+
+	cases := []struct {
+		name string
+		user string
+		m    *Model
+		id   string
+	}{
+		{"session", "", m, "other"},
+		{"user", "alice", m, "chat"},
+		{"model", "", &Model{ModelPath: "/blobs/sha256-b"}, "chat"},
+		{"adapter", "", &Model{ModelPath: "/blobs/sha256-a", AdapterPaths: []string{"/blobs/sha256-c"}}, "chat"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sessionPath(tt.user, tt.m, tt.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got == p {
+				t.Errorf("shares %s", p)
+			}
+		})
+	}
+}
+
+func TestPruneSessions(t *testing.T) {
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	m := &Model{ModelPath: "/blobs/sha256-a"}
+	now := time.Now()
+	write := func(id string, size int, age time.Duration) string {
+		t.Helper()
+		p, err := sessionPath("", m, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(p, make([]byte, size), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Chtimes(p, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	exists := func(p string) bool {
+		_, err := os.Stat(p)
+		return err == nil
+	}
+
+	t.Run("ttl", func(t *testing.T) {
+		t.Setenv("GOOBLA_SESSION_TTL", "1h")
+
+		old := write("old", 1, 2*time.Hour)
+		recent := write("recent", 1, time.Minute)
+		if err := pruneSessions(maxSessionsSize()); err != nil {
+			t.Fatal(err)
+		}
+
+		if exists(old) || !exists(recent) {
+			t.Errorf("expected only the expired cache to be removed, old %t recent %t", exists(old), exists(recent))
+		}
+	})
+
+	t.Run("size", func(t *testing.T) {
+		a := write("a", 10, 3*time.Minute)
+		b := write("b", 10, 2*time.Minute)
+		c := write("c", 10, time.Minute)
+		if err := pruneSessions(25); err != nil {
+			t.Fatal(err)
+		}
+
+		if exists(a) || !exists(b) || !exists(c) {
+			t.Errorf("expected only the least recently used cache to be removed, a %t b %t c %t", exists(a), exists(b), exists(c))
+		}
+	})
+
+	t.Run("touch", func(t *testing.T) {
+		t.Setenv("GOOBLA_SESSION_TTL", "1h")
+
+		p := write("touched", 1, 2*time.Hour)
+		if _, err := sessionPath("", m, "touched"); err != nil {
+			t.Fatal(err)
+		}
+
+		if !exists(p) {
+			t.Error("expected a cache in use not to expire")
+		}
+	})
+}
+
+func TestDeleteChatSession(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	var caches []string
+	for _, m := range []*Model{{ModelPath: "/blobs/sha256-a"}, {ModelPath: "/blobs/sha256-b"}} {
+		p, err := sessionPath("", m, "chat")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(p, []byte("kv cache"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		caches = append(caches, p)
+	}
+
+	other, err := sessionPath("", &Model{ModelPath: "/blobs/sha256-a"}, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(other, []byte("kv cache"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var s Server
+	if w := createRequest(t, s.DeleteChatSessionHandler, api.DeleteChatSessionRequest{}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status code 400 without a session id, actual %d", w.Code)
+	}
+
+	if w := createRequest(t, s.DeleteChatSessionHandler, api.DeleteChatSessionRequest{SessionID: "chat"}); w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	for _, p := range caches {
+		if _, err := os.Stat(p); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected %s to be deleted, got %v", p, err)
+		}
+	}
+
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("expected another session's cache to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,362 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/types/model"
+)
+
+// Live sessions are chats with a model kept in memory by the server, so each
+// request to /api/sessions/:id/chat only sends its new messages. The KV cache
+// of a session is kept like that of a chat request with a session_id, so its
+// history isn't evaluated again either. Unlike conversations, sessions don't
+// outlive the server: they last until they're closed, or until they've been
+// idle for their idle timeout.
+
+const defaultSessionIdleTimeout = 30 * time.Minute
+
+// sessionContextKey is the live session a chat request is made in.
+const sessionContextKey = "session"
+
+var (
+	errSessionNotFound = errors.New("session not found")
+	errSessionBusy     = errors.New("a request of the session is already in progress")
+)
+
+type liveSession struct {
+	id   string
+	user string
+
+	// model is the name of the session's model, and modelPath its path in
+	// the scheduler
+	model     string
+	modelPath string
+
+	// cache is the file of the session's KV cache
+	cache string
+
+	options     map[string]any
+	idleTimeout time.Duration
+	created     time.Time
+
+	// the fields below are guarded by the mutex of the sessions
+	messages []api.Message
+	lastUsed time.Time
+	// busy is set while a request of the session is in progress, and
+	// closed if the session is closed in the meantime
+	busy   bool
+	closed bool
+}
+
+func (ls *liveSession) expired(now time.Time) bool {
+	return !ls.busy && now.Sub(ls.lastUsed) >= ls.idleTimeout
+}
+
+func (ls *liveSession) info() api.Session {
+	return api.Session{
+		ID:         ls.id,
+		Model:      ls.model,
+		Messages:   len(ls.messages),
+		CreatedAt:  ls.created,
+		LastUsedAt: ls.lastUsed,
+		ExpiresAt:  ls.lastUsed.Add(ls.idleTimeout),
+	}
+}
+
+// sessions are the live sessions by id.
+type sessions struct {
+	mu       sync.Mutex
+	sessions map[string]*liveSession
+}
+
+// create creates a session for user with the model m, named name.
+func (ss *sessions) create(user, name string, m *Model, r api.SessionRequest) (*liveSession, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(b)
+
+	cache, err := sessionPath(user, m, "session:"+id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	ls := &liveSession{
+		id:          id,
+		user:        user,
+		model:       name,
+		modelPath:   m.ModelPath,
+		cache:       cache,
+		options:     r.Options,
+		idleTimeout: defaultSessionIdleTimeout,
+		created:     now,
+		lastUsed:    now,
+	}
+
+	if r.IdleTimeout != nil && r.IdleTimeout.Duration > 0 {
+		ls.idleTimeout = r.IdleTimeout.Duration
+	}
+
+	if r.System != "" {
+		ls.messages = []api.Message{{Role: "system", Content: r.System}}
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if ss.sessions == nil {
+		ss.sessions = make(map[string]*liveSession)
+	}
+	ss.sessions[id] = ls
+	return ls, nil
+}
+
+// evictLocked closes the sessions that have been idle for their idle
+// timeout. ss.mu must be held.
+func (ss *sessions) evictLocked(now time.Time) {
+	for id, ls := range ss.sessions {
+		if ls.expired(now) {
+			slog.Debug("closing idle session", "session", id, "model", ls.model)
+			delete(ss.sessions, id)
+			removeSessionCache(ls)
+		}
+	}
+}
+
+// acquire returns the session id of user for a request, which must release
+// it once it's done.
+func (ss *sessions) acquire(user, id string) (*liveSession, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.evictLocked(time.Now())
+
+	ls, ok := ss.sessions[id]
+	if !ok || ls.user != user {
+		return nil, errSessionNotFound
+	}
+
+	if ls.busy {
+		return nil, errSessionBusy
+	}
+
+	ls.busy = true
+	return ls, nil
+}
+
+func (ss *sessions) release(ls *liveSession) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ls.busy = false
+	ls.lastUsed = time.Now().UTC()
+	if ls.closed {
+		removeSessionCache(ls)
+	}
+}
+
+// history returns the messages of the session ls.
+func (ss *sessions) history(ls *liveSession) []api.Message {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	return slices.Clone(ls.messages)
+}
+
+// add adds msgs to the end of the history of the session ls.
+func (ss *sessions) add(ls *liveSession, msgs []api.Message) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ls.messages = append(ls.messages, msgs...)
+}
+
+// close closes the session id of user. The KV cache of a session with a
+// request in progress is removed once the request is done.
+func (ss *sessions) close(user, id string) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ls, ok := ss.sessions[id]
+	if !ok || ls.user != user {
+		return errSessionNotFound
+	}
+
+	delete(ss.sessions, id)
+	if ls.busy {
+		ls.closed = true
+	} else {
+		removeSessionCache(ls)
+	}
+	return nil
+}
+
+// closeAll closes every session, once the runners have been stopped.
+func (ss *sessions) closeAll() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	for id, ls := range ss.sessions {
+		delete(ss.sessions, id)
+		removeSessionCache(ls)
+	}
+}
+
+// list returns the sessions of user, most recently used first.
+func (ss *sessions) list(user string) []api.Session {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.evictLocked(time.Now())
+
+	list := []api.Session{}
+	for _, ls := range ss.sessions {
+		if ls.user == user {
+			list = append(list, ls.info())
+		}
+	}
+
+	slices.SortFunc(list, func(a, b api.Session) int {
+		return cmp.Or(b.LastUsedAt.Compare(a.LastUsedAt), cmp.Compare(a.ID, b.ID))
+	})
+	return list
+}
+
+// count returns the number of live sessions with the model at path.
+func (ss *sessions) count(path string) int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	var n int
+	for _, ls := range ss.sessions {
+		if ls.modelPath == path && !ls.expired(time.Now()) {
+			n++
+		}
+	}
+	return n
+}
+
+// run closes idle sessions until ctx is done.
+func (ss *sessions) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			ss.mu.Lock()
+			ss.evictLocked(now)
+			ss.mu.Unlock()
+		}
+	}
+}
+
+func removeSessionCache(ls *liveSession) {
+	if err := os.Remove(ls.cache); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Warn("failed to remove the cache of a session", "session", ls.id, "error", err)
+	}
+}
+
+func (s *Server) CreateSessionHandler(c *gin.Context) {
+	var r api.SessionRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name := model.ParseName(r.Model)
+	if !name.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+
+	name, err := getExistingName(name)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !checkRead(c, name) {
+		return
+	}
+
+	m, err := GetModel(name.String())
+	if errors.Is(err, os.ErrNotExist) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found", r.Model)})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := modelOptions(m, r.Options); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ls, err := s.sessions.create(requestUser(c), name.DisplayShortest(), m, r)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, ls.info())
+}
+
+func (s *Server) ListSessionsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, api.ListSessionsResponse{Sessions: s.sessions.list(requestUser(c))})
+}
+
+// SessionChatHandler handles a chat request of a live session, which only
+// has the new messages of the chat.
+func (s *Server) SessionChatHandler(c *gin.Context) {
+	ls, err := s.sessions.acquire(requestUser(c), c.Param("id"))
+	if err != nil {
+		handleSessionError(c, err)
+		return
+	}
+	defer s.sessions.release(ls)
+
+	c.Set(sessionContextKey, ls)
+	s.ChatHandler(c)
+}
+
+func (s *Server) CloseSessionHandler(c *gin.Context) {
+	if err := s.sessions.close(requestUser(c), c.Param("id")); err != nil {
+		handleSessionError(c, err)
+	}
+}
+
+func handleSessionError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errSessionNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("session '%s' not found", c.Param("id"))})
+	case errors.Is(err, errSessionBusy):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
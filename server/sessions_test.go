@@ -0,0 +1,88 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/goobla/goobla/api"
+)
+
+func TestSessions(t *testing.T) {
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	var ss sessions
+	m := &Model{ModelPath: "/models/test"}
+
+	ls, err := ss.create("alice", "test", m, api.SessionRequest{System: "Be brief."})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ss.create("bob", "test", m, api.SessionRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := ss.count(m.ModelPath); n != 2 {
+		t.Errorf("expected 2 sessions with the model, got %d", n)
+	}
+
+	if _, err := ss.acquire("bob", ls.id); !errors.Is(err, errSessionNotFound) {
+		t.Errorf("expected another user's session not to be found, got %v", err)
+	}
+
+	if _, err := ss.acquire("alice", ls.id); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ss.acquire("alice", ls.id); !errors.Is(err, errSessionBusy) {
+		t.Errorf("expected the session to be busy, got %v", err)
+	}
+
+	ss.add(ls, []api.Message{{Role: "user", Content: "Hello!"}, {Role: "assistant", Content: "Hi!"}})
+	if h := ss.history(ls); len(h) != 3 || h[0].Role != "system" {
+		t.Errorf("unexpected history %+v", h)
+	}
+
+	// a session closed during a request keeps its cache until it's done
+	if err := os.WriteFile(ls.cache, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ss.close("alice", ls.id); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(ls.cache); err != nil {
+		t.Errorf("expected the cache to be kept during the request, got %v", err)
+	}
+
+	ss.release(ls)
+	if _, err := os.Stat(ls.cache); !os.IsNotExist(err) {
+		t.Errorf("expected the cache to be removed, got %v", err)
+	}
+
+	if list := ss.list("alice"); len(list) != 0 {
+		t.Errorf("expected no sessions, got %+v", list)
+	}
+
+	t.Run("idle", func(t *testing.T) {
+		ls, err := ss.create("alice", "test", m, api.SessionRequest{IdleTimeout: &api.Duration{Duration: time.Minute}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if list := ss.list("alice"); len(list) != 1 || !list[0].ExpiresAt.Equal(list[0].LastUsedAt.Add(time.Minute)) {
+			t.Errorf("unexpected sessions %+v", list)
+		}
+
+		ss.mu.Lock()
+		ls.lastUsed = ls.lastUsed.Add(-time.Hour)
+		ss.mu.Unlock()
+
+		if _, err := ss.acquire("alice", ls.id); !errors.Is(err, errSessionNotFound) {
+			t.Errorf("expected an idle session to be closed, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,429 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/envconfig"
+	"github.com/goobla/goobla/types/model"
+)
+
+// Models are signed with the private key in GOOBLA_SIGNING_KEY, which is
+// kept apart from the key the server uses to authenticate with the registry
+// so that key can't be used to sign models trusted elsewhere. Models can only
+// be signed by requests from the server's machine. A signature covers the
+// digests of the model's config and layers, so it stays valid when the model
+// is copied, renamed or pulled from a mirror.
+//
+// Like cosign, signatures are stored in the registry next to the model as a
+// manifest tagged sha256-<manifest digest>.sig, whose config blob holds the
+// signatures. Locally they are stored in the signatures directory of the
+// models directory, keyed by the digest of the signed content.
+
+const mediaTypeSignatures = "application/vnd.goobla.image.signatures+json"
+
+// maxSignaturesSize limits the size of the signatures blob read from a
+// registry.
+const maxSignaturesSize = 1 << 20
+
+var (
+	errUnsignedModel    = errors.New("model is not signed by a trusted key")
+	errInvalidSignature = errors.New("invalid signature")
+	errNoSigningKey     = errors.New("GOOBLA_SIGNING_KEY isn't set")
+)
+
+// Signature is a detached signature of a model.
+type Signature struct {
+	// Key is the base64 encoded public key, as in an authorized_keys file.
+	Key string `json:"key"`
+	// Signature is the base64 encoded signature of the model's content.
+	Signature string `json:"signature"`
+}
+
+// signedContent returns the bytes signed for m.
+func signedContent(m *Manifest) ([]byte, error) {
+	layers := make([]string, len(m.Layers))
+	for i, l := range m.Layers {
+		layers[i] = l.Digest
+	}
+
+	return json.Marshal(struct {
+		Config string   `json:"config"`
+		Layers []string `json:"layers"`
+	}{m.Config.Digest, layers})
+}
+
+// signatureTag returns the tag of the signatures for the manifest with the
+// given digest.
+func signatureTag(digest string) string {
+	return "sha256-" + strings.TrimPrefix(digest, "sha256:") + ".sig"
+}
+
+// signaturesFile returns the path to the signatures of m in the models
+// directory dir.
+func signaturesFile(dir string, m *Manifest) (string, error) {
+	b, err := signedContent(m)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "signatures", fmt.Sprintf("sha256-%x", sha256.Sum256(b))), nil
+}
+
+// readSignatures returns the local signatures of m, if any.
+func readSignatures(m *Manifest) ([]Signature, error) {
+	dirs, err := envconfig.ModelsDirs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dir := range slices.Backward(dirs) {
+		p, err := signaturesFile(dir, m)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := os.ReadFile(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		var sigs []Signature
+		if err := json.Unmarshal(b, &sigs); err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		return sigs, nil
+	}
+
+	return nil, nil
+}
+
+// writeSignatures replaces the local signatures of m.
+func writeSignatures(m *Manifest, sigs []Signature) error {
+	dir, err := envconfig.Models()
+	if err != nil {
+		return err
+	}
+
+	p, err := signaturesFile(dir, m)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(sigs)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(p, b, 0o644)
+}
+
+// signingKey returns the signer of the private key in GOOBLA_SIGNING_KEY.
+func signingKey() (ssh.Signer, error) {
+	p := envconfig.SigningKey()
+	if p == "" {
+		return nil, errNoSigningKey
+	}
+
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+
+	return signer, nil
+}
+
+// signModel signs m with the signing key, adding the signature to those
+// stored locally. It returns the public key that signed the model in
+// authorized_keys format.
+func signModel(m *Manifest) (string, error) {
+	signer, err := signingKey()
+	if err != nil {
+		return "", err
+	}
+
+	b, err := signedContent(m)
+	if err != nil {
+		return "", err
+	}
+
+	sig, err := signer.Sign(rand.Reader, b)
+	if err != nil {
+		return "", err
+	}
+
+	key := base64.StdEncoding.EncodeToString(signer.PublicKey().Marshal())
+
+	sigs, err := readSignatures(m)
+	if err != nil {
+		return "", err
+	}
+
+	sigs = slices.DeleteFunc(sigs, func(s Signature) bool { return s.Key == key })
+	sigs = append(sigs, Signature{Key: key, Signature: base64.StdEncoding.EncodeToString(sig.Blob)})
+	if err := writeSignatures(m, sigs); err != nil {
+		return "", err
+	}
+
+	return string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(signer.PublicKey()))), nil
+}
+
+// verify checks that s is a valid signature of content.
+func (s Signature) verify(content []byte) error {
+	b, err := base64.StdEncoding.DecodeString(s.Key)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidSignature, err)
+	}
+
+	key, err := ssh.ParsePublicKey(b)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidSignature, err)
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(s.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidSignature, err)
+	}
+
+	if err := key.Verify(content, &ssh.Signature{Format: key.Type(), Blob: blob}); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidSignature, err)
+	}
+
+	return nil
+}
+
+// trustedKeys returns the keys listed in the trusted keys file, which uses
+// the format of OpenSSH's authorized_keys, keyed by the base64 encoded key.
+func trustedKeys() (map[string]bool, error) {
+	p := envconfig.TrustedKeys()
+	b, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; scanner.Scan(); line++ {
+		if s := strings.TrimSpace(scanner.Text()); s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+
+		key, _, _, _, err := ssh.ParseAuthorizedKey(scanner.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", p, line, err)
+		}
+
+		keys[base64.StdEncoding.EncodeToString(key.Marshal())] = true
+	}
+
+	return keys, nil
+}
+
+// verifySignatures checks sigs against m, returning those that are valid. An
+// invalid signature from a trusted key is an error, as is a model without a
+// signature from a trusted key if signed models are required.
+func verifySignatures(m *Manifest, sigs []Signature) ([]Signature, error) {
+	content, err := signedContent(m)
+	if err != nil {
+		return nil, err
+	}
+
+	trusted, err := trustedKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	var valid []Signature
+	var verified bool
+	for _, s := range sigs {
+		if err := s.verify(content); err != nil {
+			if trusted[s.Key] {
+				return nil, err
+			}
+
+			slog.Warn("ignoring invalid signature", "key", s.Key, "error", err)
+			continue
+		}
+
+		valid = append(valid, s)
+		verified = verified || trusted[s.Key]
+	}
+
+	if !verified && envconfig.RequireSignedModels() {
+		return nil, errUnsignedModel
+	}
+
+	return valid, nil
+}
+
+// pullSignatures returns the verified signatures of m, which was pulled from
+// mp.
+func pullSignatures(ctx context.Context, mp ModelPath, m *Manifest, regOpts *registryOptions) ([]Signature, error) {
+	sp := mp
+	sp.Tag = signatureTag(m.digest)
+
+	var sigs []Signature
+	sm, err := pullModelManifest(ctx, sp, regOpts)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		// registries that don't know the tag may fail in other ways
+		slog.Warn("couldn't pull signatures", "model", mp.GetShortTagname(), "error", err)
+	case sm.Config.MediaType != mediaTypeSignatures:
+		slog.Warn("ignoring signatures with unknown media type", "model", mp.GetShortTagname(), "mediaType", sm.Config.MediaType)
+	default:
+		resp, err := makeRequestWithRetry(ctx, http.MethodGet, blobURL(sp, sm.Config.Digest, regOpts), nil, nil, regOpts)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		b, err := io.ReadAll(io.LimitReader(resp.Body, maxSignaturesSize))
+		if err != nil {
+			return nil, err
+		}
+
+		if digest := fmt.Sprintf("sha256:%x", sha256.Sum256(b)); digest != sm.Config.Digest {
+			return nil, fmt.Errorf("%w: signatures have digest %s, expected %s", errDigestMismatch, digest, sm.Config.Digest)
+		}
+
+		if err := json.Unmarshal(b, &sigs); err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidSignature, err)
+		}
+	}
+
+	return verifySignatures(m, sigs)
+}
+
+// pushSignatures pushes the local signatures of m to mp's registry, next to
+// the manifest with the given digest.
+func pushSignatures(ctx context.Context, mp ModelPath, m *Manifest, digest, contentType string, regOpts *registryOptions, fn func(api.ProgressResponse)) error {
+	sigs, err := readSignatures(m)
+	if err != nil || len(sigs) == 0 {
+		return err
+	}
+
+	fn(api.ProgressResponse{Status: "pushing signatures"})
+
+	b, err := json.Marshal(sigs)
+	if err != nil {
+		return err
+	}
+
+	layer, err := NewLayer(bytes.NewReader(b), mediaTypeSignatures)
+	if err != nil {
+		return err
+	}
+
+	if err := uploadBlob(ctx, mp, layer, regOpts, fn); err != nil {
+		return err
+	}
+
+	sm, err := json.Marshal(Manifest{
+		SchemaVersion: 2,
+		MediaType:     contentType,
+		Config:        layer,
+		Layers:        []Layer{},
+	})
+	if err != nil {
+		return err
+	}
+
+	sp := mp
+	sp.Tag = signatureTag(digest)
+
+	headers := make(http.Header)
+	headers.Set("Content-Type", contentType)
+	resp, err := makeRequestWithRetry(ctx, http.MethodPut, manifestURL(sp, regOpts), headers, bytes.NewReader(sm), regOpts)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return nil
+}
+
+func (s *Server) SignHandler(c *gin.Context) {
+	// a model signed by anyone who can reach the server would be trusted
+	// by every server that trusts its key
+	if !isLocalRequest(c.Request) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "models can only be signed on the server's machine"})
+		return
+	}
+
+	var r api.SignRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	n := model.ParseName(r.Model)
+	if !n.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("name %q is invalid", r.Model)})
+		return
+	}
+
+	n, err := getExistingName(n)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !checkRead(c, n) {
+		return
+	}
+
+	m, err := ParseNamedManifest(n)
+	if errors.Is(err, os.ErrNotExist) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found", r.Model)})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	key, err := signModel(m)
+	if errors.Is(err, errNoSigningKey) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "set GOOBLA_SIGNING_KEY to the path of a private key to sign models"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.SignResponse{PublicKey: key})
+}
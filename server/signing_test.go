@@ -0,0 +1,242 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/fs/ggml"
+	"github.com/goobla/goobla/server/internal/client/goobla"
+	"github.com/goobla/goobla/types/model"
+)
+
+// writeTrustedKeys writes a trusted keys file listing keys.
+func writeTrustedKeys(t *testing.T, keys ...ssh.PublicKey) {
+	t.Helper()
+
+	var b bytes.Buffer
+	for _, key := range keys {
+		b.Write(ssh.MarshalAuthorizedKey(key))
+	}
+
+	p := filepath.Join(t.TempDir(), "trusted_keys")
+	require.NoError(t, os.WriteFile(p, b.Bytes(), 0o600))
+	t.Setenv("GOOBLA_TRUSTED_KEYS", p)
+}
+
+func TestSignModel(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	// the server's registry key isn't used to sign models
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	block, err := ssh.MarshalPrivateKey(key, "")
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "signing_key")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(block), 0o600))
+
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+
+	var s Server
+	_, digest := createBinFile(t, ggml.KV{"general.architecture": "test"}, nil)
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Files: map[string]string{"model.gguf": digest},
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	sign := func(remoteAddr string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		b, err := json.Marshal(api.SignRequest{Model: "test"})
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/sign", bytes.NewReader(b))
+		c.Request.RemoteAddr = remoteAddr
+		s.SignHandler(c)
+		return w
+	}
+
+	w = sign("127.0.0.1:1234")
+	require.Equal(t, http.StatusBadRequest, w.Code, "expected an error without a signing key")
+
+	t.Setenv("GOOBLA_SIGNING_KEY", keyPath)
+
+	w = sign("192.0.2.1:1234")
+	require.Equal(t, http.StatusForbidden, w.Code, "expected remote requests not to sign models")
+
+	w = sign("127.0.0.1:1234")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp api.SignResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(signer.PublicKey()))), resp.PublicKey)
+
+	// signing again replaces the signature
+	w = sign("[::1]:1234")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	m, err := ParseNamedManifest(model.ParseName("test"))
+	require.NoError(t, err)
+
+	sigs, err := readSignatures(m)
+	require.NoError(t, err)
+	require.Len(t, sigs, 1)
+
+	// copies share the signatures of the original
+	require.NoError(t, CopyModel(model.ParseName("test"), model.ParseName("copy")))
+	c, err := ParseNamedManifest(model.ParseName("copy"))
+	require.NoError(t, err)
+	copied, err := readSignatures(c)
+	require.NoError(t, err)
+	assert.Equal(t, sigs, copied)
+
+	t.Run("untrusted", func(t *testing.T) {
+		writeTrustedKeys(t)
+
+		valid, err := verifySignatures(m, sigs)
+		require.NoError(t, err)
+		assert.Len(t, valid, 1)
+
+		t.Setenv("GOOBLA_REQUIRE_SIGNED_MODELS", "1")
+		_, err = verifySignatures(m, sigs)
+		assert.ErrorIs(t, err, errUnsignedModel)
+	})
+
+	t.Run("trusted", func(t *testing.T) {
+		writeTrustedKeys(t, signer.PublicKey())
+		t.Setenv("GOOBLA_REQUIRE_SIGNED_MODELS", "1")
+
+		valid, err := verifySignatures(m, sigs)
+		require.NoError(t, err)
+		assert.Len(t, valid, 1)
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		writeTrustedKeys(t, signer.PublicKey())
+
+		sig, err := signer.Sign(rand.Reader, []byte("something else"))
+		require.NoError(t, err)
+
+		tampered := []Signature{{Key: sigs[0].Key, Signature: base64.StdEncoding.EncodeToString(sig.Blob)}}
+		_, err = verifySignatures(m, tampered)
+		assert.ErrorIs(t, err, errInvalidSignature)
+	})
+}
+
+func TestPullSignedModel(t *testing.T) {
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+	t.Setenv("GOOBLA_REQUIRE_SIGNED_MODELS", "1")
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	writeTrustedKeys(t, signer.PublicKey())
+
+	blob, digest := testBlob("model weights")
+	m := Manifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeDockerManifest,
+		Layers:        []Layer{{MediaType: "application/vnd.goobla.image.model", Digest: digest, Size: int64(len(blob))}},
+	}
+	manifest, err := json.Marshal(m)
+	require.NoError(t, err)
+	manifestDigest := fmt.Sprintf("%x", sha256.Sum256(manifest))
+
+	content, err := signedContent(&m)
+	require.NoError(t, err)
+	sig, err := signer.Sign(rand.Reader, content)
+	require.NoError(t, err)
+	sigs, err := json.Marshal([]Signature{{
+		Key:       base64.StdEncoding.EncodeToString(signer.PublicKey().Marshal()),
+		Signature: base64.StdEncoding.EncodeToString(sig.Blob),
+	}})
+	require.NoError(t, err)
+	sigsDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(sigs))
+	sigsManifest, err := json.Marshal(Manifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeDockerManifest,
+		Config:        Layer{MediaType: mediaTypeSignatures, Digest: sigsDigest, Size: int64(len(sigs))},
+		Layers:        []Layer{},
+	})
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		responses := map[string][]byte{
+			"/v2/ns/signed/blobs/" + digest:                             blob,
+			"/v2/ns/signed/blobs/" + sigsDigest:                         sigs,
+			"/v2/ns/unsigned/blobs/" + digest:                           blob,
+			"/v2/ns/signed/manifests/latest":                            manifest,
+			"/v2/ns/unsigned/manifests/latest":                          manifest,
+			"/v2/ns/signed/manifests/sha256-" + manifestDigest + ".sig": sigsManifest,
+		}
+
+		b, ok := responses[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		if r.Method == http.MethodHead {
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+	}))
+	defer srv.Close()
+
+	name := "http://" + srv.Listener.Addr().String() + "/ns/signed"
+	require.NoError(t, PullModel(t.Context(), name, &registryOptions{Insecure: true}, func(api.ProgressResponse) {}))
+
+	local, err := ParseNamedManifest(model.ParseName(name))
+	require.NoError(t, err)
+	got, err := readSignatures(local)
+	require.NoError(t, err)
+	assert.Len(t, got, 1)
+
+	name = "http://" + srv.Listener.Addr().String() + "/ns/unsigned"
+	err = PullModel(t.Context(), name, &registryOptions{Insecure: true}, func(api.ProgressResponse) {})
+	require.ErrorIs(t, err, errUnsignedModel)
+
+	_, err = ParseNamedManifest(model.ParseName(name))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestRequireSignedModelsRoutes(t *testing.T) {
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	rc := &goobla.Registry{HTTPClient: panicOnRoundTrip}
+	require.True(t, useRegistryClient(rc), "expected the new registry client to handle pulls")
+
+	// the new registry client doesn't verify signatures, so it can't pull
+	// when they're required
+	t.Setenv("GOOBLA_REQUIRE_SIGNED_MODELS", "1")
+	assert.False(t, useRegistryClient(rc), "expected pulls not to use the new registry client")
+}
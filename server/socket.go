@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/goobla/goobla/envconfig"
+)
+
+// socketListener accepts connections to a unix socket from the peers allowed
+// by GOOBLA_SOCKET_UIDS and GOOBLA_SOCKET_GIDS, closing the others.
+type socketListener struct {
+	*net.UnixListener
+	uids, gids []uint32
+}
+
+func (l *socketListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(l.uids) == 0 && len(l.gids) == 0 {
+			return conn, nil
+		}
+
+		uid, gid, err := peerCredentials(conn)
+		if err != nil {
+			slog.Warn("couldn't get the credentials of a socket peer", "error", err)
+		} else if slices.Contains(l.uids, uid) || slices.Contains(l.gids, gid) {
+			return conn, nil
+		} else {
+			slog.Warn("refused a socket peer", "uid", uid, "gid", gid)
+		}
+
+		conn.Close()
+	}
+}
+
+func parseIDs(name string, values []string) ([]uint32, error) {
+	var ids []uint32
+	for _, v := range values {
+		id, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid id %q", name, v)
+		}
+		ids = append(ids, uint32(id))
+	}
+	return ids, nil
+}
+
+// ListenUnix listens on the unix socket path, replacing the socket of a
+// server that's no longer running. With GOOBLA_SOCKET_UIDS or
+// GOOBLA_SOCKET_GIDS set, the socket can be connected to by any user but only
+// the connections of those users and groups are accepted.
+func ListenUnix(path string) (net.Listener, error) {
+	uids, err := parseIDs("GOOBLA_SOCKET_UIDS", envconfig.SocketUIDs())
+	if err != nil {
+		return nil, err
+	}
+
+	gids, err := parseIDs("GOOBLA_SOCKET_GIDS", envconfig.SocketGIDs())
+	if err != nil {
+		return nil, err
+	}
+
+	if fi, err := os.Lstat(path); err == nil && fi.Mode().Type() == fs.ModeSocket {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s: another server is listening on the socket", path)
+		}
+
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(uids) > 0 || len(gids) > 0 {
+		if err := os.Chmod(path, 0o666); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+
+	return &socketListener{UnixListener: ln, uids: uids, gids: gids}, nil
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/goobla/goobla/api"
+)
+
+func TestListenUnix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets aren't tested on windows")
+	}
+
+	// socket paths are limited to around 100 bytes, which t.TempDir may
+	// exceed
+	dir, err := os.MkdirTemp("", "goobla")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "goobla.sock")
+	t.Setenv("GOOBLA_HOST", "unix://"+path)
+
+	serve := func(t *testing.T) func() {
+		t.Helper()
+		ln, err := ListenUnix(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"version":"0.0.0"}`))
+		})}
+		go srv.Serve(ln)
+		return func() { srv.Close() }
+	}
+
+	version := func(t *testing.T) error {
+		t.Helper()
+		client, err := api.ClientFromEnvironment()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = client.Version(t.Context())
+		return err
+	}
+
+	t.Run("connect", func(t *testing.T) {
+		stop := serve(t)
+		defer stop()
+
+		if err := version(t); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := ListenUnix(path); err == nil {
+			t.Error("expected an error listening on a socket in use")
+		}
+	})
+
+	t.Run("stale socket", func(t *testing.T) {
+		ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln.SetUnlinkOnClose(false)
+		ln.Close()
+
+		stop := serve(t)
+		defer stop()
+
+		if err := version(t); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("allowed user", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("peer credentials are only supported on linux")
+		}
+
+		t.Setenv("GOOBLA_SOCKET_UIDS", strconv.Itoa(os.Getuid()))
+		stop := serve(t)
+		defer stop()
+
+		if err := version(t); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("refused user", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("peer credentials are only supported on linux")
+		}
+
+		t.Setenv("GOOBLA_SOCKET_UIDS", strconv.Itoa(os.Getuid()+1))
+		t.Setenv("GOOBLA_SOCKET_GIDS", strconv.Itoa(os.Getgid()+1))
+		stop := serve(t)
+		defer stop()
+
+		if err := version(t); err == nil {
+			t.Fatal("expected the connection to be refused")
+		}
+	})
+
+	t.Run("invalid ids", func(t *testing.T) {
+		t.Setenv("GOOBLA_SOCKET_UIDS", "root")
+		if _, err := ListenUnix(path); err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
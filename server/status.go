@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/types/model"
+)
+
+// /api/status streams a summary of what the server is doing, for indicators
+// such as the app's tray icon. The status is sent when the request is made and
+// again whenever it changes, so clients don't need to poll /api/ps.
+
+const (
+	statusIdle        = "idle"
+	statusGenerating  = "generating"
+	statusDownloading = "downloading"
+	statusError       = "error"
+
+	// statusInterval is how often the status is checked for changes.
+	statusInterval = time.Second
+)
+
+func (s *Server) StatusHandler(c *gin.Context) {
+	user := requestUser(c)
+	ctx := c.Request.Context()
+
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
+
+		var last api.StatusResponse
+		for first := true; ; first = false {
+			if status := s.status(user); first || !reflect.DeepEqual(status, last) {
+				select {
+				case ch <- status:
+				case <-ctx.Done():
+					return
+				}
+				last = status
+			}
+
+			select {
+			case <-time.After(statusInterval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	streamResponse(c, ch)
+}
+
+// status returns the status of the server as seen by user, who only sees the
+// models they can read. A GPU that's gone missing takes precedence over a
+// model generating, which takes precedence over a model being pulled.
+func (s *Server) status(user string) api.StatusResponse {
+	status := api.StatusResponse{State: statusIdle, Models: []string{}}
+
+	var generating bool
+	s.sched.loadedMu.Lock()
+	for _, r := range s.sched.loaded {
+		r.refMu.Lock()
+		generating = generating || r.refCount > 0
+		r.refMu.Unlock()
+
+		status.VRAM += int64(r.estimatedVRAM)
+		if canRead(user, model.ParseName(r.model.Name)) {
+			status.Models = append(status.Models, r.model.ShortName)
+		}
+	}
+	s.sched.loadedMu.Unlock()
+	slices.Sort(status.Models)
+
+	var missing []string
+	for _, d := range s.sched.deviceStatus() {
+		if d.Status != deviceAvailable {
+			missing = append(missing, fmt.Sprintf("%s GPU %s is %s", d.Library, d.ID, d.Status))
+			continue
+		}
+		status.TotalVRAM += d.TotalVRAM
+	}
+
+	switch {
+	case len(missing) > 0:
+		status.State = statusError
+		status.Message = strings.Join(missing, ", ")
+	case generating:
+		status.State = statusGenerating
+	case s.pulls.Load() > 0:
+		status.State = statusDownloading
+	}
+
+	return status
+}
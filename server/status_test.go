@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/goobla/goobla/api"
+)
+
+func TestStatus(t *testing.T) {
+	s := Server{sched: InitScheduler(t.Context())}
+
+	if status := s.status(""); status.State != statusIdle || len(status.Models) != 0 {
+		t.Errorf("expected the server to be idle, got %+v", status)
+	}
+
+	s.sched.loaded["alice/test"] = &runnerRef{model: &Model{Name: "registry.goobla.ai/alice/test:latest", ShortName: "alice/test"}, estimatedVRAM: 4 << 30}
+	runner := &runnerRef{model: &Model{Name: "registry.goobla.ai/library/test:latest", ShortName: "test"}, estimatedVRAM: 2 << 30}
+	s.sched.loaded["test"] = runner
+	s.sched.devices["cuda-0"] = &api.DeviceStatus{Library: "cuda", ID: "0", Status: deviceAvailable, TotalVRAM: 8 << 30}
+
+	s.pulls.Add(1)
+	status := s.status("")
+	if status.State != statusDownloading || len(status.Models) != 2 || status.Models[0] != "alice/test" || status.VRAM != 6<<30 || status.TotalVRAM != 8<<30 {
+		t.Errorf("expected the server to be downloading, got %+v", status)
+	}
+
+	runner.refCount = 1
+	if status := s.status(""); status.State != statusGenerating {
+		t.Errorf("expected the server to be generating, got %+v", status)
+	}
+
+	s.sched.devices["cuda-1"] = &api.DeviceStatus{Library: "cuda", ID: "1", Status: deviceMissing, TotalVRAM: 8 << 30}
+	if status := s.status(""); status.State != statusError || status.Message != "cuda GPU 1 is missing" || status.TotalVRAM != 8<<30 {
+		t.Errorf("expected the server to have an error, got %+v", status)
+	}
+
+	// other users' models aren't listed
+	p := filepath.Join(t.TempDir(), "authorized_keys")
+	if err := os.WriteFile(p, fmt.Appendf(nil, "%s alice\n", bytes.TrimSpace(ssh.MarshalAuthorizedKey(newTestSigner(t).PublicKey()))), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOOBLA_AUTHORIZED_KEYS", p)
+
+	if status := s.status("bob"); len(status.Models) != 1 || status.Models[0] != "test" {
+		t.Errorf("expected only the library model, got %+v", status.Models)
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := Server{sched: InitScheduler(t.Context())}
+	r := gin.New()
+	r.GET("/api/status", s.StatusHandler)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/status", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	next := func() api.StatusResponse {
+		if !scanner.Scan() {
+			t.Fatalf("expected a status, got %v", scanner.Err())
+		}
+
+		var status api.StatusResponse
+		if err := json.Unmarshal(scanner.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	if status := next(); status.State != statusIdle {
+		t.Errorf("expected the server to be idle, got %+v", status)
+	}
+
+	s.pulls.Add(1)
+	if status := next(); status.State != statusDownloading {
+		t.Errorf("expected the server to be downloading, got %+v", status)
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/goobla/goobla/envconfig"
+)
+
+// serverTLSConfig returns the TLS configuration of the server's listener set
+// by GOOBLA_TLS_CERT and GOOBLA_TLS_KEY, or nil to serve plain HTTP. With
+// GOOBLA_TLS_CLIENT_CA set, clients must present a certificate signed by one
+// of its CAs.
+func serverTLSConfig() (*tls.Config, error) {
+	certFile, keyFile, clientCA := envconfig.TLSCert(), envconfig.TLSKey(), envconfig.TLSClientCA()
+	if certFile == "" && keyFile == "" {
+		if clientCA != "" {
+			return nil, errors.New("GOOBLA_TLS_CLIENT_CA requires GOOBLA_TLS_CERT and GOOBLA_TLS_KEY")
+		}
+		return nil, nil
+	}
+
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("GOOBLA_TLS_CERT and GOOBLA_TLS_KEY must be set together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if clientCA != "" {
+		pem, err := os.ReadFile(clientCA)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", clientCA)
+		}
+
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
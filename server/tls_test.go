@@ -0,0 +1,144 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/goobla/goobla/api"
+)
+
+// writeCert writes a certificate for name signed by parent, or self-signed
+// if parent is nil, and its key to dir, returning their paths.
+func writeCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (string, string, *x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certPath, keyPath, cert, key
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	caPath, _, ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	certPath, keyPath, _, _ := writeCert(t, dir, "server", ca, caKey)
+	clientCert, clientKey, _, _ := writeCert(t, dir, "client", ca, caKey)
+
+	t.Run("disabled", func(t *testing.T) {
+		cfg, err := serverTLSConfig()
+		if err != nil || cfg != nil {
+			t.Errorf("expected no TLS, got %v, %v", cfg, err)
+		}
+	})
+
+	t.Run("missing key", func(t *testing.T) {
+		t.Setenv("GOOBLA_TLS_CERT", certPath)
+		if _, err := serverTLSConfig(); err == nil {
+			t.Error("expected an error")
+		}
+	})
+
+	t.Run("client CA without cert", func(t *testing.T) {
+		t.Setenv("GOOBLA_TLS_CLIENT_CA", caPath)
+		if _, err := serverTLSConfig(); err == nil {
+			t.Error("expected an error")
+		}
+	})
+
+	t.Run("mutual", func(t *testing.T) {
+		t.Setenv("GOOBLA_TLS_CERT", certPath)
+		t.Setenv("GOOBLA_TLS_KEY", keyPath)
+		t.Setenv("GOOBLA_TLS_CLIENT_CA", caPath)
+
+		cfg, err := serverTLSConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"version":"0.0.0"}`))
+		})}
+		go srv.Serve(tls.NewListener(ln, cfg))
+		defer srv.Close()
+
+		base := &url.URL{Scheme: "https", Host: ln.Addr().String()}
+		client := func(t *testing.T, cert, key string) *api.Client {
+			t.Helper()
+			cfg, err := api.TLSConfig(caPath, cert, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return api.NewClient(base, &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}})
+		}
+
+		if _, err := client(t, "", "").Version(t.Context()); err == nil {
+			t.Error("expected a client without a certificate to be refused")
+		}
+
+		if _, err := client(t, clientCert, clientKey).Version(t.Context()); err != nil {
+			t.Errorf("expected a client with a certificate to connect, got %v", err)
+		}
+	})
+}
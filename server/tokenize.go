@@ -0,0 +1,48 @@
+package server
+
+import (
+	"bytes"
+	"slices"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/template"
+)
+
+// tokenizePrompt returns the text the model would be given to generate a
+// response to req: its prompt formatted like a generate request, or its
+// messages formatted like a chat without truncating them.
+func tokenizePrompt(m *Model, req api.TokenizeRequest) (string, error) {
+	if req.Raw {
+		return req.Prompt, nil
+	}
+
+	var msgs []api.Message
+	if len(req.Messages) > 0 {
+		msgs = slices.Concat(m.Messages, req.Messages)
+		if req.Messages[0].Role != "system" && m.System != "" {
+			msgs = append([]api.Message{{Role: "system", Content: m.System}}, msgs...)
+		}
+		msgs = filterThinkTags(msgs, m)
+	} else {
+		if req.System != "" {
+			msgs = append(msgs, api.Message{Role: "system", Content: req.System})
+		} else if m.System != "" {
+			msgs = append(msgs, api.Message{Role: "system", Content: m.System})
+		}
+
+		msgs = append(msgs, m.Messages...)
+		msgs = append(msgs, api.Message{Role: "user", Content: req.Prompt})
+	}
+
+	var b bytes.Buffer
+	if err := m.Template.Execute(&b, template.Values{
+		Messages:   msgs,
+		Tools:      req.Tools,
+		Think:      req.Think != nil && *req.Think,
+		IsThinkSet: req.Think != nil,
+	}); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/discover"
+	"github.com/goobla/goobla/fs/ggml"
+	"github.com/goobla/goobla/template"
+)
+
+// mockTokenizer detokenizes tokens to their ids.
+type mockTokenizer struct {
+	mockRunner
+}
+
+func (mockTokenizer) Detokenize(_ context.Context, tokens []int) (string, error) {
+	var sb strings.Builder
+	for _, t := range tokens {
+		fmt.Fprintf(&sb, "<%d>", t)
+	}
+
+	return sb.String(), nil
+}
+
+func TestTokenizePrompt(t *testing.T) {
+	tmpl, err := template.Parse(`{{- range .Messages }}{{ .Role }}: {{ .Content }}
+{{ end }}{{ if .Think }}think{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := Model{
+		Template: tmpl,
+		System:   "You are a llama.",
+		Messages: []api.Message{{Role: "user", Content: "Hi"}, {Role: "assistant", Content: "Hello!"}},
+	}
+
+	think := true
+	cases := []struct {
+		name string
+		req  api.TokenizeRequest
+		want string
+	}{
+		{
+			name: "prompt",
+			req:  api.TokenizeRequest{Prompt: "Why is the sky blue?"},
+			want: "system: You are a llama.\nuser: Hi\nassistant: Hello!\nuser: Why is the sky blue?\n",
+		},
+		{
+			name: "system",
+			req:  api.TokenizeRequest{Prompt: "Why is the sky blue?", System: "You are an alpaca."},
+			want: "system: You are an alpaca.\nuser: Hi\nassistant: Hello!\nuser: Why is the sky blue?\n",
+		},
+		{
+			name: "raw",
+			req:  api.TokenizeRequest{Prompt: "Why is the sky blue?", Raw: true},
+			want: "Why is the sky blue?",
+		},
+		{
+			name: "messages",
+			req: api.TokenizeRequest{
+				Messages: []api.Message{{Role: "user", Content: "Why is the sky blue?"}},
+				Think:    &think,
+			},
+			want: "system: You are a llama.\nuser: Hi\nassistant: Hello!\nuser: Why is the sky blue?\nthink",
+		},
+		{
+			name: "messages with system",
+			req:  api.TokenizeRequest{Messages: []api.Message{{Role: "system", Content: "You are an alpaca."}, {Role: "user", Content: "Why?"}}},
+			want: "user: Hi\nassistant: Hello!\nsystem: You are an alpaca.\nuser: Why?\n",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tokenizePrompt(&m, tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	if len(m.Messages) != 2 {
+		t.Errorf("expected the model's messages to be unchanged, got %+v", m.Messages)
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var mock mockTokenizer
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			getGpuFn:      discover.GetGPUInfo,
+			getCpuFn:      discover.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, _ *ggml.GGML, _ discover.GpuInfoList, _ int) {
+				// add small delay to simulate loading
+				time.Sleep(time.Millisecond)
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(t.Context())
+
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture":          "llama",
+		"llama.block_count":             uint32(1),
+		"llama.context_length":          uint32(8192),
+		"llama.embedding_length":        uint32(4096),
+		"llama.attention.head_count":    uint32(32),
+		"llama.attention.head_count_kv": uint32(8),
+		"tokenizer.ggml.tokens":         []string{"a", "b", "c"},
+		"tokenizer.ggml.scores":         []float32{0, 0, 0},
+		"tokenizer.ggml.token_type":     []int32{0, 0, 0},
+	}, []*ggml.Tensor{
+		{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+	})
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:    "test",
+		Files:    map[string]string{"file.gguf": digest},
+		Template: `{{ range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}`,
+		Stream:   &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	t.Run("prompt", func(t *testing.T) {
+		w := createRequest(t, s.TokenizeHandler, api.TokenizeRequest{
+			Model:   "test",
+			Prompt:  "Why is the sky blue?",
+			Options: map[string]any{"num_ctx": 1024},
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.TokenizeResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		// "user:" and the four words of the prompt
+		want := api.TokenizeResponse{Model: "test", Tokens: []int{0, 1, 2, 3, 4, 5}, Count: 6, ContextLength: 1024}
+		if diff := cmp.Diff(want, resp); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("messages", func(t *testing.T) {
+		w := createRequest(t, s.TokenizeHandler, api.TokenizeRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Hi"}, {Role: "assistant", Content: "Hello!"}},
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.TokenizeResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Count != 4 || len(resp.Tokens) != 4 {
+			t.Errorf("unexpected response %+v", resp)
+		}
+	})
+
+	t.Run("messages and prompt", func(t *testing.T) {
+		w := createRequest(t, s.TokenizeHandler, api.TokenizeRequest{
+			Model:    "test",
+			Prompt:   "Why is the sky blue?",
+			Messages: []api.Message{{Role: "user", Content: "Hi"}},
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("missing model", func(t *testing.T) {
+		w := createRequest(t, s.TokenizeHandler, api.TokenizeRequest{Model: "missing", Prompt: "Hi"})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("template", func(t *testing.T) {
+		w := createRequest(t, s.TemplateHandler, api.TemplateRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Why is the sky blue?"}},
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.TemplateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(api.TemplateResponse{Model: "test", Prompt: "user: Why is the sky blue? ", Count: 6}, resp); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("template override", func(t *testing.T) {
+		w := createRequest(t, s.TemplateHandler, api.TemplateRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Why is the sky blue?"}},
+			Tools:    api.Tools{{Type: "function", Function: api.ToolFunction{Name: "get_weather"}}},
+			Template: `{{ range .Tools }}[{{ .Function.Name }}] {{ end }}{{ range .Messages }}<{{ .Role }}>{{ .Content }}{{ end }}`,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.TemplateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(api.TemplateResponse{Model: "test", Prompt: "[get_weather] <user>Why is the sky blue?", Count: 6}, resp); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		// the model's template is unchanged
+		w = createRequest(t, s.TemplateHandler, api.TemplateRequest{Model: "test", Messages: []api.Message{{Role: "user", Content: "Hi"}}})
+		if !strings.Contains(w.Body.String(), `"user: Hi "`) {
+			t.Errorf("unexpected response %s", w.Body.String())
+		}
+	})
+
+	t.Run("template errors", func(t *testing.T) {
+		cases := map[string]api.TemplateRequest{
+			"no messages":    {Model: "test"},
+			"invalid":        {Model: "test", Messages: []api.Message{{Role: "user", Content: "Hi"}}, Template: "{{ .Messages"},
+			"execute failed": {Model: "test", Messages: []api.Message{{Role: "user", Content: "Hi"}}, Template: "{{ index .Messages 5 }}"},
+		}
+
+		for name, req := range cases {
+			t.Run(name, func(t *testing.T) {
+				w := createRequest(t, s.TemplateHandler, req)
+				if w.Code != http.StatusBadRequest {
+					t.Errorf("expected status 400, got %d: %s", w.Code, w.Body.String())
+				}
+			})
+		}
+	})
+
+	t.Run("detokenize", func(t *testing.T) {
+		w := createRequest(t, s.DetokenizeHandler, api.DetokenizeRequest{Model: "test", Tokens: []int{2, 0}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.DetokenizeResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(api.DetokenizeResponse{Model: "test", Content: "<2><0>"}, resp); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("detokenize unknown token", func(t *testing.T) {
+		for _, token := range []int{3, -1} {
+			w := createRequest(t, s.DetokenizeHandler, api.DetokenizeRequest{Model: "test", Tokens: []int{0, token}})
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400 for token %d, got %d", token, w.Code)
+			}
+		}
+	})
+}
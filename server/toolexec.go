@@ -0,0 +1,461 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/envconfig"
+)
+
+// Built-in tools are run by the server for models, so a single chat request
+// can call tools and answer with their results. None are enabled unless
+// they're listed in GOOBLA_TOOLS, and requests choose which of those to
+// offer the model with server_tools.
+
+const (
+	toolCalculator = "calculator"
+	toolHTTPFetch  = "http_fetch"
+	toolRunCommand = "run_command"
+)
+
+const (
+	// maxToolRounds is how many times a chat request runs built-in tools
+	// before the calls the model makes to them are returned instead
+	maxToolRounds = 8
+
+	toolTimeout = 30 * time.Second
+
+	// maxToolOutput is how much of a tool's output is given to the model
+	maxToolOutput = 64 * 1024
+)
+
+type builtinTool struct {
+	definition string
+	run        func(ctx context.Context, args api.ToolCallFunctionArguments) (string, error)
+}
+
+var builtinTools = map[string]builtinTool{
+	toolCalculator: {
+		definition: `{
+			"type": "function",
+			"function": {
+				"name": "calculator",
+				"description": "Evaluate an arithmetic expression with +, -, *, /, %, ^ and parentheses",
+				"parameters": {
+					"type": "object",
+					"required": ["expression"],
+					"properties": {
+						"expression": {"type": "string", "description": "The expression to evaluate, e.g. (2 + 3) * 4"}
+					}
+				}
+			}
+		}`,
+		run: runCalculator,
+	},
+	toolHTTPFetch: {
+		definition: `{
+			"type": "function",
+			"function": {
+				"name": "http_fetch",
+				"description": "Fetch the contents of a URL with an HTTP GET request",
+				"parameters": {
+					"type": "object",
+					"required": ["url"],
+					"properties": {
+						"url": {"type": "string", "description": "The http or https URL to fetch"}
+					}
+				}
+			}
+		}`,
+		run: runHTTPFetch,
+	},
+	toolRunCommand: {
+		definition: `{
+			"type": "function",
+			"function": {
+				"name": "run_command",
+				"description": "Run a command on the server and return its output",
+				"parameters": {
+					"type": "object",
+					"required": ["command"],
+					"properties": {
+						"command": {"type": "string", "description": "The name of the command to run"},
+						"args": {"type": "array", "items": {"type": "string"}, "description": "The arguments to run the command with"}
+					}
+				}
+			}
+		}`,
+		run: runCommand,
+	},
+}
+
+// serverTools returns the definitions of the built-in tools named, or an
+// error if one isn't enabled on this server or has the name of one of the
+// request's own tools.
+func serverTools(names []string, requestTools []api.Tool) ([]api.Tool, error) {
+	var tools []api.Tool
+	for _, name := range names {
+		b, ok := builtinTools[name]
+		if !ok || !slices.Contains(envconfig.Tools(), name) {
+			return nil, fmt.Errorf("server tool %q isn't enabled on this server", name)
+		}
+
+		if slices.ContainsFunc(requestTools, func(t api.Tool) bool { return t.Function.Name == name }) {
+			return nil, fmt.Errorf("server tool %q has the same name as one of the request's tools", name)
+		}
+
+		var tool api.Tool
+		if err := json.Unmarshal([]byte(b.definition), &tool); err != nil {
+			return nil, err
+		}
+		tools = append(tools, tool)
+	}
+
+	return tools, nil
+}
+
+// runTools runs the calls to built-in tools, returning their results.
+func runTools(ctx context.Context, calls []api.ToolCall) []api.ToolExecution {
+	executions := make([]api.ToolExecution, len(calls))
+	for i, call := range calls {
+		executions[i].Call = call
+
+		ctx, cancel := context.WithTimeout(ctx, toolTimeout)
+		result, err := builtinTools[call.Function.Name].run(ctx, call.Function.Arguments)
+		cancel()
+		if err != nil {
+			executions[i].Error = err.Error()
+		}
+
+		if len(result) > maxToolOutput {
+			result = result[:maxToolOutput]
+		}
+		executions[i].Result = result
+	}
+
+	return executions
+}
+
+// toolMessage returns the message giving the model the result of e.
+func toolMessage(e api.ToolExecution) api.Message {
+	content := e.Result
+	if e.Error != "" {
+		content = strings.TrimSpace(content + "\nerror: " + e.Error)
+	}
+
+	return api.Message{Role: "tool", Content: content}
+}
+
+func stringArg(args api.ToolCallFunctionArguments, name string) (string, error) {
+	s, ok := args[name].(string)
+	if !ok || s == "" {
+		return "", fmt.Errorf("%s is required", name)
+	}
+
+	return s, nil
+}
+
+func runCalculator(_ context.Context, args api.ToolCallFunctionArguments) (string, error) {
+	expr, err := stringArg(args, "expression")
+	if err != nil {
+		return "", err
+	}
+
+	v, err := calculate(expr)
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64), nil
+}
+
+func runHTTPFetch(ctx context.Context, args api.ToolCallFunctionArguments) (string, error) {
+	raw, err := stringArg(args, "url")
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+
+	if envconfig.Offline() {
+		return "", errOffline
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxToolOutput))
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return string(body), errors.New(resp.Status)
+	}
+
+	return string(body), nil
+}
+
+// fetchAddrAllowed reports whether http_fetch may connect to an address. It's
+// a variable so tests can fetch from local servers.
+var fetchAddrAllowed = func(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddressSpace.Contains(addr)
+}
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598, which isn't
+// reachable from the internet either.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// fetchClient is the client of the http_fetch tool. It ignores proxies and
+// refuses to connect to loopback, private and link-local addresses, which is
+// checked for the address each connection resolves to, including those of
+// redirects, so models can't reach services on the server's network.
+var fetchClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 30 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				ap, err := netip.ParseAddrPort(address)
+				if err != nil {
+					return err
+				}
+
+				if !fetchAddrAllowed(ap.Addr()) {
+					return fmt.Errorf("fetching from %s isn't allowed", ap.Addr())
+				}
+
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("too many redirects")
+		}
+
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("unsupported URL scheme %q", req.URL.Scheme)
+		}
+
+		return nil
+	},
+}
+
+func runCommand(ctx context.Context, args api.ToolCallFunctionArguments) (string, error) {
+	name, err := stringArg(args, "command")
+	if err != nil {
+		return "", err
+	}
+
+	if !slices.Contains(envconfig.ToolCommands(), name) {
+		return "", fmt.Errorf("command %q isn't allowed", name)
+	}
+
+	var cmdArgs []string
+	if list, ok := args["args"].([]any); ok {
+		for _, a := range list {
+			s, ok := a.(string)
+			if !ok {
+				return "", errors.New("args must be strings")
+			}
+			// options can make allowed commands run others, such as
+			// find -exec or git -c core.sshCommand=...
+			if strings.HasPrefix(s, "-") {
+				return "", fmt.Errorf("option %q isn't allowed", s)
+			}
+
+			cmdArgs = append(cmdArgs, s)
+		}
+	}
+
+	out, err := exec.CommandContext(ctx, name, cmdArgs...).CombinedOutput()
+	return string(out), err
+}
+
+// calculate evaluates an arithmetic expression of numbers, parentheses and
+// the operators +, -, *, /, % and ^, which raises to a power.
+func calculate(expr string) (float64, error) {
+	c := calculator{s: expr}
+	v, err := c.sum()
+	if err != nil {
+		return 0, err
+	}
+
+	if c.skipSpace(); c.i < len(c.s) {
+		return 0, fmt.Errorf("unexpected %q at %d", c.s[c.i], c.i)
+	}
+
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, errors.New("result isn't a finite number")
+	}
+
+	return v, nil
+}
+
+type calculator struct {
+	s string
+	i int
+}
+
+func (c *calculator) skipSpace() {
+	for c.i < len(c.s) && unicode.IsSpace(rune(c.s[c.i])) {
+		c.i++
+	}
+}
+
+// next returns the next operator if it's one of ops, and skips it.
+func (c *calculator) next(ops string) (byte, bool) {
+	c.skipSpace()
+	if c.i < len(c.s) && strings.IndexByte(ops, c.s[c.i]) >= 0 {
+		c.i++
+		return c.s[c.i-1], true
+	}
+
+	return 0, false
+}
+
+func (c *calculator) sum() (float64, error) {
+	v, err := c.product()
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		op, ok := c.next("+-")
+		if !ok {
+			return v, nil
+		}
+
+		w, err := c.product()
+		if err != nil {
+			return 0, err
+		}
+
+		if op == '+' {
+			v += w
+		} else {
+			v -= w
+		}
+	}
+}
+
+func (c *calculator) product() (float64, error) {
+	v, err := c.unary()
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		op, ok := c.next("*/%")
+		if !ok {
+			return v, nil
+		}
+
+		w, err := c.unary()
+		if err != nil {
+			return 0, err
+		}
+
+		switch op {
+		case '*':
+			v *= w
+		case '/':
+			v /= w
+		case '%':
+			v = math.Mod(v, w)
+		}
+	}
+}
+
+func (c *calculator) unary() (float64, error) {
+	if op, ok := c.next("+-"); ok {
+		v, err := c.unary()
+		if op == '-' {
+			v = -v
+		}
+		return v, err
+	}
+
+	return c.power()
+}
+
+// power is right associative, so 2^3^2 is 2^9.
+func (c *calculator) power() (float64, error) {
+	v, err := c.operand()
+	if err != nil {
+		return 0, err
+	}
+
+	if _, ok := c.next("^"); ok {
+		w, err := c.unary()
+		if err != nil {
+			return 0, err
+		}
+		v = math.Pow(v, w)
+	}
+
+	return v, nil
+}
+
+func (c *calculator) operand() (float64, error) {
+	if _, ok := c.next("("); ok {
+		v, err := c.sum()
+		if err != nil {
+			return 0, err
+		}
+
+		if _, ok := c.next(")"); !ok {
+			return 0, errors.New("missing )")
+		}
+		return v, nil
+	}
+
+	c.skipSpace()
+	start := c.i
+	for c.i < len(c.s) && (c.s[c.i] >= '0' && c.s[c.i] <= '9' || c.s[c.i] == '.') {
+		c.i++
+	}
+
+	if start == c.i {
+		if c.i == len(c.s) {
+			return 0, errors.New("unexpected end of expression")
+		}
+		return 0, fmt.Errorf("unexpected %q at %d", c.s[c.i], c.i)
+	}
+
+	return strconv.ParseFloat(c.s[start:c.i], 64)
+}
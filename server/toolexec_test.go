@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/goobla/goobla/api"
+)
+
+func TestCalculate(t *testing.T) {
+	cases := []struct {
+		expr string
+		want float64
+		err  bool
+	}{
+		{expr: "1 + 2 * 3", want: 7},
+		{expr: "(1 + 2) * 3", want: 9},
+		{expr: "-2 ^ 2", want: -4},
+		{expr: "2 ^ 3 ^ 2", want: 512},
+		{expr: "7 % 4 - 10 / 4", want: 0.5},
+		{expr: "--1.5", want: 1.5},
+		{expr: "1 +", err: true},
+		{expr: "(1 + 2", err: true},
+		{expr: "1 2", err: true},
+		{expr: "1 / 0", err: true},
+		{expr: "x", err: true},
+	}
+
+	for _, tt := range cases {
+		got, err := calculate(tt.expr)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", tt.expr, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+		} else if got != tt.want {
+			t.Errorf("%q = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestServerTools(t *testing.T) {
+	t.Setenv("GOOBLA_TOOLS", "calculator")
+
+	tools, err := serverTools([]string{"calculator"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tools) != 1 || tools[0].Function.Name != "calculator" || len(tools[0].Function.Parameters.Properties) != 1 {
+		t.Errorf("unexpected tools %v", tools)
+	}
+
+	if _, err := serverTools([]string{"http_fetch"}, nil); err == nil {
+		t.Error("expected an error for a tool that isn't enabled")
+	}
+
+	if _, err := serverTools([]string{"calculator"}, tools); err == nil {
+		t.Error("expected an error for a tool with the name of a request tool")
+	}
+}
+
+func TestRunTools(t *testing.T) {
+	t.Setenv("GOOBLA_TOOL_COMMANDS", "echo")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ok" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("fetched"))
+	}))
+	defer srv.Close()
+
+	// the test server listens on loopback, which http_fetch refuses
+	local := runTools(context.Background(), []api.ToolCall{
+		{Function: api.ToolCallFunction{Name: "http_fetch", Arguments: api.ToolCallFunctionArguments{"url": srv.URL + "/ok"}}},
+	})
+	if !strings.Contains(local[0].Error, "isn't allowed") {
+		t.Errorf("expected fetching from loopback to fail, got %q, %q", local[0].Result, local[0].Error)
+	}
+
+	allowed := fetchAddrAllowed
+	fetchAddrAllowed = func(netip.Addr) bool { return true }
+	t.Cleanup(func() { fetchAddrAllowed = allowed })
+
+	call := func(name string, args api.ToolCallFunctionArguments) api.ToolCall {
+		return api.ToolCall{Function: api.ToolCallFunction{Name: name, Arguments: args}}
+	}
+
+	executions := runTools(context.Background(), []api.ToolCall{
+		call("calculator", api.ToolCallFunctionArguments{"expression": "6 * 7"}),
+		call("http_fetch", api.ToolCallFunctionArguments{"url": srv.URL + "/ok"}),
+		call("http_fetch", api.ToolCallFunctionArguments{"url": srv.URL + "/missing"}),
+		call("http_fetch", api.ToolCallFunctionArguments{"url": "file:///etc/passwd"}),
+		call("run_command", api.ToolCallFunctionArguments{"command": "echo", "args": []any{"hello"}}),
+		call("run_command", api.ToolCallFunctionArguments{"command": "rm", "args": []any{"-rf", "/"}}),
+		call("run_command", api.ToolCallFunctionArguments{"command": "echo", "args": []any{"-e", "hello"}}),
+	})
+
+	want := []struct {
+		result string
+		err    bool
+	}{
+		{result: "42"},
+		{result: "fetched"},
+		{result: "404 page not found\n", err: true},
+		{err: true},
+		{result: "hello\n"},
+		{err: true},
+		{err: true},
+	}
+
+	for i, w := range want {
+		e := executions[i]
+		if e.Result != w.result || (e.Error != "") != w.err {
+			t.Errorf("%d: got %q, %q", i, e.Result, e.Error)
+		}
+	}
+
+	if msg := toolMessage(executions[5]); msg.Role != "tool" || !strings.Contains(msg.Content, "isn't allowed") {
+		t.Errorf("unexpected tool message %v", msg)
+	}
+}
+
+func TestFetchAddrAllowed(t *testing.T) {
+	cases := map[string]bool{
+		"93.184.215.14":    true,
+		"2606:4700::1111":  true,
+		"127.0.0.1":        false,
+		"::1":              false,
+		"10.1.2.3":         false,
+		"172.16.0.1":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"100.64.0.1":       false,
+		"0.0.0.0":          false,
+		"fe80::1":          false,
+		"fd00::1":          false,
+		"::ffff:127.0.0.1": false,
+		"224.0.0.1":        false,
+	}
+
+	for addr, want := range cases {
+		if got := fetchAddrAllowed(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("%s: got %v, want %v", addr, got, want)
+		}
+	}
+}
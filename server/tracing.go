@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/goobla/goobla/envconfig"
+	"github.com/goobla/goobla/version"
+)
+
+// Requests are traced with OpenTelemetry when GOOBLA_OTEL_ENDPOINT is set.
+// Each request has a span with children for scheduling the model, which
+// includes loading it, and for generating tokens, so the time spent queued,
+// loading and generating can be told apart.
+
+var tracer = otel.Tracer("github.com/goobla/goobla/server")
+
+// otelEndpoint returns the URL traces are sent to for the endpoint s, which
+// may be a host and port or a URL. The OTLP traces path is used if the URL
+// has no path.
+func otelEndpoint(s string) (string, error) {
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid GOOBLA_OTEL_ENDPOINT %q", s)
+	}
+
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+
+	return u.String(), nil
+}
+
+// setupTracing exports traces to GOOBLA_OTEL_ENDPOINT. The function it
+// returns flushes any spans not yet exported.
+func setupTracing(ctx context.Context) (func(), error) {
+	s := envconfig.OTelEndpoint()
+	if s == "" {
+		return func() {}, nil
+	}
+
+	if envconfig.Offline() {
+		slog.Warn("not exporting traces while offline", "endpoint", s)
+		return func() {}, nil
+	}
+
+	endpoint, err := otelEndpoint(s)
+	if err != nil {
+		return nil, err
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("goobla"),
+		semconv.ServiceVersion(version.Version),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	slog.Info("exporting traces", "endpoint", endpoint)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := tp.Shutdown(ctx); err != nil {
+			slog.Warn("couldn't flush traces", "error", err)
+		}
+	}, nil
+}
+
+// endSpan ends span, recording err if it isn't nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// tracingMiddleware starts a span for each request, continuing the trace of
+// the client if it sent a traceparent header.
+func tracingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+		name := c.Request.Method
+		if route := c.FullPath(); route != "" {
+			name += " " + route
+		}
+
+		ctx, span := tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Request.Method),
+				semconv.HTTPRoute(c.FullPath()),
+				semconv.URLPath(c.Request.URL.Path),
+			),
+		)
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
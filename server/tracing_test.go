@@ -0,0 +1,93 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestOtelEndpoint(t *testing.T) {
+	cases := []struct {
+		endpoint string
+		want     string
+		err      bool
+	}{
+		{endpoint: "localhost:4318", want: "http://localhost:4318/v1/traces"},
+		{endpoint: "http://collector:4318/", want: "http://collector:4318/v1/traces"},
+		{endpoint: "https://otel.example.com/otlp/v1/traces", want: "https://otel.example.com/otlp/v1/traces"},
+		{endpoint: "grpc://collector:4317", err: true},
+		{endpoint: "http://", err: true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			got, err := otelEndpoint(tt.endpoint)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	provider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagator)
+	})
+
+	r := gin.New()
+	r.Use(tracingMiddleware())
+	r.GET("/api/tags", func(c *gin.Context) {
+		_, span := tracer.Start(c.Request.Context(), "child")
+		span.End()
+		c.Status(http.StatusOK)
+	})
+	r.POST("/api/generate", func(c *gin.Context) {
+		c.Status(http.StatusInternalServerError)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/tags", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/generate", nil))
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 3)
+
+	child, tags, generate := spans[0], spans[1], spans[2]
+	assert.Equal(t, "child", child.Name)
+	assert.Equal(t, tags.SpanContext.SpanID(), child.Parent.SpanID())
+
+	assert.Equal(t, "GET /api/tags", tags.Name)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", tags.SpanContext.TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", tags.Parent.SpanID().String())
+	assert.Contains(t, tags.Attributes, attribute.String("http.route", "/api/tags"))
+	assert.Contains(t, tags.Attributes, attribute.Int("http.response.status_code", http.StatusOK))
+	assert.Equal(t, codes.Unset, tags.Status.Code)
+
+	assert.Equal(t, "POST /api/generate", generate.Name)
+	assert.False(t, generate.Parent.IsValid())
+	assert.Equal(t, codes.Error, generate.Status.Code)
+}
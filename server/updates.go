@@ -0,0 +1,144 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/envconfig"
+	"github.com/goobla/goobla/types/model"
+)
+
+// A model follows the tag it was pulled with, so llama3.2:3b is updated when
+// the 3b tag moves in the registry. Models pulled by digest never change and
+// models that aren't in a registry, such as those created locally, have
+// nothing to update from.
+
+// sameContent reports whether a and b have the same config and layers.
+// Manifests are rewritten when they are pulled, so their digests can't be
+// compared directly.
+func sameContent(a, b *Manifest) bool {
+	return a.Config.Digest == b.Config.Digest && slices.EqualFunc(a.Layers, b.Layers, func(x, y Layer) bool {
+		return x.Digest == y.Digest
+	})
+}
+
+// findUpdates checks the models in ms against their registries, returning
+// those with a newer version.
+func findUpdates(ctx context.Context, ms map[model.Name]*Manifest) ([]api.ModelUpdate, error) {
+	names := slices.SortedFunc(maps.Keys(ms), func(a, b model.Name) int {
+		return cmp.Compare(a.String(), b.String())
+	})
+
+	updates := []api.ModelUpdate{}
+	for _, n := range names {
+		mp := ParseModelPath(n.String())
+		if mp.Digest() != "" {
+			continue
+		}
+
+		_, remote, _, err := pullMirroredManifest(ctx, mp, &registryOptions{})
+		if errors.Is(err, context.Canceled) {
+			return nil, err
+		} else if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			slog.Debug("couldn't check for update", "model", n.DisplayShortest(), "error", err)
+			continue
+		}
+
+		if sameContent(ms[n], remote) {
+			continue
+		}
+
+		updates = append(updates, api.ModelUpdate{
+			Model:        n.DisplayShortest(),
+			Digest:       ms[n].digest,
+			RemoteDigest: remote.digest,
+		})
+	}
+
+	return updates, nil
+}
+
+// updateModels pulls the newer version of every model that has one.
+func updateModels(ctx context.Context) error {
+	ms, err := Manifests(true)
+	if err != nil {
+		return err
+	}
+
+	updates, err := findUpdates(ctx, ms)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range updates {
+		slog.Info("updating model", "model", u.Model, "digest", u.RemoteDigest)
+		if err := PullModel(ctx, u.Model, &registryOptions{}, func(api.ProgressResponse) {}); errors.Is(err, context.Canceled) {
+			return err
+		} else if err != nil {
+			slog.Warn("couldn't update model", "model", u.Model, "error", err)
+		}
+	}
+
+	return nil
+}
+
+func runUpdater(ctx context.Context) {
+	interval := envconfig.UpdateInterval()
+	if interval == 0 || envconfig.Offline() {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := updateModels(ctx); errors.Is(err, context.Canceled) {
+			return
+		} else if err != nil {
+			slog.Warn("couldn't update models", "error", err)
+		}
+	}
+}
+
+func (s *Server) UpdatesHandler(c *gin.Context) {
+	if !checkOnline(c) {
+		return
+	}
+
+	ms, err := Manifests(true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	user := requestUser(c)
+	maps.DeleteFunc(ms, func(n model.Name, _ *Manifest) bool {
+		return !canRead(user, n)
+	})
+
+	updates, err := findUpdates(c.Request.Context(), ms)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.UpdatesResponse{Models: updates})
+}
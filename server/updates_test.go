@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/types/model"
+)
+
+func TestFindUpdates(t *testing.T) {
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	var mu sync.Mutex
+	responses := make(map[string][]byte)
+	publish := func(repo, weights string) string {
+		blob, digest := testBlob(weights)
+		manifest, err := json.Marshal(Manifest{
+			SchemaVersion: 2,
+			MediaType:     mediaTypeDockerManifest,
+			Layers:        []Layer{{MediaType: "application/vnd.goobla.image.model", Digest: digest, Size: int64(len(blob))}},
+		})
+		require.NoError(t, err)
+
+		mu.Lock()
+		defer mu.Unlock()
+		responses["/v2/ns/"+repo+"/blobs/"+digest] = blob
+		responses["/v2/ns/"+repo+"/manifests/latest"] = manifest
+		return fmt.Sprintf("%x", sha256.Sum256(manifest))
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		b, ok := responses[r.URL.Path]
+		mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		if r.Method == http.MethodHead {
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+	}))
+	defer srv.Close()
+
+	host := srv.Listener.Addr().String()
+	writeRegistriesConfig(t, `{"registries": {"`+host+`": {"scheme": "http"}}}`)
+
+	publish("current", "current weights")
+	publish("stale", "old weights")
+	publish("removed", "removed weights")
+	for _, repo := range []string{"current", "stale", "removed"} {
+		require.NoError(t, PullModel(t.Context(), host+"/ns/"+repo, &registryOptions{}, func(api.ProgressResponse) {}))
+	}
+
+	digest := publish("stale", "new weights")
+	delete(responses, "/v2/ns/removed/manifests/latest")
+
+	ms, err := Manifests(true)
+	require.NoError(t, err)
+
+	updates, err := findUpdates(t.Context(), ms)
+	require.NoError(t, err)
+	require.Len(t, updates, 1)
+	assert.Equal(t, host+"/ns/stale:latest", updates[0].Model)
+	assert.Equal(t, ms[model.ParseName(host+"/ns/stale")].digest, updates[0].Digest)
+	assert.Equal(t, digest, updates[0].RemoteDigest)
+
+	require.NoError(t, updateModels(t.Context()))
+
+	ms, err = Manifests(true)
+	require.NoError(t, err)
+	updates, err = findUpdates(t.Context(), ms)
+	require.NoError(t, err)
+	assert.Empty(t, updates)
+
+	_, weights := testBlob("new weights")
+	m := ms[model.ParseName(host+"/ns/stale")]
+	require.NotNil(t, m)
+	assert.Equal(t, weights, m.Layers[0].Digest)
+}
@@ -35,6 +35,8 @@ type blobUpload struct {
 
 	nextURL chan *url.URL
 
+	limiter *rateLimiter
+
 	context.CancelFunc
 
 	file *os.File
@@ -112,13 +114,14 @@ func (b *blobUpload) Prepare(ctx context.Context, requestURL *url.URL, opts *reg
 		slog.Info(fmt.Sprintf("uploading %s in %d %s part(s)", b.Digest[7:19], len(b.Parts), format.HumanBytes(b.Parts[0].Size)))
 	}
 
-	requestURL, err = url.Parse(location)
+	// OCI registries commonly return a location relative to the request
+	nextURL, err := requestURL.Parse(location)
 	if err != nil {
 		return err
 	}
 
 	b.nextURL = make(chan *url.URL, 1)
-	b.nextURL <- requestURL
+	b.nextURL <- nextURL
 	return nil
 }
 
@@ -127,6 +130,7 @@ func (b *blobUpload) Prepare(ctx context.Context, requestURL *url.URL, opts *reg
 func (b *blobUpload) Run(ctx context.Context, opts *registryOptions) {
 	defer blobUploadManager.Delete(b.Digest)
 	ctx, b.CancelFunc = context.WithCancel(ctx)
+	b.limiter = opts.limiter
 
 	p, err := GetBlobsPath(b.Digest)
 	if err != nil {
@@ -228,7 +232,8 @@ func (b *blobUpload) uploadPart(ctx context.Context, method string, requestURL *
 	md5sum := md5.New()
 	w := &progressWriter{blobUpload: b}
 
-	resp, err := makeRequest(ctx, method, requestURL, headers, io.TeeReader(sr, io.MultiWriter(w, md5sum)), opts)
+	body := rateLimitReader(ctx, io.TeeReader(sr, io.MultiWriter(w, md5sum)), b.limiter)
+	resp, err := makeRequest(ctx, method, requestURL, headers, body, opts)
 	if err != nil {
 		w.Rollback()
 		return err
@@ -240,7 +245,7 @@ func (b *blobUpload) uploadPart(ctx context.Context, method string, requestURL *
 		location = resp.Header.Get("Location")
 	}
 
-	nextURL, err := url.Parse(location)
+	nextURL, err := requestURL.Parse(location)
 	if err != nil {
 		w.Rollback()
 		return err
@@ -279,7 +284,7 @@ func (b *blobUpload) uploadPart(ctx context.Context, method string, requestURL *
 	case resp.StatusCode == http.StatusUnauthorized:
 		w.Rollback()
 		challenge := parseRegistryChallenge(resp.Header.Get("www-authenticate"))
-		token, err := getAuthorizationToken(ctx, challenge)
+		token, err := getRegistryToken(ctx, challenge, opts)
 		if err != nil {
 			return err
 		}
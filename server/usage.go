@@ -0,0 +1,60 @@
+package server
+
+import (
+	"time"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/llm"
+)
+
+// minStatsInterval is the shortest interval usage is streamed at.
+const minStatsInterval = 100 * time.Millisecond
+
+// statsInterval returns the interval to stream usage at for a request with
+// the given stream and stats_interval, or 0 if it shouldn't be.
+func statsInterval(stream *bool, d *api.Duration) time.Duration {
+	if d == nil || d.Duration <= 0 || (stream != nil && !*stream) {
+		return 0
+	}
+
+	return max(d.Duration, minStatsInterval)
+}
+
+// usageTracker reports the progress of a completion as [api.Usage].
+type usageTracker struct {
+	evalCount    int
+	evalDuration time.Duration
+
+	// partial is the usage of the completion so far, which is reported if
+	// it fails
+	partial api.Usage
+}
+
+// observe records the response cr of the completion in the partial usage.
+func (u *usageTracker) observe(cr llm.CompletionResponse) {
+	switch {
+	case cr.Progress || cr.Done:
+		u.partial.PromptEvalCount = cr.PromptEvalCount
+		u.partial.PromptTokens = cr.PromptTokens
+		u.partial.EvalCount = cr.EvalCount
+	case cr.Content != "":
+		// the counts are only reported every stats interval, so the
+		// responses since are counted as a token each
+		u.partial.EvalCount++
+	}
+}
+
+func (u *usageTracker) usage(cr llm.CompletionResponse) *api.Usage {
+	usage := api.Usage{
+		PromptEvalCount: cr.PromptEvalCount,
+		PromptTokens:    cr.PromptTokens,
+		EvalCount:       cr.EvalCount,
+	}
+
+	if d := cr.EvalDuration - u.evalDuration; d > 0 {
+		usage.TokensPerSecond = float64(cr.EvalCount-u.evalCount) / d.Seconds()
+	}
+
+	u.evalCount, u.evalDuration = cr.EvalCount, cr.EvalDuration
+	return &usage
+}
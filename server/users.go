@@ -0,0 +1,428 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/goobla/goobla/envconfig"
+	"github.com/goobla/goobla/types/model"
+)
+
+// In multi-user mode, enabled with GOOBLA_MULTI_USER, every request must be
+// signed with a key listed in the authorized keys file, which names the user
+// the key belongs to. Each user owns the namespace with their name: only they
+// can see the models in it, and it is the only namespace they can create,
+// copy, import or delete models in. Models in other namespaces, such as those
+// pulled from the library, are shared by all users.
+//
+// The authorized keys file uses the format of OpenSSH's authorized_keys, with
+// the user name as the comment:
+//
+//	ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIK0wmN/Cr3JXqmLW7u+g9pTh+wyqDHpSQEIQczXkVx9q alice
+//
+// Requests are signed by the client as it does for GOOBLA_AUTH, over the
+// method, path and query of the request. The query has the time the request
+// was signed and a nonce, which can only be used once, so a signed request
+// can't be replayed.
+//
+// Users of OIDC tokens own namespaces the same way. They're recorded in
+// oidc_users.json in the models directory the first time they make a
+// request, so their namespaces stay private. A token can't claim a reserved
+// namespace, such as library, or one that already has models but no user.
+
+const userKey = "user"
+
+// maxSignatureAge is how far the timestamp of a signed request may be from
+// the server's clock.
+const maxSignatureAge = 5 * time.Minute
+
+var errUnauthenticated = errors.New("unauthenticated")
+
+// usedNonces are the nonces of signed requests, with when they expire, which
+// is when their requests' signatures would.
+var usedNonces struct {
+	mu     sync.Mutex
+	nonces map[string]time.Time
+	pruned time.Time
+}
+
+// useNonce records the nonce of a request signed by key at ts, reporting
+// whether it hadn't been used yet.
+func useNonce(key, nonce string, ts time.Time) bool {
+	usedNonces.mu.Lock()
+	defer usedNonces.mu.Unlock()
+
+	now := time.Now()
+	if usedNonces.nonces == nil {
+		usedNonces.nonces = make(map[string]time.Time)
+	}
+
+	if now.Sub(usedNonces.pruned) > time.Minute {
+		for k, expires := range usedNonces.nonces {
+			if now.After(expires) {
+				delete(usedNonces.nonces, k)
+			}
+		}
+		usedNonces.pruned = now
+	}
+
+	k := key + ":" + nonce
+	if _, ok := usedNonces.nonces[k]; ok {
+		return false
+	}
+
+	usedNonces.nonces[k] = ts.Add(maxSignatureAge)
+	return true
+}
+
+// reservedNamespaces are shared by all users, so can't be a user's.
+var reservedNamespaces = []string{"library"}
+
+// authorizedKeys are the users of a multi-user server, keyed by the base64
+// encoded public key, cached until the file changes.
+var authorizedKeys cachedFile[map[string]string]
+
+func loadAuthorizedKeys() (map[string]string, error) {
+	authorizedKeys.Lock()
+	defer authorizedKeys.Unlock()
+
+	return authorizedKeys.load(envconfig.AuthorizedKeys(), parseAuthorizedKeys)
+}
+
+func parseAuthorizedKeys(p string, b []byte) (map[string]string, error) {
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; scanner.Scan(); line++ {
+		if s := strings.TrimSpace(scanner.Text()); s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+
+		key, user, _, _, err := ssh.ParseAuthorizedKey(scanner.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", p, line, err)
+		}
+
+		if !isValidUser(user) {
+			return nil, fmt.Errorf("%s:%d: invalid user name %q", p, line, user)
+		}
+
+		users[base64.StdEncoding.EncodeToString(key.Marshal())] = user
+	}
+
+	return users, nil
+}
+
+// isValidUser reports whether user can be used as a model namespace.
+func isValidUser(user string) bool {
+	return model.Name{Host: "h", Namespace: user, Model: "m", Tag: "t"}.IsValid() &&
+		!slices.ContainsFunc(reservedNamespaces, func(ns string) bool { return strings.EqualFold(ns, user) })
+}
+
+// isUser reports whether namespace belongs to a user.
+func isUser(namespace string) bool {
+	if !isValidUser(namespace) {
+		return false
+	}
+
+	if isAuthorizedUser(namespace) {
+		return true
+	}
+
+	users, err := loadOIDCUsers()
+	if err != nil {
+		slog.Error("couldn't load OIDC users", "error", err)
+		// without the list, every namespace may be a user's
+		return true
+	}
+
+	return users[strings.ToLower(namespace)]
+}
+
+// isAuthorizedUser reports whether namespace belongs to a user in the
+// authorized keys file.
+func isAuthorizedUser(namespace string) bool {
+	users, err := loadAuthorizedKeys()
+	if err != nil {
+		return false
+	}
+
+	for _, user := range users {
+		if strings.EqualFold(user, namespace) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// oidcUsers are the users that have made requests with OIDC tokens, keyed by
+// their lowercased names, cached until the file changes.
+var oidcUsers cachedFile[map[string]bool]
+
+func oidcUsersPath() (string, error) {
+	dir, err := envconfig.Models()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "oidc_users.json"), nil
+}
+
+func loadOIDCUsers() (map[string]bool, error) {
+	oidcUsers.Lock()
+	defer oidcUsers.Unlock()
+
+	return loadOIDCUsersLocked()
+}
+
+// loadOIDCUsersLocked loads the OIDC users. It must be called with
+// oidcUsers locked.
+func loadOIDCUsersLocked() (map[string]bool, error) {
+	p, err := oidcUsersPath()
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := oidcUsers.load(p, func(p string, b []byte) (map[string]bool, error) {
+		var list []string
+		if err := json.Unmarshal(b, &list); err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+
+		users := make(map[string]bool, len(list))
+		for _, user := range list {
+			users[strings.ToLower(user)] = true
+		}
+		return users, nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]bool{}, nil
+	}
+	return users, err
+}
+
+// registerOIDCUser records user as the owner of their namespace, unless the
+// namespace has models and isn't already a user's, since it's then shared.
+func registerOIDCUser(user string) error {
+	oidcUsers.Lock()
+	defer oidcUsers.Unlock()
+
+	users, err := loadOIDCUsersLocked()
+	if err != nil {
+		return err
+	}
+
+	if users[strings.ToLower(user)] {
+		return nil
+	}
+
+	if isAuthorizedUser(user) {
+		return nil
+	}
+
+	ms, err := Manifests(true)
+	if err != nil {
+		return err
+	}
+
+	for n := range ms {
+		if strings.EqualFold(n.Namespace, user) {
+			return fmt.Errorf("%w: namespace %q is shared", errInvalidToken, user)
+		}
+	}
+
+	list := slices.Sorted(maps.Keys(users))
+	list = append(list, strings.ToLower(user))
+
+	b, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+
+	p, err := oidcUsersPath()
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(p, b, 0o600); err != nil {
+		return err
+	}
+
+	oidcUsers.reset()
+	return nil
+}
+
+// authenticate returns the user that signed r.
+func authenticate(r *http.Request) (string, error) {
+	pub, sig, ok := strings.Cut(r.Header.Get("Authorization"), ":")
+	if !ok {
+		return "", fmt.Errorf("%w: missing signature", errUnauthenticated)
+	}
+
+	query := r.URL.Query()
+	unix, err := strconv.ParseInt(query.Get("ts"), 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("%w: missing timestamp", errUnauthenticated)
+	}
+
+	if d := time.Since(time.Unix(unix, 0)); d > maxSignatureAge || d < -maxSignatureAge {
+		return "", fmt.Errorf("%w: signature expired", errUnauthenticated)
+	}
+
+	nonce := query.Get("nonce")
+	if nonce == "" {
+		return "", fmt.Errorf("%w: missing nonce", errUnauthenticated)
+	}
+
+	users, err := loadAuthorizedKeys()
+	if err != nil {
+		slog.Error("couldn't load authorized keys", "error", err)
+		return "", fmt.Errorf("%w: no authorized keys", errUnauthenticated)
+	}
+
+	user, ok := users[pub]
+	if !ok {
+		return "", fmt.Errorf("%w: unknown key", errUnauthenticated)
+	}
+
+	keyBytes, err := base64.StdEncoding.DecodeString(pub)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errUnauthenticated, err)
+	}
+
+	key, err := ssh.ParsePublicKey(keyBytes)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errUnauthenticated, err)
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errUnauthenticated, err)
+	}
+
+	challenge := fmt.Sprintf("%s,%s?%s", r.Method, r.URL.Path, query.Encode())
+	if err := key.Verify([]byte(challenge), &ssh.Signature{Format: key.Type(), Blob: blob}); err != nil {
+		return "", fmt.Errorf("%w: invalid signature", errUnauthenticated)
+	}
+
+	// nonces are only recorded for valid signatures, so others can't use
+	// them up
+	if !useNonce(pub, nonce, time.Unix(unix, 0)) {
+		return "", fmt.Errorf("%w: signature already used", errUnauthenticated)
+	}
+
+	return user, nil
+}
+
+// multiUserMiddleware authenticates requests when the server is in
+// multi-user mode, recording the user for the handlers.
+func multiUserMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !envconfig.MultiUser() {
+			c.Next()
+			return
+		}
+
+		switch c.Request.URL.Path {
+		case "/", "/api/version", "/api/health/live", "/api/health/ready", "/metrics":
+			c.Next()
+			return
+		}
+
+		// requests made with OIDC tokens have the user of the token, which
+		// is checked by apiKeyMiddleware
+		if oidcEnabled() && isJWT(requestAPIKey(c)) {
+			c.Next()
+			return
+		}
+
+		user, err := authenticate(c.Request)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Set(userKey, user)
+		c.Next()
+	}
+}
+
+// requestUser returns the user making the request, or "" if the server is
+// not in multi-user mode.
+func requestUser(c *gin.Context) string {
+	return c.GetString(userKey)
+}
+
+// canRead reports whether user may use the model n, which they can unless
+// it is in another user's namespace.
+func canRead(user string, n model.Name) bool {
+	return user == "" || strings.EqualFold(n.Namespace, user) || !isUser(n.Namespace)
+}
+
+// canWrite reports whether user may create or remove the model n, which must
+// be in their namespace.
+func canWrite(user string, n model.Name) bool {
+	return user == "" || strings.EqualFold(n.Namespace, user)
+}
+
+// canReadBlob reports whether user may download the blob digest, which must
+// be part of a model they can use.
+func canReadBlob(user, digest string) bool {
+	ms, err := Manifests(true)
+	if err != nil {
+		return false
+	}
+
+	digest = strings.Replace(digest, "-", ":", 1)
+	for n, m := range ms {
+		if !canRead(user, n) {
+			continue
+		}
+
+		for _, l := range append(m.Layers, m.Config) {
+			if l.Digest == digest {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// checkWrite aborts the request if its user may not create or remove the
+// model n, reporting whether it may continue.
+func checkWrite(c *gin.Context, n model.Name) bool {
+	if user := requestUser(c); !canWrite(user, n) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("models can only be changed in your namespace, such as %s/%s", user, n.Model)})
+		return false
+	}
+	return true
+}
+
+// checkRead aborts the request if its user may not use the model n,
+// reporting whether it may continue. Models in other users' namespaces are
+// reported as not found.
+func checkRead(c *gin.Context, n model.Name) bool {
+	if !canRead(requestUser(c), n) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", n.DisplayShortest())})
+		return false
+	}
+	return true
+}
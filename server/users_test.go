@@ -0,0 +1,197 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/fs/ggml"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	return signer
+}
+
+// signedRequest returns a request signed by signer at ts, as the client
+// signs them, or an unsigned request if signer is nil.
+func signedRequest(t *testing.T, signer ssh.Signer, method, path string, ts time.Time, body io.Reader) *http.Request {
+	t.Helper()
+
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	require.NoError(t, err)
+
+	query := url.Values{}
+	query.Set("ts", strconv.FormatInt(ts.Unix(), 10))
+	query.Set("nonce", base64.RawURLEncoding.EncodeToString(nonce))
+
+	req := httptest.NewRequest(method, path+"?"+query.Encode(), body)
+	if signer != nil {
+		sig, err := signer.Sign(rand.Reader, fmt.Appendf(nil, "%s,%s?%s", method, path, query.Encode()))
+		require.NoError(t, err)
+		pub := base64.StdEncoding.EncodeToString(signer.PublicKey().Marshal())
+		req.Header.Set("Authorization", pub+":"+base64.StdEncoding.EncodeToString(sig.Blob))
+	}
+
+	return req
+}
+
+func TestMultiUser(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	var s Server
+	_, digest := createBinFile(t, ggml.KV{"general.architecture": "test"}, nil)
+	for _, name := range []string{"alice/private", "bob/private", "shared"} {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model: name,
+			Files: map[string]string{"model.gguf": digest},
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	alice, bob, stranger := newTestSigner(t), newTestSigner(t), newTestSigner(t)
+
+	var keys bytes.Buffer
+	fmt.Fprintf(&keys, "# team box\n")
+	fmt.Fprintf(&keys, "%s alice\n", bytes.TrimSpace(ssh.MarshalAuthorizedKey(alice.PublicKey())))
+	fmt.Fprintf(&keys, "%s bob\n", bytes.TrimSpace(ssh.MarshalAuthorizedKey(bob.PublicKey())))
+	p := filepath.Join(t.TempDir(), "authorized_keys")
+	require.NoError(t, os.WriteFile(p, keys.Bytes(), 0o600))
+
+	t.Setenv("GOOBLA_AUTHORIZED_KEYS", p)
+	t.Setenv("GOOBLA_MULTI_USER", "1")
+
+	r := gin.New()
+	r.Use(multiUserMiddleware())
+	r.GET("/api/version", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"version": "0.0.0"}) })
+	r.GET("/api/tags", s.ListHandler)
+	r.POST("/api/show", s.ShowHandler)
+	r.POST("/api/copy", s.CopyHandler)
+	r.DELETE("/api/delete", s.DeleteHandler)
+
+	do := func(signer ssh.Signer, method, path string, body any) *httptest.ResponseRecorder {
+		var b bytes.Buffer
+		if body != nil {
+			require.NoError(t, json.NewEncoder(&b).Encode(body))
+		}
+
+		req := signedRequest(t, signer, method, path, time.Now(), &b)
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, do(nil, http.MethodGet, "/api/version", nil).Code)
+		assert.Equal(t, http.StatusUnauthorized, do(nil, http.MethodGet, "/api/tags", nil).Code)
+		assert.Equal(t, http.StatusUnauthorized, do(stranger, http.MethodGet, "/api/tags", nil).Code)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		w := do(alice, http.MethodGet, "/api/tags", nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var resp api.ListResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+
+		var names []string
+		for _, m := range resp.Models {
+			names = append(names, m.Name)
+		}
+		assert.ElementsMatch(t, []string{"alice/private:latest", "shared:latest"}, names)
+	})
+
+	t.Run("show", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, do(alice, http.MethodPost, "/api/show", api.ShowRequest{Model: "alice/private"}).Code)
+		assert.Equal(t, http.StatusOK, do(alice, http.MethodPost, "/api/show", api.ShowRequest{Model: "shared"}).Code)
+		assert.Equal(t, http.StatusNotFound, do(alice, http.MethodPost, "/api/show", api.ShowRequest{Model: "bob/private"}).Code)
+	})
+
+	t.Run("copy", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, do(alice, http.MethodPost, "/api/copy", api.CopyRequest{Source: "shared", Destination: "alice/copy"}).Code)
+		assert.Equal(t, http.StatusForbidden, do(alice, http.MethodPost, "/api/copy", api.CopyRequest{Source: "shared", Destination: "bob/copy"}).Code)
+		assert.Equal(t, http.StatusForbidden, do(alice, http.MethodPost, "/api/copy", api.CopyRequest{Source: "shared", Destination: "copy"}).Code)
+		assert.Equal(t, http.StatusNotFound, do(alice, http.MethodPost, "/api/copy", api.CopyRequest{Source: "bob/private", Destination: "alice/stolen"}).Code)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, do(alice, http.MethodDelete, "/api/delete", api.DeleteRequest{Model: "bob/private"}).Code)
+		assert.Equal(t, http.StatusForbidden, do(alice, http.MethodDelete, "/api/delete", api.DeleteRequest{Model: "shared"}).Code)
+		assert.Equal(t, http.StatusOK, do(bob, http.MethodDelete, "/api/delete", api.DeleteRequest{Model: "bob/private"}).Code)
+	})
+}
+
+func TestAuthenticateExpired(t *testing.T) {
+	signer := newTestSigner(t)
+
+	p := filepath.Join(t.TempDir(), "authorized_keys")
+	require.NoError(t, os.WriteFile(p, fmt.Appendf(nil, "%s alice\n", bytes.TrimSpace(ssh.MarshalAuthorizedKey(signer.PublicKey()))), 0o600))
+	t.Setenv("GOOBLA_AUTHORIZED_KEYS", p)
+
+	req := signedRequest(t, signer, http.MethodGet, "/api/tags", time.Now().Add(-time.Hour), nil)
+	_, err := authenticate(req)
+	assert.ErrorIs(t, err, errUnauthenticated)
+}
+
+func TestAuthenticateReplay(t *testing.T) {
+	signer := newTestSigner(t)
+
+	p := filepath.Join(t.TempDir(), "authorized_keys")
+	require.NoError(t, os.WriteFile(p, fmt.Appendf(nil, "%s alice\n", bytes.TrimSpace(ssh.MarshalAuthorizedKey(signer.PublicKey()))), 0o600))
+	t.Setenv("GOOBLA_AUTHORIZED_KEYS", p)
+
+	req := signedRequest(t, signer, http.MethodPost, "/api/delete", time.Now(), nil)
+	user, err := authenticate(req)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", user)
+
+	// the same signature can't be used again, even with another body
+	replay := httptest.NewRequest(http.MethodPost, req.URL.String(), strings.NewReader(`{"model":"alice/other"}`))
+	replay.Header = req.Header.Clone()
+	_, err = authenticate(replay)
+	assert.ErrorIs(t, err, errUnauthenticated)
+
+	// the signature covers the query
+	req = signedRequest(t, signer, http.MethodGet, "/api/tags", time.Now(), nil)
+	q := req.URL.Query()
+	q.Set("filter", "other")
+	req.URL.RawQuery = q.Encode()
+	_, err = authenticate(req)
+	assert.ErrorIs(t, err, errUnauthenticated)
+
+	// requests without a nonce are refused
+	req = signedRequest(t, signer, http.MethodGet, "/api/tags", time.Now(), nil)
+	q = req.URL.Query()
+	q.Del("nonce")
+	req.URL.RawQuery = q.Encode()
+	_, err = authenticate(req)
+	assert.ErrorIs(t, err, errUnauthenticated)
+}
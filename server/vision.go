@@ -0,0 +1,327 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/envconfig"
+	"github.com/goobla/goobla/llm"
+	"github.com/goobla/goobla/model/imageproc"
+)
+
+// Images are sent in requests as base64 encoded data, or as the URLs or
+// paths of images for the server to load. Images are only fetched from the
+// hosts in GOOBLA_IMAGE_HOSTS and read from the directories in
+// GOOBLA_IMAGE_PATHS, which are both empty by default. Images larger than
+// the model's vision encoder takes are scaled down before they're sent to
+// the runner, since it would scale them down anyway.
+
+const (
+	// maxImageBytes is the largest image that is loaded
+	maxImageBytes = 32 << 20
+
+	// maxImagePixels is the most pixels an image can have, since small
+	// files can decode to very large images
+	maxImagePixels = 64_000_000
+
+	imageFetchTimeout = 30 * time.Second
+)
+
+var (
+	errImageNotAllowed = errors.New("image isn't allowed")
+	errImageTooLarge   = errors.New("image is too large")
+)
+
+var imageClient = &http.Client{
+	Timeout: imageFetchTimeout,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+
+		// redirects are checked too, so allowed hosts can't redirect to
+		// ones that aren't
+		if !imageHostAllowed(req.URL.Hostname()) {
+			return fmt.Errorf("%w: %s isn't in GOOBLA_IMAGE_HOSTS", errImageNotAllowed, req.URL.Hostname())
+		}
+		return nil
+	},
+}
+
+// imageErrorStatus returns the status of a request whose images failed to
+// load with err.
+func imageErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errImageNotAllowed):
+		return http.StatusForbidden
+	case errors.Is(err, errOffline):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// prepareImages replaces the references in lists with the images they refer
+// to, and fits the images to the vision encoder of m.
+func prepareImages(ctx context.Context, m *Model, lists ...[]api.ImageData) error {
+	size := -1
+	for _, images := range lists {
+		for i, data := range images {
+			if ref := data.Ref(); ref != "" {
+				var err error
+				data, err = loadImage(ctx, ref)
+				if err != nil {
+					return fmt.Errorf("failed to load image %s: %w", ref, err)
+				}
+			}
+
+			if size < 0 {
+				size = visionImageSize(m)
+			}
+
+			// images that can't be decoded are left for the runner to
+			// reject, as they were before they were fitted
+			if fitted, err := fitImage(data, size); err == nil {
+				data = fitted
+			} else if errors.Is(err, errImageTooLarge) {
+				return err
+			} else {
+				slog.Debug("unable to fit image", "error", err)
+			}
+
+			images[i] = data
+		}
+	}
+
+	return nil
+}
+
+// loadImage returns the image at ref, an http(s) or file URL or a path.
+func loadImage(ctx context.Context, ref string) ([]byte, error) {
+	u, err := url.Parse(ref)
+	if err == nil {
+		switch u.Scheme {
+		case "http", "https":
+			return fetchImage(ctx, u)
+		case "file":
+			path := filepath.FromSlash(u.Path)
+			if runtime.GOOS == "windows" {
+				// file:///C:/image.png has the path /C:/image.png
+				path = strings.TrimPrefix(path, `\`)
+			}
+			return readImage(path)
+		}
+	}
+
+	return readImage(ref)
+}
+
+func imageHostAllowed(host string) bool {
+	return slices.ContainsFunc(envconfig.ImageHosts(), func(h string) bool {
+		return h == "*" || strings.EqualFold(h, host)
+	})
+}
+
+func fetchImage(ctx context.Context, u *url.URL) ([]byte, error) {
+	if !imageHostAllowed(u.Hostname()) {
+		return nil, fmt.Errorf("%w: %s isn't in GOOBLA_IMAGE_HOSTS", errImageNotAllowed, u.Hostname())
+	}
+
+	if envconfig.Offline() {
+		return nil, errOffline
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := imageClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, errors.New(resp.Status)
+	}
+
+	return readImageData(resp.Body)
+}
+
+// imagePathAllowed reports whether path is in one of the directories in
+// GOOBLA_IMAGE_PATHS.
+func imagePathAllowed(path string) bool {
+	return slices.ContainsFunc(envconfig.ImagePaths(), func(dir string) bool {
+		dirs := []string{dir}
+		if real, err := filepath.EvalSymlinks(dir); err == nil {
+			dirs = append(dirs, real)
+		}
+
+		return slices.ContainsFunc(dirs, func(dir string) bool {
+			rel, err := filepath.Rel(dir, path)
+			return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+		})
+	})
+}
+
+func readImage(path string) ([]byte, error) {
+	path = filepath.Clean(path)
+	if !imagePathAllowed(path) {
+		return nil, fmt.Errorf("%w: %s isn't in GOOBLA_IMAGE_PATHS", errImageNotAllowed, path)
+	}
+
+	// links are resolved so the ones in allowed directories can't point
+	// outside of them
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !imagePathAllowed(real) {
+		return nil, fmt.Errorf("%w: %s isn't in GOOBLA_IMAGE_PATHS", errImageNotAllowed, path)
+	}
+
+	f, err := os.Open(real)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return readImageData(f)
+}
+
+func readImageData(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxImageBytes+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > maxImageBytes {
+		return nil, fmt.Errorf("image is larger than %d bytes", maxImageBytes)
+	}
+
+	return data, nil
+}
+
+// visionImageSizes caches the result of visionImageSize by model digest, so
+// models aren't read for each request with images.
+var visionImageSizes sync.Map
+
+// visionImageSize returns the longest side, in pixels, of the largest images
+// the vision encoder of m takes, or 0 if it's unknown.
+func visionImageSize(m *Model) int {
+	if m.Digest == "" {
+		return readVisionImageSize(m)
+	}
+
+	if size, ok := visionImageSizes.Load(m.Digest); ok {
+		return size.(int)
+	}
+
+	size := readVisionImageSize(m)
+	visionImageSizes.Store(m.Digest, size)
+	return size
+}
+
+func readVisionImageSize(m *Model) int {
+	if f, err := llm.LoadModel(m.ModelPath, 0); err == nil {
+		kv := f.KV()
+		switch kv.Architecture() {
+		case "gemma3":
+			return int(kv.Uint("vision.image_size"))
+		case "mllama":
+			// images are split into tiles of image_size, which may all be
+			// in a row
+			return int(kv.Uint("vision.image_size") * kv.Uint("vision.max_num_tiles"))
+		case "mistral3":
+			return int(kv.Uint("vision.longest_edge", 1540))
+		case "qwen25vl":
+			return int(math.Sqrt(float64(kv.Uint("vision.max_pixels", 28*28*1280))))
+		}
+	}
+
+	for _, path := range m.ProjectorPaths {
+		f, err := llm.LoadModel(path, 64)
+		if err != nil || f.KV().Architecture() != "clip" {
+			continue
+		}
+
+		kv := f.KV()
+		switch kv.String("clip.projector_type") {
+		case "resampler", "qwen2vl_merger", "qwen2.5vl_merger":
+			// these split images into slices or patches of any number
+			return 0
+		}
+
+		// the pinpoints are the sizes of the grids images are split into
+		if pinpoints := kv.Ints("clip.vision.image_grid_pinpoints"); len(pinpoints) > 0 {
+			return int(slices.Max(pinpoints))
+		}
+
+		return int(kv.Uint("vision.image_size"))
+	}
+
+	return 0
+}
+
+// fitImage scales the image in data down so its longest side is at most size,
+// if size isn't 0. Images that aren't JPEG or PNG are converted to PNG, which
+// every runner decodes.
+func fitImage(data []byte, size int) ([]byte, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return nil, fmt.Errorf("%w: %dx%d is more than %d pixels", errImageTooLarge, config.Width, config.Height, maxImagePixels)
+	}
+
+	longest := max(config.Width, config.Height)
+	resize := size > 0 && longest > size
+	if !resize && (format == "jpeg" || format == "png") {
+		return data, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if resize {
+		width := max(config.Width*size/longest, 1)
+		height := max(config.Height*size/longest, 1)
+		img = imageproc.Resize(imageproc.Composite(img), image.Point{width, height}, imageproc.ResizeBilinear)
+	}
+
+	var b bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&b, img, &jpeg.Options{Quality: 95})
+	} else {
+		err = png.Encode(&b, img)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
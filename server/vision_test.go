@@ -0,0 +1,233 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/image/bmp"
+
+	"github.com/goobla/goobla/api"
+)
+
+func testImage(t *testing.T, width, height int, encode func(*bytes.Buffer, image.Image) error) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	if err := encode(&b, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func encodePNG(b *bytes.Buffer, img image.Image) error { return png.Encode(b, img) }
+
+// pngHeader returns the start of a PNG image of width by height pixels, which
+// is enough to read its size but not to decode it.
+func pngHeader(width, height uint32) []byte {
+	ihdr := binary.BigEndian.AppendUint32([]byte("IHDR"), width)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, height)
+	ihdr = append(ihdr, 8, 6, 0, 0, 0)
+
+	b := []byte("\x89PNG\r\n\x1a\n")
+	b = binary.BigEndian.AppendUint32(b, uint32(len(ihdr)-4))
+	b = append(b, ihdr...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(ihdr))
+}
+
+func encodeBMP(b *bytes.Buffer, img image.Image) error { return bmp.Encode(b, img) }
+
+func TestLoadImagePath(t *testing.T) {
+	data := testImage(t, 4, 4, encodePNG)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "image.png")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	outside := filepath.Join(t.TempDir(), "image.png")
+	if err := os.WriteFile(outside, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	link := filepath.Join(dir, "link.png")
+	if err := os.Symlink(outside, link); err != nil {
+		t.Skip("symlinks not supported")
+	}
+
+	if _, err := loadImage(t.Context(), path); !errors.Is(err, errImageNotAllowed) {
+		t.Fatalf("expected %v, got %v", errImageNotAllowed, err)
+	}
+
+	t.Setenv("GOOBLA_IMAGE_PATHS", dir)
+
+	for _, ref := range []string{path, (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()} {
+		got, err := loadImage(t.Context(), ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: image mismatch", ref)
+		}
+	}
+
+	for _, ref := range []string{outside, link, filepath.Join(dir, "..", filepath.Base(filepath.Dir(outside)), "image.png")} {
+		if _, err := loadImage(t.Context(), ref); !errors.Is(err, errImageNotAllowed) {
+			t.Errorf("%s: expected %v, got %v", ref, errImageNotAllowed, err)
+		}
+	}
+}
+
+func TestLoadImageURL(t *testing.T) {
+	data := testImage(t, 4, 4, encodePNG)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image.png":
+			w.Write(data)
+		case "/redirect":
+			http.Redirect(w, r, "http://example.com/image.png", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	if _, err := loadImage(t.Context(), srv.URL+"/image.png"); !errors.Is(err, errImageNotAllowed) {
+		t.Fatalf("expected %v, got %v", errImageNotAllowed, err)
+	}
+
+	t.Setenv("GOOBLA_IMAGE_HOSTS", "127.0.0.1")
+
+	got, err := loadImage(t.Context(), srv.URL+"/image.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Error("image mismatch")
+	}
+
+	if _, err := loadImage(t.Context(), srv.URL+"/missing.png"); err == nil {
+		t.Error("expected error")
+	}
+
+	if _, err := loadImage(t.Context(), srv.URL+"/redirect"); !errors.Is(err, errImageNotAllowed) {
+		t.Errorf("expected %v, got %v", errImageNotAllowed, err)
+	}
+
+	t.Setenv("GOOBLA_OFFLINE", "1")
+
+	if _, err := loadImage(t.Context(), srv.URL+"/image.png"); !errors.Is(err, errOffline) {
+		t.Errorf("expected %v, got %v", errOffline, err)
+	}
+}
+
+func TestFitImage(t *testing.T) {
+	cases := []struct {
+		name          string
+		data          []byte
+		size          int
+		width, height int
+		format        string
+	}{
+		{name: "smaller", data: testImage(t, 100, 50, encodePNG), size: 200, width: 100, height: 50, format: "png"},
+		{name: "larger", data: testImage(t, 100, 50, encodePNG), size: 20, width: 20, height: 10, format: "png"},
+		{name: "unknown size", data: testImage(t, 100, 50, encodePNG), width: 100, height: 50, format: "png"},
+		{name: "bmp", data: testImage(t, 100, 50, encodeBMP), size: 200, width: 100, height: 50, format: "png"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := fitImage(tt.data, tt.size)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			config, format, err := image.DecodeConfig(bytes.NewReader(got))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if config.Width != tt.width || config.Height != tt.height || format != tt.format {
+				t.Errorf("expected %dx%d %s, got %dx%d %s", tt.width, tt.height, tt.format, config.Width, config.Height, format)
+			}
+		})
+	}
+
+	if _, err := fitImage([]byte("image"), 20); err == nil {
+		t.Error("expected error")
+	}
+
+	// images with too many pixels aren't decoded
+	if _, err := fitImage(pngHeader(1<<16, 1<<16), 20); !errors.Is(err, errImageTooLarge) {
+		t.Errorf("expected %v, got %v", errImageTooLarge, err)
+	}
+}
+
+func TestVisionImageSizeCache(t *testing.T) {
+	m := &Model{Digest: "sha256:" + t.Name(), ModelPath: filepath.Join(t.TempDir(), "missing")}
+	if size := visionImageSize(m); size != 0 {
+		t.Fatalf("expected 0, got %d", size)
+	}
+
+	// the size is only read once for each model
+	visionImageSizes.Store(m.Digest, 896)
+	t.Cleanup(func() { visionImageSizes.Delete(m.Digest) })
+	if size := visionImageSize(m); size != 896 {
+		t.Errorf("expected the cached size, got %d", size)
+	}
+}
+
+func TestPrepareImages(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "image.png")
+	if err := os.WriteFile(path, testImage(t, 4, 4, encodePNG), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "large.png"), pngHeader(1<<16, 1<<16), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("GOOBLA_IMAGE_PATHS", dir)
+
+	images := []api.ImageData{api.ImageData(path), api.ImageData("image")}
+	if err := prepareImages(t.Context(), &Model{}, images); err != nil {
+		t.Fatal(err)
+	}
+
+	if images[0].Ref() != "" {
+		t.Error("expected the path to be replaced by the image")
+	}
+
+	// images that can't be decoded are kept for the runner to reject
+	if string(images[1]) != "image" {
+		t.Errorf("expected image to be kept, got %q", images[1])
+	}
+
+	for _, tt := range []struct {
+		path   string
+		status int
+	}{
+		{filepath.Join(dir, "missing.png"), http.StatusBadRequest},
+		{filepath.Join(t.TempDir(), "image.png"), http.StatusForbidden},
+		{filepath.Join(dir, "large.png"), http.StatusBadRequest},
+	} {
+		err := prepareImages(t.Context(), &Model{}, []api.ImageData{api.ImageData(tt.path)})
+		if imageErrorStatus(err) != tt.status {
+			t.Errorf("%s: expected %d, got %d: %v", tt.path, tt.status, imageErrorStatus(err), err)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"slices"
+	"time"
+
+	"github.com/goobla/goobla/envconfig"
+	"github.com/goobla/goobla/version"
+)
+
+// Webhooks are notified of model lifecycle events with a POST of the event
+// as JSON. Events are signed with HMAC-SHA256 of the body using the webhook's
+// secret, sent as "sha256=<hex>" in the X-Goobla-Signature header.
+
+const (
+	eventModelPulled     = "model.pulled"
+	eventModelCreated    = "model.created"
+	eventModelDeleted    = "model.deleted"
+	eventModelLoadFailed = "model.load_failed"
+	eventServerStarted   = "server.started"
+)
+
+var webhookEvents = []string{eventModelPulled, eventModelCreated, eventModelDeleted, eventModelLoadFailed, eventServerStarted}
+
+const (
+	webhookTimeout  = 10 * time.Second
+	webhookAttempts = 3
+)
+
+// webhookBackoff is the delay before retrying a failed delivery, multiplied
+// by the number of attempts so far.
+var webhookBackoff = 5 * time.Second
+
+// webhookConfig is a URL notified of events, as read from the webhooks config
+// file:
+//
+//	{
+//	  "webhooks": [
+//	    {
+//	      "url": "https://hooks.example.com/goobla",
+//	      "secret": "...",
+//	      "events": ["model.pulled", "model.deleted"]
+//	    }
+//	  ]
+//	}
+//
+// A webhook without events is notified of all of them.
+type webhookConfig struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret,omitempty"`
+	Events []string `json:"events,omitempty"`
+}
+
+type webhooksFile struct {
+	Webhooks []webhookConfig `json:"webhooks"`
+}
+
+// loadWebhooks returns the webhooks in GOOBLA_WEBHOOKS followed by those in
+// the webhooks config file. The file is read on each call so changes take
+// effect without restarting the server.
+func loadWebhooks() ([]webhookConfig, error) {
+	var hooks []webhookConfig
+	for _, u := range envconfig.Webhooks() {
+		hooks = append(hooks, webhookConfig{URL: u, Secret: envconfig.WebhookSecret()})
+	}
+
+	p := envconfig.WebhooksConfig()
+	b, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		// only the webhooks from the environment
+	} else if err != nil {
+		return nil, err
+	} else {
+		var f webhooksFile
+		if err := json.Unmarshal(b, &f); err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+
+		for _, h := range f.Webhooks {
+			for _, e := range h.Events {
+				if !slices.Contains(webhookEvents, e) {
+					return nil, fmt.Errorf("%s: webhook %q: unknown event %q", p, h.URL, e)
+				}
+			}
+		}
+
+		hooks = append(hooks, f.Webhooks...)
+	}
+
+	for _, h := range hooks {
+		if u, err := url.Parse(h.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid webhook url %q", h.URL)
+		}
+	}
+
+	return hooks, nil
+}
+
+// webhookEvent is the body sent to webhooks.
+type webhookEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Model string    `json:"model,omitempty"`
+	// Digest is the digest of a pulled model's manifest.
+	Digest string `json:"digest,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Text describes the event for chat services such as Slack, which
+	// display the text field of incoming messages.
+	Text string `json:"text"`
+}
+
+func (e webhookEvent) text() string {
+	switch e.Event {
+	case eventModelPulled:
+		return fmt.Sprintf("Goobla pulled %s", e.Model)
+	case eventModelCreated:
+		return fmt.Sprintf("Goobla created %s", e.Model)
+	case eventModelDeleted:
+		return fmt.Sprintf("Goobla deleted %s", e.Model)
+	case eventModelLoadFailed:
+		return fmt.Sprintf("Goobla failed to load %s: %s", e.Model, e.Error)
+	case eventServerStarted:
+		return fmt.Sprintf("Goobla %s started", version.Version)
+	default:
+		return e.Event
+	}
+}
+
+// notify sends e to the webhooks that want it, unless the server is
+// offline. Delivery happens in the background and failures are only logged.
+func notify(e webhookEvent) {
+	if envconfig.Offline() {
+		return
+	}
+
+	hooks, err := loadWebhooks()
+	if err != nil {
+		slog.Warn("ignoring invalid webhooks config", "error", err)
+		return
+	}
+
+	if len(hooks) == 0 {
+		return
+	}
+
+	e.Time = time.Now().UTC()
+	e.Text = e.text()
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		slog.Warn("couldn't encode webhook event", "event", e.Event, "error", err)
+		return
+	}
+
+	for _, h := range hooks {
+		if len(h.Events) == 0 || slices.Contains(h.Events, e.Event) {
+			go h.deliver(e.Event, b)
+		}
+	}
+}
+
+// deliver posts body to the webhook, retrying failures.
+func (h webhookConfig) deliver(event string, body []byte) {
+	for attempt := range webhookAttempts {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * webhookBackoff)
+		}
+
+		err := h.post(event, body)
+		if err == nil {
+			return
+		}
+
+		slog.Warn("couldn't deliver webhook", "event", event, "attempt", attempt+1, "error", err)
+	}
+}
+
+func (h webhookConfig) post(event string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", fmt.Sprintf("goobla/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
+	req.Header.Set("X-Goobla-Event", event)
+	if h.Secret != "" {
+		req.Header.Set("X-Goobla-Signature", "sha256="+webhookSignature(h.Secret, body))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("%s: %s", req.URL.Redacted(), resp.Status)
+	}
+
+	return nil
+}
+
+// webhookSignature returns the hex encoded HMAC-SHA256 of body with secret.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/fs/ggml"
+)
+
+type webhookRequest struct {
+	event  webhookEvent
+	header http.Header
+	body   []byte
+}
+
+// newWebhookServer returns a server that records the webhooks it receives,
+// responding with each of statuses in turn and then 200 OK.
+func newWebhookServer(t *testing.T, statuses ...int) (*httptest.Server, chan webhookRequest) {
+	t.Helper()
+
+	ch := make(chan webhookRequest, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		var e webhookEvent
+		if err := json.Unmarshal(b, &e); err != nil {
+			t.Error(err)
+		}
+
+		ch <- webhookRequest{event: e, header: r.Header, body: b}
+
+		if len(statuses) > 0 {
+			w.WriteHeader(statuses[0])
+			statuses = statuses[1:]
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, ch
+}
+
+func receiveWebhook(t *testing.T, ch chan webhookRequest) webhookRequest {
+	t.Helper()
+
+	select {
+	case r := <-ch:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for webhook")
+		return webhookRequest{}
+	}
+}
+
+func writeWebhooksConfig(t *testing.T, s string) {
+	t.Helper()
+
+	p := filepath.Join(t.TempDir(), "webhooks.json")
+	require.NoError(t, os.WriteFile(p, []byte(s), 0o644))
+	t.Setenv("GOOBLA_WEBHOOKS_CONFIG", p)
+}
+
+func TestLoadWebhooks(t *testing.T) {
+	t.Setenv("GOOBLA_WEBHOOKS", "http://localhost:8080/hook")
+	t.Setenv("GOOBLA_WEBHOOK_SECRET", "env secret")
+
+	t.Run("env", func(t *testing.T) {
+		t.Setenv("GOOBLA_WEBHOOKS_CONFIG", filepath.Join(t.TempDir(), "webhooks.json"))
+
+		hooks, err := loadWebhooks()
+		require.NoError(t, err)
+		assert.Equal(t, []webhookConfig{{URL: "http://localhost:8080/hook", Secret: "env secret"}}, hooks)
+	})
+
+	t.Run("file", func(t *testing.T) {
+		writeWebhooksConfig(t, `{"webhooks": [{"url": "https://hooks.example.com/goobla", "secret": "file secret", "events": ["model.pulled"]}]}`)
+
+		hooks, err := loadWebhooks()
+		require.NoError(t, err)
+		assert.Equal(t, []webhookConfig{
+			{URL: "http://localhost:8080/hook", Secret: "env secret"},
+			{URL: "https://hooks.example.com/goobla", Secret: "file secret", Events: []string{"model.pulled"}},
+		}, hooks)
+	})
+
+	t.Run("unknown event", func(t *testing.T) {
+		writeWebhooksConfig(t, `{"webhooks": [{"url": "https://hooks.example.com/goobla", "events": ["model.renamed"]}]}`)
+
+		_, err := loadWebhooks()
+		assert.ErrorContains(t, err, `unknown event "model.renamed"`)
+	})
+
+	t.Run("invalid url", func(t *testing.T) {
+		writeWebhooksConfig(t, `{"webhooks": [{"url": "ftp://hooks.example.com/goobla"}]}`)
+
+		_, err := loadWebhooks()
+		assert.ErrorContains(t, err, "invalid webhook url")
+	})
+}
+
+func TestNotify(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("GOOBLA_MODELS", t.TempDir())
+
+	all, allCh := newWebhookServer(t)
+	deletes, deletesCh := newWebhookServer(t)
+
+	t.Setenv("GOOBLA_WEBHOOKS", all.URL)
+	t.Setenv("GOOBLA_WEBHOOK_SECRET", "secret")
+	writeWebhooksConfig(t, `{"webhooks": [{"url": "`+deletes.URL+`", "events": ["model.deleted"]}]}`)
+
+	var s Server
+	_, digest := createBinFile(t, ggml.KV{"general.architecture": "test"}, nil)
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Files: map[string]string{"model.gguf": digest},
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	r := receiveWebhook(t, allCh)
+	assert.Equal(t, eventModelCreated, r.event.Event)
+	assert.Equal(t, "test:latest", r.event.Model)
+	assert.Equal(t, "Goobla created test:latest", r.event.Text)
+	assert.False(t, r.event.Time.IsZero())
+	assert.Equal(t, eventModelCreated, r.header.Get("X-Goobla-Event"))
+	assert.Equal(t, "sha256="+webhookSignature("secret", r.body), r.header.Get("X-Goobla-Signature"))
+
+	w = createRequest(t, s.DeleteHandler, api.DeleteRequest{Model: "test"})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	r = receiveWebhook(t, allCh)
+	assert.Equal(t, eventModelDeleted, r.event.Event)
+
+	// only the deletion is sent to the second webhook, without a signature
+	r = receiveWebhook(t, deletesCh)
+	assert.Equal(t, eventModelDeleted, r.event.Event)
+	assert.Empty(t, r.header.Get("X-Goobla-Signature"))
+	assert.Empty(t, deletesCh)
+}
+
+func TestNotifyRetry(t *testing.T) {
+	t.Setenv("GOOBLA_WEBHOOKS_CONFIG", filepath.Join(t.TempDir(), "webhooks.json"))
+
+	backoff := webhookBackoff
+	webhookBackoff = 0
+	t.Cleanup(func() { webhookBackoff = backoff })
+
+	srv, ch := newWebhookServer(t, http.StatusInternalServerError, http.StatusBadGateway)
+	t.Setenv("GOOBLA_WEBHOOKS", srv.URL)
+
+	notify(webhookEvent{Event: eventServerStarted})
+
+	for range webhookAttempts {
+		r := receiveWebhook(t, ch)
+		assert.Equal(t, eventServerStarted, r.event.Event)
+	}
+
+	select {
+	case <-ch:
+		t.Fatal("webhook delivered after it succeeded")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,195 @@
+package template
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/template/jinja"
+)
+
+// Problem is an issue found by [Template.Check].
+type Problem struct {
+	// Fixture is the name of the conversation the template was rendered
+	// with, if the problem is with a particular conversation
+	Fixture string
+
+	Message string
+
+	// Warning is whether the template can still be used despite the problem
+	Warning bool
+}
+
+func (p Problem) String() string {
+	if p.Fixture == "" {
+		return p.Message
+	}
+	return p.Fixture + ": " + p.Message
+}
+
+type fixture struct {
+	name   string
+	values Values
+}
+
+var weatherTool = func() api.Tool {
+	var tool api.Tool
+	if err := json.Unmarshal([]byte(`{"type": "function", "function": {"name": "get_weather", "description": "Get the current weather in a city", "parameters": {"type": "object", "required": ["city"], "properties": {"city": {"type": "string", "description": "The name of the city"}}}}}`), &tool); err != nil {
+		panic(err)
+	}
+	return tool
+}()
+
+// fixtures are the conversations templates are checked with. The tools
+// fixture is only rendered by templates that support tools.
+var fixtures = []fixture{
+	{"system and user", Values{Messages: []api.Message{
+		{Role: "system", Content: "You are a helpful assistant."},
+		{Role: "user", Content: "Why is the sky blue?"},
+	}}},
+	{"multi-turn", Values{Messages: []api.Message{
+		{Role: "user", Content: "Hello!"},
+		{Role: "assistant", Content: "Hi! How can I help you today?"},
+		{Role: "user", Content: "Tell me a joke."},
+	}}},
+	{"tools", Values{
+		Messages: []api.Message{
+			{Role: "user", Content: "What's the weather like in the capital of France?"},
+			{Role: "assistant", ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"city": "Paris"}}}}},
+			{Role: "tool", Content: "22 degrees and sunny"},
+		},
+		Tools: api.Tools{weatherTool},
+	}},
+	{"images", Values{Messages: []api.Message{
+		{Role: "user", Content: "What is in this image?", Images: []api.ImageData{[]byte("image")}},
+	}}},
+}
+
+// Check renders the template with sample conversations, with a system
+// prompt, several turns, tools and images, and returns the problems it
+// finds: templates that fail to render, refer to undefined variables or
+// leave messages out of the prompt. Messages the template rejects with an
+// exception and system messages it leaves out are only warnings.
+func (t *Template) Check() []Problem {
+	var problems []Problem
+	if t.jinja == nil {
+		for _, name := range t.undefined() {
+			problems = append(problems, Problem{Message: fmt.Sprintf("undefined variable %q", name)})
+		}
+	}
+
+	for _, f := range fixtures {
+		if f.name == "tools" && !slices.Contains(t.Vars(), "tools") {
+			continue
+		}
+
+		problems = append(problems, t.check(f)...)
+	}
+
+	return problems
+}
+
+func (t *Template) check(f fixture) []Problem {
+	var b bytes.Buffer
+	if err := t.Execute(&b, f.values); err != nil {
+		var e *jinja.Exception
+		if errors.As(err, &e) {
+			return []Problem{{Fixture: f.name, Message: "the template rejects the conversation: " + e.Message, Warning: true}}
+		}
+		return []Problem{{Fixture: f.name, Message: err.Error()}}
+	}
+
+	var problems []Problem
+	if t.jinja != nil {
+		names, err := t.jinja.Undefined(jinjaVars(f.values))
+		if err != nil {
+			return []Problem{{Fixture: f.name, Message: err.Error()}}
+		}
+
+		for _, name := range names {
+			problems = append(problems, Problem{Fixture: f.name, Message: fmt.Sprintf("undefined variable %q", name)})
+		}
+	}
+
+	for _, m := range f.values.Messages {
+		if m.Content != "" && !strings.Contains(b.String(), m.Content) {
+			problems = append(problems, Problem{
+				Fixture: f.name,
+				Message: fmt.Sprintf("the %s message is missing from the prompt", m.Role),
+				Warning: m.Role == "system",
+			})
+		}
+
+		for _, call := range m.ToolCalls {
+			// the name of the function is also in the tools, so the
+			// arguments are checked too
+			missing := !strings.Contains(b.String(), call.Function.Name)
+			for _, v := range call.Function.Arguments {
+				missing = missing || !strings.Contains(b.String(), fmt.Sprint(v))
+			}
+
+			if missing {
+				problems = append(problems, Problem{Fixture: f.name, Message: "the tool call is missing from the prompt"})
+			}
+		}
+	}
+
+	return problems
+}
+
+// undefined returns the fields the Go template refers to that aren't in the
+// values templates are rendered with.
+func (t *Template) undefined() []string {
+	known := map[string]struct{}{}
+	for _, name := range []string{"System", "Prompt", "Response", "Suffix", "Messages", "Tools", "Think", "IsThinkSet"} {
+		known[name] = struct{}{}
+	}
+
+	seen := map[reflect.Type]bool{}
+	var walk func(reflect.Type)
+	walk = func(rt reflect.Type) {
+		if seen[rt] {
+			return
+		}
+		seen[rt] = true
+
+		for i := range rt.NumMethod() {
+			known[rt.Method(i).Name] = struct{}{}
+		}
+
+		switch rt.Kind() {
+		case reflect.Pointer, reflect.Slice, reflect.Array, reflect.Map:
+			walk(rt.Elem())
+		case reflect.Struct:
+			for i := range rt.NumField() {
+				known[rt.Field(i).Name] = struct{}{}
+				walk(rt.Field(i).Type)
+			}
+		}
+	}
+	walk(reflect.TypeFor[api.Message]())
+	walk(reflect.TypeFor[api.Tool]())
+
+	var names []string
+	for _, tt := range t.Templates() {
+		if tt.Tree == nil {
+			continue
+		}
+
+		for _, n := range tt.Root.Nodes {
+			for _, name := range Identifiers(n) {
+				if _, ok := known[name]; !ok && !strings.HasPrefix(name, "$") && !slices.Contains(names, name) {
+					names = append(names, name)
+				}
+			}
+		}
+	}
+
+	slices.Sort(names)
+	return names
+}
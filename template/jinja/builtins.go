@@ -0,0 +1,1061 @@
+package jinja
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxRange is the maximum length of ranges, to bound the time templates
+// take to render.
+const maxRange = 100_000
+
+// arg returns the argument at position i or named name, or def if it's
+// missing.
+func arg(args []any, kwargs *dict, i int, name string, def any) any {
+	if i < len(args) {
+		return args[i]
+	}
+	if kwargs != nil {
+		if v, ok := kwargs.get(name); ok {
+			return v
+		}
+	}
+	return def
+}
+
+func stringArg(args []any, kwargs *dict, i int, name string, def string) (string, error) {
+	switch v := arg(args, kwargs, i, name, def).(type) {
+	case string:
+		return v, nil
+	case undefined:
+		return def, nil
+	default:
+		return "", fmt.Errorf("%s must be a string, got %s", name, typeName(v))
+	}
+}
+
+func intArg(args []any, kwargs *dict, i int, name string, def int) (int, error) {
+	switch v := arg(args, kwargs, i, name, def).(type) {
+	case int:
+		return v, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case nil, undefined:
+		return def, nil
+	default:
+		return 0, fmt.Errorf("%s must be an integer, got %s", name, typeName(v))
+	}
+}
+
+type filterFunc func(s *state, v any, args []any, kwargs *dict) (any, error)
+
+var filters map[string]filterFunc
+
+func init() {
+	filters = map[string]filterFunc{
+		"abs": func(_ *state, v any, _ []any, _ *dict) (any, error) {
+			switch v := v.(type) {
+			case int:
+				return max(v, -v), nil
+			case float64:
+				return math.Abs(v), nil
+			}
+			return nil, fmt.Errorf("bad operand type for abs: %s", typeName(v))
+		},
+		"capitalize": stringFilter(capitalize),
+		"count":      lengthFilter,
+		"default":    defaultFilter,
+		"d":          defaultFilter,
+		"dictsort": func(_ *state, v any, args []any, kwargs *dict) (any, error) {
+			d, ok := v.(*dict)
+			if !ok {
+				return nil, fmt.Errorf("dictsort expects a dict, got %s", typeName(v))
+			}
+
+			keys := slices.Clone(d.keys)
+			slices.SortFunc(keys, func(a, b string) int {
+				if !truthy(arg(args, kwargs, 0, "case_sensitive", false)) {
+					a, b = strings.ToLower(a), strings.ToLower(b)
+				}
+				return strings.Compare(a, b)
+			})
+			if truthy(arg(args, kwargs, 2, "reverse", false)) {
+				slices.Reverse(keys)
+			}
+
+			items := make([]any, len(keys))
+			for i, key := range keys {
+				items[i] = []any{key, d.values[key]}
+			}
+			return items, nil
+		},
+		"escape": stringFilter(html.EscapeString),
+		"e":      stringFilter(html.EscapeString),
+		"first": func(_ *state, v any, _ []any, _ *dict) (any, error) {
+			items, err := iterate(v)
+			if err != nil {
+				return nil, err
+			}
+			if len(items) == 0 {
+				return undefined{}, nil
+			}
+			return items[0], nil
+		},
+		"float": func(_ *state, v any, args []any, kwargs *dict) (any, error) {
+			switch v := v.(type) {
+			case int:
+				return float64(v), nil
+			case float64:
+				return v, nil
+			case string:
+				if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					return f, nil
+				}
+			}
+			return arg(args, kwargs, 0, "default", 0.0), nil
+		},
+		"indent": func(_ *state, v any, args []any, kwargs *dict) (any, error) {
+			width := strings.Repeat(" ", 4)
+			switch w := arg(args, kwargs, 0, "width", 4).(type) {
+			case int:
+				width = strings.Repeat(" ", max(w, 0))
+			case string:
+				width = w
+			}
+
+			first := truthy(arg(args, kwargs, 1, "first", false))
+			blank := truthy(arg(args, kwargs, 2, "blank", false))
+
+			lines := strings.Split(str(v), "\n")
+			for i, line := range lines {
+				if (i > 0 || first) && (blank || strings.TrimSpace(line) != "") {
+					lines[i] = width + line
+				}
+			}
+			return strings.Join(lines, "\n"), nil
+		},
+		"int": func(_ *state, v any, args []any, kwargs *dict) (any, error) {
+			switch v := v.(type) {
+			case int:
+				return v, nil
+			case float64:
+				return int(v), nil
+			case bool:
+				if v {
+					return 1, nil
+				}
+				return 0, nil
+			case string:
+				s := strings.TrimSpace(v)
+				if n, err := strconv.Atoi(s); err == nil {
+					return n, nil
+				}
+				if f, err := strconv.ParseFloat(s, 64); err == nil {
+					return int(f), nil
+				}
+			}
+			return arg(args, kwargs, 0, "default", 0), nil
+		},
+		"items": func(_ *state, v any, _ []any, _ *dict) (any, error) {
+			return dictItems(v)
+		},
+		"join": func(_ *state, v any, args []any, kwargs *dict) (any, error) {
+			items, err := iterate(v)
+			if err != nil {
+				return nil, err
+			}
+
+			sep, err := stringArg(args, kwargs, 0, "d", "")
+			if err != nil {
+				return nil, err
+			}
+
+			attr, _ := arg(args, kwargs, 1, "attribute", nil).(string)
+
+			parts := make([]string, len(items))
+			for i, item := range items {
+				if attr != "" {
+					item = attribute(item, attr)
+				}
+				parts[i] = str(item)
+			}
+			return strings.Join(parts, sep), nil
+		},
+		"last": func(_ *state, v any, _ []any, _ *dict) (any, error) {
+			items, err := iterate(v)
+			if err != nil {
+				return nil, err
+			}
+			if len(items) == 0 {
+				return undefined{}, nil
+			}
+			return items[len(items)-1], nil
+		},
+		"length": lengthFilter,
+		"list": func(_ *state, v any, _ []any, _ *dict) (any, error) {
+			items, err := iterate(v)
+			if err != nil {
+				return nil, err
+			}
+			return append([]any{}, items...), nil
+		},
+		"lower": stringFilter(strings.ToLower),
+		"map": func(s *state, v any, args []any, kwargs *dict) (any, error) {
+			items, err := iterate(v)
+			if err != nil {
+				return nil, err
+			}
+
+			mapped := make([]any, len(items))
+			if attr, ok := kwargs.get("attribute"); ok {
+				def, _ := kwargs.get("default")
+				for i, item := range items {
+					mapped[i] = attribute(item, str(attr))
+					if _, ok := mapped[i].(undefined); ok && def != nil {
+						mapped[i] = def
+					}
+				}
+				return mapped, nil
+			}
+
+			if len(args) == 0 {
+				return nil, errors.New("map expects a filter or attribute")
+			}
+
+			name, ok := args[0].(string)
+			f, found := filters[name]
+			if !ok || !found {
+				return nil, fmt.Errorf("no filter named %v", args[0])
+			}
+
+			for i, item := range items {
+				if mapped[i], err = f(s, item, args[1:], kwargs); err != nil {
+					return nil, err
+				}
+			}
+			return mapped, nil
+		},
+		"max":        extremeFilter(1),
+		"min":        extremeFilter(-1),
+		"reject":     selectFilter(false, false),
+		"rejectattr": selectFilter(false, true),
+		"replace": func(_ *state, v any, args []any, kwargs *dict) (any, error) {
+			old, err := stringArg(args, kwargs, 0, "old", "")
+			if err != nil {
+				return nil, err
+			}
+			new, err := stringArg(args, kwargs, 1, "new", "")
+			if err != nil {
+				return nil, err
+			}
+			n, err := intArg(args, kwargs, 2, "count", -1)
+			if err != nil {
+				return nil, err
+			}
+			return strings.Replace(str(v), old, new, n), nil
+		},
+		"reverse": func(_ *state, v any, _ []any, _ *dict) (any, error) {
+			if s, ok := v.(string); ok {
+				runes := []rune(s)
+				slices.Reverse(runes)
+				return string(runes), nil
+			}
+
+			items, err := iterate(v)
+			if err != nil {
+				return nil, err
+			}
+			items = slices.Clone(items)
+			slices.Reverse(items)
+			return items, nil
+		},
+		"round": func(_ *state, v any, args []any, kwargs *dict) (any, error) {
+			f, ok := number(v)
+			if !ok {
+				return nil, fmt.Errorf("round expects a number, got %s", typeName(v))
+			}
+
+			precision, err := intArg(args, kwargs, 0, "precision", 0)
+			if err != nil {
+				return nil, err
+			}
+
+			method, err := stringArg(args, kwargs, 1, "method", "common")
+			if err != nil {
+				return nil, err
+			}
+
+			p := math.Pow(10, float64(precision))
+			switch method {
+			case "common":
+				return math.Round(f*p) / p, nil
+			case "ceil":
+				return math.Ceil(f*p) / p, nil
+			case "floor":
+				return math.Floor(f*p) / p, nil
+			}
+			return nil, errors.New("method must be common, ceil or floor")
+		},
+		"safe":       func(_ *state, v any, _ []any, _ *dict) (any, error) { return v, nil },
+		"select":     selectFilter(true, false),
+		"selectattr": selectFilter(true, true),
+		"sort": func(_ *state, v any, args []any, kwargs *dict) (any, error) {
+			items, err := iterate(v)
+			if err != nil {
+				return nil, err
+			}
+
+			reverse := truthy(arg(args, kwargs, 0, "reverse", false))
+			caseSensitive := truthy(arg(args, kwargs, 1, "case_sensitive", false))
+			attr, _ := arg(args, kwargs, 2, "attribute", nil).(string)
+
+			key := func(v any) any {
+				if attr != "" {
+					v = attribute(v, attr)
+				}
+				if s, ok := v.(string); ok && !caseSensitive {
+					return strings.ToLower(s)
+				}
+				return v
+			}
+
+			items = slices.Clone(items)
+			var cmpErr error
+			slices.SortStableFunc(items, func(a, b any) int {
+				c, err := compare(key(a), key(b))
+				if err != nil {
+					cmpErr = err
+				}
+				if reverse {
+					return -c
+				}
+				return c
+			})
+			return items, cmpErr
+		},
+		"string": func(_ *state, v any, _ []any, _ *dict) (any, error) {
+			return str(v), nil
+		},
+		"sum": func(_ *state, v any, args []any, kwargs *dict) (any, error) {
+			items, err := iterate(v)
+			if err != nil {
+				return nil, err
+			}
+
+			attr, _ := arg(args, kwargs, 0, "attribute", nil).(string)
+			sum := arg(args, kwargs, 1, "start", 0)
+			for _, item := range items {
+				if attr != "" {
+					item = attribute(item, attr)
+				}
+				if sum, err = arithmetic("+", sum, item); err != nil {
+					return nil, err
+				}
+			}
+			return sum, nil
+		},
+		"title": stringFilter(title),
+		"tojson": func(_ *state, v any, args []any, kwargs *dict) (any, error) {
+			indent := -1
+			if n, ok := arg(args, kwargs, 0, "indent", nil).(int); ok {
+				indent = n
+			}
+
+			var b strings.Builder
+			if err := toJSON(&b, v, indent, 0); err != nil {
+				return nil, err
+			}
+			return b.String(), nil
+		},
+		"trim": func(_ *state, v any, args []any, kwargs *dict) (any, error) {
+			chars, ok := arg(args, kwargs, 0, "chars", nil).(string)
+			if !ok {
+				return strings.TrimSpace(str(v)), nil
+			}
+			return strings.Trim(str(v), chars), nil
+		},
+		"unique": func(_ *state, v any, _ []any, _ *dict) (any, error) {
+			items, err := iterate(v)
+			if err != nil {
+				return nil, err
+			}
+
+			var unique []any
+			for _, item := range items {
+				if !slices.ContainsFunc(unique, func(u any) bool { return equal(u, item) }) {
+					unique = append(unique, item)
+				}
+			}
+			return unique, nil
+		},
+		"upper": stringFilter(strings.ToUpper),
+		"wordcount": func(_ *state, v any, _ []any, _ *dict) (any, error) {
+			return len(strings.Fields(str(v))), nil
+		},
+	}
+}
+
+func stringFilter(fn func(string) string) filterFunc {
+	return func(_ *state, v any, _ []any, _ *dict) (any, error) {
+		return fn(str(v)), nil
+	}
+}
+
+func lengthFilter(_ *state, v any, _ []any, _ *dict) (any, error) {
+	return length(v)
+}
+
+func defaultFilter(_ *state, v any, args []any, kwargs *dict) (any, error) {
+	_, isUndefined := v.(undefined)
+	if isUndefined || truthy(arg(args, kwargs, 1, "boolean", false)) && !truthy(v) {
+		return arg(args, kwargs, 0, "default_value", ""), nil
+	}
+	return v, nil
+}
+
+func extremeFilter(sign int) filterFunc {
+	return func(_ *state, v any, args []any, kwargs *dict) (any, error) {
+		items, err := iterate(v)
+		if err != nil {
+			return nil, err
+		}
+		if len(items) == 0 {
+			return undefined{}, nil
+		}
+
+		attr, _ := arg(args, kwargs, 1, "attribute", nil).(string)
+		best := items[0]
+		for _, item := range items[1:] {
+			a, b := item, best
+			if attr != "" {
+				a, b = attribute(a, attr), attribute(b, attr)
+			}
+
+			c, err := compare(a, b)
+			if err != nil {
+				return nil, err
+			}
+			if c*sign > 0 {
+				best = item
+			}
+		}
+		return best, nil
+	}
+}
+
+// selectFilter returns the select, reject, selectattr or rejectattr filter,
+// which keep the items, or attributes of items with attr, that pass a test
+// if keep or else fail it.
+func selectFilter(keep, attr bool) filterFunc {
+	return func(_ *state, v any, args []any, _ *dict) (any, error) {
+		items, err := iterate(v)
+		if err != nil {
+			return nil, err
+		}
+
+		var name string
+		if attr {
+			if len(args) == 0 {
+				return nil, errors.New("missing attribute")
+			}
+			name = str(args[0])
+			args = args[1:]
+		}
+
+		test := func(v any, _ []any) (bool, error) { return truthy(v), nil }
+		if len(args) > 0 {
+			var ok bool
+			if test, ok = tests[str(args[0])]; !ok {
+				return nil, fmt.Errorf("no test named %q", str(args[0]))
+			}
+			args = args[1:]
+		}
+
+		selected := []any{}
+		for _, item := range items {
+			v := item
+			if attr {
+				v = attribute(item, name)
+			}
+
+			ok, err := test(v, args)
+			if err != nil {
+				return nil, err
+			}
+			if ok == keep {
+				selected = append(selected, item)
+			}
+		}
+		return selected, nil
+	}
+}
+
+// attribute returns the attribute of v at path, whose parts are separated
+// by dots.
+func attribute(v any, path string) any {
+	for _, part := range strings.Split(path, ".") {
+		if n, err := strconv.Atoi(part); err == nil {
+			v = getitem(v, n)
+		} else {
+			v = getitem(v, part)
+		}
+	}
+	return v
+}
+
+func dictItems(v any) (any, error) {
+	d, ok := v.(*dict)
+	if !ok {
+		if _, ok := v.(undefined); ok {
+			return []any{}, nil
+		}
+		return nil, fmt.Errorf("%s has no items", typeName(v))
+	}
+
+	items := make([]any, len(d.keys))
+	for i, key := range d.keys {
+		items[i] = []any{key, d.values[key]}
+	}
+	return items, nil
+}
+
+func capitalize(s string) string {
+	r, n := utf8.DecodeRuneInString(s)
+	if n == 0 {
+		return s
+	}
+	return string(unicode.ToUpper(r)) + strings.ToLower(s[n:])
+}
+
+func title(s string) string {
+	var b strings.Builder
+	start := true
+	for _, r := range s {
+		if start {
+			b.WriteRune(unicode.ToUpper(r))
+		} else {
+			b.WriteRune(unicode.ToLower(r))
+		}
+		start = !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\''
+	}
+	return b.String()
+}
+
+type testFunc func(v any, args []any) (bool, error)
+
+var tests map[string]testFunc
+
+func init() {
+	is := func(fn func(v any) bool) testFunc {
+		return func(v any, _ []any) (bool, error) { return fn(v), nil }
+	}
+
+	compareTest := func(fn func(c int) bool) testFunc {
+		return func(v any, args []any) (bool, error) {
+			if len(args) == 0 {
+				return false, errors.New("missing value to compare with")
+			}
+			c, err := compare(v, args[0])
+			return err == nil && fn(c), err
+		}
+	}
+
+	eq := func(v any, args []any) (bool, error) {
+		return len(args) > 0 && equal(v, args[0]), nil
+	}
+
+	tests = map[string]testFunc{
+		"boolean": is(func(v any) bool { _, ok := v.(bool); return ok }),
+		"callable": is(func(v any) bool {
+			switch v.(type) {
+			case function, *macro:
+				return true
+			}
+			return false
+		}),
+		"defined": is(func(v any) bool { _, ok := v.(undefined); return !ok }),
+		"divisibleby": func(v any, args []any) (bool, error) {
+			a, ok := v.(int)
+			b, ok2 := arg(args, nil, 0, "num", nil).(int)
+			if !ok || !ok2 || b == 0 {
+				return false, errors.New("divisibleby expects integers")
+			}
+			return a%b == 0, nil
+		},
+		"eq":      eq,
+		"equalto": eq,
+		"==":      eq,
+		"even":    is(func(v any) bool { n, ok := v.(int); return ok && n%2 == 0 }),
+		"false":   is(func(v any) bool { b, ok := v.(bool); return ok && !b }),
+		"float":   is(func(v any) bool { _, ok := v.(float64); return ok }),
+		"ge":      compareTest(func(c int) bool { return c >= 0 }),
+		"gt":      compareTest(func(c int) bool { return c > 0 }),
+		"in": func(v any, args []any) (bool, error) {
+			if len(args) == 0 {
+				return false, errors.New("missing container")
+			}
+			return contains(args[0], v)
+		},
+		"integer": is(func(v any) bool { _, ok := v.(int); return ok }),
+		"iterable": is(func(v any) bool {
+			switch v.(type) {
+			case string, []any, *dict:
+				return true
+			}
+			return false
+		}),
+		"le":      compareTest(func(c int) bool { return c <= 0 }),
+		"lower":   is(func(v any) bool { s, ok := v.(string); return ok && s == strings.ToLower(s) }),
+		"lt":      compareTest(func(c int) bool { return c < 0 }),
+		"mapping": is(func(v any) bool { _, ok := v.(*dict); return ok }),
+		"ne": func(v any, args []any) (bool, error) {
+			return len(args) == 0 || !equal(v, args[0]), nil
+		},
+		"none":   is(func(v any) bool { return v == nil }),
+		"number": is(func(v any) bool { _, ok := number(v); return ok }),
+		"odd":    is(func(v any) bool { n, ok := v.(int); return ok && n%2 != 0 }),
+		"sameas": func(v any, args []any) (bool, error) {
+			if len(args) == 0 {
+				return false, errors.New("missing value to compare with")
+			}
+			switch v.(type) {
+			case nil, bool:
+				return v == args[0], nil
+			case *dict:
+				return v == args[0], nil
+			}
+			return equal(v, args[0]), nil
+		},
+		"sequence": is(func(v any) bool {
+			switch v.(type) {
+			case string, []any, *dict:
+				return true
+			}
+			return false
+		}),
+		"string":    is(func(v any) bool { _, ok := v.(string); return ok }),
+		"true":      is(func(v any) bool { b, ok := v.(bool); return ok && b }),
+		"undefined": is(func(v any) bool { _, ok := v.(undefined); return ok }),
+		"upper":     is(func(v any) bool { s, ok := v.(string); return ok && s == strings.ToUpper(s) }),
+	}
+}
+
+// method returns the method name of v, such as the methods of Python's
+// strings and dicts that templates call.
+func method(v any, name string) (function, bool) {
+	switch v := v.(type) {
+	case string:
+		return stringMethod(v, name)
+	case *dict:
+		if v.namespace {
+			return nil, false
+		}
+
+		switch name {
+		case "items":
+			return func([]any, *dict) (any, error) { return dictItems(v) }, true
+		case "keys":
+			return func([]any, *dict) (any, error) { return iterate(v) }, true
+		case "values":
+			return func([]any, *dict) (any, error) {
+				values := make([]any, len(v.keys))
+				for i, key := range v.keys {
+					values[i] = v.values[key]
+				}
+				return values, nil
+			}, true
+		case "get":
+			return func(args []any, kwargs *dict) (any, error) {
+				key, ok := arg(args, kwargs, 0, "key", nil).(string)
+				if ok {
+					if value, ok := v.get(key); ok {
+						return value, nil
+					}
+				}
+				return arg(args, kwargs, 1, "default", nil), nil
+			}, true
+		}
+	case []any:
+		switch name {
+		case "index":
+			return func(args []any, _ *dict) (any, error) {
+				for i, item := range v {
+					if len(args) > 0 && equal(item, args[0]) {
+						return i, nil
+					}
+				}
+				return nil, errors.New("item is not in list")
+			}, true
+		case "count":
+			return func(args []any, _ *dict) (any, error) {
+				var n int
+				for _, item := range v {
+					if len(args) > 0 && equal(item, args[0]) {
+						n++
+					}
+				}
+				return n, nil
+			}, true
+		}
+	}
+	return nil, false
+}
+
+func stringMethod(s, name string) (function, bool) {
+	// strip takes the characters to strip, or whitespace by default
+	strip := func(trim func(string, string) string, space func(string) string) function {
+		return func(args []any, kwargs *dict) (any, error) {
+			switch chars := arg(args, kwargs, 0, "chars", nil).(type) {
+			case string:
+				return trim(s, chars), nil
+			case nil, undefined:
+				return space(s), nil
+			default:
+				return nil, fmt.Errorf("strip arg must be None or str, not %s", typeName(chars))
+			}
+		}
+	}
+
+	// affix checks for a prefix or suffix, or any of a tuple of them
+	affix := func(has func(string, string) bool) function {
+		return func(args []any, kwargs *dict) (any, error) {
+			switch v := arg(args, kwargs, 0, "prefix", nil).(type) {
+			case string:
+				return has(s, v), nil
+			case []any:
+				return slices.ContainsFunc(v, func(a any) bool {
+					a2, ok := a.(string)
+					return ok && has(s, a2)
+				}), nil
+			default:
+				return nil, fmt.Errorf("expected a string or tuple of strings, got %s", typeName(v))
+			}
+		}
+	}
+
+	noArgs := func(fn func(string) any) function {
+		return func([]any, *dict) (any, error) { return fn(s), nil }
+	}
+
+	switch name {
+	case "strip":
+		return strip(strings.Trim, strings.TrimSpace), true
+	case "lstrip":
+		return strip(strings.TrimLeft, func(s string) string { return strings.TrimLeftFunc(s, unicode.IsSpace) }), true
+	case "rstrip":
+		return strip(strings.TrimRight, func(s string) string { return strings.TrimRightFunc(s, unicode.IsSpace) }), true
+	case "startswith":
+		return affix(strings.HasPrefix), true
+	case "endswith":
+		return affix(strings.HasSuffix), true
+	case "upper":
+		return noArgs(func(s string) any { return strings.ToUpper(s) }), true
+	case "lower":
+		return noArgs(func(s string) any { return strings.ToLower(s) }), true
+	case "title":
+		return noArgs(func(s string) any { return title(s) }), true
+	case "capitalize":
+		return noArgs(func(s string) any { return capitalize(s) }), true
+	case "isdigit":
+		return noArgs(func(s string) any {
+			return s != "" && strings.IndexFunc(s, func(r rune) bool { return !unicode.IsDigit(r) }) < 0
+		}), true
+	case "isspace":
+		return noArgs(func(s string) any {
+			return s != "" && strings.IndexFunc(s, func(r rune) bool { return !unicode.IsSpace(r) }) < 0
+		}), true
+	case "splitlines":
+		return noArgs(func(s string) any {
+			lines := []any{}
+			for line := range strings.Lines(s) {
+				lines = append(lines, strings.TrimRight(line, "\r\n"))
+			}
+			return lines
+		}), true
+	case "split":
+		return func(args []any, kwargs *dict) (any, error) {
+			n, err := intArg(args, kwargs, 1, "maxsplit", -1)
+			if err != nil {
+				return nil, err
+			}
+
+			var parts []string
+			switch sep := arg(args, kwargs, 0, "sep", nil).(type) {
+			case nil, undefined:
+				parts = strings.Fields(s)
+				if n >= 0 && len(parts) > n+1 {
+					// the remainder after the last split keeps its whitespace
+					rest := strings.TrimLeftFunc(s, unicode.IsSpace)
+					for range n {
+						i := strings.IndexFunc(rest, unicode.IsSpace)
+						rest = strings.TrimLeftFunc(rest[i:], unicode.IsSpace)
+					}
+					parts = append(parts[:n], rest)
+				}
+			case string:
+				if sep == "" {
+					return nil, errors.New("empty separator")
+				}
+				if n >= 0 {
+					n++
+				}
+				parts = strings.SplitN(s, sep, n)
+			default:
+				return nil, fmt.Errorf("separator must be a string, got %s", typeName(sep))
+			}
+
+			items := make([]any, len(parts))
+			for i, part := range parts {
+				items[i] = part
+			}
+			return items, nil
+		}, true
+	case "replace":
+		return func(args []any, kwargs *dict) (any, error) {
+			old, err := stringArg(args, kwargs, 0, "old", "")
+			if err != nil {
+				return nil, err
+			}
+			new, err := stringArg(args, kwargs, 1, "new", "")
+			if err != nil {
+				return nil, err
+			}
+			n, err := intArg(args, kwargs, 2, "count", -1)
+			if err != nil {
+				return nil, err
+			}
+			return strings.Replace(s, old, new, n), nil
+		}, true
+	case "find":
+		return func(args []any, kwargs *dict) (any, error) {
+			sub, err := stringArg(args, kwargs, 0, "sub", "")
+			if err != nil {
+				return nil, err
+			}
+			i := strings.Index(s, sub)
+			if i < 0 {
+				return -1, nil
+			}
+			return utf8.RuneCountInString(s[:i]), nil
+		}, true
+	case "count":
+		return func(args []any, kwargs *dict) (any, error) {
+			sub, err := stringArg(args, kwargs, 0, "sub", "")
+			if err != nil {
+				return nil, err
+			}
+			return strings.Count(s, sub), nil
+		}, true
+	case "join":
+		return func(args []any, kwargs *dict) (any, error) {
+			items, err := iterate(arg(args, kwargs, 0, "iterable", nil))
+			if err != nil {
+				return nil, err
+			}
+
+			parts := make([]string, len(items))
+			for i, item := range items {
+				part, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("sequence item %d: expected str instance, %s found", i, typeName(item))
+				}
+				parts[i] = part
+			}
+			return strings.Join(parts, s), nil
+		}, true
+	case "format":
+		return func(args []any, kwargs *dict) (any, error) {
+			var b strings.Builder
+			var next int
+			for rest := s; rest != ""; {
+				i := strings.IndexAny(rest, "{}")
+				if i < 0 {
+					b.WriteString(rest)
+					break
+				}
+
+				b.WriteString(rest[:i])
+				if i+1 < len(rest) && rest[i+1] == rest[i] {
+					b.WriteByte(rest[i])
+					rest = rest[i+2:]
+					continue
+				}
+
+				j := strings.IndexByte(rest[i:], '}')
+				if rest[i] == '}' || j < 0 {
+					return nil, errors.New("single brace in format string")
+				}
+
+				field := rest[i+1 : i+j]
+				rest = rest[i+j+1:]
+
+				var v any
+				if n, err := strconv.Atoi(field); err == nil {
+					v = arg(args, nil, n, "", undefined{})
+				} else if field == "" {
+					v = arg(args, nil, next, "", undefined{})
+					next++
+				} else {
+					v = arg(nil, kwargs, 0, field, undefined{})
+				}
+				b.WriteString(str(v))
+			}
+			return b.String(), nil
+		}, true
+	}
+	return nil, false
+}
+
+var globals = map[string]any{
+	"range": function(func(args []any, _ *dict) (any, error) {
+		bounds := make([]int, len(args))
+		for i, a := range args {
+			n, ok := a.(int)
+			if !ok {
+				return nil, fmt.Errorf("range expects integers, got %s", typeName(a))
+			}
+			bounds[i] = n
+		}
+
+		start, stop, step := 0, 0, 1
+		switch len(bounds) {
+		case 1:
+			stop = bounds[0]
+		case 2:
+			start, stop = bounds[0], bounds[1]
+		case 3:
+			start, stop, step = bounds[0], bounds[1], bounds[2]
+		default:
+			return nil, fmt.Errorf("range expects 1 to 3 arguments, got %d", len(args))
+		}
+
+		if step == 0 {
+			return nil, errors.New("range step can't be zero")
+		}
+
+		items := []any{}
+		for i := start; step > 0 && i < stop || step < 0 && i > stop; i += step {
+			if len(items) >= maxRange {
+				return nil, fmt.Errorf("range is longer than %d", maxRange)
+			}
+			items = append(items, i)
+		}
+		return items, nil
+	}),
+	"namespace": function(func(args []any, kwargs *dict) (any, error) {
+		ns := newDict()
+		ns.namespace = true
+		if len(args) > 0 {
+			if d, ok := args[0].(*dict); ok {
+				for _, key := range d.keys {
+					ns.set(key, d.values[key])
+				}
+			}
+		}
+		for _, key := range kwargs.keys {
+			ns.set(key, kwargs.values[key])
+		}
+		return ns, nil
+	}),
+	"dict": function(func(_ []any, kwargs *dict) (any, error) {
+		d := newDict()
+		for _, key := range kwargs.keys {
+			d.set(key, kwargs.values[key])
+		}
+		return d, nil
+	}),
+	"raise_exception": function(func(args []any, _ *dict) (any, error) {
+		var message string
+		if len(args) > 0 {
+			message = str(args[0])
+		}
+		return nil, &Exception{Message: message}
+	}),
+	"strftime_now": function(func(args []any, _ *dict) (any, error) {
+		if len(args) == 0 {
+			return nil, errors.New("strftime_now expects a format")
+		}
+		return strftime(time.Now(), str(args[0])), nil
+	}),
+}
+
+// strftime formats t as Python's strftime does.
+func strftime(t time.Time, format string) string {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			b.WriteByte(format[i])
+			continue
+		}
+
+		i++
+		switch format[i] {
+		case 'a':
+			b.WriteString(t.Format("Mon"))
+		case 'A':
+			b.WriteString(t.Format("Monday"))
+		case 'b', 'h':
+			b.WriteString(t.Format("Jan"))
+		case 'B':
+			b.WriteString(t.Format("January"))
+		case 'd':
+			b.WriteString(t.Format("02"))
+		case 'e':
+			b.WriteString(t.Format("_2"))
+		case '-':
+			// %-d and similar formats without padding
+			if i+1 < len(format) {
+				i++
+				switch format[i] {
+				case 'd':
+					b.WriteString(strconv.Itoa(t.Day()))
+				case 'm':
+					b.WriteString(strconv.Itoa(int(t.Month())))
+				case 'H':
+					b.WriteString(strconv.Itoa(t.Hour()))
+				default:
+					b.WriteString("%-" + string(format[i]))
+				}
+			}
+		case 'm':
+			b.WriteString(t.Format("01"))
+		case 'y':
+			b.WriteString(t.Format("06"))
+		case 'Y':
+			b.WriteString(t.Format("2006"))
+		case 'H':
+			b.WriteString(t.Format("15"))
+		case 'I':
+			b.WriteString(t.Format("03"))
+		case 'M':
+			b.WriteString(t.Format("04"))
+		case 'S':
+			b.WriteString(t.Format("05"))
+		case 'p':
+			b.WriteString(t.Format("PM"))
+		case 'j':
+			fmt.Fprintf(&b, "%03d", t.YearDay())
+		case 'z':
+			b.WriteString(t.Format("-0700"))
+		case 'Z':
+			b.WriteString(t.Format("MST"))
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(format[i])
+		}
+	}
+	return b.String()
+}
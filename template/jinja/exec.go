@@ -0,0 +1,843 @@
+package jinja
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strings"
+)
+
+var (
+	errBreak    = errors.New("break outside of a loop")
+	errContinue = errors.New("continue outside of a loop")
+)
+
+// maxDepth is the maximum depth of nested macro calls.
+const maxDepth = 100
+
+// Exception is the error of templates that call raise_exception, such as
+// when the roles of the messages don't alternate.
+type Exception struct {
+	Message string
+}
+
+func (e *Exception) Error() string {
+	return e.Message
+}
+
+type scope struct {
+	vars   map[string]any
+	parent *scope
+}
+
+func newScope(parent *scope) *scope {
+	return &scope{vars: make(map[string]any), parent: parent}
+}
+
+func (s *scope) get(name string) (any, bool) {
+	for ; s != nil; s = s.parent {
+		if v, ok := s.vars[name]; ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+type macro struct {
+	node  *macroNode
+	scope *scope
+	state *state
+}
+
+type state struct {
+	depth int
+
+	// undefined holds the names of the undefined variables that were
+	// rendered, if it isn't nil
+	undefined map[string]struct{}
+}
+
+// Execute renders the template with the variables vars, which are converted
+// from Go values: structs and other types are converted through JSON.
+func (t *Template) Execute(w io.Writer, vars map[string]any) error {
+	return t.execute(w, vars, &state{})
+}
+
+// Undefined renders the template with the variables vars and returns the
+// names of the undefined variables it rendered. Undefined variables that are
+// only tested, such as with "is defined", aren't returned.
+func (t *Template) Undefined(vars map[string]any) ([]string, error) {
+	s := state{undefined: make(map[string]struct{})}
+	if err := t.execute(io.Discard, vars, &s); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(s.undefined))
+	for name := range s.undefined {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+func (t *Template) execute(w io.Writer, vars map[string]any, s *state) error {
+	root := newScope(newScope(nil))
+	for name, v := range globals {
+		root.parent.vars[name] = v
+	}
+
+	for name, v := range vars {
+		v, err := fromGo(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		root.vars[name] = v
+	}
+
+	var b strings.Builder
+	if err := s.exec(&b, root, t.nodes); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (s *state) exec(w *strings.Builder, sc *scope, nodes []node) error {
+	for _, n := range nodes {
+		if err := s.node(w, sc, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *state) node(w *strings.Builder, sc *scope, n node) error {
+	switch n := n.(type) {
+	case *textNode:
+		w.WriteString(n.text)
+	case *outputNode:
+		v, err := s.eval(sc, n.expr)
+		if err != nil {
+			return err
+		}
+		if v, ok := v.(undefined); ok && v.name != "" && s.undefined != nil {
+			s.undefined[v.name] = struct{}{}
+		}
+		w.WriteString(str(v))
+	case *ifNode:
+		for i, cond := range n.conds {
+			v, err := s.eval(sc, cond)
+			if err != nil {
+				return err
+			}
+			if truthy(v) {
+				return s.exec(w, sc, n.bodies[i])
+			}
+		}
+		return s.exec(w, sc, n.orElse)
+	case *forNode:
+		return s.loop(w, sc, n)
+	case *setNode:
+		var v any
+		if n.value != nil {
+			var err error
+			if v, err = s.eval(sc, n.value); err != nil {
+				return err
+			}
+		} else {
+			var b strings.Builder
+			if err := s.exec(&b, sc, n.body); err != nil {
+				return err
+			}
+			v = b.String()
+		}
+
+		values := []any{v}
+		if len(n.targets) > 1 {
+			items, err := iterate(v)
+			if err != nil {
+				return err
+			}
+			if len(items) != len(n.targets) {
+				return fmt.Errorf("expected %d values to unpack, got %d", len(n.targets), len(items))
+			}
+			values = items
+		}
+
+		for i, target := range n.targets {
+			if err := s.assign(sc, target, values[i]); err != nil {
+				return err
+			}
+		}
+	case *macroNode:
+		sc.vars[n.name] = &macro{node: n, scope: sc, state: s}
+	case *filterBlockNode:
+		var b strings.Builder
+		if err := s.exec(&b, sc, n.body); err != nil {
+			return err
+		}
+
+		v, err := s.filter(sc, n.filter, b.String())
+		if err != nil {
+			return err
+		}
+		w.WriteString(str(v))
+	case *doNode:
+		_, err := s.eval(sc, n.expr)
+		return err
+	case *breakNode:
+		return errBreak
+	case *continueNode:
+		return errContinue
+	}
+	return nil
+}
+
+func (s *state) assign(sc *scope, target expr, v any) error {
+	switch target := target.(type) {
+	case *nameExpr:
+		sc.vars[target.name] = v
+		return nil
+	case *attrExpr:
+		obj, err := s.eval(sc, target.obj)
+		if err != nil {
+			return err
+		}
+
+		if ns, ok := obj.(*dict); ok && ns.namespace {
+			ns.set(target.attr, v)
+			return nil
+		}
+		return fmt.Errorf("can't set attribute %q of %s, only of namespaces", target.attr, typeName(obj))
+	}
+	return errors.New("invalid assignment")
+}
+
+func (s *state) loop(w *strings.Builder, sc *scope, n *forNode) error {
+	v, err := s.eval(sc, n.iter)
+	if err != nil {
+		return err
+	}
+
+	items, err := iterate(v)
+	if err != nil {
+		return err
+	}
+
+	// each item's variables are bound in its own scope so the variables
+	// set in the loop don't leak out of it
+	bind := func(item any) (*scope, error) {
+		child := newScope(sc)
+		if len(n.targets) == 1 {
+			child.vars[n.targets[0]] = item
+			return child, nil
+		}
+
+		values, err := iterate(item)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) != len(n.targets) {
+			return nil, fmt.Errorf("expected %d values to unpack, got %d", len(n.targets), len(values))
+		}
+		for i, target := range n.targets {
+			child.vars[target] = values[i]
+		}
+		return child, nil
+	}
+
+	if n.cond != nil {
+		var filtered []any
+		for _, item := range items {
+			child, err := bind(item)
+			if err != nil {
+				return err
+			}
+
+			v, err := s.eval(child, n.cond)
+			if err != nil {
+				return err
+			}
+			if truthy(v) {
+				filtered = append(filtered, item)
+			}
+		}
+		items = filtered
+	}
+
+	if len(items) == 0 {
+		return s.exec(w, sc, n.orElse)
+	}
+
+	for i, item := range items {
+		child, err := bind(item)
+		if err != nil {
+			return err
+		}
+
+		loop := newDict()
+		loop.set("index", i+1)
+		loop.set("index0", i)
+		loop.set("revindex", len(items)-i)
+		loop.set("revindex0", len(items)-i-1)
+		loop.set("first", i == 0)
+		loop.set("last", i == len(items)-1)
+		loop.set("length", len(items))
+		loop.set("previtem", undefined{"previtem"})
+		if i > 0 {
+			loop.set("previtem", items[i-1])
+		}
+		loop.set("nextitem", undefined{"nextitem"})
+		if i < len(items)-1 {
+			loop.set("nextitem", items[i+1])
+		}
+		loop.set("cycle", function(func(args []any, _ *dict) (any, error) {
+			if len(args) == 0 {
+				return nil, errors.New("no items for cycling given")
+			}
+			return args[i%len(args)], nil
+		}))
+		child.vars["loop"] = loop
+
+		if err := s.exec(w, child, n.body); errors.Is(err, errBreak) {
+			break
+		} else if err != nil && !errors.Is(err, errContinue) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *state) eval(sc *scope, e expr) (any, error) {
+	switch e := e.(type) {
+	case *literal:
+		return e.value, nil
+	case *nameExpr:
+		if v, ok := sc.get(e.name); ok {
+			return v, nil
+		}
+		return undefined{e.name}, nil
+	case *listExpr:
+		items := make([]any, len(e.items))
+		for i, item := range e.items {
+			v, err := s.eval(sc, item)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = v
+		}
+		return items, nil
+	case *dictExpr:
+		d := newDict()
+		for i := range e.keys {
+			key, err := s.eval(sc, e.keys[i])
+			if err != nil {
+				return nil, err
+			}
+			value, err := s.eval(sc, e.values[i])
+			if err != nil {
+				return nil, err
+			}
+			d.set(str(key), value)
+		}
+		return d, nil
+	case *attrExpr:
+		obj, err := s.eval(sc, e.obj)
+		if err != nil {
+			return nil, err
+		}
+		return getattr(obj, e.attr), nil
+	case *itemExpr:
+		obj, err := s.eval(sc, e.obj)
+		if err != nil {
+			return nil, err
+		}
+		key, err := s.eval(sc, e.key)
+		if err != nil {
+			return nil, err
+		}
+		return getitem(obj, key), nil
+	case *sliceExpr:
+		return s.slice(sc, e)
+	case *callExpr:
+		fn, err := s.eval(sc, e.fn)
+		if err != nil {
+			return nil, err
+		}
+		args, kwargs, err := s.args(sc, e.args)
+		if err != nil {
+			return nil, err
+		}
+		return s.call(fn, args, kwargs)
+	case *filterExpr:
+		obj, err := s.eval(sc, e.obj)
+		if err != nil {
+			return nil, err
+		}
+		return s.filter(sc, e, obj)
+	case *testExpr:
+		obj, err := s.eval(sc, e.obj)
+		if err != nil {
+			return nil, err
+		}
+
+		test, ok := tests[e.name]
+		if !ok {
+			return nil, fmt.Errorf("no test named %q", e.name)
+		}
+
+		args, _, err := s.args(sc, e.args)
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := test(obj, args)
+		if err != nil {
+			return nil, err
+		}
+		return result != e.negate, nil
+	case *binaryExpr:
+		return s.binary(sc, e)
+	case *unaryExpr:
+		x, err := s.eval(sc, e.x)
+		if err != nil {
+			return nil, err
+		}
+
+		switch e.op {
+		case "not":
+			return !truthy(x), nil
+		case "-":
+			switch x := x.(type) {
+			case int:
+				return -x, nil
+			case float64:
+				return -x, nil
+			}
+		case "+":
+			if _, ok := number(x); ok {
+				return x, nil
+			}
+		}
+		return nil, fmt.Errorf("bad operand type for unary %s: %s", e.op, typeName(x))
+	case *condExpr:
+		cond, err := s.eval(sc, e.cond)
+		if err != nil {
+			return nil, err
+		}
+
+		if truthy(cond) {
+			return s.eval(sc, e.then)
+		} else if e.orElse != nil {
+			return s.eval(sc, e.orElse)
+		}
+		return undefined{}, nil
+	}
+	return nil, fmt.Errorf("unknown expression %T", e)
+}
+
+func (s *state) args(sc *scope, a args) ([]any, *dict, error) {
+	args := make([]any, len(a.positional))
+	for i, e := range a.positional {
+		v, err := s.eval(sc, e)
+		if err != nil {
+			return nil, nil, err
+		}
+		args[i] = v
+	}
+
+	kwargs := newDict()
+	for i, name := range a.keywords {
+		v, err := s.eval(sc, a.values[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		kwargs.set(name, v)
+	}
+	return args, kwargs, nil
+}
+
+func (s *state) call(fn any, args []any, kwargs *dict) (any, error) {
+	switch fn := fn.(type) {
+	case function:
+		return fn(args, kwargs)
+	case *macro:
+		return fn.call(args, kwargs)
+	case undefined:
+		if fn.name != "" {
+			return nil, fmt.Errorf("%q is undefined", fn.name)
+		}
+	}
+	return nil, fmt.Errorf("%s is not callable", typeName(fn))
+}
+
+func (m *macro) call(args []any, kwargs *dict) (any, error) {
+	if m.state.depth >= maxDepth {
+		return nil, fmt.Errorf("maximum macro call depth exceeded in %s", m.node.name)
+	}
+	m.state.depth++
+	defer func() { m.state.depth-- }()
+
+	if len(args) > len(m.node.params) {
+		return nil, fmt.Errorf("macro %s takes %d arguments, got %d", m.node.name, len(m.node.params), len(args))
+	}
+
+	sc := newScope(m.scope)
+	for i, param := range m.node.params {
+		switch v, ok := kwargs.get(param); {
+		case i < len(args):
+			sc.vars[param] = args[i]
+		case ok:
+			sc.vars[param] = v
+		case m.node.defaults[i] != nil:
+			v, err := m.state.eval(sc, m.node.defaults[i])
+			if err != nil {
+				return nil, err
+			}
+			sc.vars[param] = v
+		default:
+			sc.vars[param] = undefined{param}
+		}
+	}
+
+	var b strings.Builder
+	if err := m.state.exec(&b, sc, m.node.body); err != nil {
+		return nil, err
+	}
+	return b.String(), nil
+}
+
+func (s *state) filter(sc *scope, e *filterExpr, obj any) (any, error) {
+	f, ok := filters[e.name]
+	if !ok {
+		return nil, fmt.Errorf("no filter named %q", e.name)
+	}
+
+	args, kwargs, err := s.args(sc, e.args)
+	if err != nil {
+		return nil, err
+	}
+	return f(s, obj, args, kwargs)
+}
+
+func (s *state) slice(sc *scope, e *sliceExpr) (any, error) {
+	obj, err := s.eval(sc, e.obj)
+	if err != nil {
+		return nil, err
+	}
+
+	var bounds [3]*int
+	for i, b := range []expr{e.start, e.stop, e.step} {
+		if b == nil {
+			continue
+		}
+
+		v, err := s.eval(sc, b)
+		if err != nil {
+			return nil, err
+		}
+
+		switch v := v.(type) {
+		case nil:
+		case int:
+			bounds[i] = &v
+		default:
+			return nil, fmt.Errorf("slice indices must be integers, got %s", typeName(v))
+		}
+	}
+
+	var items []any
+	switch obj := obj.(type) {
+	case string:
+		for _, r := range obj {
+			items = append(items, string(r))
+		}
+	case []any:
+		items = obj
+	default:
+		return nil, fmt.Errorf("%s can't be sliced", typeName(obj))
+	}
+
+	step := 1
+	if bounds[2] != nil {
+		if step = *bounds[2]; step == 0 {
+			return nil, errors.New("slice step can't be zero")
+		}
+	}
+
+	// indices are bounded as in Python
+	n := len(items)
+	index := func(b *int, def int) int {
+		if b == nil {
+			return def
+		}
+
+		i := *b
+		if i < 0 {
+			i += n
+		}
+
+		lo, hi := 0, n
+		if step < 0 {
+			lo, hi = -1, n-1
+		}
+		return min(max(i, lo), hi)
+	}
+
+	var sliced []any
+	if step > 0 {
+		for i := index(bounds[0], 0); i < index(bounds[1], n); i += step {
+			sliced = append(sliced, items[i])
+		}
+	} else {
+		for i := index(bounds[0], n-1); i > index(bounds[1], -1); i += step {
+			sliced = append(sliced, items[i])
+		}
+	}
+
+	if _, ok := obj.(string); ok {
+		var b strings.Builder
+		for _, item := range sliced {
+			b.WriteString(item.(string))
+		}
+		return b.String(), nil
+	}
+	return append([]any{}, sliced...), nil
+}
+
+func (s *state) binary(sc *scope, e *binaryExpr) (any, error) {
+	left, err := s.eval(sc, e.left)
+	if err != nil {
+		return nil, err
+	}
+
+	// and and or evaluate to one of their operands as in Python
+	switch e.op {
+	case "and":
+		if !truthy(left) {
+			return left, nil
+		}
+		return s.eval(sc, e.right)
+	case "or":
+		if truthy(left) {
+			return left, nil
+		}
+		return s.eval(sc, e.right)
+	}
+
+	right, err := s.eval(sc, e.right)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "<", ">", "<=", ">=":
+		c, err := compare(left, right)
+		if err != nil {
+			return nil, err
+		}
+		switch e.op {
+		case "<":
+			return c < 0, nil
+		case ">":
+			return c > 0, nil
+		case "<=":
+			return c <= 0, nil
+		}
+		return c >= 0, nil
+	case "in", "not in":
+		ok, err := contains(right, left)
+		if err != nil {
+			return nil, err
+		}
+		return ok != (e.op == "not in"), nil
+	case "~":
+		return str(left) + str(right), nil
+	}
+
+	return arithmetic(e.op, left, right)
+}
+
+func contains(container, v any) (bool, error) {
+	switch c := container.(type) {
+	case string:
+		s, ok := v.(string)
+		if !ok {
+			return false, fmt.Errorf("'in <string>' requires string as left operand, not %s", typeName(v))
+		}
+		return strings.Contains(c, s), nil
+	case []any:
+		for _, item := range c {
+			if equal(item, v) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case *dict:
+		s, ok := v.(string)
+		if !ok {
+			return false, nil
+		}
+		_, ok = c.get(s)
+		return ok, nil
+	case undefined:
+		return false, nil
+	}
+	return false, fmt.Errorf("argument of type %s is not iterable", typeName(container))
+}
+
+func arithmetic(op string, left, right any) (any, error) {
+	if a, ok := left.(int); ok {
+		if b, ok := right.(int); ok {
+			switch op {
+			case "+":
+				return a + b, nil
+			case "-":
+				return a - b, nil
+			case "*":
+				return a * b, nil
+			case "//":
+				if b == 0 {
+					return nil, errors.New("integer division by zero")
+				}
+				return int(math.Floor(float64(a) / float64(b))), nil
+			case "%":
+				if b == 0 {
+					return nil, errors.New("integer modulo by zero")
+				}
+				return ((a % b) + b) % b, nil
+			case "**":
+				if b >= 0 {
+					return int(math.Pow(float64(a), float64(b))), nil
+				}
+			}
+		}
+	}
+
+	if a, ok := number(left); ok {
+		if b, ok := number(right); ok {
+			switch op {
+			case "+":
+				return a + b, nil
+			case "-":
+				return a - b, nil
+			case "*":
+				return a * b, nil
+			case "/":
+				if b == 0 {
+					return nil, errors.New("division by zero")
+				}
+				return a / b, nil
+			case "//":
+				if b == 0 {
+					return nil, errors.New("division by zero")
+				}
+				return math.Floor(a / b), nil
+			case "%":
+				if b == 0 {
+					return nil, errors.New("modulo by zero")
+				}
+				return a - b*math.Floor(a/b), nil
+			case "**":
+				return math.Pow(a, b), nil
+			}
+		}
+	}
+
+	switch op {
+	case "+":
+		switch a := left.(type) {
+		case string:
+			if b, ok := right.(string); ok {
+				return a + b, nil
+			}
+		case []any:
+			if b, ok := right.([]any); ok {
+				return append(append([]any{}, a...), b...), nil
+			}
+		}
+	case "*":
+		a, b := left, right
+		if _, ok := a.(int); ok {
+			a, b = b, a
+		}
+		if n, ok := b.(int); ok {
+			switch a := a.(type) {
+			case string:
+				return strings.Repeat(a, max(n, 0)), nil
+			case []any:
+				var items []any
+				for range max(n, 0) {
+					items = append(items, a...)
+				}
+				return items, nil
+			}
+		}
+	}
+
+	for _, v := range []any{left, right} {
+		if u, ok := v.(undefined); ok && u.name != "" {
+			return nil, fmt.Errorf("%q is undefined", u.name)
+		}
+	}
+	return nil, fmt.Errorf("unsupported operand types for %s: %s and %s", op, typeName(left), typeName(right))
+}
+
+// getattr returns the attribute name of obj, which is a method or the value
+// of the key name of dicts.
+func getattr(obj any, name string) any {
+	if m, ok := method(obj, name); ok {
+		return m
+	}
+
+	if d, ok := obj.(*dict); ok {
+		if v, ok := d.get(name); ok {
+			return v
+		}
+	}
+	return undefined{}
+}
+
+// getitem returns the item key of obj, and the attributes of obj if it
+// doesn't have the item.
+func getitem(obj, key any) any {
+	switch obj := obj.(type) {
+	case *dict:
+		if k, ok := key.(string); ok {
+			if v, ok := obj.get(k); ok {
+				return v
+			}
+		}
+	case []any:
+		if i, ok := key.(int); ok {
+			if i < 0 {
+				i += len(obj)
+			}
+			if i >= 0 && i < len(obj) {
+				return obj[i]
+			}
+		}
+	case string:
+		if i, ok := key.(int); ok {
+			runes := []rune(obj)
+			if i < 0 {
+				i += len(runes)
+			}
+			if i >= 0 && i < len(runes) {
+				return string(runes[i])
+			}
+		}
+	}
+
+	if name, ok := key.(string); ok {
+		return getattr(obj, name)
+	}
+	return undefined{}
+}
@@ -0,0 +1,192 @@
+package jinja
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func render(t *testing.T, s string, vars map[string]any) string {
+	t.Helper()
+
+	tmpl, err := Parse(s)
+	if err != nil {
+		t.Fatalf("parse %q: %v", s, err)
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, vars); err != nil {
+		t.Fatalf("execute %q: %v", s, err)
+	}
+	return b.String()
+}
+
+func TestExecute(t *testing.T) {
+	messages := []any{
+		map[string]any{"role": "system", "content": "You are helpful."},
+		map[string]any{"role": "user", "content": "Hello"},
+		map[string]any{"role": "assistant", "content": " Hi! "},
+	}
+
+	cases := []struct {
+		template string
+		want     string
+	}{
+		{"Hello {{ name }}!", "Hello world!"},
+		{"{{ missing }}|{{ missing is defined }}|{{ none }}|{{ true }}", "|False|None|True"},
+		{"{{ 1 + 2 * 3 }} {{ 7 // 2 }} {{ 7 / 2 }} {{ -7 % 3 }} {{ 2 ** 10 }} {{ 'a' ~ 1 }}", "7 3 3.5 2 1024 a1"},
+		{"{{ 'a' if false else 'b' }}{{ 'c' if true }}{{ 'd' if false }}", "bc"},
+		{"{{ messages[0]['role'] }} {{ messages[-1].content | trim }} {{ messages | length }}", "system Hi! 3"},
+		{"{% for m in messages %}{{ loop.index }}{{ m.role[0] }}{% if not loop.last %},{% endif %}{% endfor %}", "1s,2u,3a"},
+		{"{% for m in messages if m.role != 'system' %}{{ loop.index0 }}:{{ m.role }} {% endfor %}", "0:user 1:assistant "},
+		{"{% for m in [] %}x{% else %}empty{% endfor %}", "empty"},
+		{"{% for i in range(5) %}{% if i == 1 %}{% continue %}{% endif %}{% if i == 3 %}{% break %}{% endif %}{{ i }}{% endfor %}", "02"},
+		{"{% for k, v in {'a': 1, 'b': 2}.items() %}{{ k }}={{ v }};{% endfor %}", "a=1;b=2;"},
+		{"{% set x = 1 %}{% for i in [1] %}{% set x = 2 %}{% endfor %}{{ x }}", "1"},
+		{"{% set ns = namespace(x=1) %}{% for i in [1, 2] %}{% set ns.x = ns.x + i %}{% endfor %}{{ ns.x }}", "4"},
+		{"{% set x %}a{{ 1 }}b{% endset %}{{ x }}", "a1b"},
+		{"{% macro greet(name, greeting='Hi') %}{{ greeting }} {{ name }}{% endmacro %}{{ greet('a') }}, {{ greet('b', greeting='Yo') }}", "Hi a, Yo b"},
+		{"{{ '  x  '.strip() }}|{{ 'a,b'.split(',') }}|{{ 'abc'.startswith(('x', 'a')) }}|{{ 'Hello'.upper() }}", "x|['a', 'b']|True|HELLO"},
+		{"{{ 'abcdef'[1:3] }}{{ 'abc'[::-1] }}{{ [1, 2, 3][-2:] }}", "bccba[2, 3]"},
+		{"{{ {'name': 'f', 'args': {'a': [1, 2.5, none, true]}} | tojson }}", `{"name": "f", "args": {"a": [1, 2.5, null, true]}}`},
+		{"{{ {'a': 1, 'b': []} | tojson(indent=2) }}", "{\n  \"a\": 1,\n  \"b\": []\n}"},
+		{"{{ 'é\"\n' | tojson }}", `"é\"\n"`},
+		{"{{ [3, 1, 2] | sort | join(', ') }} {{ [1, 2] | map('string') | list }} {{ ['a', 'b'] | first }}{{ ['a', 'b'] | last }}", "1, 2, 3 ['1', '2'] ab"},
+		{"{{ messages | selectattr('role', 'equalto', 'user') | map(attribute='content') | join }}", "Hello"},
+		{"{{ messages | rejectattr('role', 'in', ['system', 'user']) | list | length }}", "1"},
+		{"{{ missing | default('x') }}{{ '' | default('y', true) }}{{ 0 is number }}{{ 'a' is string }}{{ none is none }}{{ 3 is odd }}", "xyTrueTrueTrueTrue"},
+		{"{{ x is not defined and y is undefined }}{{ 2 is divisibleby 2 }}{{ 'a' in 'abc' }}{{ 1 not in [1] }}{{ 1 < 2 < 3 }}", "TrueTrueTrueFalseTrue"},
+		{"{{ 'hello world' | title }} {{ 'HELLO' | capitalize }} {{ 'a\nb' | indent(2) }}", "Hello World Hello a\n  b"},
+		{"{{ '{} and {name}'.format(1, name='b') }}", "1 and b"},
+		{"{# comment #}{% raw %}{{ not rendered }}{% endraw %}", "{{ not rendered }}"},
+		{"{% generation %}x{% endgeneration %}", "x"},
+		{"{% filter upper %}abc{% endfilter %}", "ABC"},
+		{"{{ 'a' 'b' }}{{ (1, 2) }}{{ 1.0 }}{{ 1e-5 }}", "ab[1, 2]1.01e-05"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.template, func(t *testing.T) {
+			got := render(t, tt.template, map[string]any{"name": "world", "messages": messages})
+			if got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestWhitespace(t *testing.T) {
+	cases := []struct {
+		template string
+		want     string
+	}{
+		// trim_blocks removes the newline after blocks
+		{"{% if true %}\na\n{% endif %}\nb", "a\nb"},
+		// lstrip_blocks removes the indentation of blocks
+		{"x\n    {% if true %}\n    a\n    {% endif %}\n", "x\n    a\n"},
+		{"{% for i in [1, 2] -%}\n  {{ i }}\n{%- endfor %}", "12"},
+		{"a  {{- 'b' -}}  c", "abc"},
+		{"{%+ if true %}a{% endif +%}\n", "a\n"},
+		{"  {{ 'a' }}\n", "  a\n"},
+		{"{# c #}\nx", "x"},
+	}
+
+	for _, tt := range cases {
+		if got := render(t, tt.template, nil); got != tt.want {
+			t.Errorf("%q: expected %q, got %q", tt.template, tt.want, got)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for _, s := range []string{
+		"{% if true %}",
+		"{% for x in y %}{% endif %}",
+		"{{ 1 + }}",
+		"{{ 'unterminated }}",
+		"{% include 'x' %}",
+		"{% endfor %}",
+		"{{ x",
+	} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("%q: expected a parse error", s)
+		}
+	}
+
+	tmpl, err := Parse("{{ raise_exception('roles must alternate') }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var e *Exception
+	if err := tmpl.Execute(&strings.Builder{}, nil); !errors.As(err, &e) || e.Message != "roles must alternate" {
+		t.Errorf("expected an exception, got %v", err)
+	}
+
+	for _, s := range []string{
+		"{{ missing + 1 }}",
+		"{{ missing() }}",
+		"{{ 1 / 0 }}",
+		"{{ x | nofilter }}",
+		"{% set x.y = 1 %}",
+		"{% macro m() %}{{ m() }}{% endmacro %}{{ m() }}",
+	} {
+		tmpl, err := Parse(s)
+		if err != nil {
+			t.Fatalf("%q: %v", s, err)
+		}
+		if err := tmpl.Execute(&strings.Builder{}, nil); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestVars(t *testing.T) {
+	tmpl, err := Parse("{% for m in messages %}{{ m.content }}{% endfor %}{% if tools %}{{ tools | tojson }}{% endif %}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vars := tmpl.Vars()
+	for _, name := range []string{"messages", "tools"} {
+		found := false
+		for _, v := range vars {
+			found = found || v == name
+		}
+		if !found {
+			t.Errorf("expected %q in %v", name, vars)
+		}
+	}
+}
+
+func TestFromGo(t *testing.T) {
+	type function struct {
+		Name       string         `json:"name"`
+		Parameters map[string]any `json:"parameters"`
+	}
+
+	got := render(t, "{{ tools | tojson }}", map[string]any{
+		"tools": []function{{Name: "get_weather", Parameters: map[string]any{"type": "object", "required": []string{"city"}}}},
+	})
+
+	want := `[{"name": "get_weather", "parameters": {"required": ["city"], "type": "object"}}]`
+	if got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestUndefined(t *testing.T) {
+	tmpl, err := Parse("{{ greeting }} {{ name }}{% if tools is defined %}{{ tools }}{% endif %}{% for m in messages %}{{ m.missing }}{% endfor %}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := tmpl.Undefined(map[string]any{"name": "world", "messages": []any{map[string]any{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tested variables and missing attributes aren't reported
+	if len(names) != 1 || names[0] != "greeting" {
+		t.Errorf("expected [greeting], got %v", names)
+	}
+}
@@ -0,0 +1,349 @@
+package jinja
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenText tokenKind = iota
+	tokenVarBegin
+	tokenVarEnd
+	tokenBlockBegin
+	tokenBlockEnd
+	tokenName
+	tokenString
+	tokenInt
+	tokenFloat
+	tokenOperator
+	tokenEOF
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	line  int
+}
+
+// operators are the operators of expressions, longest first so they're
+// matched greedily
+var operators = []string{
+	"**", "//", "==", "!=", "<=", ">=",
+	"+", "-", "*", "/", "%", "~", "<", ">", "=",
+	"(", ")", "[", "]", "{", "}", ",", ".", ":", "|",
+}
+
+var endRaw = regexp.MustCompile(`\{%([-+]?)\s*endraw\s*([-+]?)%\}`)
+
+type lexer struct {
+	s      string
+	pos    int
+	line   int
+	tokens []token
+
+	// lineStart is whether the text being lexed starts at the beginning of
+	// a line, for lstrip_blocks
+	lineStart bool
+}
+
+// lex splits s into tokens with the whitespace control of chat templates,
+// which are rendered with trim_blocks and lstrip_blocks enabled: the first
+// newline after a block or comment is removed, as is the whitespace before
+// a block or comment on its line.
+func lex(s string) ([]token, error) {
+	l := lexer{s: s, line: 1, lineStart: true}
+	for l.pos < len(l.s) {
+		i := l.nextTag()
+		if i < 0 {
+			l.text(l.s[l.pos:])
+			break
+		}
+
+		text, kind := l.s[l.pos:i], l.s[i+1]
+		control := byte(0)
+		if i+2 < len(l.s) && (l.s[i+2] == '-' || l.s[i+2] == '+') {
+			control = l.s[i+2]
+		}
+
+		switch {
+		case control == '-':
+			text = strings.TrimRight(text, " \t\r\n")
+		case control == 0 && kind != '{':
+			if j := strings.LastIndexByte(text, '\n'); (j >= 0 || l.lineStart) && strings.Trim(text[j+1:], " \t") == "" {
+				text = text[:j+1]
+			}
+		}
+
+		l.text(text)
+		l.line += strings.Count(l.s[l.pos:i], "\n")
+		l.pos = i + 2
+		if control != 0 {
+			l.pos++
+		}
+
+		var err error
+		switch kind {
+		case '#':
+			err = l.comment()
+		case '{':
+			err = l.tag(tokenVarBegin, tokenVarEnd, "}}")
+		case '%':
+			err = l.tag(tokenBlockBegin, tokenBlockEnd, "%}")
+			if err == nil {
+				err = l.raw()
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	l.tokens = append(l.tokens, token{kind: tokenEOF, line: l.line})
+	return l.tokens, nil
+}
+
+// nextTag returns the index of the next tag, or -1 if there are none.
+func (l *lexer) nextTag() int {
+	for i := l.pos; i+1 < len(l.s); i++ {
+		if l.s[i] == '{' && strings.IndexByte("{%#", l.s[i+1]) >= 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+func (l *lexer) text(s string) {
+	if s != "" {
+		l.tokens = append(l.tokens, token{kind: tokenText, value: s, line: l.line})
+	}
+}
+
+// end consumes the end of a tag at l.pos, returning whether there was one.
+// Whitespace after the tag is removed according to its whitespace control
+// and, for blocks and comments, trim_blocks.
+func (l *lexer) end(delim string, trim bool) bool {
+	control := byte(0)
+	rest := l.s[l.pos:]
+	if len(rest) > 0 && (rest[0] == '-' || rest[0] == '+') && strings.HasPrefix(rest[1:], delim) {
+		control = rest[0]
+		rest = rest[1:]
+	}
+
+	if !strings.HasPrefix(rest, delim) {
+		return false
+	}
+
+	l.pos = len(l.s) - len(rest) + len(delim)
+	start := l.pos
+	switch {
+	case control == '-':
+		for l.pos < len(l.s) && strings.IndexByte(" \t\r\n", l.s[l.pos]) >= 0 {
+			l.pos++
+		}
+	case control == 0 && trim:
+		if strings.HasPrefix(l.s[l.pos:], "\r\n") {
+			l.pos += 2
+		} else if strings.HasPrefix(l.s[l.pos:], "\n") {
+			l.pos++
+		}
+	}
+
+	skipped := l.s[start:l.pos]
+	l.line += strings.Count(skipped, "\n")
+	l.lineStart = strings.HasSuffix(skipped, "\n")
+	return true
+}
+
+func (l *lexer) comment() error {
+	line := l.line
+	for l.pos < len(l.s) {
+		if l.end("#}", true) {
+			return nil
+		}
+		if l.s[l.pos] == '\n' {
+			l.line++
+		}
+		l.pos++
+	}
+	return fmt.Errorf("line %d: unclosed comment", line)
+}
+
+// tag lexes the expression or statement of a tag up to its end delimiter.
+func (l *lexer) tag(begin, end tokenKind, delim string) error {
+	line := l.line
+	l.tokens = append(l.tokens, token{kind: begin, line: line})
+
+	var depth int
+	for l.pos < len(l.s) {
+		c := l.s[l.pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			if c == '\n' {
+				l.line++
+			}
+			l.pos++
+			continue
+		case depth == 0 && l.end(delim, end == tokenBlockEnd):
+			l.tokens = append(l.tokens, token{kind: end, line: l.line})
+			return nil
+		case c == '\'' || c == '"':
+			s, err := l.string()
+			if err != nil {
+				return err
+			}
+			l.tokens = append(l.tokens, token{kind: tokenString, value: s, line: l.line})
+			continue
+		case isDigit(c):
+			l.number()
+			continue
+		case isLetter(c):
+			start := l.pos
+			for l.pos < len(l.s) && (isLetter(l.s[l.pos]) || isDigit(l.s[l.pos])) {
+				l.pos++
+			}
+			l.tokens = append(l.tokens, token{kind: tokenName, value: l.s[start:l.pos], line: l.line})
+			continue
+		}
+
+		var op string
+		for _, o := range operators {
+			if strings.HasPrefix(l.s[l.pos:], o) {
+				op = o
+				break
+			}
+		}
+
+		switch op {
+		case "":
+			return fmt.Errorf("line %d: unexpected character %q", l.line, c)
+		case "(", "[", "{":
+			depth++
+		case ")", "]", "}":
+			depth--
+		}
+
+		l.tokens = append(l.tokens, token{kind: tokenOperator, value: op, line: l.line})
+		l.pos += len(op)
+	}
+
+	return fmt.Errorf("line %d: unclosed tag, expected %q", line, delim)
+}
+
+// raw replaces a raw block that was just lexed with its contents as text.
+func (l *lexer) raw() error {
+	n := len(l.tokens)
+	if n < 3 || l.tokens[n-3].kind != tokenBlockBegin || l.tokens[n-2].kind != tokenName || l.tokens[n-2].value != "raw" {
+		return nil
+	}
+
+	line := l.tokens[n-3].line
+	l.tokens = l.tokens[:n-3]
+
+	m := endRaw.FindStringSubmatchIndex(l.s[l.pos:])
+	if m == nil {
+		return fmt.Errorf("line %d: unclosed raw block", line)
+	}
+
+	text := l.s[l.pos : l.pos+m[0]]
+	if l.s[l.pos+m[2]:l.pos+m[3]] == "-" {
+		text = strings.TrimRight(text, " \t\r\n")
+	}
+	l.text(text)
+
+	l.line += strings.Count(l.s[l.pos:l.pos+m[1]], "\n")
+	l.pos += m[1]
+	if l.s[l.pos-m[1]+m[4]:l.pos-m[1]+m[5]] == "-" {
+		for l.pos < len(l.s) && strings.IndexByte(" \t\r\n", l.s[l.pos]) >= 0 {
+			l.pos++
+		}
+	} else if strings.HasPrefix(l.s[l.pos:], "\n") {
+		l.pos++
+	}
+	return nil
+}
+
+func (l *lexer) string() (string, error) {
+	line := l.line
+	quote := l.s[l.pos]
+	l.pos++
+
+	var b strings.Builder
+	for l.pos < len(l.s) {
+		c := l.s[l.pos]
+		l.pos++
+		switch c {
+		case quote:
+			return b.String(), nil
+		case '\n':
+			l.line++
+		case '\\':
+			if l.pos >= len(l.s) {
+				break
+			}
+
+			e := l.s[l.pos]
+			l.pos++
+			switch e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '0':
+				b.WriteByte(0)
+			case '\\', '\'', '"':
+				b.WriteByte(e)
+			case '\n':
+				l.line++
+			default:
+				b.WriteByte('\\')
+				b.WriteByte(e)
+			}
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return "", fmt.Errorf("line %d: unterminated string", line)
+}
+
+func (l *lexer) number() {
+	start, kind := l.pos, tokenInt
+	for l.pos < len(l.s) && (isDigit(l.s[l.pos]) || l.s[l.pos] == '_') {
+		l.pos++
+	}
+
+	if l.pos+1 < len(l.s) && l.s[l.pos] == '.' && isDigit(l.s[l.pos+1]) {
+		kind = tokenFloat
+		l.pos++
+		for l.pos < len(l.s) && isDigit(l.s[l.pos]) {
+			l.pos++
+		}
+	}
+
+	if l.pos < len(l.s) && (l.s[l.pos] == 'e' || l.s[l.pos] == 'E') {
+		i := l.pos + 1
+		if i < len(l.s) && (l.s[i] == '+' || l.s[i] == '-') {
+			i++
+		}
+		if i < len(l.s) && isDigit(l.s[i]) {
+			kind = tokenFloat
+			for l.pos = i; l.pos < len(l.s) && isDigit(l.s[l.pos]); l.pos++ {
+			}
+		}
+	}
+
+	value := strings.ReplaceAll(l.s[start:l.pos], "_", "")
+	l.tokens = append(l.tokens, token{kind: kind, value: value, line: l.line})
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_'
+}
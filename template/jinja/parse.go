@@ -0,0 +1,963 @@
+package jinja
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+)
+
+type node interface{}
+
+type (
+	textNode struct {
+		text string
+	}
+
+	outputNode struct {
+		expr expr
+	}
+
+	ifNode struct {
+		conds  []expr
+		bodies [][]node
+		orElse []node
+	}
+
+	forNode struct {
+		targets []string
+		iter    expr
+		cond    expr
+		body    []node
+		orElse  []node
+	}
+
+	setNode struct {
+		targets []expr
+		value   expr
+		// body is the body of a block set, which is used when value is nil
+		body []node
+	}
+
+	macroNode struct {
+		name     string
+		params   []string
+		defaults []expr
+		body     []node
+	}
+
+	filterBlockNode struct {
+		filter *filterExpr
+		body   []node
+	}
+
+	doNode struct {
+		expr expr
+	}
+
+	breakNode    struct{}
+	continueNode struct{}
+)
+
+type expr interface{}
+
+type (
+	literal struct {
+		value any
+	}
+
+	nameExpr struct {
+		name string
+	}
+
+	listExpr struct {
+		items []expr
+	}
+
+	dictExpr struct {
+		keys, values []expr
+	}
+
+	attrExpr struct {
+		obj  expr
+		attr string
+	}
+
+	itemExpr struct {
+		obj, key expr
+	}
+
+	sliceExpr struct {
+		obj               expr
+		start, stop, step expr
+	}
+
+	callExpr struct {
+		fn   expr
+		args args
+	}
+
+	filterExpr struct {
+		obj  expr
+		name string
+		args args
+	}
+
+	testExpr struct {
+		obj    expr
+		name   string
+		args   args
+		negate bool
+	}
+
+	binaryExpr struct {
+		op          string
+		left, right expr
+	}
+
+	unaryExpr struct {
+		op string
+		x  expr
+	}
+
+	condExpr struct {
+		cond, then, orElse expr
+	}
+)
+
+type args struct {
+	positional []expr
+	keywords   []string
+	values     []expr
+}
+
+// Template is a parsed Jinja template.
+type Template struct {
+	nodes []node
+	vars  []string
+}
+
+// Parse parses a Jinja template.
+func Parse(s string) (*Template, error) {
+	tokens, err := lex(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := parser{tokens: tokens, vars: make(map[string]struct{})}
+	nodes, end, err := p.body()
+	if err != nil {
+		return nil, err
+	}
+
+	if end != "" {
+		return nil, p.errorf("unexpected %q", end)
+	}
+
+	vars := make([]string, 0, len(p.vars))
+	for name := range p.vars {
+		vars = append(vars, name)
+	}
+	slices.Sort(vars)
+
+	return &Template{nodes: nodes, vars: vars}, nil
+}
+
+// Vars returns the names of the variables the template refers to.
+func (t *Template) Vars() []string {
+	return t.vars
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	vars   map[string]struct{}
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", p.peek().line, fmt.Sprintf(format, args...))
+}
+
+// is reports whether the next token is of kind with the value, if any.
+func (p *parser) is(kind tokenKind, value ...string) bool {
+	t := p.peek()
+	return t.kind == kind && (len(value) == 0 || slices.Contains(value, t.value))
+}
+
+// accept consumes the next token if it's of kind with the value.
+func (p *parser) accept(kind tokenKind, value ...string) bool {
+	if p.is(kind, value...) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(kind tokenKind, value ...string) (token, error) {
+	if !p.is(kind, value...) {
+		t := p.peek()
+		switch {
+		case len(value) > 0:
+			return t, p.errorf("expected %q, got %s", value[0], describe(t))
+		case kind == tokenName:
+			return t, p.errorf("expected a name, got %s", describe(t))
+		case kind == tokenVarEnd:
+			return t, p.errorf("expected end of print statement, got %s", describe(t))
+		case kind == tokenBlockEnd:
+			return t, p.errorf("expected end of statement block, got %s", describe(t))
+		}
+		return t, p.errorf("unexpected %s", describe(t))
+	}
+	return p.next(), nil
+}
+
+func describe(t token) string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of template"
+	case tokenVarEnd, tokenBlockEnd:
+		return "end of tag"
+	case tokenString:
+		return strconv.Quote(t.value)
+	}
+	return fmt.Sprintf("%q", t.value)
+}
+
+// body parses nodes until the end of the template or a block tag that the
+// caller handles, such as endfor, whose name is returned after consuming
+// its beginning.
+func (p *parser) body(ends ...string) ([]node, string, error) {
+	var nodes []node
+	for {
+		t := p.next()
+		switch t.kind {
+		case tokenEOF:
+			if len(ends) > 0 {
+				return nil, "", fmt.Errorf("line %d: unexpected end of template, expected %q", t.line, ends[len(ends)-1])
+			}
+			return nodes, "", nil
+		case tokenText:
+			nodes = append(nodes, &textNode{t.value})
+		case tokenVarBegin:
+			e, err := p.expression()
+			if err != nil {
+				return nil, "", err
+			}
+			if _, err := p.expect(tokenVarEnd); err != nil {
+				return nil, "", err
+			}
+			nodes = append(nodes, &outputNode{e})
+		case tokenBlockBegin:
+			name, err := p.expect(tokenName)
+			if err != nil {
+				return nil, "", err
+			}
+
+			if slices.Contains(ends, name.value) {
+				return nodes, name.value, nil
+			}
+
+			n, err := p.statement(name)
+			if err != nil {
+				return nil, "", err
+			}
+			if n != nil {
+				nodes = append(nodes, n)
+			}
+		default:
+			return nil, "", fmt.Errorf("line %d: unexpected %s", t.line, describe(t))
+		}
+	}
+}
+
+// endBlock parses the end of a block tag, such as endif.
+func (p *parser) endBlock() error {
+	_, err := p.expect(tokenBlockEnd)
+	return err
+}
+
+func (p *parser) statement(name token) (node, error) {
+	switch name.value {
+	case "if":
+		return p.ifStatement()
+	case "for":
+		return p.forStatement()
+	case "set":
+		return p.setStatement()
+	case "macro":
+		return p.macroStatement()
+	case "filter":
+		f, err := p.filter(nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.endBlock(); err != nil {
+			return nil, err
+		}
+		body, _, err := p.body("endfilter")
+		if err != nil {
+			return nil, err
+		}
+		return &filterBlockNode{f, body}, p.endBlock()
+	case "do":
+		e, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		return &doNode{e}, p.endBlock()
+	case "break":
+		return &breakNode{}, p.endBlock()
+	case "continue":
+		return &continueNode{}, p.endBlock()
+	case "generation":
+		// generation blocks mark the assistant's output for training and
+		// are otherwise rendered as they are
+		if err := p.endBlock(); err != nil {
+			return nil, err
+		}
+		body, _, err := p.body("endgeneration")
+		if err != nil {
+			return nil, err
+		}
+		return &ifNode{conds: []expr{&literal{true}}, bodies: [][]node{body}}, p.endBlock()
+	}
+
+	return nil, fmt.Errorf("line %d: unknown tag %q", name.line, name.value)
+}
+
+func (p *parser) ifStatement() (node, error) {
+	var n ifNode
+	for {
+		cond, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.endBlock(); err != nil {
+			return nil, err
+		}
+
+		body, end, err := p.body("elif", "else", "endif")
+		if err != nil {
+			return nil, err
+		}
+
+		n.conds = append(n.conds, cond)
+		n.bodies = append(n.bodies, body)
+
+		switch end {
+		case "else":
+			if err := p.endBlock(); err != nil {
+				return nil, err
+			}
+			if n.orElse, _, err = p.body("endif"); err != nil {
+				return nil, err
+			}
+			return &n, p.endBlock()
+		case "endif":
+			return &n, p.endBlock()
+		}
+	}
+}
+
+func (p *parser) forStatement() (node, error) {
+	var n forNode
+	for {
+		t, err := p.expect(tokenName)
+		if err != nil {
+			return nil, err
+		}
+		n.targets = append(n.targets, t.value)
+		if !p.accept(tokenOperator, ",") {
+			break
+		}
+	}
+
+	if _, err := p.expect(tokenName, "in"); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if n.iter, err = p.or(); err != nil {
+		return nil, err
+	}
+
+	if p.accept(tokenName, "if") {
+		if n.cond, err = p.expression(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.is(tokenName, "recursive") {
+		return nil, p.errorf("recursive loops are not supported")
+	}
+
+	if err := p.endBlock(); err != nil {
+		return nil, err
+	}
+
+	body, end, err := p.body("else", "endfor")
+	if err != nil {
+		return nil, err
+	}
+	n.body = body
+
+	if end == "else" {
+		if err := p.endBlock(); err != nil {
+			return nil, err
+		}
+		if n.orElse, _, err = p.body("endfor"); err != nil {
+			return nil, err
+		}
+	}
+
+	return &n, p.endBlock()
+}
+
+func (p *parser) setStatement() (node, error) {
+	var n setNode
+	for {
+		t, err := p.expect(tokenName)
+		if err != nil {
+			return nil, err
+		}
+
+		var target expr = &nameExpr{t.value}
+		if p.accept(tokenOperator, ".") {
+			attr, err := p.expect(tokenName)
+			if err != nil {
+				return nil, err
+			}
+			p.vars[t.value] = struct{}{}
+			target = &attrExpr{target, attr.value}
+		}
+
+		n.targets = append(n.targets, target)
+		if !p.accept(tokenOperator, ",") {
+			break
+		}
+	}
+
+	if p.accept(tokenOperator, "=") {
+		var err error
+		if n.value, err = p.tuple(); err != nil {
+			return nil, err
+		}
+		return &n, p.endBlock()
+	}
+
+	if len(n.targets) > 1 {
+		return nil, p.errorf("block set statements can only set one variable")
+	}
+
+	if err := p.endBlock(); err != nil {
+		return nil, err
+	}
+
+	body, _, err := p.body("endset")
+	if err != nil {
+		return nil, err
+	}
+	n.body = body
+	return &n, p.endBlock()
+}
+
+func (p *parser) macroStatement() (node, error) {
+	name, err := p.expect(tokenName)
+	if err != nil {
+		return nil, err
+	}
+
+	n := macroNode{name: name.value}
+	if _, err := p.expect(tokenOperator, "("); err != nil {
+		return nil, err
+	}
+
+	for !p.accept(tokenOperator, ")") {
+		param, err := p.expect(tokenName)
+		if err != nil {
+			return nil, err
+		}
+
+		var value expr
+		if p.accept(tokenOperator, "=") {
+			if value, err = p.expression(); err != nil {
+				return nil, err
+			}
+		}
+
+		n.params = append(n.params, param.value)
+		n.defaults = append(n.defaults, value)
+
+		if !p.accept(tokenOperator, ",") {
+			if _, err := p.expect(tokenOperator, ")"); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	if err := p.endBlock(); err != nil {
+		return nil, err
+	}
+
+	if n.body, _, err = p.body("endmacro"); err != nil {
+		return nil, err
+	}
+
+	// the name of the macro may be repeated in its end tag
+	p.accept(tokenName, n.name)
+	return &n, p.endBlock()
+}
+
+// tuple parses an expression, or a tuple of expressions without parentheses.
+func (p *parser) tuple() (expr, error) {
+	e, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.is(tokenOperator, ",") {
+		return e, nil
+	}
+
+	items := []expr{e}
+	for p.accept(tokenOperator, ",") {
+		if p.is(tokenBlockEnd) || p.is(tokenVarEnd) {
+			break
+		}
+
+		e, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, e)
+	}
+	return &listExpr{items}, nil
+}
+
+func (p *parser) expression() (expr, error) {
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.accept(tokenName, "if") {
+		return e, nil
+	}
+
+	cond, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+
+	var orElse expr
+	if p.accept(tokenName, "else") {
+		if orElse, err = p.expression(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &condExpr{cond, e, orElse}, nil
+}
+
+func (p *parser) or() (expr, error) {
+	return p.binary(p.and, tokenName, "or")
+}
+
+func (p *parser) and() (expr, error) {
+	return p.binary(p.not, tokenName, "and")
+}
+
+func (p *parser) not() (expr, error) {
+	if p.accept(tokenName, "not") {
+		x, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{"not", x}, nil
+	}
+	return p.compare()
+}
+
+func (p *parser) compare() (expr, error) {
+	left, err := p.math1()
+	if err != nil {
+		return nil, err
+	}
+
+	var result expr
+	for {
+		var op string
+		switch {
+		case p.is(tokenOperator, "==", "!=", "<", ">", "<=", ">="):
+			op = p.next().value
+		case p.accept(tokenName, "in"):
+			op = "in"
+		case p.is(tokenName, "not") && p.tokens[p.pos+1].kind == tokenName && p.tokens[p.pos+1].value == "in":
+			p.pos += 2
+			op = "not in"
+		default:
+			if result == nil {
+				return left, nil
+			}
+			return result, nil
+		}
+
+		right, err := p.math1()
+		if err != nil {
+			return nil, err
+		}
+
+		// chained comparisons such as a < b < c compare each pair
+		e := &binaryExpr{op, left, right}
+		if result == nil {
+			result = e
+		} else {
+			result = &binaryExpr{"and", result, e}
+		}
+		left = right
+	}
+}
+
+func (p *parser) math1() (expr, error) {
+	return p.binary(p.concat, tokenOperator, "+", "-")
+}
+
+func (p *parser) concat() (expr, error) {
+	return p.binary(p.math2, tokenOperator, "~")
+}
+
+func (p *parser) math2() (expr, error) {
+	return p.binary(p.pow, tokenOperator, "*", "/", "//", "%")
+}
+
+func (p *parser) pow() (expr, error) {
+	return p.binary(p.unary, tokenOperator, "**")
+}
+
+// binary parses left-associative binary operations of the operators ops
+// with operands parsed by operand.
+func (p *parser) binary(operand func() (expr, error), kind tokenKind, ops ...string) (expr, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.is(kind, ops...) {
+		op := p.next().value
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op, left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) unary() (expr, error) {
+	var e expr
+	if p.is(tokenOperator, "-", "+") {
+		op := p.next().value
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		e = &unaryExpr{op, x}
+	} else {
+		var err error
+		if e, err = p.primary(); err != nil {
+			return nil, err
+		}
+		if e, err = p.postfix(e); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		var err error
+		switch {
+		case p.is(tokenOperator, "|"):
+			e, err = p.filter(e)
+		case p.accept(tokenName, "is"):
+			e, err = p.test(e)
+		default:
+			return e, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) primary() (expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenName:
+		switch t.value {
+		case "true", "True":
+			return &literal{true}, nil
+		case "false", "False":
+			return &literal{false}, nil
+		case "none", "None":
+			return &literal{nil}, nil
+		}
+		p.vars[t.value] = struct{}{}
+		return &nameExpr{t.value}, nil
+	case tokenString:
+		s := t.value
+		// adjacent strings are concatenated
+		for p.is(tokenString) {
+			s += p.next().value
+		}
+		return &literal{s}, nil
+	case tokenInt:
+		n, err := strconv.Atoi(t.value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid integer %s", t.line, t.value)
+		}
+		return &literal{n}, nil
+	case tokenFloat:
+		f, err := strconv.ParseFloat(t.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid number %s", t.line, t.value)
+		}
+		return &literal{f}, nil
+	case tokenOperator:
+		switch t.value {
+		case "(":
+			if p.accept(tokenOperator, ")") {
+				return &listExpr{}, nil
+			}
+
+			e, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+
+			if p.accept(tokenOperator, ")") {
+				return e, nil
+			}
+
+			items := []expr{e}
+			for p.accept(tokenOperator, ",") && !p.is(tokenOperator, ")") {
+				e, err := p.expression()
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, e)
+			}
+
+			if _, err := p.expect(tokenOperator, ")"); err != nil {
+				return nil, err
+			}
+			return &listExpr{items}, nil
+		case "[":
+			var items []expr
+			for !p.accept(tokenOperator, "]") {
+				e, err := p.expression()
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, e)
+
+				if !p.accept(tokenOperator, ",") {
+					if _, err := p.expect(tokenOperator, "]"); err != nil {
+						return nil, err
+					}
+					break
+				}
+			}
+			return &listExpr{items}, nil
+		case "{":
+			var d dictExpr
+			for !p.accept(tokenOperator, "}") {
+				key, err := p.expression()
+				if err != nil {
+					return nil, err
+				}
+				if _, err := p.expect(tokenOperator, ":"); err != nil {
+					return nil, err
+				}
+				value, err := p.expression()
+				if err != nil {
+					return nil, err
+				}
+				d.keys = append(d.keys, key)
+				d.values = append(d.values, value)
+
+				if !p.accept(tokenOperator, ",") {
+					if _, err := p.expect(tokenOperator, "}"); err != nil {
+						return nil, err
+					}
+					break
+				}
+			}
+			return &d, nil
+		}
+	}
+
+	return nil, fmt.Errorf("line %d: unexpected %s", t.line, describe(t))
+}
+
+func (p *parser) postfix(e expr) (expr, error) {
+	for {
+		switch {
+		case p.accept(tokenOperator, "."):
+			t := p.next()
+			switch t.kind {
+			case tokenName:
+				e = &attrExpr{e, t.value}
+			case tokenInt:
+				n, _ := strconv.Atoi(t.value)
+				e = &itemExpr{e, &literal{n}}
+			default:
+				return nil, fmt.Errorf("line %d: expected an attribute, got %s", t.line, describe(t))
+			}
+		case p.accept(tokenOperator, "["):
+			var err error
+			if e, err = p.subscript(e); err != nil {
+				return nil, err
+			}
+		case p.accept(tokenOperator, "("):
+			a, err := p.args()
+			if err != nil {
+				return nil, err
+			}
+			e = &callExpr{e, a}
+		default:
+			return e, nil
+		}
+	}
+}
+
+func (p *parser) subscript(obj expr) (expr, error) {
+	var parts [3]expr
+	var i int
+	for {
+		if !p.is(tokenOperator, ":", "]") {
+			e, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			parts[i] = e
+		}
+
+		if p.accept(tokenOperator, "]") {
+			break
+		}
+
+		if _, err := p.expect(tokenOperator, ":"); err != nil {
+			return nil, err
+		}
+
+		if i++; i > 2 {
+			return nil, p.errorf("invalid slice")
+		}
+	}
+
+	if i == 0 {
+		if parts[0] == nil {
+			return nil, p.errorf("expected an index")
+		}
+		return &itemExpr{obj, parts[0]}, nil
+	}
+	return &sliceExpr{obj, parts[0], parts[1], parts[2]}, nil
+}
+
+// args parses the arguments of a call after its opening parenthesis.
+func (p *parser) args() (args, error) {
+	var a args
+	for !p.accept(tokenOperator, ")") {
+		if p.is(tokenName) && p.tokens[p.pos+1].kind == tokenOperator && p.tokens[p.pos+1].value == "=" {
+			name := p.next().value
+			p.next()
+
+			value, err := p.expression()
+			if err != nil {
+				return a, err
+			}
+			a.keywords = append(a.keywords, name)
+			a.values = append(a.values, value)
+		} else {
+			if len(a.keywords) > 0 {
+				return a, p.errorf("positional argument follows keyword argument")
+			}
+
+			value, err := p.expression()
+			if err != nil {
+				return a, err
+			}
+			a.positional = append(a.positional, value)
+		}
+
+		if !p.accept(tokenOperator, ",") {
+			if _, err := p.expect(tokenOperator, ")"); err != nil {
+				return a, err
+			}
+			break
+		}
+	}
+	return a, nil
+}
+
+// filter parses a filter applied to obj, after its "|" if obj isn't nil.
+func (p *parser) filter(obj expr) (*filterExpr, error) {
+	if obj != nil {
+		p.next()
+	}
+
+	name, err := p.expect(tokenName)
+	if err != nil {
+		return nil, err
+	}
+
+	f := filterExpr{obj: obj, name: name.value}
+	if p.accept(tokenOperator, "(") {
+		if f.args, err = p.args(); err != nil {
+			return nil, err
+		}
+	}
+	return &f, nil
+}
+
+// keywords can't be the argument of a test without parentheses.
+var keywords = []string{"and", "or", "not", "if", "else", "in", "is"}
+
+func (p *parser) test(obj expr) (expr, error) {
+	t := testExpr{obj: obj, negate: p.accept(tokenName, "not")}
+
+	name, err := p.expect(tokenName)
+	if err != nil {
+		return nil, err
+	}
+	t.name = name.value
+
+	switch {
+	case p.accept(tokenOperator, "("):
+		if t.args, err = p.args(); err != nil {
+			return nil, err
+		}
+	case p.is(tokenString) || p.is(tokenInt) || p.is(tokenFloat) || p.is(tokenName) && !slices.Contains(keywords, p.peek().value):
+		// tests such as divisibleby 3 take one argument without parentheses
+		arg, err := p.primary()
+		if err != nil {
+			return nil, err
+		}
+		if arg, err = p.postfix(arg); err != nil {
+			return nil, err
+		}
+		t.args.positional = []expr{arg}
+	}
+	return &t, nil
+}
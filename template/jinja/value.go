@@ -0,0 +1,543 @@
+package jinja
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Values in templates are nil for none, bool, int, float64, string, []any
+// for lists and tuples, *dict, function, *macro and undefined.
+
+// undefined is the value of variables, attributes and items that don't
+// exist. It renders as an empty string, like in Jinja.
+type undefined struct {
+	name string
+}
+
+// dict is a dictionary that keeps the order its keys were inserted in, as
+// Python does, so tools and arguments are rendered in their original order.
+type dict struct {
+	keys   []string
+	values map[string]any
+
+	// namespace is whether the dict is a namespace, whose attributes can be
+	// set in loops
+	namespace bool
+}
+
+func newDict() *dict {
+	return &dict{values: make(map[string]any)}
+}
+
+func (d *dict) get(key string) (any, bool) {
+	v, ok := d.values[key]
+	return v, ok
+}
+
+func (d *dict) set(key string, value any) {
+	if _, ok := d.values[key]; !ok {
+		d.keys = append(d.keys, key)
+	}
+	d.values[key] = value
+}
+
+// function is a callable such as a global function or a method.
+type function func(args []any, kwargs *dict) (any, error)
+
+func truthy(v any) bool {
+	switch v := v.(type) {
+	case nil, undefined:
+		return false
+	case bool:
+		return v
+	case int:
+		return v != 0
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case []any:
+		return len(v) > 0
+	case *dict:
+		return len(v.keys) > 0
+	}
+	return true
+}
+
+// str returns v as Python's str does.
+func str(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case undefined:
+		return ""
+	}
+	return repr(v)
+}
+
+// repr returns v as Python's repr does.
+func repr(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "None"
+	case undefined:
+		return ""
+	case bool:
+		if v {
+			return "True"
+		}
+		return "False"
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		return formatFloat(v)
+	case string:
+		return quote(v)
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = repr(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case *dict:
+		items := make([]string, len(v.keys))
+		for i, key := range v.keys {
+			items[i] = quote(key) + ": " + repr(v.values[key])
+		}
+		if v.namespace {
+			return "<Namespace {" + strings.Join(items, ", ") + "}>"
+		}
+		return "{" + strings.Join(items, ", ") + "}"
+	case function, *macro:
+		return "<function>"
+	}
+	return fmt.Sprint(v)
+}
+
+// formatFloat formats f as Python does.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "nan"
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-4 || abs >= 1e16) {
+		return strconv.FormatFloat(f, 'e', -1, 64)
+	}
+
+	s := strconv.FormatFloat(f, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
+
+// quote quotes s as Python's repr does, in single quotes unless s contains
+// single quotes but no double quotes.
+func quote(s string) string {
+	q := byte('\'')
+	if strings.Contains(s, "'") && !strings.Contains(s, `"`) {
+		q = '"'
+	}
+
+	var b strings.Builder
+	b.WriteByte(q)
+	for _, r := range s {
+		switch {
+		case r == rune(q) || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte(q)
+	return b.String()
+}
+
+// toJSON writes v as Python's json.dumps does without ensure_ascii, with
+// items indented by indent spaces if it isn't negative.
+func toJSON(b *strings.Builder, v any, indent, depth int) error {
+	newline := func(depth int) {
+		if indent >= 0 {
+			b.WriteByte('\n')
+			b.WriteString(strings.Repeat(" ", indent*depth))
+		}
+	}
+
+	separator := ", "
+	if indent >= 0 {
+		separator = ","
+	}
+
+	switch v := v.(type) {
+	case nil, undefined:
+		b.WriteString("null")
+	case bool:
+		b.WriteString(strconv.FormatBool(v))
+	case int:
+		b.WriteString(strconv.Itoa(v))
+	case float64:
+		switch {
+		case math.IsNaN(v):
+			b.WriteString("NaN")
+		case math.IsInf(v, 1):
+			b.WriteString("Infinity")
+		case math.IsInf(v, -1):
+			b.WriteString("-Infinity")
+		default:
+			b.WriteString(formatFloat(v))
+		}
+	case string:
+		jsonString(b, v)
+	case []any:
+		if len(v) == 0 {
+			b.WriteString("[]")
+			return nil
+		}
+
+		b.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				b.WriteString(separator)
+			}
+			newline(depth + 1)
+			if err := toJSON(b, item, indent, depth+1); err != nil {
+				return err
+			}
+		}
+		newline(depth)
+		b.WriteByte(']')
+	case *dict:
+		if len(v.keys) == 0 {
+			b.WriteString("{}")
+			return nil
+		}
+
+		b.WriteByte('{')
+		for i, key := range v.keys {
+			if i > 0 {
+				b.WriteString(separator)
+			}
+			newline(depth + 1)
+			jsonString(b, key)
+			b.WriteString(": ")
+			if err := toJSON(b, v.values[key], indent, depth+1); err != nil {
+				return err
+			}
+		}
+		newline(depth)
+		b.WriteByte('}')
+	default:
+		return fmt.Errorf("%s is not JSON serializable", typeName(v))
+	}
+	return nil
+}
+
+func jsonString(b *strings.Builder, s string) {
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(b, `\u%04x`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+}
+
+func typeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "NoneType"
+	case undefined:
+		return "Undefined"
+	case bool:
+		return "bool"
+	case int:
+		return "int"
+	case float64:
+		return "float"
+	case string:
+		return "str"
+	case []any:
+		return "list"
+	case *dict:
+		return "dict"
+	case function, *macro:
+		return "function"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func equal(a, b any) bool {
+	if x, ok := number(a); ok {
+		y, ok := number(b)
+		return ok && x == y
+	}
+
+	switch a := a.(type) {
+	case nil:
+		return b == nil
+	case undefined:
+		_, ok := b.(undefined)
+		return ok
+	case bool:
+		b, ok := b.(bool)
+		return ok && a == b
+	case string:
+		b, ok := b.(string)
+		return ok && a == b
+	case []any:
+		b, ok := b.([]any)
+		return ok && slices.EqualFunc(a, b, equal)
+	case *dict:
+		b, ok := b.(*dict)
+		if !ok || len(a.keys) != len(b.keys) {
+			return false
+		}
+		for _, key := range a.keys {
+			if v, ok := b.values[key]; !ok || !equal(a.values[key], v) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// number returns v as a float if it's an int or float.
+func number(v any) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// compare returns the order of a and b, which must both be numbers or
+// strings.
+func compare(a, b any) (int, error) {
+	if x, ok := number(a); ok {
+		if y, ok := number(b); ok {
+			switch {
+			case x < y:
+				return -1, nil
+			case x > y:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	}
+
+	if x, ok := a.(string); ok {
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), nil
+		}
+	}
+
+	return 0, fmt.Errorf("can't compare %s and %s", typeName(a), typeName(b))
+}
+
+// iterate returns the items of v, the keys of dicts and the characters of
+// strings.
+func iterate(v any) ([]any, error) {
+	switch v := v.(type) {
+	case undefined:
+		return nil, nil
+	case []any:
+		return v, nil
+	case *dict:
+		keys := make([]any, len(v.keys))
+		for i, key := range v.keys {
+			keys[i] = key
+		}
+		return keys, nil
+	case string:
+		chars := make([]any, 0, utf8.RuneCountInString(v))
+		for _, r := range v {
+			chars = append(chars, string(r))
+		}
+		return chars, nil
+	}
+	return nil, fmt.Errorf("%s is not iterable", typeName(v))
+}
+
+func length(v any) (int, error) {
+	switch v := v.(type) {
+	case undefined:
+		return 0, nil
+	case string:
+		return utf8.RuneCountInString(v), nil
+	case []any:
+		return len(v), nil
+	case *dict:
+		return len(v.keys), nil
+	}
+	return 0, fmt.Errorf("%s has no length", typeName(v))
+}
+
+// fromGo converts the Go value v to a template value. Values other than
+// basic types, slices and maps are converted through JSON, so structs keep
+// the order of their fields.
+func fromGo(v any) (any, error) {
+	switch v := v.(type) {
+	case nil, bool, int, float64, string, *dict, function, undefined:
+		return v, nil
+	case int32:
+		return int(v), nil
+	case int64:
+		return int(v), nil
+	case uint32:
+		return int(v), nil
+	case float32:
+		return float64(v), nil
+	case []string:
+		items := make([]any, len(v))
+		for i, s := range v {
+			items[i] = s
+		}
+		return items, nil
+	case []any:
+		items := make([]any, len(v))
+		for i, item := range v {
+			var err error
+			if items[i], err = fromGo(item); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+
+		d := newDict()
+		for _, key := range keys {
+			value, err := fromGo(v[key])
+			if err != nil {
+				return nil, err
+			}
+			d.set(key, value)
+		}
+		return d, nil
+	case json.RawMessage:
+		return fromJSON(v)
+	}
+
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Pointer && rv.IsNil() {
+		return nil, nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return fromJSON(b)
+}
+
+// fromJSON decodes JSON keeping the order of the keys of objects.
+func fromJSON(b []byte) (any, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	var decode func() (any, error)
+	decode = func() (any, error) {
+		t, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := t.(type) {
+		case json.Delim:
+			switch t {
+			case '[':
+				items := []any{}
+				for d.More() {
+					item, err := decode()
+					if err != nil {
+						return nil, err
+					}
+					items = append(items, item)
+				}
+				_, err := d.Token()
+				return items, err
+			case '{':
+				obj := newDict()
+				for d.More() {
+					key, err := d.Token()
+					if err != nil {
+						return nil, err
+					}
+
+					value, err := decode()
+					if err != nil {
+						return nil, err
+					}
+					obj.set(key.(string), value)
+				}
+				_, err := d.Token()
+				return obj, err
+			}
+		case json.Number:
+			if n, err := t.Int64(); err == nil && !strings.ContainsAny(t.String(), ".eE") {
+				return int(n), nil
+			}
+			return t.Float64()
+		default:
+			return t, nil
+		}
+		return nil, errors.New("invalid JSON")
+	}
+
+	v, err := decode()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, errors.New("invalid JSON")
+	}
+	return v, nil
+}
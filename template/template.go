@@ -17,6 +17,7 @@ import (
 	"golang.org/x/exp/maps"
 
 	"github.com/goobla/goobla/api"
+	"github.com/goobla/goobla/template/jinja"
 )
 
 //go:embed index.json
@@ -95,6 +96,10 @@ var DefaultTemplate, _ = Parse("{{ .Prompt }}")
 type Template struct {
 	*template.Template
 	raw string
+
+	// jinja is the template if it's a Jinja chat template, such as the
+	// chat templates embedded in GGUF files. Template is then empty.
+	jinja *jinja.Template
 }
 
 // response is a template node that can be added to templates that don't already have one
@@ -127,6 +132,16 @@ func Parse(s string) (*Template, error) {
 	tmpl := template.New("").Option("missingkey=zero").Funcs(funcs)
 
 	tmpl, err := tmpl.Parse(s)
+	if strings.Contains(s, "{%") {
+		// Jinja templates rarely parse as Go templates, and when they do
+		// their statements are left as text
+		if j, jerr := jinja.Parse(s); jerr == nil {
+			return &Template{Template: template.Must(template.New("").Parse("")), raw: s, jinja: j}, nil
+		} else if err != nil {
+			return nil, jerr
+		}
+	}
+
 	if err != nil {
 		return nil, err
 	}
@@ -145,6 +160,10 @@ func (t *Template) String() string {
 }
 
 func (t *Template) Vars() []string {
+	if t.jinja != nil {
+		return t.jinja.Vars()
+	}
+
 	var vars []string
 	for _, tt := range t.Templates() {
 		for _, n := range tt.Root.Nodes {
@@ -223,6 +242,10 @@ func (t *Template) Subtree(fn func(parse.Node) bool) *template.Template {
 }
 
 func (t *Template) Execute(w io.Writer, v Values) error {
+	if t.jinja != nil {
+		return t.executeJinja(w, v)
+	}
+
 	system, messages := collate(v.Messages)
 	if v.Prompt != "" && v.Suffix != "" {
 		return t.Template.Execute(w, map[string]any{
@@ -309,6 +332,66 @@ func (t *Template) Execute(w io.Writer, v Values) error {
 	return err
 }
 
+// executeJinja executes a Jinja chat template with the variables that
+// chat templates of Hugging Face models are rendered with.
+func (t *Template) executeJinja(w io.Writer, v Values) error {
+	return t.jinja.Execute(w, jinjaVars(v))
+}
+
+// jinjaVars returns the variables Jinja templates are rendered with, named
+// as they are by Hugging Face.
+func jinjaVars(v Values) map[string]any {
+	msgs := v.Messages
+	if len(msgs) == 0 && v.Prompt != "" {
+		msgs = []api.Message{{Role: "user", Content: v.Prompt}}
+	}
+
+	messages := make([]any, len(msgs))
+	for i, m := range msgs {
+		message := map[string]any{"role": m.Role, "content": m.Content}
+		if m.Thinking != "" {
+			message["reasoning_content"] = m.Thinking
+		}
+
+		if len(m.ToolCalls) > 0 {
+			calls := make([]any, len(m.ToolCalls))
+			for i, call := range m.ToolCalls {
+				calls[i] = map[string]any{
+					"type": "function",
+					"function": map[string]any{
+						"name":      call.Function.Name,
+						"arguments": map[string]any(call.Function.Arguments),
+					},
+				}
+			}
+			message["tool_calls"] = calls
+		}
+
+		messages[i] = message
+	}
+
+	vars := map[string]any{
+		"messages": messages,
+		// templates are parsed without the model's vocabulary, and the BOS
+		// token is added when the prompt is tokenized if the model adds it
+		"bos_token": "",
+		"eos_token": "",
+		// a response is generated unless the last message is a response
+		// to continue
+		"add_generation_prompt": len(msgs) == 0 || msgs[len(msgs)-1].Role != "assistant",
+	}
+
+	if len(v.Tools) > 0 {
+		vars["tools"] = v.Tools
+	}
+
+	if v.IsThinkSet {
+		vars["enable_thinking"] = v.Think
+	}
+
+	return vars
+}
+
 // collate messages based on role. consecutive messages of the same role are merged
 // into a single message. collate also collects and returns all system messages.
 // collate mutates message content adding image tags ([img-%d]) as needed
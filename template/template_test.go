@@ -376,3 +376,166 @@ func TestExecuteWithSuffix(t *testing.T) {
 		})
 	}
 }
+
+func TestJinja(t *testing.T) {
+	t.Run("named", func(t *testing.T) {
+		// the chat templates of the models the named templates were written
+		// for are rendered as they are
+		f, err := os.Open(filepath.Join("testdata", "templates.jsonl"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var ss map[string]string
+			if err := json.Unmarshal(scanner.Bytes(), &ss); err != nil {
+				t.Fatal(err)
+			}
+
+			for k, v := range ss {
+				tmpl, err := Parse(v)
+				if err != nil {
+					t.Fatalf("%s: %v", k, err)
+				}
+				if tmpl.jinja == nil {
+					t.Fatalf("%s: expected a Jinja template", k)
+				}
+
+				var b bytes.Buffer
+				if err := tmpl.Execute(&b, Values{Messages: []api.Message{{Role: "user", Content: "Hello, how are you?"}}}); err != nil {
+					t.Fatalf("%s: %v", k, err)
+				}
+				if !strings.Contains(b.String(), "Hello, how are you?") {
+					t.Errorf("%s: expected the message in %q", k, b.String())
+				}
+			}
+		}
+	})
+
+	t.Run("tools", func(t *testing.T) {
+		bts, err := os.ReadFile(filepath.Join("testdata", "qwen2.5.jinja"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tmpl, err := Parse(string(bts))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Contains(tmpl.Vars(), "tools") {
+			t.Errorf("expected tools in %v", tmpl.Vars())
+		}
+
+		var tool api.Tool
+		if err := json.Unmarshal([]byte(`{"type": "function", "function": {"name": "get_weather", "description": "Get the weather", "parameters": {"type": "object", "required": ["city"], "properties": {"city": {"type": "string", "description": "The city"}}}}}`), &tool); err != nil {
+			t.Fatal(err)
+		}
+
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, Values{
+			Messages: []api.Message{
+				{Role: "system", Content: "You are helpful."},
+				{Role: "user", Content: "What's the weather in Paris?"},
+				{Role: "assistant", ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"city": "Paris"}}}}},
+				{Role: "tool", Content: "22°C"},
+			},
+			Tools: api.Tools{tool},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		expect := "<|im_start|>system\nYou are helpful.\n\n# Tools\n\nYou may call one or more functions to assist with the user query.\n\nYou are provided with function signatures within <tools></tools> XML tags:\n<tools>\n" +
+			`{"type": "function", "function": {"name": "get_weather", "description": "Get the weather", "parameters": {"type": "object", "required": ["city"], "properties": {"city": {"type": "string", "description": "The city"}}}}}` +
+			"\n</tools>\n\nFor each function call, return a json object with function name and arguments within <tool_call></tool_call> XML tags:\n<tool_call>\n{\"name\": <function-name>, \"arguments\": <args-json-object>}\n</tool_call><|im_end|>\n" +
+			"<|im_start|>user\nWhat's the weather in Paris?<|im_end|>\n" +
+			"<|im_start|>assistant\n<tool_call>\n{\"name\": \"get_weather\", \"arguments\": {\"city\": \"Paris\"}}\n</tool_call><|im_end|>\n" +
+			"<|im_start|>user\n<tool_response>\n22°C\n</tool_response><|im_end|>\n" +
+			"<|im_start|>assistant\n"
+		if diff := cmp.Diff(b.String(), expect); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("go", func(t *testing.T) {
+		// templates with Jinja-like text that parse as Go templates stay Go
+		// templates
+		tmpl, err := Parse("{{ .Prompt }} {% not a tag")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tmpl.jinja != nil {
+			t.Error("expected a Go template")
+		}
+
+		if _, err := Parse("{% if messages %}{{ end }}"); err == nil {
+			t.Error("expected an error for an invalid template")
+		}
+	})
+}
+
+func TestCheck(t *testing.T) {
+	cases := []struct {
+		name     string
+		template string
+		want     []Problem
+	}{
+		{
+			name:     "chatml",
+			template: "{{- range .Messages }}<|im_start|>{{ .Role }}\n{{ .Content }}<|im_end|>\n{{ end }}<|im_start|>assistant\n",
+		},
+		{
+			name:     "default",
+			template: "{{ .Prompt }}",
+			want:     []Problem{{Fixture: "system and user", Message: "the system message is missing from the prompt", Warning: true}},
+		},
+		{
+			name:     "undefined field",
+			template: "{{ .Sytem }} {{ .Prompt }}",
+			want: []Problem{
+				{Message: `undefined variable "Sytem"`},
+				{Fixture: "system and user", Message: "the system message is missing from the prompt", Warning: true},
+			},
+		},
+		{
+			name:     "dropped role",
+			template: `{{ range .Messages }}{{ if ne .Role "assistant" }}{{ .Content }}{{ end }}{{ end }}`,
+			want:     []Problem{{Fixture: "multi-turn", Message: "the assistant message is missing from the prompt"}},
+		},
+		{
+			name:     "jinja",
+			template: "{% for message in messages %}<|{{ message.role }}|>{{ message.content }}{% endfor %}{% if tools is defined %}{{ tools | tojson }}{% endif %}",
+			want: []Problem{
+				{Fixture: "tools", Message: "the tool call is missing from the prompt"},
+			},
+		},
+		{
+			name:     "jinja undefined",
+			template: "{{ system_prompt }}{% for message in messages %}{{ message.content }}{% endfor %}",
+			want: []Problem{
+				{Fixture: "system and user", Message: `undefined variable "system_prompt"`},
+				{Fixture: "multi-turn", Message: `undefined variable "system_prompt"`},
+				{Fixture: "images", Message: `undefined variable "system_prompt"`},
+			},
+		},
+		{
+			name:     "jinja exception",
+			template: "{% for message in messages %}{% if message.role == 'system' %}{{ raise_exception('System role not supported') }}{% endif %}{{ message.content }}{% endfor %}",
+			want:     []Problem{{Fixture: "system and user", Message: "the template rejects the conversation: System role not supported", Warning: true}},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tmpl.Check(), tt.want); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
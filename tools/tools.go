@@ -24,6 +24,23 @@ type Parser struct {
 	state  toolsState
 	buffer []byte
 	n      int
+
+	partial partial
+	deltas  []api.ToolCallDelta
+}
+
+// partial is the progress of streaming the tool call at the start of the
+// buffer as it's generated.
+type partial struct {
+	tool    *api.Tool
+	nameEnd int
+
+	// start is where the arguments object starts in the buffer once it's
+	// found, pos how much of it has been streamed and end where it ends
+	start, pos, end int
+
+	depth             int
+	inString, escaped bool
 }
 
 // NewParser creates a new tool call parser from a model's chat
@@ -76,11 +93,13 @@ func (p *Parser) Add(s string) (calls []api.ToolCall, content string) {
 	}
 
 	for {
+		p.stream()
 		call := p.parseToolCall()
 		if call == nil {
 			break
 		}
 
+		p.finish(*call)
 		calls = append(calls, *call)
 	}
 
@@ -93,6 +112,162 @@ func (p *Parser) Add(s string) (calls []api.ToolCall, content string) {
 	return calls, content
 }
 
+// Deltas returns the parts of tool calls generated since it was last
+// called, so they can be streamed before the calls are complete. The
+// first delta of a call has its name, and the arguments of its deltas
+// joined together are the call's arguments as JSON.
+func (p *Parser) Deltas() []api.ToolCallDelta {
+	deltas := p.deltas
+	p.deltas = nil
+	return deltas
+}
+
+// stream adds deltas for the part of the tool call at the start of the
+// buffer generated since the last call: its name once it's complete, then
+// its arguments as they're generated.
+func (p *Parser) stream() {
+	c := &p.partial
+	if c.tool == nil {
+		c.tool, c.nameEnd = p.findName()
+		if c.tool == nil {
+			return
+		}
+
+		p.deltas = append(p.deltas, api.ToolCallDelta{Index: p.n, Name: c.tool.Function.Name})
+	}
+
+	// the arguments of tools without parameters are added once the call
+	// is complete
+	if len(c.tool.Function.Parameters.Properties) == 0 || c.end > 0 {
+		return
+	}
+
+	if c.start == 0 {
+		i := argumentsStart(p.buffer[c.nameEnd:])
+		if i == -1 {
+			return
+		}
+
+		c.start = c.nameEnd + i
+		c.pos = c.start
+	}
+
+	from := c.pos
+	for ; c.pos < len(p.buffer) && c.end == 0; c.pos++ {
+		switch b := p.buffer[c.pos]; {
+		case c.escaped:
+			c.escaped = false
+		case c.inString && b == '\\':
+			c.escaped = true
+		case b == '"':
+			c.inString = !c.inString
+		case c.inString:
+		case b == '{':
+			c.depth++
+		case b == '}':
+			c.depth--
+			if c.depth == 0 {
+				c.end = c.pos + 1
+			}
+		}
+	}
+
+	if c.pos > from {
+		p.deltas = append(p.deltas, api.ToolCallDelta{Index: p.n, Arguments: string(p.buffer[from:c.pos])})
+	}
+}
+
+// finish adds the deltas needed to complete call, the tool call parsed
+// from the start of the buffer, and starts streaming the next one.
+func (p *Parser) finish(call api.ToolCall) {
+	c := p.partial
+	p.partial = partial{}
+
+	delta := api.ToolCallDelta{Index: call.Function.Index}
+	if c.tool == nil {
+		delta.Name = call.Function.Name
+	}
+
+	// arguments that couldn't be streamed are sent whole
+	if c.start == 0 {
+		delta.Arguments = call.Function.Arguments.String()
+	}
+
+	if delta.Name != "" || delta.Arguments != "" {
+		p.deltas = append(p.deltas, delta)
+	}
+}
+
+// findName returns the tool that the call at the start of the buffer is
+// for once its name has been generated, and where the name ends.
+func (p *Parser) findName() (*api.Tool, int) {
+	if p.tag == "{" {
+		rest, ok := afterKey(p.buffer, "name")
+		if !ok || len(rest) == 0 || rest[0] != '"' {
+			return nil, 0
+		}
+
+		name, _, ok := bytes.Cut(rest[1:], []byte{'"'})
+		if !ok {
+			return nil, 0
+		}
+
+		for i := range p.tools {
+			if p.tools[i].Function.Name == string(name) {
+				return &p.tools[i], len(p.buffer) - len(rest) + len(name) + 2
+			}
+		}
+
+		return nil, 0
+	}
+
+	// as in parseToolCall, the tool is the one whose name ends first
+	var tool *api.Tool
+	end := len(p.buffer)
+	for i := range p.tools {
+		n := p.tools[i].Function.Name
+		if j := bytes.Index(p.buffer, []byte(n)); j != -1 && j+len(n) < end {
+			tool = &p.tools[i]
+			end = j + len(n)
+		}
+	}
+
+	return tool, end
+}
+
+// argumentsStart returns the index of the object that is the value of the
+// first "arguments" or "parameters" key in buf, or -1 if there isn't one
+// yet.
+func argumentsStart(buf []byte) int {
+	for _, key := range []string{"arguments", "parameters"} {
+		if rest, ok := afterKey(buf, key); ok {
+			if len(rest) == 0 || rest[0] != '{' {
+				return -1
+			}
+
+			return len(buf) - len(rest)
+		}
+	}
+
+	return -1
+}
+
+// afterKey returns what follows the first JSON object key named key in buf
+// and its colon, and whether they were found.
+func afterKey(buf []byte, key string) ([]byte, bool) {
+	i := bytes.Index(buf, []byte(`"`+key+`"`))
+	if i == -1 {
+		return nil, false
+	}
+
+	rest := bytes.TrimLeft(buf[i+len(key)+2:], " \t\r\n")
+	if len(rest) == 0 || rest[0] != ':' {
+		return nil, false
+	}
+
+	return bytes.TrimLeft(rest[1:], " \t\r\n"), true
+}
+
 // findTag searches the buffer to find and handle a tool calling tag
 // returning true if the tag was found and false otherwise, and
 // a string content signaling any content that should be sent back to the user
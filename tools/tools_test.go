@@ -1,11 +1,13 @@
 package tools
 
 import (
+	"encoding/json"
 	"testing"
 	"text/template"
 
 	"github.com/goobla/goobla/api"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
 func TestParser(t *testing.T) {
@@ -585,10 +587,12 @@ func TestParser(t *testing.T) {
 			parser := NewParser(tt.tmpl, tools)
 
 			var calls []api.ToolCall
+			var deltas []api.ToolCallDelta
 			var content string
 			for _, input := range tt.inputs {
 				tcs, c := parser.Add(input)
 				calls = append(calls, tcs...)
+				deltas = append(deltas, parser.Deltas()...)
 				content += c
 			}
 
@@ -605,10 +609,95 @@ func TestParser(t *testing.T) {
 					t.Errorf("Tool call %d mismatch (-got +want):\n%s", i, diff)
 				}
 			}
+
+			// the deltas add up to the calls, though calls that aren't
+			// completed may have been started
+			if diff := cmp.Diff(joinDeltas(t, deltas, len(calls)), tt.calls, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("Tool call deltas mismatch (-got +want):\n%s", diff)
+			}
 		})
 	}
 }
 
+// joinDeltas returns the first n tool calls that deltas add up to.
+func joinDeltas(t *testing.T, deltas []api.ToolCallDelta, n int) []api.ToolCall {
+	t.Helper()
+
+	var names []string
+	var args []string
+	for _, d := range deltas {
+		if d.Index >= n {
+			continue
+		}
+
+		if d.Index == len(names) {
+			if d.Name == "" {
+				t.Fatalf("first delta of tool call %d has no name", d.Index)
+			}
+			names = append(names, d.Name)
+			args = append(args, "")
+		} else if d.Name != "" {
+			t.Fatalf("tool call %d named again", d.Index)
+		}
+		args[d.Index] += d.Arguments
+	}
+
+	var calls []api.ToolCall
+	for i := range names {
+		call := api.ToolCall{Function: api.ToolCallFunction{Index: i, Name: names[i]}}
+		if err := json.Unmarshal([]byte(args[i]), &call.Function.Arguments); err != nil {
+			t.Fatalf("tool call %d arguments %q: %v", i, args[i], err)
+		}
+		calls = append(calls, call)
+	}
+
+	return calls
+}
+
+func TestDeltas(t *testing.T) {
+	qwen, err := template.New("qwen").Parse(`{{if .ToolCalls}}<tool_call>{{range .ToolCalls}}{"name": "{{.Function.Name}}", "arguments": {{.Function.Arguments}}}{{end}}</tool_call>{{end}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tool api.Tool
+	if err := json.Unmarshal([]byte(`{"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object", "properties": {"city": {"type": "string"}}}}}`), &tool); err != nil {
+		t.Fatal(err)
+	}
+
+	output := `<tool_call>{"name": "get_weather", "arguments": {"city": "Paris \"}{\""}}</tool_call>` +
+		`<tool_call>{"name": "get_weather", "arguments": {"city": "Tokyo"}}</tool_call>`
+
+	// generated a byte at a time, the name is streamed once it's complete
+	// and the arguments as they're generated
+	parser := NewParser(qwen, []api.Tool{tool})
+	var deltas []api.ToolCallDelta
+	var calls []api.ToolCall
+	for i := range len(output) {
+		tcs, _ := parser.Add(output[i : i+1])
+		calls = append(calls, tcs...)
+
+		ds := parser.Deltas()
+		if len(ds) > 1 {
+			t.Fatalf("expected a delta at a time, got %v", ds)
+		}
+		deltas = append(deltas, ds...)
+	}
+
+	if len(calls) != 2 {
+		t.Fatalf("expected 2 tool calls, got %d", len(calls))
+	}
+
+	if diff := cmp.Diff(joinDeltas(t, deltas, len(calls)), calls); diff != "" {
+		t.Errorf("Tool call deltas mismatch (-got +want):\n%s", diff)
+	}
+
+	// 1 delta for each call's name and each byte of its arguments
+	if want := 2 + len(`{"city": "Paris \"}{\""}`) + len(`{"city": "Tokyo"}`); len(deltas) != want {
+		t.Errorf("expected %d deltas, got %d", want, len(deltas))
+	}
+}
+
 func TestDone(t *testing.T) {
 	tests := []struct {
 		name   string
@@ -9,6 +9,8 @@ const (
 	CapabilityVision     = Capability("vision")
 	CapabilityEmbedding  = Capability("embedding")
 	CapabilityThinking   = Capability("thinking")
+	CapabilityRerank     = Capability("rerank")
+	CapabilityAudio      = Capability("audio")
 )
 
 func (c Capability) String() string {
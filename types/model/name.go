@@ -126,6 +126,11 @@ type Name struct {
 //	      pattern: { alphanum | "_" } { alphanum | "-" | ":" }*
 //	      length:  [1, 80]
 //
+// A digest of the form "sha256:" followed by 64 hex characters pins the name
+// to an immutable manifest. It is stored in the tag part as "sha256-<hex>" and
+// takes precedence over any tag given alongside it. Any other digest makes the
+// name invalid.
+//
 // Most users should use [ParseName] instead, unless need to support
 // different defaults than DefaultName.
 //
@@ -142,11 +147,17 @@ func ParseNameBare(s string) Name {
 	var n Name
 	var promised bool
 
+	s, digest, pinned := strings.Cut(s, "@")
+
 	// "/" is an illegal tag character, so we can use it to split the host
 	if strings.LastIndex(s, ":") > strings.LastIndex(s, "/") {
 		s, n.Tag, _ = cutPromised(s, ":")
 	}
 
+	if pinned {
+		n.Tag = digestTag(digest)
+	}
+
 	s, n.Model, promised = cutPromised(s, "/")
 	if !promised {
 		n.Model = s
@@ -235,11 +246,48 @@ func (n Name) DisplayShortest() string {
 
 	// always include model and tag
 	sb.WriteString(n.Model)
-	sb.WriteString(":")
-	sb.WriteString(n.Tag)
+	if d := n.Digest(); d != "" {
+		sb.WriteString("@")
+		sb.WriteString(d)
+	} else {
+		sb.WriteString(":")
+		sb.WriteString(n.Tag)
+	}
 	return sb.String()
 }
 
+// Digest returns the manifest digest, in the form "sha256:<hex>", that n is
+// pinned to, or the empty string if n refers to a tag.
+func (n Name) Digest() string {
+	hex, ok := strings.CutPrefix(n.Tag, "sha256-")
+	if !ok || !isValidDigestHex(hex) {
+		return ""
+	}
+	return "sha256:" + hex
+}
+
+// digestTag returns the tag part used to store a name pinned to digest d, or
+// MissingPart if d is not a valid sha256 digest.
+func digestTag(d string) string {
+	hex, ok := strings.CutPrefix(d, "sha256:")
+	if !ok || !isValidDigestHex(hex) {
+		return MissingPart
+	}
+	return "sha256-" + hex
+}
+
+func isValidDigestHex(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	for i := range s {
+		if !(s[i] >= '0' && s[i] <= '9' || s[i] >= 'a' && s[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
 // IsValidNamespace reports whether the provided string is a valid
 // namespace.
 func IsValidNamespace(s string) bool {
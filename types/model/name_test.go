@@ -4,6 +4,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -189,6 +190,42 @@ var testCases = map[string]bool{ // name -> valid
 	"host/name:space/model:tag": false,
 }
 
+func TestParseNameDigest(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("0a", 32)
+
+	cases := map[string]string{
+		"model@" + digest:                  "sha256-" + strings.Repeat("0a", 32),
+		"h/n/model:tag@" + digest:          "sha256-" + strings.Repeat("0a", 32),
+		"model@sha256:abc":                 MissingPart,
+		"model@md5:" + digest[7:]:          MissingPart,
+		"model@" + strings.ToUpper(digest): MissingPart,
+	}
+
+	for s, want := range cases {
+		t.Run(s, func(t *testing.T) {
+			n := ParseName(s)
+			if n.Tag != want {
+				t.Errorf("ParseName(%q).Tag = %q; want %q", s, n.Tag, want)
+			}
+
+			if want == MissingPart {
+				if n.IsValid() {
+					t.Errorf("ParseName(%q).IsValid() = true; want false", s)
+				}
+				return
+			}
+
+			if got := n.Digest(); got != digest {
+				t.Errorf("ParseName(%q).Digest() = %q; want %q", s, got, digest)
+			}
+		})
+	}
+
+	if got := ParseName("model:tag").Digest(); got != "" {
+		t.Errorf("ParseName(%q).Digest() = %q; want empty", "model:tag", got)
+	}
+}
+
 func TestNameparseNameDefault(t *testing.T) {
 	const name = "xx"
 	n := ParseName(name)
@@ -290,11 +327,12 @@ func TestParseNameFromFilepath(t *testing.T) {
 
 func TestDisplayShortest(t *testing.T) {
 	cases := map[string]string{
-		"registry.goobla.ai/library/model:latest": "model:latest",
-		"registry.goobla.ai/library/model:tag":    "model:tag",
-		"registry.goobla.ai/namespace/model:tag":  "namespace/model:tag",
-		"host/namespace/model:tag":                "host/namespace/model:tag",
-		"host/library/model:tag":                  "host/library/model:tag",
+		"registry.goobla.ai/library/model:latest":                            "model:latest",
+		"registry.goobla.ai/library/model:tag":                               "model:tag",
+		"registry.goobla.ai/namespace/model:tag":                             "namespace/model:tag",
+		"host/namespace/model:tag":                                           "host/namespace/model:tag",
+		"host/library/model:tag":                                             "host/library/model:tag",
+		"registry.goobla.ai/library/model@sha256:" + strings.Repeat("a", 64): "model@sha256:" + strings.Repeat("a", 64),
 	}
 
 	for in, want := range cases {